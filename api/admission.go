@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/promql/parser"
+	"harry671003/hello/cardinality"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EstimateHeader carries the estimated number of series a query reads.
+	EstimateHeader = "X-Cardinality-Estimate"
+	// LimitExceededHeader is set on requests that exceeded the limit but
+	// were let through because the middleware only annotates.
+	LimitExceededHeader = "X-Cardinality-Limit-Exceeded"
+)
+
+// AdmissionConfig configures the query admission middleware.
+type AdmissionConfig struct {
+	// MaxSeries is the largest number of series a query may select.
+	// Zero disables the limit, in which case requests are only annotated
+	// with the estimate.
+	MaxSeries int64
+	// AnnotateOnly lets requests exceeding MaxSeries through, marking
+	// them with LimitExceededHeader instead of rejecting them.
+	AnnotateOnly bool
+	// Logger logs rejected queries at info level, and estimates at debug
+	// level. Nothing is logged if it is nil.
+	Logger *slog.Logger
+}
+
+// NewAdmissionMiddleware returns a middleware for Prometheus-compatible
+// query frontends. It estimates the number of series selected by requests to
+// /api/v1/query and /api/v1/query_range as the sum over all selectors in the
+// query, sets EstimateHeader on the response, and rejects requests exceeding
+// the configured limit with HTTP 422. Other requests and queries that fail to
+// parse or estimate are passed through unchanged.
+func NewAdmissionMiddleware(index cardinality.CardinalityIndex, cfg AdmissionConfig) func(http.Handler) http.Handler {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	return func(next http.Handler) http.Handler {
+		return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/api/v1/query") && !strings.HasSuffix(r.URL.Path, "/api/v1/query_range") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			query, err := queryParam(w, r)
+			if err != nil {
+				writeQueryParamError(w, err)
+				return
+			}
+			expr, err := parser.ParseExpr(query)
+			if err != nil {
+				logger.Debug("Passing through query that failed to parse", "query", query, "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var estimate int64
+			for _, matchers := range parser.ExtractSelectors(expr) {
+				// The parser built the matchers, normalizing them can only
+				// strip anchors. The matchers are kept as parsed if it
+				// fails.
+				if normalized, err := matcherCache.NormalizeMatchers(matchers); err == nil {
+					matchers = normalized
+				}
+				series, err := cardinality.GetCardinalityChecked(r.Context(), index, matchers...)
+				// Selectors on unknown labels select no series, other
+				// errors leave the query without an estimate.
+				if err != nil && !errors.Is(err, cardinality.ErrUnknownLabel) {
+					logger.Warn("Passing through query that failed to estimate", "query", query, "err", err)
+					next.ServeHTTP(w, r)
+					return
+				}
+				estimate += series
+			}
+			w.Header().Set(EstimateHeader, strconv.FormatInt(estimate, 10))
+			logger.Debug("Estimated query", "query", query, "series", estimate)
+
+			if cfg.MaxSeries > 0 && estimate > cfg.MaxSeries {
+				logger.Info("Query exceeds the series limit", "query", query, "series", estimate, "limit", cfg.MaxSeries, "rejected", !cfg.AnnotateOnly)
+				if !cfg.AnnotateOnly {
+					writeAPIError(w, http.StatusUnprocessableEntity, "execution",
+						fmt.Sprintf("query selects an estimated %d series, exceeding the limit of %d", estimate, cfg.MaxSeries))
+					return
+				}
+				w.Header().Set(LimitExceededHeader, "true")
+			}
+
+			next.ServeHTTP(w, r)
+		}), "admission")
+	}
+}
+
+// maxQueryFormBytes bounds the form bodies of the queries buffered by the
+// admission middleware.
+const maxQueryFormBytes = 1 << 20
+
+// queryParam returns the query parameter of r without consuming the body,
+// so that the request can still be proxied. Bodies larger than
+// maxQueryFormBytes fail with an *http.MaxBytesError.
+func queryParam(w http.ResponseWriter, r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r.URL.Query().Get("query"), nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxQueryFormBytes))
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	clone := r.Clone(r.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	if err := clone.ParseForm(); err != nil {
+		return "", err
+	}
+	return clone.Form.Get("query"), nil
+}
+
+// writeQueryParamError writes the error of queryParam, with HTTP 413 for
+// bodies over the limit.
+func writeQueryParamError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "bad_data", err.Error())
+		return
+	}
+	writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+}
+
+// writeAPIError writes an error in the format of the Prometheus HTTP API.
+func writeAPIError(w http.ResponseWriter, code int, errorType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     msg,
+	})
+}
@@ -0,0 +1,821 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+	"harry671003/hello/cardinality"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestIndex indexes 20 series of http_requests_total (10 pods x 2
+// methods) and 5 series of up (5 pods).
+func newTestIndex() *cardinality.BitmapIndex {
+	index := cardinality.NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for _, method := range []string{"GET", "POST"} {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "http_requests_total", "method", method, "pod", fmt.Sprintf("pod-%d", pod)), ref)
+		}
+		if pod < 5 {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), ref)
+		}
+	}
+	return index
+}
+
+func TestBreakdown(t *testing.T) {
+	index := newTestIndex()
+
+	metrics, err := MetricBreakdown(context.Background(), index)
+	require.NoError(t, err)
+	require.Equal(t, []MetricCardinality{
+		{Metric: "http_requests_total", Series: 20},
+		{Metric: "up", Series: 5},
+	}, metrics)
+
+	lbls, err := LabelBreakdown(context.Background(), index, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	require.NoError(t, err)
+	require.Equal(t, []LabelCardinality{
+		{Name: "pod", Values: 5, Series: 5},
+		{Name: "__name__", Values: 1, Series: 5},
+	}, lbls)
+
+	_, err = MetricBreakdown(context.Background(), cardinality.CardinalityIndex(nil))
+	require.ErrorIs(t, err, ErrBreakdownUnsupported)
+}
+
+func TestArrowHandler(t *testing.T) {
+	handler := NewArrowHandler(newTestIndex())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?by=label&selector=http_requests_total", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, ArrowStreamContentType, rec.Header().Get("Content-Type"))
+
+	reader, err := ipc.NewReader(rec.Body)
+	require.NoError(t, err)
+	defer reader.Release()
+
+	require.True(t, reader.Next())
+	record := reader.Record()
+	require.Equal(t, int64(3), record.NumRows())
+	require.Equal(t, "pod", record.Column(0).(*array.String).Value(0))
+	require.Equal(t, int64(10), record.Column(1).(*array.Int64).Value(0))
+	require.Equal(t, int64(20), record.Column(2).(*array.Int64).Value(0))
+	require.False(t, reader.Next())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?by=tenant", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestWriteArrowBatches(t *testing.T) {
+	rows := make([]MetricCardinality, 10)
+	for i := range rows {
+		rows[i] = MetricCardinality{Metric: fmt.Sprintf("metric_%d", i), Series: int64(i)}
+	}
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, WriteMetricBreakdownArrow(rec.Body, rows, 4))
+
+	reader, err := ipc.NewReader(rec.Body)
+	require.NoError(t, err)
+	defer reader.Release()
+
+	var batches []int64
+	for reader.Next() {
+		batches = append(batches, reader.Record().NumRows())
+	}
+	require.Equal(t, []int64{4, 4, 2}, batches)
+}
+
+func TestAdmissionMiddleware(t *testing.T) {
+	var proxiedBody string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		proxiedBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	})
+	index := newTestIndex()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	handler := NewAdmissionMiddleware(index, AdmissionConfig{MaxSeries: 10, Logger: logger})(next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "5", rec.Header().Get(EstimateHeader))
+
+	// Selectors are summed over the whole query.
+	form := url.Values{"query": {`sum(http_requests_total) / count(up)`}}.Encode()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	require.Equal(t, "25", rec.Header().Get(EstimateHeader))
+	require.Contains(t, rec.Body.String(), "exceeding the limit of 10")
+	require.Contains(t, logs.String(), `msg="Query exceeds the series limit" query="sum(http_requests_total) / count(up)" series=25 limit=10 rejected=true`)
+
+	// Annotate only, and the body must still reach the next handler.
+	handler = NewAdmissionMiddleware(index, AdmissionConfig{MaxSeries: 10, AnnotateOnly: true})(next)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "true", rec.Header().Get(LimitExceededHeader))
+	require.Equal(t, form, proxiedBody)
+
+	// Form bodies are bounded.
+	large := url.Values{"query": {strings.Repeat("up or ", maxQueryFormBytes/6) + "up"}}.Encode()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(large))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Other endpoints are passed through.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(EstimateHeader))
+
+	// Unknown labels select no series.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up{instnace="a"}`), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "0", rec.Header().Get(EstimateHeader))
+
+	// Queries are passed through if the index fails.
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	handler = NewAdmissionMiddleware(cardinality.NewRemoteIndex(unavailable.URL), AdmissionConfig{MaxSeries: 10})(next)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(EstimateHeader))
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	var client string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = ClientFromContext(r.Context())
+	})
+	handler := NewAuthMiddleware(AuthConfig{
+		BasicAuth:    map[string]string{"alice": "secret"},
+		BearerTokens: map[string]string{"team-a": "token-a", "team-b": "token-b"},
+	})(next)
+	serve := func(setup func(r *http.Request)) *httptest.ResponseRecorder {
+		client = ""
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+		setup(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(func(r *http.Request) { r.SetBasicAuth("alice", "secret") })
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "alice", client)
+	rec = serve(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-b") })
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "team-b", client)
+
+	for name, setup := range map[string]func(r *http.Request){
+		"missing":        func(*http.Request) {},
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("alice", "guess") },
+		"unknown user":   func(r *http.Request) { r.SetBasicAuth("bob", "secret") },
+		"wrong token":    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-c") },
+		"empty token":    func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") },
+	} {
+		rec := serve(setup)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, name)
+		require.Equal(t, `Basic realm="promql-cardinality"`, rec.Header().Get("WWW-Authenticate"), name)
+		require.Empty(t, client, name)
+	}
+
+	// Without credentials requests pass unauthenticated.
+	rec = httptest.NewRecorder()
+	NewAuthMiddleware(AuthConfig{})(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(RateLimitConfig{
+		Default: RateLimit{Rate: 1, Burst: 2},
+		Clients: map[string]RateLimit{"team-a": {Rate: 10, Burst: 10}, "admin": {}},
+	}, func() time.Time { return now })
+	handler := NewAuthMiddleware(AuthConfig{BearerTokens: map[string]string{"team-a": "a", "team-b": "b", "admin": "root"}})(
+		limiter.middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	serve := func(token string, n int) (ok int, retryAfter string) {
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code == http.StatusOK {
+				ok++
+			} else {
+				require.Equal(t, http.StatusTooManyRequests, rec.Code)
+				retryAfter = rec.Header().Get("Retry-After")
+			}
+		}
+		return ok, retryAfter
+	}
+
+	ok, retryAfter := serve("b", 5)
+	require.Equal(t, 2, ok)
+	require.Equal(t, "1", retryAfter)
+	ok, _ = serve("a", 20)
+	require.Equal(t, 10, ok)
+	ok, _ = serve("root", 100)
+	require.Equal(t, 100, ok)
+
+	// Buckets refill at the rate of the client.
+	now = now.Add(time.Second)
+	ok, _ = serve("b", 5)
+	require.Equal(t, 1, ok)
+	now = now.Add(time.Hour)
+	ok, _ = serve("b", 5)
+	require.Equal(t, 2, ok)
+
+	// Unauthenticated clients are limited by address.
+	rec := httptest.NewRecorder()
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		limiter.middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	}
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestReadyHandler(t *testing.T) {
+	r := cardinality.NewReadiness()
+	handler := NewReadyHandler(r)
+	serve := func() (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var resp map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, resp
+	}
+
+	code, resp := serve()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "index is building", resp["error"])
+
+	require.NoError(t, r.Load(context.Background(), nil, func(context.Context) error { return nil }))
+	code, resp = serve()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ready", resp["data"].(map[string]any)["state"])
+	require.Equal(t, "cold", resp["data"].(map[string]any)["start"])
+
+	r = cardinality.NewReadiness()
+	handler = NewReadyHandler(r)
+	require.Error(t, r.Load(context.Background(), nil, func(context.Context) error { return errors.New("head is gone") }))
+	code, resp = serve()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "index failed to load: head is gone", resp["error"])
+}
+
+func TestReport(t *testing.T) {
+	index := newTestIndex()
+
+	report, err := Report(context.Background(), index, ReportOptions{MaxMetrics: 1, MaxValues: 1})
+	require.NoError(t, err)
+	require.Equal(t, &CardinalityReport{
+		Series:  25,
+		Metrics: 2,
+		Entries: []MetricReport{{
+			Metric: "http_requests_total",
+			Series: 20,
+			Labels: []LabelReport{
+				{Name: "pod", Values: 10, Series: 20, TopValues: []ValueReport{{Value: "pod-0", Series: 2}}},
+				{Name: "method", Values: 2, Series: 20, TopValues: []ValueReport{{Value: "GET", Series: 10}}},
+			},
+		}},
+	}, report)
+
+	report, err = Report(context.Background(), index, ReportOptions{
+		Matchers:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1")},
+		MaxLabels: 1,
+		MaxValues: 2,
+		Sort:      SortByName,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []MetricReport{
+		{Metric: "http_requests_total", Series: 2, Labels: []LabelReport{
+			{Name: "method", Values: 2, Series: 2, TopValues: []ValueReport{{Value: "GET", Series: 1}, {Value: "POST", Series: 1}}},
+		}},
+		{Metric: "up", Series: 1, Labels: []LabelReport{
+			{Name: "pod", Values: 1, Series: 1, TopValues: []ValueReport{{Value: "pod-1", Series: 1}}},
+		}},
+	}, report.Entries)
+
+	_, err = Report(context.Background(), index, ReportOptions{Sort: "size"})
+	require.Error(t, err)
+
+	handler := NewReportHandler(index)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?selector=up&labels=1&values=3", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data CardinalityReport `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, int64(5), resp.Data.Series)
+	require.Len(t, resp.Data.Entries, 1)
+	require.Len(t, resp.Data.Entries[0].Labels[0].TopValues, 3)
+
+	for _, query := range []string{"?metrics=0", "?values=x", "?sort=size", "?selector=up{"} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		require.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+// countingIndex counts the estimates of the index.
+type countingIndex struct {
+	*cardinality.BitmapIndex
+	estimates atomic.Int64
+}
+
+func (c *countingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	c.estimates.Add(1)
+	return c.BitmapIndex.GetCardinalityContext(ctx, matchers...)
+}
+
+func TestReportTopValueCandidates(t *testing.T) {
+	index := &countingIndex{BitmapIndex: cardinality.NewBitmapIndex()}
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%02d", i)), storage.SeriesRef(i))
+	}
+	for i := 0; i < 10; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-99", "shard", strconv.Itoa(i)), storage.SeriesRef(100+i))
+	}
+
+	// Only the values with the most series in the index are estimated.
+	report, err := Report(context.Background(), index, ReportOptions{MaxLabels: 1, MaxValues: 1})
+	require.NoError(t, err)
+	require.Equal(t, []ValueReport{{Value: "pod-99", Series: 11}}, report.Entries[0].Labels[0].TopValues)
+	// The metric and the label are estimated once each.
+	require.Equal(t, int64(2+reportCandidates), index.estimates.Load())
+}
+
+func TestCompareTSDBStatus(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/status/tsdb", r.URL.Path)
+		require.Equal(t, "5", r.URL.Query().Get("limit"))
+		_, _ = io.WriteString(w, `{"status": "success", "data": {
+			"headStats": {"numSeries": 25},
+			"seriesCountByMetricName": [{"name": "http_requests_total", "value": 20}, {"name": "up", "value": 8}],
+			"labelValueCountByLabelName": [{"name": "pod", "value": 10}, {"name": "method", "value": 2}],
+			"seriesCountByLabelValuePair": [{"name": "method=GET", "value": 10}, {"name": "pod=pod-9", "value": 0}]
+		}}`)
+	}))
+	defer prometheus.Close()
+
+	c, err := CompareTSDBStatus(context.Background(), newTestIndex(), prometheus.URL, TSDBCompareOptions{Limit: 5, Threshold: 0.1})
+	require.NoError(t, err)
+	require.Equal(t, &TSDBComparison{
+		Checked: 7,
+		Divergences: []TSDBDivergence{
+			{Stat: LabelPairSeriesStat, Name: "pod=pod-9", Prometheus: 0, Local: 2, Error: 1},
+			{Stat: MetricSeriesStat, Name: "up", Prometheus: 8, Local: 5, Error: 0.375},
+		},
+	}, c)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	_, err = CompareTSDBStatus(context.Background(), newTestIndex(), unavailable.URL, TSDBCompareOptions{})
+	require.ErrorContains(t, err, "503")
+}
+
+func TestLintHandler(t *testing.T) {
+	handler := NewLintHandler(newTestIndex(), 0)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lint?"+url.Values{"query": {`{method="GET"}`}}.Encode(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":[{
+		"selector":"{method=\"GET\"}",
+		"position":{"Start":0,"End":14},
+		"series":10,
+		"message":"selector {method=\"GET\"} matches ~10 series; consider adding a metric name"
+	}]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lint?query=up", nil))
+	require.JSONEq(t, `{"status":"success","data":[]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lint?query=sum(", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMimirCardinalityHandler(t *testing.T) {
+	handler := NewMimirCardinalityHandler(newTestIndex())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/label_names?limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{
+		"label_values_count_total": 14,
+		"label_names_count": 3,
+		"cardinality": [
+			{"label_name": "pod", "label_values_count": 10},
+			{"label_name": "__name__", "label_values_count": 2}
+		]
+	}`, rec.Body.String())
+
+	query := url.Values{"label_names[]": {"method", "__name__"}, "selector": {`{pod=~"pod-[0-4]"}`}}.Encode()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/label_values?"+query, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{
+		"series_count_total": 15,
+		"labels": [
+			{"label_name": "__name__", "label_values_count": 2, "series_count": 15, "cardinality": [
+				{"label_value": "http_requests_total", "series_count": 10},
+				{"label_value": "up", "series_count": 5}
+			]},
+			{"label_name": "method", "label_values_count": 2, "series_count": 10, "cardinality": [
+				{"label_value": "GET", "series_count": 5},
+				{"label_value": "POST", "series_count": 5}
+			]}
+		]
+	}`, rec.Body.String())
+
+	// Regexes are anchored like in PromQL: "pod-1" doesn't match pod-10,
+	// and explicit anchors change nothing.
+	for _, selector := range []string{`{pod=~"pod-1"}`, `{pod=~"^pod-1$"}`} {
+		query = url.Values{"label_names[]": {"pod"}, "selector": {selector}}.Encode()
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/label_values?"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"series_count_total":3`, selector)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/label_values", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/label_names?limit=501", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestStatsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewStatsHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"label_names":3,"label_values":14,"series":25,"series_added":25`)
+
+	rec = httptest.NewRecorder()
+	NewStatsHandler(cardinality.NewRouterIndex(newTestIndex(), cardinality.NewHyperMinHashIndex(), 10)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestStreamHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stream?"+url.Values{
+		"selector": {`http_requests_total{pod=~"pod-.*"}`},
+		"chunk":    {"3"},
+	}.Encode(), nil)
+	NewStreamHandler(newTestIndex()).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, NDJSONContentType, rec.Header().Get("Content-Type"))
+	require.Equal(t, `{"values_done":3,"values_total":10,"series":6,"estimate":20,"done":false}
+{"values_done":6,"values_total":10,"series":12,"estimate":20,"done":false}
+{"values_done":9,"values_total":10,"series":18,"estimate":20,"done":false}
+{"values_done":10,"values_total":10,"series":20,"estimate":20,"done":true}
+`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	NewStreamHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream?selector=up&chunk=0", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestDependenciesHandler(t *testing.T) {
+	index := cardinality.NewBitmapIndex(cardinality.WithCooccurrenceTracking())
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "instance", fmt.Sprintf("10.0.0.%d", i%20), "pod", fmt.Sprintf("pod-%d", i%20), "shard", fmt.Sprintf("%d", i)), storage.SeriesRef(i))
+	}
+
+	rec := httptest.NewRecorder()
+	NewDependenciesHandler(index).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dependencies", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `{"from":"instance","to":"pod","mutual":true}`)
+	require.Contains(t, rec.Body.String(), `{"from":"shard","to":"pod","mutual":false}`)
+	require.Contains(t, rec.Body.String(), `labels \"instance\" and \"pod\" are 1:1, one of them is redundant`)
+
+	rec = httptest.NewRecorder()
+	NewDependenciesHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dependencies", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestDependenciesHandlerDuringIngestion(t *testing.T) {
+	index := cardinality.NewBitmapIndex(cardinality.WithCooccurrenceTracking())
+	handler := NewDependenciesHandler(index)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			index.AddSeries(labels.FromStrings("__name__", "up", fmt.Sprintf("label_%d", i%50), "value", "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+		}
+	}()
+	for {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dependencies", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestSeriesSamplesHandler(t *testing.T) {
+	index := cardinality.NewBitmapIndex(cardinality.WithSeriesSamples(1))
+	for i := 0; i < 5; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+	}
+
+	rec := httptest.NewRecorder()
+	NewSeriesSamplesHandler(index).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/series?"+url.Values{
+		"selector": {`up{pod=~"pod-[0-2]"}`},
+		"limit":    {"2"},
+	}.Encode(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":[{"__name__":"up","pod":"pod-0"},{"__name__":"up","pod":"pod-1"}]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	NewSeriesSamplesHandler(index).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/series?selector=missing", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":[]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	NewSeriesSamplesHandler(index).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/series?selector=up&limit=-1", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	NewSeriesSamplesHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/series?selector=up", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestRelabelImpactHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewRelabelImpactHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/relabel", strings.NewReader(`
+- action: labeldrop
+  regex: pod
+`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"series":25,"dropped":0,"merged":22,"remaining":3`)
+
+	for body, code := range map[string]int{
+		"- action: replace\n  target_label: a": http.StatusUnprocessableEntity,
+		"- action: unknown":                    http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		NewRelabelImpactHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/relabel", strings.NewReader(body)))
+		require.Equal(t, code, rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	NewRelabelImpactHandler(newTestIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/relabel", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestDebugHandler(t *testing.T) {
+	tracking := cardinality.NewTrackingIndex(cardinality.NewCachingIndex(newTestIndex(), time.Minute, 0), 10)
+	handler := NewDebugHandler(tracking, cardinality.NewMatcherCache(10))
+	for range 3 {
+		tracking.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	}
+	tracking.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1"))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality?limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var summary DebugSummary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &summary))
+	require.Equal(t, []string{"*cardinality.TrackingIndex", "*cardinality.CachingIndex", "*cardinality.BitmapIndex"}, summary.Indexes)
+	require.NotNil(t, summary.Stats)
+	require.Len(t, summary.Shards, 2)
+	require.Len(t, summary.Bitmaps, 2)
+	require.Equal(t, []cardinality.MatcherCount{{Matchers: `{__name__="up"}`, Count: 3}, {Matchers: `{pod="pod-1"}`, Count: 1}}, summary.HotMatchers)
+	require.NotNil(t, summary.Caches.Results)
+	require.Equal(t, int64(2), summary.Caches.Results.Misses)
+	require.NotNil(t, summary.Caches.Matchers)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/shards", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var shards []cardinality.ShardStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &shards))
+	require.Len(t, shards, 3)
+
+	// The handlers of a section compute only their own.
+	summary = debugSummary(tracking, nil, 2, debugShards)
+	require.Len(t, summary.Shards, 2)
+	require.Nil(t, summary.Stats)
+	require.Nil(t, summary.Bitmaps)
+	require.Nil(t, summary.HotMatchers)
+	require.Nil(t, summary.Caches.Results)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/matchers?limit=-1", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	NewDebugHandler(cardinality.NewHyperMinHashIndex(), nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/bitmaps", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `[]`, rec.Body.String())
+
+	// Without a matcher cache, the cache of the handlers is reported.
+	rec = httptest.NewRecorder()
+	NewDebugHandler(cardinality.NewHyperMinHashIndex(), nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/caches", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"matchers"`)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/pprof/heap?gc=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotZero(t, rec.Body.Len())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/pprof/profile?seconds=0.05", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotZero(t, rec.Body.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/pprof/profile", nil).WithContext(ctx))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cardinality/pprof/profile?seconds=3600", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSchemaHandler(t *testing.T) {
+	registry, err := cardinality.NewSchemaRegistry()
+	require.NoError(t, err)
+	handler := NewSchemaHandler(newTestIndex(), registry)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/cardinality/schema", strings.NewReader(`{"metric":"http_requests_total","labels":[{"name":"pod","required":true},{"name":"method","pattern":"GET"}]}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/schema", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":[{"metric":"http_requests_total","labels":[{"name":"pod","required":true},{"name":"method","pattern":"GET"}]}]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/schema/violations", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":{"series":20,"unchecked":5,"violating":10,"excess":0,"metrics":[
+		{"metric":"http_requests_total","series":20,"violating":10,"excess":0,"violations":[{"label":"method","kind":"invalid_value","series":10,"examples":["POST"]}]}
+	]}}`, rec.Body.String())
+
+	for body, code := range map[string]int{
+		`{"metric":"up","labels":[{"name":"pod","pattern":"("}]}`: http.StatusBadRequest,
+		`{"metric":"up","unknown":true}`:                          http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/cardinality/schema", strings.NewReader(body)))
+		require.Equal(t, code, rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/cardinality/schema?metric=http_requests_total", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/cardinality/schema?metric=http_requests_total", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	NewSchemaHandler(cardinality.NewHyperMinHashIndex(), registry).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/schema/violations", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestSnapshotHistoryHandler(t *testing.T) {
+	store, err := cardinality.NewSnapshotStore(cardinality.DirBucket(t.TempDir()), t.TempDir(), 0)
+	require.NoError(t, err)
+	index := cardinality.NewBitmapIndex()
+	start := time.Unix(1700000000, 0)
+	for i := range 3 {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+		require.NoError(t, store.Save(context.Background(), index, start.Add(time.Duration(i)*time.Hour)))
+	}
+	handler := NewSnapshotHistoryHandler(store)
+
+	for query, want := range map[string]string{
+		"?selector=up&time=1700003700":                    `{"snapshot_time":"2023-11-14T23:13:20Z","series":2}`,
+		"?selector=up&time=2023-11-15T02:00:00Z":          `{"snapshot_time":"2023-11-15T00:13:20Z","series":3}`,
+		"?selector=" + url.QueryEscape(`up{pod="pod-0"}`): `{"snapshot_time":"2023-11-15T00:13:20Z","series":1}`,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/history"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		require.JSONEq(t, `{"status":"success","data":`+want+`}`, rec.Body.String(), query)
+	}
+
+	for query, code := range map[string]int{
+		"?selector=up&time=1600000000": http.StatusNotFound,
+		"?selector=up&time=yesterday":  http.StatusBadRequest,
+		"?selector=up{":                http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/history"+query, nil))
+		require.Equal(t, code, rec.Code, query)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/history/snapshots", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":["2023-11-14T22:13:20Z","2023-11-14T23:13:20Z","2023-11-15T00:13:20Z"]}`, rec.Body.String())
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	index := cardinality.NewBitmapIndex()
+	exemplars := cardinality.NewExemplarIndex()
+	ingester := cardinality.NewIngester(index, nil)
+	ingester.SetExemplarIndex(exemplars)
+	handler := NewRemoteWriteHandler(ingester)
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:    []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "pod", Value: "pod-0"}},
+		Samples:   []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+		Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 1}},
+	}}}
+	buf, err := req.Marshal()
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, buf))))
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")))
+
+	rec = httptest.NewRecorder()
+	NewExemplarHandler(exemplars).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/exemplars?limit=5", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"success","data":[{"label":"trace_id","values":1,"exemplars":1,"metrics":[{"metric":"http_requests_total","values":1,"exemplars":1}]}]}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	NewExemplarHandler(cardinality.NewExemplarIndex()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/exemplars", nil))
+	require.JSONEq(t, `{"status":"success","data":[]}`, rec.Body.String())
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/write", nil),
+		httptest.NewRequest(http.MethodPost, "/api/v1/write", strings.NewReader("not snappy")),
+		httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, []byte("not protobuf")))),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		require.NotEqual(t, http.StatusNoContent, rec.Code)
+	}
+
+	// Bodies too large, compressed or once decoded, are rejected before
+	// being decoded.
+	large := make([]byte, maxRemoteWriteBytes+1)
+	for _, body := range [][]byte{large, snappy.Encode(nil, large)} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body)))
+		require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	NewExemplarHandler(exemplars).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cardinality/exemplars?limit=-1", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"io"
+	"net/http"
+)
+
+// ArrowStreamContentType is the media type of Arrow IPC streams.
+const ArrowStreamContentType = "application/vnd.apache.arrow.stream"
+
+// DefaultArrowBatchSize is the number of rows per record batch.
+const DefaultArrowBatchSize = 64 * 1024
+
+var (
+	metricBreakdownSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "metric", Type: arrow.BinaryTypes.String},
+		{Name: "series", Type: arrow.PrimitiveTypes.Int64},
+	}, nil)
+
+	labelBreakdownSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "label", Type: arrow.BinaryTypes.String},
+		{Name: "values", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "series", Type: arrow.PrimitiveTypes.Int64},
+	}, nil)
+)
+
+// WriteMetricBreakdownArrow writes rows to w as an Arrow IPC stream of
+// (metric, series) record batches of at most batchSize rows.
+func WriteMetricBreakdownArrow(w io.Writer, rows []MetricCardinality, batchSize int) error {
+	return writeArrowStream(w, metricBreakdownSchema, len(rows), batchSize, func(b *array.RecordBuilder, i int) {
+		b.Field(0).(*array.StringBuilder).Append(rows[i].Metric)
+		b.Field(1).(*array.Int64Builder).Append(rows[i].Series)
+	})
+}
+
+// WriteLabelBreakdownArrow writes rows to w as an Arrow IPC stream of
+// (label, values, series) record batches of at most batchSize rows.
+func WriteLabelBreakdownArrow(w io.Writer, rows []LabelCardinality, batchSize int) error {
+	return writeArrowStream(w, labelBreakdownSchema, len(rows), batchSize, func(b *array.RecordBuilder, i int) {
+		b.Field(0).(*array.StringBuilder).Append(rows[i].Name)
+		b.Field(1).(*array.Int64Builder).Append(rows[i].Values)
+		b.Field(2).(*array.Int64Builder).Append(rows[i].Series)
+	})
+}
+
+func writeArrowStream(w io.Writer, schema *arrow.Schema, rows, batchSize int, appendRow func(*array.RecordBuilder, int)) error {
+	if batchSize <= 0 {
+		batchSize = DefaultArrowBatchSize
+	}
+
+	mem := memory.NewGoAllocator()
+	builder := array.NewRecordBuilder(mem, schema)
+	defer builder.Release()
+
+	writer := ipc.NewWriter(w, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+	for start := 0; start < rows; start += batchSize {
+		end := min(start+batchSize, rows)
+		for i := start; i < end; i++ {
+			appendRow(builder, i)
+		}
+
+		record := builder.NewRecord()
+		err := writer.Write(record)
+		record.Release()
+		if err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// NewArrowHandler returns an http.Handler serving cardinality breakdowns of
+// index as Arrow IPC streams. The "by" query parameter selects a breakdown
+// per "metric" (default) or per "label", and the optional "selector"
+// parameter restricts it to the series matching a series selector.
+func NewArrowHandler(index cardinality.CardinalityIndex) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matchers []*labels.Matcher
+		if selector := r.FormValue("selector"); selector != "" {
+			var err error
+			if matchers, err = matcherCache.ParseSelector(selector); err != nil {
+				http.Error(w, fmt.Sprintf("invalid selector: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var write func(io.Writer) error
+		switch by := r.FormValue("by"); by {
+		case "", "metric":
+			rows, err := MetricBreakdown(r.Context(), index, matchers...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			write = func(w io.Writer) error { return WriteMetricBreakdownArrow(w, rows, DefaultArrowBatchSize) }
+		case "label":
+			rows, err := LabelBreakdown(r.Context(), index, matchers...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			write = func(w io.Writer) error { return WriteLabelBreakdownArrow(w, rows, DefaultArrowBatchSize) }
+		default:
+			http.Error(w, fmt.Sprintf("invalid breakdown %q", by), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", ArrowStreamContentType)
+		// The status code has been sent at this point, so a failed write can
+		// only be noticed by the client as a truncated stream.
+		_ = write(w)
+	})
+	return instrument(handler, "arrow")
+}
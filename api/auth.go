@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type clientKey struct{}
+
+// ClientFromContext returns the name of the client authenticated by the
+// auth middleware, or "" if the request wasn't authenticated.
+func ClientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// AuthConfig configures the authentication middleware. Clients are named
+// after their basic auth user, or the name of their bearer token.
+type AuthConfig struct {
+	// BasicAuth maps user names to their password.
+	BasicAuth map[string]string
+	// BearerTokens maps the names of clients to their token.
+	BearerTokens map[string]string
+}
+
+// NewAuthMiddleware returns a middleware rejecting the requests without
+// valid basic auth credentials or bearer token with HTTP 401, so that the
+// API can be exposed to several teams. The name of the client is passed
+// along in the request context, see ClientFromContext. Requests pass
+// unauthenticated if no credentials are configured.
+func NewAuthMiddleware(cfg AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(cfg.BasicAuth) == 0 && len(cfg.BearerTokens) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, ok := cfg.authenticate(r)
+			if !ok {
+				if len(cfg.BasicAuth) > 0 {
+					w.Header().Set("WWW-Authenticate", `Basic realm="promql-cardinality"`)
+				}
+				writeAPIError(w, http.StatusUnauthorized, "unauthorized", "invalid or missing credentials")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, client)))
+		})
+	}
+}
+
+// authenticate returns the client of the credentials of the request. All
+// credentials are compared in constant time, so that the response time
+// doesn't tell how much of a secret matched.
+func (c AuthConfig) authenticate(r *http.Request) (string, bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		expected, known := c.BasicAuth[user]
+		if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && known {
+			return user, true
+		}
+		return "", false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	client, found := "", false
+	for name, expected := range c.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			client, found = name, true
+		}
+	}
+	return client, found
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"sort"
+)
+
+// ErrBreakdownUnsupported is returned for indexes that can't enumerate label
+// names and values.
+var ErrBreakdownUnsupported = errors.New("index does not support label enumeration")
+
+// matcherCache holds the regex matchers of the selectors of requests, which
+// dashboards repeat, and the label presence matchers of the breakdowns,
+// which are built for every label on every request.
+var matcherCache = cardinality.NewMatcherCache(4096)
+
+// MetricCardinality is the number of series of a single metric.
+type MetricCardinality struct {
+	Metric string
+	Series int64
+}
+
+// LabelCardinality is the number of distinct values of a label and the
+// number of series carrying it.
+type LabelCardinality struct {
+	Name   string
+	Values int64
+	Series int64
+}
+
+// MetricBreakdown returns the series count of every metric selected by the
+// matchers, largest first.
+func MetricBreakdown(ctx context.Context, index cardinality.CardinalityIndex, matchers ...*labels.Matcher) ([]MetricCardinality, error) {
+	lvi, ok := index.(cardinality.LabelValuesIndex)
+	if !ok {
+		return nil, ErrBreakdownUnsupported
+	}
+
+	metrics := lvi.LabelValues(labels.MetricName, matchers...)
+	rows := make([]MetricCardinality, 0, len(metrics))
+	for _, metric := range metrics {
+		metricMatchers := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metric)}, matchers...)
+		rows = append(rows, MetricCardinality{
+			Metric: metric,
+			Series: cardinality.GetCardinalityContext(ctx, index, metricMatchers...),
+		})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Series > rows[j].Series
+	})
+	return rows, nil
+}
+
+// LabelBreakdown returns the distinct value and series counts of every label
+// on the series selected by the matchers, ordered by distinct values, largest
+// first.
+func LabelBreakdown(ctx context.Context, index cardinality.CardinalityIndex, matchers ...*labels.Matcher) ([]LabelCardinality, error) {
+	lvi, ok := index.(cardinality.LabelValuesIndex)
+	if !ok {
+		return nil, ErrBreakdownUnsupported
+	}
+
+	names := lvi.LabelNames(matchers...)
+	rows := make([]LabelCardinality, 0, len(names))
+	for _, name := range names {
+		labelMatchers := append([]*labels.Matcher{matcherCache.MustNewMatcher(labels.MatchRegexp, name, ".+")}, matchers...)
+		rows = append(rows, LabelCardinality{
+			Name:   name,
+			Values: int64(len(lvi.LabelValues(name, matchers...))),
+			Series: cardinality.GetCardinalityContext(ctx, index, labelMatchers...),
+		})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Values > rows[j].Values
+	})
+	return rows, nil
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// maxCPUProfile bounds the duration of the CPU profiles of the debug
+// handler.
+const maxCPUProfile = 5 * time.Minute
+
+// DebugSummary is the internal state of an index served by the debug
+// handler. Fields the index doesn't support are left out.
+type DebugSummary struct {
+	// Indexes are the types of the index and of the indexes it wraps,
+	// outermost first.
+	Indexes     []string                   `json:"indexes"`
+	Stats       *cardinality.IndexStats    `json:"stats,omitempty"`
+	Shards      []cardinality.ShardStats   `json:"shards,omitempty"`
+	Bitmaps     []cardinality.BitmapStats  `json:"bitmaps,omitempty"`
+	HotMatchers []cardinality.MatcherCount `json:"hot_matchers,omitempty"`
+	Caches      DebugCaches                `json:"caches"`
+}
+
+// DebugCaches holds the stats of the caches of an index.
+type DebugCaches struct {
+	Results  *cardinality.ResultCacheStats  `json:"results,omitempty"`
+	Matchers *cardinality.MatcherCacheStats `json:"matchers,omitempty"`
+}
+
+type unwrapper interface {
+	Unwrap() cardinality.CardinalityIndex
+}
+
+// debugSection is a set of the sections of a DebugSummary, so that the
+// handlers of a single section don't compute the others.
+type debugSection int
+
+const (
+	debugStats debugSection = 1 << iota
+	debugShards
+	debugBitmaps
+	debugMatchers
+	debugCaches
+
+	debugAll = debugStats | debugShards | debugBitmaps | debugMatchers | debugCaches
+)
+
+// debugSummary walks the index and the indexes it wraps, filling in the
+// given sections.
+func debugSummary(index cardinality.CardinalityIndex, matcherCache *cardinality.MatcherCache, limit int, sections debugSection) DebugSummary {
+	var summary DebugSummary
+	if matcherCache != nil && sections&debugCaches != 0 {
+		stats := matcherCache.Stats()
+		summary.Caches.Matchers = &stats
+	}
+	for index != nil {
+		summary.Indexes = append(summary.Indexes, fmt.Sprintf("%T", index))
+		if si, ok := index.(cardinality.StatsIndex); ok && summary.Stats == nil && sections&debugStats != 0 {
+			stats := si.Stats()
+			summary.Stats = &stats
+		}
+		switch idx := index.(type) {
+		case *cardinality.BitmapIndex:
+			if sections&debugShards != 0 {
+				shards := idx.ShardStats()
+				summary.Shards = shards[:min(limit, len(shards))]
+			}
+			if sections&debugBitmaps != 0 {
+				summary.Bitmaps = idx.LargestBitmaps(limit)
+			}
+		case *cardinality.TrackingIndex:
+			if sections&debugMatchers != 0 {
+				summary.HotMatchers = idx.HotMatchers(limit)
+			}
+		case *cardinality.CachingIndex:
+			if sections&debugCaches != 0 {
+				stats := idx.Stats()
+				summary.Caches.Results = &stats
+			}
+		}
+		u, ok := index.(unwrapper)
+		if !ok {
+			break
+		}
+		index = u.Unwrap()
+	}
+	return summary
+}
+
+// NewDebugHandler returns a handler exposing summaries of the internal state
+// of the index and on-demand profiles of the process:
+//
+//	/debug/cardinality?limit=            everything below, as a DebugSummary
+//	/debug/cardinality/shards?limit=     the largest label shards of a BitmapIndex
+//	/debug/cardinality/bitmaps?limit=    the largest label value bitmaps of a BitmapIndex
+//	/debug/cardinality/matchers?limit=   the hottest matcher sets of a TrackingIndex
+//	/debug/cardinality/caches            the stats of the result and matcher caches
+//	/debug/cardinality/pprof/heap?gc=    a heap profile, after a GC if gc is set
+//	/debug/cardinality/pprof/profile?seconds=  a CPU profile
+//
+// Wrapping indexes are looked through with their Unwrap method, so a
+// TrackingIndex around a CachingIndex around a BitmapIndex reports all
+// three. A nil matcher cache reports the cache shared by the handlers of
+// this package. Profiles are for operators, so the handler should be served
+// behind authentication.
+func NewDebugHandler(index cardinality.CardinalityIndex, cache *cardinality.MatcherCache) http.Handler {
+	if cache == nil {
+		cache = matcherCache
+	}
+	mux := http.NewServeMux()
+	summary := func(w http.ResponseWriter, r *http.Request, sections debugSection) (DebugSummary, bool) {
+		limit := defaultCardinalityLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxCardinalityLimit {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("limit param must be an integer between 0 and %d", maxCardinalityLimit))
+				return DebugSummary{}, false
+			}
+		}
+		return debugSummary(index, cache, limit, sections), true
+	}
+
+	mux.HandleFunc("/debug/cardinality", func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := summary(w, r, debugAll); ok {
+			writeJSON(w, s)
+		}
+	})
+	mux.HandleFunc("/debug/cardinality/shards", func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := summary(w, r, debugShards); ok {
+			writeJSON(w, emptyIfNil(s.Shards))
+		}
+	})
+	mux.HandleFunc("/debug/cardinality/bitmaps", func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := summary(w, r, debugBitmaps); ok {
+			writeJSON(w, emptyIfNil(s.Bitmaps))
+		}
+	})
+	mux.HandleFunc("/debug/cardinality/matchers", func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := summary(w, r, debugMatchers); ok {
+			writeJSON(w, emptyIfNil(s.HotMatchers))
+		}
+	})
+	mux.HandleFunc("/debug/cardinality/caches", func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := summary(w, r, debugCaches); ok {
+			writeJSON(w, s.Caches)
+		}
+	})
+
+	mux.HandleFunc("/debug/cardinality/pprof/heap", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="heap.pprof"`)
+		if err := pprof.Lookup("heap").WriteTo(w, 0); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+		}
+	})
+	mux.HandleFunc("/debug/cardinality/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		duration := 30 * time.Second
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			seconds, err := strconv.ParseFloat(s, 64)
+			if err != nil || seconds <= 0 || time.Duration(seconds*float64(time.Second)) > maxCPUProfile {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("seconds param must be a positive number up to %d", int(maxCPUProfile.Seconds())))
+				return
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		}
+		if err := writeCPUProfile(w, r, duration); err != nil {
+			writeAPIError(w, http.StatusConflict, "unavailable", err.Error())
+		}
+	})
+	return instrument(mux, "debug")
+}
+
+// writeCPUProfile profiles the CPU for the duration, or until the request
+// is canceled. It fails if a CPU profile is already running, as the runtime
+// supports one at a time.
+func writeCPUProfile(w http.ResponseWriter, r *http.Request, duration time.Duration) error {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile.pprof"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		return errors.New("a CPU profile is already running")
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// emptyIfNil returns an empty slice for nil, so that it is encoded as an
+// empty JSON array.
+func emptyIfNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
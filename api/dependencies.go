@@ -0,0 +1,35 @@
+package api
+
+import (
+	"harry671003/hello/cardinality"
+	"net/http"
+)
+
+// NewDependenciesHandler returns a handler responding with the functional
+// dependencies between the labels of the index and the label design advice
+// derived from them, in the format of the Prometheus HTTP API. The index
+// must track label co-occurrence.
+func NewDependenciesHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ci, ok := index.(cardinality.CooccurrenceIndex)
+		if !ok || ci.Cooccurrence() == nil {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", "index does not track label co-occurrence")
+			return
+		}
+		tracker := ci.Cooccurrence()
+		deps, advice := tracker.Dependencies(), tracker.LabelAdvice()
+		if deps == nil {
+			deps = []cardinality.LabelDependency{}
+		}
+		if advice == nil {
+			advice = []string{}
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data": map[string]any{
+				"dependencies": deps,
+				"advice":       advice,
+			},
+		})
+	}), "dependencies")
+}
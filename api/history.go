@@ -0,0 +1,84 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"harry671003/hello/cardinality"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewSnapshotHistoryHandler returns a handler answering the cardinality of
+// selectors as of past times from the snapshots of the store, in the format
+// of the Prometheus HTTP API:
+//
+//	/api/v1/cardinality/history?selector=&time=   the series of the selector in the latest snapshot at or before time
+//	/api/v1/cardinality/history/snapshots         the times of the snapshots
+//
+// Times are RFC 3339 or Unix timestamps, and default to now.
+func NewSnapshotHistoryHandler(store *cardinality.SnapshotStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/cardinality/history", func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := matcherCache.ParseSelector(r.FormValue("selector"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid selector: %v", err))
+			return
+		}
+		ts := time.Now()
+		if s := r.FormValue("time"); s != "" {
+			if ts, err = parseTime(s); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+				return
+			}
+		}
+
+		snapshot, taken, err := store.At(r.Context(), ts)
+		switch {
+		case errors.Is(err, cardinality.ErrNoSnapshot):
+			writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		defer snapshot.Close()
+		series := snapshot.GetCardinalityContext(r.Context(), matchers...)
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data": map[string]any{
+				"snapshot_time": taken.UTC(),
+				"series":        series,
+			},
+		})
+	})
+	mux.HandleFunc("/api/v1/cardinality/history/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		times, err := store.Snapshots(r.Context())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		for i := range times {
+			times[i] = times[i].UTC()
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   emptyIfNil(times),
+		})
+	})
+	return instrument(mux, "history")
+}
+
+// parseTime parses an RFC 3339 time or a Unix timestamp in seconds, like the
+// Prometheus HTTP API.
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, must be RFC 3339 or a Unix timestamp", s)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"harry671003/hello/cardinality"
+	"harry671003/hello/estimator"
+	"net/http"
+)
+
+// NewLintHandler returns a handler that lints the PromQL query in the query
+// parameter, for IDE and CI integrations. It responds in the format of the
+// Prometheus HTTP API with the list of warnings as data. Selectors estimated
+// to match more than maxSeries series are reported, zero disables the limit.
+func NewLintHandler(index cardinality.CardinalityIndex, maxSeries int64) http.Handler {
+	e := estimator.New(index)
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := queryParam(w, r)
+		if err != nil {
+			writeQueryParamError(w, err)
+			return
+		}
+		warnings, err := e.Lint(query, maxSeries)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		if warnings == nil {
+			warnings = []estimator.LintWarning{}
+		}
+
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   warnings,
+		})
+	}), "lint")
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultCardinalityLimit = 20
+	maxCardinalityLimit     = 500
+)
+
+type labelNamesCardinalityResponse struct {
+	ValuesCountTotal int64                   `json:"label_values_count_total"`
+	LabelNamesCount  int                     `json:"label_names_count"`
+	Cardinality      []labelNamesCardinality `json:"cardinality"`
+}
+
+type labelNamesCardinality struct {
+	LabelName   string `json:"label_name"`
+	ValuesCount int64  `json:"label_values_count"`
+}
+
+type labelValuesCardinalityResponse struct {
+	SeriesCountTotal int64                    `json:"series_count_total"`
+	Labels           []labelValuesCardinality `json:"labels"`
+}
+
+type labelValuesCardinality struct {
+	LabelName   string                  `json:"label_name"`
+	ValuesCount int                     `json:"label_values_count"`
+	SeriesCount int64                   `json:"series_count"`
+	Cardinality []labelValueCardinality `json:"cardinality"`
+}
+
+type labelValueCardinality struct {
+	LabelValue  string `json:"label_value"`
+	SeriesCount int64  `json:"series_count"`
+}
+
+// NewMimirCardinalityHandler returns a handler serving the subset of the
+// Mimir cardinality API used by the Grafana cardinality dashboards:
+//
+//	/api/v1/cardinality/label_names?selector=&limit=
+//	/api/v1/cardinality/label_values?label_names[]=&selector=&limit=
+//
+// The index must implement LabelValuesIndex.
+func NewMimirCardinalityHandler(index cardinality.CardinalityIndex) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/cardinality/label_names", func(w http.ResponseWriter, r *http.Request) {
+		lvi, matchers, limit, ok := parseCardinalityRequest(w, r, index)
+		if !ok {
+			return
+		}
+
+		resp := labelNamesCardinalityResponse{Cardinality: []labelNamesCardinality{}}
+		for _, name := range lvi.LabelNames(matchers...) {
+			values := int64(len(lvi.LabelValues(name, matchers...)))
+			resp.ValuesCountTotal += values
+			resp.LabelNamesCount++
+			resp.Cardinality = append(resp.Cardinality, labelNamesCardinality{LabelName: name, ValuesCount: values})
+		}
+		sort.SliceStable(resp.Cardinality, func(i, j int) bool {
+			return resp.Cardinality[i].ValuesCount > resp.Cardinality[j].ValuesCount
+		})
+		resp.Cardinality = resp.Cardinality[:min(limit, len(resp.Cardinality))]
+		writeJSON(w, resp)
+	})
+
+	mux.HandleFunc("/api/v1/cardinality/label_values", func(w http.ResponseWriter, r *http.Request) {
+		lvi, matchers, limit, ok := parseCardinalityRequest(w, r, index)
+		if !ok {
+			return
+		}
+		names := r.Form["label_names[]"]
+		if len(names) == 0 {
+			http.Error(w, "label_names[] param is required", http.StatusBadRequest)
+			return
+		}
+
+		// Without a selector, every series is counted.
+		totalMatchers := matchers
+		if len(totalMatchers) == 0 {
+			totalMatchers = []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, labels.MetricName, "")}
+		}
+		resp := labelValuesCardinalityResponse{
+			SeriesCountTotal: cardinality.GetCardinalityContext(r.Context(), index, totalMatchers...),
+			Labels:           []labelValuesCardinality{},
+		}
+		for _, name := range names {
+			label := labelValuesCardinality{LabelName: name, Cardinality: []labelValueCardinality{}}
+			for _, value := range lvi.LabelValues(name, matchers...) {
+				valueMatchers := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, name, value)}, matchers...)
+				series := cardinality.GetCardinalityContext(r.Context(), index, valueMatchers...)
+				label.ValuesCount++
+				label.SeriesCount += series
+				label.Cardinality = append(label.Cardinality, labelValueCardinality{LabelValue: value, SeriesCount: series})
+			}
+			sort.SliceStable(label.Cardinality, func(i, j int) bool {
+				return label.Cardinality[i].SeriesCount > label.Cardinality[j].SeriesCount
+			})
+			label.Cardinality = label.Cardinality[:min(limit, len(label.Cardinality))]
+			resp.Labels = append(resp.Labels, label)
+		}
+		sort.SliceStable(resp.Labels, func(i, j int) bool {
+			return resp.Labels[i].SeriesCount > resp.Labels[j].SeriesCount
+		})
+		writeJSON(w, resp)
+	})
+	return instrument(mux, "mimir")
+}
+
+// parseCardinalityRequest parses the selector and limit parameters shared by
+// the cardinality endpoints, writing an error response if they're invalid.
+func parseCardinalityRequest(w http.ResponseWriter, r *http.Request, index cardinality.CardinalityIndex) (cardinality.LabelValuesIndex, []*labels.Matcher, int, bool) {
+	lvi, ok := index.(cardinality.LabelValuesIndex)
+	if !ok {
+		http.Error(w, ErrBreakdownUnsupported.Error(), http.StatusNotImplemented)
+		return nil, nil, 0, false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, 0, false
+	}
+
+	var matchers []*labels.Matcher
+	if selector := r.Form.Get("selector"); selector != "" {
+		var err error
+		if matchers, err = matcherCache.ParseSelector(selector); err != nil {
+			http.Error(w, fmt.Sprintf("invalid selector: %v", err), http.StatusBadRequest)
+			return nil, nil, 0, false
+		}
+	}
+
+	limit := defaultCardinalityLimit
+	if s := r.Form.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxCardinalityLimit {
+			http.Error(w, fmt.Sprintf("limit param must be an integer between 0 and %d", maxCardinalityLimit), http.StatusBadRequest)
+			return nil, nil, 0, false
+		}
+	}
+	return lvi, matchers, limit, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
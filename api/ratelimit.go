@@ -0,0 +1,137 @@
+package api
+
+import (
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedClients bounds the clients the rate limit middleware tracks.
+// Clients whose bucket refilled are forgotten first.
+const maxRateLimitedClients = 10000
+
+// RateLimit is a token bucket limit: Rate requests per second on average,
+// and up to Burst at once. A zero rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig configures the rate limit middleware.
+type RateLimitConfig struct {
+	// Default is the limit of every client.
+	Default RateLimit
+	// Clients overrides the limit of clients authenticated by the auth
+	// middleware, by name.
+	Clients map[string]RateLimit
+	// Logger logs rejected requests at debug level. Nothing is logged if it
+	// is nil.
+	Logger *slog.Logger
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimitMiddleware returns a middleware limiting the rate of requests
+// of every client, so that a single team can't monopolize the API. Clients
+// are told apart by the name the auth middleware authenticated them with,
+// which must run first, or by their address. Requests over the limit are
+// rejected with HTTP 429 and a Retry-After header.
+func NewRateLimitMiddleware(cfg RateLimitConfig) func(http.Handler) http.Handler {
+	return newRateLimiter(cfg, time.Now).middleware
+}
+
+func newRateLimiter(cfg RateLimitConfig, now func() time.Time) *rateLimiter {
+	if cfg.Logger == nil {
+		cfg.Logger = promslog.NewNopLogger()
+	}
+	return &rateLimiter{cfg: cfg, now: now, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, limit := l.limit(r)
+		if limit.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, ok := l.take(client, limit); !ok {
+			l.cfg.Logger.Debug("Rate limited request", "client", client, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeAPIError(w, http.StatusTooManyRequests, "rate_limited",
+				fmt.Sprintf("client %s exceeded the rate limit of %g requests per second", client, limit.Rate))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limit returns the client of the request and its limit.
+func (l *rateLimiter) limit(r *http.Request) (string, RateLimit) {
+	if client := ClientFromContext(r.Context()); client != "" {
+		if limit, ok := l.cfg.Clients[client]; ok {
+			return client, limit
+		}
+		return client, l.cfg.Default
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host, l.cfg.Default
+}
+
+// take takes a token from the bucket of the client, or returns how long it
+// takes for one to be available.
+func (l *rateLimiter) take(client string, limit RateLimit) (time.Duration, bool) {
+	burst := float64(max(limit.Burst, 1))
+	now := l.now()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitedClients {
+			l.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// forgetIdle drops the buckets that had the time to refill, which are the
+// same as new ones. The caller must hold the lock.
+func (l *rateLimiter) forgetIdle(now time.Time) {
+	for client, b := range l.buckets {
+		limit := l.cfg.Default
+		if override, ok := l.cfg.Clients[client]; ok {
+			limit = override
+		}
+		if limit.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(max(limit.Burst, 1)) {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"harry671003/hello/cardinality"
+	"net/http"
+)
+
+// Readier reports whether an index finished its initial load, like a
+// cardinality.Readiness or a cardinality.Reindexer.
+type Readier interface {
+	Ready() bool
+}
+
+// NewReadyHandler returns a handler for /ready, responding with HTTP 200
+// once the index is loaded and 503 while it is building or if its load
+// failed, so that load balancers only route estimates to complete indexes.
+// The load status is included if r is a cardinality.Readiness.
+func NewReadyHandler(r Readier) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var data any = map[string]cardinality.ReadinessState{"state": cardinality.ReadinessReady}
+		msg := "index is building"
+		if rs, ok := r.(interface {
+			Status() cardinality.ReadinessStatus
+		}); ok {
+			status := rs.Status()
+			if status.State == cardinality.ReadinessFailed {
+				msg = "index failed to load: " + status.Error
+			}
+			data = status
+		}
+		if !r.Ready() {
+			writeAPIError(w, http.StatusServiceUnavailable, "unavailable", msg)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   data,
+		})
+	}), "ready")
+}
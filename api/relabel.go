@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+	"harry671003/hello/cardinality"
+	"io"
+	"net/http"
+)
+
+// maxRelabelConfigBytes bounds the size of the rules of a what-if request.
+const maxRelabelConfigBytes = 1 << 20
+
+// relabelImpactIndex is implemented by indexes that can simulate relabel
+// rules.
+type relabelImpactIndex interface {
+	RelabelImpact(rules []*relabel.Config) (cardinality.RelabelImpact, error)
+}
+
+// NewRelabelImpactHandler returns a handler simulating the relabel rules
+// posted as the body, a YAML list in the format of metric_relabel_configs,
+// against the indexed series. It responds in the format of the Prometheus
+// HTTP API with how many series the rules would remove.
+func NewRelabelImpactHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ri, ok := index.(relabelImpactIndex)
+		if !ok {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", "index does not simulate relabel rules")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "bad_data", "relabel rules must be posted")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRelabelConfigBytes))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		var rules []*relabel.Config
+		if err := yaml.UnmarshalStrict(body, &rules); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid relabel rules: %v", err))
+			return
+		}
+
+		impact, err := ri.RelabelImpact(rules)
+		switch {
+		case errors.Is(err, cardinality.ErrUnsupportedRelabelRule):
+			writeAPIError(w, http.StatusUnprocessableEntity, "bad_data", err.Error())
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   impact,
+		})
+	}), "relabel_impact")
+}
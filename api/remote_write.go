@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"harry671003/hello/cardinality"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxRemoteWriteBytes bounds the size of a remote write request, both
+// compressed and decoded, like the 32MiB limit of the remote read of
+// Prometheus.
+const maxRemoteWriteBytes = 32 << 20
+
+// NewRemoteWriteHandler returns a handler receiving Prometheus remote write
+// 1.0 requests, snappy-compressed protobuf, and adding their series and
+// exemplars to the ingester, so that a Prometheus can feed the index with a
+// remote_write entry. Requests above maxRemoteWriteBytes are rejected with
+// 413.
+func NewRemoteWriteHandler(ingester *cardinality.Ingester) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAPIError(w, http.StatusMethodNotAllowed, "bad_data", "remote write requests must be POSTs")
+			return
+		}
+		compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "bad_data", err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		if n, err := snappy.DecodedLen(compressed); err == nil && n > maxRemoteWriteBytes {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "bad_data", fmt.Sprintf("decoded write request of %d bytes exceeds the limit of %d", n, maxRemoteWriteBytes))
+			return
+		}
+		buf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid snappy payload: %v", err))
+			return
+		}
+		var req prompb.WriteRequest
+		if err := req.Unmarshal(buf); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid write request: %v", err))
+			return
+		}
+		ingester.IngestRemoteWrite(&req)
+		w.WriteHeader(http.StatusNoContent)
+	}), "remote_write")
+}
+
+// NewExemplarHandler returns a handler responding with the stats of the
+// exemplar labels of e, with up to limit metrics each, most values first.
+func NewExemplarHandler(e *cardinality.ExemplarIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultCardinalityLimit
+		if s := r.FormValue("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxCardinalityLimit {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("limit param must be an integer between 0 and %d", maxCardinalityLimit))
+				return
+			}
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   emptyIfNil(e.LabelStats(limit)),
+		})
+	}), "exemplars")
+}
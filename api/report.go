@@ -0,0 +1,259 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// ReportSort orders the entries of a CardinalityReport.
+type ReportSort string
+
+const (
+	// SortBySeries orders metrics and values by series and labels by
+	// distinct values, largest first, and truncates the smallest.
+	SortBySeries ReportSort = "series"
+	// SortByName orders metrics, labels and values by name.
+	SortByName ReportSort = "name"
+)
+
+// ReportOptions configures Report. Zero limits are unlimited.
+type ReportOptions struct {
+	// Matchers select the series reported, all series without matchers.
+	Matchers []*labels.Matcher
+	// MaxMetrics, MaxLabels and MaxValues limit the metrics reported, the
+	// labels reported per metric and the top values reported per label.
+	// Sorted by series, the top values are chosen among a bounded number
+	// of candidates, see topValues.
+	MaxMetrics int
+	MaxLabels  int
+	MaxValues  int
+	// Sort defaults to SortBySeries.
+	Sort ReportSort
+}
+
+// CardinalityReport is the tree of metrics, their labels and the top
+// values of the labels of the series selected by a Report.
+type CardinalityReport struct {
+	// Series is the sum of the series of the metrics selected.
+	Series int64 `json:"series"`
+	// Metrics counts the metrics selected, of which the first MaxMetrics
+	// are reported.
+	Metrics int            `json:"metrics"`
+	Entries []MetricReport `json:"entries"`
+}
+
+// MetricReport is the series of a metric and the labels of its series.
+type MetricReport struct {
+	Metric string        `json:"metric"`
+	Series int64         `json:"series"`
+	Labels []LabelReport `json:"labels"`
+}
+
+// LabelReport is the distinct values of a label of a metric, the series of
+// the metric carrying it, and its top values.
+type LabelReport struct {
+	Name      string        `json:"name"`
+	Values    int           `json:"values"`
+	Series    int64         `json:"series"`
+	TopValues []ValueReport `json:"top_values"`
+}
+
+// ValueReport is the series of a metric with a label value.
+type ValueReport struct {
+	Value  string `json:"value"`
+	Series int64  `json:"series"`
+}
+
+// Report returns the metrics of the series selected by the options, the
+// distinct values of their labels and the series of their top values, in a
+// single tree for dashboards to render without a request per level. Only
+// the metrics kept by the limits are broken down, so the cost of a report
+// grows with its limits rather than with the index.
+func Report(ctx context.Context, index cardinality.CardinalityIndex, opts ReportOptions) (*CardinalityReport, error) {
+	lvi, ok := index.(cardinality.LabelValuesIndex)
+	if !ok {
+		return nil, ErrBreakdownUnsupported
+	}
+	switch opts.Sort {
+	case "":
+		opts.Sort = SortBySeries
+	case SortBySeries, SortByName:
+	default:
+		return nil, fmt.Errorf("unknown report sort %q", opts.Sort)
+	}
+
+	metrics, err := MetricBreakdown(ctx, index, opts.Matchers...)
+	if err != nil {
+		return nil, err
+	}
+	report := &CardinalityReport{Metrics: len(metrics), Entries: make([]MetricReport, 0, len(metrics))}
+	for _, m := range metrics {
+		report.Series += m.Series
+	}
+	if opts.Sort == SortByName {
+		slices.SortFunc(metrics, func(a, b MetricCardinality) int { return cmp.Compare(a.Metric, b.Metric) })
+	}
+	metrics = limitReport(metrics, opts.MaxMetrics)
+
+	for _, m := range metrics {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		metricMatchers := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, m.Metric)}, opts.Matchers...)
+		entry := MetricReport{Metric: m.Metric, Series: m.Series, Labels: []LabelReport{}}
+		for _, name := range lvi.LabelNames(metricMatchers...) {
+			if name == labels.MetricName {
+				continue
+			}
+			entry.Labels = append(entry.Labels, LabelReport{
+				Name:   name,
+				Values: len(lvi.LabelValues(name, metricMatchers...)),
+			})
+		}
+		if opts.Sort == SortBySeries {
+			slices.SortStableFunc(entry.Labels, func(a, b LabelReport) int { return cmp.Compare(b.Values, a.Values) })
+		}
+		entry.Labels = limitReport(entry.Labels, opts.MaxLabels)
+
+		for i := range entry.Labels {
+			label := &entry.Labels[i]
+			labelMatchers := append([]*labels.Matcher{matcherCache.MustNewMatcher(labels.MatchRegexp, label.Name, ".+")}, metricMatchers...)
+			label.Series = cardinality.GetCardinalityContext(ctx, index, labelMatchers...)
+			label.TopValues = topValues(ctx, index, lvi, label.Name, metricMatchers, opts)
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	return report, nil
+}
+
+const (
+	// reportCandidates is the number of values estimated per top value
+	// reported, among the largest values of the index.
+	reportCandidates = 4
+	// maxReportEstimates bounds the values estimated per label by indexes
+	// without label statistics, or without a limit of top values.
+	maxReportEstimates = 1000
+)
+
+// topValues returns the values of the label on the series of the matchers
+// with their series, sorted and limited by the options. Sorted by series,
+// only candidates are estimated: with label statistics, the
+// reportCandidates values per top value with the most series in the whole
+// index, which are usually the largest on the matchers too, and otherwise
+// the first maxReportEstimates values by name.
+func topValues(ctx context.Context, index cardinality.CardinalityIndex, lvi cardinality.LabelValuesIndex, name string, matchers []*labels.Matcher, opts ReportOptions) []ValueReport {
+	values := lvi.LabelValues(name, matchers...)
+	switch {
+	case opts.Sort == SortByName:
+		// Values are sorted already, so only the values reported are
+		// estimated.
+		values = limitReport(values, opts.MaxValues)
+	case opts.MaxValues > 0:
+		if lsi, ok := index.(cardinality.LabelStatsIndex); ok {
+			values = rankValues(lsi, name, values)
+			values = limitReport(values, min(reportCandidates*opts.MaxValues, maxReportEstimates))
+		} else {
+			values = limitReport(values, maxReportEstimates)
+		}
+	default:
+		values = limitReport(values, maxReportEstimates)
+	}
+	top := make([]ValueReport, 0, len(values))
+	for _, value := range values {
+		valueMatchers := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, name, value)}, matchers...)
+		top = append(top, ValueReport{Value: value, Series: cardinality.GetCardinalityContext(ctx, index, valueMatchers...)})
+	}
+	if opts.Sort == SortBySeries {
+		slices.SortStableFunc(top, func(a, b ValueReport) int { return cmp.Compare(b.Series, a.Series) })
+	}
+	return limitReport(top, opts.MaxValues)
+}
+
+// rankValues orders the values by their series in the whole index, largest
+// first, values without statistics last.
+func rankValues(index cardinality.LabelStatsIndex, name string, values []string) []string {
+	stats := index.TopLabelValues(name, -1)
+	rank := make(map[string]int, len(stats))
+	for i, s := range stats {
+		rank[s.Value] = i
+	}
+	rankOf := func(value string) int {
+		if i, ok := rank[value]; ok {
+			return i
+		}
+		return len(stats)
+	}
+	values = slices.Clone(values)
+	slices.SortStableFunc(values, func(a, b string) int { return cmp.Compare(rankOf(a), rankOf(b)) })
+	return values
+}
+
+func limitReport[S ~[]E, E any](s S, limit int) S {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	return s[:limit]
+}
+
+// NewReportHandler returns a handler responding with a Report of the
+// selector parameter:
+//
+//	/api/v1/cardinality/report?selector=&metrics=&labels=&values=&sort=
+//
+// metrics, labels and values limit the metrics, labels per metric and top
+// values per label reported, 20 by default, and sort is series or name.
+// The index must implement LabelValuesIndex.
+func NewReportHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := index.(cardinality.LabelValuesIndex); !ok {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", ErrBreakdownUnsupported.Error())
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+
+		opts := ReportOptions{Sort: ReportSort(r.Form.Get("sort"))}
+		if selector := r.Form.Get("selector"); selector != "" {
+			var err error
+			if opts.Matchers, err = matcherCache.ParseSelector(selector); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid selector: %v", err))
+				return
+			}
+		}
+		for _, p := range []struct {
+			param string
+			limit *int
+		}{{"metrics", &opts.MaxMetrics}, {"labels", &opts.MaxLabels}, {"values", &opts.MaxValues}} {
+			*p.limit = defaultCardinalityLimit
+			if s := r.Form.Get(p.param); s != "" {
+				var err error
+				if *p.limit, err = strconv.Atoi(s); err != nil || *p.limit < 1 || *p.limit > maxCardinalityLimit {
+					writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("%s param must be an integer between 1 and %d", p.param, maxCardinalityLimit))
+					return
+				}
+			}
+		}
+		if opts.Sort != "" && opts.Sort != SortBySeries && opts.Sort != SortByName {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("sort param must be %s or %s", SortBySeries, SortByName))
+			return
+		}
+
+		report, err := Report(r.Context(), index, opts)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   report,
+		})
+	}), "report")
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"strconv"
+)
+
+// NewSeriesSamplesHandler returns a handler responding with example series
+// of the selector parameter, up to limit of them, in the format of the
+// Prometheus series API, so that reports can show the series behind a
+// count. The index must implement SamplingIndex.
+func NewSeriesSamplesHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, ok := index.(cardinality.SamplingIndex)
+		if !ok {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", "index does not sample series")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		matchers, err := matcherCache.ParseSelector(r.Form.Get("selector"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid selector: %v", err))
+			return
+		}
+		limit := defaultCardinalityLimit
+		if s := r.Form.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxCardinalityLimit {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("limit param must be an integer between 0 and %d", maxCardinalityLimit))
+				return
+			}
+		}
+
+		series, err := si.SampleSeries(matchers, limit)
+		switch {
+		case errors.Is(err, cardinality.ErrSeriesNotSampled):
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", err.Error())
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		if series == nil {
+			series = []labels.Labels{}
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   series,
+		})
+	}), "series_samples")
+}
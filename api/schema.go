@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"strconv"
+)
+
+// maxSchemaBytes bounds the size of a posted schema.
+const maxSchemaBytes = 1 << 20
+
+// schemaIndex is implemented by indexes that can check the series against
+// label schemas.
+type schemaIndex interface {
+	CheckSchema(registry *cardinality.SchemaRegistry) (cardinality.SchemaReport, error)
+}
+
+// NewSchemaHandler returns a handler managing the schemas of the registry and
+// reporting the series of the index breaking them, in the format of the
+// Prometheus HTTP API:
+//
+//	GET    /api/v1/cardinality/schema                   the registered schemas
+//	POST   /api/v1/cardinality/schema                   registers the MetricSchema posted as JSON
+//	DELETE /api/v1/cardinality/schema?metric=           removes the schema of a metric
+//	GET    /api/v1/cardinality/schema/violations?limit= the SchemaReport, with up to limit metrics
+func NewSchemaHandler(index cardinality.CardinalityIndex, registry *cardinality.SchemaRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/cardinality/schema", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, map[string]any{
+				"status": "success",
+				"data":   registry.Schemas(),
+			})
+		case http.MethodPost:
+			var schema cardinality.MetricSchema
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSchemaBytes))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&schema); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid schema: %v", err))
+				return
+			}
+			if err := registry.Register(schema); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", err.Error())
+				return
+			}
+			writeJSON(w, map[string]any{
+				"status": "success",
+				"data":   schema,
+			})
+		case http.MethodDelete:
+			metric := r.URL.Query().Get("metric")
+			if !registry.Unregister(metric) {
+				writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no schema for metric %q", metric))
+				return
+			}
+			writeJSON(w, map[string]any{"status": "success"})
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "bad_data", "schemas must be read, posted or deleted")
+		}
+	})
+	mux.HandleFunc("/api/v1/cardinality/schema/violations", func(w http.ResponseWriter, r *http.Request) {
+		si, ok := index.(schemaIndex)
+		if !ok {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", "index does not check schemas")
+			return
+		}
+		limit := defaultCardinalityLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxCardinalityLimit {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("limit param must be an integer between 0 and %d", maxCardinalityLimit))
+				return
+			}
+		}
+
+		report, err := si.CheckSchema(registry)
+		switch {
+		case errors.Is(err, cardinality.ErrUnsupportedSchemaLabel):
+			writeAPIError(w, http.StatusUnprocessableEntity, "bad_data", err.Error())
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		report.Metrics = report.Metrics[:min(limit, len(report.Metrics))]
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   report,
+		})
+	})
+	return instrument(mux, "schema")
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"harry671003/hello/cardinality"
+	"net/http"
+)
+
+// NewStatsHandler returns a handler responding with the stats of the index
+// in the format of the Prometheus HTTP API, for monitoring its health.
+func NewStatsHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		si, ok := index.(cardinality.StatsIndex)
+		if !ok {
+			writeAPIError(w, http.StatusNotImplemented, "unavailable", "index does not report stats")
+			return
+		}
+		writeJSON(w, map[string]any{
+			"status": "success",
+			"data":   si.Stats(),
+		})
+	}), "stats")
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"harry671003/hello/cardinality"
+	"net/http"
+	"strconv"
+)
+
+// NDJSONContentType is the content type of newline delimited JSON streams.
+const NDJSONContentType = "application/x-ndjson"
+
+// NewStreamHandler returns a handler estimating the series matching the
+// selector parameter and streaming the partial results as newline delimited
+// cardinality.Progress objects, so that UIs can show a live estimate and
+// cancel the request once the magnitude is clear. The optional chunk
+// parameter sets the number of label values unioned between results.
+func NewStreamHandler(index cardinality.CardinalityIndex) http.Handler {
+	return instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := matcherCache.ParseSelector(r.FormValue("selector"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid selector: %v", err), http.StatusBadRequest)
+			return
+		}
+		chunkSize := cardinality.DefaultStreamChunkSize
+		if s := r.FormValue("chunk"); s != "" {
+			if chunkSize, err = strconv.Atoi(s); err != nil || chunkSize <= 0 {
+				http.Error(w, "chunk param must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", NDJSONContentType)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		// The status code has been sent with the first result, errors can
+		// only be noticed by the client as a stream without a done result.
+		_ = cardinality.StreamCardinality(r.Context(), index, chunkSize, func(p cardinality.Progress) error {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}, matchers...)
+	}), "stream")
+}
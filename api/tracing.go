@@ -0,0 +1,13 @@
+package api
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net/http"
+)
+
+// instrument traces the requests served by handler with spans named after
+// the operation, continuing the trace of the client if it sent one. Every
+// handler constructor of the package wraps its handler with it.
+func instrument(handler http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(handler, "cardinality."+operation)
+}
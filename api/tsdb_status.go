@@ -0,0 +1,160 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TSDBStat names a statistic of the Prometheus TSDB status API.
+type TSDBStat string
+
+const (
+	HeadSeriesStat      TSDBStat = "head_series"
+	MetricSeriesStat    TSDBStat = "series_count_by_metric_name"
+	LabelValuesStat     TSDBStat = "label_value_count_by_label_name"
+	LabelPairSeriesStat TSDBStat = "series_count_by_label_value_pair"
+)
+
+// TSDBCompareOptions configures CompareTSDBStatus.
+type TSDBCompareOptions struct {
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Limit is the number of entries of every list of the status, 10 by
+	// default on the server.
+	Limit int
+	// Threshold is the relative error above which a statistic diverges.
+	Threshold float64
+}
+
+// TSDBDivergence is a statistic of the Prometheus TSDB status that the
+// index doesn't agree with.
+type TSDBDivergence struct {
+	Stat TSDBStat `json:"stat"`
+	// Name is the metric, label or label pair of the statistic, empty for
+	// the head series.
+	Name       string  `json:"name,omitempty"`
+	Prometheus int64   `json:"prometheus"`
+	Local      int64   `json:"local"`
+	Error      float64 `json:"error"`
+}
+
+// TSDBComparison is the result of CompareTSDBStatus.
+type TSDBComparison struct {
+	// Checked counts the statistics compared.
+	Checked int `json:"checked"`
+	// Divergences lists the statistics off by more than the threshold,
+	// largest error first.
+	Divergences []TSDBDivergence `json:"divergences"`
+}
+
+// tsdbStatus is the subset of the Prometheus /api/v1/status/tsdb response
+// compared.
+type tsdbStatus struct {
+	HeadStats struct {
+		NumSeries uint64 `json:"numSeries"`
+	} `json:"headStats"`
+	SeriesCountByMetricName     []tsdbStat `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []tsdbStat `json:"labelValueCountByLabelName"`
+	SeriesCountByLabelValuePair []tsdbStat `json:"seriesCountByLabelValuePair"`
+}
+
+type tsdbStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// CompareTSDBStatus fetches the TSDB status of the Prometheus server at
+// prometheusURL and compares its series and label value counts with the
+// index, which should track the same head, so that users can check the
+// index follows the server. The status only covers the head block, so an
+// index also loading older blocks or holding other servers' series
+// diverges by design. The label value counts are only compared if the index
+// implements LabelValuesIndex.
+func CompareTSDBStatus(ctx context.Context, index cardinality.CardinalityIndex, prometheusURL string, opts TSDBCompareOptions) (*TSDBComparison, error) {
+	status, err := fetchTSDBStatus(ctx, prometheusURL, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TSDBComparison{Divergences: []TSDBDivergence{}}
+	compare := func(stat TSDBStat, name string, prometheus uint64, local int64) {
+		c.Checked++
+		d := TSDBDivergence{Stat: stat, Name: name, Prometheus: int64(prometheus), Local: local}
+		if d.Error = cardinality.RelativeError(d.Local, d.Prometheus); d.Error > opts.Threshold {
+			c.Divergences = append(c.Divergences, d)
+		}
+	}
+
+	all := labels.MustNewMatcher(labels.MatchNotEqual, labels.MetricName, "")
+	compare(HeadSeriesStat, "", status.HeadStats.NumSeries, cardinality.GetCardinalityContext(ctx, index, all))
+	for _, s := range status.SeriesCountByMetricName {
+		m := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, s.Name)
+		compare(MetricSeriesStat, s.Name, s.Value, cardinality.GetCardinalityContext(ctx, index, m))
+	}
+	if lvi, ok := index.(cardinality.LabelValuesIndex); ok {
+		for _, s := range status.LabelValueCountByLabelName {
+			compare(LabelValuesStat, s.Name, s.Value, int64(len(lvi.LabelValues(s.Name))))
+		}
+	}
+	for _, s := range status.SeriesCountByLabelValuePair {
+		name, value, ok := strings.Cut(s.Name, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label pair %q in TSDB status", s.Name)
+		}
+		m := labels.MustNewMatcher(labels.MatchEqual, name, value)
+		compare(LabelPairSeriesStat, s.Name, s.Value, cardinality.GetCardinalityContext(ctx, index, m))
+	}
+
+	slices.SortStableFunc(c.Divergences, func(a, b TSDBDivergence) int {
+		return cmp.Compare(b.Error, a.Error)
+	})
+	return c, nil
+}
+
+func fetchTSDBStatus(ctx context.Context, prometheusURL string, opts TSDBCompareOptions) (*tsdbStatus, error) {
+	const path = "/api/v1/status/tsdb"
+	u := strings.TrimSuffix(prometheusURL, "/") + path
+	if opts.Limit > 0 {
+		u += "?" + url.Values{"limit": {strconv.Itoa(opts.Limit)}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var body struct {
+		Status string     `json:"status"`
+		Error  string     `json:"error"`
+		Data   tsdbStatus `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if body.Status != "success" {
+		return nil, fmt.Errorf("%s: %s", path, body.Error)
+	}
+	return &body.Data, nil
+}
@@ -0,0 +1,235 @@
+package cardinality
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"io"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+)
+
+// MatcherClass is a class of matcher sets indexes estimate alike, e.g.
+// intersections of equalities, or regular expressions over many values.
+type MatcherClass string
+
+const (
+	// ClassSingleEqual is a single equality matcher, {pod="pod-1"}.
+	ClassSingleEqual MatcherClass = "single-eq"
+	// ClassMultiEqual is only equality matchers, {__name__="up",pod="pod-1"}.
+	ClassMultiEqual MatcherClass = "multi-eq"
+	// ClassEqualRegex is equality and regular expression matchers,
+	// {__name__="up",pod=~"pod-1.*"}.
+	ClassEqualRegex MatcherClass = "eq+regex"
+	// ClassEqualNegative is equality matchers and one negative matcher,
+	// {__name__="up",pod!="pod-1"}.
+	ClassEqualNegative MatcherClass = "eq+neg"
+	// ClassMultiNegative is several negative matchers, which indexes
+	// answer by subtracting one estimate from another repeatedly,
+	// {__name__="up",pod!="pod-1",job!~"api|db"}.
+	ClassMultiNegative MatcherClass = "multi-neg"
+	// ClassSetRegex is regular expressions matching a set of values and no
+	// equality, {pod=~"pod-1|pod-2"}.
+	ClassSetRegex MatcherClass = "set-regex"
+	// ClassBroadRegex is regular expressions matching any number of values
+	// and no equality, {__name__=~"http_.*"}.
+	ClassBroadRegex MatcherClass = "broad-regex"
+	// ClassOther is the matcher sets of no other class.
+	ClassOther MatcherClass = "other"
+)
+
+// MatcherClasses are the classes of ClassifyMatchers, in the order of
+// accuracy reports.
+var MatcherClasses = []MatcherClass{
+	ClassSingleEqual, ClassMultiEqual, ClassEqualRegex, ClassEqualNegative,
+	ClassMultiNegative, ClassSetRegex, ClassBroadRegex, ClassOther,
+}
+
+// ClassifyMatchers returns the class of a matcher set.
+func ClassifyMatchers(matchers ...*labels.Matcher) MatcherClass {
+	var equal, negative, regex, setRegex int
+	for _, m := range matchers {
+		switch m.Type {
+		case labels.MatchEqual:
+			equal++
+		case labels.MatchNotEqual, labels.MatchNotRegexp:
+			negative++
+		case labels.MatchRegexp:
+			regex++
+			if len(m.SetMatches()) > 0 {
+				setRegex++
+			}
+		}
+	}
+	switch {
+	case negative >= 2:
+		return ClassMultiNegative
+	case equal == 1 && len(matchers) == 1:
+		return ClassSingleEqual
+	case equal >= 2 && len(matchers) == equal:
+		return ClassMultiEqual
+	case equal >= 1 && regex >= 1 && negative == 0:
+		return ClassEqualRegex
+	case equal >= 1 && negative == 1 && regex == 0:
+		return ClassEqualNegative
+	case equal == 0 && negative == 0 && regex > setRegex:
+		return ClassBroadRegex
+	case equal == 0 && negative == 0 && regex > 0:
+		return ClassSetRegex
+	}
+	return ClassOther
+}
+
+// ClassAccuracy is the accuracy of an index on the matcher sets of a
+// class. Errors are relative to the ground truth.
+type ClassAccuracy struct {
+	Class   MatcherClass `json:"class"`
+	Queries int          `json:"queries"`
+	Mean    float64      `json:"mean"`
+	P50     float64      `json:"p50"`
+	P90     float64      `json:"p90"`
+	P99     float64      `json:"p99"`
+	Max     float64      `json:"max"`
+	// Worst is the matcher set with the largest error.
+	Worst ReplayedSelector `json:"worst"`
+}
+
+// AccuracyReport is the accuracy of an index per matcher class, for the
+// classes with queries, see EvaluateAccuracy.
+type AccuracyReport struct {
+	Queries int             `json:"queries"`
+	Classes []ClassAccuracy `json:"classes"`
+}
+
+// EvaluateAccuracy estimates every matcher set with index and compares the
+// estimates to the answers of truth, typically a BitmapIndex or BlockIndex
+// of the same series, to report where the index is weak.
+func EvaluateAccuracy(ctx context.Context, index, truth CardinalityIndex, queries [][]*labels.Matcher) (*AccuracyReport, error) {
+	byClass := map[MatcherClass][]ReplayedSelector{}
+	for _, matchers := range queries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		s := ReplayedSelector{Selector: "{" + matchersKey(matchers) + "}", Queries: 1}
+		s.Estimate = GetCardinalityContext(ctx, index, matchers...)
+		s.Actual = GetCardinalityContext(ctx, truth, matchers...)
+		s.Error = RelativeError(s.Estimate, s.Actual)
+		class := ClassifyMatchers(matchers...)
+		byClass[class] = append(byClass[class], s)
+	}
+
+	report := &AccuracyReport{Queries: len(queries)}
+	for _, class := range MatcherClasses {
+		selectors := byClass[class]
+		if len(selectors) == 0 {
+			continue
+		}
+		slices.SortStableFunc(selectors, func(a, b ReplayedSelector) int { return cmp.Compare(a.Error, b.Error) })
+		var sum float64
+		for _, s := range selectors {
+			sum += s.Error
+		}
+		report.Classes = append(report.Classes, ClassAccuracy{
+			Class:   class,
+			Queries: len(selectors),
+			Mean:    sum / float64(len(selectors)),
+			P50:     errorPercentile(selectors, 0.5),
+			P90:     errorPercentile(selectors, 0.9),
+			P99:     errorPercentile(selectors, 0.99),
+			Max:     selectors[len(selectors)-1].Error,
+			Worst:   selectors[len(selectors)-1],
+		})
+	}
+	return report, nil
+}
+
+// errorPercentile returns the nearest-rank percentile of the errors of the
+// selectors, sorted by error.
+func errorPercentile(selectors []ReplayedSelector, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(selectors)))) - 1
+	return selectors[max(rank, 0)].Error
+}
+
+// WriteMarkdown writes the report as a markdown table.
+func (r *AccuracyReport) WriteMarkdown(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "| Class | Queries | Mean | p50 | p90 | p99 | Max | Worst |\n|---|---:|---:|---:|---:|---:|---:|---|\n"); err != nil {
+		return err
+	}
+	for _, c := range r.Classes {
+		_, err := fmt.Fprintf(w, "| %s | %d | %.2f%% | %.2f%% | %.2f%% | %.2f%% | %.2f%% | `%s` (%d for %d) |\n",
+			c.Class, c.Queries, c.Mean*100, c.P50*100, c.P90*100, c.P99*100, c.Max*100, c.Worst.Selector, c.Worst.Estimate, c.Worst.Actual)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AccuracyQueries samples n matcher sets of every class but ClassOther
+// from the label values of index, for EvaluateAccuracy. The same seed
+// samples the same matcher sets from the same series.
+func AccuracyQueries(index LabelValuesIndex, n int, seed uint64) [][]*labels.Matcher {
+	r := rand.New(rand.NewPCG(seed, seed))
+	s := matcherSampler{index: index, rand: r}
+	if len(index.LabelNames()) == 0 {
+		return nil
+	}
+
+	var queries [][]*labels.Matcher
+	for _, class := range MatcherClasses {
+		if class == ClassOther {
+			continue
+		}
+		for sampled, attempts := 0, 0; sampled < n && attempts < 10*n; attempts++ {
+			first, other, ok := s.equal()
+			if !ok {
+				continue
+			}
+			var matchers []*labels.Matcher
+			switch class {
+			case ClassSingleEqual:
+				matchers = []*labels.Matcher{first}
+			case ClassMultiEqual, ClassEqualRegex, ClassEqualNegative:
+				value, ok := s.value(other, first)
+				if !ok {
+					continue
+				}
+				var second *labels.Matcher
+				switch class {
+				case ClassMultiEqual:
+					second = s.matcher(labels.MatchEqual, other, value)
+				case ClassEqualRegex:
+					second = s.prefix(other, value, ".*")
+				default:
+					second = s.matcher(labels.MatchNotEqual, other, value)
+				}
+				matchers = []*labels.Matcher{first, second}
+			case ClassMultiNegative:
+				value, ok := s.value(other, first)
+				if !ok {
+					continue
+				}
+				excluded, _ := s.value(other)
+				matchers = []*labels.Matcher{
+					first,
+					s.matcher(labels.MatchNotEqual, other, value),
+					s.matcher(labels.MatchNotRegexp, other, regexp.QuoteMeta(excluded)),
+				}
+			case ClassSetRegex:
+				value, _ := s.value(first.Name)
+				matchers = []*labels.Matcher{s.matcher(labels.MatchRegexp, first.Name, regexp.QuoteMeta(first.Value)+"|"+regexp.QuoteMeta(value))}
+			case ClassBroadRegex:
+				matchers = []*labels.Matcher{s.prefix(first.Name, first.Value, ".+")}
+			}
+			if slices.Contains(matchers, nil) || ClassifyMatchers(matchers...) != class {
+				continue
+			}
+			queries = append(queries, matchers)
+			sampled++
+		}
+	}
+	return queries
+}
@@ -0,0 +1,59 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"time"
+)
+
+// ErrActiveSeriesNotTracked is returned by GetActiveCardinality on an index
+// that wasn't created WithActiveSeries.
+var ErrActiveSeriesNotTracked = errors.New("active series are not tracked")
+
+// AddSeriesSample adds a series like AddSeries and records a sample of it at
+// t, in milliseconds, if the index was created WithActiveSeries. Only the
+// latest sample of every series is kept.
+func (b *BitmapIndex) AddSeriesSample(lbls labels.Labels, ref storage.SeriesRef, t int64) {
+	ref, ok := b.addSeries(lbls, ref)
+	if !ok || b.lastSample == nil {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if last, ok := b.lastSample[uint64(ref)]; !ok || t > last {
+		b.lastSample[uint64(ref)] = t
+	}
+}
+
+// GetActiveCardinality returns the number of series matching the matchers
+// that had a sample within window before now, as opposed to all the series
+// ever added. This is how Mimir and Cortex ingesters count active series,
+// with a window of their idle timeout. Series added without samples are
+// never active.
+func (b *BitmapIndex) GetActiveCardinality(window time.Duration, matchers ...*labels.Matcher) (int64, error) {
+	if b.lastSample == nil {
+		return 0, ErrActiveSeriesNotTracked
+	}
+	if len(matchers) == 0 {
+		return 0, nil
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0, nil
+	}
+	bitmap := b.getIntersectionBitmap(context.Background(), matchers)
+	cutoff := b.now().Add(-window).UnixMilli()
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	var active int64
+	for it := bitmap.Iterator(); it.HasNext(); {
+		if t, ok := b.lastSample[it.Next()]; ok && t >= cutoff {
+			active++
+		}
+	}
+	return active, nil
+}
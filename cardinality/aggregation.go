@@ -0,0 +1,57 @@
+package cardinality
+
+import (
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"slices"
+)
+
+// SimulateAggregation returns the number of series matching the matchers
+// that would remain once dropLabels are aggregated away, like
+// sum without(dropLabels) does: the number of distinct combinations of the
+// other labels. Like in PromQL, the metric name is dropped too. It helps
+// designing recording rules that reduce cardinality. Labels whose values are bucketed or collapsed must be
+// dropped, as their values aren't known per series.
+func (b *BitmapIndex) SimulateAggregation(matchers []*labels.Matcher, dropLabels []string) (int64, error) {
+	refs, err := b.GetMatchingRefs(matchers...)
+	if err != nil || len(refs) == 0 {
+		return 0, err
+	}
+	matching := roaring64.New()
+	for _, ref := range refs {
+		matching.Add(uint64(ref))
+	}
+
+	hashes := make(map[uint64]uint64, len(refs))
+	var shardErr error
+	b.forEachShard(func(name string, s *labelShard) {
+		if shardErr != nil || name == labels.MetricName || slices.Contains(dropLabels, name) {
+			return
+		}
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		if !s.present.Intersects(matching) {
+			return
+		}
+		if s.bucketed != nil || s.collapsed {
+			shardErr = fmt.Errorf("the values of label %q are bucketed or collapsed", name)
+			return
+		}
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				if !v.postings.Intersects(matching) {
+					continue
+				}
+				h := labelHash(name, str(id))
+				for it := roaring64.And(v.postings, matching).Iterator(); it.HasNext(); {
+					hashes[it.Next()] += h
+				}
+			}
+		})
+	})
+	if shardErr != nil {
+		return 0, shardErr
+	}
+	return countDistinct(matching, hashes), nil
+}
@@ -1,92 +1,1134 @@
 package cardinality
 
 import (
+	"context"
+	"fmt"
 	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"go.opentelemetry.io/otel/attribute"
+	"harry671003/hello/cardinality/sketchcore"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// BitmapIndex is sharded by label name: every label name owns its values,
+// their bitmaps and statistics, and a lock. Values are stored as IDs of a
+// SymbolTable. Concurrent AddSeries calls only contend on the label names
+// they share, and a label name's structures can be dropped or spilled as a
+// unit. The index is safe for concurrent use.
 type BitmapIndex struct {
-	index map[string]map[string]*roaring64.Bitmap
+	shardsMtx sync.RWMutex
+	shards    map[string]*labelShard
+	symbols   *SymbolTable
+	bucketing bucketing
+	logger    *slog.Logger
+	ttl       time.Duration
+	now       func() time.Time
+	relabel   []*relabel.Config
+	guard     *valueGuard
+	filter    *seenFilter
+	presence  bool
+
+	// mtx guards the series level state below.
+	mtx  sync.RWMutex
+	seen seriesSet
+	refs *refAllocator
+	// seenRefs replaces seen when values expire, so that a known series is
+	// re-added under its original ref.
+	seenRefs map[uint64]storage.SeriesRef
+	cooc     *CooccurrenceTracker
+	// all holds every series, to select the series without a label for
+	// matchers that match "".
+	all *roaring64.Bitmap
+	// hashes maps series refs to the hash of their labels, to assign series
+	// to query shards.
+	hashes map[uint64]uint64
+	// metricSeen replaces seen for the series with a metric name when the
+	// index keeps sub-indexes per metric, so that EvictMetric can forget
+	// them.
+	metricSeen map[string]seriesSet
+	// samples holds the labels of the sampled series, the series whose
+	// labels hash is a multiple of sampleEvery.
+	samples     map[uint64]labels.Labels
+	sampleEvery uint64
+	// histograms maps the refs of native histogram series to their number
+	// of buckets, and exemplars holds the series with exemplars.
+	histograms map[uint64]uint32
+	exemplars  *roaring64.Bitmap
+	// lastSample maps series refs to the timestamp of their latest sample,
+	// in milliseconds.
+	lastSample map[uint64]int64
+
+	// pairs holds the series of every combination of values of the
+	// configured label pairs.
+	labelPairs labelPairs
+	pairsMtx   sync.RWMutex
+	pairs      map[pairKey]*roaring64.Bitmap
+
+	// metrics holds a sub-index of the series of every metric name.
+	metricsMtx sync.RWMutex
+	metrics    map[string]*BitmapIndex
+
+	// cold holds the postings moved to disk, see Tier.
+	cold *coldTier
+
+	added      atomic.Int64
+	lastUpdate atomic.Int64
+}
+
+// labelShard holds everything the index knows about a single label name.
+type labelShard struct {
+	mtx     sync.RWMutex
+	symbols *SymbolTable
+	// values is keyed by the symbol of the value.
+	values map[uint32]*valueEntry
+	// bucketed replaces values once the label has too many of them.
+	bucketed *sketchcore.ValueBuckets[*roaring64.Bitmap]
+	// present holds the series that have the label.
+	present *roaring64.Bitmap
+	// modified is when a series was last added, and optimized the value of
+	// modified when the bitmaps were last optimized, in Unix nanoseconds.
+	modified  int64
+	optimized int64
+	// collapsed is set once values share their bitmap, see
+	// CollapseValuePattern.
+	collapsed bool
+	// cold is the cold tier of the index, if any. Queries record when they
+	// selected a value only when it is set.
+	cold *coldTier
+	// presence holds the values, if the index was created
+	// WithValuePresence, until the label is bucketed.
+	presence *cuckooFilter
+}
+
+// valueEntry holds the series of a label value and their statistics.
+type valueEntry struct {
+	postings *roaring64.Bitmap
+	stat     valueStat
+	// lastSeen is the time the value was last added at, and lastQueried
+	// the time it was last selected by a query, in Unix nanoseconds.
+	lastSeen    int64
+	lastQueried atomic.Int64
+	// segment holds the postings of the value while they are cold, see
+	// Tier.
+	segment *tierSegment
 }
 
-func NewBitmapIndex() *BitmapIndex {
-	return &BitmapIndex{
-		index: make(map[string]map[string]*roaring64.Bitmap),
+func newLabelShard(symbols *SymbolTable) *labelShard {
+	return &labelShard{
+		symbols: symbols,
+		values:  make(map[uint32]*valueEntry),
+		present: roaring64.NewBitmap(),
 	}
 }
 
+// lookup returns the entry of a value, or nil. The caller must hold the lock.
+func (s *labelShard) lookup(value string) *valueEntry {
+	if !s.presence.contains(value) {
+		return nil
+	}
+	id, ok := s.symbols.Lookup(value)
+	if !ok {
+		return nil
+	}
+	return s.values[id]
+}
+
+// insert adds an entry for a value that has none. The caller must hold the
+// lock.
+func (s *labelShard) insert(value string) *valueEntry {
+	v := &valueEntry{postings: roaring64.NewBitmap()}
+	s.values[s.symbols.Ref(value)] = v
+	if s.presence != nil && !s.presence.insert(value) {
+		s.growPresence()
+	}
+	return v
+}
+
+// growPresence replaces the full presence filter by one with room for
+// twice the values. The caller must hold the lock.
+func (s *labelShard) growPresence() {
+	for size := 2 * len(s.values); ; size *= 2 {
+		f, ok := newCuckooFilter(size), true
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id := range s.values {
+				if ok = f.insert(str(id)); !ok {
+					break
+				}
+			}
+		})
+		if ok {
+			s.presence = f
+			return
+		}
+	}
+}
+
+// stats returns the statistics of the values. The caller must hold the lock.
+func (s *labelShard) stats() labelStats {
+	stats := make(labelStats, len(s.values))
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id, v := range s.values {
+			stats[str(id)] = &valueStat{series: v.stat.series, bytes: v.stat.bytes}
+		}
+	})
+	return stats
+}
+
+func NewBitmapIndex(opts ...Option) *BitmapIndex {
+	o := applyOptions(opts)
+	b := &BitmapIndex{
+		shards:    make(map[string]*labelShard),
+		symbols:   o.symbols,
+		bucketing: o.bucketing,
+		logger:    o.logger,
+		ttl:       o.valueTTL,
+		relabel:   o.relabel,
+		guard:     newValueGuard(o.valueGuard),
+		presence:  o.valuePresence,
+		now:       time.Now,
+		seen:      newSeriesSet(o.dedup),
+		all:       roaring64.NewBitmap(),
+	}
+	if b.symbols == nil {
+		b.symbols = NewSymbolTable()
+	}
+	if len(o.labelPairs) > 0 {
+		b.labelPairs = o.labelPairs
+		b.pairs = make(map[pairKey]*roaring64.Bitmap)
+	}
+	if o.cooccurrence {
+		b.cooc = NewCooccurrenceTracker()
+	}
+	if o.metricIndex {
+		b.metrics = make(map[string]*BitmapIndex)
+	}
+	// Tests replace now after construction.
+	b.filter = newSeenFilter(o.seenFilter.series, o.seenFilter.interval, func() time.Time { return b.now() })
+	if o.coldTierDir != "" {
+		b.cold = &coldTier{dir: o.coldTierDir, now: func() time.Time { return b.now() }, logger: b.logger}
+	}
+	if o.seriesHashes {
+		b.hashes = make(map[uint64]uint64)
+	}
+	if o.sampleEvery > 0 {
+		b.samples = make(map[uint64]labels.Labels)
+		b.sampleEvery = uint64(o.sampleEvery)
+	}
+	if o.seriesTypes {
+		b.histograms = make(map[uint64]uint32)
+		b.exemplars = roaring64.NewBitmap()
+	}
+	if o.activeSeries {
+		b.lastSample = make(map[uint64]int64)
+	}
+	if o.allocateRefs {
+		// The allocator already tells whether a series is new.
+		b.refs = newRefAllocator()
+		b.seen = nil
+	} else if o.valueTTL > 0 && o.dedup {
+		b.seenRefs = make(map[uint64]storage.SeriesRef)
+		b.seen = nil
+	}
+	if b.metrics != nil && b.seen != nil {
+		b.metricSeen = make(map[string]seriesSet)
+	}
+	return b
+}
+
+// shard returns the shard of the label name, or nil if there is none.
+func (b *BitmapIndex) shard(name string) *labelShard {
+	b.shardsMtx.RLock()
+	defer b.shardsMtx.RUnlock()
+	return b.shards[name]
+}
+
+// getOrCreateShard returns the shard of the label name, creating it if needed.
+func (b *BitmapIndex) getOrCreateShard(name string) *labelShard {
+	if s := b.shard(name); s != nil {
+		return s
+	}
+
+	b.shardsMtx.Lock()
+	defer b.shardsMtx.Unlock()
+	if s, ok := b.shards[name]; ok {
+		return s
+	}
+	s := newLabelShard(b.symbols)
+	s.cold = b.cold
+	if b.presence {
+		s.presence = newCuckooFilter(0)
+	}
+	b.shards[name] = s
+	return s
+}
+
+// forEachShard calls fn for every label name and its shard, without holding
+// the shards lock.
+func (b *BitmapIndex) forEachShard(fn func(name string, s *labelShard)) {
+	b.shardsMtx.RLock()
+	names := make([]string, 0, len(b.shards))
+	shards := make([]*labelShard, 0, len(b.shards))
+	for name, s := range b.shards {
+		names = append(names, name)
+		shards = append(shards, s)
+	}
+	b.shardsMtx.RUnlock()
+
+	for i, s := range shards {
+		fn(names[i], s)
+	}
+}
+
+func (b *BitmapIndex) TopLabelValues(name string, n int) []LabelValueStats {
+	s := b.shard(name)
+	if s == nil {
+		return []LabelValueStats{}
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.stats().TopLabelValues(n)
+}
+
+func (b *BitmapIndex) TopLabelValuesByBytes(name string, n int) []LabelValueStats {
+	s := b.shard(name)
+	if s == nil {
+		return []LabelValueStats{}
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.stats().TopLabelValuesByBytes(n)
+}
+
+// Cooccurrence returns the label co-occurrence statistics of the index, or nil
+// if the index was not created WithCooccurrenceTracking.
+func (b *BitmapIndex) Cooccurrence() *CooccurrenceTracker {
+	return b.cooc
+}
+
 func (b *BitmapIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	b.addSeries(lbls, ref)
+}
+
+// addSeries adds the series and returns its ref in the index, or false if
+// the relabel rules of the index dropped it or its seen filter skipped it.
+func (b *BitmapIndex) addSeries(lbls labels.Labels, ref storage.SeriesRef) (storage.SeriesRef, bool) {
+	if b.filter != nil && b.filter.seen(lbls.Hash()) {
+		return 0, false
+	}
+	lbls, ok := relabelSeries(b.relabel, lbls)
+	if !ok {
+		return 0, false
+	}
+	lbls, flagged := b.guard.check(lbls)
+	b.mtx.Lock()
+	isNew := true
+	switch {
+	case b.refs != nil:
+		ref, isNew = b.refs.ref(lbls)
+	case b.seenRefs != nil:
+		hash := lbls.Hash()
+		if existing, ok := b.seenRefs[hash]; ok {
+			ref, isNew = existing, false
+		} else {
+			b.seenRefs[hash] = ref
+		}
+	default:
+		isNew = b.seenSet(lbls).add(lbls.Hash())
+	}
+	if isNew {
+		b.guard.record(flagged)
+	}
+	// Known series are only re-added to refresh when their values were
+	// last seen.
+	if !isNew && b.ttl == 0 {
+		b.mtx.Unlock()
+		return ref, true
+	}
+	if isNew && b.cooc != nil {
+		b.cooc.AddSeries(lbls)
+	}
+	if isNew && b.hashes != nil {
+		b.hashes[uint64(ref)] = lbls.Hash()
+	}
+	if isNew && b.samples != nil && lbls.Hash()%b.sampleEvery == 0 {
+		b.samples[uint64(ref)] = lbls.Copy()
+	}
+	b.mtx.Unlock()
+
+	if isNew {
+		b.added.Add(1)
+	}
+	now := b.now().UnixNano()
+	b.lastUpdate.Store(now)
+
+	weight := seriesBytes(lbls)
 	for _, l := range lbls {
-		lName := internString(l.Name)
-		lValue := internString(l.Value)
+		if b.getOrCreateShard(l.Name).add(l.Value, uint64(ref), weight, b.bucketing, now) {
+			b.logger.Info("Bucketing label values", "label", l.Name)
+		}
+	}
+	// The series only joins all series once it has all its labels, or
+	// concurrent queries would see it without them, e.g. count it for
+	// job!="api" although its job is api.
+	b.mtx.Lock()
+	b.all.Add(uint64(ref))
+	b.mtx.Unlock()
+
+	if b.pairs != nil {
+		b.pairsMtx.Lock()
+		b.labelPairs.forEach(lbls, func(key pairKey) {
+			bitmap, ok := b.pairs[key]
+			if !ok {
+				bitmap = roaring64.NewBitmap()
+				b.pairs[key] = bitmap
+			}
+			bitmap.Add(uint64(ref))
+		})
+		b.pairsMtx.Unlock()
+	}
 
-		valueMap, ok := b.index[lName]
-		if !ok {
-			valueMap = make(map[string]*roaring64.Bitmap)
-			b.index[lName] = valueMap
+	if b.metrics != nil {
+		if name := lbls.Get(labels.MetricName); name != "" {
+			b.metricIndex(name, true).AddSeries(lbls, ref)
 		}
+	}
+	return ref, true
+}
 
-		bitmap, ok := valueMap[lValue]
-		if !ok {
-			bitmap = roaring64.NewBitmap()
-			valueMap[lValue] = bitmap
+// seenSet returns the set deduplicating the series. The caller must hold
+// the lock.
+func (b *BitmapIndex) seenSet(lbls labels.Labels) seriesSet {
+	name := lbls.Get(labels.MetricName)
+	if b.metricSeen == nil || name == "" {
+		return b.seen
+	}
+	seen, ok := b.metricSeen[name]
+	if !ok {
+		seen = make(seriesSet)
+		b.metricSeen[name] = seen
+	}
+	return seen
+}
+
+// forgetSeen drops the labels hashes of removed series from the seen sets,
+// so that the series are added again as new ones.
+func (b *BitmapIndex) forgetSeen(hashes []uint64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, hash := range hashes {
+		delete(b.seen, hash)
+		for _, seen := range b.metricSeen {
+			delete(seen, hash)
 		}
+	}
+}
+
+// metricIndex returns the sub-index of a metric, creating it if create is
+// set, or nil.
+func (b *BitmapIndex) metricIndex(name string, create bool) *BitmapIndex {
+	b.metricsMtx.RLock()
+	sub, ok := b.metrics[name]
+	b.metricsMtx.RUnlock()
+	if ok || !create {
+		return sub
+	}
+
+	b.metricsMtx.Lock()
+	defer b.metricsMtx.Unlock()
+	if sub, ok := b.metrics[name]; ok {
+		return sub
+	}
+	// The series are deduplicated and expired by the parent index.
+	// Sub-indexes share its symbols.
+	sub = &BitmapIndex{
+		shards:   make(map[string]*labelShard),
+		symbols:  b.symbols,
+		logger:   promslog.NewNopLogger(),
+		now:      b.now,
+		seen:     newSeriesSet(false),
+		all:      roaring64.NewBitmap(),
+		cold:     b.cold,
+		presence: b.presence,
+	}
+	b.metrics[name] = sub
+	return sub
+}
 
-		bitmap.Add(uint64(ref))
+// metricMatchers returns the metric name of an equality matcher on
+// __name__, and the other matchers.
+func metricMatchers(matchers []*labels.Matcher) (string, []*labels.Matcher, bool) {
+	for i, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value != "" {
+			return m.Value, append(slices.Clone(matchers[:i]), matchers[i+1:]...), true
+		}
 	}
+	return "", nil, false
+}
+
+// pairCardinality returns the number of series with the values of a label
+// pair that match the other matchers.
+func (b *BitmapIndex) pairCardinality(ctx context.Context, key pairKey, rest []*labels.Matcher) int64 {
+	var intersection *roaring64.Bitmap
+	if len(rest) > 0 {
+		intersection = b.getIntersectionBitmap(ctx, rest)
+	}
+
+	b.pairsMtx.RLock()
+	defer b.pairsMtx.RUnlock()
+	bitmap, ok := b.pairs[key]
+	switch {
+	case !ok:
+		return 0
+	case intersection == nil:
+		return int64(bitmap.GetCardinality())
+	default:
+		return int64(bitmap.AndCardinality(intersection))
+	}
+}
+
+// add adds the series to the label value. It reports whether the values of
+// the label were bucketed as a result.
+func (s *labelShard) add(value string, ref uint64, weight int64, bucketing bucketing, now int64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.present.Add(ref)
+	s.modified = now
+
+	if s.bucketed != nil {
+		s.bucketed.Bucket(value).Add(ref)
+		return false
+	}
+
+	v := s.lookup(value)
+	if v == nil {
+		v = s.insert(value)
+	}
+	v.lastSeen = now
+	v.warm()
+	if v.postings.CheckedAdd(ref) {
+		v.stat.series++
+		v.stat.bytes += weight
+	}
+
+	if bucketing.shouldBucket(len(s.values)) {
+		s.bucketValues(bucketing.buckets)
+		return true
+	}
+	return false
+}
+
+// bucketValues moves the values of the label into value buckets. The caller
+// must hold the lock.
+func (s *labelShard) bucketValues(n int) {
+	buckets := sketchcore.NewValueBuckets(n, roaring64.NewBitmap)
+	for id, v := range s.values {
+		buckets.Bucket(s.symbols.String(id)).Or(v.read())
+		v.release()
+		s.symbols.Release(id)
+	}
+	s.bucketed = buckets
+	s.values = make(map[uint32]*valueEntry)
+	s.presence = nil
+}
+
+// EvictStale drops the label values that haven't been added for longer than
+// the TTL configured WithValueTTL, and returns the number of values dropped.
+// The series of a stale value can't have been added since either, so they
+// are removed from the whole index, including the values they share with
+// live series. Series are only removed once one of their values goes stale.
+func (b *BitmapIndex) EvictStale() int {
+	if b.ttl == 0 {
+		return 0
+	}
+	cutoff := b.now().Add(-b.ttl).UnixNano()
+
+	evicted := 0
+	stale := roaring64.NewBitmap()
+	b.forEachShard(func(_ string, s *labelShard) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for id, v := range s.values {
+			if v.lastSeen < cutoff {
+				stale.Or(v.read())
+				s.delete(id)
+				evicted++
+			}
+		}
+	})
+	if stale.IsEmpty() {
+		return evicted
+	}
+	evicted += b.evictSeries(stale)
+	b.logger.Debug("Evicted stale label values", "values", evicted, "series", stale.GetCardinality())
+	return evicted
+}
+
+// evictSeries removes the series from the index and its metric
+// sub-indexes, and returns the number of values left without series.
+func (b *BitmapIndex) evictSeries(stale *roaring64.Bitmap) int {
+	evicted := b.removeSeries(stale)
+	if b.metrics != nil {
+		b.metricsMtx.Lock()
+		for name, sub := range b.metrics {
+			sub.removeSeries(stale)
+			if sub.all.IsEmpty() {
+				delete(b.metrics, name)
+			}
+		}
+		b.metricsMtx.Unlock()
+	}
+	return evicted
+}
+
+// EvictMetric removes the series of a metric from the whole index, e.g. to
+// drop a metric that was renamed or is no longer scraped, and returns the
+// number of series removed. It needs the sub-indexes kept
+// WithMetricNameIndex to find the series, and removes nothing otherwise.
+// Series of the metric added again afterwards are counted as new.
+func (b *BitmapIndex) EvictMetric(name string) int {
+	b.metricsMtx.Lock()
+	sub, ok := b.metrics[name]
+	delete(b.metrics, name)
+	b.metricsMtx.Unlock()
+	if !ok {
+		return 0
+	}
+
+	sub.mtx.RLock()
+	stale := sub.all.Clone()
+	sub.mtx.RUnlock()
+	b.mtx.Lock()
+	delete(b.metricSeen, name)
+	b.mtx.Unlock()
+	b.removeSeries(stale)
+	if sub.cold != nil {
+		sub.releaseCold()
+	}
+
+	b.logger.Debug("Evicted metric", "metric", name, "series", stale.GetCardinality())
+	return int(stale.GetCardinality())
+}
+
+// removeSeries removes the series from the whole index and returns the
+// number of values left without series, which are dropped.
+func (b *BitmapIndex) removeSeries(stale *roaring64.Bitmap) int {
+	// The series leave all series before their labels, see addSeries.
+	b.mtx.Lock()
+	b.all.AndNot(stale)
+	b.mtx.Unlock()
+
+	evicted := 0
+	b.forEachShard(func(_ string, s *labelShard) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.present.AndNot(stale)
+		if s.bucketed != nil {
+			for _, bitmap := range s.bucketed.Buckets {
+				bitmap.AndNot(stale)
+			}
+		}
+		if s.collapsed {
+			evicted += s.removeShared(stale)
+		}
+		for id, v := range s.values {
+			if !v.postings.Intersects(stale) {
+				// Values sharing a bitmap emptied through another value.
+				if s.collapsed && v.postings.IsEmpty() {
+					s.delete(id)
+					evicted++
+				}
+				continue
+			}
+			before := v.postings.GetCardinality()
+			v.warm()
+			v.postings.AndNot(stale)
+			after := v.postings.GetCardinality()
+			if after == 0 {
+				s.delete(id)
+				evicted++
+				continue
+			}
+			// Bytes aren't tracked per series, so they shrink in proportion.
+			v.stat.bytes = v.stat.bytes * int64(after) / int64(before)
+			v.stat.series = int64(after)
+		}
+	})
+
+	b.pairsMtx.Lock()
+	for key, bitmap := range b.pairs {
+		bitmap.AndNot(stale)
+		if bitmap.IsEmpty() {
+			delete(b.pairs, key)
+		}
+	}
+	b.pairsMtx.Unlock()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for hash, ref := range b.seenRefs {
+		if stale.Contains(uint64(ref)) {
+			delete(b.seenRefs, hash)
+		}
+	}
+	if b.refs != nil {
+		b.refs.forget(stale)
+	}
+	if b.hashes != nil || b.samples != nil || b.histograms != nil || b.lastSample != nil {
+		for it := stale.Iterator(); it.HasNext(); {
+			ref := it.Next()
+			delete(b.hashes, ref)
+			delete(b.samples, ref)
+			delete(b.histograms, ref)
+			delete(b.lastSample, ref)
+		}
+	}
+	if b.exemplars != nil {
+		b.exemplars.AndNot(stale)
+	}
+	return evicted
+}
+
+// delete drops a value from the shard. The caller must hold the lock.
+func (s *labelShard) delete(id uint32) {
+	if s.presence != nil {
+		s.presence.delete(s.symbols.String(id))
+	}
+	s.values[id].release()
+	delete(s.values, id)
+	s.symbols.Release(id)
+}
+
+// series returns the number of series with the value, if the shard is not
+// bucketed. It is safe to call on a nil shard.
+func (s *labelShard) series(value string) (int64, bool) {
+	if s == nil {
+		return 0, true
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.bucketed != nil {
+		return 0, false
+	}
+	if v := s.lookup(value); v != nil {
+		v.touch(s.cold.queryTime())
+		return int64(v.postings.GetCardinality()), true
+	}
+	return 0, true
 }
 
 func (b *BitmapIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return b.GetCardinalityContext(context.Background(), matchers...)
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns
+// ErrUnknownLabel for matchers on labels without series, and the errors of
+// the QueryContext of ctx.
+func (b *BitmapIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, b, func(name string) bool { return b.shard(name) != nil }, matchers)
+}
+
+func (b *BitmapIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) (card int64) {
+	ctx, span := tracer.Start(ctx, "BitmapIndex.GetCardinality")
+	defer func() {
+		span.SetAttributes(attribute.Int64("cardinality", card))
+		span.End()
+	}()
+	setSpanMatchers(span, matchers...)
+
 	if len(matchers) == 0 {
 		return 0
 	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0
+	}
+
+	// Fast path: a single equality matcher is answered by the stored bitmap
+	// without cloning it.
+	if len(matchers) == 1 && matchers[0].Type == labels.MatchEqual && matchers[0].Value != "" {
+		if card, ok := b.shard(matchers[0].Name).series(matchers[0].Value); ok {
+			return card
+		}
+	}
+
+	if b.metrics != nil {
+		if name, rest, ok := metricMatchers(matchers); ok {
+			sub := b.metricIndex(name, false)
+			switch {
+			case sub == nil:
+				return 0
+			case len(rest) == 0:
+				sub.mtx.RLock()
+				defer sub.mtx.RUnlock()
+				return int64(sub.all.GetCardinality())
+			}
+			return sub.GetCardinalityContext(ctx, rest...)
+		}
+	}
+
+	q := QueryFromContext(ctx)
+	q.begin()
+	if key, rest, ok := b.labelPairs.match(matchers); ok {
+		card = b.pairCardinality(ctx, key, rest)
+	} else {
+		card = int64(b.getIntersectionBitmap(ctx, matchers).GetCardinality())
+	}
+	if q.exceeded() {
+		return 0
+	}
+	return card
+}
+
+// Stats returns the size of the index. Memory counts the bitmaps, the
+// symbol table and the value sketches of bucketed labels, whose values are
+// estimated. A symbol table shared by several indexes is counted by each of
+// them.
+func (b *BitmapIndex) Stats() IndexStats {
+	stats := IndexStats{MemoryBytes: b.symbols.Size()}
+	b.addStats(&stats)
+	if b.cold != nil {
+		stats.DiskBytes = b.cold.bytes.Load()
+	}
+
+	b.metricsMtx.RLock()
+	for _, sub := range b.metrics {
+		// Only the memory counts, the labels and series are the parent's.
+		var subStats IndexStats
+		sub.addStats(&subStats)
+		stats.MemoryBytes += subStats.MemoryBytes
+	}
+	b.metricsMtx.RUnlock()
+	return stats
+}
+
+// addStats adds the statistics of the index structures, without the symbol
+// table, to stats.
+func (b *BitmapIndex) addStats(stats *IndexStats) {
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		stats.LabelNames++
+		stats.MemoryBytes += int64(len(name)) + int64(s.present.GetSizeInBytes()) + s.presence.size()
+		var counted map[*roaring64.Bitmap]struct{}
+		if s.collapsed {
+			counted = make(map[*roaring64.Bitmap]struct{})
+		}
+		for _, v := range s.values {
+			if v.segment != nil {
+				continue
+			}
+			if counted != nil {
+				if _, ok := counted[v.postings]; ok {
+					continue
+				}
+				counted[v.postings] = struct{}{}
+			}
+			stats.MemoryBytes += int64(v.postings.GetSizeInBytes())
+		}
+		stats.LabelValues += len(s.values)
+		if s.bucketed != nil {
+			stats.MemoryBytes += int64(sketchcore.SketchSize)
+			for _, bitmap := range s.bucketed.Buckets {
+				stats.MemoryBytes += int64(bitmap.GetSizeInBytes())
+			}
+			stats.LabelValues += s.bucketed.Values()
+		}
+	})
+
+	b.pairsMtx.RLock()
+	for key, bitmap := range b.pairs {
+		stats.MemoryBytes += int64(len(key.values[0])+len(key.values[1])) + int64(bitmap.GetSizeInBytes())
+	}
+	b.pairsMtx.RUnlock()
 
-	intersectionBitmap := b.getUnionBitmapForMatcher(matchers[0])
+	b.mtx.RLock()
+	stats.Series = int64(b.all.GetCardinality())
+	stats.MemoryBytes += int64(b.all.GetSizeInBytes())
+	b.mtx.RUnlock()
 
+	stats.SeriesAdded = b.added.Load()
+	if t := b.lastUpdate.Load(); t != 0 {
+		stats.LastUpdate = time.Unix(0, t)
+	}
+}
+
+// GetCardinalityWithPostings returns the number of series in p that match
+// the matchers, for callers that already restricted the series, e.g. to a
+// shard or a tenant. The postings must be refs of the series as added to
+// the index. Without matchers, the series of p in the index are counted.
+func (b *BitmapIndex) GetCardinalityWithPostings(p index.Postings, matchers ...*labels.Matcher) (int64, error) {
+	_, span := tracer.Start(context.Background(), "BitmapIndex.GetCardinalityWithPostings")
+	defer span.End()
+	setSpanMatchers(span, matchers...)
+
+	restrict := roaring64.NewBitmap()
+	for p.Next() {
+		restrict.Add(uint64(p.At()))
+	}
+	if err := p.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating postings: %w", err)
+	}
+
+	if len(matchers) == 0 {
+		b.mtx.RLock()
+		defer b.mtx.RUnlock()
+		return int64(restrict.AndCardinality(b.all)), nil
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0, nil
+	}
+	return int64(b.getIntersectionBitmap(context.Background(), matchers).AndCardinality(restrict)), nil
+}
+
+func (b *BitmapIndex) GetMatchingRefs(matchers ...*labels.Matcher) ([]storage.SeriesRef, error) {
+	return b.GetMatchingRefsContext(context.Background(), matchers...)
+}
+
+// GetMatchingRefsContext returns the refs of the series matching the
+// matchers, in ascending order, so that callers can fetch the series the
+// index counts, using it as a secondary index. The refs are the ones given
+// to AddSeries, or the allocated ones with WithAllocatedRefs. The refs are
+// exact, except for matchers on bucketed labels and for queries reaching
+// their QueryLimits, which return a superset of the matching series:
+// callers should check the labels of the series they fetch.
+func (b *BitmapIndex) GetMatchingRefsContext(ctx context.Context, matchers ...*labels.Matcher) ([]storage.SeriesRef, error) {
+	ctx, span := tracer.Start(ctx, "BitmapIndex.GetMatchingRefs")
+	defer span.End()
+	setSpanMatchers(span, matchers...)
+
+	if err := checkMatchers(matchers); err != nil {
+		return nil, err
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return nil, nil
+	}
+
+	q := QueryFromContext(ctx)
+	q.begin()
+	bitmap := b.getIntersectionBitmap(ctx, matchers)
+	if q != nil && q.Err() != nil {
+		return nil, q.Err()
+	}
+	refs := make([]storage.SeriesRef, 0, bitmap.GetCardinality())
+	it := bitmap.Iterator()
+	for it.HasNext() {
+		refs = append(refs, storage.SeriesRef(it.Next()))
+	}
+	span.SetAttributes(attribute.Int("refs", len(refs)))
+	return refs, nil
+}
+
+func (b *BitmapIndex) LabelNames(matchers ...*labels.Matcher) []string {
+	var intersectionBitmap *roaring64.Bitmap
+	if len(matchers) > 0 {
+		intersectionBitmap = b.getIntersectionBitmap(context.Background(), matchers)
+		if intersectionBitmap.IsEmpty() {
+			return nil
+		}
+	}
+
+	var names []string
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		if intersectionBitmap == nil || s.present.Intersects(intersectionBitmap) {
+			names = append(names, name)
+		}
+	})
+	slices.Sort(names)
+	return names
+}
+
+// LabelValues returns the values of the label. The values of bucketed
+// labels aren't kept, so there are none; ShardStats reports which labels
+// are bucketed and estimates their values.
+func (b *BitmapIndex) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	var intersectionBitmap *roaring64.Bitmap
+	if len(matchers) > 0 {
+		intersectionBitmap = b.getIntersectionBitmap(context.Background(), matchers)
+		if intersectionBitmap.IsEmpty() {
+			return nil
+		}
+	}
+
+	s := b.shard(name)
+	if s == nil {
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var values []string
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id, v := range s.values {
+			if intersectionBitmap == nil || v.postings.Intersects(intersectionBitmap) {
+				values = append(values, str(id))
+			}
+		}
+	})
+	slices.Sort(values)
+	return values
+}
+
+// getIntersectionBitmap returns the series matching all matchers. The
+// bitmaps are taken from the QueryContext of ctx, if any; the result is empty
+// once the query runs out of budget.
+func (b *BitmapIndex) getIntersectionBitmap(ctx context.Context, matchers []*labels.Matcher) *roaring64.Bitmap {
+	intersectionBitmap := b.getUnionBitmapForMatcher(ctx, matchers[0])
+
+	q := QueryFromContext(ctx)
 	for _, matcher := range matchers[1:] {
-		matcherBitmap := b.getUnionBitmapForMatcher(matcher)
+		// Leaving out matchers only makes the answer larger.
+		if !q.merge() {
+			break
+		}
+		matcherBitmap := b.getUnionBitmapForMatcher(ctx, matcher)
 		intersectionBitmap.And(matcherBitmap)
 
 		if intersectionBitmap.IsEmpty() {
-			return 0
+			break
 		}
 	}
+	if q.exceeded() {
+		intersectionBitmap.Clear()
+	}
 
-	return int64(intersectionBitmap.GetCardinality())
+	return intersectionBitmap
 }
 
-func (b *BitmapIndex) getUnionBitmapForMatcher(matcher *labels.Matcher) *roaring64.Bitmap {
-	unionBitmap := roaring64.NewBitmap()
+func (b *BitmapIndex) getUnionBitmapForMatcher(ctx context.Context, matcher *labels.Matcher) (unionBitmap *roaring64.Bitmap) {
+	_, span := tracer.Start(ctx, "BitmapIndex.getUnionBitmapForMatcher")
+	defer func() {
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Int64("cardinality", int64(unionBitmap.GetCardinality())))
+		}
+		span.End()
+	}()
+	setSpanMatchers(span, matcher)
+
+	q := QueryFromContext(ctx)
+	unionBitmap = q.bitmap()
+	if q.exceeded() {
+		return unionBitmap
+	}
+	defer func() {
+		q.charge(int64(unionBitmap.GetSizeInBytes()))
+	}()
+
+	// As in PromQL, a matcher that matches the empty string also selects the
+	// series without the label. All series are read under the lock of the
+	// shard, or a series evicted meanwhile could be in all series but no
+	// longer in the label, and counted as without it, see removeSeries.
+	s := b.shard(matcher.Name)
+	if s == nil {
+		if matcher.Matches("") {
+			b.mtx.RLock()
+			unionBitmap.Or(b.all)
+			b.mtx.RUnlock()
+		}
+		return unionBitmap
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if matcher.Matches("") {
+		b.mtx.RLock()
+		unionBitmap.Or(b.all)
+		b.mtx.RUnlock()
+		unionBitmap.AndNot(s.present)
+	}
+	queried := s.cold.queryTime()
+	q.beginMatcher()
+	// complete is cleared once the matcher runs out of the limits of the
+	// query, and the result is widened to an upper bound.
+	complete := true
+	defer func() {
+		if !complete {
+			// Every matching value is a subset of the label.
+			unionBitmap.Or(s.present)
+		}
+	}()
 
-	if valueMap, ok := b.index[matcher.Name]; ok {
-		switch matcher.Type {
-		case labels.MatchEqual:
-			if bitmap, exists := valueMap[matcher.Value]; exists {
-				unionBitmap.Or(bitmap) // Exact match: Add the single bitmap
+	if s.bucketed != nil {
+		s.bucketed.ForEachMatching(matcher, func(bitmap *roaring64.Bitmap) {
+			if complete = complete && q.merge(); complete {
+				unionBitmap.Or(bitmap)
 			}
+		})
+		return unionBitmap
+	}
 
-		case labels.MatchRegexp:
-			for value, bitmap := range valueMap {
-				if matcher.Matches(value) {
-					unionBitmap.Or(bitmap) // Regex match: Union all matching bitmaps
-				}
+	switch matcher.Type {
+	case labels.MatchEqual:
+		if v := s.lookup(matcher.Value); v != nil {
+			if complete = q.merge(); complete {
+				v.touch(queried)
+				unionBitmap.Or(v.read()) // Exact match: Add the single bitmap
 			}
+		}
 
-		case labels.MatchNotEqual:
-			for value, bitmap := range valueMap {
-				if value != matcher.Value {
-					unionBitmap.Or(bitmap) // Exclude the specified value
-				}
+	case labels.MatchNotEqual:
+		excluded, ok := s.symbols.Lookup(matcher.Value)
+		for id, v := range s.values {
+			if complete = q.scan(); !complete {
+				break
+			}
+			if ok && id == excluded {
+				continue // Exclude the specified value
 			}
+			if complete = q.merge(); !complete {
+				break
+			}
+			v.touch(queried)
+			unionBitmap.Or(v.read())
+		}
 
-		case labels.MatchNotRegexp:
-			for value, bitmap := range valueMap {
-				if !matcher.Matches(value) {
-					unionBitmap.Or(bitmap) // Exclude values matching the regex
+	case labels.MatchRegexp, labels.MatchNotRegexp:
+		// Set matches like a|b|c look up their values instead of scanning
+		// the label.
+		if set := matcher.SetMatches(); matcher.Type == labels.MatchRegexp && len(set) > 0 && len(set) < len(s.values) {
+			for _, value := range set {
+				v := s.lookup(value)
+				if v == nil {
+					continue
 				}
+				if complete = q.merge(); !complete {
+					break
+				}
+				v.touch(queried)
+				unionBitmap.Or(v.read())
 			}
+			break
 		}
+		// Matches already negates the regex of MatchNotRegexp.
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				if complete = q.scan(); !complete {
+					break
+				}
+				if matcher.Matches(str(id)) {
+					if complete = q.merge(); !complete {
+						break
+					}
+					v.touch(queried)
+					unionBitmap.Or(v.read()) // Regex match: Union all matching bitmaps
+				}
+			}
+		})
 	}
 
 	return unionBitmap
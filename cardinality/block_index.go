@@ -2,114 +2,66 @@ package cardinality
 
 import (
 	"context"
-	"fmt"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
-	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/util/teststorage"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"sync/atomic"
 )
 
+// BlockIndex answers from the postings of the head of a test storage. It
+// is exact and serves as the reference the other indexes are tested
+// against. Errors reading the head are logged and answered as no series.
 type BlockIndex struct {
-	store *teststorage.TestStorage
+	store  *teststorage.TestStorage
+	logger *slog.Logger
+	errors atomic.Int64
 }
 
-func NewBlockIndex(store *teststorage.TestStorage) *BlockIndex {
-	return &BlockIndex{store}
+func NewBlockIndex(store *teststorage.TestStorage, opts ...Option) *BlockIndex {
+	o := applyOptions(opts)
+	return &BlockIndex{store: store, logger: o.logger}
 }
 
 func (b *BlockIndex) AddSeries(_ labels.Labels, _ storage.SeriesRef) {}
 
 func (b *BlockIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return b.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (b *BlockIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) (card int64) {
+	ctx, span := tracer.Start(ctx, "BlockIndex.GetCardinality")
+	defer func() {
+		span.SetAttributes(attribute.Int64("cardinality", card))
+		span.End()
+	}()
+	setSpanMatchers(span, matchers...)
+
 	// Get the head block from the test storage
 	head := b.store.Head()
 
 	// Retrieve the index reader for querying postings
 	indexReader, err := head.Index()
 	if err != nil {
-		panic(fmt.Sprintf("failed to get index reader: %v", err))
+		b.errors.Add(1)
+		b.logger.Error("Failed to get index reader", "err", err)
+		return 0
 	}
 	defer indexReader.Close()
 
-	// Get postings for the matchers
-	var postings index.Postings
-	for _, matcher := range matchers {
-		var matcherPostings index.Postings
-
-		switch matcher.Type {
-		case labels.MatchEqual:
-			// Get postings for exact match
-			matcherPostings, err = indexReader.Postings(context.TODO(), matcher.Name, matcher.Value)
-			if err != nil {
-				panic(fmt.Sprintf("failed to get postings for matcher %s: %v", matcher.String(), err))
-			}
-
-		case labels.MatchNotEqual:
-			// Get all postings for the label and exclude the specified value
-			allPostings, err := indexReader.Postings(context.TODO(), matcher.Name, "")
-			if err != nil {
-				panic(fmt.Sprintf("failed to get all postings for label %s: %v", matcher.Name, err))
-			}
-			excludedPostings, err := indexReader.Postings(context.TODO(), matcher.Name, matcher.Value)
-			if err != nil {
-				panic(fmt.Sprintf("failed to get excluded postings for value %s: %v", matcher.Value, err))
-			}
-			matcherPostings = index.Without(allPostings, excludedPostings)
-
-		case labels.MatchRegexp:
-			// Iterate over all label values and match against the regex
-			matcherPostings = nil
-			allValues, err := indexReader.LabelValues(context.TODO(), matcher.Name)
-			if err != nil {
-				panic(fmt.Sprintf("failed to get all values for label %s: %v", matcher.Name, err))
-			}
-			for _, value := range allValues {
-				if matcher.Matches(value) {
-					valuePostings, err := indexReader.Postings(context.TODO(), matcher.Name, value)
-					if err != nil {
-						panic(fmt.Sprintf("failed to get postings for value %s: %v", value, err))
-					}
-					if matcherPostings == nil {
-						matcherPostings = valuePostings
-					} else {
-						matcherPostings = index.Merge(context.TODO(), matcherPostings, valuePostings)
-					}
-				}
-			}
-
-		case labels.MatchNotRegexp:
-			// Iterate over all label values and exclude matches against the regex
-			matcherPostings = nil
-			allValues, err := indexReader.LabelValues(context.TODO(), matcher.Name)
-			if err != nil {
-				panic(fmt.Sprintf("failed to get all values for label %s: %v", matcher.Name, err))
-			}
-			for _, value := range allValues {
-				if !matcher.Matches(value) {
-					valuePostings, err := indexReader.Postings(context.TODO(), matcher.Name, value)
-					if err != nil {
-						panic(fmt.Sprintf("failed to get postings for value %s: %v", value, err))
-					}
-					if matcherPostings == nil {
-						matcherPostings = valuePostings
-					} else {
-						matcherPostings = index.Merge(context.TODO(), matcherPostings, valuePostings)
-					}
-				}
-			}
-		}
-
-		if matcherPostings == nil {
-			// No postings found for the matcher; no series match
-			return 0
-		}
-
-		if postings == nil {
-			// Initialize with the first matcher
-			postings = matcherPostings
-		} else {
-			// Intersect postings for subsequent matchers
-			postings = index.Intersect(postings, matcherPostings)
-		}
+	if len(matchers) == 0 {
+		return 0
+	}
+
+	// Select the postings the same way the TSDB querier does, so that the
+	// answers follow PromQL semantics, e.g. for matchers matching "".
+	postings, err := tsdb.PostingsForMatchers(ctx, indexReader, matchers...)
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error("Failed to get postings for matchers", "matchers", matcherStrings(matchers), "err", err)
+		return 0
 	}
 
 	// Iterate over the postings to count the number of series
@@ -119,8 +71,60 @@ func (b *BlockIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
 	}
 
 	if err := postings.Err(); err != nil {
-		panic(fmt.Sprintf("error iterating postings: %v", err))
+		b.errors.Add(1)
+		b.logger.Error("Failed to iterate postings", "matchers", matcherStrings(matchers), "err", err)
+		return 0
 	}
 
 	return cardinality
 }
+
+// GetCardinalityChecked is like GetCardinalityContext but checks the
+// matchers and the budget of the QueryContext of ctx.
+func (b *BlockIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, b, nil, matchers)
+}
+
+func (b *BlockIndex) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	indexReader, err := b.store.Head().Index()
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error("Failed to get index reader", "err", err)
+		return nil
+	}
+	defer indexReader.Close()
+
+	values, err := indexReader.SortedLabelValues(context.TODO(), name, matchers...)
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error("Failed to get label values", "label", name, "err", err)
+		return nil
+	}
+	return values
+}
+
+func (b *BlockIndex) LabelNames(matchers ...*labels.Matcher) []string {
+	indexReader, err := b.store.Head().Index()
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error("Failed to get index reader", "err", err)
+		return nil
+	}
+	defer indexReader.Close()
+
+	names, err := indexReader.LabelNames(context.TODO(), matchers...)
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error("Failed to get label names", "err", err)
+		return nil
+	}
+	return names
+}
+
+// Stats returns the number of series in the head and the errors reading it.
+func (b *BlockIndex) Stats() IndexStats {
+	return IndexStats{
+		Series: int64(b.store.Head().NumSeries()),
+		Errors: b.errors.Load(),
+	}
+}
@@ -0,0 +1,211 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// BlockRetention keeps a long-running BitmapIndex in sync with the
+// retention of the TSDB blocks it was built from, without rebuilding it
+// like a Reindexer does. It remembers the series of every block it added,
+// and once a block is deleted, removes the series no other block has. The
+// index must allocate its own refs, WithAllocatedRefs, so that a series has
+// the same ref in every block. Series outside of blocks, e.g. of a head,
+// must be added with AddSeries to be kept: a series added to the index
+// directly shares the ref of the same series of a block, and is removed
+// with the block. Series an index created WithSeenFilter skipped while a
+// block was added aren't removed. It costs a bitmap of series refs per
+// block.
+type BlockRetention struct {
+	index *BitmapIndex
+	opts  []BuildOption
+
+	// mtx serializes adding and removing blocks and series.
+	mtx    sync.Mutex
+	blocks map[ulid.ULID]*roaring64.Bitmap
+	// head holds the refs of the series added with AddSeries that no block
+	// added since has.
+	head *roaring64.Bitmap
+}
+
+// NewBlockRetention returns a BlockRetention for the index, reading blocks
+// with the build options.
+func NewBlockRetention(index *BitmapIndex, opts ...BuildOption) (*BlockRetention, error) {
+	if index.refs == nil {
+		return nil, errors.New("block retention needs an index with allocated refs")
+	}
+	return &BlockRetention{
+		index:  index,
+		opts:   opts,
+		blocks: make(map[ulid.ULID]*roaring64.Bitmap),
+		head:   roaring64.NewBitmap(),
+	}, nil
+}
+
+// AddSeries adds a series that isn't in a block, e.g. of a head, to the
+// index, keeping it when blocks are removed until a block with the series
+// is added, e.g. once the head is compacted. A series still in the head
+// after that must be added again to be kept once that block is removed.
+// The ref is ignored, as the index allocates its own.
+func (r *BlockRetention) AddSeries(lbls labels.Labels, _ storage.SeriesRef) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if ref, ok := r.index.addSeries(lbls, 0); ok {
+		r.head.Add(uint64(ref))
+	}
+}
+
+// Blocks returns the IDs of the blocks in the index, sorted.
+func (r *BlockRetention) Blocks() []ulid.ULID {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ids := make([]ulid.ULID, 0, len(r.blocks))
+	for id := range r.blocks {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b ulid.ULID) int { return a.Compare(b) })
+	return ids
+}
+
+// AddBlock adds the series of a block to the index, remembering them as
+// the series of the block id. Adding a known block does nothing.
+func (r *BlockRetention) AddBlock(ctx context.Context, id ulid.ULID, block tsdb.BlockReader) error {
+	return r.addBlock(id, func(add func(labels.Labels, storage.SeriesRef)) error {
+		return buildFromBlock(ctx, block, add, applyBuildOptions(r.opts))
+	})
+}
+
+func (r *BlockRetention) addBlock(id ulid.ULID, build func(add func(labels.Labels, storage.SeriesRef)) error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.blocks[id]; ok {
+		return nil
+	}
+
+	series := roaring64.NewBitmap()
+	err := build(func(lbls labels.Labels, _ storage.SeriesRef) {
+		if ref, ok := r.index.addSeries(lbls, 0); ok {
+			series.Add(uint64(ref))
+		}
+	})
+	if err != nil {
+		// Series already added stay until another block holding them is
+		// deleted.
+		return err
+	}
+	series.RunOptimize()
+	r.blocks[id] = series
+	r.head.AndNot(series)
+	return nil
+}
+
+// RemoveBlock removes the series of a deleted block that no other block
+// has from the index, and returns the number of series removed.
+func (r *BlockRetention) RemoveBlock(id ulid.ULID) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	stale, ok := r.blocks[id]
+	if !ok {
+		return 0
+	}
+	delete(r.blocks, id)
+	for _, series := range r.blocks {
+		stale.AndNot(series)
+	}
+	stale.AndNot(r.head)
+	if stale.IsEmpty() {
+		return 0
+	}
+	r.index.evictSeries(stale)
+	r.index.logger.Debug("Removed series of deleted block", "block", id, "series", stale.GetCardinality())
+	return int(stale.GetCardinality())
+}
+
+// SyncDir adds the blocks of a TSDB data directory the index doesn't have,
+// and removes the blocks that were deleted from it, e.g. by retention.
+func (r *BlockRetention) SyncDir(ctx context.Context, dir string) error {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return err
+	}
+	present := make(map[ulid.ULID]bool, len(dirs))
+	o := applyBuildOptions(r.opts)
+	for _, name := range dirs {
+		id := ulid.MustParse(name)
+		present[id] = true
+		if r.has(id) {
+			continue
+		}
+		block, err := tsdb.OpenBlock(o.logger, filepath.Join(dir, name), nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to open block %s: %w", name, err)
+		}
+		err = r.AddBlock(ctx, id, block)
+		block.Close()
+		if err != nil {
+			return fmt.Errorf("failed to index block %s: %w", name, err)
+		}
+	}
+	r.removeAbsent(present)
+	return nil
+}
+
+// SyncBucket adds the blocks of a tenant in a Mimir or Cortex blocks
+// storage bucket the index doesn't have, and removes the blocks that were
+// deleted or marked for deletion, according to the bucket index of the
+// tenant, see BuildFromBucket.
+func (r *BlockRetention) SyncBucket(ctx context.Context, bkt Bucket, tenant string) error {
+	bucketIndex, err := ReadBucketIndex(ctx, bkt, tenant)
+	if err != nil {
+		return err
+	}
+	present := make(map[ulid.ULID]bool, len(bucketIndex.Blocks))
+	for _, block := range bucketIndex.Blocks {
+		present[block.ID] = true
+	}
+	for _, mark := range bucketIndex.BlockDeletionMarks {
+		delete(present, mark.ID)
+	}
+
+	o := applyBuildOptions(r.opts)
+	for _, block := range bucketIndex.Blocks {
+		if !present[block.ID] || r.has(block.ID) {
+			continue
+		}
+		err := r.addBlock(block.ID, func(add func(labels.Labels, storage.SeriesRef)) error {
+			_, err := buildFromBucketBlock(ctx, bkt, tenant, block, add, o)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to index block %s of tenant %s: %w", block.ID, tenant, err)
+		}
+	}
+	r.removeAbsent(present)
+	return nil
+}
+
+// has reports whether the block was added.
+func (r *BlockRetention) has(id ulid.ULID) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.blocks[id]
+	return ok
+}
+
+// removeAbsent removes the blocks that aren't present.
+func (r *BlockRetention) removeAbsent(present map[ulid.ULID]bool) {
+	for _, id := range r.Blocks() {
+		if !present[id] {
+			r.RemoveBlock(id)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package cardinality
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bucketIndexFile is the name of the bucket index in the directory of a
+// tenant.
+const bucketIndexFile = "bucket-index.json.gz"
+
+// Bucket is the read access to object storage BuildFromBucket needs. It is
+// the Get method of the objstore.BucketReader used by Mimir, Cortex and
+// Thanos, so their buckets can be passed as is.
+type Bucket interface {
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// DirBucket is a Bucket of the files in a local directory, like the
+// filesystem backend of Mimir.
+type DirBucket string
+
+func (d DirBucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+// Upload writes the object to a temporary file renamed into place, so that
+// readers never see partial objects.
+func (d DirBucket) Upload(_ context.Context, name string, r io.Reader) error {
+	p := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Delete removes the object.
+func (d DirBucket) Delete(_ context.Context, name string) error {
+	return os.Remove(d.path(name))
+}
+
+// Iter calls f with the name of every object in dir, in lexical order,
+// leaving out subdirectories and temporary files. A missing dir has no
+// objects.
+func (d DirBucket) Iter(_ context.Context, dir string, f func(name string) error) error {
+	entries, err := os.ReadDir(d.path(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.Contains(e.Name(), ".tmp") {
+			continue
+		}
+		if err := f(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d DirBucket) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// BucketIndex is the part of the bucket index of a tenant, written by the
+// Mimir and Cortex compactors, that lists the blocks of the tenant.
+type BucketIndex struct {
+	Version            int                       `json:"version"`
+	Blocks             []BucketIndexBlock        `json:"blocks"`
+	BlockDeletionMarks []BucketIndexDeletionMark `json:"block_deletion_marks"`
+	// UpdatedAt is when the compactor last wrote the index, in Unix
+	// seconds.
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// BucketIndexBlock is a block of a BucketIndex. Times are in milliseconds,
+// MaxTime being exclusive.
+type BucketIndexBlock struct {
+	ID      ulid.ULID `json:"block_id"`
+	MinTime int64     `json:"min_time"`
+	MaxTime int64     `json:"max_time"`
+	// CompactorShardID is set on the blocks of a tenant split by the
+	// split-and-merge compactor, which hold a shard of the series of their
+	// time range each.
+	CompactorShardID string `json:"compactor_shard_id,omitempty"`
+}
+
+// BucketIndexDeletionMark is a block of a BucketIndex the compactor marked
+// for deletion, at DeletionTime in Unix seconds.
+type BucketIndexDeletionMark struct {
+	ID           ulid.ULID `json:"block_id"`
+	DeletionTime int64     `json:"deletion_time"`
+}
+
+// ReadBucketIndex reads the bucket index of a tenant.
+func ReadBucketIndex(ctx context.Context, bkt Bucket, tenant string) (*BucketIndex, error) {
+	r, err := bkt.Get(ctx, path.Join(tenant, bucketIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket index of tenant %s: %w", tenant, err)
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket index of tenant %s: %w", tenant, err)
+	}
+	defer gz.Close()
+
+	var idx BucketIndex
+	if err := json.NewDecoder(gz).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("failed to decode bucket index of tenant %s: %w", tenant, err)
+	}
+	if idx.Version != 1 {
+		return nil, fmt.Errorf("unsupported bucket index version %d of tenant %s", idx.Version, tenant)
+	}
+	return &idx, nil
+}
+
+// BuildFromBucket adds the series of the blocks of a tenant in a Mimir or
+// Cortex blocks storage bucket to idx, for capacity planning over the
+// retention of the bucket rather than the few hours of a head. Blocks are
+// listed from the bucket index of the tenant, without the blocks marked for
+// deletion, whose series are in the blocks they were compacted into, and
+// only the blocks overlapping [mint, maxt] are read. The index headers of
+// the store-gateways hold no series, so the index of every block is
+// downloaded to a temporary file and memory-mapped while it is read. Series
+// are given refs of their own, as refs are only unique within a block;
+// series in several blocks are counted once as long as idx deduplicates by
+// labels, which is the default.
+func BuildFromBucket(ctx context.Context, bkt Bucket, tenant string, mint, maxt int64, idx CardinalityIndex, opts ...BuildOption) error {
+	var nextID storage.SeriesRef
+	return buildFromBucket(ctx, bkt, tenant, mint, maxt, func(lbls labels.Labels, _ storage.SeriesRef) {
+		nextID++
+		idx.AddSeries(lbls, nextID)
+	}, applyBuildOptions(opts))
+}
+
+// BuildTenantsFromBucket builds the index of every tenant in m from the
+// bucket, see BuildFromBucket.
+func BuildTenantsFromBucket(ctx context.Context, bkt Bucket, tenants []string, mint, maxt int64, m *TenantIndexManager, opts ...BuildOption) error {
+	o := applyBuildOptions(opts)
+	for _, tenant := range tenants {
+		var nextID storage.SeriesRef
+		err := buildFromBucket(ctx, bkt, tenant, mint, maxt, func(lbls labels.Labels, _ storage.SeriesRef) {
+			nextID++
+			m.AddSeries(tenant, lbls, nextID)
+		}, o)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func buildFromBucket(ctx context.Context, bkt Bucket, tenant string, mint, maxt int64, add func(labels.Labels, storage.SeriesRef), o buildOptions) error {
+	start := time.Now()
+	bucketIndex, err := ReadBucketIndex(ctx, bkt, tenant)
+	if err != nil {
+		return err
+	}
+	deleted := make(map[ulid.ULID]bool, len(bucketIndex.BlockDeletionMarks))
+	for _, mark := range bucketIndex.BlockDeletionMarks {
+		deleted[mark.ID] = true
+	}
+
+	blocks, series := 0, 0
+	for _, block := range bucketIndex.Blocks {
+		if deleted[block.ID] || block.MaxTime <= mint || block.MinTime > maxt {
+			continue
+		}
+		done, err := buildFromBucketBlock(ctx, bkt, tenant, block, add, o)
+		if err != nil {
+			return fmt.Errorf("failed to index block %s of tenant %s: %w", block.ID, tenant, err)
+		}
+		blocks++
+		series += done
+	}
+	o.logger.Info("Indexed tenant from bucket", "tenant", tenant, "blocks", blocks, "series", series, "duration", time.Since(start))
+	return nil
+}
+
+// buildFromBucketBlock downloads the index of a block and adds its series,
+// returning their number.
+func buildFromBucketBlock(ctx context.Context, bkt Bucket, tenant string, block BucketIndexBlock, add func(labels.Labels, storage.SeriesRef), o buildOptions) (int, error) {
+	r, err := bkt.Get(ctx, path.Join(tenant, block.ID.String(), "index"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get index: %w", err)
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "cardinality-index-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to download index: %w", err)
+	}
+
+	indexReader, err := index.NewFileReader(f.Name(), index.DecodePostingsRaw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer indexReader.Close()
+	done, _, err := buildFromIndex(ctx, indexReader, add, o)
+	if err != nil {
+		return 0, err
+	}
+	o.logger.Debug("Indexed block", "tenant", tenant, "block", block.ID, "mint", block.MinTime, "maxt", block.MaxTime, "series", done)
+	return done, nil
+}
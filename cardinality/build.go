@@ -0,0 +1,197 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BuildOption configures BuildFromHead.
+type BuildOption func(*buildOptions)
+
+type buildOptions struct {
+	workers  int
+	batch    int
+	progress func(done, total int)
+	logger   *slog.Logger
+}
+
+// WithBuildWorkers sets the number of goroutines reading series labels from
+// the head. It defaults to GOMAXPROCS.
+func WithBuildWorkers(n int) BuildOption {
+	return func(o *buildOptions) {
+		o.workers = max(n, 1)
+	}
+}
+
+// WithBuildLogger sets the logger of the build, which logs the blocks that
+// were indexed. Nothing is logged by default.
+func WithBuildLogger(logger *slog.Logger) BuildOption {
+	return func(o *buildOptions) {
+		o.logger = logger
+	}
+}
+
+// WithBuildProgress registers fn to be called after every batch of series
+// added to the index, with the number of series added so far and the total.
+func WithBuildProgress(fn func(done, total int)) BuildOption {
+	return func(o *buildOptions) {
+		o.progress = fn
+	}
+}
+
+type seriesEntry struct {
+	ref  storage.SeriesRef
+	lbls labels.Labels
+}
+
+func applyBuildOptions(opts []BuildOption) buildOptions {
+	o := buildOptions{
+		workers: runtime.GOMAXPROCS(0),
+		batch:   4096,
+		logger:  promslog.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// BuildFromHead adds every series in the head to idx. Labels are read by
+// parallel workers, while the index is only written to from the calling
+// goroutine, so idx doesn't need to be safe for concurrent use.
+func BuildFromHead(ctx context.Context, head *tsdb.Head, idx CardinalityIndex, opts ...BuildOption) error {
+	return buildFromBlock(ctx, head, idx.AddSeries, applyBuildOptions(opts))
+}
+
+// BuildFromBlock adds every series of a persisted block to idx, see
+// BuildFromHead. The series refs passed to idx are only unique within the
+// block; use a Reindexer to combine several blocks in a BitmapIndex.
+func BuildFromBlock(ctx context.Context, block tsdb.BlockReader, idx CardinalityIndex, opts ...BuildOption) error {
+	return buildFromBlock(ctx, block, idx.AddSeries, applyBuildOptions(opts))
+}
+
+func buildFromBlock(ctx context.Context, block tsdb.BlockReader, add func(labels.Labels, storage.SeriesRef), o buildOptions) error {
+	start := time.Now()
+	indexReader, err := block.Index()
+	if err != nil {
+		return fmt.Errorf("failed to get index reader: %w", err)
+	}
+	defer indexReader.Close()
+
+	done, removed, err := buildFromIndex(ctx, indexReader, add, o)
+	if err != nil {
+		return err
+	}
+	o.logger.Debug("Indexed block", "mint", block.Meta().MinTime, "maxt", block.Meta().MaxTime, "series", done, "removed", removed, "duration", time.Since(start))
+	return nil
+}
+
+// seriesReader is the part of a TSDB index reader that builds read from.
+type seriesReader interface {
+	Postings(ctx context.Context, name string, values ...string) (index.Postings, error)
+	Series(ref storage.SeriesRef, builder *labels.ScratchBuilder, chks *[]chunks.Meta) error
+}
+
+// buildFromIndex adds every series of a TSDB index to add, and returns the
+// number of series added and of series removed while reading.
+func buildFromIndex(ctx context.Context, indexReader seriesReader, add func(labels.Labels, storage.SeriesRef), o buildOptions) (int, int64, error) {
+	name, value := index.AllPostingsKey()
+	postings, err := indexReader.Postings(ctx, name, value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get all postings: %w", err)
+	}
+	var refs []storage.SeriesRef
+	for postings.Next() {
+		refs = append(refs, postings.At())
+	}
+	if err := postings.Err(); err != nil {
+		return 0, 0, fmt.Errorf("error iterating postings: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan []storage.SeriesRef)
+	results := make(chan []seriesEntry, o.workers)
+	errs := make(chan error, o.workers)
+	var removed atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < o.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var builder labels.ScratchBuilder
+			for chunk := range chunks {
+				batch := make([]seriesEntry, 0, len(chunk))
+				for _, ref := range chunk {
+					if err := indexReader.Series(ref, &builder, nil); err != nil {
+						// Series removed by head GC since the postings were read.
+						if errors.Is(err, storage.ErrNotFound) {
+							removed.Add(1)
+							continue
+						}
+						errs <- fmt.Errorf("failed to read series %d: %w", ref, err)
+						cancel()
+						return
+					}
+					batch = append(batch, seriesEntry{ref: ref, lbls: builder.Labels()})
+				}
+				select {
+				case results <- batch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(chunks)
+		for start := 0; start < len(refs); start += o.batch {
+			select {
+			case chunks <- refs[start:min(start+o.batch, len(refs))]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for batch := range results {
+		for _, s := range batch {
+			add(s.lbls, s.ref)
+		}
+		done += len(batch)
+		if o.progress != nil {
+			o.progress(done, len(refs))
+		}
+	}
+
+	select {
+	case err := <-errs:
+		return 0, 0, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	return done, removed.Load(), nil
+}
@@ -0,0 +1,303 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CalibrationStats summarizes how an approximate index's answers compare to
+// the ground truth for one matcher shape.
+type CalibrationStats struct {
+	Shape   string
+	Samples int
+	// Bias is the mean relative error, positive if the index overestimates.
+	Bias float64
+	// MeanAbsError is the mean absolute relative error.
+	MeanAbsError float64
+	// Correction is the factor estimates are multiplied by to remove the
+	// bias: the total of the true answers over the total of the estimates.
+	Correction float64
+}
+
+type calibrationStat struct {
+	samples        int
+	relErrSum      float64
+	absRelErrSum   float64
+	estimateSum    float64
+	groundTruthSum float64
+}
+
+// Calibrator compares the answers of an approximate index to the ground
+// truth, typically a BlockIndex, on sampled matcher sets and learns a
+// correction factor per matcher shape. It is itself an index that forwards to
+// the approximate index, applying the correction if auto-apply is enabled.
+type Calibrator struct {
+	approx    CardinalityIndex
+	truth     CardinalityIndex
+	autoApply bool
+
+	mtx   sync.Mutex
+	rand  *rand.Rand
+	stats map[string]*calibrationStat
+}
+
+// NewCalibrator returns a calibrator of approx against truth. Matcher sets
+// are sampled from the label values of approx, or of truth if approx doesn't
+// implement LabelValuesIndex.
+func NewCalibrator(approx, truth CardinalityIndex, autoApply bool) *Calibrator {
+	return &Calibrator{
+		approx:    approx,
+		truth:     truth,
+		autoApply: autoApply,
+		rand:      rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		stats:     make(map[string]*calibrationStat),
+	}
+}
+
+// MatcherShape describes the matcher types of a query independently of the
+// label names and values, e.g. "=,=~".
+func MatcherShape(matchers ...*labels.Matcher) string {
+	types := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		types = append(types, m.Type.String())
+	}
+	slices.Sort(types)
+	return strings.Join(types, ",")
+}
+
+// Calibrate records how the approximate answer to the query compares to the
+// ground truth. Queries without series are not recorded, as their relative
+// error is undefined.
+func (c *Calibrator) Calibrate(matchers ...*labels.Matcher) {
+	truth := c.truth.GetCardinality(matchers...)
+	if truth == 0 {
+		return
+	}
+	estimate := c.approx.GetCardinality(matchers...)
+	relErr := float64(estimate-truth) / float64(truth)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	shape := MatcherShape(matchers...)
+	s, ok := c.stats[shape]
+	if !ok {
+		s = &calibrationStat{}
+		c.stats[shape] = s
+	}
+	s.samples++
+	s.relErrSum += relErr
+	s.absRelErrSum += math.Abs(relErr)
+	s.estimateSum += float64(estimate)
+	s.groundTruthSum += float64(truth)
+}
+
+// CalibrateSamples calibrates n sampled matcher sets.
+func (c *Calibrator) CalibrateSamples(n int) {
+	for i := 0; i < n; i++ {
+		if matchers := c.sample(); len(matchers) > 0 {
+			c.Calibrate(matchers...)
+		}
+	}
+}
+
+// Run calibrates n sampled matcher sets every interval until ctx is done.
+func (c *Calibrator) Run(ctx context.Context, interval time.Duration, n int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.CalibrateSamples(n)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample returns a random matcher set of one of the common query shapes:
+// a single equality matcher, optionally combined with an equality,
+// inequality or prefix regex matcher on another label of the same series.
+func (c *Calibrator) sample() []*labels.Matcher {
+	lvi, ok := c.approx.(LabelValuesIndex)
+	if !ok {
+		if lvi, ok = c.truth.(LabelValuesIndex); !ok {
+			return nil
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	s := matcherSampler{index: lvi, rand: c.rand}
+	first, other, ok := s.equal()
+	if !ok {
+		return nil
+	}
+	value, ok := s.value(other, first)
+	if !ok {
+		return []*labels.Matcher{first}
+	}
+
+	var second *labels.Matcher
+	switch c.rand.IntN(4) {
+	case 0:
+		return []*labels.Matcher{first}
+	case 1:
+		second = s.matcher(labels.MatchEqual, other, value)
+	case 2:
+		second = s.matcher(labels.MatchNotEqual, other, value)
+	default:
+		second = s.prefix(other, value, ".*")
+	}
+	if second == nil {
+		return nil
+	}
+	return []*labels.Matcher{first, second}
+}
+
+// matcherSampler samples matchers from the label values of an index, for
+// the Calibrator and AccuracyQueries. Samples the index can't be queried
+// with, like regular expressions of invalid UTF-8 values, are dropped.
+type matcherSampler struct {
+	index LabelValuesIndex
+	rand  *rand.Rand
+}
+
+// pick returns a random element of values, false if there is none.
+func (s matcherSampler) pick(values []string) (string, bool) {
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[s.rand.IntN(len(values))], true
+}
+
+// equal returns an equality matcher on a random label, and another label of
+// the series it selects, empty if they have no other label. Labels without
+// values are skipped.
+func (s matcherSampler) equal() (*labels.Matcher, string, bool) {
+	names := s.index.LabelNames()
+	for _, i := range s.rand.Perm(len(names)) {
+		value, ok := s.pick(s.index.LabelValues(names[i]))
+		if !ok {
+			continue
+		}
+		first := s.matcher(labels.MatchEqual, names[i], value)
+		if first == nil {
+			return nil, "", false
+		}
+		others := slices.DeleteFunc(s.index.LabelNames(first), func(n string) bool { return n == first.Name })
+		other, _ := s.pick(others)
+		return first, other, true
+	}
+	return nil, "", false
+}
+
+// value returns a random value of the label among the series of the
+// matchers, false if there is none.
+func (s matcherSampler) value(name string, matchers ...*labels.Matcher) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	return s.pick(s.index.LabelValues(name, matchers...))
+}
+
+// prefix returns a regular expression matcher of a random prefix of value,
+// cut on a rune boundary, followed by suffix, or nil if it is rejected.
+func (s matcherSampler) prefix(name, value, suffix string) *labels.Matcher {
+	n := s.rand.IntN(len(value) + 1)
+	for n < len(value) && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return s.matcher(labels.MatchRegexp, name, regexp.QuoteMeta(value[:n])+suffix)
+}
+
+// matcher returns the matcher, or nil if it is rejected.
+func (s matcherSampler) matcher(t labels.MatchType, name, value string) *labels.Matcher {
+	m, err := labels.NewMatcher(t, name, value)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// Stats returns the calibration statistics of every matcher shape seen so
+// far, ordered by shape.
+func (c *Calibrator) Stats() []CalibrationStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	stats := make([]CalibrationStats, 0, len(c.stats))
+	for shape, s := range c.stats {
+		stats = append(stats, s.summary(shape))
+	}
+	slices.SortFunc(stats, func(a, b CalibrationStats) int { return strings.Compare(a.Shape, b.Shape) })
+	return stats
+}
+
+func (s *calibrationStat) summary(shape string) CalibrationStats {
+	stats := CalibrationStats{
+		Shape:        shape,
+		Samples:      s.samples,
+		Bias:         s.relErrSum / float64(s.samples),
+		MeanAbsError: s.absRelErrSum / float64(s.samples),
+		Correction:   1,
+	}
+	if s.estimateSum > 0 {
+		stats.Correction = s.groundTruthSum / s.estimateSum
+	}
+	return stats
+}
+
+// CorrectionFactor returns the learned correction factor for the shape of
+// the matchers, 1 if the shape hasn't been calibrated yet.
+func (c *Calibrator) CorrectionFactor(matchers ...*labels.Matcher) float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	shape := MatcherShape(matchers...)
+	s, ok := c.stats[shape]
+	if !ok {
+		return 1
+	}
+	return s.summary(shape).Correction
+}
+
+// AddSeries adds the series to the approximate index.
+func (c *Calibrator) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	c.approx.AddSeries(lbls, ref)
+}
+
+// GetCardinality returns the approximate index's answer, multiplied by the
+// correction factor if auto-apply is enabled.
+func (c *Calibrator) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return c.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (c *Calibrator) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	card := GetCardinalityContext(ctx, c.approx, matchers...)
+	if !c.autoApply {
+		return card
+	}
+	return int64(math.Round(float64(card) * c.CorrectionFactor(matchers...)))
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the
+// errors of the approximate index.
+func (c *Calibrator) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	card, err := c.approx.GetCardinalityChecked(ctx, matchers...)
+	if err != nil || !c.autoApply {
+		return card, err
+	}
+	return int64(math.Round(float64(card) * c.CorrectionFactor(matchers...))), nil
+}
@@ -1,17 +1,47 @@
 package cardinality
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	dto "github.com/prometheus/prometheus/prompb/io/prometheus/client"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/wlog"
 	"github.com/prometheus/prometheus/util/teststorage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"harry671003/hello/cardinality/sketchcore"
+	"harry671003/hello/cardinality/workload"
+	"log/slog"
 	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"runtime/pprof"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func BenchmarkCardinality(b *testing.B) {
@@ -21,12 +51,14 @@ func BenchmarkCardinality(b *testing.B) {
 
 	hmhIndex := NewHyperMinHashIndex()
 	bitmapIndex := NewBitmapIndex()
+	metricNameIndex := NewBitmapIndex(WithMetricNameIndex())
 	blockIndex := NewBlockIndex(store)
 	app := store.Appender(context.TODO())
 
 	totalSeries, err := ingestData(app, func(ref storage.SeriesRef, lbls labels.Labels) {
 		hmhIndex.AddSeries(lbls, ref)
 		bitmapIndex.AddSeries(lbls, ref)
+		metricNameIndex.AddSeries(lbls, ref)
 	})
 
 	require.NoError(b, err)
@@ -62,6 +94,15 @@ func BenchmarkCardinality(b *testing.B) {
 		}
 	})
 
+	b.Run("BitmapMetricNameIndex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			estimate := metricNameIndex.GetCardinality(matchers...)
+			delta := math.Abs(float64(card - estimate))
+
+			require.LessOrEqual(b, delta, threshold)
+		}
+	})
+
 	b.Run("Block", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			estimate := blockIndex.GetCardinality(matchers...)
@@ -72,12 +113,55 @@ func BenchmarkCardinality(b *testing.B) {
 	})
 }
 
+// BenchmarkBitmapIndexAddSeriesParallel compares concurrent ingestion into
+// the sharded index with serializing all writers on a single lock, which is
+// what callers had to do before the index was sharded.
+func BenchmarkBitmapIndexAddSeriesParallel(b *testing.B) {
+	series := make([]labels.Labels, 100000)
+	for i := range series {
+		series[i] = labels.FromStrings(
+			"__name__", fmt.Sprintf("metric_%d", i%50),
+			"instance", fmt.Sprintf("instance-%d", i%1000),
+			"method", fmt.Sprintf("method-%d", i%5),
+			"pod", fmt.Sprintf("pod-%d", i),
+			"status", fmt.Sprintf("%d", 200+i%7),
+		)
+	}
+
+	run := func(b *testing.B, add func(labels.Labels, storage.SeriesRef)) {
+		var next atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ref := next.Add(1)
+				add(series[ref%uint64(len(series))], storage.SeriesRef(ref))
+			}
+		})
+	}
+
+	b.Run("GlobalLock", func(b *testing.B) {
+		index := NewBitmapIndex(WithoutDeduplication())
+		var mtx sync.Mutex
+		run(b, func(lbls labels.Labels, ref storage.SeriesRef) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			index.AddSeries(lbls, ref)
+		})
+	})
+
+	b.Run("Sharded", func(b *testing.B) {
+		index := NewBitmapIndex(WithoutDeduplication())
+		run(b, index.AddSeries)
+	})
+}
+
 func TestCardinality(t *testing.T) {
 	store := teststorage.New(t)
 	defer store.Close()
 
 	bitmapIndex := NewBitmapIndex()
 	hmhIndex := NewHyperMinHashIndex()
+	exactHashIndex := NewExactHashIndex()
 	blockIndex := NewBlockIndex(store)
 
 	app := store.Appender(context.TODO())
@@ -85,6 +169,7 @@ func TestCardinality(t *testing.T) {
 	totalSeries, err := ingestData(app, func(ref storage.SeriesRef, lbls labels.Labels) {
 		bitmapIndex.AddSeries(lbls, ref)
 		hmhIndex.AddSeries(lbls, ref)
+		exactHashIndex.AddSeries(lbls, ref)
 	})
 	require.NoError(t, err)
 	t.Logf("Total series: %d", totalSeries)
@@ -188,6 +273,7 @@ func TestCardinality(t *testing.T) {
 	}{
 		{"Bitmap", bitmapIndex},
 		{"HyperMinMax", hmhIndex},
+		{"ExactHash", exactHashIndex},
 		{"BlockIndex", blockIndex},
 	}
 
@@ -209,8 +295,9 @@ func TestCardinality(t *testing.T) {
 		}
 	}
 
-	// pprof
-	printProfile()
+	for _, shard := range bitmapIndex.ShardStats() {
+		t.Logf("Shard: %s, Values: %d, Series: %d, Bytes: %d", shard.Label, shard.Values, shard.Series, shard.MemoryBytes)
+	}
 }
 
 func ingestData(app storage.Appender, updateFn func(storage.SeriesRef, labels.Labels)) (int, error) {
@@ -274,7 +361,7 @@ func validateDelta(t *testing.T, actual, estimate int64, name string) {
 func generateValues(pre string, count int) []string {
 	values := make([]string, 0, count)
 	for i := 0; i < count; i++ {
-		values = append(values, internString(fmt.Sprintf("%s-%d", pre, i)))
+		values = append(values, fmt.Sprintf("%s-%d", pre, i))
 	}
 	return values
 }
@@ -381,8 +468,4126 @@ func generateCombinations(metricLabels []labelValue) [][]labels.Label {
 	return labelCombinations
 }
 
-func printProfile() {
-	f, _ := os.Create("memprofile.prof")
-	pprof.WriteHeapProfile(f)
-	f.Close()
+func TestAddSeriesDeduplication(t *testing.T) {
+	lbls := labels.FromStrings("__name__", "up", "job", "api")
+
+	// The same series re-added under a different ref must only be counted once.
+	bitmapIndex := NewBitmapIndex()
+	bitmapIndex.AddSeries(lbls, 1)
+	bitmapIndex.AddSeries(lbls, 2)
+	require.Equal(t, int64(1), bitmapIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "job", "api")))
+
+	// Without the seen-set every ref is indexed.
+	bitmapIndex = NewBitmapIndex(WithoutDeduplication())
+	bitmapIndex.AddSeries(lbls, 1)
+	bitmapIndex.AddSeries(lbls, 2)
+	require.Equal(t, int64(2), bitmapIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "job", "api")))
+
+	hmhIndex := NewHyperMinHashIndex()
+	hmhIndex.AddSeries(lbls, 1)
+	hmhIndex.AddSeries(lbls, 1)
+	require.Len(t, hmhIndex.seen, 1)
+}
+
+func TestCooccurrenceTracker(t *testing.T) {
+	index := NewBitmapIndex(WithCooccurrenceTracking())
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 100; pod++ {
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			ref++
+			index.AddSeries(labels.FromStrings(
+				"instance", fmt.Sprintf("10.0.0.%d", pod),
+				"method", method,
+				"pod", fmt.Sprintf("pod-%d", pod),
+			), ref)
+		}
+	}
+
+	cooc := index.Cooccurrence()
+	require.NotNil(t, cooc)
+	require.Nil(t, NewBitmapIndex().Cooccurrence())
+
+	require.InDelta(t, 100, cooc.JointDistinct("instance", "pod"), 5)
+	require.InDelta(t, 400, cooc.JointDistinct("method", "pod"), 20)
+
+	// pod and instance are 1:1, method and pod are independent.
+	require.Greater(t, cooc.Dependence("pod", "instance"), 0.9)
+	require.Less(t, cooc.Dependence("pod", "method"), 0.1)
+
+	// Assuming independence would estimate 100*100*4 combinations.
+	require.InDelta(t, 400, cooc.EstimateCombinations("pod", "instance", "method"), 40)
+}
+
+func TestValueBuckets(t *testing.T) {
+	bitmapIndex := NewBitmapIndex(WithValueBuckets(100, 16))
+	hmhIndex := NewHyperMinHashIndex(WithValueBuckets(100, 16))
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", "requests_total", "id", fmt.Sprintf("id-%d", i))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+
+	require.Len(t, bitmapIndex.shards["id"].bucketed.Buckets, 16)
+	require.Empty(t, bitmapIndex.shards["id"].values)
+	require.True(t, hmhIndex.core.Bucketed("id"))
+	// Nor are they interned.
+	require.NotContains(t, hmhIndex.strings.values, "id")
+	require.Len(t, hmhIndex.strings.values["__name__"], 1)
+
+	for _, ix := range []CardinalityIndex{bitmapIndex, hmhIndex} {
+		// Equality selects a whole bucket, so it over-counts but stays bounded,
+		// also for values that were never added.
+		estimate := ix.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "id", "id-1"))
+		require.GreaterOrEqual(t, estimate, int64(1))
+		require.Less(t, estimate, int64(200))
+		require.Less(t, ix.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "id", "unknown")), int64(200))
+
+		// Set matchers select the buckets of their values, other matchers
+		// every bucket.
+		set := ix.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "id", "id-1|id-2"))
+		require.GreaterOrEqual(t, set, estimate)
+		require.Less(t, set, int64(400))
+		require.InEpsilon(t, 1000, ix.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "id", "id-1.*")), 0.05)
+		require.InEpsilon(t, 1000, ix.GetCardinality(labels.MustNewMatcher(labels.MatchNotEqual, "id", "id-1")), 0.05)
+		require.Zero(t, ix.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "id", "")))
+	}
+
+	// The values of bucketed labels aren't kept, only estimated.
+	require.Empty(t, bitmapIndex.LabelValues("id"))
+	require.Empty(t, hmhIndex.LabelValues("id"))
+	for _, shard := range bitmapIndex.ShardStats() {
+		if shard.Label == "id" {
+			require.True(t, shard.Bucketed)
+			require.InEpsilon(t, 1000, shard.Values, 0.05)
+		}
+	}
+	require.InEpsilon(t, 1000+1, bitmapIndex.Stats().LabelValues, 0.05)
+}
+
+func TestSingleEqualityMatcherIsExact(t *testing.T) {
+	hmhIndex := NewHyperMinHashIndex()
+	for i := 0; i < 5000; i++ {
+		hmhIndex.AddSeries(labels.FromStrings("__name__", "requests_total", "id", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%7)), storage.SeriesRef(i))
+	}
+
+	require.Equal(t, int64(5000), hmhIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "requests_total")))
+	require.Equal(t, int64(715), hmhIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")))
+	require.Zero(t, hmhIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7")))
+}
+
+func TestBuildFromHead(t *testing.T) {
+	store := teststorage.New(t)
+	defer store.Close()
+
+	app := store.Appender(context.TODO())
+	for i := 0; i < 10000; i++ {
+		_, err := app.Append(0, labels.FromStrings("__name__", "requests_total", "id", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%10)), 0, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	index := NewBitmapIndex()
+	var progress []int
+	err := BuildFromHead(context.Background(), store.Head(), index, WithBuildWorkers(4), WithBuildProgress(func(done, total int) {
+		require.Equal(t, 10000, total)
+		progress = append(progress, done)
+	}))
+	require.NoError(t, err)
+
+	require.Equal(t, 10000, progress[len(progress)-1])
+	require.Equal(t, int64(10000), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "requests_total")))
+	require.Equal(t, int64(1000), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, BuildFromHead(ctx, store.Head(), NewBitmapIndex()), context.Canceled)
+}
+
+// createTestBlock creates a block of up series of the pods in dir and
+// returns its ID.
+func createTestBlock(t *testing.T, dir string, pods ...int) ulid.ULID {
+	var series []storage.Series
+	for _, pod := range pods {
+		series = append(series, storage.NewListSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), chunks.GenerateSamples(0, 1)))
+	}
+	path, err := tsdb.CreateBlock(series, dir, 0, promslog.NewNopLogger())
+	require.NoError(t, err)
+	return ulid.MustParse(filepath.Base(path))
+}
+
+func TestAccuracyOnGeneratedBlock(t *testing.T) {
+	spec, err := workload.Load([]byte(`
+seed: 1
+metrics:
+  - name: http_requests_total
+    series: 20000
+    labels:
+      - name: method
+        values: [GET, POST, PUT, DELETE]
+      - name: pod
+        count: 2000
+        distribution: zipf
+      - name: user
+        count: 100
+  - name: blocks_loaded
+    labels:
+      - name: instance
+        count: 50
+      - name: user
+        count: 100
+`))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	ids, err := workload.WriteBlocks(context.Background(), spec, dir, nil)
+	require.NoError(t, err)
+	block, err := tsdb.OpenBlock(nil, filepath.Join(dir, ids[0].String()), nil, nil)
+	require.NoError(t, err)
+	defer block.Close()
+
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	for _, index := range []CardinalityIndex{bitmapIndex, hmhIndex} {
+		require.NoError(t, BuildFromBlock(context.Background(), block, index))
+	}
+
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")},
+		{labels.MustNewMatcher(labels.MatchEqual, "user", "user-7")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[0-9]"), labels.MustNewMatcher(labels.MatchEqual, "method", "GET")},
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "blocks_loaded"), labels.MustNewMatcher(labels.MatchNotEqual, "instance", "instance-0")},
+	} {
+		querier, err := tsdb.NewBlockQuerier(block, math.MinInt64, math.MaxInt64)
+		require.NoError(t, err)
+		set := querier.Select(context.Background(), false, nil, matchers...)
+		var actual int64
+		for set.Next() {
+			actual++
+		}
+		require.NoError(t, querier.Close())
+
+		require.Equal(t, actual, bitmapIndex.GetCardinality(matchers...), "%v", matchers)
+		require.InEpsilon(t, actual, hmhIndex.GetCardinality(matchers...), 0.1, "%v", matchers)
+	}
+}
+
+func TestReindexer(t *testing.T) {
+	dir := t.TempDir()
+	createTestBlock(t, dir, 0, 1, 2)
+	createTestBlock(t, dir, 2, 3)
+
+	r := NewReindexer(dir, nil, func() *BitmapIndex { return NewBitmapIndex() })
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.False(t, r.Ready())
+
+	changed, err := r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.True(t, r.Ready())
+	// pod-2 is in both blocks but only counted once.
+	require.Equal(t, int64(4), r.Index().GetCardinality(up))
+
+	changed, err = r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	createTestBlock(t, dir, 4)
+	changed, err = r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, int64(5), r.Index().GetCardinality(up))
+
+	// New series of the head are indexed too.
+	opts := tsdb.DefaultHeadOptions()
+	opts.ChunkDirRoot = t.TempDir()
+	head, err := tsdb.NewHead(nil, nil, nil, nil, opts, nil)
+	require.NoError(t, err)
+	defer head.Close()
+	appendHead := func(pod string) {
+		app := head.Appender(context.Background())
+		_, err := app.Append(0, labels.FromStrings("__name__", "up", "pod", pod), 1000, 1)
+		require.NoError(t, err)
+		require.NoError(t, app.Commit())
+	}
+	appendHead("pod-4")
+	r = NewReindexer(dir, head, func() *BitmapIndex { return NewBitmapIndex() })
+	changed, err = r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, int64(5), r.Index().GetCardinality(up))
+	changed, err = r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	appendHead("pod-5")
+	changed, err = r.ReindexIfChanged(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, int64(6), r.Index().GetCardinality(up))
+}
+
+func writeBucketIndex(t *testing.T, dir string, bucketIndex BucketIndex) {
+	f, err := os.Create(filepath.Join(dir, bucketIndexFile))
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	require.NoError(t, json.NewEncoder(gz).Encode(bucketIndex))
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+}
+
+func TestBuildFromBucket(t *testing.T) {
+	dir := t.TempDir()
+	tenantDir := filepath.Join(dir, "team-a")
+	blocks := []ulid.ULID{
+		createTestBlock(t, tenantDir, 0, 1, 2),
+		createTestBlock(t, tenantDir, 2, 3),
+		createTestBlock(t, tenantDir, 4),
+	}
+
+	// The third block is marked for deletion, and a fourth one is out of
+	// range and missing.
+	bucketIndex := BucketIndex{Version: 1, UpdatedAt: time.Now().Unix()}
+	for _, id := range blocks {
+		bucketIndex.Blocks = append(bucketIndex.Blocks, BucketIndexBlock{ID: id, MinTime: 0, MaxTime: 2})
+	}
+	bucketIndex.BlockDeletionMarks = []BucketIndexDeletionMark{{ID: blocks[2]}}
+	bucketIndex.Blocks = append(bucketIndex.Blocks, BucketIndexBlock{ID: ulid.MustNew(1, nil), MinTime: 10, MaxTime: 20})
+	writeBucketIndex(t, tenantDir, bucketIndex)
+
+	index := NewBitmapIndex()
+	require.NoError(t, BuildFromBucket(context.Background(), DirBucket(dir), "team-a", 0, 5, index))
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	// pod-2 is in both blocks but only counted once.
+	require.Equal(t, int64(4), index.GetCardinality(up))
+
+	m := NewTenantIndexManager(func(string) CardinalityIndex { return NewBitmapIndex() })
+	require.NoError(t, BuildTenantsFromBucket(context.Background(), DirBucket(dir), []string{"team-a"}, 0, 5, m))
+	require.Equal(t, int64(4), m.GetCardinality("team-a", up))
+
+	// The missing block is read once in range.
+	require.Error(t, BuildFromBucket(context.Background(), DirBucket(dir), "team-a", 0, 10, NewBitmapIndex()))
+	require.Error(t, BuildFromBucket(context.Background(), DirBucket(dir), "team-b", 0, 5, NewBitmapIndex()))
+}
+
+func TestBlockRetention(t *testing.T) {
+	_, err := NewBlockRetention(NewBitmapIndex())
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	first := createTestBlock(t, dir, 0, 1, 2)
+	second := createTestBlock(t, dir, 2, 3)
+	index := NewBitmapIndex(WithAllocatedRefs(), WithMetricNameIndex())
+	r, err := NewBlockRetention(index)
+	require.NoError(t, err)
+	require.NoError(t, r.SyncDir(context.Background(), dir))
+	require.Len(t, r.Blocks(), 2)
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.Equal(t, int64(4), index.GetCardinality(up))
+
+	// pod-2 is still in the second block.
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, first.String())))
+	createTestBlock(t, dir, 4)
+	require.NoError(t, r.SyncDir(context.Background(), dir))
+	require.Len(t, r.Blocks(), 2)
+	require.Equal(t, int64(3), index.GetCardinality(up))
+	require.Equal(t, []string{"pod-2", "pod-3", "pod-4"}, index.LabelValues("pod"))
+
+	// Series of a head are kept until a block takes them over.
+	r.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-3"), 0)
+	r.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-5"), 0)
+	require.Equal(t, 1, r.RemoveBlock(second))
+	require.Equal(t, 0, r.RemoveBlock(ulid.MustNew(1, nil)))
+	require.Equal(t, []string{"pod-3", "pod-4", "pod-5"}, index.LabelValues("pod"))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, second.String())))
+	createTestBlock(t, dir, 5)
+	require.NoError(t, r.SyncDir(context.Background(), dir))
+	require.Equal(t, []string{"pod-3", "pod-4", "pod-5"}, index.LabelValues("pod"))
+	for _, id := range r.Blocks() {
+		r.RemoveBlock(id)
+	}
+	require.Equal(t, []string{"pod-3"}, index.LabelValues("pod"))
+	require.Equal(t, int64(1), index.GetCardinality(up, labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")))
+
+	// Blocks marked for deletion in the bucket index are removed.
+	bucket := t.TempDir()
+	tenantDir := filepath.Join(bucket, "team-a")
+	first = createTestBlock(t, tenantDir, 0, 1)
+	second = createTestBlock(t, tenantDir, 1, 2)
+	bucketIndex := BucketIndex{Version: 1, Blocks: []BucketIndexBlock{{ID: first}, {ID: second}}}
+	writeBucketIndex(t, tenantDir, bucketIndex)
+	index = NewBitmapIndex(WithAllocatedRefs())
+	r, err = NewBlockRetention(index)
+	require.NoError(t, err)
+	require.NoError(t, r.SyncBucket(context.Background(), DirBucket(bucket), "team-a"))
+	require.Equal(t, int64(3), index.GetCardinality(up))
+	bucketIndex.BlockDeletionMarks = []BucketIndexDeletionMark{{ID: first}}
+	writeBucketIndex(t, tenantDir, bucketIndex)
+	require.NoError(t, r.SyncBucket(context.Background(), DirBucket(bucket), "team-a"))
+	require.Equal(t, []string{"pod-1", "pod-2"}, index.LabelValues("pod"))
+}
+
+func TestCompositeIndex(t *testing.T) {
+	dir := t.TempDir()
+	createBlock := func(start int, pods ...int) tsdb.BlockReader {
+		var series []storage.Series
+		for _, pod := range pods {
+			series = append(series, storage.NewListSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), chunks.GenerateSamples(start, 10)))
+		}
+		path, err := tsdb.CreateBlock(series, dir, 0, promslog.NewNopLogger())
+		require.NoError(t, err)
+		block, err := tsdb.OpenBlock(promslog.NewNopLogger(), path, nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { block.Close() })
+		return block
+	}
+	first, second := createBlock(0, 0, 1, 2), createBlock(100, 2, 3)
+
+	c := NewCompositeIndex()
+	require.NoError(t, c.AddBlock(context.Background(), first))
+	require.NoError(t, c.AddBlock(context.Background(), second))
+	require.NoError(t, c.AddBlock(context.Background(), second))
+	require.Len(t, c.Blocks(), 2)
+	c.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-3"), 1)
+	c.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-4"), 2)
+
+	// pod-2 and pod-3 are in two sub-indexes but only counted once.
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.Equal(t, int64(5), c.GetCardinality(up))
+	require.Equal(t, int64(3), c.GetCardinalityRange(context.Background(), 0, 50, up))
+	require.Equal(t, int64(2), c.GetCardinalityRange(context.Background(), 100, 100, up))
+	require.Equal(t, int64(3), c.GetCardinalityRange(context.Background(), 100, 200, up))
+	require.Equal(t, int64(2), c.GetCardinalityRange(context.Background(), 200, 300, up))
+	require.Equal(t, int64(2), c.GetCardinalityRange(context.Background(), 0, 300, up, labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[23]")))
+
+	require.True(t, c.RemoveBlock(first.Meta().ULID))
+	require.False(t, c.RemoveBlock(first.Meta().ULID))
+	require.Equal(t, []CompositeBlock{{ID: second.Meta().ULID, MinTime: 100, MaxTime: 110, Series: 2}}, c.Blocks())
+	require.Equal(t, int64(3), c.GetCardinality(up))
+	// The refs of pod-0 and pod-1, in no sub-index anymore, are dropped.
+	require.Len(t, c.space.hashes, 3)
+	require.Len(t, c.space.table, 4)
+
+	// Adding a block truncates the head series it covers.
+	c = NewCompositeIndex()
+	c.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", "pod-2"), 1, 50)
+	c.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", "pod-3"), 2, 109)
+	c.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", "pod-4"), 3, 105)
+	c.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", "pod-4"), 3, 110)
+	require.NoError(t, c.AddBlock(context.Background(), second))
+	require.Equal(t, int64(3), c.GetCardinality(up))
+	require.Equal(t, []string{"pod-4"}, c.Head().LabelValues("pod"))
+	require.Len(t, c.space.table, 3)
+
+	// A block added concurrently is only added once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.AddBlock(context.Background(), first))
+		}()
+	}
+	wg.Wait()
+	require.Len(t, c.Blocks(), 2)
+	require.True(t, c.RemoveBlock(first.Meta().ULID))
+	require.Len(t, c.space.table, 3)
+	// pod-3 gets its block ref back if added to the head again.
+	c.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", "pod-3"), 4, 120)
+	require.Equal(t, int64(3), c.GetCardinality(up))
+	require.Equal(t, int64(2), c.GetCardinalityRange(context.Background(), 110, 200, up))
+}
+
+func TestSmallTenants(t *testing.T) {
+	m := NewTenantIndexManager(func(string) CardinalityIndex { return NewBitmapIndex() })
+	m.SetSmallTenantThreshold(10)
+	for i := 0; i < 10; i++ {
+		m.AddSeries("small", labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i))
+		m.AddSeries("small", labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i))
+		m.AddSeries("large", labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i))
+	}
+	m.AddSeries("large", labels.FromStrings("__name__", "build_info"), 10)
+
+	small, _ := m.get("small")
+	require.IsType(t, &smallIndex{}, small.index)
+	large, _ := m.get("large")
+	require.IsType(t, &BitmapIndex{}, large.index)
+
+	for _, tenant := range []string{"small", "large"} {
+		require.Equal(t, int64(10), m.GetCardinality(tenant, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+		require.Equal(t, int64(5), m.GetCardinality(tenant, labels.MustNewMatcher(labels.MatchRegexp, "pod", "[0-4]")))
+		require.Equal(t, int64(10), m.Usage(tenant).TopMetricSeries)
+	}
+	require.Equal(t, int64(1), m.GetCardinality("large", labels.MustNewMatcher(labels.MatchEqual, "pod", "")))
+	require.Equal(t, []string{"__name__", "pod"}, small.index.(LabelValuesIndex).LabelNames())
+	require.Equal(t, []string{"3"}, small.index.(LabelValuesIndex).LabelValues("pod", labels.MustNewMatcher(labels.MatchEqual, "pod", "3")))
+}
+
+func TestTenantQuotas(t *testing.T) {
+	m := NewTenantIndexManager(func(string) CardinalityIndex { return NewBitmapIndex() })
+	m.SetDefaultQuota(Quota{MaxSeries: 1000})
+	m.SetQuota("team-a", Quota{MaxSeries: 100, MaxSeriesPerMetric: 50})
+	m.SetQuota("team-c", Quota{})
+
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"team-a", "team-b", "team-c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 60; i++ {
+				m.AddSeries(tenant, labels.FromStrings("__name__", "up", "id", strconv.Itoa(i)), storage.SeriesRef(i))
+				m.AddSeries(tenant, labels.FromStrings("__name__", "requests_total", "id", strconv.Itoa(i%20)), storage.SeriesRef(i+100))
+			}
+		}()
+	}
+	wg.Wait()
+
+	usage := m.Usage("team-a")
+	require.Equal(t, int64(80), usage.Series)
+	require.Equal(t, "up", usage.TopMetric)
+	require.Equal(t, int64(60), usage.TopMetricSeries)
+	require.True(t, usage.Exceeded())
+	require.InDelta(t, 1.2, usage.Utilization(), 0.001)
+
+	closest := m.TenantsClosestToLimit(5)
+	require.Len(t, closest, 2)
+	require.Equal(t, "team-a", closest[0].Tenant)
+	require.Equal(t, "team-b", closest[1].Tenant)
+	require.False(t, closest[1].Exceeded())
+	require.Len(t, m.TenantsClosestToLimit(-1), 2)
+	require.Empty(t, m.TenantsClosestToLimit(0))
+
+	// Quotas can change while usage is read.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.SetQuota("team-a", Quota{MaxSeries: int64(100 + i)})
+			m.SetDefaultQuota(Quota{MaxSeries: int64(1000 + i)})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		m.Usage("team-a")
+		m.Usage("team-b")
+	}
+	wg.Wait()
+	require.Equal(t, Quota{MaxSeries: 199}, m.Usage("team-a").Quota)
+	require.Equal(t, Quota{MaxSeries: 1099}, m.Usage("team-b").Quota)
+
+	require.Equal(t, int64(20), m.GetCardinality("team-c", labels.MustNewMatcher(labels.MatchEqual, "__name__", "requests_total")))
+	require.Zero(t, m.GetCardinality("unknown", labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+}
+
+func TestTopLabelValues(t *testing.T) {
+	for _, ix := range []interface {
+		CardinalityIndex
+		LabelStatsIndex
+	}{NewBitmapIndex(), NewHyperMinHashIndex()} {
+		// Many small series for pod-0, few large ones for pod-1.
+		for i := 0; i < 10; i++ {
+			ix.AddSeries(labels.FromStrings("id", strconv.Itoa(i), "pod", "pod-0"), storage.SeriesRef(i))
+		}
+		for i := 0; i < 3; i++ {
+			ix.AddSeries(labels.FromStrings("path", strings.Repeat("x", 100)+strconv.Itoa(i), "pod", "pod-1"), storage.SeriesRef(100+i))
+		}
+
+		top := ix.TopLabelValues("pod", 1)
+		require.Equal(t, []LabelValueStats{{Value: "pod-0", Series: 10, Bytes: 10 * (2 + 1 + 3 + 5)}}, top)
+
+		top = ix.TopLabelValuesByBytes("pod", -1)
+		require.Len(t, top, 2)
+		require.Equal(t, "pod-1", top[0].Value)
+		require.Equal(t, int64(3), top[0].Series)
+		require.Equal(t, int64(3*(4+101+3+5)), top[0].Bytes)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	index := NewBitmapIndex()
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "id", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%2)), storage.SeriesRef(i))
+	}
+	old, err := TakeSnapshot(index, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	for i := 100; i < 200; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "id", strconv.Itoa(i), "pod", "pod-2"), storage.SeriesRef(i))
+	}
+	current, err := TakeSnapshot(index, time.Unix(3600, 0))
+	require.NoError(t, err)
+
+	// Round-trip through the serialized form.
+	var buf bytes.Buffer
+	_, err = current.WriteTo(&buf)
+	require.NoError(t, err)
+	current, err = ReadSnapshot(&buf)
+	require.NoError(t, err)
+
+	require.Equal(t, []ValueChange{
+		{Name: "__name__", Value: "up", Old: 100, New: 200},
+		{Name: "pod", Value: "pod-2", Old: 0, New: 100},
+	}, Diff(old, current, 1))
+
+	// Disappeared values are reported with a negative delta.
+	changes := Diff(current, old, 99)
+	require.Len(t, changes, 2)
+	require.Equal(t, int64(-100), changes[0].Delta())
+
+	require.Equal(t, []LabelChange{
+		{Name: "id", OldValues: 100, NewValues: 200},
+		{Name: "pod", OldValues: 2, NewValues: 3},
+	}, DiffLabels(old, current, 0))
+}
+
+func TestGallopingIntersect(t *testing.T) {
+	large := make([]uint64, 0, 1000)
+	for i := uint64(0); i < 1000; i++ {
+		large = append(large, i*3)
+	}
+
+	require.Equal(t, []uint64{0, 9, 2997}, gallopingIntersect([]uint64{0, 1, 9, 10, 2997, 5000}, large))
+	require.Equal(t, []uint64{0, 9, 2997}, gallopingIntersect(large, []uint64{0, 1, 9, 10, 2997, 5000}))
+	require.Empty(t, gallopingIntersect([]uint64{1, 2}, large[:0]))
+}
+
+func TestAllocatedRefs(t *testing.T) {
+	// Remote write has no series refs, so every series arrives with ref 0.
+	index := NewBitmapIndex(WithAllocatedRefs())
+	for i := 0; i < 10; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), 0)
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), 0)
+	}
+	require.Equal(t, int64(10), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "3")))
+
+	a := newRefAllocator()
+	first := labels.FromStrings("job", "a")
+	second := labels.FromStrings("job", "b")
+	ref, isNew := a.ref(first)
+	require.True(t, isNew)
+	require.Equal(t, storage.SeriesRef(1), ref)
+
+	// Pretend the second series' labels hash collides with the first one.
+	a.refs[second.Hash()] = a.refs[first.Hash()]
+	ref, isNew = a.ref(second)
+	require.True(t, isNew)
+	require.Equal(t, storage.SeriesRef(2), ref)
+	ref, isNew = a.ref(second)
+	require.False(t, isNew)
+	require.Equal(t, storage.SeriesRef(2), ref)
+	require.Len(t, a.conflicts[second.Hash()], 1)
+}
+
+func TestIndexFile(t *testing.T) {
+	index := NewBitmapIndex(WithValueBuckets(5, 2))
+	for i := 0; i < 20; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "job", fmt.Sprintf("job-%d", i%3), "pod", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	index.AddSeries(labels.FromStrings("__name__", "down", "job", "job-0"), 20)
+
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, WriteIndexFile(path, index))
+	f, err := OpenIndexFile(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")},
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "job-0")},
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "missing")},
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "job-1"), labels.MustNewMatcher(labels.MatchRegexp, "pod", "1.*")},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "__name__", "up"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-0")},
+		{labels.MustNewMatcher(labels.MatchNotRegexp, "pod", "1.*")},
+		// pod is bucketed.
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "3")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "3|4"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-0")},
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "")},
+	} {
+		require.Equal(t, index.GetCardinality(matchers...), f.GetCardinality(matchers...), "%v", matchers)
+	}
+	require.Equal(t, index.LabelNames(), f.LabelNames())
+	require.Equal(t, index.LabelValues("pod"), f.LabelValues("pod"))
+	require.Equal(t, []string{"job-0"}, f.LabelValues("job", labels.MustNewMatcher(labels.MatchEqual, "__name__", "down")))
+
+	// Version 1 files, without buckets, are still read.
+	unbucketed := NewBitmapIndex()
+	for i := 0; i < 20; i++ {
+		unbucketed.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	require.NoError(t, WriteIndexFile(path, unbucketed))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	toc := b[len(b)-indexFileTOCLen:]
+	namesStart := binary.BigEndian.Uint64(toc[16:])
+	v1 := append([]byte(nil), b[:namesStart]...)
+	v1[4] = 1
+	for e := b[namesStart : len(b)-indexFileTOCLen]; len(e) > 0; e = e[indexFileNameLen:] {
+		v1 = append(v1, e[:indexFileNameLenV1]...)
+	}
+	v1 = append(v1, toc...)
+	require.NoError(t, os.WriteFile(path, v1, 0o644))
+	v1File, err := OpenIndexFile(path)
+	require.NoError(t, err)
+	defer v1File.Close()
+	require.Equal(t, int64(3), v1File.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "1|2|3")))
+	require.Equal(t, unbucketed.LabelValues("pod"), v1File.LabelValues("pod"))
+
+	require.NoError(t, os.WriteFile(path, []byte("not an index file"), 0o644))
+	_, err = OpenIndexFile(path)
+	require.ErrorIs(t, err, ErrIndexFileCorrupted)
+
+	// Name entries out of the values section are refused on opening.
+	corrupted := append([]byte(nil), b...)
+	binary.BigEndian.PutUint64(corrupted[namesStart+4:], 1<<40)
+	require.NoError(t, os.WriteFile(path, corrupted, 0o644))
+	_, err = OpenIndexFile(path)
+	require.ErrorIs(t, err, ErrIndexFileCorrupted)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	start := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	for name, bkt := range map[string]SnapshotBucket{
+		"dir": DirBucket(t.TempDir()),
+		// Other buckets are downloaded to the cache directory.
+		"remote": struct{ SnapshotBucket }{DirBucket(t.TempDir())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cacheDir := t.TempDir()
+			store, err := NewSnapshotStore(bkt, cacheDir, 48*time.Hour)
+			require.NoError(t, err)
+
+			// A day of snapshots, one more pod every hour.
+			index := NewBitmapIndex()
+			for hour := range 24 {
+				index.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(hour)), storage.SeriesRef(hour))
+				require.NoError(t, store.Save(ctx, index, start.Add(time.Duration(hour)*time.Hour)))
+			}
+			// The snapshots saved are not kept in the cache directory.
+			cached, err := os.ReadDir(cacheDir)
+			require.NoError(t, err)
+			require.Empty(t, cached)
+			times, err := store.Snapshots(ctx)
+			require.NoError(t, err)
+			require.Len(t, times, 24)
+			require.True(t, times[0].Equal(start))
+
+			for _, tc := range []struct {
+				at   time.Time
+				want int64
+			}{
+				{start, 1},
+				{start.Add(90 * time.Minute), 2},
+				{start.Add(48 * time.Hour), 24},
+			} {
+				snapshot, taken, err := store.At(ctx, tc.at)
+				require.NoError(t, err)
+				require.Equal(t, tc.want, snapshot.GetCardinality(up), tc.at)
+				require.False(t, taken.After(tc.at))
+				require.NoError(t, snapshot.Close())
+			}
+			_, _, err = store.At(ctx, start.Add(-time.Second))
+			require.ErrorIs(t, err, ErrNoSnapshot)
+
+			// Saving two days later deletes the snapshots of the first
+			// 23 hours, and their downloads.
+			require.NoError(t, store.Save(ctx, index, start.Add(71*time.Hour)))
+			times, err = store.Snapshots(ctx)
+			require.NoError(t, err)
+			require.Len(t, times, 2)
+			_, _, err = store.At(ctx, start.Add(time.Hour))
+			require.ErrorIs(t, err, ErrNoSnapshot)
+			cached, err = os.ReadDir(cacheDir)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(cached), len(times))
+		})
+	}
+}
+
+func TestRouterIndex(t *testing.T) {
+	router := NewRouterIndex(NewBitmapIndex(), NewHyperMinHashIndex(), 5)
+	for i := 0; i < 100; i++ {
+		router.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.Equal(t, RouteExact, router.Route(up))
+	require.Equal(t, RouteExact, router.Route(up, labels.MustNewMatcher(labels.MatchRegexp, "pod", "1")))
+	require.Equal(t, RouteApprox, router.Route(up, labels.MustNewMatcher(labels.MatchRegexp, "pod", "1.*")))
+	require.Equal(t, int64(100), router.GetCardinality(up))
+
+	got, want := router.Verify(labels.MustNewMatcher(labels.MatchRegexp, "pod", "[1-5].*"))
+	require.Equal(t, int64(55), want)
+	require.InEpsilon(t, want, got, 0.1)
+}
+
+// doublingIndex overestimates every answer of its index by a factor of two.
+type doublingIndex struct {
+	*BitmapIndex
+}
+
+func (d doublingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return 2 * d.BitmapIndex.GetCardinality(matchers...)
+}
+
+func (d doublingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	return 2 * d.BitmapIndex.GetCardinalityContext(ctx, matchers...)
+}
+
+func TestCalibrator(t *testing.T) {
+	truth := NewBitmapIndex()
+	approx := doublingIndex{NewBitmapIndex()}
+	calibrator := NewCalibrator(approx, truth, true)
+	for i := 0; i < 50; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%5), "pod", fmt.Sprintf("pod-%d", i))
+		truth.AddSeries(lbls, storage.SeriesRef(i))
+		calibrator.AddSeries(lbls, storage.SeriesRef(i))
+	}
+
+	calibrator.CalibrateSamples(100)
+	stats := calibrator.Stats()
+	require.NotEmpty(t, stats)
+	for _, s := range stats {
+		require.InDelta(t, 1.0, s.Bias, 1e-9, s.Shape)
+		require.InDelta(t, 0.5, s.Correction, 1e-9, s.Shape)
+	}
+
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")
+	require.Equal(t, "=", MatcherShape(up))
+	require.Equal(t, int64(10), calibrator.GetCardinality(up))
+
+	// Labels without listable values, here bucketed, are skipped, and
+	// prefixes of multi-byte values stay valid regular expressions.
+	index := NewBitmapIndex(WithValueBuckets(5, 4))
+	for i := 0; i < 50; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "city", fmt.Sprintf("Zürich-日本-%d", i%3), "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+	}
+	require.Empty(t, index.LabelValues("pod"))
+	calibrator = NewCalibrator(index, index, false)
+	calibrator.CalibrateSamples(500)
+	require.NotEmpty(t, calibrator.Stats())
+}
+
+func TestEvaluateAccuracy(t *testing.T) {
+	m := func(t labels.MatchType, name, value string) *labels.Matcher {
+		return labels.MustNewMatcher(t, name, value)
+	}
+	for class, matchers := range map[MatcherClass][]*labels.Matcher{
+		ClassSingleEqual:   {m(labels.MatchEqual, "pod", "pod-1")},
+		ClassMultiEqual:    {m(labels.MatchEqual, "__name__", "up"), m(labels.MatchEqual, "pod", "pod-1")},
+		ClassEqualRegex:    {m(labels.MatchEqual, "__name__", "up"), m(labels.MatchRegexp, "pod", "pod-1.*")},
+		ClassEqualNegative: {m(labels.MatchEqual, "__name__", "up"), m(labels.MatchNotEqual, "pod", "pod-1")},
+		ClassMultiNegative: {m(labels.MatchEqual, "__name__", "up"), m(labels.MatchNotEqual, "pod", "pod-1"), m(labels.MatchNotRegexp, "job", "api|db")},
+		ClassSetRegex:      {m(labels.MatchRegexp, "pod", "pod-1|pod-2")},
+		ClassBroadRegex:    {m(labels.MatchRegexp, "__name__", "http_.*")},
+		ClassOther:         {m(labels.MatchNotEqual, "pod", "pod-1")},
+	} {
+		require.Equal(t, class, ClassifyMatchers(matchers...), "%v", matchers)
+	}
+
+	truth := NewBitmapIndex()
+	approx := doublingIndex{NewBitmapIndex()}
+	for i := 0; i < 100; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%5), "job", fmt.Sprintf("job-%d", i%3), "pod", fmt.Sprintf("pod-%d", i))
+		truth.AddSeries(lbls, storage.SeriesRef(i))
+		approx.AddSeries(lbls, storage.SeriesRef(i))
+	}
+
+	queries := AccuracyQueries(truth, 10, 1)
+	require.Equal(t, fmt.Sprint(queries), fmt.Sprint(AccuracyQueries(truth, 10, 1)))
+	report, err := EvaluateAccuracy(context.Background(), approx, truth, queries)
+	require.NoError(t, err)
+	require.Equal(t, len(queries), report.Queries)
+	require.Len(t, report.Classes, len(MatcherClasses)-1)
+	for _, c := range report.Classes {
+		require.Equal(t, 10, c.Queries, c.Class)
+		// The doubling index is off by 100% on every query with series.
+		require.LessOrEqual(t, c.P50, c.P90)
+		require.LessOrEqual(t, c.P99, c.Max)
+		require.Equal(t, 1.0, c.Max, c.Class)
+		require.Equal(t, c.Worst.Estimate, 2*c.Worst.Actual)
+	}
+
+	var md bytes.Buffer
+	require.NoError(t, report.WriteMarkdown(&md))
+	lines := strings.Split(strings.TrimSpace(md.String()), "\n")
+	require.Len(t, lines, len(report.Classes)+2)
+	require.True(t, strings.HasPrefix(lines[2], "| single-eq | 10 | "), lines[2])
+
+	// Prefixes of multi-byte values are cut on rune boundaries.
+	utf := NewBitmapIndex()
+	for i := 0; i < 20; i++ {
+		utf.AddSeries(labels.FromStrings("__name__", "up", "city", fmt.Sprintf("Zürich-日本-%d", i%3)), storage.SeriesRef(i))
+	}
+	for _, matchers := range AccuracyQueries(utf, 50, 1) {
+		for _, m := range matchers {
+			require.True(t, utf8.ValidString(m.Value), m.String())
+		}
+	}
+}
+
+func TestEmptyValueMatchers(t *testing.T) {
+	store := teststorage.New(t)
+	defer store.Close()
+
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	exactHashIndex := NewExactHashIndex()
+	blockIndex := NewBlockIndex(store)
+
+	app := store.Appender(context.Background())
+	for i := 0; i < 300; i++ {
+		b := labels.NewScratchBuilder(3)
+		b.Add("__name__", fmt.Sprintf("metric_%d", i%3))
+		b.Add("instance", strconv.Itoa(i))
+		// A third of the series has no job label.
+		if i%3 != 0 {
+			b.Add("job", fmt.Sprintf("job-%d", i%2))
+		}
+		b.Sort()
+		lbls := b.Labels()
+		ref, err := app.Append(0, lbls, 0, 0)
+		require.NoError(t, err)
+		bitmapIndex.AddSeries(lbls, ref)
+		hmhIndex.AddSeries(lbls, ref)
+		exactHashIndex.AddSeries(lbls, ref)
+	}
+	require.NoError(t, app.Commit())
+
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, WriteIndexFile(path, bitmapIndex))
+	indexFile, err := OpenIndexFile(path)
+	require.NoError(t, err)
+	defer indexFile.Close()
+
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "")},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "job", "")},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-0")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "job", "job-0|")},
+		{labels.MustNewMatcher(labels.MatchNotRegexp, "job", "job-.*")},
+		{labels.MustNewMatcher(labels.MatchEqual, "missing", "")},
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1"), labels.MustNewMatcher(labels.MatchEqual, "job", "")},
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0"), labels.MustNewMatcher(labels.MatchEqual, "job", "")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "__name__", "metric_[01]"), labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-1")},
+		{labels.MustNewMatcher(labels.MatchEqual, "job", ""), labels.MustNewMatcher(labels.MatchEqual, "missing", "")},
+	} {
+		want := blockIndex.GetCardinality(matchers...)
+		require.Equal(t, want, bitmapIndex.GetCardinality(matchers...), "BitmapIndex %v", matchers)
+		require.Equal(t, want, exactHashIndex.GetCardinality(matchers...), "ExactHashIndex %v", matchers)
+		require.Equal(t, want, indexFile.GetCardinality(matchers...), "IndexFile %v", matchers)
+		require.InDelta(t, want, hmhIndex.GetCardinality(matchers...), 0.1*float64(want)+2, "HyperMinHashIndex %v", matchers)
+	}
+}
+
+func TestExactHashIndexReAdds(t *testing.T) {
+	index := NewExactHashIndex()
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), 0)
+	}
+	memory := index.Stats().MemoryBytes
+
+	// Series added over and over, as by remote write, are compacted without
+	// being read.
+	for range 1000 {
+		for i := 0; i < 100; i++ {
+			index.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), 0)
+		}
+	}
+	require.Less(t, len(index.all.hashes), 2*100)
+	require.Less(t, len(index.index["__name__"]["up"].hashes), 2*100)
+	require.Less(t, len(index.index["pod"]["0"].hashes), 2*minHashSetCompaction)
+	// Every set has at most twice its hashes, or the hashes below which it
+	// isn't compacted.
+	require.Less(t, index.Stats().MemoryBytes, 2*memory+100*2*minHashSetCompaction*8)
+	require.Equal(t, int64(100), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	for name, index := range map[string]CardinalityIndex{
+		"exact":        NewExactHashIndex(),
+		"hyperminhash": NewHyperMinHashIndex(WithCooccurrenceTracking()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+			pods := labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 500; i++ {
+						index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i), "worker", strconv.Itoa(w)), 0)
+						index.GetCardinality(up, pods)
+					}
+				}()
+			}
+			wg.Wait()
+			require.InEpsilon(t, 2000, index.GetCardinality(up), 0.05)
+		})
+	}
+}
+
+func TestUnknownLabelMatchers(t *testing.T) {
+	store := teststorage.New(t)
+	defer store.Close()
+
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	exactHashIndex := NewExactHashIndex()
+	blockIndex := NewBlockIndex(store)
+
+	app := store.Appender(context.Background())
+	for i := 0; i < 200; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "instance", strconv.Itoa(i))
+		ref, err := app.Append(0, lbls, 0, 0)
+		require.NoError(t, err)
+		bitmapIndex.AddSeries(lbls, ref)
+		hmhIndex.AddSeries(lbls, ref)
+		exactHashIndex.AddSeries(lbls, ref)
+	}
+	require.NoError(t, app.Commit())
+
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, WriteIndexFile(path, bitmapIndex))
+	indexFile, err := OpenIndexFile(path)
+	require.NoError(t, err)
+	defer indexFile.Close()
+
+	indexes := map[string]CardinalityIndex{
+		"BitmapIndex":       bitmapIndex,
+		"ExactHashIndex":    exactHashIndex,
+		"HyperMinHashIndex": hmhIndex,
+		"IndexFile":         indexFile,
+	}
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchNotEqual, "unknown", "x")},
+		{labels.MustNewMatcher(labels.MatchNotRegexp, "unknown", "x|y")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "unknown", ".*")},
+		{labels.MustNewMatcher(labels.MatchEqual, "unknown", "x")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "unknown", ".+")},
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1"), labels.MustNewMatcher(labels.MatchNotEqual, "unknown", "x")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "__name__", "metric_[12]"), labels.MustNewMatcher(labels.MatchNotRegexp, "unknown", "x")},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "unknown", "x"), labels.MustNewMatcher(labels.MatchNotEqual, "other", "y")},
+	} {
+		want := blockIndex.GetCardinality(matchers...)
+		for name, index := range indexes {
+			if name == "HyperMinHashIndex" {
+				require.InDelta(t, want, index.GetCardinality(matchers...), 0.1*float64(want)+2, "%s %v", name, matchers)
+			} else {
+				require.Equal(t, want, index.GetCardinality(matchers...), "%s %v", name, matchers)
+			}
+		}
+
+		wantNames := blockIndex.LabelNames(matchers...)
+		wantValues := blockIndex.LabelValues("__name__", matchers...)
+		for name, index := range indexes {
+			valuesIndex := index.(LabelValuesIndex)
+			require.ElementsMatch(t, wantNames, valuesIndex.LabelNames(matchers...), "%s %v", name, matchers)
+			require.ElementsMatch(t, wantValues, valuesIndex.LabelValues("__name__", matchers...), "%s %v", name, matchers)
+		}
+	}
+}
+
+func TestChurnTracker(t *testing.T) {
+	churn := NewChurnTracker(time.Minute, time.Hour, func() CardinalityIndex { return NewBitmapIndex() })
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+
+	// 10 pods exist from the start, and a new pod is added every minute
+	// for an hour while the old ones keep being scraped.
+	ref := storage.SeriesRef(0)
+	for minute := 0; minute <= 60; minute++ {
+		ts := start.Add(time.Duration(minute) * time.Minute)
+		for pod := 0; pod < 10+minute; pod++ {
+			ref++
+			churn.AddSeriesAt(labels.FromStrings("job", "api", "pod", strconv.Itoa(pod)), ref, ts)
+		}
+	}
+
+	now := start.Add(60 * time.Minute)
+	require.Equal(t, int64(1), churn.NewSeries(now, job))
+	require.Equal(t, int64(11), churn.NewSeries(now.Add(-10*time.Minute), job))
+	require.Equal(t, int64(70), churn.NewSeries(start, job))
+	require.Equal(t, int64(0), churn.NewSeries(now, labels.MustNewMatcher(labels.MatchEqual, "job", "db")))
+
+	// The first minute drops out of the retention, but its pods are still
+	// known and don't count as new.
+	churn.AddSeriesAt(labels.FromStrings("job", "api", "pod", "0"), 1, start.Add(61*time.Minute))
+	churn.AddSeriesAt(labels.FromStrings("job", "api", "pod", "new"), ref+1, start.Add(61*time.Minute))
+	require.Equal(t, int64(61), churn.NewSeries(start, job))
+}
+
+func TestEvictStale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := NewBitmapIndex(WithValueTTL(time.Hour))
+	index.now = func() time.Time { return now }
+
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	for i := 0; i < 10; i++ {
+		index.AddSeries(labels.FromStrings("job", "api", "pod", fmt.Sprintf("old-%d", i)), storage.SeriesRef(i))
+	}
+
+	// The old pods churn away, new ones keep being scraped.
+	now = now.Add(45 * time.Minute)
+	for i := 0; i < 5; i++ {
+		index.AddSeries(labels.FromStrings("job", "api", "pod", fmt.Sprintf("new-%d", i)), storage.SeriesRef(100+i))
+	}
+	now = now.Add(30 * time.Minute)
+	index.AddSeries(labels.FromStrings("job", "api", "pod", "new-0"), 100)
+	require.Equal(t, int64(15), index.GetCardinality(job))
+	require.Equal(t, []LabelValueStats{{Value: "api", Series: 15, Bytes: 15 * 14}}, index.TopLabelValues("job", 1))
+
+	require.Equal(t, 10, index.EvictStale())
+	require.Equal(t, int64(5), index.GetCardinality(job))
+	require.Equal(t, int64(5), index.GetCardinality(labels.MustNewMatcher(labels.MatchNotEqual, "pod", "")))
+	require.Equal(t, []string{"new-0", "new-1", "new-2", "new-3", "new-4"}, index.LabelValues("pod"))
+	require.Equal(t, []LabelValueStats{{Value: "api", Series: 5, Bytes: 5 * 14}}, index.TopLabelValues("job", 1))
+
+	// An evicted series that comes back is indexed again.
+	index.AddSeries(labels.FromStrings("job", "api", "pod", "old-0"), 0)
+	require.Equal(t, int64(6), index.GetCardinality(job))
+}
+
+func TestSketchDeltas(t *testing.T) {
+	ingesters := []*HyperMinHashIndex{NewHyperMinHashIndex(WithDeltaTracking()), NewHyperMinHashIndex(WithDeltaTracking())}
+	aggregator := NewHyperMinHashIndex()
+	federate := func() int {
+		sketches := 0
+		for _, ingester := range ingesters {
+			var buf bytes.Buffer
+			_, err := ingester.ExportDelta().WriteTo(&buf)
+			require.NoError(t, err)
+			delta, err := ReadSketchDelta(&buf)
+			require.NoError(t, err)
+			sketches += delta.Len()
+			aggregator.ApplyDelta(delta)
+		}
+		return sketches
+	}
+
+	for i := 0; i < 1000; i++ {
+		ingesters[i%2].AddSeries(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%10), "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+	}
+	require.Equal(t, 2*(5+500), federate())
+
+	// A corrupted label length is refused instead of allocated, and so
+	// are unknown versions and flags.
+	for _, b := range [][]byte{
+		binary.AppendUvarint([]byte{deltaVersion, 0, 1}, 1<<40),
+		{0, 1},
+		{deltaVersion, 2},
+	} {
+		_, err := ReadSketchDelta(bytes.NewReader(b))
+		require.ErrorIs(t, err, ErrSketchDeltaCorrupted)
+	}
+
+	// Only the sketches touched since the previous export are sent.
+	ingesters[0].AddSeries(labels.FromStrings("__name__", "metric_0", "pod", "pod-new"), 1000)
+	require.Equal(t, 2, federate())
+	require.Equal(t, 0, federate())
+
+	require.InDelta(t, 101, aggregator.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")), 5)
+	require.InDelta(t, 1001, aggregator.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-.*")), 30)
+	require.InDelta(t, 0, aggregator.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "")), 30)
+}
+
+func TestSketchDeltaBuckets(t *testing.T) {
+	ingester := NewHyperMinHashIndex(WithDeltaTracking(), WithValueBuckets(100, 8))
+	aggregators := []*HyperMinHashIndex{NewHyperMinHashIndex(), NewHyperMinHashIndex(WithValueBuckets(100, 4))}
+	federate := func() {
+		var buf bytes.Buffer
+		_, err := ingester.ExportDelta().WriteTo(&buf)
+		require.NoError(t, err)
+		delta, err := ReadSketchDelta(&buf)
+		require.NoError(t, err)
+		for _, aggregator := range aggregators {
+			aggregator.ApplyDelta(delta)
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		aggregators[1].AddSeries(labels.FromStrings("__name__", "up", "id", fmt.Sprintf("id-%d", i)), storage.SeriesRef(i))
+	}
+	for i := 0; i < 50; i++ {
+		ingester.AddSeries(labels.FromStrings("__name__", "up", "id", fmt.Sprintf("id-%d", i)), storage.SeriesRef(i))
+	}
+	federate()
+	// The label is bucketed after the values were exported.
+	for i := 50; i < 1000; i++ {
+		ingester.AddSeries(labels.FromStrings("__name__", "up", "id", fmt.Sprintf("id-%d", i)), storage.SeriesRef(i))
+	}
+	federate()
+
+	id := labels.MustNewMatcher(labels.MatchEqual, "id", "id-1")
+	for _, aggregator := range aggregators {
+		require.True(t, aggregator.core.Bucketed("id"))
+		require.InDelta(t, 1000, aggregator.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "id", ".+")), 30)
+		buckets, _ := aggregator.core.Buckets("id")
+		require.InDelta(t, 1000, buckets.Values(), 30)
+	}
+	// Buckets are merged one for one into as many buckets, and into every
+	// bucket of a label bucketed into 4 otherwise.
+	require.InDelta(t, ingester.GetCardinality(id), aggregators[0].GetCardinality(id), 10)
+	require.InDelta(t, 1000, aggregators[1].GetCardinality(id), 30)
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	lbls := labels.Labels{{Name: "pod", Value: "a"}, {Name: "__name__", Value: "up"}, {Name: "pod", Value: "a"}, {Name: "job", Value: ""}}
+	normalized, err := NormalizeLabels(lbls)
+	require.NoError(t, err)
+	require.Equal(t, labels.FromStrings("__name__", "up", "pod", "a"), normalized)
+	require.Equal(t, "pod", lbls[0].Name, "input must not be modified")
+
+	_, err = NormalizeLabels(labels.Labels{{Name: "pod", Value: "a"}, {Name: "pod", Value: "b"}})
+	require.ErrorIs(t, err, ErrDuplicateLabelName)
+	_, err = NormalizeLabels(labels.Labels{{Name: "", Value: "a"}})
+	require.ErrorIs(t, err, ErrEmptyLabelName)
+
+	index := NewBitmapIndex()
+	require.NoError(t, AddSeriesValidated(index, lbls, 1))
+	require.Error(t, AddSeriesValidated(index, labels.Labels{{Name: "", Value: "a"}}, 2))
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "a")))
+	require.Equal(t, []string{"__name__", "pod"}, index.LabelNames())
+}
+
+func TestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	bitmapIndex := NewBitmapIndex(WithValueBuckets(10, 4), WithLogger(logger))
+	hmhIndex := NewHyperMinHashIndex(WithValueBuckets(10, 4), WithLogger(logger))
+	for i := 0; i < 20; i++ {
+		lbls := labels.FromStrings("__name__", "up", "id", strconv.Itoa(i))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	// Both indexes log the label once, when it crosses the threshold.
+	require.Equal(t, 2, strings.Count(logs.String(), `level=INFO msg="Bucketing label values" label=id`))
+
+	// A zero threshold logs every evaluation.
+	logs.Reset()
+	index := NewLoggingIndex(bitmapIndex, logger, 0)
+	require.Equal(t, int64(20), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Contains(t, logs.String(), `level=DEBUG msg="Slow matcher evaluation" matchers="[__name__=\"up\"]" cardinality=20`)
+
+	logs.Reset()
+	index = NewLoggingIndex(bitmapIndex, logger, time.Hour)
+	index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	require.Empty(t, logs.String())
+
+	dir := t.TempDir()
+	createTestBlock(t, dir, 0, 1)
+	r := NewReindexer(dir, nil, func() *BitmapIndex { return NewBitmapIndex() }, WithBuildLogger(logger))
+	require.NoError(t, r.Reindex(context.Background()))
+	require.Contains(t, logs.String(), `msg="Indexed block"`)
+	require.Contains(t, logs.String(), `msg="Rebuilt index"`)
+	require.Contains(t, logs.String(), "blocks=1 series=2")
+}
+
+func TestSimplifyMatchers(t *testing.T) {
+	m := labels.MustNewMatcher
+	for _, tc := range []struct {
+		matchers []*labels.Matcher
+		want     []*labels.Matcher
+		ok       bool
+	}{
+		{
+			matchers: []*labels.Matcher{m(labels.MatchEqual, "job", "api"), m(labels.MatchRegexp, "pod", ".*")},
+			want:     []*labels.Matcher{m(labels.MatchEqual, "job", "api")},
+			ok:       true,
+		},
+		{
+			matchers: []*labels.Matcher{m(labels.MatchRegexp, "method", "GET"), m(labels.MatchNotRegexp, "code", "500")},
+			want:     []*labels.Matcher{m(labels.MatchEqual, "method", "GET"), m(labels.MatchNotEqual, "code", "500")},
+			ok:       true,
+		},
+		{
+			matchers: []*labels.Matcher{m(labels.MatchNotEqual, "job", "a"), m(labels.MatchNotEqual, "job", "a"), m(labels.MatchRegexp, "pod", "p.+")},
+			want:     []*labels.Matcher{m(labels.MatchNotEqual, "job", "a"), m(labels.MatchRegexp, "pod", "p.+")},
+			ok:       true,
+		},
+		{
+			matchers: []*labels.Matcher{m(labels.MatchEqual, "job", "api"), m(labels.MatchRegexp, "job", "a.*"), m(labels.MatchNotEqual, "job", "db")},
+			want:     []*labels.Matcher{m(labels.MatchEqual, "job", "api")},
+			ok:       true,
+		},
+		{
+			matchers: []*labels.Matcher{m(labels.MatchRegexp, "pod", ".*"), m(labels.MatchRegexp, "job", ".*")},
+			want:     []*labels.Matcher{m(labels.MatchRegexp, "pod", ".*")},
+			ok:       true,
+		},
+		{matchers: []*labels.Matcher{m(labels.MatchEqual, "job", "a"), m(labels.MatchEqual, "job", "b")}},
+		{matchers: []*labels.Matcher{m(labels.MatchRegexp, "job", "a"), m(labels.MatchEqual, "job", "b")}},
+		{matchers: []*labels.Matcher{m(labels.MatchEqual, "job", "a"), m(labels.MatchNotRegexp, "job", "a|b")}},
+		{matchers: []*labels.Matcher{m(labels.MatchEqual, "job", ""), m(labels.MatchNotEqual, "job", "")}},
+	} {
+		got, ok := SimplifyMatchers(tc.matchers)
+		require.Equal(t, tc.ok, ok, "%v", tc.matchers)
+		if !ok {
+			continue
+		}
+		require.Equal(t, matcherStrings(tc.want), matcherStrings(got), "%v", tc.matchers)
+	}
+
+	// Simplified matchers give the same answers.
+	store := teststorage.New(t)
+	defer store.Close()
+	blockIndex := NewBlockIndex(store)
+	bitmapIndex := NewBitmapIndex()
+	exactHashIndex := NewExactHashIndex()
+	app := store.Appender(context.Background())
+	for i := 0; i < 100; i++ {
+		lbls := labels.FromStrings("__name__", "requests_total", "job", fmt.Sprintf("job-%d", i%3), "method", []string{"GET", "POST"}[i%2])
+		ref, err := app.Append(0, lbls, 0, 0)
+		require.NoError(t, err)
+		bitmapIndex.AddSeries(lbls, ref)
+		exactHashIndex.AddSeries(lbls, ref)
+	}
+	require.NoError(t, app.Commit())
+	for _, matchers := range [][]*labels.Matcher{
+		{m(labels.MatchRegexp, "method", "GET")},
+		{m(labels.MatchRegexp, "job", ".*")},
+		{m(labels.MatchRegexp, "job", ".*"), m(labels.MatchRegexp, "unknown", ".*")},
+		{m(labels.MatchEqual, "job", "job-1"), m(labels.MatchRegexp, "job", "job-.*")},
+		{m(labels.MatchEqual, "job", "job-1"), m(labels.MatchEqual, "job", "job-2")},
+		{m(labels.MatchNotRegexp, "method", "GET"), m(labels.MatchNotRegexp, "method", "GET")},
+	} {
+		want := blockIndex.GetCardinality(matchers...)
+		require.Equal(t, want, bitmapIndex.GetCardinality(matchers...), "%v", matchers)
+		require.Equal(t, want, exactHashIndex.GetCardinality(matchers...), "%v", matchers)
+	}
+}
+
+func TestGetCardinalityWithPostings(t *testing.T) {
+	bitmapIndex := NewBitmapIndex()
+	for i := 1; i <= 100; i++ {
+		bitmapIndex.AddSeries(labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%4)), storage.SeriesRef(i))
+	}
+	// The shard owns the first half of the series, and a ref unknown to
+	// the index.
+	var shard []storage.SeriesRef
+	for i := 1; i <= 50; i++ {
+		shard = append(shard, storage.SeriesRef(i))
+	}
+	shard = append(shard, 1000)
+
+	card, err := bitmapIndex.GetCardinalityWithPostings(index.NewListPostings(shard), labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1"))
+	require.NoError(t, err)
+	require.Equal(t, int64(13), card)
+
+	card, err = bitmapIndex.GetCardinalityWithPostings(index.NewListPostings(shard), labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1"), labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-2"))
+	require.NoError(t, err)
+	require.Zero(t, card)
+
+	card, err = bitmapIndex.GetCardinalityWithPostings(index.NewListPostings(shard))
+	require.NoError(t, err)
+	require.Equal(t, int64(50), card)
+
+	_, err = bitmapIndex.GetCardinalityWithPostings(index.ErrPostings(errors.New("read failed")))
+	require.Error(t, err)
+}
+
+func TestShardCardinalities(t *testing.T) {
+	bitmapIndex := NewBitmapIndex(WithSeriesHashes())
+	want := make([]int64, 4)
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%2))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		if i%2 == 0 {
+			want[lbls.Hash()%4]++
+		}
+	}
+
+	pod0 := labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")
+	shards, err := bitmapIndex.ShardCardinalities(4, pod0)
+	require.NoError(t, err)
+	require.Equal(t, want, shards)
+
+	card, err := bitmapIndex.GetShardCardinality(2, 4, pod0)
+	require.NoError(t, err)
+	require.Equal(t, want[2], card)
+
+	_, err = bitmapIndex.GetShardCardinality(4, 4, pod0)
+	require.Error(t, err)
+	_, err = NewBitmapIndex().ShardCardinalities(4, pod0)
+	require.ErrorIs(t, err, ErrSeriesHashesNotTracked)
+}
+
+func TestIndexStats(t *testing.T) {
+	start := time.Now()
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	exactHashIndex := NewExactHashIndex()
+	for i := 0; i < 100; i++ {
+		lbls := labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%4))
+		for _, index := range []CardinalityIndex{bitmapIndex, hmhIndex, exactHashIndex} {
+			index.AddSeries(lbls, storage.SeriesRef(i))
+			index.AddSeries(lbls, storage.SeriesRef(i))
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, WriteIndexFile(path, bitmapIndex))
+	indexFile, err := OpenIndexFile(path)
+	require.NoError(t, err)
+	defer indexFile.Close()
+
+	for name, index := range map[string]StatsIndex{
+		"BitmapIndex":       bitmapIndex,
+		"HyperMinHashIndex": hmhIndex,
+		"ExactHashIndex":    exactHashIndex,
+		"IndexFile":         indexFile,
+	} {
+		stats := index.Stats()
+		require.Equal(t, 3, stats.LabelNames, name)
+		require.Equal(t, 105, stats.LabelValues, name)
+		require.InDelta(t, 100, stats.Series, 2, name)
+		require.Positive(t, stats.MemoryBytes, name)
+		require.Zero(t, stats.Errors, name)
+		if name == "IndexFile" {
+			require.Zero(t, stats.SeriesAdded)
+			require.True(t, stats.LastUpdate.IsZero())
+			continue
+		}
+		require.Equal(t, int64(100), stats.SeriesAdded, name)
+		require.False(t, stats.LastUpdate.Before(start), name)
+	}
+
+	// Corrupted postings are counted instead of panicking.
+	require.True(t, indexFile.postings([]byte{1, 2, 3}).IsEmpty())
+	require.Equal(t, int64(1), indexFile.Stats().Errors)
+}
+
+func TestMatcherCache(t *testing.T) {
+	cache := NewMatcherCache(2)
+
+	m1, err := cache.NewMatcher(labels.MatchRegexp, "job", "api.*")
+	require.NoError(t, err)
+	m2, err := cache.NewMatcher(labels.MatchRegexp, "job", "api.*")
+	require.NoError(t, err)
+	require.Same(t, m1, m2)
+	require.True(t, m2.Matches("api-server"))
+
+	// Equality matchers aren't cached.
+	cache.MustNewMatcher(labels.MatchEqual, "job", "api")
+	require.Equal(t, MatcherCacheStats{Hits: 1, Misses: 1, Size: 1}, cache.Stats())
+
+	_, err = cache.NewMatcher(labels.MatchRegexp, "job", "(")
+	require.Error(t, err)
+
+	cache.MustNewMatcher(labels.MatchNotRegexp, "job", "api.*")
+	cache.MustNewMatcher(labels.MatchRegexp, "instance", ".+")
+	require.Equal(t, MatcherCacheStats{Hits: 1, Misses: 4, Evictions: 1, Size: 2}, cache.Stats())
+	require.NotSame(t, m1, cache.MustNewMatcher(labels.MatchRegexp, "job", "api.*"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.MustNewMatcher(labels.MatchRegexp, "job", fmt.Sprintf("api-%d", j%4))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 2, cache.Stats().Size)
+
+	// Parsed selectors share the matchers of their normalized patterns.
+	cache = NewMatcherCache(10)
+	a, err := cache.ParseSelector(`{job=~"^api.*$", pod="pod-1"}`)
+	require.NoError(t, err)
+	b, err := cache.ParseSelector(`{job=~"api.*"}`)
+	require.NoError(t, err)
+	require.Same(t, a[0], b[0])
+	require.Equal(t, "api.*", a[0].Value)
+	require.Equal(t, MatcherCacheStats{Hits: 1, Misses: 1, Size: 1}, cache.Stats())
+	_, err = cache.ParseSelector(`{job=~"("}`)
+	require.Error(t, err)
+}
+
+func TestSymbolTable(t *testing.T) {
+	symbols := NewSymbolTable()
+	a := symbols.Ref("a")
+	require.Equal(t, a, symbols.Ref("a"))
+	b := symbols.Ref("b")
+	require.Equal(t, "b", symbols.String(b))
+	require.Equal(t, 2, symbols.Len())
+
+	// IDs are reused once all references are released.
+	symbols.Release(a)
+	_, ok := symbols.Lookup("a")
+	require.True(t, ok)
+	symbols.Release(a)
+	_, ok = symbols.Lookup("a")
+	require.False(t, ok)
+	require.Equal(t, a, symbols.Ref("c"))
+	require.Equal(t, 2, symbols.Len())
+
+	// Indexes sharing a table reference every value once per index.
+	shared := NewSymbolTable()
+	now := time.Now()
+	first := NewBitmapIndex(WithSymbolTable(shared), WithValueTTL(time.Hour))
+	first.now = func() time.Time { return now }
+	second := NewBitmapIndex(WithSymbolTable(shared))
+	for i := 0; i < 10; i++ {
+		lbls := labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i))
+		first.AddSeries(lbls, storage.SeriesRef(i))
+		second.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	require.Equal(t, 11, shared.Len())
+	require.Equal(t, int64(1), first.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3")))
+	require.Equal(t, int64(9), second.GetCardinality(labels.MustNewMatcher(labels.MatchNotEqual, "pod", "pod-3")))
+	require.Equal(t, int64(10), second.GetCardinality(labels.MustNewMatcher(labels.MatchNotEqual, "pod", "unknown")))
+	require.Equal(t, int64(2), second.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[12]")))
+
+	// Evicted values are released, the second index still holds them.
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, 11, first.EvictStale())
+	require.Equal(t, 11, shared.Len())
+	require.Equal(t, []string{"pod-0", "pod-1"}, second.LabelValues("pod")[:2])
+	require.Zero(t, first.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3")))
+}
+
+func TestStreamCardinality(t *testing.T) {
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	for i := 0; i < 100; i++ {
+		lbls := labels.FromStrings("__name__", "requests", "pod", fmt.Sprintf("pod-%d", i%50), "status", strconv.Itoa(200+i%2))
+		if i%10 == 0 {
+			lbls = labels.FromStrings("__name__", "requests", "status", strconv.Itoa(200+i%2))
+		}
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+
+	collect := func(index CardinalityIndex, matchers ...*labels.Matcher) []Progress {
+		var results []Progress
+		require.NoError(t, StreamCardinality(context.Background(), index, 10, func(p Progress) error {
+			results = append(results, p)
+			return nil
+		}, matchers...))
+		return results
+	}
+
+	// The series without the pod label match "" and are counted upfront.
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "status", "200"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "pod", "pod-1.*"),
+	}
+	results := collect(bitmapIndex, matchers...)
+	require.Len(t, results, 4)
+	for i, p := range results {
+		require.Equal(t, 35, p.ValuesTotal)
+		require.Equal(t, min(10*(i+1), 35), p.ValuesDone)
+		require.Equal(t, i == 3, p.Done)
+		require.LessOrEqual(t, p.Series, bitmapIndex.GetCardinality(matchers...))
+	}
+	require.Equal(t, bitmapIndex.GetCardinality(matchers...), results[3].Series)
+	require.Equal(t, results[3].Series, results[3].Estimate)
+
+	// Chunk sizes of zero or less mean the default chunk size.
+	for _, chunkSize := range []int{0, -1} {
+		results = nil
+		require.NoError(t, bitmapIndex.StreamCardinality(context.Background(), chunkSize, func(p Progress) error {
+			results = append(results, p)
+			return nil
+		}, matchers...))
+		require.Equal(t, []Progress{{ValuesDone: 35, ValuesTotal: 35, Series: bitmapIndex.GetCardinality(matchers...), Estimate: bitmapIndex.GetCardinality(matchers...), Done: true}}, results, chunkSize)
+	}
+
+	// Indexes without streaming support report the final result only.
+	results = collect(hmhIndex, matchers...)
+	require.Len(t, results, 1)
+	require.True(t, results[0].Done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := bitmapIndex.StreamCardinality(ctx, 10, func(Progress) error {
+		calls++
+		cancel()
+		return nil
+	}, matchers...)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, calls)
+}
+
+// fuzzReader turns fuzz input into choices, returning zeros once the input
+// is exhausted.
+type fuzzReader []byte
+
+func (r *fuzzReader) next(n int) int {
+	if len(*r) == 0 {
+		return 0
+	}
+	b := (*r)[0]
+	*r = (*r)[1:]
+	return int(b) % n
+}
+
+func FuzzCardinality(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("\x10\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c"))
+	f.Add([]byte("\x3f\xff\x00\x11\x22\x33\x44\x55\x66\x77\x88\x99\xaa\xbb\xcc\xdd\xee"))
+	f.Add([]byte("\x20\x05\x01\x03\x00\x02\x04\x01\x01\x02\x03\x02\x01\x04\x03\x05"))
+
+	values := []string{"", "x", "y", "z", "xy"}
+	patterns := []string{"", "x", "y", "x|y", ".*", ".+", "x.*", "metric_1", "metric_.*", "|x", "("}
+	names := []string{"__name__", "a", "b", "c", "unknown"}
+	types := []labels.MatchType{labels.MatchEqual, labels.MatchNotEqual, labels.MatchRegexp, labels.MatchNotRegexp}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := fuzzReader(data)
+		store := teststorage.New(t)
+		defer store.Close()
+
+		bitmapIndex := NewBitmapIndex()
+		hmhIndex := NewHyperMinHashIndex()
+		exactHashIndex := NewExactHashIndex()
+		blockIndex := NewBlockIndex(store)
+
+		app := store.Appender(context.Background())
+		numSeries := 1 + r.next(64)
+		for i := 0; i < numSeries; i++ {
+			b := labels.NewScratchBuilder(4)
+			b.Add("__name__", fmt.Sprintf("metric_%d", r.next(4)))
+			for _, name := range names[1:4] {
+				// Empty values leave the label out.
+				if value := values[r.next(len(values))]; value != "" {
+					b.Add(name, value)
+				}
+			}
+			b.Sort()
+			lbls := b.Labels()
+			ref, err := app.Append(0, lbls, 0, 0)
+			require.NoError(t, err)
+			bitmapIndex.AddSeries(lbls, ref)
+			hmhIndex.AddSeries(lbls, ref)
+			exactHashIndex.AddSeries(lbls, ref)
+		}
+		require.NoError(t, app.Commit())
+
+		path := filepath.Join(t.TempDir(), "index")
+		require.NoError(t, WriteIndexFile(path, bitmapIndex))
+		indexFile, err := OpenIndexFile(path)
+		require.NoError(t, err)
+		defer indexFile.Close()
+
+		for i := 0; i < 8; i++ {
+			var matchers []*labels.Matcher
+			for j := 0; j <= r.next(3); j++ {
+				m, err := labels.NewMatcher(types[r.next(len(types))], names[r.next(len(names))], patterns[r.next(len(patterns))])
+				if err != nil {
+					continue
+				}
+				matchers = append(matchers, m)
+			}
+			if len(matchers) == 0 {
+				continue
+			}
+
+			want := blockIndex.GetCardinality(matchers...)
+			require.Equal(t, want, bitmapIndex.GetCardinality(matchers...), "BitmapIndex %v", matchers)
+			require.Equal(t, want, exactHashIndex.GetCardinality(matchers...), "ExactHashIndex %v", matchers)
+			require.Equal(t, want, indexFile.GetCardinality(matchers...), "IndexFile %v", matchers)
+			require.InDelta(t, want, hmhIndex.GetCardinality(matchers...), 0.1*float64(max(want, 20)), "HyperMinHashIndex %v", matchers)
+		}
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "instance", strconv.Itoa(i), "job", fmt.Sprintf("job-%d", i%10))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "__name__", "metric_[12]"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-1"),
+	}
+
+	q := NewQueryContext(1 << 20)
+	ctx := ContextWithQuery(context.Background(), q)
+	for _, index := range []ContextIndex{bitmapIndex, hmhIndex} {
+		want := index.(CardinalityIndex).GetCardinality(matchers...)
+		for i := 0; i < 3; i++ {
+			require.Equal(t, want, index.GetCardinalityContext(ctx, matchers...))
+			require.NoError(t, q.Err())
+		}
+	}
+	// The scratch structures are reused by every query.
+	require.Len(t, q.bitmaps, 2)
+	require.Equal(t, 2, q.sketches.InUse())
+
+	q = AcquireQueryContext(100)
+	ctx = ContextWithQuery(context.Background(), q)
+	for _, index := range []ContextIndex{bitmapIndex, hmhIndex} {
+		require.Zero(t, index.GetCardinalityContext(ctx, matchers...))
+		require.ErrorIs(t, q.Err(), ErrMemoryBudgetExceeded)
+	}
+	q.Release()
+}
+
+func TestQueryLimits(t *testing.T) {
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%2), "instance", strconv.Itoa(i), "zone", fmt.Sprintf("zone-%d", i%4))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	hostile := labels.MustNewMatcher(labels.MatchRegexp, "instance", ".*1.*1.*")
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")
+	zone := labels.MustNewMatcher(labels.MatchEqual, "zone", "zone-1")
+
+	for name, index := range map[string]ContextIndex{"BitmapIndex": bitmapIndex, "HyperMinHashIndex": hmhIndex} {
+		t.Run(name, func(t *testing.T) {
+			q := NewQueryContext(0)
+			ctx := ContextWithQuery(context.Background(), q)
+			exact := index.GetCardinalityContext(ctx, hostile, metric)
+			require.False(t, q.Truncated())
+
+			// The regex can't be evaluated, so it selects every series with
+			// the label.
+			q.SetLimits(QueryLimits{MaxValuesScanned: 100})
+			truncated := index.GetCardinalityContext(ctx, hostile, metric)
+			require.True(t, q.Truncated())
+			require.Greater(t, truncated, exact)
+			require.InDelta(t, 500, truncated, 50)
+
+			// Cheap matchers aren't affected.
+			require.InDelta(t, 250, index.GetCardinalityContext(ctx, metric, zone), 25)
+			require.False(t, q.Truncated())
+
+			// Matchers left out of the intersection only widen the answer.
+			q.SetLimits(QueryLimits{MaxMerges: 1})
+			require.GreaterOrEqual(t, index.GetCardinalityContext(ctx, metric, zone), int64(250))
+			require.True(t, q.Truncated())
+		})
+	}
+}
+
+func TestLabelPairs(t *testing.T) {
+	now := time.Now()
+	bitmapIndex := NewBitmapIndex(WithLabelPairs([2]string{"__name__", "pod"}), WithValueTTL(time.Hour))
+	bitmapIndex.now = func() time.Time { return now }
+	hmhIndex := NewHyperMinHashIndex(WithLabelPairs([2]string{"__name__", "pod"}))
+	for i := 0; i < 10000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%10), "instance", strconv.Itoa(i), "pod", fmt.Sprintf("pod-%d", i%1000))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+
+	// The pair is answered exactly by the sketch index, in either order.
+	pair := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3"),
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_3"),
+	}
+	require.Equal(t, int64(10), bitmapIndex.GetCardinality(pair...))
+	require.Equal(t, int64(10), hmhIndex.GetCardinality(pair...))
+	require.Zero(t, hmhIndex.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3"), labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_4")))
+
+	withInstance := append(pair, labels.MustNewMatcher(labels.MatchRegexp, "instance", "[0-4].*"))
+	require.Equal(t, int64(5), bitmapIndex.GetCardinality(withInstance...))
+	require.InDelta(t, 5, hmhIndex.GetCardinality(withInstance...), 2)
+
+	// Evicted series are dropped from the pairs.
+	now = now.Add(2 * time.Hour)
+	bitmapIndex.AddSeries(labels.FromStrings("__name__", "metric_3", "instance", "new", "pod", "pod-3"), 10000)
+	bitmapIndex.EvictStale()
+	require.Equal(t, int64(1), bitmapIndex.GetCardinality(pair...))
+}
+
+func TestLabelDependencies(t *testing.T) {
+	index := NewHyperMinHashIndex(WithCooccurrenceTracking())
+	for i := 0; i < 2000; i++ {
+		pod := i % 200
+		index.AddSeries(labels.FromStrings(
+			"__name__", "requests",
+			"instance", fmt.Sprintf("10.0.0.%d", pod),
+			"method", fmt.Sprintf("method-%d", i%7),
+			"node", fmt.Sprintf("node-%d", pod%20),
+			"pod", fmt.Sprintf("pod-%d", pod),
+		), storage.SeriesRef(i))
+	}
+
+	tracker := index.Cooccurrence()
+	require.Equal(t, []LabelDependency{
+		{From: "instance", To: "node"},
+		{From: "instance", To: "pod", Mutual: true},
+		{From: "pod", To: "instance", Mutual: true},
+		{From: "pod", To: "node"},
+	}, tracker.Dependencies())
+	require.False(t, tracker.Determines("node", "pod"))
+	require.False(t, tracker.Determines("method", "pod"))
+	require.Equal(t, []string{
+		`every "instance" has a single "node", grouping by both is the same as grouping by "instance"`,
+		`labels "instance" and "pod" are 1:1, one of them is redundant`,
+		`every "pod" has a single "node", grouping by both is the same as grouping by "pod"`,
+	}, tracker.LabelAdvice())
+
+	// Matchers on labels determined by pod are answered exactly from pod.
+	pod := labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-42")
+	require.Equal(t, int64(7), index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "node", "node-2")))
+	require.Equal(t, int64(7), index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchRegexp, "node", "node-[0-4]")))
+	require.Equal(t, int64(7), index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "instance", "10.0.0.42")))
+	require.Zero(t, index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "node", "node-3")))
+	require.InDelta(t, 1, index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "method", "method-2")), 1)
+
+	// A pod split over two nodes, within the tolerance of Determines, keeps
+	// the matchers on its nodes.
+	index = NewHyperMinHashIndex(WithCooccurrenceTracking())
+	for i := 0; i < 2000; i++ {
+		pod := i % 200
+		node := pod % 20
+		if pod == 0 && i%400 >= 200 {
+			node = 1
+		}
+		index.AddSeries(labels.FromStrings("node", fmt.Sprintf("node-%d", node), "pod", fmt.Sprintf("pod-%d", pod), "series", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	require.True(t, index.Cooccurrence().Determines("pod", "node"))
+	pod = labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")
+	require.Equal(t, int64(10), index.GetCardinality(pod))
+	require.InDelta(t, 5, index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "node", "node-0")), 1)
+	require.InDelta(t, 5, index.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "node", "node-1")), 1)
+}
+
+func TestTrendTracker(t *testing.T) {
+	index := NewBitmapIndex()
+	tracker := NewTrendTracker(index, 48)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	tracker.Track(1000, job)
+
+	// 10 pods are added every hour.
+	ref := storage.SeriesRef(0)
+	for hour := 0; hour < 60; hour++ {
+		for i := 0; i < 10; i++ {
+			ref++
+			index.AddSeries(labels.FromStrings("job", "api", "pod", strconv.Itoa(int(ref))), ref)
+		}
+		tracker.Sample(start.Add(time.Duration(hour) * time.Hour))
+	}
+	history := tracker.History(job)
+	require.Len(t, history, 48)
+	require.Equal(t, TrendPoint{Time: start.Add(59 * time.Hour), Series: 600}, history[47])
+
+	f, err := tracker.Forecast([]*labels.Matcher{job}, 24*time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(600), f.Current)
+	require.Equal(t, int64(840), f.Predicted)
+	require.InDelta(t, 10, f.Growth, 0.01)
+	require.False(t, f.Breach)
+
+	f, err = tracker.Forecast([]*labels.Matcher{job}, 48*time.Hour)
+	require.NoError(t, err)
+	require.True(t, f.Breach)
+	require.WithinDuration(t, start.Add(99*time.Hour), f.BreachAt, time.Minute)
+
+	// Growth that slows down is followed by Holt's method.
+	slowing := labels.MustNewMatcher(labels.MatchEqual, "job", "slowing")
+	tracker.Track(0, slowing)
+	var series int64
+	for hour := 0; hour < 24; hour++ {
+		tracker.Record(start.Add(time.Duration(hour)*time.Hour), series, slowing)
+		if hour < 12 {
+			series += 100
+		} else {
+			series += 10
+		}
+	}
+	f, err = tracker.Forecast([]*labels.Matcher{slowing}, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, "holt", f.Method)
+	require.Less(t, f.Growth, 50.0)
+
+	_, err = tracker.Forecast([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "db")}, time.Hour)
+	require.ErrorIs(t, err, ErrNotEnoughHistory)
+}
+
+func TestGraphiteParser(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		line     string
+		want     []labels.Labels
+		err      bool
+	}{
+		{line: "servers.web-1.cpu 0.5 1700000000", want: []labels.Labels{labels.FromStrings("__name__", "servers_web_1_cpu")}},
+		{line: "cpu.user;host=web1;dc=eu 1", want: []labels.Labels{labels.FromStrings("__name__", "cpu_user", "host", "web1", "dc", "eu")}},
+		{template: "env.host.name", line: "prod.web1.cpu.user 1", want: []labels.Labels{labels.FromStrings("__name__", "cpu_user", "env", "prod", "host", "web1")}},
+		{template: "_.host.name", line: "servers.web1.5m 1", want: []labels.Labels{labels.FromStrings("__name__", "_5m", "host", "web1")}},
+		{line: ""},
+		{line: "cpu", err: true},
+		{line: "cpu..user 1", err: true},
+		{line: "cpu;host 1", err: true},
+		{template: "env.host", line: "prod.web1 1", err: true},
+	} {
+		got, err := GraphiteParser{Template: tc.template}.ParseLine(tc.line)
+		if tc.err {
+			require.ErrorIs(t, err, ErrInvalidLine, tc.line)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got, tc.line)
+	}
+}
+
+func TestInfluxParser(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []labels.Labels
+		err  bool
+	}{
+		{
+			line: "cpu,host=web1,region=eu usage_user=0.5,usage_system=0.1 1700000000000000000",
+			want: []labels.Labels{
+				labels.FromStrings("__name__", "cpu_usage_user", "host", "web1", "region", "eu"),
+				labels.FromStrings("__name__", "cpu_usage_system", "host", "web1", "region", "eu"),
+			},
+		},
+		{
+			line: `disk\ io,path=/var\,log value=1i,label="a, b=c",ok=true`,
+			want: []labels.Labels{
+				labels.FromStrings("__name__", "disk_io", "path", "/var,log"),
+				labels.FromStrings("__name__", "disk_io_ok", "path", "/var,log"),
+			},
+		},
+		{line: "# comment"},
+		{line: "cpu", err: true},
+		{line: "cpu,host value=1", err: true},
+		{line: ",host=a value=1", err: true},
+	} {
+		got, err := InfluxParser{}.ParseLine(tc.line)
+		if tc.err {
+			require.ErrorIs(t, err, ErrInvalidLine, tc.line)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got, tc.line)
+	}
+}
+
+func TestIngester(t *testing.T) {
+	index := NewBitmapIndex()
+	ingester := NewIngester(index, InfluxParser{})
+	input := strings.Join([]string{
+		"cpu,host=web1 user=1,system=2 1",
+		"cpu,host=web2 user=1,system=2 1",
+		"cpu,host=web1 user=3,system=4 2",
+		"mem,host=web1 used=10",
+		"",
+		"broken",
+	}, "\n")
+	require.NoError(t, ingester.Ingest(strings.NewReader(input)))
+	require.Equal(t, IngestStats{Lines: 6, Invalid: 1, Series: 5}, ingester.Stats())
+	require.Equal(t, int64(2), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_user")))
+	require.Equal(t, int64(3), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "host", "web1")))
+}
+
+func TestRemoteIndex(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/api/v1/series":
+			assert.Equal(t, `{job="api"}`, r.URL.Query().Get("match[]"))
+			assert.NotEmpty(t, r.URL.Query().Get("start"))
+			fmt.Fprint(w, `{"status":"success","data":[{"job":"api","pod":"a"},{"job":"api","pod":"b"}]}`)
+		case "/api/v1/cardinality/label_values":
+			assert.Equal(t, "team-a", r.Header.Get("X-Scope-OrgID"))
+			assert.Equal(t, `{job="api"}`, r.URL.Query().Get("selector"))
+			fmt.Fprint(w, `{"series_count_total":42,"labels":[]}`)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+
+	index := NewRemoteIndex(server.URL)
+	require.Equal(t, int64(2), index.GetCardinality(job))
+	require.Equal(t, int64(2), index.GetCardinality(job))
+	require.Equal(t, int64(1), requests.Load())
+
+	mimir := NewRemoteIndex(server.URL, WithCardinalityAPI(), WithRemoteHeader("X-Scope-OrgID", "team-a"), WithRemoteCacheTTL(0))
+	require.Equal(t, int64(42), mimir.GetCardinality(job))
+	require.Equal(t, int64(42), mimir.GetCardinality(job))
+	require.Equal(t, int64(3), requests.Load())
+
+	broken := NewRemoteIndex(server.URL+"/missing", WithRemoteTimeout(time.Second))
+	require.Equal(t, int64(0), broken.GetCardinality(job))
+	require.Equal(t, int64(1), broken.Stats().Errors)
+}
+
+func TestFederatedIndex(t *testing.T) {
+	zone := func(series int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"series_count_total":%d,"labels":[]}`, series)
+		}))
+	}
+	zoneA, zoneB := zone(100), zone(98)
+	defer zoneA.Close()
+	defer zoneB.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	remote := func(server *httptest.Server) CardinalityIndex {
+		return NewRemoteIndex(server.URL, WithCardinalityAPI(), WithRemoteCacheTTL(0))
+	}
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+
+	// Replicas answer as long as a zone does.
+	replicas, err := NewFederatedIndex(MergeReplicas,
+		Zone{Name: "zone-a", Index: remote(zoneA)},
+		Zone{Name: "zone-b", Index: remote(zoneB)},
+		Zone{Name: "zone-c", Index: remote(broken)},
+	)
+	require.NoError(t, err)
+	result, err := replicas.GetFederatedCardinality(context.Background(), job)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), result.Series)
+	require.Len(t, result.Zones, 3)
+	require.Equal(t, "zone-b", result.Zones[1].Zone)
+	require.Equal(t, int64(98), result.Zones[1].Series)
+	require.Contains(t, result.Zones[2].Error, "404")
+	require.True(t, result.Partial)
+	require.Equal(t, int64(100), replicas.GetCardinality(job))
+	require.Equal(t, int64(2), replicas.Stats().Errors)
+
+	// Shards are summed and fail with any zone.
+	local := NewBitmapIndex()
+	local.AddSeries(labels.FromStrings("job", "api"), 1)
+	shards, err := NewFederatedIndex(MergeShards, Zone{Name: "a", Index: remote(zoneA)}, Zone{Name: "local", Index: local})
+	require.NoError(t, err)
+	require.Equal(t, int64(101), shards.GetCardinality(job))
+	// The answers are scalars, so a series held by two shards counts twice.
+	other := NewBitmapIndex()
+	other.AddSeries(labels.FromStrings("job", "api"), 1)
+	shards, err = NewFederatedIndex(MergeShards, Zone{Name: "local", Index: local}, Zone{Name: "other", Index: other})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), shards.GetCardinality(job))
+	shards, err = NewFederatedIndex(MergeShards, Zone{Name: "a", Index: remote(zoneA)}, Zone{Name: "c", Index: remote(broken)})
+	require.NoError(t, err)
+	series, err := shards.GetCardinalityChecked(context.Background(), job)
+	require.ErrorContains(t, err, "zone c")
+	require.Equal(t, int64(100), series)
+	// Failed queries are answered as if no series matched.
+	require.Zero(t, shards.GetCardinality(job))
+	require.Equal(t, int64(2), shards.Stats().Errors)
+
+	replicas, err = NewFederatedIndex(MergeReplicas, Zone{Name: "broken", Index: remote(broken)})
+	require.NoError(t, err)
+	_, err = replicas.GetCardinalityChecked(context.Background(), job)
+	require.Error(t, err)
+
+	// Sketches count the series held by several zones once.
+	ingesters := []*HyperMinHashIndex{NewHyperMinHashIndex(WithDeltaTracking()), NewHyperMinHashIndex(WithDeltaTracking())}
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("job", "api", "pod", fmt.Sprintf("pod-%d", i))
+		ingesters[0].AddSeries(lbls, storage.SeriesRef(i))
+		if i%2 == 0 {
+			ingesters[1].AddSeries(lbls, storage.SeriesRef(i))
+		}
+	}
+	failing := true
+	sketchZone := func(name string, h *HyperMinHashIndex) Zone {
+		return Zone{Name: name, Index: h, Deltas: func(context.Context) (*SketchDelta, error) {
+			if name == "b" && failing {
+				return nil, errors.New("unavailable")
+			}
+			return h.ExportDelta(), nil
+		}}
+	}
+	sketches, err := NewFederatedIndex(MergeSketches, sketchZone("a", ingesters[0]), sketchZone("b", ingesters[1]))
+	require.NoError(t, err)
+	require.ErrorContains(t, sketches.Sync(context.Background()), "zone b: unavailable")
+	result, err = sketches.GetFederatedCardinality(context.Background(), job)
+	require.NoError(t, err)
+	require.True(t, result.Partial)
+	require.Equal(t, "unavailable", result.Zones[1].Error)
+	require.InDelta(t, 1000, result.Series, 30)
+
+	failing = false
+	require.NoError(t, sketches.Sync(context.Background()))
+	result, err = sketches.GetFederatedCardinality(context.Background(), job)
+	require.NoError(t, err)
+	require.False(t, result.Partial)
+	require.InDelta(t, 1000, result.Series, 30)
+	require.Equal(t, int64(500), result.Zones[1].Series)
+	_, err = NewFederatedIndex(MergeSketches, Zone{Name: "a", Index: ingesters[0]})
+	require.ErrorContains(t, err, "zone a has no sketch deltas")
+}
+
+func TestCachingIndex(t *testing.T) {
+	index := NewBitmapIndex()
+	cache := NewCachingIndex(index, time.Hour, 1)
+	for i := 0; i < 10; i++ {
+		cache.AddSeries(labels.FromStrings("job", "api", "pod", strconv.Itoa(i)), storage.SeriesRef(i+1))
+	}
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	pods := labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")
+
+	require.Equal(t, int64(10), cache.GetCardinality(job, pods))
+	// Reordered and equivalent matchers share the answer.
+	require.Equal(t, int64(10), cache.GetCardinality(pods, labels.MustNewMatcher(labels.MatchRegexp, "job", "api")))
+	require.Equal(t, ResultCacheStats{Hits: 1, Misses: 1, Size: 1}, cache.Stats())
+
+	// A single new series is tolerated, the second one drops the answer.
+	cache.AddSeries(labels.FromStrings("job", "api", "pod", "10"), 11)
+	require.Equal(t, int64(10), cache.GetCardinality(job, pods))
+	cache.AddSeries(labels.FromStrings("job", "api", "pod", "11"), 12)
+	require.Equal(t, int64(12), cache.GetCardinality(job, pods))
+
+	// Contradicting matchers are answered without the index.
+	require.Equal(t, int64(0), cache.GetCardinality(job, labels.MustNewMatcher(labels.MatchEqual, "job", "db")))
+	require.Equal(t, ResultCacheStats{Hits: 2, Misses: 2, Size: 1}, cache.Stats())
+
+	expiring := NewCachingIndex(index, 0, -1)
+	require.Equal(t, int64(12), expiring.GetCardinality(job))
+	require.Equal(t, int64(12), expiring.GetCardinality(job))
+	require.Equal(t, int64(0), expiring.Stats().Hits)
+
+	// Answers truncated by the limits of the query aren't cached, and a hit
+	// doesn't report the truncation of the previous query.
+	limited := NewCachingIndex(index, time.Hour, -1)
+	ones := labels.MustNewMatcher(labels.MatchRegexp, "pod", "1.*")
+	q := NewQueryContext(0)
+	q.SetLimits(QueryLimits{MaxValuesScanned: 1})
+	ctx := ContextWithQuery(context.Background(), q)
+	_, err := limited.GetCardinalityChecked(ctx, job, ones)
+	require.NoError(t, err)
+	require.True(t, q.Truncated())
+	require.Equal(t, 0, limited.Stats().Size)
+	require.Equal(t, int64(3), limited.GetCardinality(job, ones))
+	q.SetLimits(QueryLimits{})
+	series, err := limited.GetCardinalityChecked(ctx, job, ones)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), series)
+	require.False(t, q.Truncated())
+	require.Equal(t, int64(1), limited.Stats().Hits)
+}
+
+func TestDebugStats(t *testing.T) {
+	index := NewBitmapIndex()
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("job", "api", "pod", strconv.Itoa(i)), storage.SeriesRef(i+1))
+	}
+	index.AddSeries(labels.FromStrings("job", "db"), 101)
+
+	shards := index.ShardStats()
+	require.Len(t, shards, 2)
+	require.Equal(t, "pod", shards[0].Label)
+	require.Equal(t, 100, shards[0].Values)
+	require.Equal(t, int64(100), shards[0].Series)
+	require.Equal(t, ShardStats{Label: "job", Values: 2, Series: 101, MemoryBytes: shards[1].MemoryBytes}, shards[1])
+
+	bitmaps := index.LargestBitmaps(1)
+	require.Len(t, bitmaps, 1)
+	require.Equal(t, BitmapStats{Label: "job", Value: "api", Series: 100, Bytes: bitmaps[0].Bytes}, bitmaps[0])
+	all := index.LargestBitmaps(1000)
+	require.Len(t, all, 102)
+	require.Equal(t, all[:5], index.LargestBitmaps(5))
+	require.Empty(t, index.LargestBitmaps(0))
+
+	tracking := NewTrackingIndex(index, 2)
+	api := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	for i := 0; i < 3; i++ {
+		require.Equal(t, int64(100), tracking.GetCardinality(api))
+	}
+	tracking.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "job", "db"))
+	// The tracker is full, the least queried matcher set is replaced.
+	tracking.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "1"), api)
+	require.Equal(t, []MatcherCount{
+		{Matchers: `{job="api"}`, Count: 3},
+		{Matchers: `{job="api",pod="1"}`, Count: 2, Error: 1},
+	}, tracking.HotMatchers(10))
+	require.Len(t, tracking.HotMatchers(1), 1)
+	require.Same(t, index, tracking.Unwrap())
+}
+
+func TestOptimize(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Series repeat their labels, only their refs tell them apart.
+	b := NewBitmapIndex(WithoutDeduplication())
+	b.now = func() time.Time { return now }
+
+	// Contiguous refs added in random order.
+	refs := rand.Perm(100000)
+	for _, ref := range refs {
+		b.AddSeries(labels.FromStrings("job", "api", "pod", strconv.Itoa(ref%10)), storage.SeriesRef(ref+1))
+	}
+	job := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	pod := labels.MustNewMatcher(labels.MatchEqual, "pod", "3")
+
+	// Nothing is cold yet.
+	require.Equal(t, OptimizeStats{}, withoutDuration(b.Optimize(time.Minute, 0)))
+
+	now = now.Add(time.Hour)
+	stats := b.Optimize(time.Minute, 0)
+	require.Equal(t, 2, stats.Labels)
+	require.Equal(t, 13, stats.Bitmaps)
+	require.Greater(t, stats.Saved(), int64(0))
+	require.Equal(t, int64(100000), b.GetCardinality(job))
+	require.Equal(t, int64(10000), b.GetCardinality(pod))
+
+	// Labels are only optimized again after they changed.
+	require.Equal(t, 0, b.Optimize(time.Minute, 0).Labels)
+	b.AddSeries(labels.FromStrings("job", "db", "pod", "new"), 100001)
+	now = now.Add(time.Hour)
+	require.Equal(t, 2, b.Optimize(time.Minute, 0).Labels)
+
+	// An exhausted budget leaves the labels for the next pass.
+	b.AddSeries(labels.FromStrings("job", "db", "pod", "other"), 100002)
+	now = now.Add(time.Hour)
+	stats = b.Optimize(time.Minute, time.Nanosecond)
+	require.Equal(t, 2, stats.Labels+stats.Remaining)
+	require.Equal(t, 2-stats.Labels, b.Optimize(time.Minute, 0).Labels)
+}
+
+func withoutDuration(s OptimizeStats) OptimizeStats {
+	s.Duration = 0
+	return s
+}
+
+func TestColdTier(t *testing.T) {
+	dir := t.TempDir()
+	// Segments left by an earlier process are removed.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.cold"), []byte("stale"), 0o666))
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Series repeat their labels, only their refs tell them apart.
+	b := NewBitmapIndex(WithColdTier(dir), WithMetricNameIndex(), WithoutDeduplication())
+	b.now = func() time.Time { return now }
+	for i := 0; i < 1000; i++ {
+		b.AddSeries(labels.FromStrings("__name__", "up", "job", "api", "pod", fmt.Sprintf("pod-%d", i%100)), storage.SeriesRef(i+1))
+	}
+	pod := labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7")
+	pods := labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	check := func() {
+		t.Helper()
+		require.Equal(t, int64(10), b.GetCardinality(pod))
+		require.Equal(t, int64(10), b.GetCardinality(up, pod))
+		require.Equal(t, int64(110), b.GetCardinality(pods))
+		require.Equal(t, int64(1000), b.GetCardinality(up))
+	}
+	before := b.Stats()
+
+	// Nothing is cold yet.
+	stats, err := b.Tier(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Cold)
+
+	now = now.Add(time.Hour)
+	stats, err = b.Tier(time.Minute)
+	require.NoError(t, err)
+	// The labels of the index and of the sub-index of up.
+	require.Equal(t, 2*102, stats.Cold)
+	require.Equal(t, 6, stats.Segments)
+	segments, err := filepath.Glob(filepath.Join(dir, "*.cold"))
+	require.NoError(t, err)
+	require.Len(t, segments, 6)
+	after := b.Stats()
+	require.Less(t, after.MemoryBytes, before.MemoryBytes)
+	require.Equal(t, stats.Bytes, after.DiskBytes)
+	check()
+
+	// The values queried since are moved back to the heap, the others stay
+	// cold: up, pod-7 and the 11 values matching pod-1.* of the index, and
+	// pod-7 of the sub-index.
+	now = now.Add(30 * time.Second)
+	stats, err = b.Tier(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 14, stats.Hot)
+	require.Equal(t, 0, stats.Cold)
+	check()
+
+	// Cold values series are added to are moved back to the heap.
+	b.AddSeries(labels.FromStrings("__name__", "up", "job", "api", "pod", "pod-50"), 1001)
+	require.Equal(t, int64(11), b.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-50")))
+	require.Equal(t, int64(11), b.GetCardinality(up, labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-50")))
+
+	// Evicted values release their segments.
+	require.Equal(t, 1001, b.EvictMetric("up"))
+	require.Equal(t, int64(0), b.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "job", "api")))
+	segments, err = filepath.Glob(filepath.Join(dir, "*.cold"))
+	require.NoError(t, err)
+	require.Empty(t, segments)
+	require.Equal(t, int64(0), b.Stats().DiskBytes)
+
+	// Warm moves the remaining cold values back to the heap and removes
+	// their segments.
+	for i := 0; i < 1000; i++ {
+		b.AddSeries(labels.FromStrings("__name__", "up", "job", "api", "pod", fmt.Sprintf("pod-%d", i%100)), storage.SeriesRef(i+1))
+	}
+	now = now.Add(time.Hour)
+	stats, err = b.Tier(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 2*102, stats.Cold)
+	require.NoError(t, b.Warm())
+	segments, err = filepath.Glob(filepath.Join(dir, "*.cold"))
+	require.NoError(t, err)
+	require.Empty(t, segments)
+	require.Equal(t, int64(0), b.Stats().DiskBytes)
+	check()
+
+	_, err = NewBitmapIndex().Tier(time.Minute)
+	require.ErrorIs(t, err, ErrNoColdTier)
+}
+
+func TestLoadSnapshotDir(t *testing.T) {
+	dataDir := t.TempDir()
+	createTestBlock(t, dataDir, 0, 1, 2)
+	db, err := tsdb.Open(dataDir, nil, nil, tsdb.DefaultOptions(), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender(context.Background())
+	for pod := 2; pod < 6; pod++ {
+		_, err := app.Append(0, labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), time.Now().UnixMilli(), 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	// The snapshot API persists the head as a block of its own.
+	snapshotDir := filepath.Join(dataDir, "snapshots", "20240101T000000Z-1")
+	require.NoError(t, db.Snapshot(snapshotDir, true))
+
+	blocks, err := LoadSnapshotDir(context.Background(), snapshotDir, func(tsdb.BlockMeta) CardinalityIndex { return NewBitmapIndex() })
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.Equal(t, int64(3), blocks[0].Index.GetCardinality(up))
+	require.Equal(t, int64(4), blocks[1].Index.GetCardinality(up))
+	require.Less(t, blocks[0].Meta.MinTime, blocks[1].Meta.MinTime)
+
+	_, err = LoadSnapshotDir(context.Background(), t.TempDir(), func(tsdb.BlockMeta) CardinalityIndex { return NewBitmapIndex() })
+	require.Error(t, err)
+}
+
+func TestGetCardinalityChecked(t *testing.T) {
+	bitmapIndex := NewBitmapIndex()
+	hmhIndex := NewHyperMinHashIndex()
+	exactHashIndex := NewExactHashIndex()
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "instance", strconv.Itoa(i))
+		bitmapIndex.AddSeries(lbls, storage.SeriesRef(i))
+		hmhIndex.AddSeries(lbls, storage.SeriesRef(i))
+		exactHashIndex.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, WriteIndexFile(path, bitmapIndex))
+	indexFile, err := OpenIndexFile(path)
+	require.NoError(t, err)
+
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")
+	typo := labels.MustNewMatcher(labels.MatchEqual, "instnace", "1")
+	for _, index := range []CardinalityIndex{bitmapIndex, hmhIndex, indexFile, NewCachingIndex(bitmapIndex, time.Minute, 0)} {
+		card, err := GetCardinalityChecked(context.Background(), index, metric)
+		require.NoError(t, err)
+		require.Equal(t, int64(250), card)
+
+		_, err = GetCardinalityChecked(context.Background(), index, metric, typo)
+		require.ErrorIs(t, err, ErrUnknownLabel)
+		// Matchers matching the series without the label are fine.
+		card, err = GetCardinalityChecked(context.Background(), index, metric, labels.MustNewMatcher(labels.MatchNotEqual, "instnace", "1"))
+		require.NoError(t, err)
+		require.InDelta(t, 250, card, 10)
+
+		_, err = GetCardinalityChecked(context.Background(), index, metric, nil)
+		require.ErrorIs(t, err, ErrUnsupportedMatcher)
+
+		q := NewQueryContext(1)
+		_, err = GetCardinalityChecked(ContextWithQuery(context.Background(), q), index, labels.MustNewMatcher(labels.MatchRegexp, "__name__", "metric_[12]"))
+		if index != indexFile {
+			require.ErrorIs(t, err, ErrBudgetExceeded)
+		}
+	}
+
+	// Indexes without errors of their own only have their matchers checked.
+	card, err := GetCardinalityChecked(context.Background(), exactHashIndex, metric, typo)
+	require.NoError(t, err)
+	require.Zero(t, card)
+	_, err = GetCardinalityChecked(context.Background(), exactHashIndex, nil)
+	require.ErrorIs(t, err, ErrUnsupportedMatcher)
+
+	// Close waits for the queries reading the mapping.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				indexFile.GetCardinality(metric)
+				indexFile.LabelValues("__name__", metric)
+				indexFile.Stats()
+			}
+		}()
+	}
+	require.NoError(t, indexFile.Close())
+	wg.Wait()
+	require.ErrorIs(t, indexFile.Close(), ErrIndexClosed)
+	require.Zero(t, indexFile.GetCardinality(metric))
+	_, err = GetCardinalityChecked(context.Background(), indexFile, metric)
+	require.ErrorIs(t, err, ErrIndexClosed)
+}
+
+func TestMetricNameIndex(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := NewBitmapIndex(WithMetricNameIndex(), WithValueTTL(time.Hour))
+	index.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "pod", fmt.Sprintf("old-%d", i)), storage.SeriesRef(i))
+	}
+	now = now.Add(45 * time.Minute)
+	for i := 0; i < 20; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "metric_0", "pod", fmt.Sprintf("new-%d", i), "zone", "a"), storage.SeriesRef(100+i))
+	}
+
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")
+	zone := labels.MustNewMatcher(labels.MatchEqual, "zone", "a")
+	noZone := labels.MustNewMatcher(labels.MatchEqual, "zone", "")
+	require.Equal(t, int64(45), index.GetCardinality(metric))
+	require.Equal(t, int64(20), index.GetCardinality(metric, zone))
+	require.Equal(t, int64(25), index.GetCardinality(metric, noZone))
+	require.Equal(t, int64(50), index.GetCardinality(noZone, labels.MustNewMatcher(labels.MatchRegexp, "__name__", "metric_[12]")))
+	require.Zero(t, index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "unknown"), noZone))
+
+	// Evicted series leave the metrics' sub-indexes too.
+	now = now.Add(30 * time.Minute)
+	// The old pods, and the metrics only they had.
+	require.Equal(t, 103, index.EvictStale())
+	require.Equal(t, int64(20), index.GetCardinality(metric))
+	require.Zero(t, index.GetCardinality(metric, noZone))
+	require.Zero(t, index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")))
+	require.Len(t, index.metrics, 1)
+}
+
+func TestEvictMetric(t *testing.T) {
+	addSeries := func(index CardinalityIndex, prefix string, n int) {
+		for i := 0; i < n; i++ {
+			index.AddSeries(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%2), "pod", fmt.Sprintf("%s-%d", prefix, i)), storage.SeriesRef(i))
+		}
+	}
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")
+	other := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")
+	pods := labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-.*")
+
+	t.Run("BitmapIndex", func(t *testing.T) {
+		for name, opts := range map[string][]Option{
+			"Deduplicated":  {WithMetricNameIndex()},
+			"AllocatedRefs": {WithMetricNameIndex(), WithAllocatedRefs()},
+			"ValueTTL":      {WithMetricNameIndex(), WithValueTTL(time.Hour)},
+		} {
+			t.Run(name, func(t *testing.T) {
+				index := NewBitmapIndex(opts...)
+				addSeries(index, "pod", 100)
+				require.Equal(t, 50, index.EvictMetric("metric_0"))
+				require.Zero(t, index.EvictMetric("metric_0"))
+				require.Zero(t, index.GetCardinality(metric))
+				require.Equal(t, int64(50), index.GetCardinality(pods))
+				require.Equal(t, int64(50), index.GetCardinality(other, pods))
+
+				// Evicted series are indexed again when added again.
+				addSeries(index, "pod", 100)
+				require.Equal(t, int64(50), index.GetCardinality(metric))
+				require.Equal(t, int64(100), index.GetCardinality(pods))
+			})
+		}
+	})
+
+	t.Run("BitmapIndexWithoutMetricNameIndex", func(t *testing.T) {
+		index := NewBitmapIndex()
+		addSeries(index, "pod", 10)
+		require.Zero(t, index.EvictMetric("metric_0"))
+		require.Equal(t, int64(5), index.GetCardinality(metric))
+	})
+
+	t.Run("HyperMinHashIndex", func(t *testing.T) {
+		index := NewHyperMinHashIndex(WithMetricNameIndex())
+		addSeries(index, "pod", 100)
+		require.Equal(t, 50, index.EvictMetric("metric_0"))
+		require.Zero(t, index.GetCardinality(metric))
+		require.Zero(t, index.GetCardinality(metric, pods))
+		require.Equal(t, int64(50), index.GetCardinality(other))
+
+		addSeries(index, "new", 10)
+		require.Equal(t, int64(5), index.GetCardinality(metric))
+		require.InDelta(t, 5, index.GetCardinality(metric, labels.MustNewMatcher(labels.MatchRegexp, "pod", "new-.*")), 1)
+		// The sketches of all metrics still hold the evicted series.
+		require.InDelta(t, 100, index.GetCardinality(pods), 10)
+
+		// Series evicted and added again are counted once.
+		index = NewHyperMinHashIndex(WithMetricNameIndex())
+		job := labels.MustNewMatcher(labels.MatchEqual, "job", "a")
+		addJob := func(name string) {
+			for i := 0; i < 10; i++ {
+				index.AddSeries(labels.FromStrings("__name__", name, "job", "a", "pod", strconv.Itoa(i)), storage.SeriesRef(i))
+			}
+		}
+		addJob("up")
+		addJob("down")
+		require.Equal(t, int64(20), index.GetCardinality(job))
+		require.Equal(t, 10, index.EvictMetric("up"))
+		require.Equal(t, int64(10), index.GetCardinality(job))
+		require.Zero(t, index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+		addJob("up")
+		require.Equal(t, int64(20), index.GetCardinality(job))
+		require.Equal(t, int64(10), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+		require.Equal(t, int64(20), index.TopLabelValues("job", 1)[0].Series)
+	})
+}
+
+func TestNormalizeMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		// value is matched by the pattern with PromQL semantics, and
+		// partial only by a regex that isn't anchored.
+		value, partial string
+		normalized     string
+	}{
+		{pattern: "api", value: "api", partial: "api-1", normalized: "api"},
+		{pattern: "^api$", value: "api", partial: "api-1", normalized: "api"},
+		{pattern: "^api-.*", value: "api-1", partial: "old-api-1", normalized: "api-.*"},
+		{pattern: "a|b$", value: "a", partial: "ab", normalized: "a|b"},
+		{pattern: `cost\$`, value: "cost$", partial: "cost$1", normalized: `cost\$`},
+		{pattern: `cost\\$`, value: `cost\`, partial: `cost\1`, normalized: `cost\\`},
+		{pattern: "a.b", value: "a\nb", partial: "xa\nb", normalized: "a.b"},
+		// Anchors that aren't standalone are kept.
+		{pattern: "^*a", value: "a", partial: "xa", normalized: "^*a"},
+		{pattern: `\Qa$`, value: "a$", partial: "xa$", normalized: `\Qa$`},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			// A matcher without a compiled regex, as decoded from the wire.
+			raw := &labels.Matcher{Type: labels.MatchRegexp, Name: "job", Value: tc.pattern}
+			normalized, err := NormalizeMatchers([]*labels.Matcher{raw})
+			require.NoError(t, err)
+			m := normalized[0]
+			require.Equal(t, tc.normalized, m.Value)
+			require.True(t, m.Matches(tc.value))
+			require.False(t, m.Matches(tc.partial))
+			require.True(t, labels.MustNewMatcher(labels.MatchRegexp, "job", tc.pattern).Matches(tc.value))
+		})
+	}
+
+	matchers, err := ParseSelector(`up{job=~"^api$", pod!~"^canary-.*"}`)
+	require.NoError(t, err)
+	strs := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		strs = append(strs, m.String())
+	}
+	require.ElementsMatch(t, []string{`__name__="up"`, `job=~"api"`, `pod!~"canary-.*"`}, strs)
+	simplified, ok := SimplifyMatchers(matchers)
+	require.True(t, ok)
+	require.Contains(t, simplified, labels.MustNewMatcher(labels.MatchEqual, "job", "api"))
+
+	_, err = NormalizeMatchers([]*labels.Matcher{{Type: labels.MatchRegexp, Name: "job", Value: "("}})
+	require.Error(t, err)
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	logger := promslog.NewNopLogger()
+	newIndex := func() *BitmapIndex { return NewBitmapIndex(WithMetricNameIndex()) }
+	addSeries := func(index CardinalityIndex, from, to int) {
+		for i := from; i < to; i++ {
+			index.AddSeries(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%2), "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i))
+		}
+	}
+	all := labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")
+
+	w, err := OpenWAL(dir, newIndex(), logger)
+	require.NoError(t, err)
+	addSeries(w, 0, 100)
+	require.Equal(t, 50, w.EvictMetric("metric_0"))
+	addSeries(w, 100, 110)
+	require.Equal(t, int64(60), w.GetCardinality(all))
+	require.NoError(t, w.Close())
+
+	// The mutations are replayed in order.
+	w, err = OpenWAL(dir, newIndex(), logger)
+	require.NoError(t, err)
+	require.Equal(t, int64(60), w.GetCardinality(all))
+	require.Equal(t, int64(55), w.GetCardinality(metric))
+
+	// A checkpoint drops the mutations it covers.
+	index := newIndex()
+	require.NoError(t, w.Checkpoint(func() error {
+		addSeries(index, 0, 1000)
+		return nil
+	}))
+	addSeries(w, 1000, 1010)
+	require.NoError(t, w.Close())
+	w, err = OpenWAL(dir, newIndex(), logger)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), w.GetCardinality(all))
+	require.NoError(t, w.Close())
+
+	// A torn record at the end of the log is dropped.
+	first, last, err := wlog.Segments(dir)
+	require.NoError(t, err)
+	require.Less(t, first, last)
+	f, err := os.OpenFile(wlog.SegmentName(dir, last), os.O_APPEND|os.O_WRONLY, 0o666)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 0, 50, 0, 0, 0, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	w, err = OpenWAL(dir, newIndex(), logger)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), w.GetCardinality(all))
+	addSeries(w, 2000, 2005)
+	require.NoError(t, w.Close())
+	w, err = OpenWAL(dir, newIndex(), logger)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), w.GetCardinality(all))
+	require.NoError(t, w.Close())
+
+	// Empty and unknown records fail the replay.
+	for rec, msg := range map[string]string{"": "empty WAL record", string([]byte{byte(walEvictMetric) + 1}): "unknown WAL record type"} {
+		dir := t.TempDir()
+		wal, err := wlog.New(logger, nil, dir, wlog.CompressionNone)
+		require.NoError(t, err)
+		require.NoError(t, wal.Log([]byte(rec)))
+		require.NoError(t, wal.Close())
+		_, err = OpenWAL(dir, newIndex(), logger)
+		require.ErrorContains(t, err, msg)
+	}
+}
+
+func TestVerifyingIndex(t *testing.T) {
+	// The reference holds 10 series of pod-0 the primary misses.
+	primary := NewBitmapIndex()
+	v := NewVerifyingIndex(primary, NewBitmapIndex(), 1, 0.05, promslog.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		lbls := labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%10), "instance", strconv.Itoa(i))
+		v.AddSeries(lbls, storage.SeriesRef(i))
+	}
+	for i := 100; i < 110; i++ {
+		v.reference.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-0", "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+
+	require.Equal(t, int64(100), v.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Equal(t, int64(10), v.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")))
+	require.Equal(t, int64(10), v.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go v.Run(ctx)
+	require.Eventually(t, func() bool { return v.Stats().Compared == 3 }, time.Second, time.Millisecond)
+
+	stats := v.Stats()
+	require.Equal(t, int64(3), stats.Queries)
+	// 100 of 110 and 10 of 20.
+	require.Equal(t, int64(2), stats.Diverged)
+	require.InDelta(t, 0.5, stats.MaxAbsError, 1e-9)
+	require.InDelta(t, (1.0/11+0.5)/3, stats.MeanAbsError, 1e-9)
+	require.Equal(t, 6, testutil.CollectAndCount(v))
+	require.NoError(t, testutil.CollectAndCompare(v, strings.NewReader(`
+# HELP cardinality_verification_diverged_total Compared queries whose relative error exceeded the tolerance.
+# TYPE cardinality_verification_diverged_total counter
+cardinality_verification_diverged_total 2
+`), "cardinality_verification_diverged_total"))
+
+	// An ExactHashIndex reference is written and queried concurrently.
+	v = NewVerifyingIndex(NewBitmapIndex(), NewExactHashIndex(), 1, 0.05, promslog.NewNopLogger())
+	go v.Run(ctx)
+	for i := 0; i < 1000; i++ {
+		v.AddSeries(labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+		if i%10 == 0 {
+			v.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+		}
+	}
+	require.Eventually(t, func() bool { return v.Stats().Compared+v.Stats().Dropped == 100 }, time.Second, time.Millisecond)
+
+	// A blocked reference query doesn't block adding series.
+	reference := &blockingReference{CardinalityIndex: NewBitmapIndex(), release: make(chan struct{})}
+	defer close(reference.release)
+	v = NewVerifyingIndex(NewBitmapIndex(), reference, 1, 0.05, promslog.NewNopLogger())
+	go v.Run(ctx)
+	v.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	for i := 0; i < verificationQueueSize/2; i++ {
+		v.AddSeries(labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+}
+
+// blockingReference blocks every estimate until release is closed.
+type blockingReference struct {
+	CardinalityIndex
+	release chan struct{}
+}
+
+func (b *blockingReference) GetCardinality(matchers ...*labels.Matcher) int64 {
+	<-b.release
+	return b.CardinalityIndex.GetCardinality(matchers...)
+}
+
+// blockingIndex blocks every estimate until release is closed, and records
+// how many ran at the same time.
+type blockingIndex struct {
+	*BitmapIndex
+	release       chan struct{}
+	running, peak atomic.Int64
+}
+
+func (b *blockingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	running := b.running.Add(1)
+	for peak := b.peak.Load(); running > peak && !b.peak.CompareAndSwap(peak, running); peak = b.peak.Load() {
+	}
+	<-b.release
+	b.running.Add(-1)
+	return b.BitmapIndex.GetCardinality(matchers...)
+}
+
+func (b *blockingIndex) GetCardinalityChecked(_ context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return b.GetCardinality(matchers...), nil
+}
+
+// runExecutor runs the workers of e until ctx is done, returning once they
+// accept estimates.
+func runExecutor(t *testing.T, ctx context.Context, e *Executor) {
+	go e.Run(ctx)
+	require.Eventually(t, func() bool {
+		e.runMtx.Lock()
+		defer e.runMtx.Unlock()
+		return e.running > 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestExecutor(t *testing.T) {
+	index := &blockingIndex{BitmapIndex: NewBitmapIndex(), release: make(chan struct{})}
+	for i := 0; i < 10; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i))
+	}
+	e := NewExecutor(index, 3, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runExecutor(t, ctx, e)
+
+	selectors := make([][]*labels.Matcher, 4)
+	for i := range selectors {
+		selectors[i] = []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", fmt.Sprintf("[0-%d]", i))}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			series, err := e.Estimate(ctx, selectors...)
+			assert.NoError(t, err)
+			assert.Equal(t, []int64{1, 2, 3, 4}, series)
+		}()
+	}
+	// Two queries of two estimates each wait for three workers.
+	require.Eventually(t, func() bool {
+		stats := e.Stats()
+		return stats.Busy == 3 && stats.Queued == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1.0, e.Stats().Saturation())
+
+	// A query running out of time while queued fails.
+	timeout, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+	_, err := e.GetCardinalityChecked(timeout, selectors[0]...)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(index.release)
+	wg.Wait()
+	require.Equal(t, int64(3), index.peak.Load())
+	require.Equal(t, int64(8), e.Stats().Estimates)
+	require.Equal(t, int64(10), e.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Equal(t, 6, testutil.CollectAndCount(e))
+	require.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(`
+# HELP cardinality_executor_queue_length Estimates waiting for a worker.
+# TYPE cardinality_executor_queue_length gauge
+cardinality_executor_queue_length 0
+`), "cardinality_executor_queue_length"))
+}
+
+func TestExecutorQueryContext(t *testing.T) {
+	index := NewBitmapIndex()
+	for i := 0; i < 1000; i++ {
+		index.AddSeries(labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%2), "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	e := NewExecutor(index, 2, 2)
+
+	// Without workers, estimates fail instead of waiting.
+	_, err := e.GetCardinalityChecked(context.Background(), labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0"))
+	require.ErrorIs(t, err, ErrExecutorStopped)
+	require.Zero(t, e.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runExecutor(t, ctx, e)
+
+	selector := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "instance", "1.*")}
+	q := NewQueryContext(0)
+	qctx := ContextWithQuery(ctx, q)
+	_, err = e.GetCardinalityChecked(qctx, selector...)
+	require.NoError(t, err)
+	used := q.used
+	require.Positive(t, used)
+
+	// The selectors of a query share its budget.
+	series, err := e.Estimate(qctx, selector, selector)
+	require.NoError(t, err)
+	require.Equal(t, []int64{111, 111}, series)
+	require.Equal(t, 2*used, q.used)
+
+	q = NewQueryContext(used + used/2)
+	qctx = ContextWithQuery(ctx, q)
+	_, err = e.Estimate(qctx, selector)
+	require.NoError(t, err)
+	_, err = e.Estimate(qctx, selector, selector)
+	require.ErrorIs(t, err, ErrMemoryBudgetExceeded)
+	require.ErrorIs(t, q.Err(), ErrMemoryBudgetExceeded)
+
+	// Truncated estimates are reported on the QueryContext of the query.
+	q = NewQueryContext(0)
+	q.SetLimits(QueryLimits{MaxValuesScanned: 10})
+	qctx = ContextWithQuery(ctx, q)
+	_, err = e.Estimate(qctx, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")}, selector)
+	require.NoError(t, err)
+	require.True(t, q.Truncated())
+	_, err = e.Estimate(qctx, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")})
+	require.NoError(t, err)
+	require.False(t, q.Truncated())
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, err := e.GetCardinalityChecked(context.Background(), selector...)
+		return errors.Is(err, ErrExecutorStopped)
+	}, time.Second, time.Millisecond)
+}
+
+func TestMonitor(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		received [][]map[string]any
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alerts []map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+		mtx.Lock()
+		received = append(received, alerts)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	index := NewBitmapIndex()
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			index.AddSeries(labels.FromStrings("__name__", "http_requests_total", "request_id", strconv.Itoa(i)), storage.SeriesRef(i))
+		}
+	}
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")
+	m, err := NewMonitor(index, []MonitorRule{
+		{Name: "TooManySeries", Matchers: []*labels.Matcher{metric}, Threshold: 100, Labels: map[string]string{"team": "api"}},
+		{Name: "FastGrowth", Matchers: []*labels.Matcher{metric}, MaxGrowth: 30, GrowthWindow: 10 * time.Minute},
+		{Name: "UnknownLabel", Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "missing", "x")}, Threshold: 1},
+	}, WithNotifier(&WebhookNotifier{URL: srv.URL}), WithResendDelay(time.Hour))
+	require.NoError(t, err)
+
+	start := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	evaluate := func(at time.Duration) []string {
+		alerts, err := m.Evaluate(context.Background(), start.Add(at))
+		require.NoError(t, err)
+		var states []string
+		for _, a := range alerts {
+			states = append(states, a.Rule+" "+string(a.State))
+		}
+		return states
+	}
+
+	add(0, 50)
+	require.Empty(t, evaluate(0))
+	// 40 series in 5 minutes grow too fast.
+	add(50, 90)
+	require.Equal(t, []string{"FastGrowth firing"}, evaluate(5*time.Minute))
+	add(90, 110)
+	require.Equal(t, []string{"TooManySeries firing"}, evaluate(10*time.Minute))
+	// The estimate of 0m left the window, 20 series in 10 minutes resolve
+	// the growth.
+	require.Equal(t, []string{"FastGrowth resolved"}, evaluate(15*time.Minute))
+	require.Empty(t, evaluate(30*time.Minute))
+	require.Equal(t, []string{"TooManySeries firing"}, evaluate(70*time.Minute))
+
+	alerts := m.Alerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, int64(110), alerts[0].Series)
+	require.True(t, alerts[0].ActiveAt.Equal(start.Add(10*time.Minute)))
+
+	mtx.Lock()
+	require.Len(t, received, 4)
+	require.Equal(t, map[string]any{"alertname": "TooManySeries", "selector": `{__name__="http_requests_total"}`, "team": "api"}, received[1][0]["labels"])
+	require.Equal(t, "110 series exceed the threshold of 100", received[1][0]["annotations"].(map[string]any)["summary"])
+	require.NotContains(t, received[1][0], "endsAt")
+	require.Contains(t, received[2][0], "endsAt")
+	mtx.Unlock()
+
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP cardinality_alerts Firing alerts of the cardinality monitor, like the ALERTS metric of Prometheus.
+# TYPE cardinality_alerts gauge
+cardinality_alerts{alertname="TooManySeries",alertstate="firing",selector="{__name__=\"http_requests_total\"}"} 1
+`), "cardinality_alerts"))
+	require.Equal(t, 4, testutil.CollectAndCount(m))
+
+	for _, rule := range []MonitorRule{
+		{Matchers: []*labels.Matcher{metric}, Threshold: 1},
+		{Name: "a"},
+		{Name: "a", Matchers: []*labels.Matcher{metric}},
+		{Name: "a", Matchers: []*labels.Matcher{metric}, MaxGrowth: 1},
+	} {
+		_, err := NewMonitor(index, []MonitorRule{rule})
+		require.Error(t, err)
+	}
+	_, err = NewMonitor(index, []MonitorRule{{Name: "a", Matchers: []*labels.Matcher{metric}, Threshold: 1}, {Name: "a", Matchers: []*labels.Matcher{metric}, Threshold: 1}})
+	require.ErrorContains(t, err, "duplicate")
+
+	srv.Close()
+	_, err = m.Evaluate(context.Background(), start.Add(3*time.Hour))
+	require.ErrorContains(t, err, "notify")
+
+	// Firing alerts are sent again every minute by default, and a blocked
+	// notifier doesn't block the state of the monitor.
+	notifier := &blockingNotifier{sent: make(chan []Alert), release: make(chan struct{})}
+	m, err = NewMonitor(index, []MonitorRule{{Name: "TooManySeries", Matchers: []*labels.Matcher{metric}, Threshold: 100}}, WithNotifier(notifier))
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := m.Evaluate(context.Background(), start)
+		done <- err
+	}()
+	require.Len(t, <-notifier.sent, 1)
+	require.Len(t, m.Alerts(), 1)
+	require.Equal(t, 2, testutil.CollectAndCount(m))
+	close(notifier.release)
+	require.NoError(t, <-done)
+
+	go func() {
+		for range notifier.sent {
+		}
+	}()
+	alerts, err = m.Evaluate(context.Background(), start.Add(30*time.Second))
+	require.NoError(t, err)
+	require.Empty(t, alerts)
+	alerts, err = m.Evaluate(context.Background(), start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	close(notifier.sent)
+
+	// Alerts no notifier accepted are sent again by the next evaluation,
+	// even if firing alerts are never sent again.
+	failing := &failingNotifier{err: errors.New("unavailable")}
+	m, err = NewMonitor(index, []MonitorRule{{Name: "TooManySeries", Matchers: []*labels.Matcher{metric}, Threshold: 100}}, WithNotifier(failing), WithResendDelay(0))
+	require.NoError(t, err)
+	_, err = m.Evaluate(context.Background(), start)
+	require.ErrorContains(t, err, "unavailable")
+	failing.err = nil
+	alerts, err = m.Evaluate(context.Background(), start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	alerts, err = m.Evaluate(context.Background(), start.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, alerts)
+
+	m.rules[0].rule.Threshold = 1000
+	failing.err = errors.New("unavailable")
+	alerts, err = m.Evaluate(context.Background(), start.Add(3*time.Minute))
+	require.Error(t, err)
+	require.Equal(t, AlertResolved, alerts[0].State)
+	require.Empty(t, m.Alerts())
+	failing.err = nil
+	alerts, err = m.Evaluate(context.Background(), start.Add(4*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	require.Equal(t, AlertResolved, alerts[0].State)
+	require.True(t, alerts[0].ResolvedAt.Equal(start.Add(3*time.Minute)))
+	alerts, err = m.Evaluate(context.Background(), start.Add(5*time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, alerts)
+	require.Equal(t, 4, failing.calls)
+}
+
+// failingNotifier fails with err if it is set.
+type failingNotifier struct {
+	err   error
+	calls int
+}
+
+func (n *failingNotifier) Notify(context.Context, []Alert) error {
+	n.calls++
+	return n.err
+}
+
+// blockingNotifier hands the alerts to sent and waits for release.
+type blockingNotifier struct {
+	sent    chan []Alert
+	release chan struct{}
+}
+
+func (n *blockingNotifier) Notify(_ context.Context, alerts []Alert) error {
+	n.sent <- alerts
+	<-n.release
+	return nil
+}
+
+func TestReplayQueryLog(t *testing.T) {
+	exact := NewBitmapIndex()
+	for i := 0; i < 100; i++ {
+		exact.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%10), "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	// The index under test misses the series of pod-0.
+	index := NewBitmapIndex()
+	for i := 0; i < 100; i++ {
+		if i%10 != 0 {
+			index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%10), "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+		}
+	}
+
+	log := strings.Join([]string{
+		`{"params":{"query":"sum(up)","start":"2024-01-01T00:00:00Z"},"stats":{"timings":{"evalTotalTime":0.1}}}`,
+		`{"params":{"query":"up{pod=~\"^pod-0$\"} / up{pod=\"pod-1\"}"}}`,
+		`{"params":{"query":"rate(up[5m])"}}`,
+		`{"params":{"query":"missing"}}`,
+		`{"params":{"query":"sum("}}`,
+		`not json`,
+	}, "\n")
+	report, err := ReplayQueryLog(context.Background(), strings.NewReader(log), index, exact, 2)
+	require.NoError(t, err)
+	require.Equal(t, 4, report.Queries)
+	require.Equal(t, 2, report.Skipped)
+	require.Equal(t, 4, report.Selectors)
+	require.Equal(t, []CardinalityBucket{
+		{UpperBound: 0, Selectors: 2},
+		{UpperBound: 1},
+		{UpperBound: 10, Selectors: 1},
+		{UpperBound: 100, Selectors: 1},
+	}, report.Distribution)
+	require.Len(t, report.Slowest, 2)
+
+	// up and rate(up[5m]) share a selector.
+	require.Len(t, report.Worst, 2)
+	require.Equal(t, ReplayedSelector{Selector: `{__name__="up",pod=~"pod-0"}`, Queries: 1, Actual: 10, Error: 1, Duration: report.Worst[0].Duration}, report.Worst[0])
+	require.Equal(t, `{__name__="up"}`, report.Worst[1].Selector)
+	require.Equal(t, 2, report.Worst[1].Queries)
+	require.InDelta(t, 0.1, report.Worst[1].Error, 1e-9)
+	require.InDelta(t, 1.1/4, report.MeanAbsError, 1e-9)
+	require.Equal(t, 1.0, report.MaxAbsError)
+
+	report, err = ReplayQueryLog(context.Background(), strings.NewReader(log), index, nil, 2)
+	require.NoError(t, err)
+	require.Empty(t, report.Worst)
+	require.Zero(t, report.MaxAbsError)
+}
+
+func TestGetMatchingRefs(t *testing.T) {
+	b := NewBitmapIndex()
+	for i := 0; i < 20; i++ {
+		lbls := labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%4))
+		if i%2 == 0 {
+			lbls = labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%4), "instance", strconv.Itoa(i))
+		}
+		b.AddSeries(lbls, storage.SeriesRef(100+i))
+	}
+
+	refs, err := b.GetMatchingRefs(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1"))
+	require.NoError(t, err)
+	// Series without an instance label are deduplicated.
+	require.Equal(t, []storage.SeriesRef{101}, refs)
+
+	refs, err = b.GetMatchingRefs(
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"),
+		labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[02]"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "instance", "4"),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []storage.SeriesRef{100, 102, 106, 108, 110, 112, 114, 116, 118}, refs)
+	require.Len(t, refs, int(b.GetCardinality(
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"),
+		labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[02]"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "instance", "4"),
+	)))
+
+	refs, err = b.GetMatchingRefs(labels.MustNewMatcher(labels.MatchEqual, "missing", "x"))
+	require.NoError(t, err)
+	require.Empty(t, refs)
+
+	_, err = b.GetMatchingRefs(&labels.Matcher{Type: labels.MatchEqual, Value: "x"})
+	require.ErrorIs(t, err, ErrUnsupportedMatcher)
+
+	q := NewQueryContext(1)
+	_, err = b.GetMatchingRefsContext(ContextWithQuery(context.Background(), q), labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+"))
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+}
+
+func TestSampleSeries(t *testing.T) {
+	b := NewBitmapIndex(WithSeriesSamples(4), WithMetricNameIndex())
+	var all []labels.Labels
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", i%10), "instance", strconv.Itoa(i))
+		b.AddSeries(lbls, storage.SeriesRef(i))
+		all = append(all, lbls)
+	}
+
+	podMatcher := labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3")
+	series, err := b.SampleSeries([]*labels.Matcher{podMatcher}, 1000)
+	require.NoError(t, err)
+	// About one in four series is sampled.
+	require.InDelta(t, 25, len(series), 15)
+	for _, lbls := range series {
+		require.True(t, podMatcher.Matches(lbls.Get("pod")))
+		require.Contains(t, all, lbls)
+	}
+
+	series, err = b.SampleSeries([]*labels.Matcher{podMatcher}, 3)
+	require.NoError(t, err)
+	require.Len(t, series, 3)
+
+	// Evicted series aren't sampled anymore.
+	b.EvictMetric("up")
+	series, err = b.SampleSeries([]*labels.Matcher{podMatcher}, 3)
+	require.NoError(t, err)
+	require.Empty(t, series)
+	require.Empty(t, b.samples)
+
+	_, err = NewBitmapIndex().SampleSeries([]*labels.Matcher{podMatcher}, 3)
+	require.ErrorIs(t, err, ErrSeriesNotSampled)
+
+	// The buckets of bucketed values hold series of other values, which
+	// aren't returned.
+	b = NewBitmapIndex(WithSeriesSamples(1), WithValueBuckets(5, 4))
+	for i := 0; i < 100; i++ {
+		b.AddSeries(labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	instance := labels.MustNewMatcher(labels.MatchEqual, "instance", "42")
+	require.Greater(t, b.GetCardinality(instance), int64(1))
+	series, err = b.SampleSeries([]*labels.Matcher{instance}, 100)
+	require.NoError(t, err)
+	require.Equal(t, []labels.Labels{labels.FromStrings("__name__", "up", "instance", "42")}, series)
+}
+
+func TestTenantRules(t *testing.T) {
+	m := NewTenantIndexManager(func(string) CardinalityIndex { return NewBitmapIndex() })
+
+	// Without rules or a default tenant, series have no tenant.
+	_, ok := m.AddSeriesFromLabels(labels.FromStrings("__name__", "up", "user", "alice"), 1)
+	require.False(t, ok)
+
+	rules := append(TenantFromLabel("user", false), &relabel.Config{
+		SourceLabels: model.LabelNames{"__name__"},
+		Regex:        relabel.MustNewRegexp("debug_.*"),
+		Action:       relabel.Drop,
+	})
+	m.SetTenantRules(rules, "")
+	tenant, ok := m.AddSeriesFromLabels(labels.FromStrings("__name__", "up", "user", "alice"), 1)
+	require.True(t, ok)
+	require.Equal(t, "alice", tenant)
+	_, ok = m.AddSeriesFromLabels(labels.FromStrings("__name__", "debug_up", "user", "alice"), 2)
+	require.False(t, ok)
+	_, ok = m.AddSeriesFromLabels(labels.FromStrings("__name__", "up"), 3)
+	require.False(t, ok)
+
+	require.Equal(t, []string{"alice"}, m.Tenants())
+	require.Equal(t, int64(1), m.GetCardinality("alice", labels.MustNewMatcher(labels.MatchEqual, "user", "alice")))
+	require.Zero(t, m.GetCardinality("alice", labels.MustNewMatcher(labels.MatchEqual, TenantLabel, "alice")))
+
+	// Stripping the label keeps it out of the index.
+	m.SetTenantRules(TenantFromLabel("user", true), "")
+	m.AddSeriesFromLabels(labels.FromStrings("__name__", "up", "user", "bob"), 4)
+	require.Equal(t, int64(1), m.GetCardinality("bob", labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Zero(t, m.GetCardinality("bob", labels.MustNewMatcher(labels.MatchEqual, "user", "bob")))
+	for _, rule := range TenantFromLabel("user", true) {
+		require.NoError(t, rule.Validate())
+	}
+}
+
+func TestValuePatterns(t *testing.T) {
+	for value, expected := range map[string]string{
+		"api-7d9f8b6c4-x2k9p": "api-*",
+		"api-0":               "api-*",
+		"worker_12.eu-west-1": "worker_*.eu-west-*",
+		"job-3f1c2a9e-8b7d-4c6e-a5f4-1234567890ab": "job-*",
+		"10.0.0.1:9090": "*",
+		"http2":         "",
+		"api":           "",
+	} {
+		pattern, ok := ValuePattern(value)
+		if expected == "" {
+			require.False(t, ok, value)
+			require.Equal(t, value, pattern)
+			continue
+		}
+		require.True(t, ok, value)
+		require.Equal(t, expected, pattern, value)
+	}
+
+	b := NewBitmapIndex(WithMetricNameIndex())
+	ref := storage.SeriesRef(0)
+	for i := 0; i < 50; i++ {
+		for _, metric := range []string{"up", "requests_total"} {
+			ref++
+			b.AddSeries(labels.FromStrings("__name__", metric, "pod", fmt.Sprintf("api-%x-%d", 0x10000+i, i), "job", "api"), ref)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		ref++
+		b.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("db-%d", i), "job", "db"), ref)
+	}
+
+	patterns := b.ValuePatterns(10)
+	require.Equal(t, []LabelValuePattern{{Label: "pod", Pattern: "api-*", Values: 50, Series: 100}}, patterns)
+	require.Equal(t, "pod matches pattern api-*, 50 values, 100 series", patterns[0].String())
+	require.Len(t, b.ValuePatterns(0), 2)
+
+	before := b.Stats().MemoryBytes
+	pod := labels.MustNewMatcher(labels.MatchEqual, "pod", "api-10000-0")
+	require.Equal(t, int64(2), b.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "job", "api")))
+	require.Equal(t, 50, b.CollapseValuePattern("pod", "api-*"))
+	require.Less(t, b.Stats().MemoryBytes, before)
+	require.Zero(t, b.CollapseValuePattern("pod", "missing-*"))
+
+	// Matchers on a collapsed value select every series of the pattern.
+	require.Equal(t, int64(100), b.GetCardinality(pod, labels.MustNewMatcher(labels.MatchEqual, "job", "api")))
+	require.Equal(t, int64(50), b.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"), pod))
+	require.Equal(t, int64(5), b.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "db-.*")))
+	require.Len(t, b.LabelValues("pod"), 55)
+
+	// The values keep their own series, and lose series in proportion.
+	require.Equal(t, int64(2), b.TopLabelValues("pod", 1)[0].Series)
+	b.EvictMetric("requests_total")
+	require.Len(t, b.LabelValues("pod"), 55)
+	require.Equal(t, int64(1), b.TopLabelValues("pod", 1)[0].Series)
+
+	// Evicting every series of the pattern drops all of its values.
+	b.EvictMetric("up")
+	require.Empty(t, b.LabelValues("pod"))
+
+	// Values whose series were removed are dropped, though which values
+	// of a pattern they were isn't known.
+	b = NewBitmapIndex(WithMetricNameIndex())
+	for i := 0; i < 20; i++ {
+		metric := "old"
+		if i >= 10 {
+			metric = "new"
+		}
+		b.AddSeries(labels.FromStrings("__name__", metric, "pod", fmt.Sprintf("api-%x-%d", 0x10000+i, i)), storage.SeriesRef(i+1))
+	}
+	require.Equal(t, 20, b.CollapseValuePattern("pod", "api-*"))
+	b.EvictMetric("old")
+	require.Len(t, b.LabelValues("pod"), 10)
+	var series int64
+	for _, v := range b.TopLabelValues("pod", -1) {
+		series += v.Series
+	}
+	require.Equal(t, int64(10), series)
+}
+
+func TestIngestExposition(t *testing.T) {
+	index := NewBitmapIndex()
+	ingester := NewIngester(index, nil)
+	require.NoError(t, ingester.IngestExposition(strings.NewReader(`# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/"} 10
+http_requests_total{code="500",path="/"} 1 1700000000000
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 0.3
+latency_seconds_count 2
+`), ""))
+	require.Equal(t, IngestStats{Lines: 6, Series: 6}, ingester.Stats())
+	require.Equal(t, int64(2), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")))
+	require.Equal(t, int64(4), index.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "__name__", "latency_seconds_.+")))
+
+	// OpenMetrics is detected by its EOF marker; exemplars are skipped
+	// without an exemplar index.
+	require.NoError(t, ingester.IngestExposition(strings.NewReader(`# TYPE jobs counter
+jobs_total{queue="a"} 1 # {trace_id="abc"} 1.0
+jobs_total{queue="b"} 2
+# EOF
+`), ""))
+	require.Equal(t, int64(2), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "jobs_total")))
+
+	err := ingester.IngestExposition(strings.NewReader("up{job=\"a\"} 1\nbroken{ 1\n"), "text/plain; version=0.0.4")
+	require.ErrorIs(t, err, ErrInvalidLine)
+	require.Equal(t, int64(1), ingester.Stats().Invalid)
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+
+	require.Error(t, ingester.IngestExposition(strings.NewReader(""), "application/json"))
+}
+
+func TestSeriesTypes(t *testing.T) {
+	b := NewBitmapIndex(WithSeriesTypes(), WithMetricNameIndex())
+	b.AddSeries(labels.FromStrings("__name__", "up", "job", "api"), 1)
+	b.AddTypedSeries(labels.FromStrings("__name__", "requests_total", "job", "api"), 2, SeriesInfo{Exemplars: true})
+	b.AddTypedSeries(labels.FromStrings("__name__", "latency_seconds", "job", "api"), 3, SeriesInfo{Type: SeriesTypeHistogram, Buckets: 20, Exemplars: true})
+	b.AddTypedSeries(labels.FromStrings("__name__", "latency_seconds", "job", "db"), 4, SeriesInfo{Type: SeriesTypeHistogram})
+
+	types, err := b.GetCardinalityByType(labels.MustNewMatcher(labels.MatchRegexp, "job", ".+"))
+	require.NoError(t, err)
+	require.Equal(t, []TypeCardinality{
+		{Type: SeriesTypeFloat, Series: 2, Cost: 2, Exemplars: 1},
+		// An empty histogram costs as much as a float series.
+		{Type: SeriesTypeHistogram, Series: 2, Buckets: 20, Cost: 21, Exemplars: 1},
+	}, types)
+
+	// Re-adding a series updates its type.
+	b.AddTypedSeries(labels.FromStrings("__name__", "latency_seconds", "job", "db"), 4, SeriesInfo{Type: SeriesTypeHistogram, Buckets: 5})
+	types, err = b.GetCardinalityByType(labels.MustNewMatcher(labels.MatchEqual, "job", "db"))
+	require.NoError(t, err)
+	require.Equal(t, TypeCardinality{Type: SeriesTypeHistogram, Series: 1, Buckets: 5, Cost: 5}, types[SeriesTypeHistogram])
+
+	// Evicted series are forgotten.
+	require.Equal(t, 2, b.EvictMetric("latency_seconds"))
+	b.AddSeries(labels.FromStrings("__name__", "latency_seconds", "job", "api"), 3)
+	types, err = b.GetCardinalityByType(labels.MustNewMatcher(labels.MatchEqual, "__name__", "latency_seconds"))
+	require.NoError(t, err)
+	require.Equal(t, []TypeCardinality{{Type: SeriesTypeFloat, Series: 1, Cost: 1}, {Type: SeriesTypeHistogram}}, types)
+
+	_, err = NewBitmapIndex().GetCardinalityByType(labels.MustNewMatcher(labels.MatchEqual, "job", "api"))
+	require.ErrorIs(t, err, ErrSeriesTypesNotTracked)
+}
+
+func TestIngestExpositionTypes(t *testing.T) {
+	index := NewBitmapIndex(WithSeriesTypes())
+	ingester := NewIngester(index, nil)
+	require.NoError(t, ingester.IngestExposition(strings.NewReader(`# TYPE jobs counter
+jobs_total{queue="a"} 1 # {trace_id="abc"} 1.0
+jobs_total{queue="b"} 2
+# EOF
+`), ""))
+
+	// Native histograms are only exposed in the protobuf format.
+	mf := &dto.MetricFamily{
+		Name: "rpc_duration_seconds",
+		Type: dto.MetricType_HISTOGRAM,
+		Metric: []dto.Metric{{
+			Label: []dto.LabelPair{{Name: "service", Value: "api"}},
+			Histogram: &dto.Histogram{
+				SampleCount:   6,
+				SampleSum:     1.5,
+				Schema:        1,
+				PositiveSpan:  []dto.BucketSpan{{Offset: 0, Length: 3}, {Offset: 2, Length: 1}},
+				PositiveDelta: []int64{1, 1, 0, 1},
+				NegativeSpan:  []dto.BucketSpan{{Offset: 0, Length: 1}},
+				NegativeDelta: []int64{1},
+			},
+		}},
+	}
+	msg, err := mf.Marshal()
+	require.NoError(t, err)
+	body := append(binary.AppendUvarint(nil, uint64(len(msg))), msg...)
+	require.NoError(t, ingester.IngestExposition(bytes.NewReader(body), "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"))
+
+	types, err := index.GetCardinalityByType(labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	require.NoError(t, err)
+	require.Equal(t, []TypeCardinality{
+		{Type: SeriesTypeFloat, Series: 2, Cost: 2, Exemplars: 1},
+		{Type: SeriesTypeHistogram, Series: 1, Buckets: 5, Cost: 5},
+	}, types)
+}
+
+func TestActiveSeries(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBitmapIndex(WithActiveSeries(), WithMetricNameIndex())
+	b.now = func() time.Time { return now }
+	for pod := 0; pod < 10; pod++ {
+		lbls := labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod))
+		// Samples of pods 0-4 stopped 30m ago, and out of order samples
+		// don't move the latest sample back.
+		b.AddSeriesSample(lbls, storage.SeriesRef(pod+1), now.Add(-time.Hour).UnixMilli())
+		if pod >= 5 {
+			b.AddSeriesSample(lbls, storage.SeriesRef(pod+1), now.Add(-time.Minute).UnixMilli())
+		}
+		b.AddSeriesSample(lbls, storage.SeriesRef(pod+1), now.Add(-30*time.Minute).UnixMilli())
+	}
+	// Series without samples are never active.
+	b.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-10"), 11)
+
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+	require.Equal(t, int64(11), b.GetCardinality(up))
+	for window, want := range map[time.Duration]int64{15 * time.Minute: 5, 30 * time.Minute: 10, 0: 0} {
+		active, err := b.GetActiveCardinality(window, up)
+		require.NoError(t, err)
+		require.Equal(t, want, active, "window %v", window)
+	}
+	active, err := b.GetActiveCardinality(time.Hour, labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-[0-6]"))
+	require.NoError(t, err)
+	require.Equal(t, int64(7), active)
+
+	require.Equal(t, 11, b.EvictMetric("up"))
+	b.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-0"), 1)
+	active, err = b.GetActiveCardinality(time.Hour, up)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), active)
+
+	_, err = NewBitmapIndex().GetActiveCardinality(time.Hour, up)
+	require.ErrorIs(t, err, ErrActiveSeriesNotTracked)
+
+	// Scraped samples without timestamps are taken at the time of the
+	// scrape.
+	b = NewBitmapIndex(WithActiveSeries())
+	require.NoError(t, NewIngester(b, nil).IngestExposition(strings.NewReader(`up{job="a"} 1
+up{job="b"} 1 1700000000000
+`), ""))
+	active, err = b.GetActiveCardinality(time.Hour, up)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), active)
+	require.Equal(t, int64(2), b.GetCardinality(up))
+}
+
+func TestQueryable(t *testing.T) {
+	b := NewBitmapIndex()
+	for i := 0; i < 10; i++ {
+		b.AddSeries(labels.FromStrings("__name__", "http_requests_total", "job", "api", "pod", fmt.Sprintf("pod-%d", i)), storage.SeriesRef(i+1))
+	}
+	b.AddSeries(labels.FromStrings("__name__", "up", "job", "api"), 11)
+
+	// The PromQL engine runs the query without series, and returns the
+	// estimates of its selectors.
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1000, Timeout: time.Minute})
+	qry, err := engine.NewInstantQuery(context.Background(), NewQueryable(b), nil, `sum(rate(http_requests_total{pod=~"pod-[0-4]"}[5m])) / on() up`, time.Unix(3600, 0))
+	require.NoError(t, err)
+	res := qry.Exec(context.Background())
+	require.NoError(t, res.Err)
+	vector, err := res.Vector()
+	require.NoError(t, err)
+	require.Empty(t, vector)
+	estimates := map[string]int64{}
+	for _, warning := range res.Warnings {
+		var estimate SelectEstimate
+		require.ErrorAs(t, warning, &estimate)
+		estimates[matchersKey(estimate.Matchers)] = estimate.Series
+	}
+	require.Equal(t, map[string]int64{
+		`__name__="http_requests_total",pod=~"pod-[0-4]"`: 5,
+		`__name__="up"`: 1,
+	}, estimates)
+
+	q, err := NewQueryable(b).Querier(0, 0)
+	require.NoError(t, err)
+	defer q.Close()
+	values, _, err := q.LabelValues(context.Background(), "pod", &storage.LabelHints{Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod-0", "pod-1", "pod-2"}, values)
+	names, _, err := q.LabelNames(context.Background(), nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "job"}, names)
+
+	// Failed estimates fail the select.
+	set := q.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchEqual, "jbo", "api"))
+	require.False(t, set.Next())
+	require.ErrorIs(t, set.Err(), ErrUnknownLabel)
+
+	q, err = NewQueryable(NewCachingIndex(b, time.Minute, 0)).Querier(0, 0)
+	require.NoError(t, err)
+	_, _, err = q.LabelValues(context.Background(), "pod", nil)
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestReadiness(t *testing.T) {
+	now := time.Unix(0, 0)
+	load := func(warmErr, coldErr error) (*Readiness, []string, error) {
+		r := NewReadiness()
+		r.now = func() time.Time { return now }
+		r.status.Started = now
+		require.False(t, r.Ready())
+		require.Equal(t, ReadinessBuilding, r.Status().State)
+
+		var calls []string
+		err := r.Load(context.Background(), func(context.Context) error {
+			calls = append(calls, "warm")
+			now = now.Add(time.Second)
+			return warmErr
+		}, func(context.Context) error {
+			calls = append(calls, "cold")
+			now = now.Add(time.Minute)
+			return coldErr
+		})
+		return r, calls, err
+	}
+
+	r, calls, err := load(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"warm"}, calls)
+	require.True(t, r.Ready())
+	require.Equal(t, ReadinessStatus{State: ReadinessReady, Start: WarmStart, Started: now.Add(-time.Second), Duration: time.Second}, r.Status())
+
+	// Without a checkpoint the index is rebuilt.
+	r, calls, err = load(os.ErrNotExist, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"warm", "cold"}, calls)
+	require.True(t, r.Ready())
+	status := r.Status()
+	require.Equal(t, ColdStart, status.Start)
+	require.Equal(t, time.Minute+time.Second, status.Duration)
+	require.Equal(t, os.ErrNotExist.Error(), status.Error)
+
+	r, _, err = load(os.ErrNotExist, errors.New("head is gone"))
+	require.EqualError(t, err, "head is gone")
+	require.False(t, r.Ready())
+	require.Equal(t, ReadinessFailed, r.Status().State)
+	require.Equal(t, "head is gone", r.Status().Error)
+}
+
+func TestHyperMinHashExplain(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMetricNameIndex()}} {
+		h := NewHyperMinHashIndex(opts...)
+		for i := 0; i < 20000; i++ {
+			name := "big"
+			if i%2000 == 0 {
+				name = "small"
+			}
+			h.AddSeries(labels.FromStrings("__name__", name, "job", fmt.Sprintf("job-%d", i%2), "id", fmt.Sprint(i)), 0)
+		}
+
+		e := h.Explain(labels.MustNewMatcher(labels.MatchEqual, "__name__", "small"))
+		require.Equal(t, Explanation{Matchers: []string{`__name__="small"`}, Source: ExplainExact, Series: 10}, e)
+
+		e = h.Explain(labels.MustNewMatcher(labels.MatchEqual, "job", "job-1"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-2"))
+		require.Equal(t, ExplainEmpty, e.Source)
+		require.Zero(t, e.Series)
+
+		matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "big"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-0")}
+		e = h.Explain(matchers...)
+		require.Equal(t, sketchcore.Jaccard, e.Plan.Strategy)
+		require.Equal(t, h.GetCardinality(matchers...), e.Series)
+		if opts == nil {
+			require.Equal(t, ExplainSketches, e.Source)
+			require.InEpsilon(t, 9990, e.Series, 0.1)
+
+			// A broad matcher barely restricts a selective one.
+			e = h.Explain(labels.MustNewMatcher(labels.MatchEqual, "__name__", "small"), labels.MustNewMatcher(labels.MatchRegexp, "id", ".+"))
+			require.Equal(t, ExplainSketches, e.Source)
+			require.Equal(t, sketchcore.MinCardinality, e.Plan.Strategy)
+			require.InDelta(t, 10, e.Series, 1)
+		} else {
+			require.Equal(t, ExplainMetricSketches, e.Source)
+			require.Equal(t, []string{`__name__="big"`, `job="job-0"`}, e.Matchers)
+		}
+	}
+}
+
+func TestHyperMinHashAccuracyTarget(t *testing.T) {
+	sketched, exact := NewHyperMinHashIndex(), NewHyperMinHashIndex(WithAccuracyTarget(0.02))
+	for i := 0; i < 2000; i++ {
+		lbls := labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", i%100), "code", fmt.Sprint(200+i%3))
+		sketched.AddSeries(lbls, 0)
+		exact.AddSeries(lbls, 0)
+	}
+
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*"), labels.MustNewMatcher(labels.MatchEqual, "code", "200")}
+	require.Equal(t, sketched.GetCardinality(matchers...), exact.GetCardinality(matchers...))
+	require.Equal(t, sketched.Stats().LabelValues, exact.Stats().LabelValues)
+	// The 104 values of the 300 series are kept as hashes instead of sketches.
+	require.Equal(t, int64(4)*int64(sketchcore.SketchSize)+8*3*300, exact.Stats().MemoryBytes)
+	require.Less(t, exact.Stats().MemoryBytes, sketched.Stats().MemoryBytes/10)
+}
+
+func TestRefSpace(t *testing.T) {
+	// Both ingesters allocate refs from 1, and share the series of pod-0.
+	ingester := func(zone string, opts ...Option) *BitmapIndex {
+		index := NewBitmapIndex(opts...)
+		for i := 0; i < 10; i++ {
+			pod := fmt.Sprintf("pod-%d", i)
+			if i > 0 {
+				pod = zone + "-" + pod
+			}
+			index.AddSeries(labels.FromStrings("__name__", "up", "pod", pod), storage.SeriesRef(i+1))
+		}
+		return index
+	}
+	pod0 := labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")
+	up := labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")
+
+	offsets := NewOffsetRefSpace(32)
+	merged := NewBitmapIndex()
+	require.NoError(t, merged.Merge(ingester("a"), "a", offsets))
+	require.NoError(t, merged.Merge(ingester("b"), "b", offsets))
+	require.Equal(t, int64(20), merged.GetCardinality(up))
+	require.Equal(t, int64(2), merged.GetCardinality(pod0))
+	require.Equal(t, int64(1), merged.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "b-pod-3")))
+	require.Equal(t, int64(20), merged.Stats().SeriesAdded)
+	global, err := offsets.Global("b", 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, storage.SeriesRef(1<<32|3), global)
+	_, err = offsets.Global("a", 1<<32, 0)
+	require.ErrorIs(t, err, ErrRefOutOfSpace)
+
+	// Merging a source again only adds its new series.
+	require.NoError(t, merged.Merge(ingester("a"), "a", offsets))
+	require.Equal(t, int64(20), merged.GetCardinality(up))
+
+	// With series hashes, a table gives the series of both ingesters a
+	// single ref.
+	table := NewTableRefSpace()
+	merged = NewBitmapIndex(WithMetricNameIndex())
+	require.NoError(t, merged.Merge(ingester("a", WithSeriesHashes()), "a", table))
+	require.NoError(t, merged.Merge(ingester("b", WithSeriesHashes(), WithMetricNameIndex()), "b", table))
+	require.Equal(t, int64(19), merged.GetCardinality(up))
+	require.Equal(t, int64(1), merged.GetCardinality(pod0))
+	require.Equal(t, int64(1), merged.GetCardinality(up, pod0))
+	require.Equal(t, int64(1), merged.GetCardinality(up, labels.MustNewMatcher(labels.MatchEqual, "pod", "a-pod-3")))
+	stats := merged.TopLabelValues("pod", 1)
+	require.Equal(t, int64(1), stats[0].Series)
+	a, err := table.Global("a", 1, labels.FromStrings("__name__", "up", "pod", "pod-0").Hash())
+	require.NoError(t, err)
+	b, err := table.Global("b", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+
+	bucketed := NewBitmapIndex(WithValueBuckets(2, 4))
+	for i := 0; i < 5; i++ {
+		bucketed.AddSeries(labels.FromStrings("pod", fmt.Sprint(i)), storage.SeriesRef(i+1))
+	}
+	require.Error(t, merged.Merge(bucketed, "c", table))
+}
+
+func TestSeenFilter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	index := NewBitmapIndex(WithSeenFilter(1000, time.Minute), WithActiveSeries())
+	index.now = func() time.Time { return now }
+	for i := 0; i < 1000; i++ {
+		index.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i+1), now.UnixMilli())
+	}
+	// Up to about 1% of the new series are taken for known.
+	added := index.Stats().SeriesAdded
+	require.GreaterOrEqual(t, added, int64(970))
+
+	// Known series are skipped until the filter is reset.
+	pod := labels.FromStrings("__name__", "up", "pod", "0")
+	now = now.Add(30 * time.Second)
+	index.AddSeriesSample(pod, 1, now.UnixMilli())
+	require.Equal(t, time.Unix(1000, 0).UnixMilli(), index.lastSample[1])
+	now = now.Add(30 * time.Second)
+	index.AddSeriesSample(pod, 1, now.UnixMilli())
+	require.Equal(t, now.UnixMilli(), index.lastSample[1])
+
+	// The series wrongly skipped are added after the reset. They come last
+	// in the first pass, with the filter full, and first in this one.
+	for i := 999; i >= 0; i-- {
+		index.AddSeriesSample(labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i+1), now.UnixMilli())
+	}
+	require.Equal(t, int64(1000), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+
+	h := NewHyperMinHashIndex(WithSeenFilter(100, time.Hour))
+	for i := 0; i < 3; i++ {
+		h.AddSeries(pod, 1)
+	}
+	require.Equal(t, int64(1), h.Stats().SeriesAdded)
+	require.Nil(t, newSeenFilter(0, time.Minute, time.Now))
+	// Without resets, the series wrongly skipped would never be added.
+	require.Nil(t, newSeenFilter(100, 0, time.Now))
+	require.Nil(t, newSeenFilter(100, -time.Minute, time.Now))
+}
+
+func TestValuePresence(t *testing.T) {
+	now := time.Unix(1000, 0)
+	index := NewBitmapIndex(WithValuePresence(), WithValueTTL(time.Minute))
+	index.now = func() time.Time { return now }
+	for i := 0; i < 1000; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprint(i)), storage.SeriesRef(i+1))
+	}
+	now = now.Add(30 * time.Second)
+	index.AddSeries(labels.FromStrings("__name__", "up", "pod", "new"), 1001)
+
+	// The filter grew with the values and holds every one of them.
+	s := index.shard("pod")
+	for i := 0; i < 1000; i++ {
+		require.True(t, s.presence.contains(fmt.Sprint(i)))
+	}
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "999")))
+	require.Equal(t, int64(0), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "pod", "1000")))
+	require.Equal(t, int64(3), index.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "1|20|new|absent")))
+	require.Equal(t, int64(998), index.GetCardinality(labels.MustNewMatcher(labels.MatchNotRegexp, "pod", "1|20|new|absent")))
+
+	// Evicted values leave the filter.
+	now = now.Add(45 * time.Second)
+	require.Equal(t, 1000, index.EvictStale())
+	require.False(t, s.presence.contains("1"))
+	require.True(t, s.presence.contains("new"))
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "pod", "1|new")))
+
+	f := newCuckooFilter(0)
+	require.False(t, f.contains("a"))
+	require.True(t, f.insert("a"))
+	require.True(t, f.contains("a"))
+	f.delete("a")
+	require.False(t, f.contains("a"))
+}
+
+func TestEstimateJoinExpansion(t *testing.T) {
+	index := NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for container := 0; container < 3; container++ {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "a", "pod", fmt.Sprint(pod), "container", fmt.Sprint(container)), ref)
+		}
+	}
+	many := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "a")}
+
+	e, err := EstimateJoinExpansion(index, many, []string{"pod"}, true)
+	require.NoError(t, err)
+	require.Equal(t, JoinExpansion{Series: 30, Groups: 10, Factor: 3}, e)
+
+	e, err = EstimateJoinExpansion(index, many, []string{"container"}, false)
+	require.NoError(t, err)
+	require.Equal(t, JoinExpansion{Series: 30, Groups: 10, Factor: 3}, e)
+
+	// Without matching labels, every series joins the single "one" series.
+	e, err = EstimateJoinExpansion(index, many, nil, true)
+	require.NoError(t, err)
+	require.Equal(t, JoinExpansion{Series: 30, Groups: 1, Factor: 30}, e)
+
+	e, err = EstimateJoinExpansion(index, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "b")}, []string{"pod"}, true)
+	require.NoError(t, err)
+	require.Equal(t, JoinExpansion{}, e)
+
+	_, err = EstimateJoinExpansion(NewCachingIndex(index, time.Minute, 0), many, []string{"pod"}, true)
+	require.Error(t, err)
+}
+
+func TestRelabelConfigs(t *testing.T) {
+	dropTraceID := relabel.DefaultRelabelConfig
+	dropTraceID.Action = relabel.LabelDrop
+	dropTraceID.Regex = relabel.MustNewRegexp("trace_id")
+	dropDebug := relabel.DefaultRelabelConfig
+	dropDebug.Action = relabel.Drop
+	dropDebug.SourceLabels = model.LabelNames{"__name__"}
+	dropDebug.Regex = relabel.MustNewRegexp("debug_.*")
+	opts := []Option{WithRelabelConfigs(&dropTraceID, &dropDebug), WithActiveSeries()}
+
+	for name, index := range map[string]CardinalityIndex{
+		"bitmap":       NewBitmapIndex(opts...),
+		"hyperminhash": NewHyperMinHashIndex(opts...),
+	} {
+		for i := 0; i < 100; i++ {
+			index.AddSeries(labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", i%10), "trace_id", fmt.Sprint(i)), storage.SeriesRef(i+1))
+			index.AddSeries(labels.FromStrings("__name__", "debug_requests_total", "pod", fmt.Sprintf("pod-%d", i%10)), storage.SeriesRef(i+101))
+		}
+		// Only the labels left by the rules are indexed.
+		require.Equal(t, int64(10), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")), name)
+		require.Zero(t, index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "debug_requests_total")), name)
+		require.Equal(t, []string{"__name__", "pod"}, index.(LabelValuesIndex).LabelNames(), name)
+	}
+
+	// Series dropped by the rules have no samples either.
+	b := NewBitmapIndex(opts...)
+	b.AddSeriesSample(labels.FromStrings("__name__", "debug_requests_total"), 1, time.Now().UnixMilli())
+	active, err := b.GetActiveCardinality(time.Hour, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	require.NoError(t, err)
+	require.Zero(t, active)
+	require.Empty(t, b.lastSample)
+}
+
+func TestValueGuard(t *testing.T) {
+	require.InDelta(t, 0, entropy("aaaaaaaaaaaaaaaa"), 1e-9)
+	require.InDelta(t, 4, entropy("0123456789abcdef"), 1e-9)
+	require.Less(t, entropy("checkout-service-production"), 4.0)
+
+	const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, buckets := range []int{0, 4} {
+		guard := ValueGuard{MaxLength: 64, MinEntropy: 4, Buckets: buckets}
+		for name, index := range map[string]CardinalityIndex{
+			"bitmap":       NewBitmapIndex(WithValueGuard(guard)),
+			"hyperminhash": NewHyperMinHashIndex(WithValueGuard(guard)),
+		} {
+			for i := 0; i < 100; i++ {
+				traceID := make([]byte, 32)
+				for j := range traceID {
+					traceID[j] = base62[rng.IntN(len(base62))]
+				}
+				lbls := labels.FromStrings("__name__", "http_requests_total", "service", "checkout-service-production", "trace_id", string(traceID), "url", "/"+strings.Repeat("a", i))
+				index.AddSeries(lbls, storage.SeriesRef(i+1))
+				// Series added again are only reported once.
+				index.AddSeries(lbls, storage.SeriesRef(i+1))
+			}
+
+			report := index.(UnboundedLabelsIndex).UnboundedLabels()
+			require.Len(t, report, 2, name)
+			require.Equal(t, "trace_id", report[0].Label, name)
+			require.Equal(t, "url", report[1].Label, name)
+			li := index.(LabelValuesIndex)
+			require.Len(t, li.LabelValues("service"), 1, name)
+			if buckets == 0 {
+				require.Equal(t, UnboundedLabel{Label: "trace_id", Series: 100, HighEntropy: 100, MaxLength: 32, Example: report[0].Example}, report[0], name)
+				require.Equal(t, int64(36), report[1].TooLong, name)
+				require.Equal(t, 100, report[1].MaxLength, name)
+				require.Len(t, li.LabelValues("trace_id"), 100, name)
+				continue
+			}
+
+			// Flagged values are bucketed, so series only differing by them
+			// are the same series.
+			require.Less(t, report[0].Series, int64(100), name)
+			require.LessOrEqual(t, len(li.LabelValues("trace_id")), 4, name)
+			var bucketed int
+			for _, v := range li.LabelValues("url") {
+				if strings.HasPrefix(v, UnboundedValuePrefix) {
+					bucketed++
+				}
+			}
+			require.Len(t, li.LabelValues("url"), 64+bucketed, name)
+			require.LessOrEqual(t, bucketed, 4, name)
+		}
+	}
+	require.Nil(t, NewBitmapIndex().UnboundedLabels())
+
+	// Metric names aren't flagged, and examples are cut on a rune boundary.
+	index := NewBitmapIndex(WithValueGuard(ValueGuard{MaxLength: 10, Buckets: 4}))
+	name := "a_very_long_metric_name_total"
+	index.AddSeries(labels.FromStrings("__name__", name, "path", "/"+strings.Repeat("é", 40)), 1)
+	require.Equal(t, []string{name}, index.LabelValues("__name__"))
+	report := index.UnboundedLabels()
+	require.Len(t, report, 1)
+	require.Equal(t, "path", report[0].Label)
+	require.Equal(t, "/"+strings.Repeat("é", 31), report[0].Example)
+	require.True(t, utf8.ValidString(report[0].Example))
+}
+
+func TestRelabelImpact(t *testing.T) {
+	b := NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for path := 0; path < 5; path++ {
+			ref++
+			b.AddSeries(labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", pod), "path", fmt.Sprintf("/%d", path)), ref)
+		}
+		ref++
+		b.AddSeries(labels.FromStrings("__name__", "debug_info", "pod", fmt.Sprintf("pod-%d", pod)), ref)
+	}
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "up"), ref)
+
+	rules := func(config string) []*relabel.Config {
+		var rules []*relabel.Config
+		require.NoError(t, yaml.UnmarshalStrict([]byte(config), &rules))
+		return rules
+	}
+
+	impact, err := b.RelabelImpact(rules(`
+- source_labels: [__name__]
+  regex: debug_.*
+  action: drop
+- action: labeldrop
+  regex: pod
+- source_labels: [__name__, path]
+  regex: http_requests_total;/[01]
+  action: keep
+`))
+	require.NoError(t, err)
+	require.Equal(t, RelabelImpact{
+		Series:    61,
+		Dropped:   10 + 4,
+		Merged:    45,
+		Remaining: 2,
+		Rules: []RelabelRuleImpact{
+			{Action: relabel.Drop, Removed: 10},
+			{Action: relabel.LabelDrop, Removed: 45},
+			{Action: relabel.Keep, Removed: 4},
+		},
+	}, impact)
+
+	// Labels series don't have are empty.
+	impact, err = b.RelabelImpact(rules(`
+- source_labels: [pod]
+  regex: ""
+  action: drop
+- action: labelkeep
+  regex: __name__|path
+`))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), impact.Dropped)
+	require.Equal(t, int64(6), impact.Remaining)
+
+	_, err = b.RelabelImpact(rules(`
+- source_labels: [pod]
+  target_label: instance
+`))
+	require.ErrorIs(t, err, ErrUnsupportedRelabelRule)
+}
+
+func TestSchema(t *testing.T) {
+	b := NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for code := range 3 {
+			ref++
+			b.AddSeries(labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", pod), "code", fmt.Sprintf("%d00", code+2)), ref)
+		}
+		// A new exporter version adds a request id.
+		for id := range 2 {
+			ref++
+			b.AddSeries(labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", pod), "code", "200", "request_id", fmt.Sprintf("%d-%d", pod, id)), ref)
+		}
+	}
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "up", "job", "api"), ref)
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "up", "job", "API"), ref)
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "up"), ref)
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "node_load1", "instance", "a"), ref)
+
+	registry, err := NewSchemaRegistry(
+		MetricSchema{Metric: "http_requests_total", Labels: []LabelSchema{
+			{Name: "pod", Required: true},
+			{Name: "code", Required: true, Pattern: "[2-5][0-9][0-9]"},
+		}},
+		MetricSchema{Metric: "up", Labels: []LabelSchema{{Name: "job", Required: true, Pattern: "[a-z]+"}}},
+		MetricSchema{Metric: "missing", AllowUndeclared: true},
+	)
+	require.NoError(t, err)
+
+	report, err := b.CheckSchema(registry)
+	require.NoError(t, err)
+	require.Equal(t, SchemaReport{
+		Series:    53,
+		Unchecked: 1,
+		Violating: 22,
+		Excess:    20,
+		Metrics: []MetricSchemaReport{
+			{
+				Metric:    "http_requests_total",
+				Series:    50,
+				Violating: 20,
+				Excess:    20,
+				Violations: []SchemaViolation{
+					{Label: "request_id", Kind: ViolationUndeclaredLabel, Series: 20, Examples: []string{"0-0", "0-1", "1-0"}},
+				},
+			},
+			{
+				Metric:    "up",
+				Series:    3,
+				Violating: 2,
+				Violations: []SchemaViolation{
+					{Label: "job", Kind: ViolationInvalidValue, Series: 1, Examples: []string{"API"}},
+					{Label: "job", Kind: ViolationMissingLabel, Series: 1},
+				},
+			},
+		},
+	}, report)
+
+	require.True(t, registry.Unregister("up"))
+	require.False(t, registry.Unregister("up"))
+	require.Equal(t, []string{"http_requests_total", "missing"}, func() []string {
+		var metrics []string
+		for _, s := range registry.Schemas() {
+			metrics = append(metrics, s.Metric)
+		}
+		return metrics
+	}())
+
+	require.ErrorContains(t, registry.Register(MetricSchema{Metric: "up", Labels: []LabelSchema{{Name: "job"}, {Name: "job"}}}), "duplicate label")
+	require.ErrorContains(t, registry.Register(MetricSchema{Metric: "up", Labels: []LabelSchema{{Name: "__name__"}}}), "invalid label name")
+	require.ErrorContains(t, registry.Register(MetricSchema{Metric: "up", Labels: []LabelSchema{{Name: "job", Pattern: "("}}}), "invalid pattern")
+	require.ErrorContains(t, registry.Register(MetricSchema{Metric: "1up"}), "invalid metric name")
+
+	// Patterns can't be checked on bucketed values.
+	b = NewBitmapIndex(WithValueBuckets(4, 2))
+	for i := range 10 {
+		b.AddSeries(labels.FromStrings("__name__", "up", "job", fmt.Sprintf("job-%d", i)), storage.SeriesRef(i+1))
+	}
+	registry, err = NewSchemaRegistry(MetricSchema{Metric: "up", Labels: []LabelSchema{{Name: "job", Pattern: "job-.*"}}})
+	require.NoError(t, err)
+	_, err = b.CheckSchema(registry)
+	require.ErrorIs(t, err, ErrUnsupportedSchemaLabel)
+}
+
+func TestSetAlgebra(t *testing.T) {
+	b := NewBitmapIndex()
+	h := NewHyperMinHashIndex()
+	ref := storage.SeriesRef(0)
+	for pod := range 1000 {
+		for _, ns := range []string{"team-a", "team-b", "kube-system"} {
+			ref++
+			lbls := labels.FromStrings("__name__", "http_requests_total", "namespace", ns, "pod", fmt.Sprintf("pod-%d", pod), "shard", strconv.Itoa(pod%4))
+			b.AddSeries(lbls, ref)
+			h.AddSeries(lbls, ref)
+		}
+	}
+
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")
+	teams := labels.MustNewMatcher(labels.MatchRegexp, "namespace", "team-.*")
+	teamA := labels.MustNewMatcher(labels.MatchEqual, "namespace", "team-a")
+	shard0 := labels.MustNewMatcher(labels.MatchEqual, "shard", "0")
+	shard1 := labels.MustNewMatcher(labels.MatchEqual, "shard", "1")
+
+	for _, tc := range []struct {
+		name string
+		a, b []*labels.Matcher
+		want int64
+	}{
+		{"outside teams", []*labels.Matcher{metric}, []*labels.Matcher{teams}, 1000},
+		{"team without shard", []*labels.Matcher{teamA}, []*labels.Matcher{shard0}, 750},
+		{"disjoint", []*labels.Matcher{shard0}, []*labels.Matcher{shard1}, 750},
+		{"subset", []*labels.Matcher{teamA}, []*labels.Matcher{teams}, 0},
+		{"empty", []*labels.Matcher{teamA}, nil, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, EstimateDifference(b, tc.a, tc.b))
+			// Wrapping indexes answer from the intersection, which is exact
+			// for bitmaps.
+			require.Equal(t, tc.want, EstimateDifference(NewTrackingIndex(b, 1), tc.a, tc.b))
+			require.InDelta(t, tc.want, EstimateDifference(h, tc.a, tc.b), 100)
+		})
+	}
+
+	for _, tc := range []struct {
+		name string
+		sets [][]*labels.Matcher
+		want int64
+	}{
+		{"overlapping", [][]*labels.Matcher{{teamA}, {shard0}, {teamA, shard1}}, 1000 + 500},
+		{"disjoint", [][]*labels.Matcher{{shard0}, {shard1}}, 1500},
+		{"empty sets", [][]*labels.Matcher{{teams}, nil, {labels.MustNewMatcher(labels.MatchEqual, "namespace", "none")}}, 2000},
+		{"none", nil, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			union, err := EstimateUnion(b, tc.sets...)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, union)
+			union, err = EstimateUnion(NewTrackingIndex(b, 1), tc.sets...)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, union)
+			union, err = EstimateUnion(h, tc.sets...)
+			require.NoError(t, err)
+			require.InDelta(t, tc.want, union, 150)
+		})
+	}
+
+	sets := make([][]*labels.Matcher, maxUnionSets+1)
+	for i := range sets {
+		sets[i] = []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", fmt.Sprintf("pod-%d", i))}
+	}
+	union, err := EstimateUnion(b, sets...)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*len(sets)), union)
+	_, err = EstimateUnion(NewTrackingIndex(b, 1), sets...)
+	require.Error(t, err)
+}
+
+func TestSimulateAggregation(t *testing.T) {
+	b := NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for code := 0; code < 3; code++ {
+			ref++
+			b.AddSeries(labels.FromStrings("__name__", "http_requests_total", "pod", fmt.Sprintf("pod-%d", pod), "code", strconv.Itoa(200+code), "zone", fmt.Sprintf("zone-%d", pod%2)), ref)
+		}
+	}
+	ref++
+	b.AddSeries(labels.FromStrings("__name__", "up", "pod", "pod-0"), ref)
+
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")
+	for _, tc := range []struct {
+		drop     []string
+		expected int64
+	}{
+		{drop: nil, expected: 30},
+		{drop: []string{"pod"}, expected: 6},
+		{drop: []string{"pod", "zone"}, expected: 3},
+		{drop: []string{"pod", "code", "zone"}, expected: 1},
+		{drop: []string{"missing"}, expected: 30},
+	} {
+		series, err := b.SimulateAggregation([]*labels.Matcher{metric}, tc.drop)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, series, tc.drop)
+	}
+
+	// The metric name is dropped, so up and the requests of pod-0 are only
+	// kept apart by the zone.
+	series, err := b.SimulateAggregation([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")}, []string{"code"})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), series)
+	series, err = b.SimulateAggregation([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")}, []string{"code", "zone"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), series)
+
+	series, err = b.SimulateAggregation([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "missing")}, nil)
+	require.NoError(t, err)
+	require.Zero(t, series)
+
+	bucketed := NewBitmapIndex(WithValueBuckets(5, 2))
+	for i := 0; i < 10; i++ {
+		bucketed.AddSeries(labels.FromStrings("__name__", "up", "pod", strconv.Itoa(i)), storage.SeriesRef(i))
+	}
+	_, err = bucketed.SimulateAggregation([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")}, nil)
+	require.Error(t, err)
+	series, err = bucketed.SimulateAggregation([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")}, []string{"pod"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), series)
+}
+
+func TestExemplarIndex(t *testing.T) {
+	e := NewExemplarIndex()
+	index := NewBitmapIndex(WithSeriesTypes())
+	ingester := NewIngester(index, nil)
+	ingester.SetExemplarIndex(e)
+	require.NoError(t, ingester.IngestExposition(strings.NewReader(`# TYPE jobs counter
+jobs_total{queue="a"} 1 # {trace_id="abc"} 1.0
+jobs_total{queue="b"} 2 # {trace_id="def",span_id="1"} 1.0
+jobs_total{queue="c"} 3
+# EOF
+`), ""))
+	require.Equal(t, IngestStats{Lines: 3, Series: 3, Exemplars: 2}, ingester.Stats())
+
+	ingester.IngestRemoteWrite(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "rpc_duration_seconds"}, {Name: "service", Value: "api"}},
+			Histograms: []prompb.Histogram{{
+				Count:          &prompb.Histogram_CountInt{CountInt: 3},
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 3}},
+				PositiveDeltas: []int64{1, 0, 0},
+				Timestamp:      1700000000000,
+			}},
+			Exemplars: []prompb.Exemplar{
+				{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 0.1},
+				{Labels: []prompb.Label{{Name: "trace_id", Value: "ghi"}}, Value: 0.2},
+			},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "jobs_total"}, {Name: "queue", Value: "d"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+		},
+		{Labels: []prompb.Label{{Name: "", Value: "broken"}}},
+	}})
+	require.Equal(t, IngestStats{Lines: 6, Series: 5, Invalid: 1, Exemplars: 4}, ingester.Stats())
+	types, err := index.GetCardinalityByType(labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	require.NoError(t, err)
+	require.Equal(t, []TypeCardinality{
+		{Type: SeriesTypeFloat, Series: 4, Cost: 4, Exemplars: 2},
+		{Type: SeriesTypeHistogram, Series: 1, Buckets: 3, Cost: 3, Exemplars: 1},
+	}, types)
+
+	// Exemplars don't add series to the index.
+	require.Equal(t, int64(5), index.GetCardinality(labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")))
+	require.Equal(t, int64(4), e.GetCardinality(labels.MustNewMatcher(labels.MatchNotEqual, ExemplarLabelPrefix+"trace_id", "")))
+	require.Equal(t, int64(2), e.GetCardinality(
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "rpc_duration_seconds"),
+		labels.MustNewMatcher(labels.MatchNotEqual, ExemplarLabelPrefix+"trace_id", ""),
+	))
+
+	require.Equal(t, []ExemplarLabelStats{
+		{Label: "trace_id", Values: 3, Exemplars: 4, Metrics: []ExemplarMetricStats{
+			{Metric: "jobs_total", Values: 2, Exemplars: 2},
+			{Metric: "rpc_duration_seconds", Values: 2, Exemplars: 2},
+		}},
+		{Label: "span_id", Values: 1, Exemplars: 1, Metrics: []ExemplarMetricStats{
+			{Metric: "jobs_total", Values: 1, Exemplars: 1},
+		}},
+	}, e.LabelStats(10))
+	stats := e.LabelStats(1)
+	require.Len(t, stats[0].Metrics, 1)
+
+	// Without an exemplar index, exemplars are only counted by type.
+	ingester = NewIngester(NewBitmapIndex(), nil)
+	require.NoError(t, ingester.IngestExposition(strings.NewReader("jobs_total{queue=\"a\"} 1 # {trace_id=\"abc\"} 1.0\n# EOF\n"), ""))
+	require.Zero(t, ingester.Stats().Exemplars)
 }
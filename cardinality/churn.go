@@ -0,0 +1,107 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"sync"
+	"time"
+)
+
+type churnBucket struct {
+	start time.Time
+	index CardinalityIndex
+}
+
+// ChurnTracker answers how many new series matching a set of matchers
+// appeared recently. Every series is added to the index of the interval in
+// which it was first seen, so summing the intervals of a time range counts
+// the series created in it. Intervals older than the retention are dropped,
+// but the series seen in them are remembered so they never count as new
+// again.
+type ChurnTracker struct {
+	interval  time.Duration
+	retention time.Duration
+	newIndex  func() CardinalityIndex
+
+	mtx     sync.Mutex
+	seen    seriesSet
+	buckets []churnBucket
+}
+
+// NewChurnTracker returns a tracker with intervals of the given length,
+// keeping the intervals of the last retention. newIndex creates the index of
+// an interval.
+func NewChurnTracker(interval, retention time.Duration, newIndex func() CardinalityIndex) *ChurnTracker {
+	return &ChurnTracker{
+		interval:  interval,
+		retention: retention,
+		newIndex:  newIndex,
+		seen:      newSeriesSet(true),
+	}
+}
+
+// AddSeries records the series as seen now.
+func (c *ChurnTracker) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	c.AddSeriesAt(lbls, ref, time.Now())
+}
+
+// AddSeriesAt records the series as seen at ts. Series that were seen
+// before are ignored. Timestamps are expected to be roughly increasing;
+// series seen before the oldest retained interval are only remembered.
+func (c *ChurnTracker) AddSeriesAt(lbls labels.Labels, ref storage.SeriesRef, ts time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.seen.add(lbls.Hash()) {
+		return
+	}
+
+	start := ts.Truncate(c.interval)
+	c.expire(start)
+	for i := len(c.buckets) - 1; i >= 0; i-- {
+		if c.buckets[i].start.Equal(start) {
+			c.buckets[i].index.AddSeries(lbls, ref)
+			return
+		}
+		if c.buckets[i].start.Before(start) {
+			break
+		}
+	}
+	if len(c.buckets) > 0 && start.Before(c.buckets[0].start) {
+		return
+	}
+
+	b := churnBucket{start: start, index: c.newIndex()}
+	b.index.AddSeries(lbls, ref)
+	c.buckets = append(c.buckets, b)
+	// Keep the buckets ordered by start if a series arrived late.
+	for i := len(c.buckets) - 1; i > 0 && c.buckets[i].start.Before(c.buckets[i-1].start); i-- {
+		c.buckets[i], c.buckets[i-1] = c.buckets[i-1], c.buckets[i]
+	}
+}
+
+// expire drops the buckets that ended more than the retention before now.
+func (c *ChurnTracker) expire(now time.Time) {
+	cutoff := now.Add(-c.retention)
+	i := 0
+	for i < len(c.buckets) && !c.buckets[i].start.Add(c.interval).After(cutoff) {
+		i++
+	}
+	c.buckets = c.buckets[i:]
+}
+
+// NewSeries returns the number of series matching the matchers that were
+// first seen at or after since. The answer has the granularity of the
+// interval: every interval that ends after since is counted in full.
+func (c *ChurnTracker) NewSeries(since time.Time, matchers ...*labels.Matcher) int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var series int64
+	for _, b := range c.buckets {
+		if b.start.Add(c.interval).After(since) {
+			series += b.index.GetCardinality(matchers...)
+		}
+	}
+	return series
+}
@@ -0,0 +1,338 @@
+package cardinality
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coldSegmentPattern names the segment files of the cold tier.
+const coldSegmentPattern = "*.cold"
+
+// ErrNoColdTier is returned by the cold tier methods of an index created
+// without WithColdTier.
+var ErrNoColdTier = errors.New("index has no cold tier")
+
+// TierStats reports a pass of the cold tier.
+type TierStats struct {
+	// Cold counts the values whose postings were moved to disk, and Hot the
+	// values moved back to the heap because they were queried again.
+	Cold int `json:"cold"`
+	Hot  int `json:"hot"`
+	// Segments is the number of segment files written, and Bytes their
+	// size.
+	Segments int           `json:"segments"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// coldTier holds the segment files of the postings moved to disk. It is
+// shared by an index and its sub-indexes.
+type coldTier struct {
+	dir    string
+	now    func() time.Time
+	logger *slog.Logger
+	// bytes is the size of the mapped segments.
+	bytes atomic.Int64
+
+	// mtx guards the removal of the segments left by earlier processes,
+	// done before the first segment is written.
+	mtx     sync.Mutex
+	cleaned bool
+}
+
+// tierSegment is a memory-mapped file holding the postings of cold values of
+// a shard. The file is unmapped and removed once none of its values is cold
+// anymore. refs is guarded by the lock of the shard.
+type tierSegment struct {
+	tier *coldTier
+	path string
+	f    *fileutil.MmapFile
+	refs int
+}
+
+// queryTime returns the time to record as the last query of the values
+// selected by a query, or 0 if queries aren't tracked. It is safe to call on
+// a nil tier.
+func (t *coldTier) queryTime() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.now().UnixNano()
+}
+
+// touch records that the value was queried at now, unless now is 0. It only
+// needs a read lock of the shard.
+func (v *valueEntry) touch(now int64) {
+	if now != 0 {
+		v.lastQueried.Store(now)
+	}
+}
+
+// read returns the postings of the value for use past the lock of the shard.
+// Cold postings are copied out of their segment, which may be unmapped once
+// the lock is released; unions share the containers of the bitmaps they
+// read. The caller must hold a lock.
+func (v *valueEntry) read() *roaring64.Bitmap {
+	if v.segment == nil {
+		return v.postings
+	}
+	return v.postings.Clone()
+}
+
+// warm moves cold postings back to the heap so that they can be modified.
+// The caller must hold the lock of the shard.
+func (v *valueEntry) warm() {
+	if v.segment == nil {
+		return
+	}
+	postings := v.postings.Clone()
+	v.segment.release()
+	v.postings, v.segment = postings, nil
+}
+
+// release drops the reference of a value being dropped to its segment,
+// leaving it without postings. The caller must hold the lock of the shard.
+func (v *valueEntry) release() {
+	if v.segment == nil {
+		return
+	}
+	v.segment.release()
+	v.postings, v.segment = roaring64.NewBitmap(), nil
+}
+
+// release drops a reference to the segment, unmapping and removing its file
+// with the last one.
+func (seg *tierSegment) release() {
+	if seg.refs--; seg.refs > 0 {
+		return
+	}
+	t := seg.tier
+	t.bytes.Add(-int64(len(seg.f.Bytes())))
+	if err := seg.f.Close(); err != nil {
+		t.logger.Error("Failed to unmap cold tier segment", "path", seg.path, "err", err)
+	}
+	if err := os.Remove(seg.path); err != nil {
+		t.logger.Error("Failed to remove cold tier segment", "path", seg.path, "err", err)
+	}
+}
+
+// clean removes the segments left in the directory by an earlier process,
+// once.
+func (t *coldTier) clean() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.cleaned {
+		return nil
+	}
+	if err := os.MkdirAll(t.dir, 0o777); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(t.dir, coldSegmentPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	t.cleaned = true
+	return nil
+}
+
+// writeSegment writes the postings of the values to a new segment and
+// replaces them with views of the mapped file. On error the values are left
+// on the heap. The caller must hold the lock of the shard of the values.
+func (t *coldTier) writeSegment(values []*valueEntry) (*tierSegment, error) {
+	if err := t.clean(); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(t.dir, coldSegmentPattern)
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	offsets := make([]int64, len(values)+1)
+	w := bufio.NewWriter(f)
+	for i, v := range values {
+		n, err := v.postings.WriteTo(w)
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+			return nil, err
+		}
+		offsets[i+1] = offsets[i] + n
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	mf, err := fileutil.OpenMmapFile(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	seg := &tierSegment{tier: t, path: path, f: mf, refs: len(values)}
+	b := mf.Bytes()
+	bitmaps := make([]*roaring64.Bitmap, len(values))
+	for i := range values {
+		bitmaps[i] = roaring64.NewBitmap()
+		if _, err := bitmaps[i].FromUnsafeBytes(b[offsets[i]:offsets[i+1]]); err != nil {
+			mf.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to read cold tier segment %s: %w", path, err)
+		}
+	}
+	for i, v := range values {
+		v.postings, v.segment = bitmaps[i], seg
+	}
+	t.bytes.Add(int64(len(b)))
+	return seg, nil
+}
+
+// Tier moves the postings of the label values neither added to nor queried
+// for coldAfter to memory-mapped files in the directory configured
+// WithColdTier, and moves the postings of the cold values queried since
+// back to the heap. Cold postings are read from the page cache, copying
+// them for every query, so that the heap only holds the postings of the
+// values in use and the kernel pages out the rest. Adding a series to a
+// cold value moves it back to the heap. Bucketed labels and labels with
+// collapsed values stay on the heap.
+func (b *BitmapIndex) Tier(coldAfter time.Duration) (TierStats, error) {
+	if b.cold == nil {
+		return TierStats{}, ErrNoColdTier
+	}
+	start := time.Now()
+	cutoff := b.now().Add(-coldAfter).UnixNano()
+
+	var stats TierStats
+	err := b.tier(&stats, cutoff)
+	b.metricsMtx.RLock()
+	for _, sub := range b.metrics {
+		if err == nil {
+			err = sub.tier(&stats, cutoff)
+		}
+	}
+	b.metricsMtx.RUnlock()
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// tier runs a pass of the cold tier over the shards of the index, adding to
+// stats. It stops at the first error.
+func (b *BitmapIndex) tier(stats *TierStats, cutoff int64) error {
+	var err error
+	b.forEachShard(func(_ string, s *labelShard) {
+		if err == nil {
+			err = s.tier(stats, cutoff)
+		}
+	})
+	return err
+}
+
+// tier moves the cold values of the shard to a new segment, and the values
+// queried since cutoff back to the heap.
+func (s *labelShard) tier(stats *TierStats, cutoff int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.bucketed != nil || s.collapsed {
+		return nil
+	}
+
+	var cold []*valueEntry
+	for _, v := range s.values {
+		queried := v.lastQueried.Load()
+		switch {
+		case v.segment != nil && queried > cutoff:
+			v.warm()
+			stats.Hot++
+		case v.segment == nil && v.lastSeen <= cutoff && queried <= cutoff:
+			cold = append(cold, v)
+		}
+	}
+	if len(cold) == 0 {
+		return nil
+	}
+	seg, err := s.cold.writeSegment(cold)
+	if err != nil {
+		return fmt.Errorf("failed to write cold tier segment: %w", err)
+	}
+	stats.Cold += len(cold)
+	stats.Segments++
+	stats.Bytes += int64(len(seg.f.Bytes()))
+	return nil
+}
+
+// Warm moves the postings of every cold value back to the heap and removes
+// the segment files, e.g. before shutting down.
+func (b *BitmapIndex) Warm() error {
+	if b.cold == nil {
+		return ErrNoColdTier
+	}
+	warm := func(_ string, s *labelShard) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for _, v := range s.values {
+			v.warm()
+		}
+	}
+	b.forEachShard(warm)
+	b.metricsMtx.RLock()
+	for _, sub := range b.metrics {
+		sub.forEachShard(warm)
+	}
+	b.metricsMtx.RUnlock()
+	return nil
+}
+
+// releaseCold drops the cold postings of an index being dropped, so that
+// its segments are removed.
+func (b *BitmapIndex) releaseCold() {
+	b.forEachShard(func(_ string, s *labelShard) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for _, v := range s.values {
+			v.release()
+		}
+	})
+}
+
+// RunTiering runs a Tier pass every interval until ctx is done, and logs the
+// values moved by each pass. Failed passes are logged and retried at the
+// next interval.
+func (b *BitmapIndex) RunTiering(ctx context.Context, interval, coldAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := b.Tier(coldAfter)
+		if err != nil {
+			b.logger.Error("Failed to tier label values", "err", err)
+		}
+		if stats.Cold > 0 || stats.Hot > 0 {
+			b.logger.Debug("Tiered label values", "cold", stats.Cold, "hot", stats.Hot,
+				"segments", stats.Segments, "bytes", stats.Bytes, "duration", stats.Duration)
+		}
+	}
+}
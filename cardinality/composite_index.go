@@ -0,0 +1,265 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"math"
+	"slices"
+	"sync"
+)
+
+// compositeHead is the RefSpace source of the series of the head.
+const compositeHead = "head"
+
+// CompositeBlock describes a block sub-index of a CompositeIndex. Times
+// are in milliseconds, MaxTime being exclusive like in TSDB block metas.
+type CompositeBlock struct {
+	ID      ulid.ULID `json:"id"`
+	MinTime int64     `json:"min_time"`
+	MaxTime int64     `json:"max_time"`
+	Series  int64     `json:"series"`
+}
+
+type compositeBlock struct {
+	CompositeBlock
+	index *BitmapIndex
+}
+
+// CompositeIndex mirrors the layout of a TSDB: an immutable BitmapIndex per
+// block, built once with AddBlock, and a mutable BitmapIndex for the head,
+// fed with AddSeries. GetCardinalityRange answers for a time range from
+// the sub-indexes overlapping it only, and retention is a matter of
+// RemoveBlock dropping a sub-index. Every series gets the same ref in all
+// sub-indexes, from a table RefSpace keyed by its labels hash, so series in
+// several blocks are counted once, at the cost of the entries of the table.
+// The entries of series no sub-index has anymore are dropped. The head
+// covers the time after the last block: adding a block truncates the head
+// series without samples after it, like a TSDB head once compacted. The
+// index is safe for concurrent use.
+type CompositeIndex struct {
+	opts  []Option
+	space *RefSpace
+	head  *BitmapIndex
+
+	// headMtx guards headMaxt, the time of the last sample of every head
+	// series, by head series ref.
+	headMtx  sync.Mutex
+	headMaxt map[storage.SeriesRef]compositeHeadSeries
+
+	mtx    sync.RWMutex
+	blocks []compositeBlock
+}
+
+// compositeHeadSeries is the global ref and labels hash of a head series,
+// and the time of its last sample.
+type compositeHeadSeries struct {
+	global storage.SeriesRef
+	hash   uint64
+	maxt   int64
+}
+
+// NewCompositeIndex returns an index whose head and block sub-indexes are
+// created with opts. The composite index assigns the refs of the series, so
+// opts can't include WithAllocatedRefs.
+func NewCompositeIndex(opts ...Option) *CompositeIndex {
+	return &CompositeIndex{
+		opts:     opts,
+		space:    NewTableRefSpace(),
+		head:     NewBitmapIndex(opts...),
+		headMaxt: make(map[storage.SeriesRef]compositeHeadSeries),
+	}
+}
+
+// Head returns the mutable sub-index of the head, e.g. to evict its stale
+// values. Series must be added to it with AddSeries or AddSeriesSample.
+func (c *CompositeIndex) Head() *BitmapIndex {
+	return c.head
+}
+
+// AddSeries adds a series of the head, whose ref is the head series ref,
+// with a sample now.
+func (c *CompositeIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	c.AddSeriesSample(lbls, ref, c.head.now().UnixMilli())
+}
+
+// AddSeriesSample adds a series of the head with a sample at t, in
+// milliseconds. The series stays in the head until a block ends after its
+// last sample.
+func (c *CompositeIndex) AddSeriesSample(lbls labels.Labels, ref storage.SeriesRef, t int64) {
+	c.headMtx.Lock()
+	defer c.headMtx.Unlock()
+	hash := lbls.Hash()
+	global, err := c.space.Global(compositeHead, ref, hash)
+	if err != nil {
+		// Table ref spaces have room for every series.
+		return
+	}
+	c.head.AddSeriesSample(lbls, global, t)
+	if series, ok := c.headMaxt[ref]; !ok || t > series.maxt {
+		c.headMaxt[ref] = compositeHeadSeries{global: global, hash: hash, maxt: t}
+	}
+}
+
+// truncateHead removes the head series whose last sample is before maxt,
+// now in a block, and returns their number.
+func (c *CompositeIndex) truncateHead(maxt int64) int {
+	c.headMtx.Lock()
+	defer c.headMtx.Unlock()
+	var (
+		refs   []storage.SeriesRef
+		hashes []uint64
+	)
+	stale := roaring64.NewBitmap()
+	for ref, series := range c.headMaxt {
+		if series.maxt < maxt {
+			refs = append(refs, ref)
+			hashes = append(hashes, series.hash)
+			stale.Add(uint64(series.global))
+			delete(c.headMaxt, ref)
+		}
+	}
+	if len(refs) == 0 {
+		return 0
+	}
+	c.head.evictSeries(stale)
+	c.head.forgetSeen(hashes)
+	c.space.dropRefs(compositeHead, refs)
+	return len(refs)
+}
+
+// AddBlock builds the sub-index of a persisted block, e.g. once the head
+// was compacted into it, and truncates the head series whose last sample
+// is before the end of the block. Adding a known block does nothing.
+func (c *CompositeIndex) AddBlock(ctx context.Context, block tsdb.BlockReader, opts ...BuildOption) error {
+	meta := block.Meta()
+	source := meta.ULID.String()
+	c.mtx.RLock()
+	known := slices.ContainsFunc(c.blocks, func(b compositeBlock) bool { return b.ID == meta.ULID })
+	c.mtx.RUnlock()
+	if known {
+		return nil
+	}
+
+	index := NewBitmapIndex(c.opts...)
+	err := buildFromBlock(ctx, block, func(lbls labels.Labels, ref storage.SeriesRef) {
+		if global, err := c.space.Global(source, ref, lbls.Hash()); err == nil {
+			index.AddSeries(lbls, global)
+		}
+	}, applyBuildOptions(opts))
+	if err != nil {
+		c.space.Drop(source)
+		return err
+	}
+	// The sub-index is immutable, so its bitmaps are compacted once.
+	index.Optimize(0, 0)
+
+	c.mtx.Lock()
+	// The block may have been added concurrently, with the same refs.
+	if slices.ContainsFunc(c.blocks, func(b compositeBlock) bool { return b.ID == meta.ULID }) {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.blocks = append(c.blocks, compositeBlock{
+		CompositeBlock: CompositeBlock{ID: meta.ULID, MinTime: meta.MinTime, MaxTime: meta.MaxTime, Series: index.Stats().Series},
+		index:          index,
+	})
+	slices.SortFunc(c.blocks, func(a, b compositeBlock) int { return a.ID.Compare(b.ID) })
+	c.mtx.Unlock()
+
+	c.truncateHead(meta.MaxTime)
+	return nil
+}
+
+// RemoveBlock drops the sub-index of a block, e.g. once retention deleted
+// the block, and reports whether it was known.
+func (c *CompositeIndex) RemoveBlock(id ulid.ULID) bool {
+	c.mtx.Lock()
+	i := slices.IndexFunc(c.blocks, func(b compositeBlock) bool { return b.ID == id })
+	if i >= 0 {
+		c.blocks = slices.Delete(c.blocks, i, i+1)
+	}
+	c.mtx.Unlock()
+	if i < 0 {
+		return false
+	}
+	c.space.Drop(id.String())
+	return true
+}
+
+// Blocks returns the block sub-indexes, ordered by ID.
+func (c *CompositeIndex) Blocks() []CompositeBlock {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	blocks := make([]CompositeBlock, 0, len(c.blocks))
+	for _, b := range c.blocks {
+		blocks = append(blocks, b.CompositeBlock)
+	}
+	return blocks
+}
+
+// overlapping returns the sub-indexes with series in [mint, maxt].
+func (c *CompositeIndex) overlapping(mint, maxt int64) []*BitmapIndex {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var indexes []*BitmapIndex
+	headMint := int64(math.MinInt64)
+	for _, b := range c.blocks {
+		if b.MinTime <= maxt && b.MaxTime > mint {
+			indexes = append(indexes, b.index)
+		}
+		headMint = max(headMint, b.MaxTime)
+	}
+	if maxt >= headMint {
+		indexes = append(indexes, c.head)
+	}
+	return indexes
+}
+
+func (c *CompositeIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return c.GetCardinalityContext(context.Background(), matchers...)
+}
+
+// GetCardinalityContext returns the number of series matching the matchers
+// over all blocks and the head.
+func (c *CompositeIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	return c.GetCardinalityRange(ctx, math.MinInt64, math.MaxInt64, matchers...)
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but checks the
+// matchers and the budget of the QueryContext of ctx.
+func (c *CompositeIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, c, nil, matchers)
+}
+
+// GetCardinalityRange returns the number of series matching the matchers
+// in the blocks overlapping [mint, maxt], in milliseconds, and in the head
+// if maxt is after the last block. The series of a block are counted if
+// the block overlaps the range, even if they have no samples in it.
+func (c *CompositeIndex) GetCardinalityRange(ctx context.Context, mint, maxt int64, matchers ...*labels.Matcher) int64 {
+	ctx, span := tracer.Start(ctx, "CompositeIndex.GetCardinalityRange")
+	defer span.End()
+	setSpanMatchers(span, matchers...)
+
+	if len(matchers) == 0 {
+		return 0
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0
+	}
+
+	q := QueryFromContext(ctx)
+	q.begin()
+	union := roaring64.NewBitmap()
+	for _, index := range c.overlapping(mint, maxt) {
+		union.Or(index.getIntersectionBitmap(ctx, matchers))
+	}
+	if q.exceeded() {
+		return 0
+	}
+	return int64(union.GetCardinality())
+}
@@ -0,0 +1,190 @@
+// Package conformance is a test suite for CardinalityIndex implementations.
+// It adds a fixed set of series to an index and checks the estimates of a
+// set of matchers against the series they select, following the PromQL
+// semantics: a matcher that matches the empty string also selects the
+// series without the label.
+package conformance
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+	"harry671003/hello/cardinality"
+	"strconv"
+	"testing"
+)
+
+// minTolerated is the result size below which the relative tolerance is
+// applied to this many series instead, as sketches miscount small results
+// by a few series.
+const minTolerated = 20
+
+// Case is a set of matchers checked by the suite.
+type Case struct {
+	Name     string
+	Matchers []*labels.Matcher
+}
+
+func m(t labels.MatchType, name, value string) *labels.Matcher {
+	return labels.MustNewMatcher(t, name, value)
+}
+
+// Cases returns the matchers checked by RunConformance.
+func Cases() []Case {
+	return []Case{
+		{"metric", []*labels.Matcher{m(labels.MatchEqual, "__name__", "http_requests_total")}},
+		{"metric and pod", []*labels.Matcher{m(labels.MatchEqual, "__name__", "http_requests_total"), m(labels.MatchEqual, "pod", "pod-7")}},
+		{"label across metrics", []*labels.Matcher{m(labels.MatchEqual, "pod", "pod-7")}},
+		{"regex alternation", []*labels.Matcher{m(labels.MatchRegexp, "method", "GET|POST")}},
+		{"regex and equality", []*labels.Matcher{m(labels.MatchRegexp, "pod", "pod-[0-9]"), m(labels.MatchEqual, "method", "GET")}},
+		{"all metrics", []*labels.Matcher{m(labels.MatchRegexp, "__name__", ".+")}},
+		{"not equal", []*labels.Matcher{m(labels.MatchEqual, "__name__", "http_requests_total"), m(labels.MatchNotEqual, "method", "GET")}},
+		{"not regex", []*labels.Matcher{m(labels.MatchNotRegexp, "__name__", "http_.*|events")}},
+		{"no matching value", []*labels.Matcher{m(labels.MatchEqual, "pod", "unknown")}},
+		{"disjoint matchers", []*labels.Matcher{m(labels.MatchEqual, "__name__", "up"), m(labels.MatchEqual, "method", "GET")}},
+		{"high cardinality label", []*labels.Matcher{m(labels.MatchRegexp, "request_id", "req-1.*")}},
+		{"missing label", []*labels.Matcher{m(labels.MatchEqual, "job", "")}},
+		{"present label", []*labels.Matcher{m(labels.MatchNotEqual, "job", "")}},
+		{"not equal includes missing", []*labels.Matcher{m(labels.MatchNotEqual, "job", "job-0")}},
+		{"regex matching empty", []*labels.Matcher{m(labels.MatchRegexp, "job", "job-0|")}},
+		{"not regex includes missing", []*labels.Matcher{m(labels.MatchNotRegexp, "job", "job-.*")}},
+		{"metric without label", []*labels.Matcher{m(labels.MatchEqual, "__name__", "up"), m(labels.MatchEqual, "job", "")}},
+		{"unknown label equal", []*labels.Matcher{m(labels.MatchEqual, "unknown", "x")}},
+		{"unknown label not equal", []*labels.Matcher{m(labels.MatchNotEqual, "unknown", "x")}},
+		{"unknown label not regex", []*labels.Matcher{m(labels.MatchEqual, "__name__", "node_cpu_seconds_total"), m(labels.MatchNotRegexp, "unknown", "x|y")}},
+		{"unknown label match all", []*labels.Matcher{m(labels.MatchRegexp, "unknown", ".*")}},
+		{"unknown label match non-empty", []*labels.Matcher{m(labels.MatchRegexp, "unknown", ".+")}},
+		{"redundant matchers", []*labels.Matcher{m(labels.MatchRegexp, "method", "GET|POST"), m(labels.MatchEqual, "method", "GET")}},
+		{"contradicting matchers", []*labels.Matcher{m(labels.MatchEqual, "method", "GET"), m(labels.MatchEqual, "method", "POST")}},
+	}
+}
+
+// Series returns the series added to the index by RunConformance. There are
+// 965 series of four metrics, with labels missing on some series and a
+// label with 500 distinct values.
+func Series() []labels.Labels {
+	var series []labels.Labels
+	for pod := 0; pod < 25; pod++ {
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			for _, status := range []string{"200", "500"} {
+				series = append(series, labels.FromStrings("__name__", "http_requests_total", "method", method, "pod", fmt.Sprintf("pod-%d", pod), "status", status))
+			}
+		}
+	}
+	for pod := 0; pod < 25; pod++ {
+		// A third of the series has no job label.
+		if pod%3 == 0 {
+			series = append(series, labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)))
+		} else {
+			series = append(series, labels.FromStrings("__name__", "up", "job", fmt.Sprintf("job-%d", pod%2), "pod", fmt.Sprintf("pod-%d", pod)))
+		}
+	}
+	for instance := 0; instance < 10; instance++ {
+		for cpu := 0; cpu < 8; cpu++ {
+			for _, mode := range []string{"idle", "system", "user"} {
+				series = append(series, labels.FromStrings("__name__", "node_cpu_seconds_total", "cpu", strconv.Itoa(cpu), "instance", fmt.Sprintf("node-%d", instance), "job", "node", "mode", mode))
+			}
+		}
+	}
+	for i := 0; i < 500; i++ {
+		series = append(series, labels.FromStrings("__name__", "events", "request_id", fmt.Sprintf("req-%d", i)))
+	}
+	return series
+}
+
+// matches reports whether the series is selected by all matchers.
+func matches(lbls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// RunConformance adds Series to an index created by factory and checks the
+// estimate of every case. tolerance is the allowed relative error, applied
+// to at least 20 series; exact indexes use zero. Indexes implementing
+// cardinality.LabelValuesIndex must also list label names and values
+// exactly, and exact indexes must do so for the series selected by each
+// case. AddSeries is expected to be idempotent.
+func RunConformance(t *testing.T, factory func() cardinality.CardinalityIndex, tolerance float64) {
+	index := factory()
+	series := Series()
+	// Every series is added twice, to check that it is only counted once.
+	for i := 0; i < 2; i++ {
+		for ref, lbls := range series {
+			index.AddSeries(lbls, storage.SeriesRef(ref+1))
+		}
+	}
+
+	t.Run("no matchers", func(t *testing.T) {
+		require.Zero(t, index.GetCardinality())
+	})
+
+	for _, c := range Cases() {
+		t.Run(c.Name, func(t *testing.T) {
+			var want int64
+			for _, lbls := range series {
+				if matches(lbls, c.Matchers) {
+					want++
+				}
+			}
+			got := index.GetCardinality(c.Matchers...)
+			allowed := tolerance * float64(max(want, minTolerated))
+			require.InDelta(t, want, got, allowed, "matchers %v", c.Matchers)
+		})
+	}
+
+	lvi, ok := index.(cardinality.LabelValuesIndex)
+	if !ok {
+		return
+	}
+	t.Run("label names and values", func(t *testing.T) {
+		names, values := labelSets(series, nil)
+		require.ElementsMatch(t, names, lvi.LabelNames())
+		for _, name := range names {
+			require.ElementsMatch(t, values[name], lvi.LabelValues(name), "label %s", name)
+		}
+	})
+	if tolerance > 0 {
+		return
+	}
+	for _, c := range Cases() {
+		t.Run("label names and values/"+c.Name, func(t *testing.T) {
+			names, values := labelSets(series, c.Matchers)
+			require.ElementsMatch(t, names, lvi.LabelNames(c.Matchers...))
+			for _, name := range []string{"__name__", "job", "pod"} {
+				require.ElementsMatch(t, values[name], lvi.LabelValues(name, c.Matchers...), "label %s", name)
+			}
+		})
+	}
+}
+
+// labelSets returns the label names and the values of every label of the
+// series selected by the matchers, or of all series without matchers.
+func labelSets(series []labels.Labels, matchers []*labels.Matcher) ([]string, map[string][]string) {
+	seen := make(map[string]map[string]struct{})
+	for _, lbls := range series {
+		if len(matchers) > 0 && !matches(lbls, matchers) {
+			continue
+		}
+		lbls.Range(func(l labels.Label) {
+			if seen[l.Name] == nil {
+				seen[l.Name] = make(map[string]struct{})
+			}
+			seen[l.Name][l.Value] = struct{}{}
+		})
+	}
+
+	var names []string
+	values := make(map[string][]string, len(seen))
+	for name, set := range seen {
+		names = append(names, name)
+		for value := range set {
+			values[name] = append(values[name], value)
+		}
+	}
+	return names, values
+}
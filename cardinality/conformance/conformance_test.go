@@ -0,0 +1,70 @@
+package conformance
+
+import (
+	"github.com/prometheus/common/promslog"
+	"harry671003/hello/cardinality"
+	"testing"
+)
+
+func TestBitmapIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewBitmapIndex() }, 0)
+}
+
+func TestBitmapIndexWithAllocatedRefs(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex {
+		return cardinality.NewBitmapIndex(cardinality.WithAllocatedRefs())
+	}, 0)
+}
+
+func TestExactHashIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewExactHashIndex() }, 0)
+}
+
+func TestHyperMinHashIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewHyperMinHashIndex() }, 0.1)
+}
+
+func TestRouterIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex {
+		return cardinality.NewRouterIndex(cardinality.NewBitmapIndex(), cardinality.NewHyperMinHashIndex(), 100)
+	}, 0.1)
+}
+
+func TestLoggingIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex {
+		return cardinality.NewLoggingIndex(cardinality.NewBitmapIndex(), promslog.NewNopLogger(), 0)
+	}, 0)
+}
+
+func TestLabelPairs(t *testing.T) {
+	pairs := cardinality.WithLabelPairs([2]string{"__name__", "pod"}, [2]string{"method", "status"})
+	t.Run("BitmapIndex", func(t *testing.T) {
+		RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewBitmapIndex(pairs) }, 0)
+	})
+	t.Run("HyperMinHashIndex", func(t *testing.T) {
+		RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewHyperMinHashIndex(pairs) }, 0.1)
+	})
+}
+
+func TestHyperMinHashIndexWithCooccurrence(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex {
+		return cardinality.NewHyperMinHashIndex(cardinality.WithCooccurrenceTracking())
+	}, 0.1)
+}
+
+func TestMetricNameIndex(t *testing.T) {
+	t.Run("BitmapIndex", func(t *testing.T) {
+		RunConformance(t, func() cardinality.CardinalityIndex {
+			return cardinality.NewBitmapIndex(cardinality.WithMetricNameIndex())
+		}, 0)
+	})
+	t.Run("HyperMinHashIndex", func(t *testing.T) {
+		RunConformance(t, func() cardinality.CardinalityIndex {
+			return cardinality.NewHyperMinHashIndex(cardinality.WithMetricNameIndex())
+		}, 0.1)
+	})
+}
+
+func TestCompositeIndex(t *testing.T) {
+	RunConformance(t, func() cardinality.CardinalityIndex { return cardinality.NewCompositeIndex() }, 0)
+}
@@ -0,0 +1,188 @@
+package cardinality
+
+import (
+	"sync"
+
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+type labelPair struct {
+	first, second string
+}
+
+func newLabelPair(a, b string) labelPair {
+	if b < a {
+		a, b = b, a
+	}
+	return labelPair{first: a, second: b}
+}
+
+// CooccurrenceTracker records, for every pair of label names that appear
+// together on a series, a sketch of the distinct value combinations of the
+// pair. Comparing the joint distinct count with the per-label distinct counts
+// tells how correlated two labels are: pod and instance are typically 1:1,
+// while method and pod are close to independent.
+//
+// Every tracked pair costs one sketch, so memory grows quadratically with the
+// number of label names that co-occur on series.
+//
+// It is safe for concurrent use: series can be added while it is queried.
+type CooccurrenceTracker struct {
+	mtx    sync.RWMutex
+	values map[string]*hyperminhash.Sketch
+	pairs  map[labelPair]*hyperminhash.Sketch
+}
+
+func NewCooccurrenceTracker() *CooccurrenceTracker {
+	return &CooccurrenceTracker{
+		values: make(map[string]*hyperminhash.Sketch),
+		pairs:  make(map[labelPair]*hyperminhash.Sketch),
+	}
+}
+
+func (c *CooccurrenceTracker) AddSeries(lbls labels.Labels) {
+	buf := make([]byte, 0, 64)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, a := range lbls {
+		sketch, ok := c.values[a.Name]
+		if !ok {
+			sketch = hyperminhash.New()
+			c.values[a.Name] = sketch
+		}
+		sketch.Add([]byte(a.Value))
+
+		for _, b := range lbls[i+1:] {
+			pair := newLabelPair(a.Name, b.Name)
+			sketch, ok := c.pairs[pair]
+			if !ok {
+				sketch = hyperminhash.New()
+				c.pairs[pair] = sketch
+			}
+
+			// Label values can't contain the 0xff byte, so it separates the pair unambiguously.
+			buf = append(buf[:0], a.Value...)
+			buf = append(buf, 0xff)
+			buf = append(buf, b.Value...)
+			sketch.Add(buf)
+		}
+	}
+}
+
+// DistinctValues returns the estimated number of distinct values of name.
+func (c *CooccurrenceTracker) DistinctValues(name string) uint64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.distinctValues(name)
+}
+
+func (c *CooccurrenceTracker) distinctValues(name string) uint64 {
+	if sketch, ok := c.values[name]; ok {
+		return sketch.Cardinality()
+	}
+	return 0
+}
+
+// JointDistinct returns the estimated number of distinct (a, b) value
+// combinations seen on series carrying both labels.
+func (c *CooccurrenceTracker) JointDistinct(a, b string) uint64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.jointDistinct(a, b)
+}
+
+func (c *CooccurrenceTracker) jointDistinct(a, b string) uint64 {
+	if a == b {
+		return c.distinctValues(a)
+	}
+	if sketch, ok := c.pairs[newLabelPair(a, b)]; ok {
+		return sketch.Cardinality()
+	}
+	return 0
+}
+
+// Dependence returns how strongly the values of a and b determine each
+// other, from 0 (independent) to 1 (one label is a function of the other).
+// It returns 0 when the pair was never seen together.
+func (c *CooccurrenceTracker) Dependence(a, b string) float64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	joint := float64(c.jointDistinct(a, b))
+	da, db := float64(c.distinctValues(a)), float64(c.distinctValues(b))
+	if joint == 0 || da == 0 || db == 0 {
+		return 0
+	}
+
+	// For independent labels joint == da*db, for dependent ones joint == max(da, db).
+	maxDistinct := max(da, db)
+	independent := da * db
+	if independent <= maxDistinct {
+		return 1
+	}
+	dependence := (independent - joint) / (independent - maxDistinct)
+	return min(max(dependence, 0), 1)
+}
+
+// EstimateCombinations estimates the number of distinct value combinations of
+// the given label names. Instead of multiplying per-label distinct counts,
+// which assumes independence, every further label only contributes the
+// smallest conditional factor joint(prev, name)/distinct(prev) observed
+// against the labels before it.
+func (c *CooccurrenceTracker) EstimateCombinations(names ...string) uint64 {
+	if len(names) == 0 {
+		return 0
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.estimateCombinations(names)
+}
+
+func (c *CooccurrenceTracker) estimateCombinations(names []string) uint64 {
+	estimate := float64(c.distinctValues(names[0]))
+	for i, name := range names[1:] {
+		// Without any pair statistics fall back to assuming independence.
+		factor := float64(c.distinctValues(name))
+		seen := false
+		for _, prev := range names[:i+1] {
+			distinct, joint := c.distinctValues(prev), c.jointDistinct(prev, name)
+			if distinct == 0 || joint == 0 {
+				continue
+			}
+			if f := float64(joint) / float64(distinct); !seen || f < factor {
+				factor = f
+				seen = true
+			}
+		}
+		estimate *= max(factor, 1)
+	}
+	return uint64(estimate)
+}
+
+// CombinationsCorrection returns the factor, at most 1, by which the number
+// of value combinations of names estimated assuming their labels independent
+// is corrected for their correlation. It is 1 unless the index tracks label
+// co-occurrence, see CooccurrenceIndex.
+func CombinationsCorrection(index CardinalityIndex, names ...string) float64 {
+	ci, ok := index.(CooccurrenceIndex)
+	if !ok || len(names) < 2 {
+		return 1
+	}
+	c := ci.Cooccurrence()
+	if c == nil {
+		return 1
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	independent := 1.0
+	for _, name := range names {
+		independent *= float64(max(c.distinctValues(name), 1))
+	}
+	if correlated := float64(c.estimateCombinations(names)); correlated > 0 && correlated < independent {
+		return correlated / independent
+	}
+	return 1
+}
@@ -0,0 +1,123 @@
+package cardinality
+
+import (
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// cuckooBucketSize is the number of fingerprints per bucket. With 16
+	// bit fingerprints, about 0.012% of the absent values are taken for
+	// present.
+	cuckooBucketSize = 4
+	// cuckooMaxKicks bounds the fingerprints moved by an insertion before
+	// the filter is considered full.
+	cuckooMaxKicks = 500
+)
+
+// cuckooFilter is a cuckoo filter of the values of a label, answering
+// whether a value is present with two bucket reads, without the symbol
+// table or the values of the label. Unlike a Bloom filter it supports
+// deleting values, so it follows the values as they are evicted. It is not
+// safe for concurrent use, the shard of the label guards it.
+type cuckooFilter struct {
+	// buckets has a power of two length, zero fingerprints are empty
+	// slots.
+	buckets [][cuckooBucketSize]uint16
+}
+
+func newCuckooFilter(values int) *cuckooFilter {
+	n := 1
+	for n*cuckooBucketSize < values*2 {
+		n *= 2
+	}
+	return &cuckooFilter{buckets: make([][cuckooBucketSize]uint16, max(n, 4))}
+}
+
+// locate returns the fingerprint of a value and its two candidate buckets.
+func (f *cuckooFilter) locate(value string) (uint16, uint64, uint64) {
+	hash := xxhash.Sum64String(value)
+	fp := uint16(hash >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i := hash & uint64(len(f.buckets)-1)
+	return fp, i, f.alternate(i, fp)
+}
+
+// alternate returns the other bucket of a fingerprint in bucket i.
+func (f *cuckooFilter) alternate(i uint64, fp uint16) uint64 {
+	return (i ^ uint64(fp)*0x5bd1e995) & uint64(len(f.buckets)-1)
+}
+
+// contains reports whether the value is probably in the filter. It is safe
+// to call on a nil filter, which contains every value.
+func (f *cuckooFilter) contains(value string) bool {
+	if f == nil {
+		return true
+	}
+	fp, i1, i2 := f.locate(value)
+	for _, slot := range f.buckets[i1] {
+		if slot == fp {
+			return true
+		}
+	}
+	for _, slot := range f.buckets[i2] {
+		if slot == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds the value to the filter, and returns false if the filter is
+// full, in which case it must be rebuilt larger.
+func (f *cuckooFilter) insert(value string) bool {
+	fp, i1, i2 := f.locate(value)
+	if f.place(i1, fp) || f.place(i2, fp) {
+		return true
+	}
+	// Evict fingerprints to their other bucket until one finds room.
+	i := i1
+	for kick := 0; kick < cuckooMaxKicks; kick++ {
+		slot := kick % cuckooBucketSize
+		fp, f.buckets[i][slot] = f.buckets[i][slot], fp
+		i = f.alternate(i, fp)
+		if f.place(i, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// place stores the fingerprint in a free slot of bucket i, if any.
+func (f *cuckooFilter) place(i uint64, fp uint16) bool {
+	for slot, v := range f.buckets[i] {
+		if v == 0 {
+			f.buckets[i][slot] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// delete removes a value that was inserted in the filter.
+func (f *cuckooFilter) delete(value string) {
+	fp, i1, i2 := f.locate(value)
+	for _, i := range [2]uint64{i1, i2} {
+		for slot, v := range f.buckets[i] {
+			if v == fp {
+				f.buckets[i][slot] = 0
+				return
+			}
+		}
+	}
+}
+
+// size returns the memory used by the filter in bytes. It is safe to call
+// on a nil filter.
+func (f *cuckooFilter) size() int64 {
+	if f == nil {
+		return 0
+	}
+	return int64(len(f.buckets) * cuckooBucketSize * 2)
+}
@@ -0,0 +1,221 @@
+package cardinality
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"slices"
+	"sync"
+)
+
+// ShardStats describes the shard of a label of a BitmapIndex.
+type ShardStats struct {
+	Label string `json:"label"`
+	// Values is estimated for bucketed labels.
+	Values int `json:"values"`
+	// Series is the number of series with the label.
+	Series   int64 `json:"series"`
+	Bucketed bool  `json:"bucketed,omitempty"`
+	// MemoryBytes counts the bitmaps of the shard, like IndexStats.
+	MemoryBytes int64 `json:"memory_bytes"`
+}
+
+// ShardStats returns the stats of the shard of every label, largest first.
+func (b *BitmapIndex) ShardStats() []ShardStats {
+	var shards []ShardStats
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		stats := ShardStats{
+			Label:       name,
+			Values:      len(s.values),
+			Series:      int64(s.present.GetCardinality()),
+			Bucketed:    s.bucketed != nil,
+			MemoryBytes: int64(s.present.GetSizeInBytes()) + s.presence.size(),
+		}
+		for _, v := range s.values {
+			if v.segment == nil {
+				stats.MemoryBytes += int64(v.postings.GetSizeInBytes())
+			}
+		}
+		if s.bucketed != nil {
+			stats.Values += s.bucketed.Values()
+			for _, bitmap := range s.bucketed.Buckets {
+				stats.MemoryBytes += int64(bitmap.GetSizeInBytes())
+			}
+		}
+		shards = append(shards, stats)
+	})
+	slices.SortStableFunc(shards, func(a, b ShardStats) int { return cmp.Compare(b.MemoryBytes, a.MemoryBytes) })
+	return shards
+}
+
+// BitmapStats describes the bitmap of a label value of a BitmapIndex.
+type BitmapStats struct {
+	Label  string `json:"label"`
+	Value  string `json:"value"`
+	Series int64  `json:"series"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// LargestBitmaps returns up to n of the bitmaps of label values taking the
+// most memory, largest first. Bucketed labels and values in the cold tier
+// have no bitmap of their own and are left out. Only the n largest bitmaps
+// are kept while walking the index.
+func (b *BitmapIndex) LargestBitmaps(n int) []BitmapStats {
+	if n <= 0 {
+		return nil
+	}
+	h := make(bitmapHeap, 0, n)
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				if v.segment != nil {
+					continue
+				}
+				bytes := int64(v.postings.GetSizeInBytes())
+				if len(h) == n && bytes < h[0].Bytes {
+					continue
+				}
+				stats := BitmapStats{
+					Label:  name,
+					Value:  str(id),
+					Series: int64(v.postings.GetCardinality()),
+					Bytes:  bytes,
+				}
+				switch {
+				case len(h) < n:
+					heap.Push(&h, stats)
+				case compareBitmaps(stats, h[0]) < 0:
+					h[0] = stats
+					heap.Fix(&h, 0)
+				}
+			}
+		})
+	})
+	slices.SortFunc(h, compareBitmaps)
+	return h
+}
+
+// compareBitmaps orders bitmaps largest first, then by label and value.
+func compareBitmaps(a, b BitmapStats) int {
+	return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Label, b.Label), cmp.Compare(a.Value, b.Value))
+}
+
+// bitmapHeap is a heap of bitmaps with the one ordered last by
+// compareBitmaps on top.
+type bitmapHeap []BitmapStats
+
+func (h bitmapHeap) Len() int           { return len(h) }
+func (h bitmapHeap) Less(i, j int) bool { return compareBitmaps(h[i], h[j]) > 0 }
+func (h bitmapHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *bitmapHeap) Push(x any)        { *h = append(*h, x.(BitmapStats)) }
+
+func (h *bitmapHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// MatcherCount is the number of queries of a matcher set seen by a
+// TrackingIndex. Queries of matcher sets seen after the tracker was full
+// are counted with the error of the set they replaced, so Count is an
+// upper bound off by at most Error.
+type MatcherCount struct {
+	Matchers string `json:"matchers"`
+	Count    int64  `json:"count"`
+	Error    int64  `json:"error,omitempty"`
+}
+
+// TrackingIndex counts the queries of the matcher sets of an index to find
+// the hottest ones, e.g. the selectors of a dashboard reloaded every few
+// seconds. It keeps up to capacity matcher sets, replacing the least
+// queried one once it is full, which keeps the frequent ones as long as
+// the capacity is larger than their number. It is safe for concurrent use
+// if the index is.
+type TrackingIndex struct {
+	index    CardinalityIndex
+	capacity int
+
+	mtx    sync.Mutex
+	counts map[string]*MatcherCount
+}
+
+// NewTrackingIndex returns an index tracking the queries of index.
+func NewTrackingIndex(index CardinalityIndex, capacity int) *TrackingIndex {
+	return &TrackingIndex{
+		index:    index,
+		capacity: max(capacity, 1),
+		counts:   make(map[string]*MatcherCount, capacity),
+	}
+}
+
+// Unwrap returns the tracked index.
+func (t *TrackingIndex) Unwrap() CardinalityIndex {
+	return t.index
+}
+
+func (t *TrackingIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	t.index.AddSeries(lbls, ref)
+}
+
+func (t *TrackingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return t.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (t *TrackingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	t.observe(matchers)
+	return GetCardinalityContext(ctx, t.index, matchers...)
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the
+// errors of the tracked index, see GetCardinalityChecked.
+func (t *TrackingIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	t.observe(matchers)
+	return GetCardinalityChecked(ctx, t.index, matchers...)
+}
+
+func (t *TrackingIndex) observe(matchers []*labels.Matcher) {
+	if checkMatchers(matchers) != nil {
+		return
+	}
+	key := "{" + matchersKey(matchers) + "}"
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if c, ok := t.counts[key]; ok {
+		c.Count++
+		return
+	}
+	if len(t.counts) < t.capacity {
+		t.counts[key] = &MatcherCount{Matchers: key, Count: 1}
+		return
+	}
+	var least *MatcherCount
+	for _, c := range t.counts {
+		if least == nil || c.Count < least.Count {
+			least = c
+		}
+	}
+	delete(t.counts, least.Matchers)
+	t.counts[key] = &MatcherCount{Matchers: key, Count: least.Count + 1, Error: least.Count}
+}
+
+// HotMatchers returns up to n of the most queried matcher sets, most
+// queried first.
+func (t *TrackingIndex) HotMatchers(n int) []MatcherCount {
+	t.mtx.Lock()
+	counts := make([]MatcherCount, 0, len(t.counts))
+	for _, c := range t.counts {
+		counts = append(counts, *c)
+	}
+	t.mtx.Unlock()
+	slices.SortFunc(counts, func(a, b MatcherCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Matchers, b.Matchers))
+	})
+	return counts[:min(n, len(counts))]
+}
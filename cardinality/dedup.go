@@ -0,0 +1,24 @@
+package cardinality
+
+// seriesSet tracks the label hashes of series that have already been added
+// to an index. A nil seriesSet treats every series as new.
+type seriesSet map[uint64]struct{}
+
+func newSeriesSet(enabled bool) seriesSet {
+	if !enabled {
+		return nil
+	}
+	return make(seriesSet)
+}
+
+// add records hash and reports whether it had not been seen before.
+func (s seriesSet) add(hash uint64) bool {
+	if s == nil {
+		return true
+	}
+	if _, ok := s[hash]; ok {
+		return false
+	}
+	s[hash] = struct{}{}
+	return true
+}
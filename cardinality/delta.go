@@ -0,0 +1,266 @@
+package cardinality
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/axiomhq/hyperminhash"
+	"harry671003/hello/cardinality/sketchcore"
+	"io"
+)
+
+// deltaVersion is the version of the format written by SketchDelta.WriteTo.
+// Deltas written before the format had a version start with 0 or 1, so
+// versions start at 2.
+const deltaVersion = 2
+
+// maxDeltaString bounds the label names and values read from a delta, so a
+// corrupted length can't allocate unbounded memory. maxDeltaBuckets bounds
+// the buckets of a label likewise.
+const (
+	maxDeltaString  = 1 << 20
+	maxDeltaBuckets = 1 << 16
+)
+
+// ErrSketchDeltaCorrupted is returned by ReadSketchDelta for malformed deltas.
+var ErrSketchDeltaCorrupted = errors.New("corrupted sketch delta")
+
+// SketchDelta holds the sketches of a HyperMinHashIndex that changed since
+// the previous export. Sketch merges are idempotent, so deltas can be
+// applied more than once and in any order.
+type SketchDelta struct {
+	all    *hyperminhash.Sketch
+	labels map[string]*labelDelta
+}
+
+// labelDelta holds the sketches of the values of a label, or all its
+// buckets if it is bucketed.
+type labelDelta struct {
+	present *hyperminhash.Sketch
+	values  map[string]*hyperminhash.Sketch
+	buckets *sketchcore.ValueBuckets[*hyperminhash.Sketch]
+}
+
+// Len returns the number of label value and bucket sketches in the delta.
+func (d *SketchDelta) Len() int {
+	n := 0
+	for _, l := range d.labels {
+		n += len(l.values)
+		if l.buckets != nil {
+			n += len(l.buckets.Buckets)
+		}
+	}
+	return n
+}
+
+// ExportDelta returns the sketches modified since the previous export, for
+// an index created WithDeltaTracking. Bucketed labels are exported with all
+// their buckets, since the values added to them aren't known.
+func (h *HyperMinHashIndex) ExportDelta() *SketchDelta {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	d := &SketchDelta{labels: make(map[string]*labelDelta, len(h.dirty)+len(h.dirtyBuckets))}
+	if len(h.dirty) == 0 && len(h.dirtyBuckets) == 0 {
+		return d
+	}
+
+	d.all = sketchcore.Clone(h.core.All())
+	for name, values := range h.dirty {
+		l := &labelDelta{
+			present: sketchcore.Clone(h.core.Present(name)),
+			values:  make(map[string]*hyperminhash.Sketch, len(values)),
+		}
+		for value := range values {
+			if hll, ok := h.core.Value(name, value); ok {
+				l.values[value] = sketchcore.Clone(hll)
+			}
+		}
+		d.labels[name] = l
+	}
+	for name := range h.dirtyBuckets {
+		buckets, _ := h.core.Buckets(name)
+		l := &labelDelta{
+			present: sketchcore.Clone(h.core.Present(name)),
+			buckets: &sketchcore.ValueBuckets[*hyperminhash.Sketch]{
+				Distinct: sketchcore.Clone(buckets.Distinct),
+				Buckets:  make([]*hyperminhash.Sketch, len(buckets.Buckets)),
+			},
+		}
+		for i, sk := range buckets.Buckets {
+			l.buckets.Buckets[i] = sketchcore.Clone(sk)
+		}
+		d.labels[name] = l
+	}
+	clear(h.dirty)
+	clear(h.dirtyBuckets)
+	return d
+}
+
+// ApplyDelta merges a delta exported by another index. Exact per value
+// statistics can't be merged, so they are dropped for the labels in the
+// delta and those labels are answered from the sketches. Labels bucketed
+// by the other index are bucketed by this one too, see
+// sketchcore.Index.MergeBuckets.
+func (h *HyperMinHashIndex) ApplyDelta(d *SketchDelta) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if d.all != nil {
+		h.core.MergeAll(d.all)
+	}
+	for name, l := range d.labels {
+		h.core.MergePresent(name, l.present)
+		if l.buckets != nil {
+			h.core.MergeBuckets(name, l.buckets)
+			h.strings.release(name)
+		}
+		for value, sk := range l.values {
+			name, value := h.intern(name, value)
+			h.core.MergeValue(name, value, sk)
+		}
+		delete(h.stats, name)
+	}
+}
+
+// WriteTo writes the delta in a binary format read by ReadSketchDelta.
+// Sketches are written in little-endian byte order, whatever the platform.
+func (d *SketchDelta) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	write := func(b []byte) {
+		m, _ := bw.Write(b)
+		n += int64(m)
+	}
+	writeUvarint := func(v int) {
+		write(binary.AppendUvarint(nil, uint64(v)))
+	}
+	writeString := func(s string) {
+		writeUvarint(len(s))
+		write([]byte(s))
+	}
+	buf := make([]byte, 0, sketchcore.SketchSize)
+	writeSketch := func(sk *hyperminhash.Sketch) {
+		buf = sketchcore.AppendSketch(buf[:0], sk)
+		write(buf)
+	}
+
+	write([]byte{deltaVersion})
+	if d.all == nil {
+		write([]byte{0})
+	} else {
+		write([]byte{1})
+		writeSketch(d.all)
+	}
+	writeUvarint(len(d.labels))
+	for name, l := range d.labels {
+		writeString(name)
+		writeSketch(l.present)
+		writeUvarint(len(l.values))
+		for value, sk := range l.values {
+			writeString(value)
+			writeSketch(sk)
+		}
+		// Labels that aren't bucketed have no buckets.
+		if l.buckets == nil {
+			writeUvarint(0)
+			continue
+		}
+		writeUvarint(len(l.buckets.Buckets))
+		writeSketch(l.buckets.Distinct)
+		for _, sk := range l.buckets.Buckets {
+			writeSketch(sk)
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadSketchDelta reads a delta written by SketchDelta.WriteTo.
+func ReadSketchDelta(r io.Reader) (*SketchDelta, error) {
+	br := bufio.NewReader(r)
+	readSketch := func() (*hyperminhash.Sketch, error) {
+		return sketchcore.ReadSketch(br)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		if n > maxDeltaString {
+			return "", fmt.Errorf("%w: string of %d bytes", ErrSketchDeltaCorrupted, n)
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != deltaVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSketchDeltaCorrupted, version)
+	}
+	d := &SketchDelta{labels: make(map[string]*labelDelta)}
+	hasAll, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch hasAll {
+	case 0:
+	case 1:
+		if d.all, err = readSketch(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: invalid sketch flag %d", ErrSketchDeltaCorrupted, hasAll)
+	}
+	numLabels, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numLabels; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		l := &labelDelta{values: make(map[string]*hyperminhash.Sketch)}
+		if l.present, err = readSketch(); err != nil {
+			return nil, err
+		}
+		numValues, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numValues; j++ {
+			value, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			if l.values[value], err = readSketch(); err != nil {
+				return nil, err
+			}
+		}
+		numBuckets, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if numBuckets > maxDeltaBuckets {
+			return nil, fmt.Errorf("%w: %d buckets", ErrSketchDeltaCorrupted, numBuckets)
+		}
+		if numBuckets > 0 {
+			l.buckets = &sketchcore.ValueBuckets[*hyperminhash.Sketch]{
+				Buckets: make([]*hyperminhash.Sketch, numBuckets),
+			}
+			if l.buckets.Distinct, err = readSketch(); err != nil {
+				return nil, err
+			}
+			for j := range l.buckets.Buckets {
+				if l.buckets.Buckets[j], err = readSketch(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		d.labels[name] = l
+	}
+	return d, nil
+}
@@ -0,0 +1,70 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+var (
+	// ErrUnknownLabel is returned for a matcher on a label no series of the
+	// index has, unless the matcher matches the series without the label.
+	// It usually points to a typo in the selector.
+	ErrUnknownLabel = errors.New("unknown label")
+	// ErrIndexClosed is returned when querying an index that was closed.
+	ErrIndexClosed = errors.New("index closed")
+	// ErrBudgetExceeded is returned when a query ran out of a budget. The
+	// errors of specific budgets, like ErrMemoryBudgetExceeded, wrap it.
+	ErrBudgetExceeded = errors.New("budget exceeded")
+	// ErrUnsupportedMatcher is returned for matchers an index can't
+	// evaluate.
+	ErrUnsupportedMatcher = errors.New("unsupported matcher")
+)
+
+// GetCardinalityChecked estimates the cardinality using index and returns
+// why it couldn't be estimated, see CardinalityIndex.
+func GetCardinalityChecked(ctx context.Context, index CardinalityIndex, matchers ...*labels.Matcher) (int64, error) {
+	return index.GetCardinalityChecked(ctx, matchers...)
+}
+
+// getCardinalityChecked checks the matchers, the labels they select if
+// known is not nil, and the query budget around an estimate of index. It
+// implements GetCardinalityChecked for the indexes with no errors of their
+// own.
+func getCardinalityChecked(ctx context.Context, index CardinalityIndex, known func(name string) bool, matchers []*labels.Matcher) (int64, error) {
+	if err := checkMatchers(matchers); err != nil {
+		return 0, err
+	}
+	if known != nil {
+		for _, m := range matchers {
+			if !known(m.Name) && !m.Matches("") {
+				return 0, fmt.Errorf("%w %q", ErrUnknownLabel, m.Name)
+			}
+		}
+	}
+	card := GetCardinalityContext(ctx, index, matchers...)
+	if q := QueryFromContext(ctx); q != nil && q.Err() != nil {
+		return 0, q.Err()
+	}
+	return card, nil
+}
+
+// checkMatchers returns ErrUnsupportedMatcher for matchers no index can
+// evaluate.
+func checkMatchers(matchers []*labels.Matcher) error {
+	for _, m := range matchers {
+		switch {
+		case m == nil:
+			return fmt.Errorf("%w: nil matcher", ErrUnsupportedMatcher)
+		case m.Name == "":
+			return fmt.Errorf("%w: %s has no label name", ErrUnsupportedMatcher, m)
+		}
+		switch m.Type {
+		case labels.MatchEqual, labels.MatchNotEqual, labels.MatchRegexp, labels.MatchNotRegexp:
+		default:
+			return fmt.Errorf("%w: match type %d", ErrUnsupportedMatcher, m.Type)
+		}
+	}
+	return nil
+}
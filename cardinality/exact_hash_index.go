@@ -0,0 +1,314 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hashSet is a set of series hashes. Hashes are appended unsorted and the
+// set is sorted and deduplicated lazily when it is read, or once it has
+// doubled since it was last compacted, so that series added over and over,
+// as by remote write, don't grow it without bound.
+type hashSet struct {
+	hashes []uint64
+	dirty  bool
+	// compacted is the number of hashes after the last compaction.
+	compacted int
+}
+
+// minHashSetCompaction is the number of hashes below which a set isn't
+// compacted on add.
+const minHashSetCompaction = 8
+
+func (s *hashSet) add(hash uint64) {
+	s.hashes = append(s.hashes, hash)
+	s.dirty = true
+	if len(s.hashes) >= 2*max(s.compacted, minHashSetCompaction) {
+		s.compact()
+	}
+}
+
+func (s *hashSet) sorted() []uint64 {
+	if s.dirty {
+		s.compact()
+	}
+	return s.hashes
+}
+
+func (s *hashSet) compact() {
+	slices.Sort(s.hashes)
+	s.hashes = slices.Clip(slices.Compact(s.hashes))
+	s.compacted = len(s.hashes)
+	s.dirty = false
+}
+
+// ExactHashIndex stores the sorted, deduplicated 64-bit label set hashes of
+// the series of every label value. It is exact up to hash collisions like the
+// BitmapIndex, but doesn't need series refs, which makes it usable for
+// ingestion paths like remote write where refs aren't available. It uses more
+// memory than bitmaps for dense ref spaces. The index is safe for concurrent
+// use.
+type ExactHashIndex struct {
+	// mtx serializes queries as well as writes, since queries compact the
+	// hash sets they read in place.
+	mtx   sync.Mutex
+	index map[string]map[string]*hashSet
+	// all holds every series, to select the series without a label for
+	// matchers that match "".
+	all *hashSet
+
+	lastUpdate time.Time
+}
+
+func NewExactHashIndex() *ExactHashIndex {
+	return &ExactHashIndex{
+		index: make(map[string]map[string]*hashSet),
+		all:   &hashSet{},
+	}
+}
+
+// AddSeries adds a series to the index. The ref is ignored.
+func (e *ExactHashIndex) AddSeries(lbls labels.Labels, _ storage.SeriesRef) {
+	hash := lbls.Hash()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.all.add(hash)
+	e.lastUpdate = time.Now()
+	for _, l := range lbls {
+		valueMap, ok := e.index[l.Name]
+		if !ok {
+			valueMap = make(map[string]*hashSet)
+			e.index[l.Name] = valueMap
+		}
+
+		set, ok := valueMap[l.Value]
+		if !ok {
+			set = &hashSet{}
+			valueMap[l.Value] = set
+		}
+		set.add(hash)
+	}
+}
+
+func (e *ExactHashIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	if len(matchers) == 0 {
+		return 0
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return int64(len(e.getIntersection(matchers)))
+}
+
+// GetCardinalityChecked is like GetCardinality but checks the matchers and
+// the budget of the QueryContext of ctx.
+func (e *ExactHashIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, e, nil, matchers)
+}
+
+// Stats returns the size of the index. Memory counts the hashes, including
+// duplicates not yet compacted.
+func (e *ExactHashIndex) Stats() IndexStats {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	stats := IndexStats{
+		LabelNames:  len(e.index),
+		Series:      int64(len(e.all.sorted())),
+		MemoryBytes: int64(cap(e.all.hashes)) * 8,
+		LastUpdate:  e.lastUpdate,
+	}
+	stats.SeriesAdded = stats.Series
+	for name, valueMap := range e.index {
+		stats.LabelValues += len(valueMap)
+		stats.MemoryBytes += int64(len(name))
+		for value, set := range valueMap {
+			stats.MemoryBytes += int64(len(value)) + int64(cap(set.hashes))*8
+		}
+	}
+	return stats
+}
+
+func (e *ExactHashIndex) LabelNames(matchers ...*labels.Matcher) []string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var intersection []uint64
+	if len(matchers) > 0 {
+		if intersection = e.getIntersection(matchers); len(intersection) == 0 {
+			return nil
+		}
+	}
+
+	var names []string
+	for name, valueMap := range e.index {
+		for _, set := range valueMap {
+			if len(matchers) == 0 || intersects(set.sorted(), intersection) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (e *ExactHashIndex) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var intersection []uint64
+	if len(matchers) > 0 {
+		if intersection = e.getIntersection(matchers); len(intersection) == 0 {
+			return nil
+		}
+	}
+
+	var values []string
+	for value, set := range e.index[name] {
+		if len(matchers) == 0 || intersects(set.sorted(), intersection) {
+			values = append(values, value)
+		}
+	}
+	slices.Sort(values)
+	return values
+}
+
+func (e *ExactHashIndex) getIntersection(matchers []*labels.Matcher) []uint64 {
+	// Intersect the smallest sets first, so that every step is a galloping
+	// search of a small set into a larger one.
+	sets := make([][]uint64, 0, len(matchers))
+	for _, matcher := range matchers {
+		set := e.getUnionForMatcher(matcher)
+		if len(set) == 0 {
+			return nil
+		}
+		sets = append(sets, set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	intersection := sets[0]
+	for _, set := range sets[1:] {
+		intersection = gallopingIntersect(intersection, set)
+		if len(intersection) == 0 {
+			return nil
+		}
+	}
+	return intersection
+}
+
+func (e *ExactHashIndex) getUnionForMatcher(matcher *labels.Matcher) []uint64 {
+	valueMap := e.index[matcher.Name]
+
+	// As in PromQL, a matcher that matches the empty string also selects the
+	// series without the label, which are all series but those with a
+	// value that doesn't match.
+	if matcher.Matches("") {
+		var notMatching [][]uint64
+		for value, set := range valueMap {
+			if !matcher.Matches(value) {
+				notMatching = append(notMatching, set.sorted())
+			}
+		}
+		excluded := slices.Concat(notMatching...)
+		slices.Sort(excluded)
+		return difference(e.all.sorted(), excluded)
+	}
+
+	if matcher.Type == labels.MatchEqual {
+		if set, ok := valueMap[matcher.Value]; ok {
+			return set.sorted()
+		}
+		return nil
+	}
+
+	var matching [][]uint64
+	for value, set := range valueMap {
+		if matcher.Matches(value) {
+			matching = append(matching, set.sorted())
+		}
+	}
+	if len(matching) == 1 {
+		return matching[0]
+	}
+
+	// A series has a single value per label, so the sets of different
+	// values are disjoint and don't need deduplication.
+	union := slices.Concat(matching...)
+	slices.Sort(union)
+	return union
+}
+
+// gallopingIntersect returns the intersection of two sorted slices. Every
+// element of small is searched in large with an exponential search starting
+// from the previous match, which is much faster than a linear merge when the
+// sizes differ a lot.
+func gallopingIntersect(small, large []uint64) []uint64 {
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+
+	result := make([]uint64, 0, len(small))
+	lo := 0
+	for _, v := range small {
+		// Gallop to find a range [lo, hi) containing v.
+		step := 1
+		hi := lo
+		for hi < len(large) && large[hi] < v {
+			lo = hi
+			hi += step
+			step *= 2
+		}
+		hi = min(hi+1, len(large))
+
+		i, found := slices.BinarySearch(large[lo:hi], v)
+		lo += i
+		if found {
+			result = append(result, v)
+			lo++
+		}
+		if lo >= len(large) {
+			break
+		}
+	}
+	return result
+}
+
+// difference returns the elements of the sorted slice a that are not in the
+// sorted slice b.
+func difference(a, b []uint64) []uint64 {
+	if len(b) == 0 {
+		return a
+	}
+	result := make([]uint64, 0, len(a))
+	j := 0
+	for _, v := range a {
+		for j < len(b) && b[j] < v {
+			j++
+		}
+		if j == len(b) || b[j] != v {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// intersects reports whether two sorted slices share an element.
+func intersects(a, b []uint64) bool {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			return true
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return false
+}
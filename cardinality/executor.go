@@ -0,0 +1,376 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExecutorStats describes the load of an Executor.
+type ExecutorStats struct {
+	Workers int `json:"workers"`
+	// Queued is the number of estimates waiting for a worker, and Busy the
+	// number of workers running one.
+	Queued int64 `json:"queued"`
+	Busy   int64 `json:"busy"`
+	// Estimates counts the estimates run, and BusySeconds the time the
+	// workers spent running them.
+	Estimates   int64   `json:"estimates"`
+	BusySeconds float64 `json:"busy_seconds"`
+}
+
+// Saturation returns the share of the workers that are busy, from 0 to 1.
+func (s ExecutorStats) Saturation() float64 {
+	if s.Workers == 0 {
+		return 0
+	}
+	return float64(s.Busy) / float64(s.Workers)
+}
+
+// ErrExecutorStopped is returned by the estimates of an Executor whose
+// workers aren't running.
+var ErrExecutorStopped = errors.New("executor stopped")
+
+// executorTask is an estimate waiting for or run by a worker.
+type executorTask struct {
+	ctx      context.Context
+	budget   *queryBudget
+	matchers []*labels.Matcher
+	series   int64
+	err      error
+	done     chan struct{}
+}
+
+// queryBudget is the memory budget of a query, shared by the estimates of
+// its selectors. They run concurrently, so they each get a QueryContext
+// with the budget left, and merge their usage back.
+type queryBudget struct {
+	maxBytes int64
+	limits   QueryLimits
+
+	mtx       sync.Mutex
+	used      int64
+	truncated bool
+	err       error
+}
+
+// newQueryBudget returns the budget of the query of ctx, or nil if it has
+// no QueryContext.
+func newQueryBudget(ctx context.Context) *queryBudget {
+	parent := QueryFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	return &queryBudget{maxBytes: parent.maxBytes, limits: parent.limits}
+}
+
+// acquire returns a QueryContext for an estimate, limited to the budget
+// left, or an error if none is.
+func (b *queryBudget) acquire() (*QueryContext, error) {
+	if b == nil {
+		return AcquireQueryContext(0), nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.maxBytes > 0 && b.used >= b.maxBytes {
+		return nil, fmt.Errorf("%w: used %d bytes, budget is %d", ErrMemoryBudgetExceeded, b.used, b.maxBytes)
+	}
+	q := AcquireQueryContext(b.maxBytes - b.used)
+	q.SetLimits(b.limits)
+	return q, nil
+}
+
+// release merges the usage of an estimate and releases its QueryContext.
+// Concurrent estimates may each use the budget left when they started, so
+// the query fails if together they used more.
+func (b *queryBudget) release(q *QueryContext) {
+	if b != nil {
+		b.mtx.Lock()
+		b.used += q.used
+		b.truncated = b.truncated || q.Truncated()
+		switch {
+		case b.err != nil:
+		case q.Err() != nil:
+			b.err = q.Err()
+		case b.maxBytes > 0 && b.used > b.maxBytes:
+			b.err = fmt.Errorf("%w: used %d bytes, budget is %d", ErrMemoryBudgetExceeded, b.used, b.maxBytes)
+		}
+		b.mtx.Unlock()
+	}
+	q.Release()
+}
+
+// report sets the usage, truncation and error of the query on its
+// QueryContext, and returns the error.
+func (b *queryBudget) report(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	parent := QueryFromContext(ctx)
+	parent.begin()
+	parent.used, parent.truncated, parent.err = b.used, b.truncated, b.err
+	return b.err
+}
+
+// Executor runs the estimates of an index on a bounded pool of workers, so
+// that dozens of concurrent heavy queries, like broad regexes, queue up
+// instead of saturating all cores. The selectors of a query passed to
+// Estimate run concurrently, up to a per-query limit, so that a query with
+// many selectors doesn't hold every worker either. The workers run in Run.
+// Load is exported as metrics, the Executor being a prometheus.Collector.
+type Executor struct {
+	index    CardinalityIndex
+	workers  int
+	perQuery int
+	tasks    chan *executorTask
+
+	// stopped is closed when the workers of Run stop, and while none run.
+	runMtx  sync.Mutex
+	running int
+	stopped chan struct{}
+
+	queued    atomic.Int64
+	busy      atomic.Int64
+	estimates atomic.Int64
+	busyNanos atomic.Int64
+}
+
+// NewExecutor returns an executor running the estimates of index on the
+// given number of workers, at most perQuery of them for the selectors of a
+// single query. Zero workers use GOMAXPROCS, and zero perQuery all of them.
+// The workers query index concurrently, so it must be safe for concurrent
+// use, like the BitmapIndex, the ExactHashIndex and the HyperMinHashIndex.
+func NewExecutor(index CardinalityIndex, workers, perQuery int) *Executor {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if perQuery <= 0 || perQuery > workers {
+		perQuery = workers
+	}
+	stopped := make(chan struct{})
+	close(stopped)
+	return &Executor{
+		index:    index,
+		workers:  workers,
+		perQuery: perQuery,
+		tasks:    make(chan *executorTask),
+		stopped:  stopped,
+	}
+}
+
+// Run runs the workers until ctx is done. Estimates submitted while no
+// workers run fail with ErrExecutorStopped.
+func (e *Executor) Run(ctx context.Context) {
+	e.runMtx.Lock()
+	if e.running == 0 {
+		e.stopped = make(chan struct{})
+	}
+	e.running++
+	e.runMtx.Unlock()
+	defer func() {
+		e.runMtx.Lock()
+		if e.running--; e.running == 0 {
+			close(e.stopped)
+		}
+		e.runMtx.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case t := <-e.tasks:
+					e.queued.Add(-1)
+					e.execute(t)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// execute runs an estimate on the calling worker.
+func (e *Executor) execute(t *executorTask) {
+	defer close(t.done)
+	if err := t.ctx.Err(); err != nil {
+		t.err = err
+		return
+	}
+
+	// Estimates of the same query run concurrently, so they can't share
+	// its QueryContext, only its budget and limits.
+	q, err := t.budget.acquire()
+	if err != nil {
+		t.err = err
+		return
+	}
+
+	e.busy.Add(1)
+	start := time.Now()
+	t.series, t.err = GetCardinalityChecked(ContextWithQuery(t.ctx, q), e.index, t.matchers...)
+	t.budget.release(q)
+	e.busyNanos.Add(int64(time.Since(start)))
+	e.busy.Add(-1)
+	e.estimates.Add(1)
+}
+
+// submit queues an estimate and waits for its answer, or for ctx to be
+// done. It fails with ErrExecutorStopped if the workers don't run.
+func (e *Executor) submit(ctx context.Context, budget *queryBudget, matchers []*labels.Matcher) (int64, error) {
+	e.runMtx.Lock()
+	stopped := e.stopped
+	e.runMtx.Unlock()
+
+	t := &executorTask{ctx: ctx, budget: budget, matchers: matchers, done: make(chan struct{})}
+	e.queued.Add(1)
+	select {
+	case e.tasks <- t:
+	case <-stopped:
+		e.queued.Add(-1)
+		return 0, ErrExecutorStopped
+	case <-ctx.Done():
+		e.queued.Add(-1)
+		return 0, ctx.Err()
+	}
+
+	select {
+	case <-t.done:
+		return t.series, t.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Estimate estimates the cardinality of every selector of a query, like the
+// selectors of a PromQL expression, running up to the per-query limit of
+// them at a time. It returns the first error, in the order of the
+// selectors, like GetCardinalityChecked, or the error of ctx if it is done
+// before the estimates ran. The selectors share the budget of the
+// QueryContext of ctx, which reports the memory they used together and
+// whether any was truncated.
+func (e *Executor) Estimate(ctx context.Context, selectors ...[]*labels.Matcher) ([]int64, error) {
+	budget := newQueryBudget(ctx)
+	series := make([]int64, len(selectors))
+	errs := make([]error, len(selectors))
+	sem := make(chan struct{}, e.perQuery)
+	var wg sync.WaitGroup
+	for i, matchers := range selectors {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+		if errs[i] != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			series[i], errs[i] = e.submit(ctx, budget, matchers)
+		}()
+	}
+	wg.Wait()
+
+	budgetErr := budget.report(ctx)
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if budgetErr != nil {
+		return nil, budgetErr
+	}
+	return series, nil
+}
+
+func (e *Executor) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	e.index.AddSeries(lbls, ref)
+}
+
+func (e *Executor) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return e.GetCardinalityContext(context.Background(), matchers...)
+}
+
+// GetCardinalityContext runs the estimate on a worker, answering 0 if it
+// fails.
+func (e *Executor) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	series, _ := e.GetCardinalityChecked(ctx, matchers...)
+	return series
+}
+
+// GetCardinalityChecked runs the estimate on a worker and returns its error,
+// or the error of ctx if it is done first. Its usage is reported on the
+// QueryContext of ctx.
+func (e *Executor) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	budget := newQueryBudget(ctx)
+	series, err := e.submit(ctx, budget, matchers)
+	if budgetErr := budget.report(ctx); err == nil && budgetErr != nil {
+		return 0, budgetErr
+	}
+	return series, err
+}
+
+// Stats returns the load of the executor.
+func (e *Executor) Stats() ExecutorStats {
+	return ExecutorStats{
+		Workers:     e.workers,
+		Queued:      e.queued.Load(),
+		Busy:        e.busy.Load(),
+		Estimates:   e.estimates.Load(),
+		BusySeconds: time.Duration(e.busyNanos.Load()).Seconds(),
+	}
+}
+
+var (
+	executorWorkersDesc = prometheus.NewDesc("cardinality_executor_workers",
+		"Workers of the executor.", nil, nil)
+	executorQueueLengthDesc = prometheus.NewDesc("cardinality_executor_queue_length",
+		"Estimates waiting for a worker.", nil, nil)
+	executorBusyWorkersDesc = prometheus.NewDesc("cardinality_executor_busy_workers",
+		"Workers running an estimate.", nil, nil)
+	executorSaturationDesc = prometheus.NewDesc("cardinality_executor_saturation",
+		"Share of the workers running an estimate.", nil, nil)
+	executorEstimatesDesc = prometheus.NewDesc("cardinality_executor_estimates_total",
+		"Estimates run by the workers.", nil, nil)
+	executorBusySecondsDesc = prometheus.NewDesc("cardinality_executor_busy_seconds_total",
+		"Time the workers spent running estimates.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (e *Executor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- executorWorkersDesc
+	ch <- executorQueueLengthDesc
+	ch <- executorBusyWorkersDesc
+	ch <- executorSaturationDesc
+	ch <- executorEstimatesDesc
+	ch <- executorBusySecondsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (e *Executor) Collect(ch chan<- prometheus.Metric) {
+	stats := e.Stats()
+	ch <- prometheus.MustNewConstMetric(executorWorkersDesc, prometheus.GaugeValue, float64(stats.Workers))
+	ch <- prometheus.MustNewConstMetric(executorQueueLengthDesc, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(executorBusyWorkersDesc, prometheus.GaugeValue, float64(stats.Busy))
+	ch <- prometheus.MustNewConstMetric(executorSaturationDesc, prometheus.GaugeValue, stats.Saturation())
+	ch <- prometheus.MustNewConstMetric(executorEstimatesDesc, prometheus.CounterValue, float64(stats.Estimates))
+	ch <- prometheus.MustNewConstMetric(executorBusySecondsDesc, prometheus.CounterValue, stats.BusySeconds)
+}
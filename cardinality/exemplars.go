@@ -0,0 +1,121 @@
+package cardinality
+
+import (
+	"cmp"
+	"github.com/prometheus/prometheus/model/labels"
+	"slices"
+	"strings"
+)
+
+// ExemplarLabelPrefix prefixes the names of the exemplar labels in the
+// series of an ExemplarIndex.
+const ExemplarLabelPrefix = "__exemplar_"
+
+// ExemplarIndex tracks the labels of the exemplars of series, e.g. trace_id,
+// apart from the series themselves: exemplar storage has a cost of its own,
+// and a label with a value per request blows it up without adding series.
+// Every exemplar is indexed as a series of the labels of its series and its
+// own labels, prefixed with ExemplarLabelPrefix, so that the distinct
+// exemplar label sets of any selector can be counted. Values of exemplar
+// labels are often unique, so the index should be created WithValueTTL and
+// evicted regularly, like exemplar storage drops the oldest exemplars.
+type ExemplarIndex struct {
+	index *BitmapIndex
+}
+
+// NewExemplarIndex returns an exemplar index. The options are those of the
+// underlying BitmapIndex, which assigns its own refs.
+func NewExemplarIndex(opts ...Option) *ExemplarIndex {
+	return &ExemplarIndex{index: NewBitmapIndex(append(opts, WithAllocatedRefs())...)}
+}
+
+// AddExemplar adds an exemplar with the labels of exemplar to the series.
+func (e *ExemplarIndex) AddExemplar(series, exemplar labels.Labels) {
+	b := labels.NewBuilder(series)
+	exemplar.Range(func(l labels.Label) {
+		b.Set(ExemplarLabelPrefix+l.Name, l.Value)
+	})
+	e.index.AddSeries(b.Labels(), 0)
+}
+
+// GetCardinality returns the distinct exemplar label sets of the series
+// selected by the matchers. Matchers on exemplar labels use their prefixed
+// names, e.g. {__name__="http_request_duration_seconds_bucket",
+// __exemplar_trace_id!=""}.
+func (e *ExemplarIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return e.index.GetCardinality(matchers...)
+}
+
+// EvictStale drops the exemplars whose label values weren't added within
+// the TTL of the index, see BitmapIndex.EvictStale.
+func (e *ExemplarIndex) EvictStale() int {
+	return e.index.EvictStale()
+}
+
+// Index returns the underlying index, e.g. to serve it with the API
+// handlers of the series.
+func (e *ExemplarIndex) Index() *BitmapIndex {
+	return e.index
+}
+
+// ExemplarLabelStats describes an exemplar label.
+type ExemplarLabelStats struct {
+	Label string `json:"label"`
+	// Values counts the distinct values of the label, and Exemplars the
+	// distinct exemplar label sets with the label.
+	Values    int   `json:"values"`
+	Exemplars int64 `json:"exemplars"`
+	// Metrics are the metrics with the most values of the label.
+	Metrics []ExemplarMetricStats `json:"metrics"`
+}
+
+// ExemplarMetricStats describes an exemplar label of a metric.
+type ExemplarMetricStats struct {
+	Metric    string `json:"metric"`
+	Values    int    `json:"values"`
+	Exemplars int64  `json:"exemplars"`
+}
+
+// LabelStats returns the stats of every exemplar label, most values first,
+// with up to n of their metrics.
+func (e *ExemplarIndex) LabelStats(n int) []ExemplarLabelStats {
+	var stats []ExemplarLabelStats
+	for _, name := range e.index.LabelNames() {
+		label, ok := strings.CutPrefix(name, ExemplarLabelPrefix)
+		if !ok {
+			continue
+		}
+		present := labels.MustNewMatcher(labels.MatchNotEqual, name, "")
+		s := ExemplarLabelStats{
+			Label:     label,
+			Values:    len(e.index.LabelValues(name)),
+			Exemplars: e.index.GetCardinality(present),
+			Metrics:   []ExemplarMetricStats{},
+		}
+		for _, metric := range e.index.LabelValues(labels.MetricName, present) {
+			m := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metric)
+			s.Metrics = append(s.Metrics, ExemplarMetricStats{
+				Metric:    metric,
+				Values:    len(e.index.LabelValues(name, m)),
+				Exemplars: e.index.GetCardinality(m, present),
+			})
+		}
+		slices.SortFunc(s.Metrics, func(a, b ExemplarMetricStats) int {
+			return cmp.Or(cmp.Compare(b.Values, a.Values), cmp.Compare(a.Metric, b.Metric))
+		})
+		s.Metrics = s.Metrics[:min(n, len(s.Metrics))]
+		stats = append(stats, s)
+	}
+	slices.SortFunc(stats, func(a, b ExemplarLabelStats) int {
+		return cmp.Or(cmp.Compare(b.Values, a.Values), cmp.Compare(a.Label, b.Label))
+	})
+	return stats
+}
+
+// SetExemplarIndex makes the ingester add the exemplars of the series it
+// ingests to e, in the exposition formats that have them and remote write.
+func (i *Ingester) SetExemplarIndex(e *ExemplarIndex) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.exemplars = e
+}
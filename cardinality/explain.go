@@ -0,0 +1,60 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality/sketchcore"
+)
+
+// ExplainSource is what answered an estimate.
+type ExplainSource string
+
+const (
+	// ExplainEmpty means the matchers select no series, e.g. because they
+	// contradict each other or select an unknown metric.
+	ExplainEmpty ExplainSource = "empty"
+	// ExplainExact means the series were counted exactly, by the counters of
+	// a label value, metric or label pair.
+	ExplainExact ExplainSource = "exact"
+	// ExplainSketches means the sketches of the label values were combined.
+	ExplainSketches ExplainSource = "sketches"
+	// ExplainMetricSketches means the sketches of the metric were combined,
+	// see WithMetricNameIndex.
+	ExplainMetricSketches ExplainSource = "metric_sketches"
+	// ExplainPairSketches means the sketch of a label pair was combined with
+	// the sketches of the other matchers, see WithLabelPairs.
+	ExplainPairSketches ExplainSource = "pair_sketches"
+)
+
+// Explanation describes how an index estimated the series of matchers.
+type Explanation struct {
+	// Matchers are the matchers the estimate was made of, once simplified
+	// and without the matchers implied by others.
+	Matchers []string      `json:"matchers"`
+	Source   ExplainSource `json:"source"`
+	// Plan is the strategy chosen to combine the sketches, if any were.
+	Plan   *sketchcore.Plan `json:"plan,omitempty"`
+	Series int64            `json:"series"`
+}
+
+func (e *Explanation) source(source ExplainSource, matchers []*labels.Matcher) {
+	if e == nil {
+		return
+	}
+	e.Source = source
+	e.Matchers = make([]string, len(matchers))
+	for i, m := range matchers {
+		e.Matchers[i] = m.String()
+	}
+}
+
+// Explain estimates the series of the matchers like GetCardinality, and
+// returns how: whether the series were counted exactly, and which strategy
+// combined the sketches otherwise.
+func (h *HyperMinHashIndex) Explain(matchers ...*labels.Matcher) Explanation {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	var e Explanation
+	e.Series = h.estimate(context.Background(), matchers, &e)
+	return e
+}
@@ -0,0 +1,121 @@
+package cardinality
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"io"
+	"time"
+)
+
+// IngestExposition adds the series of a scrape, e.g. a curl of the /metrics
+// endpoint of a new exporter, to estimate its cardinality before deploying
+// it. The format is told by contentType, the Content-Type of the scrape:
+// the Prometheus text format, OpenMetrics or protobuf. An empty content
+// type selects OpenMetrics for bodies ending with "# EOF", and the
+// Prometheus text format otherwise. The series are added as exposed,
+// without the target labels like job and instance. Every sample counts as
+// a line in the stats. Parsing stops at the first malformed line, which is
+// counted as invalid and returned wrapping ErrInvalidLine. Indexes
+// implementing TypedIndex get the type of the series, native histograms
+// being only exposed in the protobuf format, and indexes implementing
+// ActiveSeriesIndex their samples, at the time of the scrape unless the
+// samples have timestamps.
+func (i *Ingester) IngestExposition(r io.Reader, contentType string) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "text/plain"
+		if bytes.HasSuffix(bytes.TrimSpace(b), []byte("# EOF")) {
+			contentType = "application/openmetrics-text"
+		}
+	}
+	p, err := textparse.New(b, contentType, "", true, true, labels.NewSymbolTable())
+	if p == nil {
+		return fmt.Errorf("unsupported content type %q: %w", contentType, err)
+	}
+
+	var (
+		lbls labels.Labels
+		e    exemplar.Exemplar
+		ts   *int64
+	)
+	now := time.Now().UnixMilli()
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			i.mtx.Lock()
+			i.stats.Lines++
+			i.stats.Invalid++
+			i.mtx.Unlock()
+			return fmt.Errorf("%w: %w", ErrInvalidLine, err)
+		}
+		if entry != textparse.EntrySeries && entry != textparse.EntryHistogram {
+			continue
+		}
+		p.Metric(&lbls)
+		// The protobuf format has an exemplar per bucket, read until
+		// Exemplar returns false.
+		var exemplars []labels.Labels
+		for p.Exemplar(&e) {
+			exemplars = append(exemplars, e.Labels)
+			e = exemplar.Exemplar{}
+		}
+		info := SeriesInfo{Exemplars: len(exemplars) > 0}
+		if entry == textparse.EntryHistogram {
+			var h *histogram.Histogram
+			var fh *histogram.FloatHistogram
+			_, ts, h, fh = p.Histogram()
+			info.Type, info.Buckets = SeriesTypeHistogram, histogramBuckets(h, fh)
+		} else {
+			_, ts, _ = p.Series()
+		}
+		t := now
+		if ts != nil {
+			t = *ts
+		}
+		i.addSeries(lbls, info, t, exemplars)
+	}
+}
+
+// addSeries adds a series scraped as is with a sample at t and the labels
+// of its exemplars, counting it as a line.
+func (i *Ingester) addSeries(lbls labels.Labels, info SeriesInfo, t int64, exemplars []labels.Labels) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.stats.Lines++
+	if i.exemplars != nil {
+		for _, e := range exemplars {
+			i.exemplars.AddExemplar(lbls, e)
+		}
+		i.stats.Exemplars += int64(len(exemplars))
+	}
+	ref, ok := i.refs.ref(lbls)
+	if ok {
+		i.stats.Series++
+	}
+
+	// Known series are re-added, their type and latest sample may have
+	// changed.
+	lbls = lbls.Copy()
+	ti, typed := i.index.(TypedIndex)
+	ai, active := i.index.(ActiveSeriesIndex)
+	switch {
+	case typed:
+		ti.AddTypedSeries(lbls, ref, info)
+	case ok && !active:
+		i.index.AddSeries(lbls, ref)
+	}
+	if active {
+		ai.AddSeriesSample(lbls, ref, t)
+	}
+}
@@ -0,0 +1,248 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FederationMerge is how a FederatedIndex combines the answers of its
+// zones.
+type FederationMerge int
+
+const (
+	// MergeReplicas is for zones holding replicas of the same series, like
+	// the zones of Mimir ingesters with zone-aware replication. The estimate
+	// is the largest answer, which tolerates zones that lag behind or fail.
+	MergeReplicas FederationMerge = iota
+	// MergeShards is for zones holding disjoint series, like servers each
+	// owning a range of a hash ring. The estimate is the sum of the answers,
+	// so every zone must answer. Series held by several zones are counted
+	// once per zone.
+	MergeShards
+	// MergeSketches is for zones holding overlapping series, like servers
+	// whose series move between them. The zones send the deltas of their
+	// sketches, merged with Sync, and the estimate is the size of the
+	// union, counting series held by several zones once.
+	MergeSketches
+)
+
+func (m FederationMerge) String() string {
+	switch m {
+	case MergeReplicas:
+		return "replicas"
+	case MergeShards:
+		return "shards"
+	case MergeSketches:
+		return "sketches"
+	default:
+		return "unknown"
+	}
+}
+
+// Zone is a named index of a FederatedIndex, usually a RemoteIndex calling
+// the cardinality server of an ingester zone. Zones merged with
+// MergeSketches need Deltas, returning the sketches modified since the
+// previous call, like HyperMinHashIndex.ExportDelta, and their Index is
+// only queried for the answers of the zones, if set.
+type Zone struct {
+	Name   string
+	Index  CardinalityIndex
+	Deltas func(ctx context.Context) (*SketchDelta, error)
+}
+
+// ZoneCardinality is the answer of a zone to a federated query.
+type ZoneCardinality struct {
+	Zone     string        `json:"zone"`
+	Series   int64         `json:"series"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// FederatedCardinality is the global estimate of a federated query, with
+// the answers of every zone in the order of the zones. Partial reports an
+// estimate missing the series of zones that failed.
+type FederatedCardinality struct {
+	Series  int64             `json:"series"`
+	Partial bool              `json:"partial,omitempty"`
+	Zones   []ZoneCardinality `json:"zones"`
+}
+
+// FederatedIndex scatters queries to the indexes of several zones in
+// parallel and gathers their answers into a global estimate. Series are
+// added by the zones themselves.
+//
+// With MergeReplicas and MergeShards, zones answer with estimates, which
+// are combined as scalars: the union of series held by several zones isn't
+// deduplicated, only bounded by the largest answer or the sum. With
+// MergeSketches, the sketches of the zones are merged into a
+// HyperMinHashIndex, which answers for the union.
+type FederatedIndex struct {
+	zones []Zone
+	merge FederationMerge
+
+	// mtx guards the merged sketches of the zones and the errors of their
+	// last Sync.
+	mtx      sync.Mutex
+	union    *HyperMinHashIndex
+	syncErrs []error
+
+	errors atomic.Int64
+}
+
+// NewFederatedIndex returns an index merging the answers of the zones with
+// merge. Zones merged with MergeSketches must have Deltas.
+func NewFederatedIndex(merge FederationMerge, zones ...Zone) (*FederatedIndex, error) {
+	f := &FederatedIndex{zones: zones, merge: merge}
+	if merge == MergeSketches {
+		for _, zone := range zones {
+			if zone.Deltas == nil {
+				return nil, fmt.Errorf("zone %s has no sketch deltas", zone.Name)
+			}
+		}
+		f.union = NewHyperMinHashIndex()
+		f.syncErrs = make([]error, len(zones))
+	}
+	return f, nil
+}
+
+// Sync merges the sketch deltas of every zone, with MergeSketches, and
+// returns the errors of the zones that failed. Their series are missing
+// from the estimates, marked partial, until they sync again.
+func (f *FederatedIndex) Sync(ctx context.Context) error {
+	if f.merge != MergeSketches {
+		return nil
+	}
+	deltas := make([]*SketchDelta, len(f.zones))
+	errs := make([]error, len(f.zones))
+	var wg sync.WaitGroup
+	for i, zone := range f.zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deltas[i], errs[i] = zone.Deltas(ctx)
+		}()
+	}
+	wg.Wait()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var failed []error
+	for i, err := range errs {
+		f.syncErrs[i] = err
+		if err != nil {
+			failed = append(failed, fmt.Errorf("zone %s: %w", f.zones[i].Name, err))
+		} else if deltas[i] != nil {
+			f.union.ApplyDelta(deltas[i])
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// AddSeries does nothing, the series are ingested by the zones.
+func (f *FederatedIndex) AddSeries(labels.Labels, storage.SeriesRef) {}
+
+func (f *FederatedIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return f.GetCardinalityContext(context.Background(), matchers...)
+}
+
+// GetCardinalityContext returns the global estimate, or 0 if the query
+// failed. Failed queries and partial estimates are counted in the stats.
+func (f *FederatedIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	series, err := f.GetCardinalityChecked(ctx, matchers...)
+	if err != nil {
+		return 0
+	}
+	return series
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the errors
+// of the zones that failed, see GetFederatedCardinality.
+func (f *FederatedIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	result, err := f.GetFederatedCardinality(ctx, matchers...)
+	return result.Series, err
+}
+
+// GetFederatedCardinality queries every zone and returns the merged estimate
+// with the answers of the zones. Replicas fail only if no zone answered,
+// shards if any zone failed, and sketches never do: their estimate is
+// partial if a zone failed its last Sync. The estimate of the zones that
+// answered is returned either way, marked partial, along with the errors
+// of the others.
+func (f *FederatedIndex) GetFederatedCardinality(ctx context.Context, matchers ...*labels.Matcher) (FederatedCardinality, error) {
+	if err := checkMatchers(matchers); err != nil {
+		return FederatedCardinality{}, err
+	}
+	result, err := f.gather(ctx, matchers)
+	if err != nil || result.Partial {
+		f.errors.Add(1)
+	}
+	return result, err
+}
+
+// gather scatters the query to the zones and merges their answers.
+func (f *FederatedIndex) gather(ctx context.Context, matchers []*labels.Matcher) (FederatedCardinality, error) {
+	result := FederatedCardinality{Zones: make([]ZoneCardinality, len(f.zones))}
+	errs := make([]error, len(f.zones))
+	var wg sync.WaitGroup
+	for i, zone := range f.zones {
+		result.Zones[i].Zone = zone.Name
+		if zone.Index == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			series, err := GetCardinalityChecked(ctx, zone.Index, matchers...)
+			result.Zones[i] = ZoneCardinality{Zone: zone.Name, Series: series, Duration: time.Since(start)}
+			if err != nil {
+				result.Zones[i].Error = err.Error()
+				errs[i] = fmt.Errorf("zone %s: %w", zone.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if f.merge == MergeSketches {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		result.Series = f.union.GetCardinalityContext(ctx, matchers...)
+		for i, err := range f.syncErrs {
+			if err != nil && errs[i] == nil {
+				result.Zones[i].Error = err.Error()
+			}
+			result.Partial = result.Partial || err != nil || errs[i] != nil
+		}
+		return result, nil
+	}
+
+	answered := 0
+	for i, zone := range result.Zones {
+		if errs[i] != nil {
+			continue
+		}
+		answered++
+		if f.merge == MergeShards {
+			result.Series += zone.Series
+		} else {
+			result.Series = max(result.Series, zone.Series)
+		}
+	}
+	result.Partial = answered < len(f.zones)
+	if f.merge == MergeReplicas && answered > 0 {
+		return result, nil
+	}
+	return result, errors.Join(errs...)
+}
+
+// Stats reports the failed queries and partial estimates; the index has no
+// local structures to report.
+func (f *FederatedIndex) Stats() IndexStats {
+	return IndexStats{Errors: f.errors.Load()}
+}
@@ -0,0 +1,284 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotEnoughHistory is returned when a forecast is requested for a
+// selector with fewer than two samples.
+var ErrNotEnoughHistory = errors.New("not enough history to forecast")
+
+// TrendPoint is the number of series of a tracked selector at a point in
+// time.
+type TrendPoint struct {
+	Time   time.Time `json:"time"`
+	Series int64     `json:"series"`
+}
+
+type trend struct {
+	matchers []*labels.Matcher
+	limit    int64
+	points   []TrendPoint
+}
+
+// TrendTracker periodically samples the cardinality of tracked selectors,
+// keeping the most recent samples of each, and forecasts their growth.
+type TrendTracker struct {
+	index     CardinalityIndex
+	maxPoints int
+
+	mtx    sync.Mutex
+	trends map[string]*trend
+}
+
+// NewTrendTracker returns a tracker sampling index and keeping up to
+// maxPoints samples per selector.
+func NewTrendTracker(index CardinalityIndex, maxPoints int) *TrendTracker {
+	return &TrendTracker{
+		index:     index,
+		maxPoints: maxPoints,
+		trends:    make(map[string]*trend),
+	}
+}
+
+// Track starts sampling the selector. limit is the series limit the
+// forecasts of the selector are compared to, e.g. the MaxSeries of a
+// tenant's Quota or its MaxSeriesPerMetric for a metric name selector; zero
+// means no limit. Tracking a tracked selector again only updates its limit.
+func (t *TrendTracker) Track(limit int64, matchers ...*labels.Matcher) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	key := matchersKey(matchers)
+	if tr, ok := t.trends[key]; ok {
+		tr.limit = limit
+		return
+	}
+	t.trends[key] = &trend{matchers: matchers, limit: limit}
+}
+
+// Untrack stops sampling the selector and drops its history.
+func (t *TrendTracker) Untrack(matchers ...*labels.Matcher) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.trends, matchersKey(matchers))
+}
+
+// Sample records the current cardinality of every tracked selector at now.
+func (t *TrendTracker) Sample(now time.Time) {
+	t.mtx.Lock()
+	trends := make([]*trend, 0, len(t.trends))
+	for _, tr := range t.trends {
+		trends = append(trends, tr)
+	}
+	t.mtx.Unlock()
+
+	// Query the index without holding the lock, so that slow queries don't
+	// block forecasts.
+	series := make([]int64, len(trends))
+	for i, tr := range trends {
+		series[i] = t.index.GetCardinality(tr.matchers...)
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for i, tr := range trends {
+		t.record(tr, TrendPoint{Time: now, Series: series[i]})
+	}
+}
+
+// Record adds a sample of a tracked selector, e.g. to backfill its history
+// from a monitoring system. Samples not after the latest sample of the
+// selector are ignored.
+func (t *TrendTracker) Record(ts time.Time, series int64, matchers ...*labels.Matcher) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if tr, ok := t.trends[matchersKey(matchers)]; ok {
+		t.record(tr, TrendPoint{Time: ts, Series: series})
+	}
+}
+
+func (t *TrendTracker) record(tr *trend, p TrendPoint) {
+	if n := len(tr.points); n > 0 && !p.Time.After(tr.points[n-1].Time) {
+		return
+	}
+	tr.points = append(tr.points, p)
+	if t.maxPoints > 0 && len(tr.points) > t.maxPoints {
+		tr.points = slices.Delete(tr.points, 0, len(tr.points)-t.maxPoints)
+	}
+}
+
+// Run samples the tracked selectors every interval until ctx is done.
+func (t *TrendTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		t.Sample(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// History returns the samples of a tracked selector, oldest first.
+func (t *TrendTracker) History(matchers ...*labels.Matcher) []TrendPoint {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tr, ok := t.trends[matchersKey(matchers)]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(tr.points)
+}
+
+// Forecast is the predicted cardinality of a selector.
+type Forecast struct {
+	// Method is the model that fit the history best: "linear" for a least
+	// squares line, "holt" for Holt's linear trend method, i.e.
+	// Holt-Winters without a seasonal component.
+	Method string `json:"method"`
+	// Current is the latest sampled number of series.
+	Current int64 `json:"current"`
+	// At is the time of the prediction, the latest sample plus the horizon.
+	At        time.Time `json:"at"`
+	Predicted int64     `json:"predicted"`
+	// Growth is the fitted trend in series per hour.
+	Growth float64 `json:"growth"`
+
+	// Limit is the limit of the selector, zero if it has none.
+	Limit int64 `json:"limit"`
+	// Breach is set if the limit is exceeded by the end of the horizon.
+	// BreachAt is the predicted time it is exceeded, or the time of the
+	// latest sample if it already is.
+	Breach   bool      `json:"breach"`
+	BreachAt time.Time `json:"breach_at"`
+}
+
+// trendModel is a fitted model: the series at the latest sample and the
+// trend in series per second.
+type trendModel struct {
+	level float64
+	slope float64
+	// sse is the sum of squared one-step-ahead errors, used to choose
+	// between models.
+	sse float64
+}
+
+// Forecast predicts the cardinality of a tracked selector horizon after its
+// latest sample, with a linear fit or Holt's method, whichever predicted
+// its history best, and when it exceeds its limit.
+func (t *TrendTracker) Forecast(matchers []*labels.Matcher, horizon time.Duration) (Forecast, error) {
+	t.mtx.Lock()
+	tr, ok := t.trends[matchersKey(matchers)]
+	if !ok || len(tr.points) < 2 {
+		t.mtx.Unlock()
+		return Forecast{}, ErrNotEnoughHistory
+	}
+	points := slices.Clone(tr.points)
+	limit := tr.limit
+	t.mtx.Unlock()
+
+	method, model := "linear", fitLinear(points)
+	if holt := fitHolt(points); holt.sse < model.sse {
+		method, model = "holt", holt
+	}
+
+	last := points[len(points)-1]
+	f := Forecast{
+		Method:    method,
+		Current:   last.Series,
+		At:        last.Time.Add(horizon),
+		Predicted: int64(math.Round(max(model.level+model.slope*horizon.Seconds(), 0))),
+		Growth:    model.slope * time.Hour.Seconds(),
+		Limit:     limit,
+	}
+	if limit <= 0 {
+		return f, nil
+	}
+	switch {
+	case last.Series > limit:
+		f.Breach, f.BreachAt = true, last.Time
+	case model.slope > 0:
+		// The time the fitted trend crosses the limit, at least the
+		// latest sample if the fitted level is already above it.
+		secs := max((float64(limit)-model.level)/model.slope, 0)
+		if secs <= horizon.Seconds() {
+			f.Breach = true
+			f.BreachAt = last.Time.Add(time.Duration(secs * float64(time.Second)))
+		}
+	}
+	return f, nil
+}
+
+// fitLinear fits a least squares line to the points. The one-step-ahead
+// errors predict every point from the line fitted to the points before it.
+func fitLinear(points []TrendPoint) trendModel {
+	origin := points[0].Time
+	var n, sx, sy, sxx, sxy, sse float64
+	line := func() (intercept, slope float64) {
+		if d := n*sxx - sx*sx; d != 0 {
+			slope = (n*sxy - sx*sy) / d
+		}
+		return (sy - slope*sx) / n, slope
+	}
+	for i, p := range points {
+		x, y := p.Time.Sub(origin).Seconds(), float64(p.Series)
+		if i >= 2 {
+			intercept, slope := line()
+			e := y - (intercept + slope*x)
+			sse += e * e
+		}
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	intercept, slope := line()
+	x := points[len(points)-1].Time.Sub(origin).Seconds()
+	return trendModel{level: intercept + slope*x, slope: slope, sse: sse}
+}
+
+// holtParams are the smoothing factors tried when fitting Holt's method.
+var holtParams = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+
+// fitHolt fits Holt's linear trend method, choosing the smoothing factors
+// of the level and the trend that minimize the one-step-ahead errors.
+// Samples don't have to be evenly spaced: the trend is kept per second.
+func fitHolt(points []TrendPoint) trendModel {
+	best := trendModel{sse: math.Inf(1)}
+	for _, alpha := range holtParams {
+		for _, beta := range holtParams {
+			if m := holt(points, alpha, beta); m.sse < best.sse {
+				best = m
+			}
+		}
+	}
+	return best
+}
+
+func holt(points []TrendPoint, alpha, beta float64) trendModel {
+	level := float64(points[1].Series)
+	slope := (level - float64(points[0].Series)) / points[1].Time.Sub(points[0].Time).Seconds()
+	var sse float64
+	for i := 2; i < len(points); i++ {
+		dt := points[i].Time.Sub(points[i-1].Time).Seconds()
+		y := float64(points[i].Series)
+		predicted := level + slope*dt
+		sse += (y - predicted) * (y - predicted)
+
+		prev := level
+		level = alpha*y + (1-alpha)*predicted
+		slope = beta*(level-prev)/dt + (1-beta)*slope
+	}
+	return trendModel{level: level, slope: slope, sse: sse}
+}
@@ -1,149 +1,430 @@
 package cardinality
 
 import (
-	"encoding/binary"
+	"context"
 	"github.com/axiomhq/hyperminhash"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"harry671003/hello/cardinality/sketchcore"
+	"log/slog"
+	"sync"
+	"time"
 )
 
+// HyperMinHashIndex is safe for concurrent use: series are added under a
+// write lock, and queries share a read lock.
 type HyperMinHashIndex struct {
-	index map[string]map[string]*hyperminhash.Sketch
+	// mtx guards the sketches and statistics below. The co-occurrence
+	// tracker, the value guard and the seen filter have locks of their own.
+	mtx         sync.RWMutex
+	core        *sketchcore.Index
+	bucketing   bucketing
+	targetError float64
+	relabel     []*relabel.Config
+	guard       *valueGuard
+	filter      *seenFilter
+	seen        seriesSet
+	cooc        *CooccurrenceTracker
+	logger      *slog.Logger
+
+	// stats holds exact per label value statistics, which also answer
+	// single equality matchers.
+	stats valueStats
+
+	// strings pools the names and values stored by the sketches, the
+	// statistics and the dirty values, except the values of bucketed
+	// labels, which are only hashed into their bucket.
+	strings labelStrings
+
+	// dirty holds the label values modified since the last ExportDelta,
+	// and dirtyBuckets the bucketed labels.
+	dirty        map[string]map[string]struct{}
+	dirtyBuckets map[string]struct{}
+
+	// pairs holds a sketch and the number of series of every combination
+	// of values of the configured label pairs.
+	labelPairs labelPairs
+	pairs      map[pairKey]*pairSketch
+
+	// metrics holds the sketches of the series of every metric name.
+	metrics map[string]*metricSketches
+
+	added      int64
+	lastUpdate time.Time
 }
 
-func NewHyperMinHashIndex() *HyperMinHashIndex {
-	return &HyperMinHashIndex{
-		index: make(map[string]map[string]*hyperminhash.Sketch),
+func NewHyperMinHashIndex(opts ...Option) *HyperMinHashIndex {
+	o := applyOptions(opts)
+	h := &HyperMinHashIndex{
+		core:        sketchcore.NewIndex(o.bucketing.threshold, o.bucketing.buckets),
+		bucketing:   o.bucketing,
+		targetError: o.targetError,
+		relabel:     o.relabel,
+		guard:       newValueGuard(o.valueGuard),
+		filter:      newSeenFilter(o.seenFilter.series, o.seenFilter.interval, time.Now),
+		stats:       make(valueStats),
+		seen:        newSeriesSet(o.dedup),
+		logger:      o.logger,
 	}
+	h.core.SetAccuracyTarget(o.targetError)
+	if o.cooccurrence {
+		h.cooc = NewCooccurrenceTracker()
+	}
+	if o.deltas {
+		h.dirty = make(map[string]map[string]struct{})
+		h.dirtyBuckets = make(map[string]struct{})
+	}
+	if len(o.labelPairs) > 0 {
+		h.labelPairs = o.labelPairs
+		h.pairs = make(map[pairKey]*pairSketch)
+	}
+	if o.metricIndex {
+		h.metrics = make(map[string]*metricSketches)
+	}
+	return h
 }
 
-func (h *HyperMinHashIndex) AddSeries(lbls labels.Labels, _ storage.SeriesRef) {
-	hash := lbls.Hash()
-	hashBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(hashBytes, hash)
+type pairSketch struct {
+	sketch *hyperminhash.Sketch
+	series int64
+}
 
-	for _, l := range lbls {
-		lName := internString(l.Name)
-		lValue := internString(l.Value)
-
-		// Retrieve or create the value map
-		valueMap, ok := h.index[lName]
-		if !ok {
-			valueMap = make(map[string]*hyperminhash.Sketch)
-			h.index[lName] = valueMap
-		}
+// metricSketches holds the sketches of the series of a single metric. Its
+// series are deduplicated by seen instead of the seen set of the index.
+// stats holds the share of the metric in the statistics of the index,
+// which are exact and so can drop the series of the metric when evicted.
+type metricSketches struct {
+	core   *sketchcore.Index
+	seen   seriesSet
+	stats  valueStats
+	series int64
+}
 
-		// Retrieve or create the HLL sketch for the label value
-		hll, ok := valueMap[lValue]
-		if !ok {
-			hll = hyperminhash.New()
-			valueMap[lValue] = hll
+// metricSketches returns the sketches of the metric of the series, or nil if
+// the series has no metric name or the index keeps no sketches per metric.
+func (h *HyperMinHashIndex) metricSketches(lbls labels.Labels) *metricSketches {
+	name := lbls.Get(labels.MetricName)
+	if h.metrics == nil || name == "" {
+		return nil
+	}
+	m, ok := h.metrics[name]
+	if !ok {
+		m = &metricSketches{
+			core:  sketchcore.NewIndex(h.bucketing.threshold, h.bucketing.buckets),
+			seen:  newSeriesSet(h.seen != nil),
+			stats: make(valueStats),
 		}
+		m.core.SetAccuracyTarget(h.targetError)
+		h.metrics[name] = m
+	}
+	return m
+}
 
-		hll.Add(hashBytes)
+// intern returns the pooled name and value of a label, or them as they are
+// if the label is bucketed: its values are only hashed into their bucket,
+// and would accumulate in the pool. The caller must hold the lock.
+func (h *HyperMinHashIndex) intern(name, value string) (string, string) {
+	if h.core.Bucketed(name) {
+		return name, value
 	}
+	return h.strings.intern(name, value)
 }
 
-func (h *HyperMinHashIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
-	return h.cardinalityUsingJacaards(matchers...)
+// Core returns the sketches of the index. They can be serialized with
+// WriteTo and queried with the sketchcore package alone, e.g. from
+// WebAssembly in a browser. The sketches aren't guarded by the lock of the
+// index, so no series may be added while they are used.
+func (h *HyperMinHashIndex) Core() *sketchcore.Index {
+	return h.core
+}
+
+func (h *HyperMinHashIndex) TopLabelValues(name string, n int) []LabelValueStats {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.stats.TopLabelValues(name, n)
 }
 
-// Estimate cardinality for a single matcher
-func (h *HyperMinHashIndex) getSketchForMatcher(matcher *labels.Matcher) *hyperminhash.Sketch {
-	resultSketch := hyperminhash.New()
+func (h *HyperMinHashIndex) TopLabelValuesByBytes(name string, n int) []LabelValueStats {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.stats.TopLabelValuesByBytes(name, n)
+}
 
-	if valueMap, ok := h.index[matcher.Name]; ok {
-		switch matcher.Type {
-		case labels.MatchEqual:
-			if hll, exists := valueMap[matcher.Value]; exists {
-				resultSketch = resultSketch.Merge(hll) // Exact match: Merge single HLL
-			}
+// Cooccurrence returns the label co-occurrence statistics of the index, or nil
+// if the index was not created WithCooccurrenceTracking.
+func (h *HyperMinHashIndex) Cooccurrence() *CooccurrenceTracker {
+	return h.cooc
+}
 
-		case labels.MatchRegexp:
-			for value, hll := range valueMap {
-				if matcher.Matches(value) {
-					resultSketch = resultSketch.Merge(hll) // Regex match: Merge all matching HLLs
-				}
-			}
+func (h *HyperMinHashIndex) AddSeries(lbls labels.Labels, _ storage.SeriesRef) {
+	if h.filter != nil && h.filter.seen(lbls.Hash()) {
+		return
+	}
+	lbls, ok := relabelSeries(h.relabel, lbls)
+	if !ok {
+		return
+	}
+	lbls, flagged := h.guard.check(lbls)
+	hash := lbls.Hash()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	metric := h.metricSketches(lbls)
+	if metric != nil {
+		if !metric.seen.add(hash) {
+			return
+		}
+	} else if !h.seen.add(hash) {
+		return
+	}
+	h.guard.record(flagged)
+	if h.cooc != nil {
+		h.cooc.AddSeries(lbls)
+	}
+
+	h.added++
+	h.lastUpdate = time.Now()
+	weight := seriesBytes(lbls)
+	h.core.AddSeries(hash)
 
-		case labels.MatchNotEqual:
-			for value, hll := range valueMap {
-				if value != matcher.Value {
-					resultSketch = resultSketch.Merge(hll) // Exclude the specified value
-				}
+	for _, l := range lbls {
+		lName, lValue := h.intern(l.Name, l.Value)
+
+		// Bucketed labels have no per-value statistics, and their deltas
+		// hold all their buckets.
+		if h.core.AddLabel(hash, lName, lValue) {
+			h.strings.release(lName)
+			if _, ok := h.stats[lName]; ok {
+				h.logger.Info("Bucketing label values", "label", lName)
+			}
+			delete(h.stats, lName)
+			if h.dirty != nil {
+				delete(h.dirty, lName)
+				h.dirtyBuckets[lName] = struct{}{}
 			}
+			if metric != nil {
+				delete(metric.stats, lName)
+			}
+			continue
+		}
+		h.stats.add(lName, lValue, weight)
+		if metric != nil {
+			metric.stats.add(lName, lValue, weight)
+		}
+		if h.dirty != nil {
+			h.markDirty(lName, lValue)
+		}
+	}
 
-		case labels.MatchNotRegexp:
-			for value, hll := range valueMap {
-				if !matcher.Matches(value) {
-					resultSketch = resultSketch.Merge(hll) // Exclude values matching the regex
-				}
+	if h.pairs != nil {
+		b := sketchcore.HashBytes(hash)
+		h.labelPairs.forEach(lbls, func(key pairKey) {
+			pair, ok := h.pairs[key]
+			if !ok {
+				pair = &pairSketch{sketch: hyperminhash.New()}
+				h.pairs[key] = pair
 			}
+			pair.sketch.Add(b)
+			pair.series++
+		})
+	}
+
+	if metric != nil {
+		metric.core.AddSeries(hash)
+		for _, l := range lbls {
+			name, value := h.intern(l.Name, l.Value)
+			metric.core.AddLabel(hash, name, value)
 		}
+		metric.series++
 	}
-	return resultSketch
 }
 
-func (h *HyperMinHashIndex) cardinalityUsingJacaards(matchers ...*labels.Matcher) int64 {
-	if len(matchers) == 0 {
+// EvictMetric drops the sketches of a metric kept WithMetricNameIndex and
+// its series from the per value statistics, and returns the number of its
+// series. Series of the metric added again afterwards are counted as new.
+// Single equality matchers, answered from the statistics, stop counting
+// the evicted series, but sketches can't remove series, so other queries
+// that don't select the metric by name keep counting them until the index
+// is rebuilt.
+func (h *HyperMinHashIndex) EvictMetric(name string) int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	m, ok := h.metrics[name]
+	if !ok {
 		return 0
 	}
+	delete(h.metrics, name)
+	h.stats.remove(m.stats)
+	return int(m.series)
+}
 
-	// Retrieve the sketches for each matcher
-	var sketches []*hyperminhash.Sketch
-	for _, matcher := range matchers {
-		sketch := h.getSketchForMatcher(matcher)
-		if sketch == nil {
-			// If any matcher has no corresponding data, the card is 0
-			return 0
-		}
-		sketches = append(sketches, sketch)
+func (h *HyperMinHashIndex) markDirty(name, value string) {
+	values, ok := h.dirty[name]
+	if !ok {
+		values = make(map[string]struct{})
+		h.dirty[name] = values
 	}
+	values[value] = struct{}{}
+}
 
-	card := int64(sketches[0].Cardinality())
-	// Iterate over pairs of sketches and track the smallest card
-	for i := 0; i < len(sketches); i++ {
-		for j := i + 1; j < len(sketches); j++ {
-			i := int64(sketches[i].Intersection(sketches[j]))
-			if i < card {
-				card = i
-			}
-		}
+// Stats returns the size of the index. Memory counts the sketches and the
+// series hashes of the values kept exact, which dominate it.
+func (h *HyperMinHashIndex) Stats() IndexStats {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	names, values, sketches := h.core.Size()
+	hashes := h.core.ExactHashes()
+	for _, m := range h.metrics {
+		_, _, n := m.core.Size()
+		sketches += n
+		hashes += m.core.ExactHashes()
 	}
+	return IndexStats{
+		LabelNames:  names,
+		LabelValues: values,
+		Series:      h.core.Series(),
+		SeriesAdded: h.added,
+		MemoryBytes: int64(sketches+len(h.pairs))*int64(sketchcore.SketchSize) + 8*int64(hashes),
+		LastUpdate:  h.lastUpdate,
+	}
+}
 
-	return card
+func (h *HyperMinHashIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return h.GetCardinalityContext(context.Background(), matchers...)
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns
+// ErrUnknownLabel for matchers on labels without series, and the errors of
+// the QueryContext of ctx.
+func (h *HyperMinHashIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, h, func(name string) bool {
+		h.mtx.RLock()
+		defer h.mtx.RUnlock()
+		return h.core.Present(name) != nil
+	}, matchers)
+}
+
+func (h *HyperMinHashIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) (card int64) {
+	ctx, span := tracer.Start(ctx, "HyperMinHashIndex.GetCardinality")
+	defer func() {
+		span.SetAttributes(attribute.Int64("cardinality", card))
+		span.End()
+	}()
+	setSpanMatchers(span, matchers...)
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.estimate(ctx, matchers, nil)
 }
 
-func (h *HyperMinHashIndex) cardinalityUsingInclusionExclusion(matchers ...*labels.Matcher) int64 {
+// estimate estimates the series of the matchers, recording how in explain
+// if it is not nil. The caller holds the read lock.
+func (h *HyperMinHashIndex) estimate(ctx context.Context, matchers []*labels.Matcher, explain *Explanation) int64 {
+	explain.source(ExplainEmpty, nil)
 	if len(matchers) == 0 {
 		return 0
 	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0
+	}
+	if h.cooc != nil {
+		if matchers, ok = skipDependent(h.cooc, matchers, h.sharedFraction); !ok {
+			return 0
+		}
+	}
+	explain.source(ExplainEmpty, matchers)
 
-	// Generate all possible combinations of matchers (powerset)
-	n := len(matchers)
-	totalMatchers := 1 << n // 2^n subsets
-
-	// Use Inclusion-Exclusion formula
-	var result int64
-	for subset := 1; subset < totalMatchers; subset++ {
-		subsetSketch := hyperminhash.New()
-		includedMatchers := 0
-
-		for i := 0; i < n; i++ {
-			if subset&(1<<i) != 0 { // Check if matcher i is in the current subset
-				subsetSketch = subsetSketch.Merge(h.getSketchForMatcher(matchers[i]))
-				includedMatchers++
-			}
+	// Fast path: a single equality matcher is answered exactly from the
+	// per-value counters without merging sketches.
+	if len(matchers) == 1 && matchers[0].Type == labels.MatchEqual && matchers[0].Value != "" {
+		if series, ok := h.stats.series(matchers[0].Name, matchers[0].Value); ok {
+			explain.source(ExplainExact, matchers)
+			return series
 		}
+	}
 
-		// Calculate cardinality for the subset and include/exclude based on the number of matchers in the subset
-		subsetCardinality := int64(subsetSketch.Cardinality())
-		if includedMatchers%2 == 1 {
-			result += subsetCardinality // Include odd-sized intersections
-		} else {
-			result -= subsetCardinality // Exclude even-sized intersections
+	// The number of sketches merged into is only known afterwards, so the
+	// budget is checked once the estimate is done.
+	q := QueryFromContext(ctx)
+	q.begin()
+	scratch := q.scratch()
+	if trace.SpanFromContext(ctx).IsRecording() {
+		// The hook needs a scratch to live on, where queries without a
+		// QueryContext would take one from the pool in PlanWith.
+		if scratch == nil {
+			scratch = sketchcore.AcquireScratch()
+			defer sketchcore.ReleaseScratch(scratch)
 		}
+		scratch.SetMatcherHook(matcherSpans(ctx, "HyperMinHashIndex.getSketchForMatcher"))
+		defer scratch.SetMatcherHook(nil)
+	}
+	var (
+		card int64
+		plan sketchcore.Plan
+	)
+	if name, rest, ok := metricMatchers(matchers); ok && h.metrics != nil {
+		// The sketches of the metric only hold its series, so the error of
+		// the intersection is relative to them rather than to all series.
+		metric, ok := h.metrics[name]
+		switch {
+		case !ok:
+			return 0
+		case len(rest) == 0:
+			explain.source(ExplainExact, matchers)
+			return metric.series
+		}
+		explain.source(ExplainMetricSketches, matchers)
+		card, plan = metric.core.PlanWith(scratch, nil, rest...)
+	} else if key, rest, ok := h.labelPairs.match(matchers); ok {
+		// The series of a pair are counted exactly, and its sketch replaces
+		// the intersection of the sketches of both labels.
+		pair, ok := h.pairs[key]
+		switch {
+		case !ok:
+			return 0
+		case len(rest) == 0:
+			explain.source(ExplainExact, matchers)
+			return pair.series
+		}
+		explain.source(ExplainPairSketches, matchers)
+		card, plan = h.core.PlanWith(scratch, []*hyperminhash.Sketch{pair.sketch}, rest...)
+	} else {
+		explain.source(ExplainSketches, matchers)
+		card, plan = h.core.PlanWith(scratch, nil, matchers...)
+	}
+	if explain != nil {
+		explain.Plan = &plan
 	}
+	if q.scratch() != nil && !q.charge(int64(q.scratch().InUse())*int64(sketchcore.SketchSize)) {
+		return 0
+	}
+	return card
+}
+
+// sharedFraction estimates the fraction of the series selected by eq that
+// are also selected by dependent, 0 if eq selects none.
+func (h *HyperMinHashIndex) sharedFraction(eq, dependent *labels.Matcher) float64 {
+	scratch := sketchcore.AcquireScratch()
+	defer sketchcore.ReleaseScratch(scratch)
+	eqSketch := h.core.SketchScratch(scratch, eq)
+	series := eqSketch.Cardinality()
+	if series == 0 {
+		return 0
+	}
+	shared := sketchcore.Intersection([]*hyperminhash.Sketch{eqSketch, h.core.SketchScratch(scratch, dependent)})
+	return min(float64(shared)/float64(series), 1)
+}
+
+func (h *HyperMinHashIndex) LabelNames(matchers ...*labels.Matcher) []string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.core.LabelNames(matchers...)
+}
 
-	return result
+func (h *HyperMinHashIndex) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.core.LabelValues(name, matchers...)
 }
@@ -0,0 +1,607 @@
+package cardinality
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"go.opentelemetry.io/otel/attribute"
+	"harry671003/hello/cardinality/sketchcore"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Index files hold a BitmapIndex in a form that is queried in place from a
+// memory-mapped file, similar to the TSDB index file. Only the label names
+// are loaded into the heap; label values are binary searched and postings
+// are read from the mapped file without copying.
+//
+// All integers are big-endian. The layout is:
+//
+//	magic    uint32
+//	version  uint8
+//	symbols  sorted, uvarint length prefixed label names and values
+//	postings serialized roaring64 bitmaps, starting with all series
+//	values   per label name, entries of (value symbol uint32, postings
+//	         offset uint64, postings length uint64) sorted by value
+//	names    entries of (name symbol uint32, values offset uint64,
+//	         number of values uint32, number of buckets uint32) sorted
+//	         by name
+//	toc      offsets of the postings, values and names sections, the
+//	         number of names and the length of the all series postings,
+//	         uint64 each
+//	crc32    castagnoli checksum of the toc
+//
+// Symbols are referenced by their offset in the file, so the symbols section
+// must end within the first 4GiB. The value strings of bucketed labels
+// aren't kept, so their value entries are their buckets in order, with the
+// label name as value symbol. Version 1 files have no number of buckets.
+const (
+	indexFileMagic   = 0xCA4D1DE0
+	indexFileVersion = 2
+
+	indexFileHeaderLen = 5
+	indexFileValueLen  = 4 + 8 + 8
+	indexFileNameLen   = 4 + 8 + 4 + 4
+	indexFileNameLenV1 = 4 + 8 + 4
+	indexFileTOCLen    = 5*8 + 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrIndexFileCorrupted is returned when an index file can't be decoded.
+var ErrIndexFileCorrupted = errors.New("corrupted index file")
+
+// WriteIndexFile writes the index to the file at path. The file is written
+// to a temporary file first and renamed, so readers never see partial files.
+// The index may be written to while the file is written; the postings are
+// copied under the lock of their label, so series added meanwhile may only
+// be in some of them.
+func WriteIndexFile(path string, b *BitmapIndex) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := writeIndexFile(f, b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type indexFileValue struct {
+	value    string
+	postings *roaring64.Bitmap
+}
+
+type indexFileWriter struct {
+	w   *bufio.Writer
+	pos uint64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *indexFileWriter) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.pos += uint64(n)
+	return err
+}
+
+func (w *indexFileWriter) writeUint32(v uint32) error {
+	return w.write(binary.BigEndian.AppendUint32(w.buf[:0], v))
+}
+
+func (w *indexFileWriter) writeUint64(v uint64) error {
+	return w.write(binary.BigEndian.AppendUint64(w.buf[:0], v))
+}
+
+func writeIndexFile(out io.Writer, b *BitmapIndex) error {
+	// Collect copies of the postings of every label value and bucket.
+	// Values of collapsed labels share their postings, which are only
+	// copied and written once.
+	labelValues := make(map[string][]indexFileValue)
+	labelBuckets := make(map[string]int)
+	symbolSet := make(map[string]struct{})
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		copies := make(map[*roaring64.Bitmap]*roaring64.Bitmap)
+		add := func(value string, postings *roaring64.Bitmap) {
+			if _, ok := copies[postings]; !ok {
+				copies[postings] = postings.Clone()
+			}
+			labelValues[name] = append(labelValues[name], indexFileValue{value, copies[postings]})
+			symbolSet[value] = struct{}{}
+		}
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				add(str(id), v.postings)
+			}
+		})
+		if s.bucketed != nil {
+			// Bucketed labels have no values, only their buckets.
+			for _, bitmap := range s.bucketed.Buckets {
+				add(name, bitmap)
+			}
+			labelBuckets[name] = len(s.bucketed.Buckets)
+		}
+		symbolSet[name] = struct{}{}
+	})
+
+	w := &indexFileWriter{w: bufio.NewWriter(out)}
+	w.writeUint32(indexFileMagic)
+	w.write([]byte{indexFileVersion})
+
+	symbols := make([]string, 0, len(symbolSet))
+	for s := range symbolSet {
+		symbols = append(symbols, s)
+	}
+	slices.Sort(symbols)
+	symbolRefs := make(map[string]uint32, len(symbols))
+	for _, s := range symbols {
+		if w.pos > math.MaxUint32 {
+			return errors.New("index file symbols exceed 4GiB")
+		}
+		symbolRefs[s] = uint32(w.pos)
+		w.write(binary.AppendUvarint(w.buf[:0], uint64(len(s))))
+		w.write([]byte(s))
+	}
+
+	type postingsRef struct{ off, len uint64 }
+	postingsStart := w.pos
+	b.mtx.RLock()
+	allLen, err := b.all.WriteTo(w.w)
+	b.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	w.pos += uint64(allLen)
+	postings := make(map[*roaring64.Bitmap]postingsRef)
+	for _, values := range labelValues {
+		for _, v := range values {
+			if _, ok := postings[v.postings]; ok {
+				continue
+			}
+			start := w.pos
+			n, err := v.postings.WriteTo(w.w)
+			if err != nil {
+				return err
+			}
+			w.pos += uint64(n)
+			postings[v.postings] = postingsRef{start, w.pos - start}
+		}
+	}
+
+	names := make([]string, 0, len(labelValues))
+	for name := range labelValues {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	valuesStart := w.pos
+	valueOffsets := make([]uint64, len(names))
+	for i, name := range names {
+		values := labelValues[name]
+		// Buckets all have the label name as value and stay in order.
+		sort.SliceStable(values, func(i, j int) bool { return values[i].value < values[j].value })
+		valueOffsets[i] = w.pos
+		for _, v := range values {
+			p := postings[v.postings]
+			w.writeUint32(symbolRefs[v.value])
+			w.writeUint64(p.off)
+			w.writeUint64(p.len)
+		}
+	}
+
+	namesStart := w.pos
+	for i, name := range names {
+		w.writeUint32(symbolRefs[name])
+		w.writeUint64(valueOffsets[i])
+		w.writeUint32(uint32(len(labelValues[name])))
+		w.writeUint32(uint32(labelBuckets[name]))
+	}
+
+	toc := make([]byte, 0, indexFileTOCLen)
+	toc = binary.BigEndian.AppendUint64(toc, postingsStart)
+	toc = binary.BigEndian.AppendUint64(toc, valuesStart)
+	toc = binary.BigEndian.AppendUint64(toc, namesStart)
+	toc = binary.BigEndian.AppendUint64(toc, uint64(len(names)))
+	toc = binary.BigEndian.AppendUint64(toc, uint64(allLen))
+	toc = binary.BigEndian.AppendUint32(toc, crc32.Checksum(toc, castagnoli))
+	if err := w.write(toc); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// IndexFile is a read-only index queried from a memory-mapped index file
+// written by WriteIndexFile. Corrupted entries found while querying are
+// logged and counted in the stats, and read as values without series.
+// Queries after Close select no series; Close waits for the running
+// queries before unmapping the file.
+type IndexFile struct {
+	f      *fileutil.MmapFile
+	b      []byte
+	logger *slog.Logger
+	errors atomic.Int64
+
+	// mtx is read locked by queries reading the mapping and locked by
+	// Close to unmap it.
+	mtx    sync.RWMutex
+	closed bool
+
+	// all holds the postings of all series.
+	all []byte
+	// names maps label names to their entries in the values section.
+	names map[string]indexFileValues
+}
+
+type indexFileValues struct {
+	off uint64
+	n   int
+	// buckets is set if the label is bucketed, the entries being its
+	// buckets.
+	buckets int
+}
+
+// OpenIndexFile memory-maps the index file at path. The index must be
+// closed to release the mapping. Only the WithLogger option applies.
+func OpenIndexFile(path string, opts ...Option) (*IndexFile, error) {
+	f, err := fileutil.OpenMmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &IndexFile{f: f, b: f.Bytes(), logger: applyOptions(opts).logger}
+	if err := idx.readTOC(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return idx, nil
+}
+
+func (f *IndexFile) readTOC() error {
+	b := f.b
+	if len(b) < indexFileHeaderLen+indexFileTOCLen {
+		return fmt.Errorf("%w: file too short", ErrIndexFileCorrupted)
+	}
+	if binary.BigEndian.Uint32(b) != indexFileMagic {
+		return fmt.Errorf("%w: invalid magic number", ErrIndexFileCorrupted)
+	}
+	nameLen := uint64(indexFileNameLen)
+	switch b[4] {
+	case 1:
+		nameLen = indexFileNameLenV1
+	case indexFileVersion:
+	default:
+		return fmt.Errorf("%w: unsupported version %d", ErrIndexFileCorrupted, b[4])
+	}
+
+	toc := b[len(b)-indexFileTOCLen:]
+	if crc32.Checksum(toc[:indexFileTOCLen-4], castagnoli) != binary.BigEndian.Uint32(toc[indexFileTOCLen-4:]) {
+		return fmt.Errorf("%w: toc checksum mismatch", ErrIndexFileCorrupted)
+	}
+	postingsStart := binary.BigEndian.Uint64(toc)
+	valuesStart := binary.BigEndian.Uint64(toc[8:])
+	namesStart := binary.BigEndian.Uint64(toc[16:])
+	numNames := binary.BigEndian.Uint64(toc[24:])
+	allLen := binary.BigEndian.Uint64(toc[32:])
+	// The sections are checked without overflowing, as the offsets may be
+	// anything in a corrupted file.
+	end := uint64(len(b) - indexFileTOCLen)
+	if namesStart > end || numNames > (end-namesStart)/nameLen || namesStart+numNames*nameLen != end {
+		return fmt.Errorf("%w: invalid names section", ErrIndexFileCorrupted)
+	}
+	if valuesStart < indexFileHeaderLen || valuesStart > namesStart {
+		return fmt.Errorf("%w: invalid values section", ErrIndexFileCorrupted)
+	}
+	if postingsStart > namesStart || allLen > namesStart-postingsStart {
+		return fmt.Errorf("%w: invalid postings section", ErrIndexFileCorrupted)
+	}
+	f.all = b[postingsStart : postingsStart+allLen]
+
+	f.names = make(map[string]indexFileValues, numNames)
+	for i := uint64(0); i < numNames; i++ {
+		e := b[namesStart+i*nameLen:]
+		name, err := f.symbol(binary.BigEndian.Uint32(e))
+		if err != nil {
+			return err
+		}
+		values := indexFileValues{
+			off: binary.BigEndian.Uint64(e[4:]),
+			n:   int(binary.BigEndian.Uint32(e[12:])),
+		}
+		if nameLen == indexFileNameLen {
+			values.buckets = int(binary.BigEndian.Uint32(e[16:]))
+		}
+		// The value entries aren't covered by the checksum, so they must
+		// be within the values section for queries to read them.
+		if values.off < valuesStart || values.off > namesStart || uint64(values.n) > (namesStart-values.off)/indexFileValueLen {
+			return fmt.Errorf("%w: values of label %q out of range", ErrIndexFileCorrupted, name)
+		}
+		if values.buckets > 0 && values.buckets != values.n {
+			return fmt.Errorf("%w: label %q has %d buckets but %d entries", ErrIndexFileCorrupted, name, values.buckets, values.n)
+		}
+		f.names[name] = values
+	}
+	return nil
+}
+
+// Close unmaps the index file once the running queries are done.
+func (f *IndexFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return ErrIndexClosed
+	}
+	f.closed = true
+	return f.f.Close()
+}
+
+func (f *IndexFile) isClosed() bool {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return f.closed
+}
+
+// symbol returns a copy of the symbol at off.
+func (f *IndexFile) symbol(off uint32) (string, error) {
+	if int(off) >= len(f.b) {
+		return "", fmt.Errorf("%w: symbol offset %d out of range", ErrIndexFileCorrupted, off)
+	}
+	n, size := binary.Uvarint(f.b[off:])
+	start := uint64(off) + uint64(size)
+	if size <= 0 || start+n > uint64(len(f.b)) {
+		return "", fmt.Errorf("%w: invalid symbol at %d", ErrIndexFileCorrupted, off)
+	}
+	return string(f.b[start : start+n]), nil
+}
+
+// value returns the value and postings location of the i-th value entry of
+// a label. Corrupted entries have no postings.
+func (f *IndexFile) value(values indexFileValues, i int) (string, []byte) {
+	e := f.b[values.off+uint64(i)*indexFileValueLen:]
+	value, err := f.symbol(binary.BigEndian.Uint32(e))
+	if err != nil {
+		f.readError(err)
+		return "", nil
+	}
+	off, n := binary.BigEndian.Uint64(e[4:]), binary.BigEndian.Uint64(e[12:])
+	if off+n < off || off+n > uint64(len(f.b)) {
+		f.readError(fmt.Errorf("%w: postings of value %q out of range", ErrIndexFileCorrupted, value))
+		return value, nil
+	}
+	return value, f.b[off : off+n]
+}
+
+// postings decodes postings in place; the bitmap must not be modified.
+func (f *IndexFile) postings(b []byte) *roaring64.Bitmap {
+	bitmap := roaring64.NewBitmap()
+	if len(b) == 0 {
+		return bitmap
+	}
+	if _, err := bitmap.FromUnsafeBytes(b); err != nil {
+		f.readError(fmt.Errorf("%w: failed to read postings: %w", ErrIndexFileCorrupted, err))
+		return roaring64.NewBitmap()
+	}
+	return bitmap
+}
+
+func (f *IndexFile) readError(err error) {
+	f.errors.Add(1)
+	f.logger.Error("Failed to read index file", "err", err)
+}
+
+// Stats returns the size of the index file. Memory is the size of the
+// mapped file. A closed index only has errors.
+func (f *IndexFile) Stats() IndexStats {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if f.closed {
+		return IndexStats{Errors: f.errors.Load()}
+	}
+	stats := IndexStats{
+		LabelNames:  len(f.names),
+		Series:      int64(f.postings(f.all).GetCardinality()),
+		MemoryBytes: int64(len(f.b)),
+		Errors:      f.errors.Load(),
+	}
+	for _, values := range f.names {
+		if values.buckets == 0 {
+			stats.LabelValues += values.n
+		}
+	}
+	return stats
+}
+
+// AddSeries is a no-op, index files are read-only.
+func (f *IndexFile) AddSeries(_ labels.Labels, _ storage.SeriesRef) {}
+
+func (f *IndexFile) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return f.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (f *IndexFile) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) (card int64) {
+	ctx, span := tracer.Start(ctx, "IndexFile.GetCardinality")
+	defer func() {
+		span.SetAttributes(attribute.Int64("cardinality", card))
+		span.End()
+	}()
+	setSpanMatchers(span, matchers...)
+
+	if len(matchers) == 0 {
+		return 0
+	}
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if f.closed {
+		return 0
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0
+	}
+	return int64(f.getIntersectionBitmap(ctx, matchers).GetCardinality())
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns
+// ErrIndexClosed after Close, including if it closed during the query, and
+// ErrUnknownLabel for matchers on labels without series.
+func (f *IndexFile) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	if f.isClosed() {
+		return 0, ErrIndexClosed
+	}
+	card, err := getCardinalityChecked(ctx, f, func(name string) bool {
+		_, ok := f.names[name]
+		return ok
+	}, matchers)
+	if f.isClosed() {
+		return 0, ErrIndexClosed
+	}
+	return card, err
+}
+
+func (f *IndexFile) LabelNames(matchers ...*labels.Matcher) []string {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if f.closed {
+		return nil
+	}
+	var intersectionBitmap *roaring64.Bitmap
+	if len(matchers) > 0 {
+		intersectionBitmap = f.getIntersectionBitmap(context.Background(), matchers)
+		if intersectionBitmap.IsEmpty() {
+			return nil
+		}
+	}
+
+	var names []string
+	for name, values := range f.names {
+		for i := 0; i < values.n; i++ {
+			_, b := f.value(values, i)
+			if intersectionBitmap == nil || f.postings(b).Intersects(intersectionBitmap) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (f *IndexFile) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if f.closed {
+		return nil
+	}
+	var intersectionBitmap *roaring64.Bitmap
+	if len(matchers) > 0 {
+		intersectionBitmap = f.getIntersectionBitmap(context.Background(), matchers)
+		if intersectionBitmap.IsEmpty() {
+			return nil
+		}
+	}
+
+	// Values are stored sorted, so no sorting is needed. The values of
+	// bucketed labels aren't stored.
+	values := f.names[name]
+	if values.buckets > 0 {
+		return nil
+	}
+	var result []string
+	for i := 0; i < values.n; i++ {
+		value, b := f.value(values, i)
+		if intersectionBitmap == nil || f.postings(b).Intersects(intersectionBitmap) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func (f *IndexFile) getIntersectionBitmap(ctx context.Context, matchers []*labels.Matcher) *roaring64.Bitmap {
+	intersectionBitmap := f.getUnionBitmapForMatcher(ctx, matchers[0])
+
+	for _, matcher := range matchers[1:] {
+		intersectionBitmap.And(f.getUnionBitmapForMatcher(ctx, matcher))
+
+		if intersectionBitmap.IsEmpty() {
+			break
+		}
+	}
+
+	return intersectionBitmap
+}
+
+func (f *IndexFile) getUnionBitmapForMatcher(ctx context.Context, matcher *labels.Matcher) (unionBitmap *roaring64.Bitmap) {
+	_, span := tracer.Start(ctx, "IndexFile.getUnionBitmapForMatcher")
+	defer func() {
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Int64("cardinality", int64(unionBitmap.GetCardinality())))
+		}
+		span.End()
+	}()
+	setSpanMatchers(span, matcher)
+
+	unionBitmap = roaring64.NewBitmap()
+	values := f.names[matcher.Name]
+
+	// As in PromQL, a matcher that matches the empty string also selects the
+	// series without the label.
+	if matcher.Matches("") {
+		unionBitmap.Or(f.postings(f.all))
+		for i := 0; i < values.n; i++ {
+			_, b := f.value(values, i)
+			unionBitmap.AndNot(f.postings(b))
+		}
+	}
+
+	if values.buckets > 0 {
+		for _, i := range sketchcore.MatchingBuckets(matcher, values.buckets) {
+			_, b := f.value(values, i)
+			unionBitmap.Or(f.postings(b))
+		}
+		return unionBitmap
+	}
+
+	if matcher.Type == labels.MatchEqual {
+		i := sort.Search(values.n, func(i int) bool {
+			value, _ := f.value(values, i)
+			return value >= matcher.Value
+		})
+		if i < values.n {
+			if value, b := f.value(values, i); value == matcher.Value {
+				unionBitmap.Or(f.postings(b))
+			}
+		}
+		return unionBitmap
+	}
+
+	for i := 0; i < values.n; i++ {
+		value, b := f.value(values, i)
+		if matcher.Matches(value) {
+			unionBitmap.Or(f.postings(b))
+		}
+	}
+	return unionBitmap
+}
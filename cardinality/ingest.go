@@ -0,0 +1,277 @@
+package cardinality
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidLine is returned for lines a LineParser can't parse.
+var ErrInvalidLine = errors.New("invalid line")
+
+// LineParser translates a line of a text metrics protocol into the label sets
+// of the Prometheus series it would become after a migration. Empty lines
+// and comments parse to no series.
+type LineParser interface {
+	ParseLine(line string) ([]labels.Labels, error)
+}
+
+// IngestStats counts the lines read by an Ingester.
+type IngestStats struct {
+	Lines int64 `json:"lines"`
+	// Invalid is the number of lines that failed to parse or translated to
+	// invalid label sets.
+	Invalid int64 `json:"invalid"`
+	// Series is the number of distinct series added to the index.
+	Series int64 `json:"series"`
+	// Exemplars counts the exemplars added to the exemplar index, if any.
+	Exemplars int64 `json:"exemplars,omitempty"`
+}
+
+// Ingester feeds the series of lines in a foreign protocol to an index, e.g.
+// to estimate the Prometheus series count of a Graphite or InfluxDB
+// installation before migrating it. Series refs are assigned by the
+// ingester, so repeated series are added once. It is safe for concurrent
+// use.
+type Ingester struct {
+	index  CardinalityIndex
+	parser LineParser
+
+	mtx       sync.Mutex
+	refs      *refAllocator
+	stats     IngestStats
+	exemplars *ExemplarIndex
+}
+
+// NewIngester returns an ingester parsing lines with parser, which may be
+// nil if series are only added with IngestExposition.
+func NewIngester(index CardinalityIndex, parser LineParser) *Ingester {
+	return &Ingester{
+		index:  index,
+		parser: parser,
+		refs:   newRefAllocator(),
+	}
+}
+
+// AddLine adds the series of a line. Nothing is added if the line or any of
+// its label sets is invalid.
+func (i *Ingester) AddLine(line string) error {
+	series, err := i.parser.ParseLine(line)
+	if err == nil {
+		for j, lbls := range series {
+			if series[j], err = NormalizeLabels(lbls); err != nil {
+				break
+			}
+		}
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.stats.Lines++
+	if err != nil {
+		i.stats.Invalid++
+		return err
+	}
+	for _, lbls := range series {
+		if ref, ok := i.refs.ref(lbls); ok {
+			i.index.AddSeries(lbls, ref)
+			i.stats.Series++
+		}
+	}
+	return nil
+}
+
+// Ingest adds the series of every line read from r. Invalid lines are
+// skipped and counted in the stats; only read errors are returned.
+func (i *Ingester) Ingest(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		_ = i.AddLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Stats returns the counts of the lines ingested so far.
+func (i *Ingester) Stats() IngestStats {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.stats
+}
+
+// GraphiteParser parses the Graphite plaintext protocol,
+// "path[;tag=value...] value [timestamp]". Without a template the metric
+// name is the whole path with dots replaced by underscores, and the tags
+// become labels.
+type GraphiteParser struct {
+	// Template maps the nodes of the path to labels, e.g. "env.host.name"
+	// turns "prod.web1.cpu.user" into cpu_user{env="prod",host="web1"}.
+	// Nodes matched by "name" and the nodes past the end of the template
+	// form the metric name; nodes matched by "_" are dropped.
+	Template string
+}
+
+func (p GraphiteParser) ParseLine(line string) ([]labels.Labels, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil, nil
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: missing value in %q", ErrInvalidLine, line)
+	}
+
+	path, tags, _ := strings.Cut(fields[0], ";")
+	var template []string
+	if p.Template != "" {
+		template = strings.Split(p.Template, ".")
+	}
+	var lbls labels.Labels
+	var name []string
+	for i, node := range strings.Split(path, ".") {
+		if node == "" {
+			return nil, fmt.Errorf("%w: empty node in %q", ErrInvalidLine, path)
+		}
+		switch {
+		case i >= len(template) || template[i] == "name":
+			name = append(name, node)
+		case template[i] != "_":
+			lbls = append(lbls, labels.Label{Name: sanitizeName(template[i], false), Value: node})
+		}
+	}
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%w: no metric name in %q", ErrInvalidLine, path)
+	}
+	lbls = append(lbls, labels.Label{Name: labels.MetricName, Value: sanitizeName(strings.Join(name, "_"), true)})
+
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ";") {
+			k, v, ok := strings.Cut(tag, "=")
+			if !ok || k == "" {
+				return nil, fmt.Errorf("%w: malformed tag %q", ErrInvalidLine, tag)
+			}
+			// The name tag repeats the path.
+			if k != "name" {
+				lbls = append(lbls, labels.Label{Name: sanitizeName(k, false), Value: v})
+			}
+		}
+	}
+	return []labels.Labels{labels.New(lbls...)}, nil
+}
+
+// InfluxParser parses the InfluxDB line protocol,
+// "measurement[,tag=value...] field=value[,field=value...] [timestamp]".
+// Every numeric or boolean field becomes a series named
+// measurement_field, or measurement for a field named "value", labeled
+// with the tags; string fields aren't exported to Prometheus and are
+// skipped.
+type InfluxParser struct{}
+
+func (InfluxParser) ParseLine(line string) ([]labels.Labels, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+
+	keys := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(keys[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("%w: empty measurement in %q", ErrInvalidLine, line)
+	}
+	tags := make(labels.Labels, 0, len(keys))
+	for _, tag := range keys[1:] {
+		k, v, err := splitInfluxPair(tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, labels.Label{Name: sanitizeName(k, false), Value: v})
+	}
+
+	var series []labels.Labels
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		k, v, err := splitInfluxPair(field)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(v, `"`) {
+			continue
+		}
+		name := measurement
+		if k != "value" {
+			name += "_" + k
+		}
+		lbls := append(tags.Copy(), labels.Label{Name: labels.MetricName, Value: sanitizeName(name, true)})
+		series = append(series, labels.New(lbls...))
+	}
+	return series, nil
+}
+
+// splitInfluxPair splits a key=value tag or field.
+func splitInfluxPair(s string) (string, string, error) {
+	parts := splitUnescaped(s, '=', true)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%w: malformed key-value pair %q", ErrInvalidLine, s)
+	}
+	// Only the first unescaped "=" separates the key from the value.
+	return unescapeInflux(parts[0]), unescapeInflux(s[len(parts[0])+1:]), nil
+}
+
+// splitUnescaped splits s around the occurrences of sep that aren't escaped
+// with a backslash or, if quotes is set, inside double quotes.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the backslashes escaping the special characters of
+// the line protocol; other backslashes are literal.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sanitizeName replaces the characters not allowed in Prometheus metric
+// names, or label names if colons is false, with underscores, and prefixes
+// names starting with a digit with an underscore.
+func sanitizeName(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || (c == ':' && colons)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
@@ -1,21 +1,170 @@
 package cardinality
 
 import (
+	"context"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+	"time"
 )
 
-var stringPool = map[string]string{}
+// labelStrings interns the label names and values an index stores, so that
+// the maps keyed by them share one copy of every string. Values are pooled
+// per label, to be released together once the label stops storing them,
+// e.g. when its values are bucketed. The zero value is ready to use; it
+// isn't safe for concurrent use.
+type labelStrings struct {
+	names  map[string]string
+	values map[string]map[string]string
+}
 
-func internString(s string) string {
-	if pooled, exists := stringPool[s]; exists {
-		return pooled
+// intern returns the pooled copies of the name and value, adding them if
+// they aren't pooled yet.
+func (p *labelStrings) intern(name, value string) (string, string) {
+	if p.names == nil {
+		p.names = make(map[string]string)
+		p.values = make(map[string]map[string]string)
+	}
+	if pooled, ok := p.names[name]; ok {
+		name = pooled
+	} else {
+		p.names[name] = name
+	}
+	values, ok := p.values[name]
+	if !ok {
+		values = make(map[string]string)
+		p.values[name] = values
 	}
-	stringPool[s] = s
-	return s
+	if pooled, ok := values[value]; ok {
+		return name, pooled
+	}
+	values[value] = value
+	return name, value
+}
+
+// release drops the values of the label from the pool.
+func (p *labelStrings) release(name string) {
+	delete(p.values, name)
 }
 
 type CardinalityIndex interface {
 	AddSeries(lbls labels.Labels, ref storage.SeriesRef)
 	GetCardinality(matchers ...*labels.Matcher) int64
+	// GetCardinalityChecked is like GetCardinality but returns why the
+	// index couldn't answer, where GetCardinality answers as if no series
+	// matched. Errors wrap the sentinel errors of this package, so callers
+	// can branch with errors.Is.
+	GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error)
+}
+
+// LabelValuesIndex is implemented by indexes that can list the label names
+// and the values a label takes on the series selected by the matchers.
+// Without matchers all names or values are returned.
+type LabelValuesIndex interface {
+	LabelNames(matchers ...*labels.Matcher) []string
+	LabelValues(name string, matchers ...*labels.Matcher) []string
+}
+
+// LabelStatsIndex is implemented by indexes that keep per label value
+// statistics. A negative n returns all values.
+type LabelStatsIndex interface {
+	TopLabelValues(name string, n int) []LabelValueStats
+	TopLabelValuesByBytes(name string, n int) []LabelValueStats
+}
+
+// CooccurrenceIndex is implemented by indexes that can track label
+// co-occurrence, see WithCooccurrenceTracking. Cooccurrence returns nil if
+// the index doesn't track it.
+type CooccurrenceIndex interface {
+	Cooccurrence() *CooccurrenceTracker
+}
+
+// ContextIndex is implemented by indexes that accept a context when
+// estimating, so that their work is traced as part of the caller's span.
+type ContextIndex interface {
+	GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64
+}
+
+// IndexStats describes the size and health of an index.
+type IndexStats struct {
+	LabelNames  int `json:"label_names"`
+	LabelValues int `json:"label_values"`
+	// Series is the number of series in the index, estimated by sketch
+	// indexes.
+	Series int64 `json:"series"`
+	// SeriesAdded counts the AddSeries calls that added a new series.
+	SeriesAdded int64 `json:"series_added"`
+	// MemoryBytes approximates the memory used by the index structures,
+	// and DiskBytes the size of the structures moved to disk, like the cold
+	// tier of a BitmapIndex.
+	MemoryBytes int64 `json:"memory_bytes"`
+	DiskBytes   int64 `json:"disk_bytes,omitempty"`
+	// LastUpdate is when a series was last added, or zero.
+	LastUpdate time.Time `json:"last_update"`
+	// Errors counts the errors reading the underlying storage or file,
+	// which are answered as if no series matched.
+	Errors int64 `json:"errors"`
+}
+
+// StatsIndex is implemented by indexes that report their size and health,
+// for operators to monitor.
+type StatsIndex interface {
+	Stats() IndexStats
+}
+
+// StreamingIndex is implemented by indexes that can report partial results
+// while estimating broad matchers, see StreamCardinality.
+type StreamingIndex interface {
+	StreamCardinality(ctx context.Context, chunkSize int, fn func(Progress) error, matchers ...*labels.Matcher) error
+}
+
+// MetricEvictionIndex is implemented by indexes that can drop the series of
+// a metric as a whole, see BitmapIndex.EvictMetric.
+type MetricEvictionIndex interface {
+	EvictMetric(name string) int
+}
+
+// SamplingIndex is implemented by indexes that can return example series
+// of a selector.
+type SamplingIndex interface {
+	SampleSeries(matchers []*labels.Matcher, n int) ([]labels.Labels, error)
+}
+
+// TypedIndex is implemented by indexes that can record the type of the
+// samples of series, see BitmapIndex.AddTypedSeries.
+type TypedIndex interface {
+	AddTypedSeries(lbls labels.Labels, ref storage.SeriesRef, info SeriesInfo)
+}
+
+// ActiveSeriesIndex is implemented by indexes that can record the samples
+// of series, see BitmapIndex.AddSeriesSample.
+type ActiveSeriesIndex interface {
+	AddSeriesSample(lbls labels.Labels, ref storage.SeriesRef, t int64)
+}
+
+// UnboundedLabelsIndex is implemented by indexes that can report the labels
+// whose values look unbounded, see WithValueGuard.
+type UnboundedLabelsIndex interface {
+	UnboundedLabels() []UnboundedLabel
+}
+
+// ExplainIndex is implemented by indexes that can tell how they estimated
+// matchers, see HyperMinHashIndex.Explain.
+type ExplainIndex interface {
+	Explain(matchers ...*labels.Matcher) Explanation
+}
+
+// SetAlgebraIndex is implemented by indexes that can combine the series of
+// several matcher sets themselves, see EstimateDifference and EstimateUnion.
+type SetAlgebraIndex interface {
+	EstimateDifference(a, b []*labels.Matcher) int64
+	EstimateUnion(sets ...[]*labels.Matcher) int64
+}
+
+// GetCardinalityContext estimates the cardinality using index, passing ctx
+// along if the index implements ContextIndex.
+func GetCardinalityContext(ctx context.Context, index CardinalityIndex, matchers ...*labels.Matcher) int64 {
+	if ci, ok := index.(ContextIndex); ok {
+		return ci.GetCardinalityContext(ctx, matchers...)
+	}
+	return index.GetCardinality(matchers...)
 }
@@ -0,0 +1,67 @@
+package cardinality
+
+import (
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"math"
+)
+
+// JoinExpansion describes the "many" side of a many-to-one vector
+// matching, like the left side of a * on(pod) group_left b.
+type JoinExpansion struct {
+	// Series is the number of series of the "many" side, and Groups the
+	// number of distinct combinations of the matching labels among them.
+	Series int64 `json:"series"`
+	Groups int64 `json:"groups"`
+	// Factor is the number of series of the "many" side per group, the
+	// distinct values of the labels outside the matching within a match:
+	// every series of the "one" side finds that many partners.
+	Factor float64 `json:"factor"`
+}
+
+// EstimateJoinExpansion estimates the expansion factor of a many-to-one
+// vector matching whose "many" side selects the series of matchers. With on
+// set, the series match on the given labels, and the factor is the series
+// per combination of their values. Otherwise the series match ignoring the
+// given labels, and the factor is the number of combinations of their
+// values, as the other labels can't be enumerated. Combinations are counted
+// from the values of every label, assumed independent unless the index
+// tracks their co-occurrence, and are exact for a single label that all the
+// series have. The index must implement LabelValuesIndex.
+func EstimateJoinExpansion(index CardinalityIndex, matchers []*labels.Matcher, names []string, on bool) (JoinExpansion, error) {
+	lvi, ok := index.(LabelValuesIndex)
+	if !ok {
+		return JoinExpansion{}, errors.New("index does not support label enumeration")
+	}
+	if err := checkMatchers(matchers); err != nil {
+		return JoinExpansion{}, err
+	}
+
+	e := JoinExpansion{Series: index.GetCardinality(matchers...)}
+	if e.Series == 0 {
+		return e, nil
+	}
+	combinations := distinctCombinations(index, lvi, matchers, names, e.Series)
+	if on {
+		e.Groups = combinations
+		e.Factor = float64(e.Series) / float64(combinations)
+	} else {
+		e.Groups = max(e.Series/combinations, 1)
+		e.Factor = float64(combinations)
+	}
+	return e, nil
+}
+
+// distinctCombinations estimates how many distinct combinations of values
+// of names the series of matchers have, between 1 and bound. Series
+// without a label count as a value of their own.
+func distinctCombinations(index CardinalityIndex, lvi LabelValuesIndex, matchers []*labels.Matcher, names []string, bound int64) int64 {
+	combinations := 1.0
+	for _, name := range names {
+		combinations *= float64(max(len(lvi.LabelValues(name, matchers...)), 1))
+	}
+
+	// Correct for correlated labels instead of assuming independence.
+	combinations *= CombinationsCorrection(index, names...)
+	return min(max(int64(math.Ceil(combinations)), 1), bound)
+}
@@ -0,0 +1,129 @@
+package cardinality
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality/sketchcore"
+	"slices"
+	"strings"
+)
+
+// dependencyTolerance is the relative sketch error tolerated when comparing
+// the joint and per-label distinct counts.
+const dependencyTolerance = 0.02
+
+// LabelDependency is a functional dependency between two labels: every
+// value of From comes with a single value of To, like instance and pod.
+type LabelDependency struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Mutual is set if To also determines From, which makes the labels 1:1.
+	Mutual bool `json:"mutual"`
+}
+
+// Determines reports whether every value of a is seen with a single value
+// of b, for labels with more than one value that appear together. Series
+// with a but not b don't count.
+func (c *CooccurrenceTracker) Determines(a, b string) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.determines(a, b)
+}
+
+func (c *CooccurrenceTracker) determines(a, b string) bool {
+	if a == b {
+		return false
+	}
+	da, db := c.distinctValues(a), c.distinctValues(b)
+	if da <= 1 || db <= 1 {
+		return false
+	}
+	joint := c.jointDistinct(a, b)
+	return joint > 0 && float64(joint) <= float64(da)*(1+dependencyTolerance)
+}
+
+// Dependencies returns the functional dependencies between the tracked
+// labels, ordered by From and To.
+func (c *CooccurrenceTracker) Dependencies() []LabelDependency {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.dependencies()
+}
+
+func (c *CooccurrenceTracker) dependencies() []LabelDependency {
+	var deps []LabelDependency
+	for pair := range c.pairs {
+		forward, backward := c.determines(pair.first, pair.second), c.determines(pair.second, pair.first)
+		if forward {
+			deps = append(deps, LabelDependency{From: pair.first, To: pair.second, Mutual: backward})
+		}
+		if backward {
+			deps = append(deps, LabelDependency{From: pair.second, To: pair.first, Mutual: forward})
+		}
+	}
+	slices.SortFunc(deps, func(a, b LabelDependency) int {
+		if c := strings.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		return strings.Compare(a.To, b.To)
+	})
+	return deps
+}
+
+// LabelAdvice returns label design advice derived from the dependencies:
+// 1:1 labels duplicate each other, and a label determined by another adds no
+// series when grouping by both.
+func (c *CooccurrenceTracker) LabelAdvice() []string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var advice []string
+	for _, dep := range c.dependencies() {
+		switch {
+		case dep.Mutual && dep.From < dep.To:
+			advice = append(advice, fmt.Sprintf("labels %q and %q are 1:1, one of them is redundant", dep.From, dep.To))
+		case !dep.Mutual:
+			advice = append(advice, fmt.Sprintf("every %q has a single %q, grouping by both is the same as grouping by %q", dep.From, dep.To, dep.From))
+		}
+	}
+	return advice
+}
+
+// skipDependent drops the matchers made redundant by an equality matcher on
+// a label determining theirs. When the series with the determining value
+// share a single value of the dependent label, a dependent matcher keeps
+// all of them or none. sharedFraction estimates the fraction it keeps: a
+// matcher keeping all of them, within the sketch error, is dropped, and
+// false is returned if it keeps none. Labels only mostly determined by
+// another, within the tolerance of Determines, can split the series of a
+// value, so matchers keeping only some are kept. Matchers that match "" are
+// kept too, as they also select series without the label.
+func skipDependent(c *CooccurrenceTracker, matchers []*labels.Matcher, sharedFraction func(eq, dependent *labels.Matcher) float64) ([]*labels.Matcher, bool) {
+	// Dropped matchers don't determine others, so that only one of two 1:1
+	// labels is dropped.
+	dropped := make([]bool, len(matchers))
+	kept := make([]*labels.Matcher, 0, len(matchers))
+	for i, m := range matchers {
+		var determinedBy *labels.Matcher
+		if !m.Matches("") {
+			for j, eq := range matchers {
+				if j != i && !dropped[j] && eq.Type == labels.MatchEqual && eq.Value != "" && c.Determines(eq.Name, m.Name) {
+					determinedBy = eq
+					break
+				}
+			}
+		}
+		if determinedBy == nil {
+			kept = append(kept, m)
+			continue
+		}
+		switch shared := sharedFraction(determinedBy, m); {
+		case shared <= sketchcore.SketchError:
+			return nil, false
+		case shared < 1-sketchcore.SketchError:
+			kept = append(kept, m)
+			continue
+		}
+		dropped[i] = true
+	}
+	return kept, true
+}
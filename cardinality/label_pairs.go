@@ -0,0 +1,56 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// labelPairs are the pairs of label names an index keeps composite
+// postings or sketches for, configured WithLabelPairs.
+type labelPairs [][2]string
+
+// pairKey identifies the values of a configured pair.
+type pairKey struct {
+	pair   int
+	values [2]string
+}
+
+// forEach calls fn for every configured pair the series has both labels of.
+func (p labelPairs) forEach(lbls labels.Labels, fn func(key pairKey)) {
+	for i, names := range p {
+		a, b := lbls.Get(names[0]), lbls.Get(names[1])
+		if a != "" && b != "" {
+			fn(pairKey{pair: i, values: [2]string{a, b}})
+		}
+	}
+}
+
+// match finds equality matchers on both labels of a configured pair. It
+// returns the key of their values and the other matchers.
+func (p labelPairs) match(matchers []*labels.Matcher) (pairKey, []*labels.Matcher, bool) {
+	for i, names := range p {
+		first, second := -1, -1
+		for j, m := range matchers {
+			if m.Type != labels.MatchEqual || m.Value == "" {
+				continue
+			}
+			switch m.Name {
+			case names[0]:
+				first = j
+			case names[1]:
+				second = j
+			}
+		}
+		if first < 0 || second < 0 {
+			continue
+		}
+
+		rest := make([]*labels.Matcher, 0, len(matchers)-2)
+		for j, m := range matchers {
+			if j != first && j != second {
+				rest = append(rest, m)
+			}
+		}
+		return pairKey{pair: i, values: [2]string{matchers[first].Value, matchers[second].Value}}, rest, true
+	}
+	return pairKey{}, nil, false
+}
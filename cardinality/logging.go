@@ -0,0 +1,60 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"log/slog"
+	"time"
+)
+
+// LoggingIndex wraps an index and logs the matcher evaluations that take
+// longer than a threshold at debug level, to find the selectors that are
+// expensive to estimate.
+type LoggingIndex struct {
+	index     CardinalityIndex
+	logger    *slog.Logger
+	threshold time.Duration
+}
+
+// NewLoggingIndex returns an index logging the evaluations of index slower
+// than threshold to logger.
+func NewLoggingIndex(index CardinalityIndex, logger *slog.Logger, threshold time.Duration) *LoggingIndex {
+	return &LoggingIndex{index: index, logger: logger, threshold: threshold}
+}
+
+func (l *LoggingIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	l.index.AddSeries(lbls, ref)
+}
+
+func (l *LoggingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return l.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (l *LoggingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	start := time.Now()
+	card := GetCardinalityContext(ctx, l.index, matchers...)
+	l.logSlow(ctx, start, matchers, card, nil)
+	return card
+}
+
+func (l *LoggingIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	start := time.Now()
+	card, err := GetCardinalityChecked(ctx, l.index, matchers...)
+	l.logSlow(ctx, start, matchers, card, err)
+	return card, err
+}
+
+// logSlow logs the evaluation started at start if it took longer than the
+// threshold.
+func (l *LoggingIndex) logSlow(ctx context.Context, start time.Time, matchers []*labels.Matcher, card int64, err error) {
+	took := time.Since(start)
+	if took <= l.threshold {
+		return
+	}
+	args := []any{"matchers", matcherStrings(matchers), "cardinality", card, "duration", took}
+	if err != nil {
+		args = append(args, "err", err)
+	}
+	l.logger.DebugContext(ctx, "Slow matcher evaluation", args...)
+}
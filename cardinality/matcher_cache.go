@@ -0,0 +1,168 @@
+package cardinality
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"sync"
+)
+
+// MatcherCacheStats describes the use of a MatcherCache.
+type MatcherCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Size      int   `json:"size"`
+}
+
+type matcherKey struct {
+	t     labels.MatchType
+	name  string
+	value string
+}
+
+// matcherEntry is a cached matcher with its key, to delete it once evicted.
+type matcherEntry struct {
+	key     matcherKey
+	matcher *labels.Matcher
+}
+
+// MatcherCache keeps the most recently used regex matchers, so that the
+// patterns repeated by dashboards are compiled once instead of on every
+// request. Matchers are immutable, so cached matchers can be shared by
+// concurrent queries. It is safe for concurrent use.
+type MatcherCache struct {
+	size int
+
+	mtx       sync.Mutex
+	entries   map[matcherKey]*list.Element
+	lru       *list.List
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// NewMatcherCache returns a cache holding up to size regex matchers.
+func NewMatcherCache(size int) *MatcherCache {
+	return &MatcherCache{
+		size:    size,
+		entries: make(map[matcherKey]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// NewMatcher returns a matcher like labels.NewMatcher. Regex matchers are
+// served from the cache, other matchers are cheap to build and aren't
+// cached.
+func (c *MatcherCache) NewMatcher(t labels.MatchType, name, value string) (*labels.Matcher, error) {
+	if t != labels.MatchRegexp && t != labels.MatchNotRegexp {
+		return labels.NewMatcher(t, name, value)
+	}
+
+	key := matcherKey{t: t, name: name, value: value}
+	if m, ok := c.get(key); ok {
+		return m, nil
+	}
+	// Compile without holding the lock, concurrent misses on the same
+	// pattern keep the first matcher stored.
+	m, err := labels.NewMatcher(t, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(key, m), nil
+}
+
+// ParseSelector is like the function ParseSelector, normalizing the
+// matchers with the cache, see NormalizeMatchers.
+func (c *MatcherCache) ParseSelector(selector string) ([]*labels.Matcher, error) {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return c.NormalizeMatchers(matchers)
+}
+
+// NormalizeMatchers is like the function NormalizeMatchers, serving the
+// regex matchers from the cache. Parsers compile the regexes they parse,
+// so a miss costs no more than normalizing, while the matchers of hits,
+// compiled once, are shared by the queries repeating the pattern, and
+// anchored patterns aren't compiled again once normalized.
+func (c *MatcherCache) NormalizeMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	normalized := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		if m == nil || (m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp) {
+			normalized[i] = m
+			continue
+		}
+		key := matcherKey{t: m.Type, name: m.Name, value: stripAnchors(m.Value)}
+		if cached, ok := c.get(key); ok {
+			normalized[i] = cached
+			continue
+		}
+		if key.value != m.Value || m.GetRegexString() == "" {
+			rebuilt, err := labels.NewMatcher(m.Type, m.Name, key.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex of %s: %w", m.Name, err)
+			}
+			m = rebuilt
+		}
+		normalized[i] = c.add(key, m)
+	}
+	return normalized, nil
+}
+
+// get returns the cached matcher of the key, counting a hit or a miss.
+func (c *MatcherCache) get(key matcherKey) (*labels.Matcher, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(*matcherEntry).matcher, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// add caches the matcher of the key and returns it, or the matcher cached
+// meanwhile by a concurrent miss.
+func (c *MatcherCache) add(key matcherKey, m *labels.Matcher) *labels.Matcher {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*matcherEntry).matcher
+	}
+	if c.size <= 0 {
+		return m
+	}
+	c.entries[key] = c.lru.PushFront(&matcherEntry{key: key, matcher: m})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*matcherEntry).key)
+		c.evictions++
+	}
+	return m
+}
+
+// MustNewMatcher is like NewMatcher but panics if the pattern is invalid.
+func (c *MatcherCache) MustNewMatcher(t labels.MatchType, name, value string) *labels.Matcher {
+	m, err := c.NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Stats returns the cache statistics.
+func (c *MatcherCache) Stats() MatcherCacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return MatcherCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Size:      c.lru.Len(),
+	}
+}
@@ -0,0 +1,412 @@
+package cardinality
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MonitorRule is a selector a Monitor estimates on every evaluation, firing
+// an alert while its series are above a threshold or grow too fast.
+type MonitorRule struct {
+	// Name is the alertname of the alerts of the rule.
+	Name     string
+	Matchers []*labels.Matcher
+	// Threshold fires the rule while the selector has more series. Zero
+	// disables it.
+	Threshold int64
+	// MaxGrowth fires the rule while the selector gained more series over
+	// the last GrowthWindow, e.g. a deployment adding a label with a value
+	// per request. Zero disables it.
+	MaxGrowth    int64
+	GrowthWindow time.Duration
+	// Labels are added to the labels of the alerts, e.g. a team to route
+	// them to.
+	Labels map[string]string
+}
+
+// AlertState is the state of an Alert.
+type AlertState string
+
+const (
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert is the state of a MonitorRule sent to notifiers.
+type Alert struct {
+	Rule     string     `json:"rule"`
+	State    AlertState `json:"state"`
+	Selector string     `json:"selector"`
+	// Series is the estimate of the selector, and Growth its change over
+	// the growth window of the rule.
+	Series int64 `json:"series"`
+	Growth int64 `json:"growth"`
+	// Reason says which limit of the rule was crossed.
+	Reason   string            `json:"reason,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	ActiveAt time.Time         `json:"active_at"`
+	// ResolvedAt is set once the alert is resolved.
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Notifier sends the alerts of a Monitor, e.g. to a webhook.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+// WebhookNotifier posts alerts as JSON in the format of the Alertmanager v2
+// API, so that it can post them to Alertmanager itself, at /api/v2/alerts,
+// as well as to any receiver of that format. The labels of an alert are
+// those of its rule, with the rule name as alertname and the selector; its
+// annotations hold the reason and the estimates.
+type WebhookNotifier struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type webhookAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// Notify implements Notifier.
+func (w *WebhookNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	payload := make([]webhookAlert, 0, len(alerts))
+	for _, a := range alerts {
+		lbls := map[string]string{"alertname": a.Rule, "selector": a.Selector}
+		maps.Copy(lbls, a.Labels)
+		annotations := map[string]string{
+			"series": strconv.FormatInt(a.Series, 10),
+			"growth": strconv.FormatInt(a.Growth, 10),
+		}
+		if a.Reason != "" {
+			annotations["summary"] = a.Reason
+		}
+		payload = append(payload, webhookAlert{Labels: lbls, Annotations: annotations, StartsAt: a.ActiveAt, EndsAt: a.ResolvedAt})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: unexpected status %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// MonitorOption configures a Monitor.
+type MonitorOption func(*monitorOptions)
+
+type monitorOptions struct {
+	notifiers   []Notifier
+	resendDelay time.Duration
+	logger      *slog.Logger
+}
+
+// WithNotifier adds a notifier the alerts are sent to.
+func WithNotifier(n Notifier) MonitorOption {
+	return func(o *monitorOptions) {
+		o.notifiers = append(o.notifiers, n)
+	}
+}
+
+// DefaultResendDelay is how long a Monitor waits before sending a firing
+// alert again by default, like Prometheus does.
+const DefaultResendDelay = time.Minute
+
+// WithResendDelay sets how long to wait before sending a firing alert again,
+// DefaultResendDelay by default. Alerts are sent when they fire and when
+// they resolve; receivers like Alertmanager also expect firing alerts to be
+// sent again periodically, and resolve those not sent within their
+// resolve_timeout. Zero never sends them again.
+func WithResendDelay(d time.Duration) MonitorOption {
+	return func(o *monitorOptions) {
+		o.resendDelay = d
+	}
+}
+
+// WithMonitorLogger sets the logger of the failed evaluations of Run. It
+// defaults to slog.Default.
+func WithMonitorLogger(logger *slog.Logger) MonitorOption {
+	return func(o *monitorOptions) {
+		o.logger = logger
+	}
+}
+
+type sample struct {
+	t      time.Time
+	series int64
+}
+
+type ruleState struct {
+	rule     MonitorRule
+	selector string
+	// series is the last estimate, -1 before the first one.
+	series int64
+	// history holds the estimates of the growth window, oldest first.
+	history []sample
+	alert   *Alert
+	// sent is when the firing alert last reached a notifier, zero until it
+	// does.
+	sent time.Time
+	// resolved is the resolved alert until it reaches a notifier.
+	resolved *Alert
+}
+
+// Monitor evaluates rules against an index on a schedule and notifies when
+// their alerts fire and resolve, so that cardinality guarding integrates
+// into alerting pipelines. The firing alerts are also exported as the
+// cardinality_alerts metric, in the style of the ALERTS metric of
+// Prometheus, the Monitor being a prometheus.Collector. It is safe for
+// concurrent use if the index is.
+type Monitor struct {
+	index CardinalityIndex
+	opts  monitorOptions
+
+	mtx   sync.Mutex
+	rules []*ruleState
+	// sendMtx serializes evaluations, so that their alerts are sent and
+	// recorded as sent in order, without holding mtx while the estimates
+	// run and the notifiers block.
+	sendMtx sync.Mutex
+}
+
+// NewMonitor returns a monitor of the rules against index. Rule names must
+// be unique, and every rule needs matchers and a threshold or a growth
+// limit.
+func NewMonitor(index CardinalityIndex, rules []MonitorRule, opts ...MonitorOption) (*Monitor, error) {
+	m := &Monitor{index: index, opts: monitorOptions{resendDelay: DefaultResendDelay, logger: slog.Default()}}
+	for _, opt := range opts {
+		opt(&m.opts)
+	}
+	seen := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		switch _, dup := seen[r.Name]; {
+		case r.Name == "":
+			return nil, errors.New("monitor rule without a name")
+		case dup:
+			return nil, fmt.Errorf("duplicate monitor rule %q", r.Name)
+		case len(r.Matchers) == 0:
+			return nil, fmt.Errorf("monitor rule %q: no matchers", r.Name)
+		case r.Threshold < 0 || r.MaxGrowth < 0:
+			return nil, fmt.Errorf("monitor rule %q: negative limit", r.Name)
+		case r.Threshold == 0 && r.MaxGrowth == 0:
+			return nil, fmt.Errorf("monitor rule %q: no threshold or growth limit", r.Name)
+		case r.MaxGrowth > 0 && r.GrowthWindow <= 0:
+			return nil, fmt.Errorf("monitor rule %q: growth limit without a window", r.Name)
+		}
+		if err := checkMatchers(r.Matchers); err != nil {
+			return nil, fmt.Errorf("monitor rule %q: %w", r.Name, err)
+		}
+		seen[r.Name] = struct{}{}
+		m.rules = append(m.rules, &ruleState{rule: r, selector: "{" + matchersKey(r.Matchers) + "}", series: -1})
+	}
+	return m, nil
+}
+
+// Evaluate estimates every rule at now, and sends the alerts that fired or
+// resolved, and the firing alerts due to be sent again, to the notifiers.
+// It returns the alerts it sent, and the errors of the estimates and of the
+// notifiers. Rules whose estimate failed keep their state. Alerts are
+// recorded as sent once a notifier accepted them; alerts no notifier
+// accepted are sent again by the next evaluation. The estimates run and the
+// notifiers are called without holding the state of the monitor, so that a
+// slow index or receiver doesn't block Alerts and Collect.
+func (m *Monitor) Evaluate(ctx context.Context, now time.Time) ([]Alert, error) {
+	m.sendMtx.Lock()
+	defer m.sendMtx.Unlock()
+	var (
+		alerts []Alert
+		states []*ruleState
+		errs   []error
+	)
+	for _, s := range m.rules {
+		series, err := GetCardinalityChecked(ctx, m.index, s.rule.Matchers...)
+		if err != nil && !errors.Is(err, ErrUnknownLabel) {
+			errs = append(errs, fmt.Errorf("monitor rule %q: %w", s.rule.Name, err))
+			continue
+		}
+		m.mtx.Lock()
+		alert, ok := s.evaluate(now, series, m.opts.resendDelay)
+		m.mtx.Unlock()
+		if ok {
+			alerts = append(alerts, alert)
+			states = append(states, s)
+		}
+	}
+	if len(alerts) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	delivered := len(m.opts.notifiers) == 0
+	for _, n := range m.opts.notifiers {
+		if err := n.Notify(ctx, alerts); err != nil {
+			errs = append(errs, fmt.Errorf("notify: %w", err))
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		m.mtx.Lock()
+		for i, s := range states {
+			s.delivered(alerts[i], now)
+		}
+		m.mtx.Unlock()
+	}
+	return alerts, errors.Join(errs...)
+}
+
+// evaluate records the estimate of the rule at now, and returns its alert
+// if it is to be sent, which includes a resolved alert that didn't reach a
+// notifier yet.
+func (s *ruleState) evaluate(now time.Time, series int64, resendDelay time.Duration) (Alert, bool) {
+	s.series = series
+	var growth int64
+	if s.rule.MaxGrowth > 0 {
+		// The oldest estimate within the window is the baseline, which
+		// takes estimates of only part of the window after a restart.
+		start := now.Add(-s.rule.GrowthWindow)
+		i := 0
+		for i < len(s.history) && s.history[i].t.Before(start) {
+			i++
+		}
+		s.history = append(s.history[i:], sample{now, series})
+		growth = series - s.history[0].series
+	}
+
+	var reason string
+	switch {
+	case s.rule.Threshold > 0 && series > s.rule.Threshold:
+		reason = fmt.Sprintf("%d series exceed the threshold of %d", series, s.rule.Threshold)
+	case s.rule.MaxGrowth > 0 && growth > s.rule.MaxGrowth:
+		reason = fmt.Sprintf("%d series added within %s exceed the limit of %d", growth, s.rule.GrowthWindow, s.rule.MaxGrowth)
+	}
+
+	switch {
+	case reason != "" && s.alert == nil:
+		s.alert = &Alert{
+			Rule:     s.rule.Name,
+			State:    AlertFiring,
+			Selector: s.selector,
+			Labels:   s.rule.Labels,
+			ActiveAt: now,
+		}
+		s.sent, s.resolved = time.Time{}, nil
+	case reason != "":
+		if !s.sent.IsZero() && (resendDelay == 0 || now.Sub(s.sent) < resendDelay) {
+			s.alert.Series, s.alert.Growth, s.alert.Reason = series, growth, reason
+			return Alert{}, false
+		}
+	case s.alert != nil:
+		alert := *s.alert
+		alert.State, alert.Series, alert.Growth, alert.Reason, alert.ResolvedAt = AlertResolved, series, growth, "", &now
+		s.alert, s.resolved = nil, &alert
+		return alert, true
+	case s.resolved != nil:
+		return *s.resolved, true
+	default:
+		return Alert{}, false
+	}
+	s.alert.Series, s.alert.Growth, s.alert.Reason = series, growth, reason
+	return *s.alert, true
+}
+
+// delivered records that alert, returned by evaluate at now, reached a
+// notifier.
+func (s *ruleState) delivered(alert Alert, now time.Time) {
+	switch {
+	case alert.State == AlertFiring && s.alert != nil && s.alert.ActiveAt.Equal(alert.ActiveAt):
+		s.sent = now
+	case alert.State == AlertResolved && s.resolved != nil && s.resolved.ActiveAt.Equal(alert.ActiveAt):
+		s.resolved = nil
+	}
+}
+
+// Alerts returns the firing alerts, sorted by rule.
+func (m *Monitor) Alerts() []Alert {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var alerts []Alert
+	for _, s := range m.rules {
+		if s.alert != nil {
+			alerts = append(alerts, *s.alert)
+		}
+	}
+	slices.SortFunc(alerts, func(a, b Alert) int { return cmp.Compare(a.Rule, b.Rule) })
+	return alerts
+}
+
+// Run evaluates the rules every interval until ctx is done. Failed
+// evaluations are logged.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := m.Evaluate(ctx, now); err != nil {
+				m.opts.logger.Error("Failed to evaluate monitor rules", "err", err)
+			}
+		}
+	}
+}
+
+var (
+	monitorAlertsDesc = prometheus.NewDesc("cardinality_alerts",
+		"Firing alerts of the cardinality monitor, like the ALERTS metric of Prometheus.", []string{"alertname", "alertstate", "selector"}, nil)
+	monitorSeriesDesc = prometheus.NewDesc("cardinality_monitor_series",
+		"Last estimate of the selector of a monitor rule.", []string{"rule", "selector"}, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (m *Monitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- monitorAlertsDesc
+	ch <- monitorSeriesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *Monitor) Collect(ch chan<- prometheus.Metric) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, s := range m.rules {
+		if s.alert != nil {
+			ch <- prometheus.MustNewConstMetric(monitorAlertsDesc, prometheus.GaugeValue, 1, s.rule.Name, string(AlertFiring), s.selector)
+		}
+		if s.series >= 0 {
+			ch <- prometheus.MustNewConstMetric(monitorSeriesDesc, prometheus.GaugeValue, float64(s.series), s.rule.Name, s.selector)
+		}
+	}
+}
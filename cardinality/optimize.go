@@ -0,0 +1,109 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"time"
+)
+
+// OptimizeStats reports a pass of the bitmap optimizer.
+type OptimizeStats struct {
+	// Labels is the number of labels whose bitmaps were optimized, and
+	// Remaining the number of cold labels left for the next pass because
+	// the budget ran out.
+	Labels    int `json:"labels"`
+	Remaining int `json:"remaining"`
+	Bitmaps   int `json:"bitmaps"`
+	// BytesBefore and BytesAfter are the serialized sizes of the optimized
+	// bitmaps.
+	BytesBefore int64         `json:"bytes_before"`
+	BytesAfter  int64         `json:"bytes_after"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// Saved returns the number of bytes saved by the pass.
+func (s OptimizeStats) Saved() int64 {
+	return s.BytesBefore - s.BytesAfter
+}
+
+// Optimize compacts the bitmaps of the cold labels, the labels no series
+// was added to for coldAfter, that changed since they were last optimized.
+// Bitmaps built from series added in random order end up with containers
+// that hold long runs as arrays or bitsets; RunOptimize converts them to run
+// containers where that is smaller. Labels are optimized one at a time,
+// only blocking the queries on the label being optimized, until the pass
+// took budget; the remaining labels are left for the next pass. A zero
+// budget is unlimited.
+func (b *BitmapIndex) Optimize(coldAfter, budget time.Duration) OptimizeStats {
+	start := time.Now()
+	cutoff := b.now().Add(-coldAfter).UnixNano()
+
+	var stats OptimizeStats
+	b.optimize(&stats, start, cutoff, budget)
+	b.metricsMtx.RLock()
+	for _, sub := range b.metrics {
+		sub.optimize(&stats, start, cutoff, budget)
+	}
+	b.metricsMtx.RUnlock()
+	stats.Duration = time.Since(start)
+	return stats
+}
+
+// optimize optimizes the cold labels of the index, adding to stats.
+func (b *BitmapIndex) optimize(stats *OptimizeStats, start time.Time, cutoff int64, budget time.Duration) {
+	b.forEachShard(func(_ string, s *labelShard) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.modified > cutoff || s.modified == s.optimized {
+			return
+		}
+		if budget > 0 && time.Since(start) > budget {
+			stats.Remaining++
+			return
+		}
+		s.forEachBitmap(func(bitmap *roaring64.Bitmap) {
+			stats.BytesBefore += int64(bitmap.GetSizeInBytes())
+			bitmap.RunOptimize()
+			stats.BytesAfter += int64(bitmap.GetSizeInBytes())
+			stats.Bitmaps++
+		})
+		s.optimized = s.modified
+		stats.Labels++
+	})
+}
+
+// forEachBitmap calls fn with every bitmap of the shard on the heap. The
+// caller must hold the lock.
+func (s *labelShard) forEachBitmap(fn func(*roaring64.Bitmap)) {
+	fn(s.present)
+	for _, v := range s.values {
+		if v.segment == nil {
+			fn(v.postings)
+		}
+	}
+	if s.bucketed != nil {
+		for _, bitmap := range s.bucketed.Buckets {
+			fn(bitmap)
+		}
+	}
+}
+
+// RunOptimizer runs an Optimize pass every interval until ctx is done, and
+// logs the space saved by each pass that optimized bitmaps.
+func (b *BitmapIndex) RunOptimizer(ctx context.Context, interval, coldAfter, budget time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if stats := b.Optimize(coldAfter, budget); stats.Labels > 0 {
+			b.logger.Debug("Optimized bitmaps", "labels", stats.Labels, "remaining", stats.Remaining,
+				"bitmaps", stats.Bitmaps, "saved_bytes", stats.Saved(), "duration", stats.Duration)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package cardinality
+
+import (
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/relabel"
+	"log/slog"
+	"time"
+)
+
+// Option configures optional behaviour of an index at construction time.
+type Option func(*options)
+
+type options struct {
+	dedup         bool
+	cooccurrence  bool
+	bucketing     bucketing
+	allocateRefs  bool
+	valueTTL      time.Duration
+	deltas        bool
+	seriesHashes  bool
+	sampleEvery   int
+	seriesTypes   bool
+	activeSeries  bool
+	symbols       *SymbolTable
+	labelPairs    labelPairs
+	metricIndex   bool
+	coldTierDir   string
+	targetError   float64
+	relabel       []*relabel.Config
+	valueGuard    ValueGuard
+	seenFilter    seenFilterOptions
+	valuePresence bool
+	logger        *slog.Logger
+}
+
+type bucketing struct {
+	// threshold is the number of values above which a label is bucketed.
+	// Zero disables bucketing.
+	threshold int
+	buckets   int
+}
+
+func (b bucketing) shouldBucket(values int) bool {
+	return b.threshold > 0 && values > b.threshold
+}
+
+type seenFilterOptions struct {
+	series   int
+	interval time.Duration
+}
+
+func defaultOptions() options {
+	return options{
+		dedup:  true,
+		logger: promslog.NewNopLogger(),
+	}
+}
+
+func applyOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithoutDeduplication disables the seen-set used to make AddSeries
+// idempotent. This saves 8 bytes plus map overhead per series, at the cost
+// of re-processing series that are added more than once.
+func WithoutDeduplication() Option {
+	return func(o *options) {
+		o.dedup = false
+	}
+}
+
+// WithCooccurrenceTracking makes the index maintain a CooccurrenceTracker,
+// available via its Cooccurrence method.
+func WithCooccurrenceTracking() Option {
+	return func(o *options) {
+		o.cooccurrence = true
+	}
+}
+
+// WithValueBuckets bounds the memory used by ultra-high-cardinality labels.
+// Once a label has more than threshold distinct values, its values are hashed
+// into the given number of buckets holding one bitmap or sketch each, trading
+// per-value accuracy for bounded memory. Equality and regex set matchers
+// on a bucketed label over-count by the series sharing a bucket with their
+// values; other matchers select every series with the label. The values of
+// bucketed labels aren't kept, so LabelValues returns none for them.
+func WithValueBuckets(threshold, buckets int) Option {
+	return func(o *options) {
+		o.bucketing = bucketing{threshold: threshold, buckets: max(buckets, 1)}
+	}
+}
+
+// WithAllocatedRefs makes a BitmapIndex assign its own series refs, keyed by
+// the labels of the series, and ignore the refs passed to AddSeries. This
+// allows using the index with ingestion sources that don't have series refs,
+// like remote write. It implies deduplication.
+func WithAllocatedRefs() Option {
+	return func(o *options) {
+		o.allocateRefs = true
+	}
+}
+
+// WithValueTTL makes a BitmapIndex track when every label value was last
+// added, so that values not seen for longer than ttl can be dropped with
+// EvictStale. Re-adding a known series refreshes its values. Values of
+// bucketed labels are never evicted.
+func WithValueTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.valueTTL = ttl
+	}
+}
+
+// WithDeltaTracking makes a HyperMinHashIndex remember which sketches were
+// modified, so that only those are exported by ExportDelta.
+func WithDeltaTracking() Option {
+	return func(o *options) {
+		o.deltas = true
+	}
+}
+
+// WithSeriesHashes makes a BitmapIndex keep the labels hash of every
+// series, at 16 bytes plus map overhead per series, so that it can estimate
+// the series of every query shard with ShardCardinalities, and a table
+// RefSpace can give a series merged from several sources a single ref.
+func WithSeriesHashes() Option {
+	return func(o *options) {
+		o.seriesHashes = true
+	}
+}
+
+// WithSeriesSamples makes a BitmapIndex keep the labels of one in every
+// series, chosen by their labels hash, so that SampleSeries can show
+// example series of a selector. With every set to 1 the labels of all
+// series are kept, which can take more memory than the index itself.
+func WithSeriesSamples(every int) Option {
+	return func(o *options) {
+		o.sampleEvery = max(every, 1)
+	}
+}
+
+// WithSeriesTypes makes a BitmapIndex keep the type of the series added with
+// AddTypedSeries, the bucket count of native histograms and whether series
+// have exemplars, so that GetCardinalityByType can tell what the series of
+// a selector cost to store. Only native histogram series and series with
+// exemplars take memory.
+func WithSeriesTypes() Option {
+	return func(o *options) {
+		o.seriesTypes = true
+	}
+}
+
+// WithActiveSeries makes a BitmapIndex keep the timestamp of the latest
+// sample of the series added with AddSeriesSample, at 16 bytes plus map
+// overhead per series, so that GetActiveCardinality can count the series
+// that are still receiving samples.
+func WithActiveSeries() Option {
+	return func(o *options) {
+		o.activeSeries = true
+	}
+}
+
+// WithSymbolTable makes a BitmapIndex store its label values in the given
+// symbol table instead of its own, so that indexes holding the same values,
+// like the indexes of several tenants, store every string once.
+func WithSymbolTable(symbols *SymbolTable) Option {
+	return func(o *options) {
+		o.symbols = symbols
+	}
+}
+
+// WithLabelPairs makes an index keep the series of every combination of
+// values of the given pairs of label names, like __name__ and pod. Queries
+// with equality matchers on both labels of a pair start from those series
+// instead of intersecting the two labels, which is faster for a
+// BitmapIndex and much more accurate for a HyperMinHashIndex. Every
+// combination of values costs a bitmap or a sketch.
+func WithLabelPairs(pairs ...[2]string) Option {
+	return func(o *options) {
+		o.labelPairs = append(o.labelPairs, pairs...)
+	}
+}
+
+// WithMetricNameIndex makes a BitmapIndex or HyperMinHashIndex keep a
+// sub-index per metric name, holding the labels of the series of that metric
+// only. Queries with an equality matcher on __name__, most of them, evaluate
+// their other matchers on the values of the metric instead of the values of
+// all metrics, which for sketches also makes the estimate more accurate.
+// Other queries fall back to the structures of all metrics. The postings or
+// sketches of every series are stored twice, and metrics can be evicted as a
+// whole with EvictMetric.
+func WithMetricNameIndex() Option {
+	return func(o *options) {
+		o.metricIndex = true
+	}
+}
+
+// WithColdTier makes a BitmapIndex able to move the postings of label values
+// that aren't in use to memory-mapped files in dir, see Tier. Segment files
+// left in dir by an earlier process are removed.
+func WithColdTier(dir string) Option {
+	return func(o *options) {
+		o.coldTierDir = dir
+	}
+}
+
+// WithAccuracyTarget makes a HyperMinHashIndex keep label values as exact
+// sets of series hashes instead of sketches while that is cheaper, or, for
+// targets below the error of sketches, sketchcore.SketchError, up to a
+// bounded size. Most values have few series, so memory goes to the
+// sketches of the values with many series. Queries still merge the sets
+// into sketches, so answers keep the error of sketches. See
+// sketchcore.Index.SetAccuracyTarget.
+func WithAccuracyTarget(relErr float64) Option {
+	return func(o *options) {
+		o.targetError = relErr
+	}
+}
+
+// WithRelabelConfigs makes a BitmapIndex or HyperMinHashIndex apply the
+// relabel rules to the labels of every series before indexing it, so that
+// noisy labels like trace_id can be kept out of the index, or labels
+// renamed. Series the rules drop, or leave without labels, are ignored.
+func WithRelabelConfigs(rules ...*relabel.Config) Option {
+	return func(o *options) {
+		o.relabel = append(o.relabel, rules...)
+	}
+}
+
+// WithValueGuard makes a BitmapIndex or HyperMinHashIndex flag the label
+// values that look unbounded as series are added, after relabeling, and
+// report them with UnboundedLabels. Flagged values are replaced by buckets
+// if the guard has any, keeping identifiers from blowing up the index.
+func WithValueGuard(guard ValueGuard) Option {
+	return func(o *options) {
+		o.valueGuard = guard
+	}
+}
+
+// WithLogger sets the logger of the index, which logs events like labels
+// being bucketed and errors reading the underlying storage. Nothing is
+// logged by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithSeenFilter makes AddSeries skip the series it added within the last
+// interval before doing any work, relabelling included, according to a
+// Bloom filter sized for the given number of series at 1.2 bytes each.
+// This is for callers adding every sample of every series, like a remote
+// write adapter, which would otherwise pay for a lookup and locks per
+// sample. Skipped series don't refresh their last sample or the last time
+// their values were seen, so interval should be at most half the window
+// of GetActiveCardinality and of WithValueTTL. About 1% of the new series
+// are taken for known until the next reset once the filter holds the
+// series it was sized for, so a filter that is never reset would drop
+// them for good; an interval that isn't positive disables the filter.
+func WithSeenFilter(series int, interval time.Duration) Option {
+	return func(o *options) {
+		o.seenFilter = seenFilterOptions{series: series, interval: interval}
+	}
+}
+
+// WithValuePresence makes a BitmapIndex keep a cuckoo filter of the values
+// of every label, at 2 to 4 bytes per value, telling whether a value
+// exists without a lookup in the shared symbol table. Equality matchers on
+// absent values, common for selectors of series that went away, and the
+// absent values of regex set matches like a|b|c are answered from the
+// filter alone.
+func WithValuePresence() Option {
+	return func(o *options) {
+		o.valuePresence = true
+	}
+}
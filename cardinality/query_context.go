@@ -0,0 +1,193 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"harry671003/hello/cardinality/sketchcore"
+	"sync"
+	"time"
+)
+
+// ErrMemoryBudgetExceeded is reported by QueryContext.Err when a query
+// needed more memory than its budget. It wraps ErrBudgetExceeded.
+var ErrMemoryBudgetExceeded = fmt.Errorf("query memory %w", ErrBudgetExceeded)
+
+// QueryContext carries the scratch bitmaps and sketches of queries and
+// their memory budget. The scratch structures are reused by the queries run
+// with the same QueryContext, so high QPS servers can keep one per worker or
+// take them from AcquireQueryContext instead of allocating them for every
+// query. It is passed to GetCardinalityContext with ContextWithQuery. A
+// QueryContext is not safe for concurrent use.
+type QueryContext struct {
+	maxBytes int64
+	used     int64
+	err      error
+
+	limits QueryLimits
+	// truncated is set for queries whose estimates ran on QueryContexts of
+	// their own, see Executor. Other queries count their work against the
+	// limits of the scratch sketches, whether they merge sketches or not.
+	truncated bool
+
+	bitmaps     []*roaring64.Bitmap
+	usedBitmaps int
+	sketches    sketchcore.Scratch
+}
+
+// NewQueryContext returns a QueryContext allowing every query maxBytes of
+// scratch memory. Zero disables the budget.
+func NewQueryContext(maxBytes int64) *QueryContext {
+	return &QueryContext{maxBytes: maxBytes}
+}
+
+// QueryLimits bounds the work of a query, e.g. against regexes like
+// ".*.*.*" on labels with millions of values. A query reaching a limit stops
+// early and answers an upper bound of its cardinality: matchers it couldn't
+// evaluate select every series with their label, and matchers it didn't
+// intersect are left out. QueryContext.Truncated reports such answers.
+// Zero values are unlimited. The limits are enforced by BitmapIndex and
+// HyperMinHashIndex.
+type QueryLimits struct {
+	// MaxValuesScanned bounds the label values a single matcher is
+	// compared against.
+	MaxValuesScanned int `json:"max_values_scanned,omitempty"`
+	// MaxMerges bounds the bitmaps or sketches merged by a query.
+	MaxMerges int `json:"max_merges,omitempty"`
+	// Timeout bounds the time spent scanning label values.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// SetLimits sets the limits of the queries run with the QueryContext.
+func (q *QueryContext) SetLimits(limits QueryLimits) {
+	q.limits = limits
+}
+
+// Truncated reports whether the last query reached one of its QueryLimits,
+// so its answer is an upper bound.
+func (q *QueryContext) Truncated() bool {
+	return q != nil && (q.truncated || q.sketches.Truncated())
+}
+
+var queryContextPool = sync.Pool{
+	New: func() any { return &QueryContext{} },
+}
+
+// AcquireQueryContext returns a QueryContext from a pool, with the given
+// budget. It must be returned with Release.
+func AcquireQueryContext(maxBytes int64) *QueryContext {
+	q := queryContextPool.Get().(*QueryContext)
+	q.maxBytes = maxBytes
+	return q
+}
+
+// Release returns the QueryContext to the pool. It must not be used
+// afterwards.
+func (q *QueryContext) Release() {
+	q.limits = QueryLimits{}
+	q.begin()
+	queryContextPool.Put(q)
+}
+
+// Err returns the error of the last query, wrapping ErrMemoryBudgetExceeded
+// if it ran out of budget. Such queries return 0.
+func (q *QueryContext) Err() error {
+	return q.err
+}
+
+// begin resets the budget and makes the scratch structures available to a
+// new query. It is safe to call on a nil QueryContext.
+func (q *QueryContext) begin() {
+	if q == nil {
+		return
+	}
+	q.used, q.err = 0, nil
+	q.usedBitmaps = 0
+	q.truncated = false
+	var deadline time.Time
+	if q.limits.Timeout > 0 {
+		deadline = time.Now().Add(q.limits.Timeout)
+	}
+	q.sketches.Reset()
+	q.sketches.SetLimits(q.limits.MaxValuesScanned, q.limits.MaxMerges, deadline)
+}
+
+// beginMatcher resets the values scanned, which are limited per matcher. It
+// is safe to call on a nil QueryContext.
+func (q *QueryContext) beginMatcher() {
+	if q != nil {
+		q.sketches.Limits().BeginMatcher()
+	}
+}
+
+// scan counts a label value compared against a matcher and reports whether
+// the query is within its limits. It is safe to call on a nil QueryContext.
+func (q *QueryContext) scan() bool {
+	return q == nil || q.sketches.Limits().Scan()
+}
+
+// merge counts a merged bitmap and reports whether the query is within its
+// limits. It is safe to call on a nil QueryContext.
+func (q *QueryContext) merge() bool {
+	return q == nil || q.sketches.Limits().Merge()
+}
+
+// bitmap returns an empty bitmap. It is safe to call on a nil QueryContext.
+func (q *QueryContext) bitmap() *roaring64.Bitmap {
+	if q == nil {
+		return roaring64.NewBitmap()
+	}
+	if q.usedBitmaps == len(q.bitmaps) {
+		q.bitmaps = append(q.bitmaps, roaring64.NewBitmap())
+	} else {
+		q.bitmaps[q.usedBitmaps].Clear()
+	}
+	b := q.bitmaps[q.usedBitmaps]
+	q.usedBitmaps++
+	return b
+}
+
+// scratch returns the scratch sketches, or nil on a nil QueryContext.
+func (q *QueryContext) scratch() *sketchcore.Scratch {
+	if q == nil {
+		return nil
+	}
+	return &q.sketches
+}
+
+// charge adds bytes to the memory used by the query and reports whether it
+// is still within the budget. It is safe to call on a nil QueryContext.
+func (q *QueryContext) charge(bytes int64) bool {
+	if q == nil {
+		return true
+	}
+	if q.err != nil {
+		return false
+	}
+	q.used += bytes
+	if q.maxBytes > 0 && q.used > q.maxBytes {
+		q.err = fmt.Errorf("%w: used %d bytes, budget is %d", ErrMemoryBudgetExceeded, q.used, q.maxBytes)
+		return false
+	}
+	return true
+}
+
+// exceeded reports whether the query ran out of budget. It is safe to call
+// on a nil QueryContext.
+func (q *QueryContext) exceeded() bool {
+	return q != nil && q.err != nil
+}
+
+type queryContextKey struct{}
+
+// ContextWithQuery returns a context carrying q, for GetCardinalityContext
+// to use its scratch structures and budget.
+func ContextWithQuery(ctx context.Context, q *QueryContext) context.Context {
+	return context.WithValue(ctx, queryContextKey{}, q)
+}
+
+// QueryFromContext returns the QueryContext of ctx, or nil.
+func QueryFromContext(ctx context.Context) *QueryContext {
+	q, _ := ctx.Value(queryContextKey{}).(*QueryContext)
+	return q
+}
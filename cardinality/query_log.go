@@ -0,0 +1,175 @@
+package cardinality
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"io"
+	"slices"
+	"time"
+)
+
+// maxQueryLogLine bounds the length of a query log line. Generated
+// dashboards send queries of hundreds of kilobytes.
+const maxQueryLogLine = 4 << 20
+
+// queryLogEntry is the part of a Prometheus query log line the replay reads.
+type queryLogEntry struct {
+	Params struct {
+		Query string `json:"query"`
+	} `json:"params"`
+}
+
+// ReplayedSelector is a selector of a replayed query log.
+type ReplayedSelector struct {
+	Selector string `json:"selector"`
+	// Queries counts the queries of the log using the selector.
+	Queries  int           `json:"queries"`
+	Estimate int64         `json:"estimate"`
+	Duration time.Duration `json:"duration"`
+	// Actual and Error are only set when the replay has a reference index.
+	Actual int64   `json:"actual,omitempty"`
+	Error  float64 `json:"error,omitempty"`
+}
+
+// CardinalityBucket counts the selectors estimated to select at most
+// UpperBound series, and more than the upper bound of the previous bucket.
+type CardinalityBucket struct {
+	UpperBound int64 `json:"upper_bound"`
+	Selectors  int   `json:"selectors"`
+}
+
+// QueryLogReport summarizes the replay of a query log.
+type QueryLogReport struct {
+	Queries int `json:"queries"`
+	// Skipped counts the lines that hold no query or whose query fails to
+	// parse.
+	Skipped   int `json:"skipped"`
+	Selectors int `json:"selectors"`
+	// Distribution buckets the distinct selectors by estimate, in powers of
+	// 10. Buckets above the largest estimate are left out.
+	Distribution []CardinalityBucket `json:"distribution"`
+	// Slowest holds the selectors that took the longest to estimate.
+	Slowest []ReplayedSelector `json:"slowest"`
+	// Worst holds the selectors whose estimates are the furthest off the
+	// reference, and MeanAbsError and MaxAbsError the mean and largest
+	// relative errors of all selectors. They are only set when the replay
+	// has a reference index.
+	Worst        []ReplayedSelector `json:"worst,omitempty"`
+	MeanAbsError float64            `json:"mean_abs_error,omitempty"`
+	MaxAbsError  float64            `json:"max_abs_error,omitempty"`
+}
+
+// ReplayQueryLog reads a Prometheus query log, as written by
+// --query.log-file, and estimates the selectors of its queries with index,
+// so that the accuracy and latency of an index can be judged on the real
+// query mix. Each distinct selector is estimated once. If reference isn't
+// nil, typically an exact index of the same series, the estimates are
+// compared to its answers. The report lists up to top selectors per ranking.
+func ReplayQueryLog(ctx context.Context, r io.Reader, index, reference CardinalityIndex, top int) (*QueryLogReport, error) {
+	report := &QueryLogReport{}
+	selectors := map[string]*ReplayedSelector{}
+	var order []*ReplayedSelector
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxQueryLogLine)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Params.Query == "" {
+			report.Skipped++
+			continue
+		}
+		expr, err := parser.ParseExpr(entry.Params.Query)
+		if err != nil {
+			report.Skipped++
+			continue
+		}
+		report.Queries++
+
+		for _, matchers := range parser.ExtractSelectors(expr) {
+			if normalized, err := NormalizeMatchers(matchers); err == nil {
+				matchers = normalized
+			}
+			key := "{" + matchersKey(matchers) + "}"
+			if s, ok := selectors[key]; ok {
+				s.Queries++
+				continue
+			}
+
+			s := &ReplayedSelector{Selector: key, Queries: 1}
+			start := time.Now()
+			s.Estimate = GetCardinalityContext(ctx, index, matchers...)
+			s.Duration = time.Since(start)
+			if reference != nil {
+				s.Actual = GetCardinalityContext(ctx, reference, matchers...)
+				s.Error = RelativeError(s.Estimate, s.Actual)
+			}
+			selectors[key] = s
+			order = append(order, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read query log: %w", err)
+	}
+
+	report.Selectors = len(order)
+	report.Distribution = cardinalityDistribution(order)
+	report.Slowest = topSelectors(order, top, func(a, b *ReplayedSelector) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	if reference != nil && len(order) > 0 {
+		var sum float64
+		for _, s := range order {
+			sum += s.Error
+			report.MaxAbsError = max(report.MaxAbsError, s.Error)
+		}
+		report.MeanAbsError = sum / float64(len(order))
+		report.Worst = topSelectors(order, top, func(a, b *ReplayedSelector) int {
+			return cmp.Compare(b.Error, a.Error)
+		})
+	}
+	return report, nil
+}
+
+// cardinalityDistribution buckets the selectors by estimate. The first
+// bucket holds the selectors without series.
+func cardinalityDistribution(selectors []*ReplayedSelector) []CardinalityBucket {
+	var buckets []CardinalityBucket
+	for _, s := range selectors {
+		i := 0
+		for bound := int64(0); s.Estimate > bound; i++ {
+			if bound == 0 {
+				bound = 1
+			} else {
+				bound *= 10
+			}
+		}
+		for len(buckets) <= i {
+			bound := int64(0)
+			if n := len(buckets); n > 0 {
+				bound = max(buckets[n-1].UpperBound*10, 1)
+			}
+			buckets = append(buckets, CardinalityBucket{UpperBound: bound})
+		}
+		buckets[i].Selectors++
+	}
+	return buckets
+}
+
+// topSelectors returns copies of the first n selectors in the order of
+// compare, ties kept in the order of the log.
+func topSelectors(selectors []*ReplayedSelector, n int, compare func(a, b *ReplayedSelector) int) []ReplayedSelector {
+	sorted := slices.Clone(selectors)
+	slices.SortStableFunc(sorted, compare)
+	top := make([]ReplayedSelector, 0, min(n, len(sorted)))
+	for _, s := range sorted[:min(n, len(sorted))] {
+		top = append(top, *s)
+	}
+	return top
+}
@@ -0,0 +1,57 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrSeriesHashesNotTracked is returned for query shard estimates from an
+// index not created WithSeriesHashes.
+var ErrSeriesHashesNotTracked = errors.New("series hashes are not tracked")
+
+// ShardCardinalities returns the number of series matching the matchers in
+// each of shardCount query shards. Series are assigned to shards like Mimir
+// query sharding does, by the hash of their labels modulo the shard count,
+// so query frontends can tell how evenly a query would be split.
+func (b *BitmapIndex) ShardCardinalities(shardCount int, matchers ...*labels.Matcher) ([]int64, error) {
+	if b.hashes == nil {
+		return nil, ErrSeriesHashesNotTracked
+	}
+	if shardCount < 1 {
+		return nil, errors.New("shard count must be positive")
+	}
+
+	shards := make([]int64, shardCount)
+	if len(matchers) == 0 {
+		return shards, nil
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return shards, nil
+	}
+	bitmap := b.getIntersectionBitmap(context.Background(), matchers)
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for it := bitmap.Iterator(); it.HasNext(); {
+		if hash, ok := b.hashes[it.Next()]; ok {
+			shards[hash%uint64(shardCount)]++
+		}
+	}
+	return shards, nil
+}
+
+// GetShardCardinality returns the number of series matching the matchers in
+// shard shardIndex of shardCount, counting shards from zero. Mimir's
+// __query_shard__ label value "1_of_16" is shard 0 of 16.
+func (b *BitmapIndex) GetShardCardinality(shardIndex, shardCount int, matchers ...*labels.Matcher) (int64, error) {
+	if shardIndex < 0 || shardIndex >= shardCount {
+		return 0, errors.New("shard index out of range")
+	}
+	shards, err := b.ShardCardinalities(shardCount, matchers...)
+	if err != nil {
+		return 0, err
+	}
+	return shards[shardIndex], nil
+}
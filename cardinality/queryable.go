@@ -0,0 +1,98 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+	"slices"
+)
+
+// SelectEstimate is the warning returned with the series of every Select of
+// a Queryable, telling how many series the selector would select. Callers
+// find it among the warnings with errors.As.
+type SelectEstimate struct {
+	Matchers []*labels.Matcher
+	Series   int64
+}
+
+func (e SelectEstimate) Error() string {
+	return fmt.Sprintf("selector {%s} selects an estimated %d series", matchersKey(e.Matchers), e.Series)
+}
+
+// Queryable is a storage.Queryable backed by an index, so that Prometheus
+// tooling, like the PromQL engine or query planners, can be pointed at the
+// index for dry runs. Selects return no series, only a SelectEstimate
+// warning; label names and values are answered by the index if it
+// implements LabelValuesIndex. The index has no notion of time, so the time
+// range of queriers is ignored.
+type Queryable struct {
+	index CardinalityIndex
+}
+
+// NewQueryable returns a Queryable answering from index.
+func NewQueryable(index CardinalityIndex) *Queryable {
+	return &Queryable{index: index}
+}
+
+func (q *Queryable) Querier(_, _ int64) (storage.Querier, error) {
+	return &indexQuerier{index: q.index}, nil
+}
+
+type indexQuerier struct {
+	index CardinalityIndex
+}
+
+func (q *indexQuerier) Select(ctx context.Context, _ bool, _ *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	series, err := GetCardinalityChecked(ctx, q.index, matchers...)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	var warnings annotations.Annotations
+	warnings.Add(SelectEstimate{Matchers: matchers, Series: series})
+	return estimateSeriesSet{warnings: warnings}
+}
+
+func (q *indexQuerier) LabelValues(_ context.Context, name string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	li, ok := q.index.(LabelValuesIndex)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: the index doesn't list label values", errors.ErrUnsupported)
+	}
+	return limitLabels(li.LabelValues(name, matchers...), hints), nil, nil
+}
+
+func (q *indexQuerier) LabelNames(_ context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	li, ok := q.index.(LabelValuesIndex)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: the index doesn't list label names", errors.ErrUnsupported)
+	}
+	return limitLabels(li.LabelNames(matchers...), hints), nil, nil
+}
+
+func (q *indexQuerier) Close() error {
+	return nil
+}
+
+// limitLabels sorts the label names or values, as queriers return them, and
+// applies the limit of the hints.
+func limitLabels(strs []string, hints *storage.LabelHints) []string {
+	strs = slices.Clone(strs)
+	slices.Sort(strs)
+	if hints != nil && hints.Limit > 0 && len(strs) > hints.Limit {
+		strs = strs[:hints.Limit]
+	}
+	return strs
+}
+
+// estimateSeriesSet is an empty series set carrying the estimate of the
+// selector as a warning.
+type estimateSeriesSet struct {
+	warnings annotations.Annotations
+}
+
+func (estimateSeriesSet) Next() bool                          { return false }
+func (estimateSeriesSet) At() storage.Series                  { return nil }
+func (estimateSeriesSet) Err() error                          { return nil }
+func (s estimateSeriesSet) Warnings() annotations.Annotations { return s.warnings }
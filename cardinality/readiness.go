@@ -0,0 +1,107 @@
+package cardinality
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReadinessState is the state of the initial load of an index.
+type ReadinessState string
+
+const (
+	ReadinessBuilding ReadinessState = "building"
+	ReadinessReady    ReadinessState = "ready"
+	ReadinessFailed   ReadinessState = "failed"
+)
+
+// StartKind tells how an index was loaded: a warm start restores the index
+// from a checkpoint and its WAL, while a cold start rebuilds it from the
+// TSDB head and blocks.
+type StartKind string
+
+const (
+	WarmStart StartKind = "warm"
+	ColdStart StartKind = "cold"
+)
+
+// ReadinessStatus describes the initial load of an index.
+type ReadinessStatus struct {
+	State ReadinessState `json:"state"`
+	// Start is how the index was loaded, once known.
+	Start    StartKind     `json:"start,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// Error is why the load failed, or why a warm start fell back to a cold
+	// one.
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness tracks the initial load of an index. An index answering before
+// its head, WAL or blocks are loaded badly undercounts, so servers report
+// themselves unready until Ready, keeping load balancers from routing
+// estimates to them.
+type Readiness struct {
+	now func() time.Time
+
+	mtx    sync.RWMutex
+	status ReadinessStatus
+}
+
+// NewReadiness returns a Readiness in the building state.
+func NewReadiness() *Readiness {
+	r := &Readiness{now: time.Now}
+	r.status = ReadinessStatus{State: ReadinessBuilding, Started: r.now()}
+	return r
+}
+
+// Load loads the index with warm, if not nil, falling back to cold if it
+// fails, e.g. because there is no checkpoint yet, and becomes ready once
+// either succeeded. cold must start from an empty index, as warm may have
+// failed halfway.
+func (r *Readiness) Load(ctx context.Context, warm, cold func(ctx context.Context) error) error {
+	var warmErr error
+	if warm != nil {
+		if warmErr = warm(ctx); warmErr == nil {
+			r.finish(WarmStart, nil, nil)
+			return nil
+		}
+	}
+	err := cold(ctx)
+	r.finish(ColdStart, warmErr, err)
+	return err
+}
+
+func (r *Readiness) finish(start StartKind, warmErr, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.status.Start = start
+	r.status.Duration = r.now().Sub(r.status.Started)
+	r.status.State = ReadinessReady
+	if warmErr != nil {
+		r.status.Error = warmErr.Error()
+	}
+	if err != nil {
+		r.status.State = ReadinessFailed
+		r.status.Error = err.Error()
+	}
+}
+
+// Ready reports whether the index finished loading.
+func (r *Readiness) Ready() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.status.State == ReadinessReady
+}
+
+// Status returns the state of the load. The duration of a load in progress
+// is the time spent so far.
+func (r *Readiness) Status() ReadinessStatus {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	status := r.status
+	if status.State == ReadinessBuilding {
+		status.Duration = r.now().Sub(status.Started)
+	}
+	return status
+}
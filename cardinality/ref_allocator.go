@@ -0,0 +1,93 @@
+package cardinality
+
+import (
+	"encoding/binary"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"hash/fnv"
+	"slices"
+)
+
+type allocatedRef struct {
+	// check is a second, independent hash of the labels used to tell apart
+	// series whose labels hash collides.
+	check uint64
+	ref   storage.SeriesRef
+}
+
+// refAllocator assigns monotonically increasing series refs to label sets,
+// for ingestion sources that don't have refs of their own. Series are keyed
+// by their labels hash; colliding hashes are told apart by a second hash, so
+// a wrong ref is only handed out if both 64-bit hashes collide.
+type refAllocator struct {
+	next      storage.SeriesRef
+	refs      map[uint64]allocatedRef
+	conflicts map[uint64][]allocatedRef
+}
+
+func newRefAllocator() *refAllocator {
+	return &refAllocator{
+		refs:      make(map[uint64]allocatedRef),
+		conflicts: make(map[uint64][]allocatedRef),
+	}
+}
+
+// ref returns the ref of the series, allocating one if the series is new.
+// It reports whether the ref was newly allocated.
+func (a *refAllocator) ref(lbls labels.Labels) (storage.SeriesRef, bool) {
+	hash := lbls.Hash()
+	check := checkHash(lbls)
+
+	existing, ok := a.refs[hash]
+	if !ok {
+		a.next++
+		a.refs[hash] = allocatedRef{check: check, ref: a.next}
+		return a.next, true
+	}
+	if existing.check == check {
+		return existing.ref, false
+	}
+
+	for _, c := range a.conflicts[hash] {
+		if c.check == check {
+			return c.ref, false
+		}
+	}
+	a.next++
+	a.conflicts[hash] = append(a.conflicts[hash], allocatedRef{check: check, ref: a.next})
+	return a.next, true
+}
+
+// forget drops the refs of the given series, so that they are allocated a
+// new ref when added again.
+func (a *refAllocator) forget(refs *roaring64.Bitmap) {
+	for hash, r := range a.refs {
+		if refs.Contains(uint64(r.ref)) {
+			delete(a.refs, hash)
+		}
+	}
+	for hash, conflicts := range a.conflicts {
+		conflicts = slices.DeleteFunc(conflicts, func(r allocatedRef) bool {
+			return refs.Contains(uint64(r.ref))
+		})
+		if len(conflicts) == 0 {
+			delete(a.conflicts, hash)
+		} else {
+			a.conflicts[hash] = conflicts
+		}
+	}
+}
+
+// checkHash hashes the labels with FNV-1a, independently of labels.Hash.
+func checkHash(lbls labels.Labels) uint64 {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64]byte
+	for _, l := range lbls {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(l.Name)))])
+		h.Write([]byte(l.Name))
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(l.Value)))])
+		h.Write([]byte(l.Value))
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,398 @@
+package cardinality
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ErrRefOutOfSpace is returned when a series ref doesn't fit the offset of
+// its source in a RefSpace.
+var ErrRefOutOfSpace = errors.New("series ref out of space")
+
+// sourceRef is a series ref of a source.
+type sourceRef struct {
+	source string
+	ref    storage.SeriesRef
+}
+
+// RefSpace maps the series refs of several sources, like ingesters or
+// Prometheus replicas, which allocate refs independently, to global refs,
+// so that their indexes can be merged without colliding, see
+// BitmapIndex.Merge. Global refs are stable for the lifetime of the space.
+// A RefSpace is safe for concurrent use.
+type RefSpace struct {
+	// bits is the width of the refs of a source with offsets, or 0 with an
+	// indirection table.
+	bits uint
+
+	mtx     sync.Mutex
+	sources map[string]uint64
+	table   map[sourceRef]storage.SeriesRef
+	// hashes maps the labels hash of a series to its global ref, so that a
+	// series of several sources gets a single one.
+	hashes map[uint64]storage.SeriesRef
+	// users counts the table entries of every global ref, with its labels
+	// hash, so that Drop knows the hashes no source has anymore.
+	users map[storage.SeriesRef]globalUsers
+	next  storage.SeriesRef
+}
+
+// globalUsers is the labels hash of a global ref and its number of table
+// entries.
+type globalUsers struct {
+	hash uint64
+	refs int
+}
+
+// NewOffsetRefSpace returns a RefSpace giving every source a range of
+// 2^bits refs, in the order sources are first seen, and the global ref
+// offset+ref to its series. It needs no memory per series, but sources
+// can't have refs above 2^bits, like the refs of a TSDB head, which
+// include the segment of the series, and the same series of several
+// sources gets several global refs.
+func NewOffsetRefSpace(bits uint) *RefSpace {
+	if bits == 0 || bits >= 64 {
+		panic(fmt.Sprintf("invalid ref space bits %d", bits))
+	}
+	return &RefSpace{bits: bits, sources: make(map[string]uint64)}
+}
+
+// NewTableRefSpace returns a RefSpace allocating increasing global refs to
+// the series of the sources in an indirection table. Series known by the
+// hash of their labels get the same global ref in every source, so that
+// replicas merge into a single series. Series whose labels hash collides
+// share a global ref, as they share a series in a deduplicating index.
+func NewTableRefSpace() *RefSpace {
+	return &RefSpace{
+		table:  make(map[sourceRef]storage.SeriesRef),
+		hashes: make(map[uint64]storage.SeriesRef),
+		users:  make(map[storage.SeriesRef]globalUsers),
+	}
+}
+
+// Global returns the global ref of the series ref of a source, allocating
+// it if needed. hash is the labels hash of the series, or 0 if unknown.
+func (s *RefSpace) Global(source string, ref storage.SeriesRef, hash uint64) (storage.SeriesRef, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.global(source, ref, hash)
+}
+
+// global is Global without locking.
+func (s *RefSpace) global(source string, ref storage.SeriesRef, hash uint64) (storage.SeriesRef, error) {
+	if s.bits > 0 {
+		if uint64(ref)>>s.bits != 0 {
+			return 0, fmt.Errorf("%w: ref %d of %s needs more than %d bits", ErrRefOutOfSpace, ref, source, s.bits)
+		}
+		slot, ok := s.sources[source]
+		if !ok {
+			slot = uint64(len(s.sources))
+			if slot>>(64-s.bits) != 0 {
+				return 0, fmt.Errorf("%w: no room for source %s", ErrRefOutOfSpace, source)
+			}
+			s.sources[source] = slot
+		}
+		return storage.SeriesRef(slot<<s.bits | uint64(ref)), nil
+	}
+
+	key := sourceRef{source: source, ref: ref}
+	if global, ok := s.table[key]; ok {
+		return global, nil
+	}
+	global, ok := s.hashes[hash]
+	if hash == 0 || !ok {
+		s.next++
+		global = s.next
+		if hash != 0 {
+			s.hashes[hash] = global
+		}
+	}
+	s.table[key] = global
+	users := s.users[global]
+	users.refs++
+	if hash != 0 {
+		users.hash = hash
+	}
+	s.users[global] = users
+	return global, nil
+}
+
+// Forget drops the refs of a source from the indirection table, e.g. once
+// the source has been merged for good or is gone. Series of other sources
+// keep their global refs, and the source's series get new ones if merged
+// again, unless their labels hash is known. It does nothing with offsets,
+// which don't use memory per series.
+func (s *RefSpace) Forget(source string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, global := range s.table {
+		if key.source == source {
+			s.release(key, global, false)
+		}
+	}
+}
+
+// Drop drops the refs of a source from the indirection table like Forget,
+// and the labels hashes of its series that no other source has, once the
+// series are gone from the indexes using the space too, e.g. with the
+// sub-index of a deleted block. The series get new global refs if added
+// again, instead of the refs of series no index has anymore, so the table
+// doesn't grow with every series ever seen.
+func (s *RefSpace) Drop(source string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, global := range s.table {
+		if key.source == source {
+			s.release(key, global, true)
+		}
+	}
+}
+
+// dropRefs is Drop for some refs of a source.
+func (s *RefSpace) dropRefs(source string, refs []storage.SeriesRef) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, ref := range refs {
+		key := sourceRef{source: source, ref: ref}
+		if global, ok := s.table[key]; ok {
+			s.release(key, global, true)
+		}
+	}
+}
+
+// release deletes a table entry and, if dropHash is set, the labels hash
+// of its global ref once no entry has it. The caller must hold the lock.
+func (s *RefSpace) release(key sourceRef, global storage.SeriesRef, dropHash bool) {
+	delete(s.table, key)
+	users := s.users[global]
+	if users.refs--; users.refs > 0 {
+		s.users[global] = users
+		return
+	}
+	delete(s.users, global)
+	if dropHash && users.hash != 0 && s.hashes[users.hash] == global {
+		delete(s.hashes, users.hash)
+	}
+}
+
+// remap returns the global refs of the series of a source, given the
+// labels hash of the series if known.
+func (s *RefSpace) remap(source string, refs *roaring64.Bitmap, hashes map[uint64]uint64) (map[uint64]uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	globals := make(map[uint64]uint64, refs.GetCardinality())
+	it := refs.Iterator()
+	for it.HasNext() {
+		ref := it.Next()
+		global, err := s.global(source, storage.SeriesRef(ref), hashes[ref])
+		if err != nil {
+			return nil, err
+		}
+		globals[ref] = uint64(global)
+	}
+	return globals, nil
+}
+
+// remapBitmap returns the bitmap of the global refs of the refs of bitmap.
+// Refs without a global ref, of series added since the refs were remapped,
+// are left out.
+func remapBitmap(globals map[uint64]uint64, bitmap *roaring64.Bitmap) *roaring64.Bitmap {
+	mapped := make([]uint64, 0, bitmap.GetCardinality())
+	it := bitmap.Iterator()
+	for it.HasNext() {
+		if global, ok := globals[it.Next()]; ok {
+			mapped = append(mapped, global)
+		}
+	}
+	slices.Sort(mapped)
+	return roaring64.BitmapOf(mapped...)
+}
+
+// Merge adds the series of src, the index of the named source, to the
+// index under their global refs in space, so that the indexes of several
+// sources, whose refs collide, can be combined into one. Merging a source
+// again adds its new series. The postings, label presence and value
+// statistics are merged, as well as the series hashes, the label pairs if
+// both indexes have the same, and the metric sub-indexes; the other
+// optional structures of the index only follow AddSeries.
+// The refs of an index merged into belong to the space, so series should
+// only be added to it with Merge. Labels with bucketed values can't be
+// merged, as their values are lost.
+func (b *BitmapIndex) Merge(src *BitmapIndex, source string, space *RefSpace) error {
+	var bucketed []string
+	src.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		if s.bucketed != nil {
+			bucketed = append(bucketed, name)
+		}
+	})
+	if len(bucketed) > 0 {
+		slices.Sort(bucketed)
+		return fmt.Errorf("can't merge bucketed labels %v", bucketed)
+	}
+
+	src.mtx.RLock()
+	all := src.all.Clone()
+	hashes := maps.Clone(src.hashes)
+	src.mtx.RUnlock()
+	globals, err := space.remap(source, all, hashes)
+	if err != nil {
+		return err
+	}
+	b.merge(src, globals, hashes)
+	return nil
+}
+
+// mergedValue is a label value of a merged index, with its postings
+// remapped to global refs.
+type mergedValue struct {
+	value    string
+	postings *roaring64.Bitmap
+	stat     valueStat
+}
+
+// mergedShard is a label of a merged index, with its postings remapped to
+// global refs.
+type mergedShard struct {
+	present *roaring64.Bitmap
+	values  []mergedValue
+}
+
+// merge adds the series of src under their global refs.
+func (b *BitmapIndex) merge(src *BitmapIndex, globals map[uint64]uint64, hashes map[uint64]uint64) {
+	src.mtx.RLock()
+	all := remapBitmap(globals, src.all)
+	src.mtx.RUnlock()
+	shards := make(map[string]mergedShard)
+	src.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		shard := mergedShard{present: remapBitmap(globals, s.present), values: make([]mergedValue, 0, len(s.values))}
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				shard.values = append(shard.values, mergedValue{value: str(id), postings: remapBitmap(globals, v.read()), stat: v.stat})
+			}
+		})
+		shards[name] = shard
+	})
+
+	if b.hashes != nil {
+		b.mtx.Lock()
+		for ref, hash := range hashes {
+			if global, ok := globals[ref]; ok {
+				b.hashes[global] = hash
+			}
+		}
+		b.mtx.Unlock()
+	}
+	b.mergeShards(all, shards)
+
+	if b.pairs != nil && slices.Equal(b.labelPairs, src.labelPairs) {
+		src.pairsMtx.RLock()
+		pairs := make(map[pairKey]*roaring64.Bitmap, len(src.pairs))
+		for key, bitmap := range src.pairs {
+			pairs[key] = remapBitmap(globals, bitmap)
+		}
+		src.pairsMtx.RUnlock()
+
+		b.pairsMtx.Lock()
+		for key, bitmap := range pairs {
+			if existing, ok := b.pairs[key]; ok {
+				existing.Or(bitmap)
+			} else {
+				b.pairs[key] = bitmap
+			}
+		}
+		b.pairsMtx.Unlock()
+	}
+
+	if b.metrics == nil {
+		return
+	}
+	if src.metrics != nil {
+		src.metricsMtx.RLock()
+		metrics := maps.Clone(src.metrics)
+		src.metricsMtx.RUnlock()
+		for name, sub := range metrics {
+			b.metricIndex(name, true).merge(sub, globals, nil)
+		}
+		return
+	}
+	// Without sub-indexes in src, the series of every metric are split out
+	// of its shards.
+	for _, metric := range shards[labels.MetricName].values {
+		sub := make(map[string]mergedShard, len(shards))
+		for name, shard := range shards {
+			filtered := mergedShard{present: roaring64.And(shard.present, metric.postings)}
+			if filtered.present.IsEmpty() {
+				continue
+			}
+			for _, v := range shard.values {
+				if postings := roaring64.And(v.postings, metric.postings); !postings.IsEmpty() {
+					filtered.values = append(filtered.values, mergedValue{value: v.value, postings: postings, stat: v.stat})
+				}
+			}
+			sub[name] = filtered
+		}
+		b.metricIndex(metric.value, true).mergeShards(metric.postings, sub)
+	}
+}
+
+// mergeShards adds the remapped series and labels of a merged index.
+func (b *BitmapIndex) mergeShards(all *roaring64.Bitmap, shards map[string]mergedShard) {
+	b.mtx.Lock()
+	added := all.GetCardinality() - roaring64.And(all, b.all).GetCardinality()
+	b.all.Or(all)
+	b.mtx.Unlock()
+	b.added.Add(int64(added))
+	now := b.now().UnixNano()
+	b.lastUpdate.Store(now)
+
+	for name, shard := range shards {
+		if b.getOrCreateShard(name).merge(shard.present, shard.values, b.bucketing, now) {
+			b.logger.Info("Bucketing label values", "label", name)
+		}
+	}
+}
+
+// merge adds the remapped series of a label of a merged index, and reports
+// whether the values of the label got bucketed. Value statistics grow by
+// the share of the value's series that are new.
+func (s *labelShard) merge(present *roaring64.Bitmap, values []mergedValue, bucketing bucketing, now int64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.present.Or(present)
+	s.modified = now
+	for _, m := range values {
+		if s.bucketed != nil {
+			s.bucketed.Bucket(m.value).Or(m.postings)
+			continue
+		}
+		v := s.lookup(m.value)
+		if v == nil {
+			v = s.insert(m.value)
+		}
+		v.lastSeen = now
+		v.warm()
+		before := v.postings.GetCardinality()
+		v.postings.Or(m.postings)
+		if added := int64(v.postings.GetCardinality() - before); added > 0 && m.stat.series > 0 {
+			v.stat.series += added
+			v.stat.bytes += m.stat.bytes * added / m.stat.series
+		}
+	}
+
+	if s.bucketed == nil && bucketing.shouldBucket(len(s.values)) {
+		s.bucketValues(bucketing.buckets)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Reindexer keeps a BitmapIndex consistent with the blocks of a TSDB data
+// directory and its head. Series refs are only unique within a block and
+// change when the head is compacted, so the Reindexer assigns every series
+// its own ID and rebuilds a fresh index whenever the set of blocks on disk
+// or the series of the head change, swapping it in once it is complete.
+//
+// Series present in several blocks are only counted once as long as the
+// index deduplicates by labels, which is the default.
+type Reindexer struct {
+	dir      string
+	head     *tsdb.Head
+	newIndex func() *BitmapIndex
+	opts     []BuildOption
+
+	mtx    sync.RWMutex
+	index  *BitmapIndex
+	blocks []string
+	heads  headState
+}
+
+// headState tells whether the series of a head changed: series are only
+// created between truncations, which move the min time and are the only
+// way series are removed.
+type headState struct {
+	series uint64
+	mint   int64
+}
+
+// headState returns the state of the head, or the zero state without one.
+func (r *Reindexer) headState() headState {
+	if r.head == nil {
+		return headState{}
+	}
+	return headState{series: r.head.NumSeries(), mint: r.head.MinTime()}
+}
+
+// NewReindexer returns a Reindexer for the blocks in dir and, if not nil,
+// head. newIndex creates the empty index every rebuild starts from.
+func NewReindexer(dir string, head *tsdb.Head, newIndex func() *BitmapIndex, opts ...BuildOption) *Reindexer {
+	return &Reindexer{
+		dir:      dir,
+		head:     head,
+		newIndex: newIndex,
+		opts:     opts,
+		index:    newIndex(),
+	}
+}
+
+// Index returns the most recently built index.
+func (r *Reindexer) Index() *BitmapIndex {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.index
+}
+
+// Ready reports whether the index was built at least once. Until then
+// Index returns an empty index.
+func (r *Reindexer) Ready() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.blocks != nil
+}
+
+// Run checks dir for new or deleted blocks every interval and rebuilds the
+// index when they changed, until ctx is done. Errors are passed to errFn,
+// or logged with the build logger if errFn is nil.
+func (r *Reindexer) Run(ctx context.Context, interval time.Duration, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.ReindexIfChanged(ctx); err != nil {
+			if errFn != nil {
+				errFn(err)
+			} else {
+				applyBuildOptions(r.opts).logger.Error("Failed to rebuild index", "dir", r.dir, "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReindexIfChanged rebuilds the index if the blocks on disk or the series
+// of the head changed since the last build. It reports whether a rebuild
+// happened.
+func (r *Reindexer) ReindexIfChanged(ctx context.Context) (bool, error) {
+	blocks, err := blockDirs(r.dir)
+	if err != nil {
+		return false, err
+	}
+
+	r.mtx.RLock()
+	unchanged := r.blocks != nil && slices.Equal(blocks, r.blocks) && r.heads == r.headState()
+	r.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, r.reindex(ctx, blocks)
+}
+
+// Reindex unconditionally rebuilds the index from all blocks and the head.
+func (r *Reindexer) Reindex(ctx context.Context) error {
+	blocks, err := blockDirs(r.dir)
+	if err != nil {
+		return err
+	}
+	return r.reindex(ctx, blocks)
+}
+
+func (r *Reindexer) reindex(ctx context.Context, blocks []string) error {
+	start := time.Now()
+	// The head is read last, so series it gets meanwhile trigger the next
+	// rebuild.
+	heads := r.headState()
+	idx := r.newIndex()
+	var nextID storage.SeriesRef
+	add := func(lbls labels.Labels, _ storage.SeriesRef) {
+		nextID++
+		idx.AddSeries(lbls, nextID)
+	}
+
+	o := applyBuildOptions(r.opts)
+	for _, dir := range blocks {
+		block, err := tsdb.OpenBlock(o.logger, filepath.Join(r.dir, dir), nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to open block %s: %w", dir, err)
+		}
+		err = buildFromBlock(ctx, block, add, o)
+		block.Close()
+		if err != nil {
+			return fmt.Errorf("failed to index block %s: %w", dir, err)
+		}
+	}
+	if r.head != nil {
+		if err := buildFromBlock(ctx, r.head, add, o); err != nil {
+			return fmt.Errorf("failed to index head: %w", err)
+		}
+	}
+
+	r.mtx.Lock()
+	r.index = idx
+	r.blocks = blocks
+	r.heads = heads
+	r.mtx.Unlock()
+	o.logger.Info("Rebuilt index", "dir", r.dir, "blocks", len(blocks), "series", nextID, "duration", time.Since(start))
+	return nil
+}
+
+// blockDirs returns the sorted names of the complete blocks in dir.
+func blockDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := ulid.ParseStrict(e.Name()); err != nil {
+			continue
+		}
+		// Blocks are written to a temporary directory and renamed once
+		// complete, but check for the meta file to be safe.
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "meta.json")); err != nil {
+			continue
+		}
+		blocks = append(blocks, e.Name())
+	}
+	slices.Sort(blocks)
+	return blocks, nil
+}
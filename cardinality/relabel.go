@@ -0,0 +1,16 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// relabelSeries applies the rules of WithRelabelConfigs to the labels of a
+// series before it is indexed. It reports false if the series is dropped.
+func relabelSeries(rules []*relabel.Config, lbls labels.Labels) (labels.Labels, bool) {
+	if len(rules) == 0 {
+		return lbls, true
+	}
+	lbls, keep := relabel.Process(lbls, rules...)
+	return lbls, keep && !lbls.IsEmpty()
+}
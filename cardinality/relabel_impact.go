@@ -0,0 +1,225 @@
+package cardinality
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/model/relabel"
+	"strings"
+)
+
+// ErrUnsupportedRelabelRule is returned for relabel rules whose effect
+// RelabelImpact can't compute.
+var ErrUnsupportedRelabelRule = errors.New("unsupported relabel rule")
+
+// RelabelImpact describes how relabel rules, like the
+// metric_relabel_configs of a scrape job, would change the indexed series.
+type RelabelImpact struct {
+	Series int64 `json:"series"`
+	// Dropped counts the series dropped by drop and keep rules, and Merged
+	// the series that become duplicates of others once labeldrop and
+	// labelkeep rules removed their distinguishing labels.
+	Dropped   int64 `json:"dropped"`
+	Merged    int64 `json:"merged"`
+	Remaining int64 `json:"remaining"`
+	// Rules holds the series every rule removes, in order.
+	Rules []RelabelRuleImpact `json:"rules"`
+}
+
+// RelabelRuleImpact is the number of series a single relabel rule removes,
+// after the rules before it were applied.
+type RelabelRuleImpact struct {
+	Action  relabel.Action `json:"action"`
+	Removed int64          `json:"removed"`
+}
+
+// relabelLabel is a copy of the postings of a label, taken so that the
+// labels can be combined without holding several locks.
+type relabelLabel struct {
+	present *roaring64.Bitmap
+	values  map[string]*roaring64.Bitmap
+}
+
+// RelabelImpact computes exactly how many series the rules would remove
+// from the index, to answer questions like "how much will dropping label X
+// save?" before changing the scrape configuration. Only the drop, keep,
+// labeldrop and labelkeep actions are supported, as the others rewrite
+// values the index can't follow; labels whose values are bucketed or
+// collapsed aren't either.
+func (b *BitmapIndex) RelabelImpact(rules []*relabel.Config) (RelabelImpact, error) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case relabel.Drop, relabel.Keep, relabel.LabelDrop, relabel.LabelKeep:
+		default:
+			return RelabelImpact{}, fmt.Errorf("%w: %s", ErrUnsupportedRelabelRule, rule.Action)
+		}
+	}
+
+	b.mtx.RLock()
+	kept := b.all.Clone()
+	b.mtx.RUnlock()
+	impact := RelabelImpact{Series: int64(kept.GetCardinality())}
+
+	snapshots := map[string]*relabelLabel{}
+	snapshot := func(name string) (*relabelLabel, error) {
+		if l, ok := snapshots[name]; ok {
+			return l, nil
+		}
+		l, err := b.relabelLabel(name)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[name] = l
+		return l, nil
+	}
+
+	// hashes holds the sum of the hashes of the labels left to every
+	// series, computed once a rule drops labels.
+	var hashes map[uint64]uint64
+	dropped := map[string]bool{}
+	series := impact.Series
+	for _, rule := range rules {
+		before := series
+		switch rule.Action {
+		case relabel.Drop, relabel.Keep:
+			matched := roaring64.NewBitmap()
+			if err := b.relabelMatches(rule, kept, nil, dropped, snapshot, matched); err != nil {
+				return RelabelImpact{}, err
+			}
+			if rule.Action == relabel.Drop {
+				kept.AndNot(matched)
+			} else {
+				kept.And(matched)
+			}
+			series = countDistinct(kept, hashes)
+			impact.Dropped += before - series
+
+		case relabel.LabelDrop, relabel.LabelKeep:
+			if hashes == nil {
+				var err error
+				if hashes, err = b.relabelHashes(snapshot); err != nil {
+					return RelabelImpact{}, err
+				}
+			}
+			for _, name := range b.LabelNames() {
+				if dropped[name] || rule.Regex.MatchString(name) != (rule.Action == relabel.LabelDrop) {
+					continue
+				}
+				dropped[name] = true
+				l, err := snapshot(name)
+				if err != nil {
+					return RelabelImpact{}, err
+				}
+				for value, postings := range l.values {
+					h := labelHash(name, value)
+					for it := postings.Iterator(); it.HasNext(); {
+						hashes[it.Next()] -= h
+					}
+				}
+			}
+			series = countDistinct(kept, hashes)
+			impact.Merged += before - series
+		}
+		impact.Rules = append(impact.Rules, RelabelRuleImpact{Action: rule.Action, Removed: before - series})
+	}
+	impact.Remaining = series
+	return impact, nil
+}
+
+// countDistinct counts the series left, the distinct label sums of the kept
+// series once labels were dropped.
+func countDistinct(kept *roaring64.Bitmap, hashes map[uint64]uint64) int64 {
+	if hashes == nil {
+		return int64(kept.GetCardinality())
+	}
+	distinct := make(map[uint64]struct{}, kept.GetCardinality())
+	for it := kept.Iterator(); it.HasNext(); {
+		distinct[hashes[it.Next()]] = struct{}{}
+	}
+	return int64(len(distinct))
+}
+
+// relabelLabel copies the postings of a label, or returns an empty label if
+// the index has none.
+func (b *BitmapIndex) relabelLabel(name string) (*relabelLabel, error) {
+	l := &relabelLabel{present: roaring64.NewBitmap(), values: map[string]*roaring64.Bitmap{}}
+	s := b.shard(name)
+	if s == nil {
+		return l, nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.bucketed != nil || s.collapsed {
+		return l, fmt.Errorf("%w: the values of label %q are bucketed or collapsed", ErrUnsupportedRelabelRule, name)
+	}
+	l.present = s.present.Clone()
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id, v := range s.values {
+			l.values[str(id)] = v.postings.Clone()
+		}
+	})
+	return l, nil
+}
+
+// relabelMatches adds the candidates whose values of the source labels of
+// the rule, joined, match its regex to matched. values holds the values of
+// the source labels chosen so far. Dropped labels are empty, like labels a
+// series doesn't have.
+func (b *BitmapIndex) relabelMatches(rule *relabel.Config, candidates *roaring64.Bitmap, values []string, dropped map[string]bool, snapshot func(string) (*relabelLabel, error), matched *roaring64.Bitmap) error {
+	if len(values) == len(rule.SourceLabels) {
+		if rule.Regex.MatchString(strings.Join(values, rule.Separator)) {
+			matched.Or(candidates)
+		}
+		return nil
+	}
+
+	name := string(rule.SourceLabels[len(values)])
+	if dropped[name] {
+		return b.relabelMatches(rule, candidates, append(values, ""), dropped, snapshot, matched)
+	}
+	l, err := snapshot(name)
+	if err != nil {
+		return err
+	}
+	if absent := roaring64.AndNot(candidates, l.present); !absent.IsEmpty() {
+		if err := b.relabelMatches(rule, absent, append(values, ""), dropped, snapshot, matched); err != nil {
+			return err
+		}
+	}
+	for value, postings := range l.values {
+		if selected := roaring64.And(candidates, postings); !selected.IsEmpty() {
+			if err := b.relabelMatches(rule, selected, append(values, value), dropped, snapshot, matched); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relabelHashes returns the sum of the hashes of the labels of every
+// series. Series with the same labels have the same sum, so the series
+// left once labels are dropped can be counted by subtracting the hashes of
+// the dropped labels.
+func (b *BitmapIndex) relabelHashes(snapshot func(string) (*relabelLabel, error)) (map[uint64]uint64, error) {
+	hashes := map[uint64]uint64{}
+	for _, name := range b.LabelNames() {
+		l, err := snapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		for value, postings := range l.values {
+			h := labelHash(name, value)
+			for it := postings.Iterator(); it.HasNext(); {
+				hashes[it.Next()] += h
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// labelHash hashes a label. The sum of the hashes of its labels identifies
+// a series regardless of their order.
+func labelHash(name, value string) uint64 {
+	return xxhash.Sum64String(name + "\xff" + value)
+}
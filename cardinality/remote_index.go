@@ -0,0 +1,243 @@
+package cardinality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteOption configures a RemoteIndex.
+type RemoteOption func(*remoteOptions)
+
+type remoteOptions struct {
+	client      *http.Client
+	headers     http.Header
+	cardinality bool
+	timeout     time.Duration
+	cacheTTL    time.Duration
+	lookback    time.Duration
+}
+
+// WithRemoteClient sets the HTTP client of the requests, e.g. to
+// authenticate them. It defaults to http.DefaultClient.
+func WithRemoteClient(client *http.Client) RemoteOption {
+	return func(o *remoteOptions) {
+		o.client = client
+	}
+}
+
+// WithRemoteHeader adds a header to every request, e.g. X-Scope-OrgID to
+// select the tenant of a Mimir cluster.
+func WithRemoteHeader(name, value string) RemoteOption {
+	return func(o *remoteOptions) {
+		o.headers.Add(name, value)
+	}
+}
+
+// WithCardinalityAPI makes the index query the Mimir cardinality API, which
+// counts the series on the server, instead of listing the series with the
+// Prometheus series API.
+func WithCardinalityAPI() RemoteOption {
+	return func(o *remoteOptions) {
+		o.cardinality = true
+	}
+}
+
+// WithRemoteTimeout sets the timeout of a request. It defaults to 10s.
+func WithRemoteTimeout(timeout time.Duration) RemoteOption {
+	return func(o *remoteOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithRemoteCacheTTL sets how long answers are cached. It defaults to a
+// minute, zero disables the cache.
+func WithRemoteCacheTTL(ttl time.Duration) RemoteOption {
+	return func(o *remoteOptions) {
+		o.cacheTTL = ttl
+	}
+}
+
+// WithRemoteLookback sets how far back the series API looks for series. It
+// defaults to 5m, the lookback of instant queries, so that only active
+// series are counted.
+func WithRemoteLookback(lookback time.Duration) RemoteOption {
+	return func(o *remoteOptions) {
+		o.lookback = lookback
+	}
+}
+
+// maxRemoteCacheEntries bounds the number of answers a RemoteIndex caches.
+const maxRemoteCacheEntries = 10000
+
+type remoteAnswer struct {
+	series  int64
+	expires time.Time
+}
+
+// RemoteIndex answers queries by calling the HTTP API of a Prometheus or
+// Mimir server, keeping no state besides a cache of recent answers. It
+// trades latency and load on the server for not having to ingest series.
+// Failed requests are answered as if no series matched and counted in the
+// stats.
+type RemoteIndex struct {
+	url string
+	o   remoteOptions
+
+	mtx    sync.Mutex
+	cache  map[string]remoteAnswer
+	errors int64
+}
+
+// NewRemoteIndex returns an index querying the server at url, e.g.
+// "http://prometheus:9090" or "http://mimir/prometheus".
+func NewRemoteIndex(url string, opts ...RemoteOption) *RemoteIndex {
+	o := remoteOptions{
+		client:   http.DefaultClient,
+		headers:  http.Header{},
+		timeout:  10 * time.Second,
+		cacheTTL: time.Minute,
+		lookback: 5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &RemoteIndex{
+		url:   strings.TrimSuffix(url, "/"),
+		o:     o,
+		cache: make(map[string]remoteAnswer),
+	}
+}
+
+// AddSeries does nothing, the series are ingested by the server.
+func (r *RemoteIndex) AddSeries(labels.Labels, storage.SeriesRef) {}
+
+func (r *RemoteIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return r.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (r *RemoteIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	series, _ := r.GetCardinalityChecked(ctx, matchers...)
+	return series
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the error
+// of a failed request.
+func (r *RemoteIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	if err := checkMatchers(matchers); err != nil {
+		return 0, err
+	}
+	key := matchersKey(matchers)
+	now := time.Now()
+	r.mtx.Lock()
+	if a, ok := r.cache[key]; ok && now.Before(a.expires) {
+		r.mtx.Unlock()
+		return a.series, nil
+	}
+	r.mtx.Unlock()
+
+	series, err := r.query(ctx, matchers, now)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		r.errors++
+		return 0, err
+	}
+	if r.o.cacheTTL > 0 {
+		flushIfFull(r.cache, maxRemoteCacheEntries, func(a remoteAnswer) bool { return !now.Before(a.expires) })
+		r.cache[key] = remoteAnswer{series: series, expires: now.Add(r.o.cacheTTL)}
+	}
+	return series, nil
+}
+
+// Stats reports the number of failed requests; the index has no local
+// structures to report.
+func (r *RemoteIndex) Stats() IndexStats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return IndexStats{Errors: r.errors}
+}
+
+// remoteSelector returns the PromQL selector of the matchers. The series API
+// requires a matcher, so an empty selector selects all series.
+func remoteSelector(matchers []*labels.Matcher) string {
+	if len(matchers) == 0 {
+		return `{__name__=~".+"}`
+	}
+	strs := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		strs = append(strs, m.String())
+	}
+	return "{" + strings.Join(strs, ",") + "}"
+}
+
+func (r *RemoteIndex) query(ctx context.Context, matchers []*labels.Matcher, now time.Time) (int64, error) {
+	if r.o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.o.timeout)
+		defer cancel()
+	}
+
+	params := url.Values{}
+	var path string
+	if r.o.cardinality {
+		path = "/api/v1/cardinality/label_values"
+		params.Set("selector", remoteSelector(matchers))
+		params.Set("label_names[]", labels.MetricName)
+		params.Set("limit", "1")
+	} else {
+		path = "/api/v1/series"
+		params.Set("match[]", remoteSelector(matchers))
+		params.Set("start", strconv.FormatInt(now.Add(-r.o.lookback).Unix(), 10))
+		params.Set("end", strconv.FormatInt(now.Unix(), 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range r.o.headers {
+		req.Header[name] = values
+	}
+
+	resp, err := r.o.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if r.o.cardinality {
+		var body struct {
+			SeriesCountTotal int64 `json:"series_count_total"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		return body.SeriesCountTotal, nil
+	}
+	var body struct {
+		Status string            `json:"status"`
+		Error  string            `json:"error"`
+		Data   []json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if body.Status != "success" {
+		return 0, fmt.Errorf("%s: %s", path, body.Error)
+	}
+	return int64(len(body.Data)), nil
+}
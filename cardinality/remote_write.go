@@ -0,0 +1,52 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"time"
+)
+
+// IngestRemoteWrite adds the series of a remote write request, like
+// IngestExposition adds the series of a scrape: indexes implementing
+// TypedIndex get their type, indexes implementing ActiveSeriesIndex their
+// latest sample, and the exemplar index set with SetExemplarIndex their
+// exemplars. Every time series counts as a line. Series with invalid labels
+// are counted as invalid and skipped.
+func (i *Ingester) IngestRemoteWrite(req *prompb.WriteRequest) {
+	var b labels.ScratchBuilder
+	now := time.Now().UnixMilli()
+	for _, ts := range req.Timeseries {
+		lbls, err := NormalizeLabels(ts.ToLabels(&b, nil))
+		if err != nil {
+			i.mtx.Lock()
+			i.stats.Lines++
+			i.stats.Invalid++
+			i.mtx.Unlock()
+			continue
+		}
+
+		var info SeriesInfo
+		t := int64(-1)
+		for _, s := range ts.Samples {
+			t = max(t, s.Timestamp)
+		}
+		for _, h := range ts.Histograms {
+			if h.IsFloatHistogram() {
+				info.Buckets = max(info.Buckets, histogramBuckets(nil, h.ToFloatHistogram()))
+			} else {
+				info.Buckets = max(info.Buckets, histogramBuckets(h.ToIntHistogram(), nil))
+			}
+			info.Type = SeriesTypeHistogram
+			t = max(t, h.Timestamp)
+		}
+		if t < 0 {
+			t = now
+		}
+		exemplars := make([]labels.Labels, 0, len(ts.Exemplars))
+		for _, e := range ts.Exemplars {
+			exemplars = append(exemplars, e.ToExemplar(&b, nil).Labels)
+		}
+		info.Exemplars = len(exemplars) > 0
+		i.addSeries(lbls, info, t, exemplars)
+	}
+}
@@ -0,0 +1,162 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// matchersKey identifies a selector independently of the order of its
+// matchers.
+func matchersKey(matchers []*labels.Matcher) string {
+	strs := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		strs = append(strs, m.String())
+	}
+	slices.Sort(strs)
+	return strings.Join(strs, ",")
+}
+
+// flushIfFull makes room in a cache of answers holding up to size entries
+// before one is added: once it is full, the stale answers are dropped, and
+// all of them if none was.
+func flushIfFull[V any](cache map[string]V, size int, stale func(V) bool) {
+	if len(cache) < size {
+		return
+	}
+	for k, v := range cache {
+		if stale(v) {
+			delete(cache, k)
+		}
+	}
+	if len(cache) >= size {
+		clear(cache)
+	}
+}
+
+// maxCachedResults bounds the number of answers a CachingIndex keeps.
+const maxCachedResults = 10000
+
+// ResultCacheStats describes the use of a CachingIndex.
+type ResultCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int   `json:"size"`
+}
+
+type cachedResult struct {
+	series  int64
+	expires time.Time
+	// adds is the number of AddSeries calls when the answer was computed.
+	adds int64
+}
+
+// CachingIndex wraps an index and caches its answers, for callers like
+// admission control that repeat the same queries and can live with answers
+// that are slightly out of date. Queries are keyed by their simplified,
+// sorted matchers, so equivalent selectors share an answer.
+type CachingIndex struct {
+	index     CardinalityIndex
+	ttl       time.Duration
+	tolerance int64
+
+	mtx     sync.Mutex
+	adds    int64
+	results map[string]cachedResult
+	hits    int64
+	misses  int64
+}
+
+// NewCachingIndex returns an index caching the answers of index for ttl.
+// An answer is also dropped once more than tolerance series were added
+// after it was computed: zero drops all answers on every AddSeries, and a
+// negative tolerance only expires answers by their ttl.
+func NewCachingIndex(index CardinalityIndex, ttl time.Duration, tolerance int64) *CachingIndex {
+	return &CachingIndex{
+		index:     index,
+		ttl:       ttl,
+		tolerance: tolerance,
+		results:   make(map[string]cachedResult),
+	}
+}
+
+// Unwrap returns the cached index.
+func (c *CachingIndex) Unwrap() CardinalityIndex {
+	return c.index
+}
+
+func (c *CachingIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	c.index.AddSeries(lbls, ref)
+	c.mtx.Lock()
+	c.adds++
+	c.mtx.Unlock()
+}
+
+func (c *CachingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return c.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (c *CachingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	series, _ := c.GetCardinalityChecked(ctx, matchers...)
+	return series
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the
+// errors of the wrapped index, see GetCardinalityChecked. Failed queries
+// aren't cached, nor are the upper bounds of queries truncated by their
+// QueryLimits, which callers without limits would take as exact.
+func (c *CachingIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	if err := checkMatchers(matchers); err != nil {
+		return 0, err
+	}
+	simplified, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return 0, nil
+	}
+	key := matchersKey(simplified)
+	// Answers served from the cache must not report the usage and
+	// truncation of the previous query of the QueryContext.
+	q := QueryFromContext(ctx)
+	q.begin()
+
+	now := time.Now()
+	c.mtx.Lock()
+	if r, ok := c.results[key]; ok && c.fresh(r, now) {
+		c.hits++
+		c.mtx.Unlock()
+		return r.series, nil
+	}
+	c.misses++
+	adds := c.adds
+	c.mtx.Unlock()
+
+	series, err := GetCardinalityChecked(ctx, c.index, simplified...)
+	if err != nil {
+		return 0, err
+	}
+	if q.Truncated() {
+		return series, nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	flushIfFull(c.results, maxCachedResults, func(r cachedResult) bool { return !c.fresh(r, now) })
+	c.results[key] = cachedResult{series: series, expires: now.Add(c.ttl), adds: adds}
+	return series, nil
+}
+
+// fresh reports whether a cached answer can still be served.
+func (c *CachingIndex) fresh(r cachedResult, now time.Time) bool {
+	return now.Before(r.expires) && (c.tolerance < 0 || c.adds-r.adds <= c.tolerance)
+}
+
+// Stats returns the cache statistics.
+func (c *CachingIndex) Stats() ResultCacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return ResultCacheStats{Hits: c.hits, Misses: c.misses, Size: len(c.results)}
+}
@@ -0,0 +1,135 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Route is the index a RouterIndex answers a query from.
+type Route int
+
+const (
+	// RouteExact answers from the exact index.
+	RouteExact Route = iota
+	// RouteApprox answers from the sketch based index.
+	RouteApprox
+)
+
+func (r Route) String() string {
+	switch r {
+	case RouteExact:
+		return "exact"
+	case RouteApprox:
+		return "approx"
+	default:
+		return "unknown"
+	}
+}
+
+// RouterIndex keeps an exact and an approximate index of the same series and
+// answers each query from the one that suits its matchers: cheap queries are
+// counted exactly, while queries whose matchers union many label values are
+// estimated from sketches. An optional verifier, typically a BlockIndex,
+// provides the ground truth to check answers against.
+type RouterIndex struct {
+	exact    CardinalityIndex
+	approx   CardinalityIndex
+	verifier CardinalityIndex
+
+	// maxExactValues is the number of label values the matchers of a query
+	// may select before it is routed to the approximate index.
+	maxExactValues int
+}
+
+// NewRouterIndex returns a router over exact and approx. Queries whose
+// matchers select more than maxExactValues label values in total are routed
+// to approx. The exact index must implement LabelValuesIndex for queries to
+// be routed to approx at all.
+func NewRouterIndex(exact, approx CardinalityIndex, maxExactValues int) *RouterIndex {
+	return &RouterIndex{
+		exact:          exact,
+		approx:         approx,
+		maxExactValues: maxExactValues,
+	}
+}
+
+// SetVerifier sets the index Verify compares answers against.
+func (r *RouterIndex) SetVerifier(verifier CardinalityIndex) {
+	r.verifier = verifier
+}
+
+// AddSeries adds the series to the exact and approximate indexes. The
+// verifier is not written to, it is expected to have its own source.
+func (r *RouterIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	r.exact.AddSeries(lbls, ref)
+	r.approx.AddSeries(lbls, ref)
+}
+
+// Route returns the index the query would be answered from.
+func (r *RouterIndex) Route(matchers ...*labels.Matcher) Route {
+	lvi, ok := r.exact.(LabelValuesIndex)
+	if !ok {
+		return RouteExact
+	}
+
+	// Equality matchers select at most one value. Every other matcher is
+	// expanded against the label values, which is much cheaper than the
+	// bitmap unions it would otherwise result in.
+	selected := 0
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual {
+			selected++
+			continue
+		}
+		for _, value := range lvi.LabelValues(m.Name) {
+			if m.Matches(value) {
+				selected++
+			}
+		}
+		if selected > r.maxExactValues {
+			return RouteApprox
+		}
+	}
+	if selected > r.maxExactValues {
+		return RouteApprox
+	}
+	return RouteExact
+}
+
+func (r *RouterIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return r.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (r *RouterIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) (card int64) {
+	ctx, span := tracer.Start(ctx, "RouterIndex.GetCardinality")
+	defer func() {
+		span.SetAttributes(attribute.Int64("cardinality", card))
+		span.End()
+	}()
+	setSpanMatchers(span, matchers...)
+
+	route := r.Route(matchers...)
+	span.SetAttributes(attribute.String("route", route.String()))
+	if route == RouteApprox {
+		return GetCardinalityContext(ctx, r.approx, matchers...)
+	}
+	return GetCardinalityContext(ctx, r.exact, matchers...)
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but checks the
+// matchers and the budget of the QueryContext of ctx.
+func (r *RouterIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, r, nil, matchers)
+}
+
+// Verify returns the routed answer to the query along with the verifier's
+// answer. Without a verifier, the exact index is used as the reference.
+func (r *RouterIndex) Verify(matchers ...*labels.Matcher) (got, want int64) {
+	verifier := r.verifier
+	if verifier == nil {
+		verifier = r.exact
+	}
+	return r.GetCardinality(matchers...), verifier.GetCardinality(matchers...)
+}
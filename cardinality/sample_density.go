@@ -0,0 +1,89 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"sync"
+	"time"
+)
+
+// SampleDensity tracks how often series receive samples, from the
+// timestamps of the ingested samples. Intervals are averaged per metric
+// name and over all series; series without samples yet are assumed to be
+// scraped at the configured interval.
+type SampleDensity struct {
+	defaultInterval time.Duration
+
+	mtx     sync.Mutex
+	last    map[uint64]int64
+	total   intervalStat
+	metrics map[string]*intervalStat
+}
+
+type intervalStat struct {
+	sum   int64
+	count int64
+}
+
+func (s intervalStat) mean() time.Duration {
+	return time.Duration(s.sum/s.count) * time.Millisecond
+}
+
+// NewSampleDensity returns a tracker that assumes defaultInterval, usually
+// the scrape interval, until samples are seen.
+func NewSampleDensity(defaultInterval time.Duration) *SampleDensity {
+	return &SampleDensity{
+		defaultInterval: defaultInterval,
+		last:            make(map[uint64]int64),
+		metrics:         make(map[string]*intervalStat),
+	}
+}
+
+// AddSample records a sample of the series at timestamp t in milliseconds.
+// Samples that aren't newer than the previous sample of the series are
+// ignored.
+func (d *SampleDensity) AddSample(lbls labels.Labels, t int64) {
+	hash := lbls.Hash()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	last, ok := d.last[hash]
+	if ok && t <= last {
+		return
+	}
+	d.last[hash] = t
+	if !ok {
+		return
+	}
+
+	name := lbls.Get(labels.MetricName)
+	stat, ok := d.metrics[name]
+	if !ok {
+		stat = &intervalStat{}
+		d.metrics[name] = stat
+	}
+	stat.sum += t - last
+	stat.count++
+	d.total.sum += t - last
+	d.total.count++
+}
+
+// Interval returns the mean interval between samples of the series matching
+// the matchers. The interval of the metric is used when the matchers select
+// a single metric name, and the interval over all series otherwise.
+func (d *SampleDensity) Interval(matchers ...*labels.Matcher) time.Duration {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			if stat, ok := d.metrics[m.Value]; ok && stat.count > 0 {
+				return stat.mean()
+			}
+		}
+	}
+	if d.total.count > 0 {
+		return d.total.mean()
+	}
+	return d.defaultInterval
+}
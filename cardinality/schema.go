@@ -0,0 +1,384 @@
+package cardinality
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"slices"
+	"sync"
+)
+
+// maxSchemaExamples bounds the example values of a SchemaViolation.
+const maxSchemaExamples = 3
+
+// ErrUnsupportedSchemaLabel is returned by CheckSchema for labels whose
+// values it must read but that are bucketed or collapsed.
+var ErrUnsupportedSchemaLabel = errors.New("unsupported schema label")
+
+// MetricSchema declares the labels expected on the series of a metric.
+type MetricSchema struct {
+	Metric string        `json:"metric"`
+	Labels []LabelSchema `json:"labels"`
+	// AllowUndeclared allows labels that aren't in Labels, which are
+	// violations otherwise.
+	AllowUndeclared bool `json:"allow_undeclared,omitempty"`
+}
+
+// LabelSchema declares a label of the series of a metric.
+type LabelSchema struct {
+	Name string `json:"name"`
+	// Required labels must be on every series of the metric.
+	Required bool `json:"required,omitempty"`
+	// Pattern is a regular expression the values of the label must match,
+	// anchored like in PromQL. Empty allows any value.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type labelRule struct {
+	required bool
+	pattern  *labels.FastRegexMatcher
+}
+
+type metricRules struct {
+	schema MetricSchema
+	labels map[string]labelRule
+}
+
+// SchemaRegistry holds the schemas of metrics, the labels their series are
+// expected to have and the values these may take, so that an index can
+// report the series breaking them with CheckSchema. Metrics without a
+// schema aren't checked. It is safe for concurrent use.
+type SchemaRegistry struct {
+	mtx     sync.RWMutex
+	metrics map[string]*metricRules
+}
+
+// NewSchemaRegistry returns a registry of the schemas.
+func NewSchemaRegistry(schemas ...MetricSchema) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{metrics: make(map[string]*metricRules, len(schemas))}
+	for _, s := range schemas {
+		if err := r.Register(s); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register adds the schema of a metric, replacing the schema the metric
+// had.
+func (r *SchemaRegistry) Register(s MetricSchema) error {
+	if !model.IsValidMetricName(model.LabelValue(s.Metric)) {
+		return fmt.Errorf("invalid metric name %q", s.Metric)
+	}
+	rules := &metricRules{schema: s, labels: make(map[string]labelRule, len(s.Labels))}
+	for _, l := range s.Labels {
+		if !model.LabelName(l.Name).IsValid() || l.Name == labels.MetricName {
+			return fmt.Errorf("metric %s: invalid label name %q", s.Metric, l.Name)
+		}
+		if _, ok := rules.labels[l.Name]; ok {
+			return fmt.Errorf("metric %s: duplicate label %q", s.Metric, l.Name)
+		}
+		rule := labelRule{required: l.Required}
+		if l.Pattern != "" {
+			var err error
+			if rule.pattern, err = labels.NewFastRegexMatcher(l.Pattern); err != nil {
+				return fmt.Errorf("metric %s: label %s: invalid pattern: %w", s.Metric, l.Name, err)
+			}
+		}
+		rules.labels[l.Name] = rule
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.metrics[s.Metric] = rules
+	return nil
+}
+
+// Unregister removes the schema of a metric, and reports whether it had
+// one.
+func (r *SchemaRegistry) Unregister(metric string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.metrics[metric]
+	delete(r.metrics, metric)
+	return ok
+}
+
+// Schemas returns the registered schemas, sorted by metric.
+func (r *SchemaRegistry) Schemas() []MetricSchema {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	schemas := make([]MetricSchema, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		schemas = append(schemas, m.schema)
+	}
+	slices.SortFunc(schemas, func(a, b MetricSchema) int { return cmp.Compare(a.Metric, b.Metric) })
+	return schemas
+}
+
+func (r *SchemaRegistry) rules() []*metricRules {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	rules := make([]*metricRules, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		rules = append(rules, m)
+	}
+	return rules
+}
+
+// SchemaViolationKind is the rule of a schema a series breaks.
+type SchemaViolationKind string
+
+const (
+	// ViolationMissingLabel is a series without a required label.
+	ViolationMissingLabel SchemaViolationKind = "missing_label"
+	// ViolationUndeclaredLabel is a series with a label the schema doesn't
+	// declare.
+	ViolationUndeclaredLabel SchemaViolationKind = "undeclared_label"
+	// ViolationInvalidValue is a series with a value not matching the
+	// pattern of its label.
+	ViolationInvalidValue SchemaViolationKind = "invalid_value"
+)
+
+// SchemaViolation counts the series of a metric breaking a rule of its
+// schema for a label.
+type SchemaViolation struct {
+	Label  string              `json:"label"`
+	Kind   SchemaViolationKind `json:"kind"`
+	Series int64               `json:"series"`
+	// Examples are a few of the offending values, for undeclared labels
+	// and invalid values.
+	Examples []string `json:"examples,omitempty"`
+}
+
+// MetricSchemaReport describes the series of a metric breaking its schema.
+type MetricSchemaReport struct {
+	Metric string `json:"metric"`
+	Series int64  `json:"series"`
+	// Violating counts the series breaking any rule.
+	Violating int64 `json:"violating"`
+	// Excess counts the series that only exist because of undeclared
+	// labels: once these are dropped, as many series become duplicates of
+	// others.
+	Excess     int64             `json:"excess"`
+	Violations []SchemaViolation `json:"violations"`
+}
+
+// SchemaReport describes the series breaking the schemas of a registry.
+type SchemaReport struct {
+	// Series counts the series of the metrics with a schema, and Unchecked
+	// the series of the other metrics.
+	Series    int64 `json:"series"`
+	Unchecked int64 `json:"unchecked"`
+	Violating int64 `json:"violating"`
+	Excess    int64 `json:"excess"`
+	// Metrics holds the metrics with violations, most violating series
+	// first.
+	Metrics []MetricSchemaReport `json:"metrics"`
+}
+
+// CheckSchema reports the series of the metrics of the registry breaking
+// their schema, and the cardinality that comes from it, e.g. a label added
+// by a new exporter version, or a pod name leaking into a status label.
+// Labels whose values must be read, the ones with a pattern and, for
+// metrics with undeclared labels, all declared labels, can't be bucketed or
+// collapsed.
+func (b *BitmapIndex) CheckSchema(registry *SchemaRegistry) (SchemaReport, error) {
+	report := SchemaReport{Metrics: []MetricSchemaReport{}}
+	checked := roaring64.NewBitmap()
+	for _, rules := range registry.rules() {
+		series, err := b.metricSeries(rules.schema.Metric)
+		if err != nil {
+			return SchemaReport{}, err
+		}
+		if series.IsEmpty() {
+			continue
+		}
+		checked.Or(series)
+		m, err := b.checkMetricSchema(rules, series)
+		if err != nil {
+			return SchemaReport{}, err
+		}
+		report.Series += m.Series
+		report.Violating += m.Violating
+		report.Excess += m.Excess
+		if m.Violating > 0 {
+			report.Metrics = append(report.Metrics, m)
+		}
+	}
+
+	b.mtx.RLock()
+	report.Unchecked = int64(b.all.GetCardinality() - b.all.AndCardinality(checked))
+	b.mtx.RUnlock()
+	slices.SortFunc(report.Metrics, func(a, b MetricSchemaReport) int {
+		return cmp.Or(cmp.Compare(b.Violating, a.Violating), cmp.Compare(a.Metric, b.Metric))
+	})
+	return report, nil
+}
+
+// metricSeries returns a copy of the series of a metric.
+func (b *BitmapIndex) metricSeries(metric string) (*roaring64.Bitmap, error) {
+	s := b.shard(labels.MetricName)
+	if s == nil {
+		return roaring64.NewBitmap(), nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.bucketed != nil || s.collapsed {
+		return nil, fmt.Errorf("%w: the metric names are bucketed or collapsed", ErrUnsupportedSchemaLabel)
+	}
+	v := s.lookup(metric)
+	if v == nil {
+		return roaring64.NewBitmap(), nil
+	}
+	return v.read().Clone(), nil
+}
+
+func (b *BitmapIndex) checkMetricSchema(rules *metricRules, series *roaring64.Bitmap) (MetricSchemaReport, error) {
+	metric := rules.schema.Metric
+	report := MetricSchemaReport{Metric: metric, Series: int64(series.GetCardinality())}
+	violating := roaring64.NewBitmap()
+	add := func(label string, kind SchemaViolationKind, bitmap *roaring64.Bitmap, examples []string) {
+		if bitmap.IsEmpty() {
+			return
+		}
+		violating.Or(bitmap)
+		report.Violations = append(report.Violations, SchemaViolation{Label: label, Kind: kind, Series: int64(bitmap.GetCardinality()), Examples: examples})
+	}
+
+	// kept are the labels left once the undeclared ones are dropped.
+	var kept []string
+	undeclared := false
+	var err error
+	b.forEachShard(func(name string, s *labelShard) {
+		if name == labels.MetricName || err != nil {
+			return
+		}
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		present := roaring64.And(s.present, series)
+		if present.IsEmpty() {
+			return
+		}
+		rule, declared := rules.labels[name]
+		switch {
+		case !declared && !rules.schema.AllowUndeclared:
+			undeclared = true
+			add(name, ViolationUndeclaredLabel, present, s.examples(series, nil))
+			return
+		case s.bucketed != nil || s.collapsed:
+			if rule.pattern != nil {
+				err = fmt.Errorf("%w: metric %s: the values of label %q are bucketed or collapsed", ErrUnsupportedSchemaLabel, metric, name)
+				return
+			}
+		case rule.pattern != nil:
+			invalid := roaring64.NewBitmap()
+			s.symbols.resolve(func(str func(uint32) string) {
+				for id, v := range s.values {
+					if !rule.pattern.MatchString(str(id)) {
+						invalid.Or(roaring64.And(v.read(), series))
+					}
+				}
+			})
+			add(name, ViolationInvalidValue, invalid, s.examples(series, rule.pattern))
+		}
+		kept = append(kept, name)
+	})
+	if err != nil {
+		return MetricSchemaReport{}, err
+	}
+
+	for name, rule := range rules.labels {
+		if !rule.required {
+			continue
+		}
+		missing := series.Clone()
+		if s := b.shard(name); s != nil {
+			s.mtx.RLock()
+			missing.AndNot(s.present)
+			s.mtx.RUnlock()
+		}
+		add(name, ViolationMissingLabel, missing, nil)
+	}
+
+	if undeclared {
+		distinct, err := b.distinctSeries(series, kept)
+		if err != nil {
+			return MetricSchemaReport{}, fmt.Errorf("metric %s: %w", metric, err)
+		}
+		report.Excess = report.Series - distinct
+	}
+	report.Violating = int64(violating.GetCardinality())
+	slices.SortFunc(report.Violations, func(a, b SchemaViolation) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.Label, b.Label), cmp.Compare(a.Kind, b.Kind))
+	})
+	return report, nil
+}
+
+// examples returns the first values of the series in sorted order that
+// don't match the pattern if any, up to maxSchemaExamples. The caller must
+// hold the lock.
+func (s *labelShard) examples(series *roaring64.Bitmap, pattern *labels.FastRegexMatcher) []string {
+	if s.bucketed != nil || s.collapsed {
+		return nil
+	}
+	examples := make([]string, 0, maxSchemaExamples)
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id, v := range s.values {
+			value := str(id)
+			full := len(examples) == maxSchemaExamples
+			if full && value >= examples[len(examples)-1] {
+				continue
+			}
+			if (pattern != nil && pattern.MatchString(value)) || !v.read().Intersects(series) {
+				continue
+			}
+			if full {
+				examples = examples[:len(examples)-1]
+			}
+			i, _ := slices.BinarySearch(examples, value)
+			examples = slices.Insert(examples, i, value)
+		}
+	})
+	if len(examples) == 0 {
+		return nil
+	}
+	return examples
+}
+
+// distinctSeries counts the distinct series left once the labels other than
+// the kept ones are dropped, summing the hashes of the kept labels of every
+// series like RelabelImpact.
+func (b *BitmapIndex) distinctSeries(series *roaring64.Bitmap, kept []string) (int64, error) {
+	hashes := make(map[uint64]uint64, series.GetCardinality())
+	for it := series.Iterator(); it.HasNext(); {
+		hashes[it.Next()] = 0
+	}
+	for _, name := range kept {
+		s := b.shard(name)
+		if s == nil {
+			continue
+		}
+		s.mtx.RLock()
+		if s.bucketed != nil || s.collapsed {
+			s.mtx.RUnlock()
+			return 0, fmt.Errorf("%w: the values of label %q are bucketed or collapsed", ErrUnsupportedSchemaLabel, name)
+		}
+		s.symbols.resolve(func(str func(uint32) string) {
+			for id, v := range s.values {
+				h := labelHash(name, str(id))
+				for it := roaring64.And(v.read(), series).Iterator(); it.HasNext(); {
+					hashes[it.Next()] += h
+				}
+			}
+		})
+		s.mtx.RUnlock()
+	}
+	distinct := make(map[uint64]struct{}, len(hashes))
+	for _, h := range hashes {
+		distinct[h] = struct{}{}
+	}
+	return int64(len(distinct)), nil
+}
@@ -0,0 +1,74 @@
+package cardinality
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// seenFilterHashes is the number of bits set per series, optimal for the 1%
+// false positive rate the filter is sized for.
+const seenFilterHashes = 7
+
+// seenFilter is a Bloom filter of the labels hashes of the series added
+// recently, checked before any other work of AddSeries, so that indexes fed
+// every sample of every series, like by a remote write adapter, only do the
+// work of a new series. It is reset every interval, so that series are
+// processed again once per interval to refresh their last sample or the
+// time their values were last seen, and so that the new series it wrongly
+// took for known, about 1% of them once it holds the series it was sized
+// for, are added after the next reset. It is safe for concurrent use.
+type seenFilter struct {
+	words    uint64
+	interval time.Duration
+	now      func() time.Time
+
+	bits    atomic.Pointer[[]atomic.Uint64]
+	resetAt atomic.Int64
+}
+
+// newSeenFilter returns a filter sized for the given number of series, or
+// nil if series or interval is not positive.
+func newSeenFilter(series int, interval time.Duration, now func() time.Time) *seenFilter {
+	if series <= 0 || interval <= 0 {
+		return nil
+	}
+	// m = -n ln(p) / ln(2)^2 bits for a false positive rate p of 1%.
+	bits := uint64(math.Ceil(-float64(series) * math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	f := &seenFilter{words: (bits + 63) / 64, interval: interval, now: now}
+	f.reset()
+	return f
+}
+
+func (f *seenFilter) reset() {
+	bits := make([]atomic.Uint64, f.words)
+	f.bits.Store(&bits)
+}
+
+// seen adds the hash to the filter and reports whether it probably was
+// already in it. It is safe to call on a nil filter, which sees nothing.
+func (f *seenFilter) seen(hash uint64) bool {
+	if f == nil {
+		return false
+	}
+	// The interval starts with the first series.
+	now := f.now().UnixNano()
+	if resetAt := f.resetAt.Load(); (resetAt == 0 || now-resetAt >= int64(f.interval)) && f.resetAt.CompareAndSwap(resetAt, now) {
+		f.reset()
+	}
+
+	bits := *f.bits.Load()
+	// Double hashing derives the positions from the two halves of the
+	// hash.
+	h1, h2 := hash, hash>>32|hash<<32|1
+	seen := true
+	for i := uint64(0); i < seenFilterHashes; i++ {
+		pos := (h1 + i*h2) % (f.words * 64)
+		word, mask := &bits[pos/64], uint64(1)<<(pos%64)
+		if word.Load()&mask == 0 {
+			seen = false
+			word.Or(mask)
+		}
+	}
+	return seen
+}
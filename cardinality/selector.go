@@ -0,0 +1,87 @@
+package cardinality
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"regexp/syntax"
+	"strings"
+)
+
+// ParseSelector parses a series selector like `{job="api", pod=~"api-.*"}`
+// and normalizes its matchers with NormalizeMatchers. It is the entry point
+// for selectors given by users, so that the API and the command line match
+// series exactly like PromQL would.
+func ParseSelector(selector string) ([]*labels.Matcher, error) {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeMatchers(matchers)
+}
+
+// NormalizeMatchers rebuilds the regex matchers to match with the semantics
+// of PromQL: a regex is anchored at both ends, so `api` doesn't match
+// "api-1", and `.` matches newlines. Matchers built as struct literals or
+// decoded from the wire have no compiled regex and are compiled here.
+// Explicit anchors, which PromQL users often add out of habit, are stripped,
+// so that `^api$` shares cached answers with `api` and is answered like the
+// equality matcher it is.
+func NormalizeMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	normalized := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		if m == nil || (m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp) {
+			normalized[i] = m
+			continue
+		}
+		value := stripAnchors(m.Value)
+		if value == m.Value && m.GetRegexString() != "" {
+			normalized[i] = m
+			continue
+		}
+		rebuilt, err := labels.NewMatcher(m.Type, m.Name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex of %s: %w", m.Name, err)
+		}
+		normalized[i] = rebuilt
+	}
+	return normalized, nil
+}
+
+// stripAnchors removes a leading ^ and an unescaped trailing $ from a regex.
+// Within a fully anchored regex they are redundant, even with alternations:
+// they only anchor the first and the last alternative, which already are.
+// Anchors that aren't standalone, like the repeated one of `^*a` or the
+// quoted one of `\Qa$`, are kept, along with the rest of the pattern.
+func stripAnchors(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return pattern
+	}
+	stripped := pattern
+	if strings.HasPrefix(stripped, "^") && edgeOp(re, true) == syntax.OpBeginText {
+		stripped = stripped[1:]
+	}
+	if strings.HasSuffix(stripped, "$") && edgeOp(re, false) == syntax.OpEndText {
+		stripped = stripped[:len(stripped)-1]
+	}
+	if _, err := syntax.Parse(stripped, syntax.Perl|syntax.DotNL); err != nil {
+		return pattern
+	}
+	return stripped
+}
+
+// edgeOp returns the op of the first or the last node of the regex that
+// matches text, descending into concatenations and alternations only, so
+// that an anchor under a repetition or a group isn't taken for a
+// standalone one.
+func edgeOp(re *syntax.Regexp, first bool) syntax.Op {
+	for (re.Op == syntax.OpConcat || re.Op == syntax.OpAlternate) && len(re.Sub) > 0 {
+		if first {
+			re = re.Sub[0]
+		} else {
+			re = re.Sub[len(re.Sub)-1]
+		}
+	}
+	return re.Op
+}
@@ -0,0 +1,39 @@
+package cardinality
+
+import (
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrSeriesNotSampled is returned by SampleSeries on an index that wasn't
+// created WithSeriesSamples.
+var ErrSeriesNotSampled = errors.New("series are not sampled")
+
+// SampleSeries returns the labels of up to n sampled series matching the
+// matchers, in the order of their refs, so that reports can show concrete
+// series and not only counts. Only the series sampled WithSeriesSamples are
+// returned, so selectors of fewer series than the sampling rate may have
+// none. The refs of labels with bucketed values include series of other
+// values, so only the sampled series whose labels match are returned.
+func (b *BitmapIndex) SampleSeries(matchers []*labels.Matcher, n int) ([]labels.Labels, error) {
+	if b.samples == nil {
+		return nil, ErrSeriesNotSampled
+	}
+	refs, err := b.GetMatchingRefs(matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []labels.Labels
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for _, ref := range refs {
+		if len(series) >= n {
+			break
+		}
+		if lbls, ok := b.samples[uint64(ref)]; ok && matchSeries(lbls, matchers) {
+			series = append(series, lbls)
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,137 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// ErrSeriesTypesNotTracked is returned by GetCardinalityByType on an index
+// that wasn't created WithSeriesTypes.
+var ErrSeriesTypesNotTracked = errors.New("series types are not tracked")
+
+// SeriesType is the type of the samples of a series.
+type SeriesType uint8
+
+const (
+	SeriesTypeFloat SeriesType = iota
+	// SeriesTypeHistogram is a native histogram series. Classic histograms
+	// are float series per bucket.
+	SeriesTypeHistogram
+)
+
+func (t SeriesType) String() string {
+	switch t {
+	case SeriesTypeFloat:
+		return "float"
+	case SeriesTypeHistogram:
+		return "histogram"
+	}
+	return "unknown"
+}
+
+func (t SeriesType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// SeriesInfo describes the samples of a series, as far as they change what
+// the series costs to store.
+type SeriesInfo struct {
+	Type SeriesType
+	// Buckets is the number of buckets of a native histogram.
+	Buckets int
+	// Exemplars is set if the series has exemplars.
+	Exemplars bool
+}
+
+// TypeCardinality is the number of series of a type selected by a query.
+type TypeCardinality struct {
+	Type   SeriesType `json:"type"`
+	Series int64      `json:"series"`
+	// Buckets sums the buckets of native histogram series.
+	Buckets int64 `json:"buckets"`
+	// Cost counts the series as the float series they cost as much to
+	// store as: a float series is 1, and a native histogram its number of
+	// buckets, like a classic histogram with the same buckets.
+	Cost int64 `json:"cost"`
+	// Exemplars counts the series with exemplars.
+	Exemplars int64 `json:"exemplars"`
+}
+
+// AddTypedSeries adds a series like AddSeries and records its type, if the
+// index was created WithSeriesTypes. Series added with AddSeries are float
+// series without exemplars. Re-adding a series updates its type.
+func (b *BitmapIndex) AddTypedSeries(lbls labels.Labels, ref storage.SeriesRef, info SeriesInfo) {
+	ref, ok := b.addSeries(lbls, ref)
+	if !ok || b.histograms == nil {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if !b.all.Contains(uint64(ref)) {
+		return
+	}
+	if info.Type == SeriesTypeHistogram {
+		b.histograms[uint64(ref)] = uint32(max(info.Buckets, 0))
+	} else {
+		delete(b.histograms, uint64(ref))
+	}
+	if info.Exemplars {
+		b.exemplars.Add(uint64(ref))
+	} else {
+		b.exemplars.Remove(uint64(ref))
+	}
+}
+
+// GetCardinalityByType returns the series matching the matchers per type,
+// float series first, so that reports can tell the series of a selector
+// from what they cost to store: a native histogram series takes the space
+// of as many float series as it has buckets.
+func (b *BitmapIndex) GetCardinalityByType(matchers ...*labels.Matcher) ([]TypeCardinality, error) {
+	if b.histograms == nil {
+		return nil, ErrSeriesTypesNotTracked
+	}
+	types := []TypeCardinality{{Type: SeriesTypeFloat}, {Type: SeriesTypeHistogram}}
+	if len(matchers) == 0 {
+		return types, nil
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return types, nil
+	}
+	bitmap := b.getIntersectionBitmap(context.Background(), matchers)
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for it := bitmap.Iterator(); it.HasNext(); {
+		ref := it.Next()
+		t := &types[SeriesTypeFloat]
+		cost := int64(1)
+		if buckets, ok := b.histograms[ref]; ok {
+			t = &types[SeriesTypeHistogram]
+			t.Buckets += int64(buckets)
+			cost = max(int64(buckets), 1)
+		}
+		t.Series++
+		t.Cost += cost
+		if b.exemplars.Contains(ref) {
+			t.Exemplars++
+		}
+	}
+	return types, nil
+}
+
+// histogramBuckets returns the number of buckets of the native histogram
+// of a sample, either integer or float.
+func histogramBuckets(h *histogram.Histogram, fh *histogram.FloatHistogram) int {
+	switch {
+	case h != nil:
+		return len(h.PositiveBuckets) + len(h.NegativeBuckets)
+	case fh != nil:
+		return len(fh.PositiveBuckets) + len(fh.NegativeBuckets)
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"math/bits"
+)
+
+// maxUnionSets bounds the matcher sets of EstimateUnion on indexes without
+// set algebra, which estimates the intersection of every subset of them.
+const maxUnionSets = 12
+
+// EstimateDifference estimates the series matching a but not b, e.g. the
+// series of a job outside of the namespaces a team owns. Indexes that don't
+// implement SetAlgebraIndex answer with the series of a minus the series
+// matching both, the concatenation of the matcher sets. An empty matcher set
+// matches no series.
+func EstimateDifference(index CardinalityIndex, a, b []*labels.Matcher) int64 {
+	if sa, ok := index.(SetAlgebraIndex); ok {
+		return sa.EstimateDifference(a, b)
+	}
+	card := index.GetCardinality(a...)
+	if card == 0 || len(b) == 0 {
+		return card
+	}
+	both := index.GetCardinality(append(a[:len(a):len(a)], b...)...)
+	return max(card-min(both, card), 0)
+}
+
+// EstimateUnion estimates the series matching any of the matcher sets.
+// Indexes that don't implement SetAlgebraIndex answer by inclusion-exclusion
+// over the intersections of the sets, and fail for more than 12 sets. The
+// estimate is kept between the largest set and the sum of the sets, which
+// sketch errors can leave.
+func EstimateUnion(index CardinalityIndex, sets ...[]*labels.Matcher) (int64, error) {
+	if sa, ok := index.(SetAlgebraIndex); ok {
+		return sa.EstimateUnion(sets...), nil
+	}
+	var nonEmpty [][]*labels.Matcher
+	var largest, sum int64
+	for _, set := range sets {
+		card := index.GetCardinality(set...)
+		if card == 0 {
+			continue
+		}
+		nonEmpty = append(nonEmpty, set)
+		largest, sum = max(largest, card), sum+card
+	}
+	switch {
+	case len(nonEmpty) <= 1:
+		return sum, nil
+	case len(nonEmpty) > maxUnionSets:
+		return 0, fmt.Errorf("union of %d matcher sets, the index supports up to %d", len(nonEmpty), maxUnionSets)
+	}
+
+	// The intersection of a subset is empty if the intersection of the
+	// subset without its highest set is, which prunes disjoint sets.
+	empty := make([]bool, 1<<len(nonEmpty))
+	var union int64
+	for subset := 1; subset < len(empty); subset++ {
+		high := 1 << (bits.Len(uint(subset)) - 1)
+		if subset != high && empty[subset^high] {
+			empty[subset] = true
+			continue
+		}
+		var matchers []*labels.Matcher
+		n := 0
+		for i, set := range nonEmpty {
+			if subset&(1<<i) != 0 {
+				matchers = append(matchers, set...)
+				n++
+			}
+		}
+		card := index.GetCardinality(matchers...)
+		empty[subset] = card == 0
+		if n%2 == 1 {
+			union += card
+		} else {
+			union -= card
+		}
+	}
+	return min(max(union, largest), sum), nil
+}
+
+// EstimateDifference returns the series matching a but not b, exactly.
+func (b *BitmapIndex) EstimateDifference(a, not []*labels.Matcher) int64 {
+	ctx := context.Background()
+	bitmap := b.matchingBitmap(ctx, a)
+	if !bitmap.IsEmpty() {
+		bitmap.AndNot(b.matchingBitmap(ctx, not))
+	}
+	return int64(bitmap.GetCardinality())
+}
+
+// EstimateUnion returns the series matching any of the matcher sets,
+// exactly.
+func (b *BitmapIndex) EstimateUnion(sets ...[]*labels.Matcher) int64 {
+	ctx := context.Background()
+	union := roaring64.NewBitmap()
+	for _, set := range sets {
+		union.Or(b.matchingBitmap(ctx, set))
+	}
+	return int64(union.GetCardinality())
+}
+
+// matchingBitmap returns the series matching all matchers, none for an
+// empty matcher set.
+func (b *BitmapIndex) matchingBitmap(ctx context.Context, matchers []*labels.Matcher) *roaring64.Bitmap {
+	if len(matchers) == 0 {
+		return roaring64.NewBitmap()
+	}
+	matchers, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return roaring64.NewBitmap()
+	}
+	return b.getIntersectionBitmap(ctx, matchers)
+}
@@ -0,0 +1,74 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"regexp"
+)
+
+// SimplifyMatchers returns an equivalent, simpler set of matchers to
+// estimate. Regexes without metacharacters become equality matchers,
+// matchers selecting every series like =~".*" and duplicate matchers are
+// dropped, and matchers on a label that also has an equality matcher are
+// checked against its value. It returns false if the matchers contradict
+// each other, like x="a" and x="b", and so select no series. If every
+// matcher selects all series, one of them is kept so that the set still
+// does. The given matchers are not modified.
+func SimplifyMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, bool) {
+	simplified := make([]*labels.Matcher, 0, len(matchers))
+	equal := make(map[string]string)
+	for _, m := range matchers {
+		m = literalMatcher(m)
+		if m.Type == labels.MatchEqual {
+			if value, ok := equal[m.Name]; ok && value != m.Value {
+				return nil, false
+			}
+			equal[m.Name] = m.Value
+		}
+		simplified = append(simplified, m)
+	}
+
+	type matcherKey struct {
+		t           labels.MatchType
+		name, value string
+	}
+	seen := make(map[matcherKey]struct{}, len(simplified))
+	result := simplified[:0]
+	for _, m := range simplified {
+		key := matcherKey{m.Type, m.Name, m.Value}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if value, ok := equal[m.Name]; ok && m.Type != labels.MatchEqual {
+			if !m.Matches(value) {
+				return nil, false
+			}
+			// Implied by the equality matcher.
+			continue
+		}
+		if m.Type == labels.MatchRegexp && m.Value == ".*" {
+			continue
+		}
+		result = append(result, m)
+	}
+	if len(result) == 0 && len(matchers) > 0 {
+		result = append(result, simplified[0])
+	}
+	return result, true
+}
+
+// literalMatcher returns an equality matcher for a regex matcher without
+// metacharacters. Regexes are anchored, so they match the literal only.
+func literalMatcher(m *labels.Matcher) *labels.Matcher {
+	if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+		return m
+	}
+	if regexp.QuoteMeta(m.Value) != m.Value {
+		return m
+	}
+	if m.Type == labels.MatchRegexp {
+		return labels.MustNewMatcher(labels.MatchEqual, m.Name, m.Value)
+	}
+	return labels.MustNewMatcher(labels.MatchNotEqual, m.Name, m.Value)
+}
@@ -0,0 +1,90 @@
+package sketchcore
+
+import (
+	"github.com/axiomhq/hyperminhash"
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ValueBuckets replaces the per-value structures of an ultra-high-cardinality
+// label with a fixed number of buckets, sketches for the Index and bitmaps
+// for the BitmapIndex of the cardinality package. Values are hashed into
+// buckets and every bucket holds the union of the series of its values, so
+// memory is bounded by the number of buckets rather than the number of
+// values. The value strings aren't kept; a sketch estimates how many
+// distinct values were added.
+//
+// Matchers on a bucketed label over-count: equality and regex set matchers
+// select the buckets their values hash to, whether or not the values were
+// added, and other matchers select every bucket.
+type ValueBuckets[T any] struct {
+	// Distinct holds the values added to the buckets.
+	Distinct *hyperminhash.Sketch
+	Buckets  []T
+}
+
+// NewValueBuckets returns n buckets created with newFn.
+func NewValueBuckets[T any](n int, newFn func() T) *ValueBuckets[T] {
+	v := &ValueBuckets[T]{
+		Distinct: hyperminhash.New(),
+		Buckets:  make([]T, n),
+	}
+	for i := range v.Buckets {
+		v.Buckets[i] = newFn()
+	}
+	return v
+}
+
+// Bucket returns the bucket value belongs to, counting the value.
+func (v *ValueBuckets[T]) Bucket(value string) T {
+	v.Distinct.Add([]byte(value))
+	return v.Buckets[bucketIndex(value, len(v.Buckets))]
+}
+
+// Values estimates the number of distinct values added.
+func (v *ValueBuckets[T]) Values() int {
+	return int(v.Distinct.Cardinality())
+}
+
+// ForEachMatching calls fn once for every bucket that may hold a value
+// matching the matcher.
+func (v *ValueBuckets[T]) ForEachMatching(matcher *labels.Matcher, fn func(T)) {
+	for _, i := range MatchingBuckets(matcher, len(v.Buckets)) {
+		fn(v.Buckets[i])
+	}
+}
+
+// MatchingBuckets returns the indexes of the buckets out of n that may hold
+// a non-empty value matching the matcher, in increasing order.
+func MatchingBuckets(matcher *labels.Matcher, n int) []int {
+	var values []string
+	switch matcher.Type {
+	case labels.MatchEqual:
+		values = []string{matcher.Value}
+	case labels.MatchRegexp:
+		values = matcher.SetMatches()
+	}
+
+	selected := make([]bool, n)
+	if values == nil {
+		for i := range selected {
+			selected[i] = true
+		}
+	}
+	for _, value := range values {
+		if value != "" {
+			selected[bucketIndex(value, n)] = true
+		}
+	}
+	var buckets []int
+	for i, ok := range selected {
+		if ok {
+			buckets = append(buckets, i)
+		}
+	}
+	return buckets
+}
+
+func bucketIndex(value string, n int) int {
+	return int(xxhash.Sum64String(value) % uint64(n))
+}
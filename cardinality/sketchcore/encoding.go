@@ -0,0 +1,307 @@
+package sketchcore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/axiomhq/hyperminhash"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"unsafe"
+)
+
+const (
+	indexMagic = 0x5CE7C4DE
+	// Version 2 added the values kept exact, see SetAccuracyTarget, and
+	// version 3 replaced the values of bucketed labels with a sketch of
+	// them.
+	indexVersion = 3
+
+	labelValues   = 0
+	labelBucketed = 1
+
+	// The lengths and counts read by ReadIndex are bounded, so a corrupted
+	// or hostile index can't allocate unbounded memory.
+	maxIndexString  = 1 << 20
+	maxIndexValues  = 1 << 24
+	maxIndexBuckets = 1 << 16
+)
+
+// ErrInvalidIndex is returned when reading data that isn't a serialized
+// index.
+var ErrInvalidIndex = errors.New("invalid sketch index")
+
+// SketchSize is the size of a serialized sketch. Sketches have no
+// serialization of their own, so their registers are copied as raw memory
+// in the byte order of the platform, which is little-endian on amd64, arm64
+// and WebAssembly.
+const SketchSize = int(unsafe.Sizeof(hyperminhash.Sketch{}))
+
+// SketchBytes returns the memory of the sketch as a byte slice, to write it
+// or to read it in place.
+func SketchBytes(sk *hyperminhash.Sketch) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(sk)), SketchSize)
+}
+
+// AppendSketch appends the registers of the sketch to b in little-endian
+// byte order, for formats read on other platforms, like deltas.
+func AppendSketch(b []byte, sk *hyperminhash.Sketch) []byte {
+	for _, r := range registers(sk) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+// ReadSketch reads a sketch written with AppendSketch.
+func ReadSketch(r io.Reader) (*hyperminhash.Sketch, error) {
+	sk := hyperminhash.New()
+	b := SketchBytes(sk)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	// Every register is decoded from the bytes it occupies.
+	regs := registers(sk)
+	for i := range regs {
+		regs[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return sk, nil
+}
+
+// WriteTo writes the index in a binary format read by ReadIndex.
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	write := func(b []byte) {
+		m, _ := bw.Write(b)
+		n += int64(m)
+	}
+	writeUvarint := func(v int) {
+		write(binary.AppendUvarint(nil, uint64(v)))
+	}
+	writeString := func(s string) {
+		writeUvarint(len(s))
+		write([]byte(s))
+	}
+
+	write(binary.BigEndian.AppendUint32(nil, indexMagic))
+	write([]byte{indexVersion})
+	writeUvarint(x.bucketThreshold)
+	writeUvarint(x.buckets)
+	write(binary.AppendUvarint(nil, uint64(x.exactLimit)))
+	write(SketchBytes(x.all))
+
+	// Every label with values or buckets is present, so the present
+	// sketches list all the labels.
+	writeUvarint(len(x.present))
+	for _, name := range slices.Sorted(maps.Keys(x.present)) {
+		writeString(name)
+		write(SketchBytes(x.present[name]))
+
+		if buckets, ok := x.bucketed[name]; ok {
+			write([]byte{labelBucketed})
+			write(SketchBytes(buckets.Distinct))
+			writeUvarint(len(buckets.Buckets))
+			for _, hll := range buckets.Buckets {
+				write(SketchBytes(hll))
+			}
+			continue
+		}
+
+		write([]byte{labelValues})
+		writeUvarint(len(x.values[name]))
+		for value, hll := range x.values[name] {
+			writeString(value)
+			write(SketchBytes(hll))
+		}
+		writeUvarint(len(x.exact[name]))
+		for value, hashes := range x.exact[name] {
+			writeString(value)
+			writeUvarint(len(hashes))
+			for _, hash := range hashes {
+				write(binary.BigEndian.AppendUint64(nil, hash))
+			}
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadIndex reads an index written by Index.WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	readSketch := func() (*hyperminhash.Sketch, error) {
+		sk := hyperminhash.New()
+		_, err := io.ReadFull(br, SketchBytes(sk))
+		return sk, err
+	}
+	readInt := func(limit int) (int, error) {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, err
+		}
+		if v > uint64(limit) {
+			return 0, fmt.Errorf("%w: length %d exceeds %d", ErrInvalidIndex, v, limit)
+		}
+		return int(v), nil
+	}
+	readString := func() (string, error) {
+		n, err := readInt(maxIndexString)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header) != indexMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidIndex)
+	}
+	version := header[4]
+	if version < 1 || version > indexVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidIndex, header[4])
+	}
+
+	threshold, err := readInt(math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := readInt(maxIndexBuckets)
+	if err != nil {
+		return nil, err
+	}
+	x := NewIndex(threshold, buckets)
+	if version > 1 {
+		limit, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 {
+			x.exactLimit = int(min(limit, maxExactHashes))
+			x.exact = make(map[string]map[string][]uint64)
+		}
+	}
+	if x.all, err = readSketch(); err != nil {
+		return nil, err
+	}
+
+	numNames, err := readInt(maxIndexValues)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numNames; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		if x.present[name], err = readSketch(); err != nil {
+			return nil, err
+		}
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case labelValues:
+			numValues, err := readInt(maxIndexValues)
+			if err != nil {
+				return nil, err
+			}
+			// The values are read before the map grows to their count.
+			valueMap := make(map[string]*hyperminhash.Sketch, min(numValues, 1024))
+			for j := 0; j < numValues; j++ {
+				value, err := readString()
+				if err != nil {
+					return nil, err
+				}
+				if valueMap[value], err = readSketch(); err != nil {
+					return nil, err
+				}
+			}
+			if version > 1 {
+				if err := x.readExact(name, br, readInt, readString); err != nil {
+					return nil, err
+				}
+			}
+			if numValues > 0 || x.exact[name] != nil {
+				x.values[name] = valueMap
+			}
+
+		case labelBucketed:
+			distinct := hyperminhash.New()
+			if version < 3 {
+				numValues, err := readInt(maxIndexValues)
+				if err != nil {
+					return nil, err
+				}
+				for j := 0; j < numValues; j++ {
+					value, err := readString()
+					if err != nil {
+						return nil, err
+					}
+					distinct.Add([]byte(value))
+				}
+			} else if distinct, err = readSketch(); err != nil {
+				return nil, err
+			}
+			numBuckets, err := readInt(maxIndexBuckets)
+			if err != nil {
+				return nil, err
+			}
+			if numBuckets == 0 {
+				return nil, fmt.Errorf("%w: label %q has no buckets", ErrInvalidIndex, name)
+			}
+			b := &ValueBuckets[*hyperminhash.Sketch]{Distinct: distinct, Buckets: make([]*hyperminhash.Sketch, numBuckets)}
+			for j := range b.Buckets {
+				if b.Buckets[j], err = readSketch(); err != nil {
+					return nil, err
+				}
+			}
+			x.bucketed[name] = b
+
+		default:
+			return nil, fmt.Errorf("%w: unknown label kind %d", ErrInvalidIndex, kind)
+		}
+	}
+	return x, nil
+}
+
+// readExact reads the values of a label kept exact.
+func (x *Index) readExact(name string, br *bufio.Reader, readInt func(limit int) (int, error), readString func() (string, error)) error {
+	numValues, err := readInt(maxIndexValues)
+	if err != nil || numValues == 0 {
+		return err
+	}
+	if x.exact == nil {
+		return fmt.Errorf("%w: label %q has exact values but the index keeps none", ErrInvalidIndex, name)
+	}
+	values := make(map[string][]uint64, min(numValues, 1024))
+	for i := 0; i < numValues; i++ {
+		value, err := readString()
+		if err != nil {
+			return err
+		}
+		n, err := readInt(maxExactHashes)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 8*n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return err
+		}
+		hashes := make([]uint64, n)
+		for j := range hashes {
+			hashes[j] = binary.BigEndian.Uint64(b[8*j:])
+		}
+		values[value] = hashes
+	}
+	x.exact[name] = values
+	return nil
+}
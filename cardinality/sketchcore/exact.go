@@ -0,0 +1,120 @@
+package sketchcore
+
+import (
+	"encoding/binary"
+	"github.com/axiomhq/hyperminhash"
+	"math"
+	"slices"
+)
+
+// Precision is the number of bits of the hashes of series that select the
+// register of a sketch. Sketches have a fixed precision of 2^14 registers.
+const Precision = 14
+
+// SketchError is the relative standard error of the number of series in a
+// sketch. It depends on the precision of sketches, not on their
+// cardinality.
+var SketchError = 1.04 / math.Sqrt(1<<Precision)
+
+// maxExactHashes bounds the exact set of a label value, 512KiB of hashes,
+// whatever the target.
+const maxExactHashes = 1 << 16
+
+// exactLimit returns the number of series up to which a label value is
+// kept as an exact set of series hashes for a target relative error. A
+// sketch meeting the target replaces the set once it is smaller, while
+// sketches less accurate than the target only replace sets reaching
+// maxExactHashes.
+func exactLimit(relErr float64) int {
+	if relErr < SketchError {
+		return maxExactHashes
+	}
+	return SketchSize / 8
+}
+
+// SetAccuracyTarget makes the index keep the label values added from now on
+// as exact sets of series hashes as long as they are smaller than a sketch,
+// or, if relErr is below SketchError, up to maxExactHashes series. Small
+// values, usually most of them, take a fraction of the memory of a sketch,
+// while memory goes to the sketches of large values. The sets don't make
+// answers exact: queries add the hashes of the values they match to the
+// sketch they merge into, which is the sketch the series would have been
+// added to, so answers have the error of sketches, SketchError relative to
+// the union of the matching values, less for small unions, which sketches
+// count almost exactly. Only the sets are exact, e.g. for the number of
+// series of a value. A zero relErr sketches every value, which is the
+// default.
+func (x *Index) SetAccuracyTarget(relErr float64) {
+	if relErr <= 0 {
+		x.exactLimit = 0
+		return
+	}
+	x.exactLimit = exactLimit(relErr)
+	if x.exact == nil {
+		x.exact = make(map[string]map[string][]uint64)
+	}
+}
+
+// ExactHashes returns the number of series hashes held by the values kept
+// exact, which take 8 bytes each.
+func (x *Index) ExactHashes() int {
+	var n int
+	for _, values := range x.exact {
+		for _, hashes := range values {
+			n += len(hashes)
+		}
+	}
+	return n
+}
+
+// addExact adds the series to the exact set of the label value, promoting
+// the value to a sketch once it reaches the limit. It reports whether the
+// series was added, which it isn't if the value already has a sketch.
+func (x *Index) addExact(name, value string, hash uint64) bool {
+	if x.exactLimit == 0 {
+		return false
+	}
+	if _, ok := x.values[name][value]; ok {
+		return false
+	}
+
+	values, ok := x.exact[name]
+	if !ok {
+		values = make(map[string][]uint64)
+		x.exact[name] = values
+	}
+	hashes := values[value]
+	if i, found := slices.BinarySearch(hashes, hash); !found {
+		hashes = slices.Insert(hashes, i, hash)
+	}
+	if len(hashes) <= x.exactLimit {
+		values[value] = hashes
+		return true
+	}
+	x.values[name][value] = sketchOf(hashes)
+	x.deleteExact(name, value)
+	return true
+}
+
+func (x *Index) deleteExact(name, value string) {
+	delete(x.exact[name], value)
+	if len(x.exact[name]) == 0 {
+		delete(x.exact, name)
+	}
+}
+
+// sketchOf returns the sketch of the series hashes, which is the sketch the
+// series would have been added to.
+func sketchOf(hashes []uint64) *hyperminhash.Sketch {
+	sk := hyperminhash.New()
+	addHashes(sk, hashes)
+	return sk
+}
+
+func addHashes(sk *hyperminhash.Sketch, hashes []uint64) {
+	var b [8]byte
+	for _, hash := range hashes {
+		binary.BigEndian.PutUint64(b[:], hash)
+		sk.Add(b[:])
+	}
+}
@@ -0,0 +1,469 @@
+// Package sketchcore is the core of the HyperMinHash cardinality index: the
+// sketches of the series of every label value and the estimation of
+// matchers from them. It has no TSDB or tracing dependencies, so it can be
+// compiled to WebAssembly and a serialized index queried client-side.
+package sketchcore
+
+import (
+	"encoding/binary"
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+	"iter"
+	"maps"
+	"slices"
+)
+
+// Index holds a sketch of the series of every label value. Labels with more
+// values than the bucketing threshold are moved into value buckets. An
+// Index is not safe for concurrent use.
+type Index struct {
+	values   map[string]map[string]*hyperminhash.Sketch
+	bucketed map[string]*ValueBuckets[*hyperminhash.Sketch]
+
+	// bucketThreshold is the number of values above which a label is
+	// bucketed. Zero disables bucketing.
+	bucketThreshold int
+	buckets         int
+
+	// all holds every series and present the series of every label name,
+	// to estimate the series without a label for matchers that match "".
+	all     *hyperminhash.Sketch
+	present map[string]*hyperminhash.Sketch
+
+	// exact holds the series hashes of the values that have no sketch yet,
+	// up to exactLimit series, see SetAccuracyTarget.
+	exact      map[string]map[string][]uint64
+	exactLimit int
+}
+
+// NewIndex returns an empty index that buckets the values of labels with
+// more than bucketThreshold values into the given number of buckets. A zero
+// threshold disables bucketing.
+func NewIndex(bucketThreshold, buckets int) *Index {
+	return &Index{
+		values:          make(map[string]map[string]*hyperminhash.Sketch),
+		bucketed:        make(map[string]*ValueBuckets[*hyperminhash.Sketch]),
+		bucketThreshold: bucketThreshold,
+		buckets:         buckets,
+		all:             hyperminhash.New(),
+		present:         make(map[string]*hyperminhash.Sketch),
+	}
+}
+
+// HashBytes returns the encoding of a series hash added to the sketches.
+func HashBytes(hash uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), hash)
+}
+
+// AddSeries adds the series with the given hash to the total series. Its
+// labels are added with AddLabel.
+func (x *Index) AddSeries(hash uint64) {
+	x.all.Add(HashBytes(hash))
+}
+
+// AddLabel adds the series with the given hash to the sketch of the label
+// value. It reports whether the label is bucketed, which may be the result
+// of this value.
+func (x *Index) AddLabel(hash uint64, name, value string) bool {
+	b := HashBytes(hash)
+
+	present, ok := x.present[name]
+	if !ok {
+		present = hyperminhash.New()
+		x.present[name] = present
+	}
+	present.Add(b)
+
+	if buckets, ok := x.bucketed[name]; ok {
+		buckets.Bucket(value).Add(b)
+		return true
+	}
+
+	valueMap, ok := x.values[name]
+	if !ok {
+		valueMap = make(map[string]*hyperminhash.Sketch)
+		x.values[name] = valueMap
+	}
+	if !x.addExact(name, value, hash) {
+		hll, ok := valueMap[value]
+		if !ok {
+			hll = hyperminhash.New()
+			valueMap[value] = hll
+		}
+		hll.Add(b)
+	}
+
+	if x.bucketThreshold > 0 && len(valueMap)+len(x.exact[name]) > x.bucketThreshold {
+		x.bucketLabel(name, max(x.buckets, 1))
+		return true
+	}
+	return false
+}
+
+// bucketLabel moves the values of a label into n value buckets.
+func (x *Index) bucketLabel(name string, n int) *ValueBuckets[*hyperminhash.Sketch] {
+	buckets := NewValueBuckets(n, hyperminhash.New)
+	for value, hll := range x.values[name] {
+		MergeInto(buckets.Bucket(value), hll)
+	}
+	for value, hashes := range x.exact[name] {
+		addHashes(buckets.Bucket(value), hashes)
+	}
+	x.bucketed[name] = buckets
+	delete(x.values, name)
+	delete(x.exact, name)
+	return buckets
+}
+
+// Bucketed reports whether the values of the label are bucketed.
+func (x *Index) Bucketed(name string) bool {
+	_, ok := x.bucketed[name]
+	return ok
+}
+
+// Buckets returns the value buckets of a bucketed label.
+func (x *Index) Buckets(name string) (*ValueBuckets[*hyperminhash.Sketch], bool) {
+	buckets, ok := x.bucketed[name]
+	return buckets, ok
+}
+
+// Size returns the number of label names and values in the index, and the
+// number of sketches holding them. Values kept exact have no sketch, see
+// ExactHashes, and values of bucketed labels are estimated.
+func (x *Index) Size() (names, values, sketches int) {
+	names = len(x.present)
+	sketches = 1 + len(x.present)
+	for _, valueMap := range x.values {
+		values += len(valueMap)
+		sketches += len(valueMap)
+	}
+	for _, exact := range x.exact {
+		values += len(exact)
+	}
+	for _, buckets := range x.bucketed {
+		values += buckets.Values()
+		sketches += len(buckets.Buckets)
+	}
+	return names, values, sketches
+}
+
+// All returns the sketch of every series.
+func (x *Index) All() *hyperminhash.Sketch {
+	return x.all
+}
+
+// Present returns the sketch of the series with the label, or nil.
+func (x *Index) Present(name string) *hyperminhash.Sketch {
+	return x.present[name]
+}
+
+// Value returns the sketch of the series with the label value. Values of
+// bucketed labels have no sketch of their own, and the sketch of values
+// kept exact is built on every call.
+func (x *Index) Value(name, value string) (*hyperminhash.Sketch, bool) {
+	if hashes, ok := x.exact[name][value]; ok {
+		return sketchOf(hashes), true
+	}
+	hll, ok := x.values[name][value]
+	return hll, ok
+}
+
+// MergeAll merges sk into the sketch of every series.
+func (x *Index) MergeAll(sk *hyperminhash.Sketch) {
+	MergeInto(x.all, sk)
+}
+
+// MergePresent merges sk into the sketch of the series with the label.
+func (x *Index) MergePresent(name string, sk *hyperminhash.Sketch) {
+	if present, ok := x.present[name]; ok {
+		MergeInto(present, sk)
+	} else {
+		x.present[name] = Clone(sk)
+	}
+}
+
+// MergeValue merges sk into the sketch of the label value, or into its
+// bucket if the label is bucketed.
+func (x *Index) MergeValue(name, value string, sk *hyperminhash.Sketch) {
+	if buckets, ok := x.bucketed[name]; ok {
+		MergeInto(buckets.Bucket(value), sk)
+		return
+	}
+
+	valueMap, ok := x.values[name]
+	if !ok {
+		valueMap = make(map[string]*hyperminhash.Sketch)
+		x.values[name] = valueMap
+	}
+	if hashes, ok := x.exact[name][value]; ok {
+		// Sketches can't be turned back into series, so the value is
+		// promoted.
+		promoted := sketchOf(hashes)
+		MergeInto(promoted, sk)
+		valueMap[value] = promoted
+		x.deleteExact(name, value)
+	} else if existing, ok := valueMap[value]; ok {
+		MergeInto(existing, sk)
+	} else {
+		valueMap[value] = Clone(sk)
+	}
+}
+
+// MergeBuckets merges the value buckets of a label bucketed by another
+// index, bucketing the label into as many buckets if it isn't yet. Buckets
+// are merged one for one between indexes with as many buckets; otherwise
+// values don't hash to the same buckets, so every bucket of b is merged
+// into every bucket of the label, which then over-counts like matchers
+// selecting every bucket.
+func (x *Index) MergeBuckets(name string, b *ValueBuckets[*hyperminhash.Sketch]) {
+	buckets, ok := x.bucketed[name]
+	if !ok {
+		buckets = x.bucketLabel(name, len(b.Buckets))
+	}
+	MergeInto(buckets.Distinct, b.Distinct)
+	if len(buckets.Buckets) == len(b.Buckets) {
+		for i, sk := range b.Buckets {
+			MergeInto(buckets.Buckets[i], sk)
+		}
+		return
+	}
+	union := hyperminhash.New()
+	for _, sk := range b.Buckets {
+		MergeInto(union, sk)
+	}
+	for _, sk := range buckets.Buckets {
+		MergeInto(sk, union)
+	}
+}
+
+// Sketch returns the union of the sketches of the values of the matcher's
+// label that match it. Series without the label are never included.
+func (x *Index) Sketch(matcher *labels.Matcher) *hyperminhash.Sketch {
+	return x.sketch(nil, matcher)
+}
+
+// SketchScratch is like Sketch, merging into a sketch of scratch. The
+// sketch must not be used after the scratch is reset.
+func (x *Index) SketchScratch(scratch *Scratch, matcher *labels.Matcher) *hyperminhash.Sketch {
+	return x.sketch(scratch, matcher)
+}
+
+func (x *Index) sketch(scratch *Scratch, matcher *labels.Matcher) *hyperminhash.Sketch {
+	resultSketch := scratch.get()
+	scratch.beginMatcher()
+	done := scratch.matcherHook(matcher)
+	// complete is cleared once the matcher runs out of the limits of the
+	// scratch, and the result is widened to an upper bound.
+	complete := true
+	defer func() {
+		if present, ok := x.present[matcher.Name]; ok && !complete {
+			// Every matching value is a subset of the label.
+			MergeInto(resultSketch, present)
+		}
+		if done != nil {
+			done(resultSketch)
+		}
+	}()
+
+	if buckets, ok := x.bucketed[matcher.Name]; ok {
+		buckets.ForEachMatching(matcher, func(hll *hyperminhash.Sketch) {
+			if complete = complete && scratch.merge(); complete {
+				MergeInto(resultSketch, hll)
+			}
+		})
+		return resultSketch
+	}
+
+	valueMap, ok := x.values[matcher.Name]
+	if !ok {
+		return resultSketch
+	}
+	exact := x.exact[matcher.Name]
+	if matcher.Type == labels.MatchEqual {
+		if hll, exists := valueMap[matcher.Value]; exists {
+			if complete = scratch.merge(); complete {
+				MergeInto(resultSketch, hll)
+			}
+		} else if hashes, exists := exact[matcher.Value]; exists {
+			if complete = scratch.merge(); complete {
+				addHashes(resultSketch, hashes)
+			}
+		}
+		return resultSketch
+	}
+	for value, hll := range valueMap {
+		if complete = scratch.scan(); !complete {
+			return resultSketch
+		}
+		if matcher.Matches(value) {
+			if complete = scratch.merge(); !complete {
+				return resultSketch
+			}
+			MergeInto(resultSketch, hll)
+		}
+	}
+	for value, hashes := range exact {
+		if complete = scratch.scan(); !complete {
+			return resultSketch
+		}
+		if matcher.Matches(value) {
+			if complete = scratch.merge(); !complete {
+				return resultSketch
+			}
+			addHashes(resultSketch, hashes)
+		}
+	}
+	return resultSketch
+}
+
+// Cardinality estimates the number of series matching all the matchers.
+// Without matchers it returns 0.
+func (x *Index) Cardinality(matchers ...*labels.Matcher) int64 {
+	return x.CardinalityScratch(nil, matchers...)
+}
+
+// CardinalityScratch is like Cardinality, taking the sketches it merges
+// into from scratch. The strategy of the estimate is chosen from the
+// matchers and the size of their sketches, see PlanWith.
+func (x *Index) CardinalityScratch(scratch *Scratch, matchers ...*labels.Matcher) int64 {
+	if len(matchers) == 0 {
+		return 0
+	}
+	card, _ := x.PlanWith(scratch, nil, matchers...)
+	return card
+}
+
+// CardinalityWith estimates the number of series in the intersection of
+// the sketches that match all the matchers, for callers keeping sketches of
+// their own. The sketches must hold the series hashes as added with
+// AddSeries, encoded with HashBytes.
+func (x *Index) CardinalityWith(scratch *Scratch, sketches []*hyperminhash.Sketch, matchers ...*labels.Matcher) int64 {
+	card, _ := x.PlanWith(scratch, sketches, matchers...)
+	return card
+}
+
+// Series estimates the total number of series.
+func (x *Index) Series() int64 {
+	return int64(x.all.Cardinality())
+}
+
+func (x *Index) LabelNames(matchers ...*labels.Matcher) []string {
+	scratch := AcquireScratch()
+	defer ReleaseScratch(scratch)
+	sketches, matchingEmpty := x.sketches(scratch, matchers)
+
+	var names []string
+	for name, valueMap := range x.values {
+		if len(matchers) == 0 || x.cardinalityWithMissing(nil, append(sketches, x.labelSketch(name, valueMap)), matchingEmpty) > 0 {
+			names = append(names, name)
+		}
+	}
+	for name, buckets := range x.bucketed {
+		if len(matchers) == 0 || x.cardinalityWithMissing(nil, append(sketches, union(slices.Values(buckets.Buckets))), matchingEmpty) > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// LabelValues returns the values of the label. The values of bucketed
+// labels aren't kept, so there are none.
+func (x *Index) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	scratch := AcquireScratch()
+	defer ReleaseScratch(scratch)
+	sketches, matchingEmpty := x.sketches(scratch, matchers)
+
+	// sketches has room for one more element, so appending the value sketch
+	// reuses the same backing array on every iteration.
+	var values []string
+	for value, hll := range x.values[name] {
+		if len(matchers) == 0 || x.cardinalityWithMissing(nil, append(sketches, hll), matchingEmpty) > 0 {
+			values = append(values, value)
+		}
+	}
+	for value, hashes := range x.exact[name] {
+		if len(matchers) == 0 || x.cardinalityWithMissing(nil, append(sketches, sketchOf(hashes)), matchingEmpty) > 0 {
+			values = append(values, value)
+		}
+	}
+	slices.Sort(values)
+	return values
+}
+
+// labelSketch returns the union of the values of a label that isn't
+// bucketed.
+func (x *Index) labelSketch(name string, valueMap map[string]*hyperminhash.Sketch) *hyperminhash.Sketch {
+	sk := union(maps.Values(valueMap))
+	for _, hashes := range x.exact[name] {
+		addHashes(sk, hashes)
+	}
+	return sk
+}
+
+func union(sketches iter.Seq[*hyperminhash.Sketch]) *hyperminhash.Sketch {
+	result := hyperminhash.New()
+	for hll := range sketches {
+		MergeInto(result, hll)
+	}
+	return result
+}
+
+// sketches returns the sketches of the matchers that don't match "", and
+// the matchers that do, which also select the series without their label
+// (including every series for labels that don't exist) and are evaluated by
+// cardinalityWithMissing.
+func (x *Index) sketches(scratch *Scratch, matchers []*labels.Matcher) ([]*hyperminhash.Sketch, []*labels.Matcher) {
+	sketches := make([]*hyperminhash.Sketch, 0, len(matchers)+1)
+	var matchingEmpty []*labels.Matcher
+	for _, matcher := range matchers {
+		if matcher.Matches("") {
+			matchingEmpty = append(matchingEmpty, matcher)
+			continue
+		}
+		sketches = append(sketches, x.sketch(scratch, matcher))
+	}
+	return sketches, matchingEmpty
+}
+
+// cardinalityWithMissing estimates the series in the intersection of the
+// sketches that also match every matcher, where the matchers match "" and
+// so also select the series without their label. Sketches can't be
+// subtracted, so each such matcher is expanded using that the series with
+// a matching value are a subset of the series having the label:
+//
+//	|X ∩ (M ∪ missing)| = |X ∩ M| + |X| - |X ∩ present|
+func (x *Index) cardinalityWithMissing(scratch *Scratch, sketches []*hyperminhash.Sketch, matchers []*labels.Matcher) int64 {
+	if len(matchers) == 0 {
+		if len(sketches) == 0 {
+			return x.Series()
+		}
+		return Intersection(sketches)
+	}
+
+	matcher, rest := matchers[0], matchers[1:]
+	present, ok := x.present[matcher.Name]
+	if !ok {
+		present = scratch.get()
+	}
+	sketches = slices.Clip(sketches)
+	matching := x.cardinalityWithMissing(scratch, append(sketches, x.sketch(scratch, matcher)), rest)
+	all := x.cardinalityWithMissing(scratch, sketches, rest)
+	withLabel := x.cardinalityWithMissing(scratch, append(sketches, present), rest)
+	return max(0, matching+all-withLabel)
+}
+
+// Intersection estimates the number of elements in the intersection of the
+// sketches as the smallest pairwise intersection.
+func Intersection(sketches []*hyperminhash.Sketch) int64 {
+	card := int64(sketches[0].Cardinality())
+	for i := 0; i < len(sketches); i++ {
+		for j := i + 1; j < len(sketches); j++ {
+			i := int64(sketches[i].Intersection(sketches[j]))
+			if i < card {
+				card = i
+			}
+		}
+	}
+	return card
+}
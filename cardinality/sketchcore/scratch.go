@@ -0,0 +1,215 @@
+package sketchcore
+
+import (
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// maxPooledSketches bounds the sketches a pooled Scratch keeps, so that a
+// query merging into many sketches doesn't pin them in the pool.
+const maxPooledSketches = 16
+
+var scratchPool = sync.Pool{
+	New: func() any { return &Scratch{} },
+}
+
+// Scratch holds sketches reused by the queries of an Index, which would
+// otherwise allocate a sketch for every matcher. The zero value is ready to
+// use, and a nil Scratch allocates new sketches. A Scratch is not safe for
+// concurrent use.
+type Scratch struct {
+	sketches []*hyperminhash.Sketch
+	used     int
+	limits   Limits
+
+	hook MatcherHook
+}
+
+// MatcherHook is called with every matcher whose sketch a query builds, and
+// the function it returns with the sketch once built, e.g. to trace the
+// matchers of a query without this package depending on a tracer.
+type MatcherHook func(matcher *labels.Matcher) func(sketch *hyperminhash.Sketch)
+
+// SetMatcherHook sets the hook of the queries using the Scratch, nil for
+// none. The hook is kept across Reset.
+func (s *Scratch) SetMatcherHook(hook MatcherHook) {
+	s.hook = hook
+}
+
+// matcherHook runs the hook, if any, for a matcher whose sketch is about to
+// be built, and returns the function to call with the sketch. It is safe to
+// call on a nil Scratch.
+func (s *Scratch) matcherHook(matcher *labels.Matcher) func(*hyperminhash.Sketch) {
+	if s == nil || s.hook == nil {
+		return nil
+	}
+	return s.hook(matcher)
+}
+
+// Limits counts the label values compared against the matchers of a query,
+// the bitmaps or sketches it merged and the time it spent, against limits
+// on each. A query reaching a limit is truncated. The zero value is
+// unlimited.
+type Limits struct {
+	maxValues, maxMerges int
+	deadline             time.Time
+	scanned, merges      int
+	truncated            bool
+}
+
+// Set sets the limits on the values compared against a single matcher, the
+// merges and the time of the query; zero values are unlimited.
+func (l *Limits) Set(maxValues, maxMerges int, deadline time.Time) {
+	l.maxValues, l.maxMerges, l.deadline = maxValues, maxMerges, deadline
+}
+
+// Reset resets the counts for a new query. The limits are kept.
+func (l *Limits) Reset() {
+	l.scanned, l.merges, l.truncated = 0, 0, false
+}
+
+// Truncated reports whether the query reached a limit since the last Reset.
+func (l *Limits) Truncated() bool {
+	return l.truncated
+}
+
+// BeginMatcher resets the values scanned, which are limited per matcher.
+func (l *Limits) BeginMatcher() {
+	l.scanned = 0
+}
+
+// Scan counts a value compared against a matcher and reports whether the
+// query is within its limits.
+func (l *Limits) Scan() bool {
+	l.scanned++
+	switch {
+	case l.maxValues > 0 && l.scanned > l.maxValues:
+	// Reading the clock for every value would dominate cheap matchers.
+	case !l.deadline.IsZero() && l.scanned%64 == 0 && time.Now().After(l.deadline):
+	default:
+		return true
+	}
+	l.truncated = true
+	return false
+}
+
+// Merge counts a merged bitmap or sketch and reports whether the query is
+// within its limits.
+func (l *Limits) Merge() bool {
+	l.merges++
+	if l.maxMerges > 0 && l.merges > l.maxMerges {
+		l.truncated = true
+		return false
+	}
+	return true
+}
+
+// SetLimits bounds the label values a matcher is compared against, the sketches
+// merged and the time spent by the queries using the Scratch; zero values
+// are unlimited. A matcher reaching a limit is answered by the sketch of the
+// series having its label, an upper bound of its answer, and Truncated
+// reports it. Limits are kept across Reset, the counts are not.
+func (s *Scratch) SetLimits(maxValues, maxMerges int, deadline time.Time) {
+	s.limits.Set(maxValues, maxMerges, deadline)
+}
+
+// Limits returns the limits of the Scratch, for callers counting the work
+// of queries that don't use sketches against the same limits.
+func (s *Scratch) Limits() *Limits {
+	return &s.limits
+}
+
+// Truncated reports whether a query reached a limit since the last Reset.
+func (s *Scratch) Truncated() bool {
+	return s != nil && s.limits.Truncated()
+}
+
+// beginMatcher is Limits.BeginMatcher, safe to call on a nil Scratch.
+func (s *Scratch) beginMatcher() {
+	if s != nil {
+		s.limits.BeginMatcher()
+	}
+}
+
+// scan is Limits.Scan, safe to call on a nil Scratch.
+func (s *Scratch) scan() bool {
+	return s == nil || s.limits.Scan()
+}
+
+// merge is Limits.Merge, safe to call on a nil Scratch.
+func (s *Scratch) merge() bool {
+	return s == nil || s.limits.Merge()
+}
+
+// get returns an empty sketch.
+func (s *Scratch) get() *hyperminhash.Sketch {
+	if s == nil {
+		return hyperminhash.New()
+	}
+	if s.used == len(s.sketches) {
+		s.sketches = append(s.sketches, hyperminhash.New())
+	} else {
+		clear(registers(s.sketches[s.used]))
+	}
+	sk := s.sketches[s.used]
+	s.used++
+	return sk
+}
+
+// AcquireScratch returns a Scratch without limits from a pool, for the
+// queries of callers without a Scratch of their own. It must be returned
+// with ReleaseScratch once the sketches it returned are no longer used.
+func AcquireScratch() *Scratch {
+	return scratchPool.Get().(*Scratch)
+}
+
+// ReleaseScratch resets the Scratch, its limits and its hook and returns it
+// to the pool.
+func ReleaseScratch(s *Scratch) {
+	s.Reset()
+	s.SetLimits(0, 0, time.Time{})
+	s.hook = nil
+	if len(s.sketches) > maxPooledSketches {
+		clear(s.sketches[maxPooledSketches:])
+		s.sketches = s.sketches[:maxPooledSketches]
+	}
+	scratchPool.Put(s)
+}
+
+// Reset makes all sketches available again. Sketches returned by queries
+// using the Scratch must not be used afterwards.
+func (s *Scratch) Reset() {
+	s.used = 0
+	s.limits.Reset()
+}
+
+// InUse returns the number of sketches taken since the last Reset.
+func (s *Scratch) InUse() int {
+	return s.used
+}
+
+// registers returns the registers of the sketch, which are 16 bit values
+// compared as integers when merging.
+func registers(sk *hyperminhash.Sketch) []uint16 {
+	return unsafe.Slice((*uint16)(unsafe.Pointer(sk)), SketchSize/2)
+}
+
+// MergeInto merges src into dst in place. Sketch.Merge copies the registers
+// into a new sketch on every call instead.
+func MergeInto(dst, src *hyperminhash.Sketch) {
+	d, s := registers(dst), registers(src)
+	for i := range d {
+		d[i] = max(d[i], s[i])
+	}
+}
+
+// Clone returns a copy of the sketch. It allocates a single sketch, where
+// merging into a new sketch with Sketch.Merge allocates two.
+func Clone(sk *hyperminhash.Sketch) *hyperminhash.Sketch {
+	c := hyperminhash.New()
+	copy(registers(c), registers(sk))
+	return c
+}
@@ -0,0 +1,316 @@
+package sketchcore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestIndex() *Index {
+	x := NewIndex(50, 8)
+	for i := 0; i < 1000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "id", fmt.Sprintf("id-%d", i), "job", fmt.Sprintf("job-%d", i%10))
+		hash := lbls.Hash()
+		x.AddSeries(hash)
+		for _, l := range lbls {
+			x.AddLabel(hash, l.Name, l.Value)
+		}
+	}
+	return x
+}
+
+func TestIndex(t *testing.T) {
+	x := newTestIndex()
+
+	require.True(t, x.Bucketed("id"))
+	require.False(t, x.Bucketed("job"))
+	require.InEpsilon(t, 1000, x.Series(), 0.05)
+	require.InEpsilon(t, 250, x.Cardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")), 0.1)
+	require.InEpsilon(t, 1000, x.Cardinality(labels.MustNewMatcher(labels.MatchNotEqual, "unknown", "x")), 0.05)
+	require.Zero(t, x.Cardinality())
+	require.Equal(t, []string{"__name__", "id", "job"}, x.LabelNames())
+	require.Equal(t, []string{"job-1", "job-3", "job-5", "job-7", "job-9"}, x.LabelValues("job", labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")))
+	// The values of bucketed labels aren't kept, only estimated.
+	require.Empty(t, x.LabelValues("id"))
+	_, values, _ := x.Size()
+	require.InEpsilon(t, 1000+4+10, values, 0.05)
+}
+
+func TestWriteReadIndex(t *testing.T) {
+	x := newTestIndex()
+
+	var buf bytes.Buffer
+	n, err := x.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+
+	read, err := ReadIndex(&buf)
+	require.NoError(t, err)
+	require.Equal(t, x.LabelNames(), read.LabelNames())
+	require.Equal(t, x.LabelValues("id"), read.LabelValues("id"))
+	require.True(t, read.Bucketed("id"))
+	_, values, _ := x.Size()
+	_, readValues, _ := read.Size()
+	require.Equal(t, values, readValues)
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "id", "id-1.*"), labels.MustNewMatcher(labels.MatchEqual, "job", "job-1")},
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "")},
+	} {
+		require.Equal(t, x.Cardinality(matchers...), read.Cardinality(matchers...), "%v", matchers)
+	}
+
+	// Labels bucketed when the index was written stay bucketed on reading.
+	hash := labels.FromStrings("id", "new").Hash()
+	require.True(t, read.AddLabel(hash, "id", "new"))
+
+	_, err = ReadIndex(bytes.NewReader([]byte("not an index")))
+	require.ErrorIs(t, err, ErrInvalidIndex)
+}
+
+func TestAppendSketch(t *testing.T) {
+	sk := hyperminhash.New()
+	for i := 0; i < 1000; i++ {
+		sk.Add(HashBytes(uint64(i)))
+	}
+
+	b := AppendSketch(nil, sk)
+	require.Len(t, b, SketchSize)
+	for i, r := range registers(sk) {
+		require.Equal(t, r, binary.LittleEndian.Uint16(b[2*i:]))
+	}
+
+	read, err := ReadSketch(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, sk.Cardinality(), read.Cardinality())
+	require.Equal(t, registers(sk), registers(read))
+}
+
+func TestReadIndexCorruptedLengths(t *testing.T) {
+	// header returns the start of an index with the given number of
+	// buckets and labels.
+	header := func(buckets, names uint64) []byte {
+		b := binary.BigEndian.AppendUint32(nil, indexMagic)
+		b = append(b, indexVersion, 0)
+		b = binary.AppendUvarint(b, buckets)
+		b = append(b, 1)
+		b = append(b, make([]byte, SketchSize)...)
+		return binary.AppendUvarint(b, names)
+	}
+	label := func(b []byte, kind byte) []byte {
+		b = append(b, 1, 'a')
+		b = append(b, make([]byte, SketchSize)...)
+		return append(b, kind)
+	}
+	for name, b := range map[string][]byte{
+		"buckets":       header(1<<40, 0),
+		"negative":      header(math.MaxUint64, 0),
+		"name":          binary.AppendUvarint(header(1, 1), 1<<62),
+		"values":        binary.AppendUvarint(label(header(1, 1), labelValues), 1<<40),
+		"exact values":  binary.AppendUvarint(binary.AppendUvarint(label(header(1, 1), labelValues), 0), 1<<40),
+		"exact hashes":  binary.AppendUvarint(append(binary.AppendUvarint(label(header(1, 1), labelValues), 0), 1, 1, 'v'), 1<<40),
+		"value buckets": append(label(header(1, 1), labelBucketed), append(make([]byte, SketchSize), 0xff, 0xff, 0xff, 0xff, 0x0f)...),
+	} {
+		_, err := ReadIndex(bytes.NewReader(b))
+		require.ErrorIs(t, err, ErrInvalidIndex, name)
+	}
+}
+
+func FuzzReadIndex(f *testing.F) {
+	var buf bytes.Buffer
+	_, err := newTestIndex().WriteTo(&buf)
+	require.NoError(f, err)
+	f.Add(buf.Bytes())
+	f.Add(buf.Bytes()[:100])
+	f.Add([]byte("not an index"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Corrupted indexes return errors instead of panicking.
+		x, err := ReadIndex(bytes.NewReader(data))
+		if err == nil {
+			x.LabelNames()
+		}
+	})
+}
+
+func TestPlan(t *testing.T) {
+	x := NewIndex(0, 0)
+	for i := 0; i < 20000; i++ {
+		name := "big"
+		if i%2000 == 0 {
+			name = "small"
+		}
+		lbls := labels.FromStrings("__name__", name, "job", fmt.Sprintf("job-%d", i%2), "id", fmt.Sprint(i))
+		hash := lbls.Hash()
+		x.AddSeries(hash)
+		for _, l := range lbls {
+			x.AddLabel(hash, l.Name, l.Value)
+		}
+	}
+	small := labels.MustNewMatcher(labels.MatchEqual, "__name__", "small")
+
+	for _, tc := range []struct {
+		matchers []*labels.Matcher
+		strategy Strategy
+	}{
+		{[]*labels.Matcher{small}, Jaccard},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "job-0"), labels.MustNewMatcher(labels.MatchEqual, "__name__", "big")}, Jaccard},
+		// A matcher selecting every series barely restricts a selective one.
+		{[]*labels.Matcher{small, labels.MustNewMatcher(labels.MatchRegexp, "id", ".+")}, MinCardinality},
+		{[]*labels.Matcher{small, labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-1")}, InclusionExclusion},
+		{[]*labels.Matcher{
+			small,
+			labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-2"),
+			labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-3"),
+			labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-4"),
+			labels.MustNewMatcher(labels.MatchNotEqual, "job", "job-5"),
+		}, MinCardinality},
+	} {
+		card, plan := x.PlanWith(nil, nil, tc.matchers...)
+		require.Equal(t, tc.strategy, plan.Strategy, "%v", tc.matchers)
+		require.Equal(t, x.Cardinality(tc.matchers...), card)
+		require.NotEmpty(t, plan.Reason)
+	}
+
+	card, plan := x.PlanWith(nil, nil, small, labels.MustNewMatcher(labels.MatchRegexp, "id", ".+"))
+	require.InDelta(t, 10, card, 1)
+	require.Equal(t, card, plan.Sketches[0])
+}
+
+func TestAccuracyTarget(t *testing.T) {
+	sketched, exact := NewIndex(0, 0), NewIndex(0, 0)
+	exact.SetAccuracyTarget(0.02)
+	for _, x := range []*Index{sketched, exact} {
+		for i := 0; i < 10000; i++ {
+			// One large job and many small ones.
+			job := "large"
+			if i%2 == 0 {
+				job = fmt.Sprintf("job-%d", i%200)
+			}
+			lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "job", job)
+			hash := lbls.Hash() + uint64(i)
+			x.AddSeries(hash)
+			for _, l := range lbls {
+				x.AddLabel(hash, l.Name, l.Value)
+			}
+		}
+	}
+
+	// Values are promoted once a sketch is smaller.
+	_, values, sketches := exact.Size()
+	require.Equal(t, 105, values)
+	require.Equal(t, 1+2+1, sketches)
+	require.Equal(t, 4*2500+100*50, exact.ExactHashes())
+
+	// The sketches built from the exact values are the same, and so are the
+	// estimates.
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "job", "job-2")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "job", "job-1.*"), labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_2")},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "job", "large")},
+	} {
+		require.Equal(t, sketched.Cardinality(matchers...), exact.Cardinality(matchers...), "%v", matchers)
+	}
+	require.Equal(t, sketched.LabelNames(), exact.LabelNames())
+	require.Equal(t, sketched.LabelValues("job", labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")), exact.LabelValues("job", labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_0")))
+
+	var buf bytes.Buffer
+	_, err := exact.WriteTo(&buf)
+	require.NoError(t, err)
+	read, err := ReadIndex(&buf)
+	require.NoError(t, err)
+	require.Equal(t, exact.ExactHashes(), read.ExactHashes())
+	require.Equal(t, exact.LabelValues("job"), read.LabelValues("job"))
+
+	// Below the error of sketches values are sketched only once they reach
+	// the bound of exact sets.
+	exact.SetAccuracyTarget(SketchError / 2)
+	hash := labels.FromStrings("job", "new").Hash()
+	for i := 0; i < 5000; i++ {
+		exact.AddLabel(hash+uint64(i), "job", "new")
+	}
+	require.Equal(t, 4*2500+100*50+5000, exact.ExactHashes())
+	for i := 5000; i <= maxExactHashes; i++ {
+		exact.AddLabel(hash+uint64(i), "job", "new")
+	}
+	require.Equal(t, 4*2500+100*50, exact.ExactHashes())
+	require.InEpsilon(t, maxExactHashes+1, exact.Cardinality(labels.MustNewMatcher(labels.MatchEqual, "job", "new")), 3*SketchError)
+}
+
+func TestScratchPool(t *testing.T) {
+	x := newTestIndex()
+	m := labels.MustNewMatcher(labels.MatchRegexp, "job", "job-[1-3]")
+
+	scratch := AcquireScratch()
+	scratch.SetLimits(1, 0, time.Time{})
+	for i := 0; i < 2*maxPooledSketches; i++ {
+		x.SketchScratch(scratch, m)
+	}
+	require.True(t, scratch.Truncated())
+	ReleaseScratch(scratch)
+	require.Zero(t, scratch.InUse())
+	require.False(t, scratch.Truncated())
+	require.Len(t, scratch.sketches, maxPooledSketches)
+
+	// Pooled scratches are reset, so estimates with and without one agree,
+	// and merges into sketches of the index don't change the sketches
+	// merged.
+	require.Equal(t, x.Cardinality(m), x.CardinalityScratch(&Scratch{}, m))
+	require.InEpsilon(t, 300, x.Cardinality(m), 0.1)
+	job9 := labels.MustNewMatcher(labels.MatchEqual, "job", "job-9")
+	before := x.Cardinality(job9)
+	x.MergeValue("job", "job-1", x.Sketch(job9))
+	require.Equal(t, before, x.Cardinality(job9))
+	require.InEpsilon(t, 400, x.Cardinality(m), 0.1)
+}
+
+func TestMatcherHook(t *testing.T) {
+	x := newTestIndex()
+	job := labels.MustNewMatcher(labels.MatchRegexp, "job", "job-[1-3]")
+	metric := labels.MustNewMatcher(labels.MatchEqual, "__name__", "metric_1")
+
+	var hooked []string
+	var series []uint64
+	scratch := AcquireScratch()
+	scratch.SetMatcherHook(func(m *labels.Matcher) func(*hyperminhash.Sketch) {
+		hooked = append(hooked, m.String())
+		return func(sk *hyperminhash.Sketch) { series = append(series, sk.Cardinality()) }
+	})
+	x.CardinalityScratch(scratch, job, metric)
+	require.Equal(t, []string{job.String(), metric.String()}, hooked)
+	require.Len(t, series, 2)
+	require.InEpsilon(t, 300, series[0], 0.1)
+	require.InEpsilon(t, 250, series[1], 0.1)
+
+	// Released scratches drop the hook.
+	ReleaseScratch(scratch)
+	require.Nil(t, scratch.hook)
+}
+
+func BenchmarkBroadRegex(b *testing.B) {
+	x := NewIndex(0, 0)
+	for i := 0; i < 10000; i++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i%4), "id", fmt.Sprintf("id-%d", i), "job", fmt.Sprintf("job-%d", i%10))
+		hash := lbls.Hash()
+		x.AddSeries(hash)
+		for _, l := range lbls {
+			x.AddLabel(hash, l.Name, l.Value)
+		}
+	}
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "id", "id-1.*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "job", "job-.*"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "__name__", "metric_1"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Cardinality(matchers...)
+	}
+}
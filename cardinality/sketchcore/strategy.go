@@ -0,0 +1,105 @@
+package sketchcore
+
+import (
+	"fmt"
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+	"slices"
+)
+
+// Strategy is how an Index estimates the series matching several matchers
+// from their sketches.
+type Strategy string
+
+const (
+	// Jaccard estimates the intersection of the sketches from their
+	// pairwise Jaccard similarity, see Intersection.
+	Jaccard Strategy = "jaccard"
+	// InclusionExclusion expands the matchers that match "", whose series
+	// without the label can't be read from sketches, into unions and
+	// intersections of sketches, see cardinalityWithMissing.
+	InclusionExclusion Strategy = "inclusion_exclusion"
+	// MinCardinality bounds the intersection by the smallest sketch, which
+	// overestimates the series that aren't in the other sketches.
+	MinCardinality Strategy = "min_cardinality"
+)
+
+const (
+	// maxInclusionExclusion is the number of matchers matching "" above
+	// which they are ignored instead of expanded. Every matcher triples the
+	// estimates to combine, and their errors add up, so the expansion of
+	// many broad matchers ends up less accurate than the upper bound.
+	maxInclusionExclusion = 3
+	// minCardinalityRatio is the ratio of the other sketches to the
+	// smallest above which the intersection is bounded by the smallest
+	// sketch, as long as the others hold at least minCardinalityCoverage of
+	// all series. The error of a Jaccard intersection is relative to the
+	// union of the sketches, so it drowns selective matchers combined with
+	// matchers selecting nearly everything, like label=~".+", which barely
+	// restrict them.
+	minCardinalityRatio    = 1000
+	minCardinalityCoverage = 0.9
+)
+
+// Plan is the strategy an Index chose to estimate matchers, and why.
+type Plan struct {
+	Strategy Strategy `json:"strategy"`
+	Reason   string   `json:"reason"`
+	// Sketches holds the estimated series of the sketch of every matcher
+	// not matching "", followed by the sketches passed by the caller.
+	Sketches []int64 `json:"sketches,omitempty"`
+	// MatchingEmpty is the number of matchers matching "".
+	MatchingEmpty int `json:"matching_empty,omitempty"`
+}
+
+// PlanWith is like CardinalityWith, also returning the plan of the
+// estimate. Without a Scratch, the sketches are taken from a pooled one.
+func (x *Index) PlanWith(scratch *Scratch, sketches []*hyperminhash.Sketch, matchers ...*labels.Matcher) (int64, Plan) {
+	if scratch == nil {
+		scratch = AcquireScratch()
+		defer ReleaseScratch(scratch)
+	}
+	own, matchingEmpty := x.sketches(scratch, matchers)
+	sketches = append(own, sketches...)
+	plan := choosePlan(sketches, len(matchingEmpty), x.Series())
+
+	switch plan.Strategy {
+	case MinCardinality:
+		if len(sketches) == 0 {
+			return x.Series(), plan
+		}
+		return slices.Min(plan.Sketches), plan
+	default:
+		return x.cardinalityWithMissing(scratch, sketches, matchingEmpty), plan
+	}
+}
+
+func choosePlan(sketches []*hyperminhash.Sketch, matchingEmpty int, series int64) Plan {
+	plan := Plan{Sketches: make([]int64, len(sketches)), MatchingEmpty: matchingEmpty}
+	for i, sk := range sketches {
+		plan.Sketches[i] = int64(sk.Cardinality())
+	}
+
+	switch {
+	case matchingEmpty > maxInclusionExclusion:
+		plan.Strategy = MinCardinality
+		plan.Reason = fmt.Sprintf("%d matchers match the empty string, more than the %d expanded by inclusion-exclusion", matchingEmpty, maxInclusionExclusion)
+	case matchingEmpty > 0:
+		plan.Strategy = InclusionExclusion
+		plan.Reason = fmt.Sprintf("%d matchers match the empty string", matchingEmpty)
+	case len(sketches) < 2:
+		plan.Strategy = Jaccard
+		plan.Reason = "single matcher"
+	default:
+		sorted := slices.Sorted(slices.Values(plan.Sketches))
+		smallest, others := sorted[0], sorted[1]
+		if others > minCardinalityRatio*max(smallest, 1) && float64(others) >= minCardinalityCoverage*float64(series) {
+			plan.Strategy = MinCardinality
+			plan.Reason = fmt.Sprintf("sketch of %d series intersected with sketches of at least %d of the %d series", smallest, others, series)
+		} else {
+			plan.Strategy = Jaccard
+			plan.Reason = fmt.Sprintf("intersection of %d sketches", len(sketches))
+		}
+	}
+	return plan
+}
@@ -0,0 +1,99 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"slices"
+)
+
+type smallSeries struct {
+	lbls labels.Labels
+	ref  storage.SeriesRef
+}
+
+// smallIndex keeps the labels of its series in a map and answers queries by
+// matching every series, which is exact and takes less memory than the
+// structures of other indexes for the few hundred series of the long tail
+// of tenants, see TenantIndexManager.SetSmallTenantThreshold. It is not
+// safe for concurrent use.
+type smallIndex struct {
+	series map[uint64]smallSeries
+}
+
+func newSmallIndex() *smallIndex {
+	return &smallIndex{series: make(map[uint64]smallSeries)}
+}
+
+func (s *smallIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	hash := lbls.Hash()
+	if _, ok := s.series[hash]; !ok {
+		s.series[hash] = smallSeries{lbls: lbls.Copy(), ref: ref}
+	}
+}
+
+func (s *smallIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	if len(matchers) == 0 {
+		return 0
+	}
+	var card int64
+	for _, series := range s.series {
+		if matchSeries(series.lbls, matchers) {
+			card++
+		}
+	}
+	return card
+}
+
+func (s *smallIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return getCardinalityChecked(ctx, s, nil, matchers)
+}
+
+// matchSeries reports whether the labels match all matchers, a missing
+// label matching like the empty value.
+func matchSeries(lbls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *smallIndex) LabelNames(matchers ...*labels.Matcher) []string {
+	names := map[string]struct{}{}
+	for _, series := range s.series {
+		if len(matchers) == 0 || matchSeries(series.lbls, matchers) {
+			series.lbls.Range(func(l labels.Label) { names[l.Name] = struct{}{} })
+		}
+	}
+	return sortedKeys(names)
+}
+
+func (s *smallIndex) LabelValues(name string, matchers ...*labels.Matcher) []string {
+	values := map[string]struct{}{}
+	for _, series := range s.series {
+		if value := series.lbls.Get(name); value != "" && (len(matchers) == 0 || matchSeries(series.lbls, matchers)) {
+			values[value] = struct{}{}
+		}
+	}
+	return sortedKeys(values)
+}
+
+// promote adds the series to index, which replaces the small index once it
+// outgrew it.
+func (s *smallIndex) promote(index CardinalityIndex) CardinalityIndex {
+	for _, series := range s.series {
+		index.AddSeries(series.lbls, series.ref)
+	}
+	return index
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
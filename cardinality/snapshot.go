@@ -0,0 +1,155 @@
+package cardinality
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"io"
+	"sort"
+	"time"
+)
+
+// Snapshot is a point-in-time copy of the number of series per label value
+// of an index. It is much smaller than the index itself and can be persisted
+// to compare cardinality over time.
+type Snapshot struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Values maps label names to label values to their number of series.
+	Values map[string]map[string]int64 `json:"values"`
+}
+
+// TakeSnapshot records the number of series of every label value in index.
+func TakeSnapshot(index CardinalityIndex, ts time.Time) (*Snapshot, error) {
+	lvi, ok := index.(LabelValuesIndex)
+	if !ok {
+		return nil, errors.New("index does not support label enumeration")
+	}
+
+	s := &Snapshot{
+		Timestamp: ts,
+		Values:    make(map[string]map[string]int64),
+	}
+	for _, name := range lvi.LabelNames() {
+		values := make(map[string]int64)
+		for _, value := range lvi.LabelValues(name) {
+			values[value] = index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, name, value))
+		}
+		s.Values[name] = values
+	}
+	return s, nil
+}
+
+// WriteTo writes the snapshot as JSON.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadSnapshot reads a snapshot written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ValueChange is the change in series of a label value between two snapshots.
+type ValueChange struct {
+	Name  string
+	Value string
+	Old   int64
+	New   int64
+}
+
+// Delta returns the change in series, negative if the value lost series.
+func (c ValueChange) Delta() int64 {
+	return c.New - c.Old
+}
+
+// Diff returns the label values whose number of series changed by more than
+// minChange between the two snapshots, including values that appeared or
+// disappeared, ordered by the absolute change, largest first.
+func Diff(old, new *Snapshot, minChange int64) []ValueChange {
+	var changes []ValueChange
+	add := func(name, value string, o, n int64) {
+		if abs(n-o) > minChange {
+			changes = append(changes, ValueChange{Name: name, Value: value, Old: o, New: n})
+		}
+	}
+
+	for name, newValues := range new.Values {
+		oldValues := old.Values[name]
+		for value, n := range newValues {
+			add(name, value, oldValues[value], n)
+		}
+	}
+	for name, oldValues := range old.Values {
+		newValues := new.Values[name]
+		for value, o := range oldValues {
+			if _, ok := newValues[value]; !ok {
+				add(name, value, o, 0)
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if di, dj := abs(changes[i].Delta()), abs(changes[j].Delta()); di != dj {
+			return di > dj
+		}
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Value < changes[j].Value
+	})
+	return changes
+}
+
+// LabelChange is the change in the number of values of a label between two
+// snapshots.
+type LabelChange struct {
+	Name      string
+	OldValues int64
+	NewValues int64
+}
+
+// Delta returns the change in values, negative if the label lost values.
+func (c LabelChange) Delta() int64 {
+	return c.NewValues - c.OldValues
+}
+
+// DiffLabels returns the labels whose number of values changed by more than
+// minChange between the two snapshots, ordered like Diff.
+func DiffLabels(old, new *Snapshot, minChange int64) []LabelChange {
+	var changes []LabelChange
+	for name, newValues := range new.Values {
+		o, n := int64(len(old.Values[name])), int64(len(newValues))
+		if abs(n-o) > minChange {
+			changes = append(changes, LabelChange{Name: name, OldValues: o, NewValues: n})
+		}
+	}
+	for name, oldValues := range old.Values {
+		if _, ok := new.Values[name]; !ok && int64(len(oldValues)) > minChange {
+			changes = append(changes, LabelChange{Name: name, OldValues: int64(len(oldValues))})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if di, dj := abs(changes[i].Delta()), abs(changes[j].Delta()); di != dj {
+			return di > dj
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
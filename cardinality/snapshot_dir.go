@@ -0,0 +1,51 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/tsdb"
+	"path/filepath"
+)
+
+// SnapshotBlock is the index of a block of a TSDB snapshot.
+type SnapshotBlock struct {
+	Meta  tsdb.BlockMeta
+	Index CardinalityIndex
+}
+
+// LoadSnapshotDir builds an index of every block of a TSDB snapshot, the
+// directory created in the snapshots directory of the data directory by the
+// /api/v1/admin/tsdb/snapshot endpoint of Prometheus. Snapshots hard-link
+// the blocks, so they can be analyzed without reading the live data
+// directory, which the TSDB may compact or delete blocks from meanwhile.
+// newIndex creates the index of a block. Blocks are returned in time order.
+//
+// To build a single index of the snapshot, counting series present in
+// several blocks once, use a Reindexer on the snapshot directory instead.
+func LoadSnapshotDir(ctx context.Context, dir string, newIndex func(meta tsdb.BlockMeta) CardinalityIndex, opts ...BuildOption) ([]SnapshotBlock, error) {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no blocks in snapshot %s", dir)
+	}
+
+	o := applyBuildOptions(opts)
+	blocks := make([]SnapshotBlock, 0, len(dirs))
+	for _, name := range dirs {
+		block, err := tsdb.OpenBlock(o.logger, filepath.Join(dir, name), nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open block %s: %w", name, err)
+		}
+		meta := block.Meta()
+		idx := newIndex(meta)
+		err = buildFromBlock(ctx, block, idx.AddSeries, o)
+		block.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to index block %s: %w", name, err)
+		}
+		blocks = append(blocks, SnapshotBlock{Meta: meta, Index: idx})
+	}
+	return blocks, nil
+}
@@ -0,0 +1,223 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshotPrefix is the directory of the bucket holding the snapshots of
+	// a SnapshotStore, named after their time in Unix milliseconds.
+	snapshotPrefix = "snapshots"
+	snapshotExt    = ".index"
+)
+
+// ErrNoSnapshot is returned by SnapshotStore.At for times before the oldest
+// snapshot.
+var ErrNoSnapshot = errors.New("no snapshot")
+
+// SnapshotBucket is the object storage a SnapshotStore keeps index snapshots
+// in. DirBucket implements it for a local directory; buckets of objstore
+// need a small adapter, as their methods take extra options.
+type SnapshotBucket interface {
+	Bucket
+	Upload(ctx context.Context, name string, r io.Reader) error
+	Delete(ctx context.Context, name string) error
+	Iter(ctx context.Context, dir string, f func(name string) error) error
+}
+
+// SnapshotStore keeps index files of a BitmapIndex taken periodically in a
+// bucket for the retention, so that the cardinality of any selector can be
+// answered as of a past time with At, e.g. in the retrospective of an
+// incident. Snapshots are downloaded to the cache directory to be
+// memory-mapped, except from a DirBucket, whose files are mapped in place.
+// It is safe for concurrent use.
+type SnapshotStore struct {
+	bkt       SnapshotBucket
+	cacheDir  string
+	retention time.Duration
+}
+
+// NewSnapshotStore returns a store of the snapshots in bkt, deleting them
+// once older than retention, or never if it is zero.
+func NewSnapshotStore(bkt SnapshotBucket, cacheDir string, retention time.Duration) (*SnapshotStore, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &SnapshotStore{bkt: bkt, cacheDir: cacheDir, retention: retention}, nil
+}
+
+// Save uploads a snapshot of the index taken at ts, and deletes the
+// snapshots past the retention. Nothing is left in the cache directory.
+// The index may be written to meanwhile, see WriteIndexFile.
+func (s *SnapshotStore) Save(ctx context.Context, b *BitmapIndex, ts time.Time) error {
+	name := snapshotName(ts)
+	local := s.cachePath(name)
+	if err := WriteIndexFile(local, b); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	// Snapshots are only read back by At, which maps those of a DirBucket in
+	// place and downloads the others on demand, so the copy is not kept.
+	defer os.Remove(local)
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.bkt.Upload(ctx, name, f); err != nil {
+		return fmt.Errorf("upload snapshot: %w", err)
+	}
+	if _, err := s.Prune(ctx, ts); err != nil {
+		return fmt.Errorf("prune snapshots: %w", err)
+	}
+	return nil
+}
+
+// Snapshots returns the times of the snapshots, oldest first.
+func (s *SnapshotStore) Snapshots(ctx context.Context) ([]time.Time, error) {
+	var times []time.Time
+	err := s.bkt.Iter(ctx, snapshotPrefix, func(name string) error {
+		if ts, ok := parseSnapshotName(name); ok {
+			times = append(times, ts)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(times, time.Time.Compare)
+	return times, nil
+}
+
+// At opens the latest snapshot taken at or before ts, and returns it with
+// the time it was taken at. It returns ErrNoSnapshot if there is none. The
+// caller must close the snapshot.
+func (s *SnapshotStore) At(ctx context.Context, ts time.Time) (*IndexFile, time.Time, error) {
+	times, err := s.Snapshots(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	i, found := slices.BinarySearchFunc(times, ts, time.Time.Compare)
+	if !found {
+		i--
+	}
+	if i < 0 {
+		return nil, time.Time{}, fmt.Errorf("%w at or before %s", ErrNoSnapshot, ts.UTC().Format(time.RFC3339))
+	}
+	taken := times[i]
+	local, err := s.fetch(ctx, snapshotName(taken))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	idx, err := OpenIndexFile(local)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return idx, taken, nil
+}
+
+// fetch returns the local path of a snapshot, downloading it to the cache
+// directory if it isn't there yet.
+func (s *SnapshotStore) fetch(ctx context.Context, name string) (string, error) {
+	if d, ok := s.bkt.(DirBucket); ok {
+		return d.path(name), nil
+	}
+	local := s.cachePath(name)
+	if _, err := os.Stat(local); err == nil {
+		return local, nil
+	}
+	r, err := s.bkt.Get(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("download snapshot: %w", err)
+	}
+	defer r.Close()
+	// Concurrent downloads of a snapshot write their own temporary file.
+	f, err := os.CreateTemp(s.cacheDir, filepath.Base(local)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return "", fmt.Errorf("download snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return local, os.Rename(f.Name(), local)
+}
+
+// Prune deletes the snapshots older than the retention at now, and their
+// downloaded copies, and returns how many it deleted. Snapshots opened by
+// At stay readable until closed.
+func (s *SnapshotStore) Prune(ctx context.Context, now time.Time) (int, error) {
+	if s.retention == 0 {
+		return 0, nil
+	}
+	times, err := s.Snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, ts := range times {
+		if !ts.Before(now.Add(-s.retention)) {
+			break
+		}
+		name := snapshotName(ts)
+		if err := s.bkt.Delete(ctx, name); err != nil {
+			return deleted, err
+		}
+		if err := os.Remove(s.cachePath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Run saves a snapshot of the index every interval until ctx is done.
+// Failed snapshots are logged and retried at the next interval.
+func (s *SnapshotStore) Run(ctx context.Context, b *BitmapIndex, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.Save(ctx, b, now); err != nil {
+				b.logger.Error("Failed to save index snapshot", "err", err)
+			}
+		}
+	}
+}
+
+func (s *SnapshotStore) cachePath(name string) string {
+	return filepath.Join(s.cacheDir, path.Base(name))
+}
+
+func snapshotName(ts time.Time) string {
+	return path.Join(snapshotPrefix, strconv.FormatInt(ts.UnixMilli(), 10)+snapshotExt)
+}
+
+func parseSnapshotName(name string) (time.Time, bool) {
+	ms, ok := strings.CutSuffix(path.Base(name), snapshotExt)
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(n), true
+}
@@ -0,0 +1,550 @@
+// Package soak runs an index for hours under continuous ingestion with
+// churn while issuing randomized queries, and checks every answer against
+// the series the index should hold and the memory of the process against
+// ceilings, to qualify an index configuration before production.
+//
+// Series belong to pods, the unit of churn like in a cluster rolling out
+// deployments. Every interval, a fraction of the pods is replaced by new
+// ones, all live pods are scraped, re-adding their series, and the index
+// evicts the label values not added for longer than its TTL, which removes
+// the series of the replaced pods. The series of a pod are
+//
+//	soak_metric_<j%10>{idx="<j>", job="job-<pod%jobs>", pod="pod-<pod>"}
+//
+// for j up to the series per pod. Queries run concurrently with ingestion,
+// so an answer is checked against the series that were surely in the index
+// during the whole query and the series that possibly were.
+package soak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"harry671003/hello/cardinality"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soakMetrics is the number of metric names of the series of a pod.
+const soakMetrics = 10
+
+// Index is an index removing the series of stale label values, like a
+// BitmapIndex created WithValueTTL.
+type Index interface {
+	cardinality.CardinalityIndex
+	EvictStale() int
+}
+
+// Config describes a soak run.
+type Config struct {
+	// Duration is the length of the run, zero running until the context
+	// is canceled.
+	Duration time.Duration
+	// Interval is the time between scrapes of the pods. TTL is the value
+	// TTL of the index, at least twice the interval so that live pods
+	// aren't evicted between scrapes.
+	Interval time.Duration
+	TTL      time.Duration
+	// Pods is the number of live pods, with SeriesPerPod series each,
+	// spread over Jobs jobs.
+	Pods         int
+	SeriesPerPod int
+	Jobs         int
+	// Churn is the fraction of the pods replaced every interval.
+	Churn float64
+	// Workers is the number of goroutines issuing queries.
+	Workers int
+	// Tolerance is the relative error allowed beyond the bounds of an
+	// answer, zero for exact indexes.
+	Tolerance float64
+	// MaxHeapBytes bounds the live heap of the process, which includes
+	// the model of the series the run keeps, and MaxIndexBytes the memory
+	// reported by the index if it is a StatsIndex. Zero is unbounded.
+	MaxHeapBytes  int64
+	MaxIndexBytes int64
+	// Seed makes the churn and the queries reproducible, not their timing.
+	Seed uint64
+	// ProgressInterval is the time between progress logs.
+	ProgressInterval time.Duration
+	Logger           *slog.Logger
+}
+
+// DefaultConfig is a run of an hour of 10000 series replacing 2% of them
+// every second.
+var DefaultConfig = Config{
+	Duration:         time.Hour,
+	Interval:         time.Second,
+	TTL:              5 * time.Second,
+	Pods:             500,
+	SeriesPerPod:     20,
+	Jobs:             20,
+	Churn:            0.02,
+	Workers:          4,
+	Seed:             1,
+	ProgressInterval: time.Minute,
+}
+
+// Validate checks the config.
+func (c *Config) Validate() error {
+	switch {
+	case c.Duration < 0:
+		return errors.New("negative duration")
+	case c.Interval <= 0:
+		return errors.New("interval must be positive")
+	case c.TTL < 2*c.Interval:
+		return fmt.Errorf("ttl %s must be at least twice the interval %s", c.TTL, c.Interval)
+	case c.Pods <= 0 || c.SeriesPerPod <= 0 || c.Jobs <= 0:
+		return errors.New("pods, series per pod and jobs must be positive")
+	case c.Churn < 0 || c.Churn > 1:
+		return fmt.Errorf("churn %g must be between 0 and 1", c.Churn)
+	case c.Workers <= 0:
+		return errors.New("workers must be positive")
+	case c.Tolerance < 0:
+		return errors.New("negative tolerance")
+	}
+	return nil
+}
+
+// Report describes a soak run.
+type Report struct {
+	Elapsed     time.Duration `json:"elapsed"`
+	Intervals   int64         `json:"intervals"`
+	PodsAdded   int64         `json:"pods_added"`
+	PodsRemoved int64         `json:"pods_removed"`
+	// PodsEvicted counts the removed pods whose series were evicted by
+	// the index.
+	PodsEvicted int64 `json:"pods_evicted"`
+	Queries     int64 `json:"queries"`
+	// MaxError is the largest relative error of an answer out of its
+	// bounds, zero if all answers were within them.
+	MaxError       float64 `json:"max_error"`
+	PeakHeapBytes  int64   `json:"peak_heap_bytes"`
+	PeakIndexBytes int64   `json:"peak_index_bytes,omitempty"`
+}
+
+// Violation is an answer out of its bounds.
+type Violation struct {
+	Matchers string
+	Estimate int64
+	// Min is the number of matching series surely in the index during the
+	// query, and Max the number possibly in it.
+	Min, Max int64
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("estimate %d of %s out of bounds [%d, %d]", v.Estimate, v.Matchers, v.Min, v.Max)
+}
+
+// pod is the state of a pod in the model of the series of the index.
+type pod struct {
+	id int
+	// scrapeStart and scrapeEnd are when the last scrape of the pod began
+	// and ended, and scraped when the last completed one began. They are
+	// zero before the first scrape.
+	scrapeStart, scrapeEnd, scraped time.Time
+	removed                         bool
+	evicted                         bool
+}
+
+// present reports whether series of the pod may be in the index.
+func (p *pod) present() bool {
+	return !p.scrapeStart.IsZero() && !p.evicted
+}
+
+type harness struct {
+	index Index
+	cfg   Config
+	r     *rand.Rand
+
+	// Label values of the series, by series and job.
+	metrics []string
+	idx     []string
+	jobs    []string
+
+	// mtx guards the model: the pods that weren't evicted, ordered by id,
+	// and the ids of the live ones.
+	mtx    sync.RWMutex
+	pods   []*pod
+	live   []int
+	nextID int
+	debt   float64
+
+	statsMtx sync.Mutex
+	report   Report
+	err      error
+	stop     context.CancelCauseFunc
+}
+
+// Run soaks the index, which must evict label values after cfg.TTL, until
+// cfg.Duration elapsed or the context is canceled. It stops at the first
+// answer out of bounds, returning a *Violation, or the first memory
+// ceiling exceeded. The report describes the run so far in all cases.
+func Run(ctx context.Context, index Index, cfg Config) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = promslog.NewNopLogger()
+	}
+	h := &harness{
+		index: index,
+		cfg:   cfg,
+		r:     rand.New(rand.NewPCG(cfg.Seed, 0)),
+		jobs:  make([]string, cfg.Jobs),
+		idx:   make([]string, cfg.SeriesPerPod),
+	}
+	for i := range soakMetrics {
+		h.metrics = append(h.metrics, "soak_metric_"+strconv.Itoa(i))
+	}
+	for i := range h.jobs {
+		h.jobs[i] = "job-" + strconv.Itoa(i)
+	}
+	for j := range h.idx {
+		h.idx[j] = strconv.Itoa(j)
+	}
+
+	ctx, h.stop = context.WithCancelCause(ctx)
+	defer h.stop(nil)
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := range cfg.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.query(ctx, rand.New(rand.NewPCG(cfg.Seed, uint64(w)+1)))
+		}()
+	}
+	h.ingest(ctx)
+	h.stop(nil)
+	wg.Wait()
+
+	h.statsMtx.Lock()
+	defer h.statsMtx.Unlock()
+	report := h.report
+	report.Elapsed = time.Since(start)
+	return &report, h.err
+}
+
+// fail stops the run with the error, keeping the first one.
+func (h *harness) fail(err error) {
+	h.statsMtx.Lock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.statsMtx.Unlock()
+	h.stop(err)
+}
+
+func (h *harness) ingest(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	lastProgress := time.Now()
+	for {
+		h.churn()
+		h.scrape(ctx)
+		h.evict()
+		if err := h.checkMemory(); err != nil {
+			h.fail(err)
+			return
+		}
+
+		h.statsMtx.Lock()
+		h.report.Intervals++
+		report := h.report
+		h.statsMtx.Unlock()
+		if h.cfg.ProgressInterval > 0 && time.Since(lastProgress) >= h.cfg.ProgressInterval {
+			lastProgress = time.Now()
+			h.cfg.Logger.Info("Soak progress", "intervals", report.Intervals, "pods_added", report.PodsAdded, "pods_evicted", report.PodsEvicted,
+				"queries", report.Queries, "max_error", report.MaxError, "peak_heap_bytes", report.PeakHeapBytes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// churn replaces the fraction of the live pods of the interval with new
+// ones, and adds pods until there are enough. Fractions of a pod are
+// carried over to the next interval.
+func (h *harness) churn() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	replaced := 0
+	if len(h.live) == h.cfg.Pods {
+		h.debt += h.cfg.Churn * float64(h.cfg.Pods)
+		replaced = int(h.debt)
+		h.debt -= float64(replaced)
+	}
+	for range replaced {
+		i := h.r.IntN(len(h.live))
+		id := h.live[i]
+		h.live[i] = h.live[len(h.live)-1]
+		h.live = h.live[:len(h.live)-1]
+		h.pods[h.find(id)].removed = true
+	}
+	added := h.cfg.Pods - len(h.live)
+	for range added {
+		h.pods = append(h.pods, &pod{id: h.nextID})
+		h.live = append(h.live, h.nextID)
+		h.nextID++
+	}
+
+	h.statsMtx.Lock()
+	h.report.PodsAdded += int64(added)
+	h.report.PodsRemoved += int64(replaced)
+	h.statsMtx.Unlock()
+}
+
+// find returns the position of the pod with the id in h.pods.
+func (h *harness) find(id int) int {
+	i, _ := slices.BinarySearchFunc(h.pods, id, func(p *pod, id int) int { return p.id - id })
+	return i
+}
+
+// scrape adds the series of all live pods.
+func (h *harness) scrape(ctx context.Context) {
+	h.mtx.RLock()
+	live := slices.Clone(h.live)
+	h.mtx.RUnlock()
+	for _, id := range live {
+		if ctx.Err() != nil {
+			return
+		}
+		h.mtx.Lock()
+		p := h.pods[h.find(id)]
+		start := time.Now()
+		p.scrapeStart = start
+		h.mtx.Unlock()
+
+		name, job := podName(id), h.jobs[id%h.cfg.Jobs]
+		for j := range h.cfg.SeriesPerPod {
+			lbls := labels.FromStrings(labels.MetricName, h.metrics[j%soakMetrics], "idx", h.idx[j], "job", job, "pod", name)
+			h.index.AddSeries(lbls, storage.SeriesRef(id*h.cfg.SeriesPerPod+j+1))
+		}
+
+		h.mtx.Lock()
+		p.scrapeEnd = time.Now()
+		p.scraped = start
+		h.mtx.Unlock()
+	}
+}
+
+// evict evicts the stale values of the index, and drops the removed pods
+// whose values were stale from the model.
+func (h *harness) evict() {
+	cutoff := time.Now().Add(-h.cfg.TTL)
+	h.index.EvictStale()
+
+	h.mtx.Lock()
+	evicted := 0
+	h.pods = slices.DeleteFunc(h.pods, func(p *pod) bool {
+		if p.removed && p.scrapeEnd.Before(cutoff) {
+			// Snapshots may still hold the pod.
+			p.evicted = true
+			evicted++
+		}
+		return p.evicted
+	})
+	h.mtx.Unlock()
+
+	h.statsMtx.Lock()
+	h.report.PodsEvicted += int64(evicted)
+	h.statsMtx.Unlock()
+}
+
+// checkMemory records the memory used and checks it against the ceilings.
+func (h *harness) checkMemory() error {
+	sample := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(sample)
+	heap := int64(sample[0].Value.Uint64())
+	var indexBytes int64
+	if si, ok := h.index.(cardinality.StatsIndex); ok {
+		indexBytes = si.Stats().MemoryBytes
+	}
+
+	h.statsMtx.Lock()
+	h.report.PeakHeapBytes = max(h.report.PeakHeapBytes, heap)
+	h.report.PeakIndexBytes = max(h.report.PeakIndexBytes, indexBytes)
+	h.statsMtx.Unlock()
+
+	if h.cfg.MaxHeapBytes > 0 && heap > h.cfg.MaxHeapBytes {
+		return fmt.Errorf("live heap of %d bytes exceeds the ceiling of %d bytes", heap, h.cfg.MaxHeapBytes)
+	}
+	if h.cfg.MaxIndexBytes > 0 && indexBytes > h.cfg.MaxIndexBytes {
+		return fmt.Errorf("index memory of %d bytes exceeds the ceiling of %d bytes", indexBytes, h.cfg.MaxIndexBytes)
+	}
+	return nil
+}
+
+// snapshot returns a copy of the state of the pods.
+func (h *harness) snapshot() []pod {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	pods := make([]pod, len(h.pods))
+	for i, p := range h.pods {
+		pods[i] = *p
+	}
+	return pods
+}
+
+// query issues random queries and checks their answers until the context
+// is canceled.
+func (h *harness) query(ctx context.Context, r *rand.Rand) {
+	for {
+		matchers := h.randomMatchers(r)
+		before := h.snapshot()
+		estimate := cardinality.GetCardinalityContext(ctx, h.index, matchers...)
+		end := time.Now()
+		after := h.snapshot()
+		if ctx.Err() != nil {
+			// The answer may be partial.
+			return
+		}
+		low, high := h.bounds(matchers, before, after, end)
+		if err := h.check(matchers, estimate, low, high); err != nil {
+			h.fail(err)
+			return
+		}
+	}
+}
+
+// bounds returns the number of matching series surely in the index during
+// a query that ended at end, and the number possibly in it, from the
+// snapshots of the pods taken before and after the query. Live pods whose
+// last completed scrape began less than the TTL before the end can't have
+// been evicted; pods whose scrape began and that weren't evicted yet may be
+// in the index.
+func (h *harness) bounds(matchers []*labels.Matcher, before, after []pod, end time.Time) (low, high int64) {
+	cutoff := end.Add(-h.cfg.TTL)
+	counted := make(map[int]bool, len(before))
+	for _, p := range before {
+		if !p.present() {
+			continue
+		}
+		n := h.matching(p.id, matchers)
+		high += n
+		counted[p.id] = true
+		if !p.removed && !p.scraped.IsZero() && !p.scraped.Before(cutoff) {
+			low += n
+		}
+	}
+	for _, p := range after {
+		if p.present() && !counted[p.id] {
+			high += h.matching(p.id, matchers)
+		}
+	}
+	return low, high
+}
+
+// matching returns the number of series of the pod matching the matchers.
+func (h *harness) matching(id int, matchers []*labels.Matcher) int64 {
+	name, job := podName(id), h.jobs[id%h.cfg.Jobs]
+	var n int64
+series:
+	for j := range h.cfg.SeriesPerPod {
+		for _, m := range matchers {
+			var v string
+			switch m.Name {
+			case labels.MetricName:
+				v = h.metrics[j%soakMetrics]
+			case "idx":
+				v = h.idx[j]
+			case "job":
+				v = job
+			case "pod":
+				v = name
+			}
+			if !m.Matches(v) {
+				continue series
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// check records the answer of a query and returns a *Violation if it is
+// out of its bounds by more than the tolerance.
+func (h *harness) check(matchers []*labels.Matcher, estimate, low, high int64) error {
+	var relErr float64
+	switch {
+	case estimate < low:
+		relErr = float64(low-estimate) / float64(low)
+	case estimate > high:
+		relErr = float64(estimate-high) / float64(max(high, 1))
+	}
+
+	h.statsMtx.Lock()
+	h.report.Queries++
+	h.report.MaxError = max(h.report.MaxError, relErr)
+	h.statsMtx.Unlock()
+
+	tol := h.cfg.Tolerance
+	if float64(estimate) < math.Floor(float64(low)*(1-tol)) || float64(estimate) > math.Ceil(float64(high)*(1+tol)) {
+		return &Violation{Matchers: selector(matchers), Estimate: estimate, Min: low, Max: high}
+	}
+	return nil
+}
+
+// randomMatchers returns the matchers of a random query. Pods are drawn
+// from all pods ever added, so that queries also select removed ones.
+func (h *harness) randomMatchers(r *rand.Rand) []*labels.Matcher {
+	h.mtx.RLock()
+	pods := h.nextID
+	h.mtx.RUnlock()
+	id := r.IntN(max(pods, 1))
+	metric := h.metrics[r.IntN(soakMetrics)]
+	job := h.jobs[r.IntN(len(h.jobs))]
+	m := labels.MustNewMatcher
+
+	switch r.IntN(7) {
+	case 0:
+		return []*labels.Matcher{m(labels.MatchEqual, labels.MetricName, metric)}
+	case 1:
+		return []*labels.Matcher{m(labels.MatchEqual, labels.MetricName, metric), m(labels.MatchEqual, "job", job)}
+	case 2:
+		return []*labels.Matcher{m(labels.MatchEqual, "pod", podName(id))}
+	case 3:
+		digits := strconv.Itoa(id)
+		prefix := digits[:1+r.IntN(len(digits))]
+		return []*labels.Matcher{m(labels.MatchEqual, labels.MetricName, metric), m(labels.MatchRegexp, "pod", "pod-"+prefix+".*")}
+	case 4:
+		other := h.jobs[r.IntN(len(h.jobs))]
+		return []*labels.Matcher{m(labels.MatchRegexp, "job", job+"|"+other), m(labels.MatchNotEqual, "idx", h.idx[r.IntN(len(h.idx))])}
+	case 5:
+		return []*labels.Matcher{m(labels.MatchRegexp, labels.MetricName, "soak_metric_[0-4]"), m(labels.MatchNotRegexp, "job", "job-1.*")}
+	default:
+		return []*labels.Matcher{m(labels.MatchEqual, "job", job), m(labels.MatchNotEqual, "pod", podName(id)), m(labels.MatchRegexp, "idx", "1.*")}
+	}
+}
+
+func selector(matchers []*labels.Matcher) string {
+	strs := make([]string, len(matchers))
+	for i, m := range matchers {
+		strs[i] = m.String()
+	}
+	return "{" + strings.Join(strs, ",") + "}"
+}
+
+func podName(id int) string {
+	return "pod-" + strconv.Itoa(id)
+}
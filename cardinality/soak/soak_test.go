@@ -0,0 +1,69 @@
+package soak
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"harry671003/hello/cardinality"
+	"testing"
+	"time"
+)
+
+func testConfig(ttl time.Duration) Config {
+	cfg := DefaultConfig
+	cfg.Duration = time.Second
+	cfg.Interval = 10 * time.Millisecond
+	cfg.TTL = ttl
+	cfg.Pods = 50
+	cfg.SeriesPerPod = 10
+	cfg.Jobs = 5
+	cfg.Churn = 0.1
+	cfg.Workers = 2
+	return cfg
+}
+
+func TestRun(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	report, err := Run(context.Background(), cardinality.NewBitmapIndex(cardinality.WithValueTTL(ttl)), testConfig(ttl))
+	require.NoError(t, err)
+	require.Greater(t, report.Intervals, int64(1))
+	require.Greater(t, report.PodsAdded, int64(50))
+	require.Greater(t, report.PodsRemoved, int64(0))
+	require.Greater(t, report.PodsEvicted, int64(0))
+	require.Greater(t, report.Queries, int64(0))
+	require.Zero(t, report.MaxError)
+	require.Greater(t, report.PeakIndexBytes, int64(0))
+}
+
+// overCounting answers one series more than the index.
+type overCounting struct {
+	*cardinality.BitmapIndex
+}
+
+func (o overCounting) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return o.BitmapIndex.GetCardinality(matchers...) + 1
+}
+
+func (o overCounting) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	return o.BitmapIndex.GetCardinalityContext(ctx, matchers...) + 1
+}
+
+func TestRunViolations(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	cfg := testConfig(ttl)
+	cfg.Duration = 0
+	report, err := Run(context.Background(), overCounting{cardinality.NewBitmapIndex(cardinality.WithValueTTL(ttl))}, cfg)
+	var violation *Violation
+	require.True(t, errors.As(err, &violation), err)
+	require.Greater(t, violation.Estimate, violation.Max)
+	require.Greater(t, report.MaxError, 0.0)
+
+	cfg.MaxIndexBytes = 1
+	_, err = Run(context.Background(), cardinality.NewBitmapIndex(cardinality.WithValueTTL(ttl)), cfg)
+	require.ErrorContains(t, err, "index memory")
+
+	cfg.TTL = cfg.Interval
+	_, err = Run(context.Background(), cardinality.NewBitmapIndex(), cfg)
+	require.ErrorContains(t, err, "twice the interval")
+}
@@ -0,0 +1,150 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/prometheus/prometheus/model/labels"
+	"slices"
+)
+
+// DefaultStreamChunkSize is the number of label values unioned between two
+// partial results.
+const DefaultStreamChunkSize = 1000
+
+// Progress is a partial result of a streamed estimation.
+type Progress struct {
+	// ValuesDone is the number of values of the broadest matcher unioned so
+	// far, out of ValuesTotal.
+	ValuesDone  int `json:"values_done"`
+	ValuesTotal int `json:"values_total"`
+	// Series is the number of matching series found so far, a lower bound
+	// of the result.
+	Series int64 `json:"series"`
+	// Estimate extrapolates Series to all values, assuming the remaining
+	// values have as many series as the unioned ones.
+	Estimate int64 `json:"estimate"`
+	// Done is set on the last result, whose Series is the final answer.
+	Done bool `json:"done"`
+}
+
+// StreamCardinality estimates the cardinality using index, calling fn with
+// partial results if the index implements StreamingIndex. Other indexes
+// report the final result only. Returning an error from fn or canceling ctx
+// stops the estimation.
+func StreamCardinality(ctx context.Context, index CardinalityIndex, chunkSize int, fn func(Progress) error, matchers ...*labels.Matcher) error {
+	if si, ok := index.(StreamingIndex); ok {
+		return si.StreamCardinality(ctx, chunkSize, fn, matchers...)
+	}
+	card := GetCardinalityContext(ctx, index, matchers...)
+	return fn(Progress{Series: card, Estimate: card, Done: true})
+}
+
+// StreamCardinality reports a partial result after unioning every chunk of
+// chunkSize values of the matcher selecting the most values. The other
+// matchers are evaluated first. Values of bucketed labels aren't streamed.
+// A chunkSize of zero or less means DefaultStreamChunkSize.
+func (b *BitmapIndex) StreamCardinality(ctx context.Context, chunkSize int, fn func(Progress) error, matchers ...*labels.Matcher) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	final := func(values int) error {
+		card := b.GetCardinalityContext(ctx, matchers...)
+		return fn(Progress{ValuesDone: values, ValuesTotal: values, Series: card, Estimate: card, Done: true})
+	}
+	if len(matchers) == 0 {
+		return final(0)
+	}
+	simplified, ok := SimplifyMatchers(matchers)
+	if !ok {
+		return final(0)
+	}
+
+	broadest := -1
+	var s *labelShard
+	var entries []*valueEntry
+	for i, m := range simplified {
+		if m.Type == labels.MatchEqual {
+			continue
+		}
+		shard := b.shard(m.Name)
+		if matching, ok := shard.matching(m); ok && len(matching) > len(entries) {
+			broadest, s, entries = i, shard, matching
+		}
+	}
+	if broadest < 0 || len(entries) <= chunkSize {
+		return final(len(entries))
+	}
+	matcher := simplified[broadest]
+	var restrict *roaring64.Bitmap
+	if others := slices.Delete(slices.Clone(simplified), broadest, broadest+1); len(others) > 0 {
+		restrict = b.getIntersectionBitmap(ctx, others)
+	}
+	count := func(bitmap *roaring64.Bitmap) int64 {
+		if restrict == nil {
+			return int64(bitmap.GetCardinality())
+		}
+		return int64(bitmap.AndCardinality(restrict))
+	}
+
+	// The series without the label are known upfront and aren't
+	// extrapolated.
+	union := roaring64.NewBitmap()
+	if matcher.Matches("") {
+		b.mtx.RLock()
+		union.Or(b.all)
+		b.mtx.RUnlock()
+		s.mtx.RLock()
+		union.AndNot(s.present)
+		s.mtx.RUnlock()
+	}
+	base := count(union)
+
+	for done := 0; done < len(entries); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := min(done+chunkSize, len(entries))
+		s.mtx.RLock()
+		for _, v := range entries[done:end] {
+			union.Or(v.read())
+		}
+		s.mtx.RUnlock()
+		done = end
+
+		series := count(union)
+		p := Progress{
+			ValuesDone:  done,
+			ValuesTotal: len(entries),
+			Series:      series,
+			Estimate:    base + (series-base)*int64(len(entries))/int64(done),
+			Done:        done == len(entries),
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matching returns the values matching the matcher, or false if the shard
+// is bucketed. It is safe to call on a nil shard.
+func (s *labelShard) matching(matcher *labels.Matcher) ([]*valueEntry, bool) {
+	if s == nil {
+		return nil, true
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.bucketed != nil {
+		return nil, false
+	}
+
+	var entries []*valueEntry
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id, v := range s.values {
+			if matcher.Matches(str(id)) {
+				entries = append(entries, v)
+			}
+		}
+	})
+	return entries, true
+}
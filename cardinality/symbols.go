@@ -0,0 +1,106 @@
+package cardinality
+
+import (
+	"sync"
+)
+
+// SymbolTable assigns uint32 IDs to label names and values, so that indexes
+// store every string once and key their internal maps by ID. Symbols are
+// reference counted: an ID is reused once all references to its string are
+// released. A table can be shared by several indexes, see WithSymbolTable.
+// It is safe for concurrent use.
+type SymbolTable struct {
+	mtx     sync.RWMutex
+	ids     map[string]uint32
+	strings []string
+	refs    []uint32
+	free    []uint32
+	bytes   int64
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{ids: make(map[string]uint32)}
+}
+
+// Ref returns the ID of s, assigning one if s has no references, and adds a
+// reference to it.
+func (t *SymbolTable) Ref(s string) uint32 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if id, ok := t.ids[s]; ok {
+		t.refs[id]++
+		return id
+	}
+
+	var id uint32
+	if n := len(t.free); n > 0 {
+		id = t.free[n-1]
+		t.free = t.free[:n-1]
+		t.strings[id] = s
+		t.refs[id] = 1
+	} else {
+		id = uint32(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.refs = append(t.refs, 1)
+	}
+	t.ids[s] = id
+	t.bytes += int64(len(s))
+	return id
+}
+
+// Release drops a reference to the symbol. The ID must not be used by the
+// caller afterwards.
+func (t *SymbolTable) Release(id uint32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.refs[id]--
+	if t.refs[id] > 0 {
+		return
+	}
+	s := t.strings[id]
+	delete(t.ids, s)
+	t.bytes -= int64(len(s))
+	t.strings[id] = ""
+	t.free = append(t.free, id)
+}
+
+// Lookup returns the ID of s, if it has one.
+func (t *SymbolTable) Lookup(s string) (uint32, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	id, ok := t.ids[s]
+	return id, ok
+}
+
+// String returns the string of a referenced ID.
+func (t *SymbolTable) String(id uint32) string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.strings[id]
+}
+
+// resolve calls fn with a function returning the string of an ID, holding
+// the read lock once for the lookups of a whole scan. fn must not add or
+// release symbols.
+func (t *SymbolTable) resolve(fn func(str func(id uint32) string)) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	fn(func(id uint32) string { return t.strings[id] })
+}
+
+// Len returns the number of symbols in the table.
+func (t *SymbolTable) Len() int {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return len(t.ids)
+}
+
+// Size approximates the memory used by the table in bytes: the strings, the
+// map entries and the ID slices.
+func (t *SymbolTable) Size() int64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	// A string header and an ID per map entry, a string header and a
+	// reference count per slice entry.
+	return t.bytes + int64(len(t.ids))*(16+4) + int64(cap(t.strings))*(16+4)
+}
@@ -0,0 +1,303 @@
+package cardinality
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/storage"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// TenantLabel is the label the tenant rules of a TenantIndexManager write
+// the tenant of a series to. It is removed before the series is indexed.
+const TenantLabel = "__tenant__"
+
+// Quota limits the number of series of a tenant.
+type Quota struct {
+	// MaxSeries is the maximum number of series of the tenant. Zero means
+	// unlimited.
+	MaxSeries int64
+	// MaxSeriesPerMetric is the maximum number of series of any single
+	// metric of the tenant. Zero means unlimited.
+	MaxSeriesPerMetric int64
+}
+
+// QuotaUsage is the usage of a tenant relative to its quota.
+type QuotaUsage struct {
+	Tenant string
+	Quota  Quota
+
+	Series int64
+	// TopMetric is the metric with the most series, and TopMetricSeries
+	// its number of series.
+	TopMetric       string
+	TopMetricSeries int64
+}
+
+// Utilization returns the highest fraction of any limit in the quota that is
+// used, or 0 if the quota is unlimited.
+func (u QuotaUsage) Utilization() float64 {
+	var utilization float64
+	if u.Quota.MaxSeries > 0 {
+		utilization = float64(u.Series) / float64(u.Quota.MaxSeries)
+	}
+	if u.Quota.MaxSeriesPerMetric > 0 {
+		utilization = max(utilization, float64(u.TopMetricSeries)/float64(u.Quota.MaxSeriesPerMetric))
+	}
+	return utilization
+}
+
+// Exceeded reports whether any limit of the quota is exceeded.
+func (u QuotaUsage) Exceeded() bool {
+	return (u.Quota.MaxSeries > 0 && u.Series > u.Quota.MaxSeries) ||
+		(u.Quota.MaxSeriesPerMetric > 0 && u.TopMetricSeries > u.Quota.MaxSeriesPerMetric)
+}
+
+type tenantIndex struct {
+	mtx   sync.Mutex
+	index CardinalityIndex
+	// small is set while the series of the tenant are in a smallIndex.
+	small *smallIndex
+}
+
+// TenantIndexManager maintains a separate index per tenant. It is safe for
+// concurrent use; operations on different tenants don't block each other.
+type TenantIndexManager struct {
+	newIndex func(tenant string) CardinalityIndex
+
+	mtx          sync.RWMutex
+	tenants      map[string]*tenantIndex
+	quotas       map[string]Quota
+	defaultQuota Quota
+	// smallThreshold is the number of series above which tenants are
+	// promoted out of a smallIndex.
+	smallThreshold int
+	// tenantRules and defaultTenant derive the tenant of the series added
+	// with AddSeriesFromLabels.
+	tenantRules   []*relabel.Config
+	defaultTenant string
+}
+
+// NewTenantIndexManager returns a manager creating the index of a tenant with
+// newIndex when it first receives series.
+func NewTenantIndexManager(newIndex func(tenant string) CardinalityIndex) *TenantIndexManager {
+	return &TenantIndexManager{
+		newIndex: newIndex,
+		tenants:  make(map[string]*tenantIndex),
+		quotas:   make(map[string]Quota),
+	}
+}
+
+// SetDefaultQuota sets the quota of tenants without their own quota.
+func (m *TenantIndexManager) SetDefaultQuota(q Quota) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.defaultQuota = q
+}
+
+// SetQuota sets the quota of a tenant.
+func (m *TenantIndexManager) SetQuota(tenant string, q Quota) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.quotas[tenant] = q
+}
+
+// quota returns the quota of a tenant. The quotas are guarded by m.mtx
+// rather than the lock of the tenant, which AddSeries holds while taking
+// m.mtx.
+func (m *TenantIndexManager) quota(tenant string) Quota {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if q, ok := m.quotas[tenant]; ok {
+		return q
+	}
+	return m.defaultQuota
+}
+
+// SetSmallTenantThreshold makes new tenants start with an exact index
+// keeping the labels of their series in a map, promoted to an index created
+// by newIndex once they have more than series series. Most tenants are
+// small, and for a few hundred series a map takes less memory than the
+// bitmaps or sketches of every label value, while answering exactly. Zero,
+// the default, creates the indexes of new tenants with newIndex right away.
+func (m *TenantIndexManager) SetSmallTenantThreshold(series int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.smallThreshold = series
+}
+
+func (m *TenantIndexManager) getOrCreate(tenant string) *tenantIndex {
+	m.mtx.RLock()
+	t, ok := m.tenants[tenant]
+	m.mtx.RUnlock()
+	if ok {
+		return t
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if t, ok := m.tenants[tenant]; ok {
+		return t
+	}
+	t = &tenantIndex{}
+	if m.smallThreshold > 0 {
+		t.small = newSmallIndex()
+		t.index = t.small
+	} else {
+		t.index = m.newIndex(tenant)
+	}
+	m.tenants[tenant] = t
+	return t
+}
+
+func (m *TenantIndexManager) get(tenant string) (*tenantIndex, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	t, ok := m.tenants[tenant]
+	return t, ok
+}
+
+// AddSeries adds a series to the index of the tenant.
+func (m *TenantIndexManager) AddSeries(tenant string, lbls labels.Labels, ref storage.SeriesRef) {
+	t := m.getOrCreate(tenant)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.index.AddSeries(lbls, ref)
+	if t.small == nil {
+		return
+	}
+	m.mtx.RLock()
+	threshold := m.smallThreshold
+	m.mtx.RUnlock()
+	if len(t.small.series) > threshold {
+		t.index = t.small.promote(m.newIndex(tenant))
+		t.small = nil
+	}
+}
+
+// SetTenantRules sets the relabel rules deriving the tenant of the series
+// added with AddSeriesFromLabels, so that a single stream of series can be
+// split into per-tenant indexes. The rules write the tenant to TenantLabel,
+// e.g. with the rules of TenantFromLabel. Series they assign no tenant
+// belong to defaultTenant, or are dropped if it is empty.
+func (m *TenantIndexManager) SetTenantRules(rules []*relabel.Config, defaultTenant string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.tenantRules = rules
+	m.defaultTenant = defaultTenant
+}
+
+// AddSeriesFromLabels adds a series to the index of the tenant the tenant
+// rules derive from its labels. The series is indexed with the labels the
+// rules return, without TenantLabel, so the rules can also strip the label
+// the tenant was read from. It returns the tenant, and false if the series
+// was dropped by the rules or has no tenant.
+func (m *TenantIndexManager) AddSeriesFromLabels(lbls labels.Labels, ref storage.SeriesRef) (string, bool) {
+	m.mtx.RLock()
+	rules, defaultTenant := m.tenantRules, m.defaultTenant
+	m.mtx.RUnlock()
+
+	lb := labels.NewBuilder(lbls)
+	if !relabel.ProcessBuilder(lb, rules...) {
+		return "", false
+	}
+	tenant := lb.Get(TenantLabel)
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	if tenant == "" {
+		return "", false
+	}
+	m.AddSeries(tenant, lb.Del(TenantLabel).Labels(), ref)
+	return tenant, true
+}
+
+// TenantFromLabel returns tenant rules taking the tenant of a series from
+// the given label, e.g. namespace, and removing the label from the indexed
+// series if strip is set.
+func TenantFromLabel(name string, strip bool) []*relabel.Config {
+	rule := relabel.DefaultRelabelConfig
+	rule.SourceLabels = model.LabelNames{model.LabelName(name)}
+	rule.TargetLabel = TenantLabel
+	rules := []*relabel.Config{&rule}
+	if strip {
+		drop := relabel.DefaultRelabelConfig
+		drop.Action = relabel.LabelDrop
+		drop.Regex = relabel.MustNewRegexp(regexp.QuoteMeta(name))
+		rules = append(rules, &drop)
+	}
+	return rules
+}
+
+// GetCardinality estimates the cardinality of the matchers within a tenant.
+func (m *TenantIndexManager) GetCardinality(tenant string, matchers ...*labels.Matcher) int64 {
+	t, ok := m.get(tenant)
+	if !ok {
+		return 0
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.index.GetCardinality(matchers...)
+}
+
+// Tenants returns the sorted IDs of all tenants with an index.
+func (m *TenantIndexManager) Tenants() []string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	tenants := make([]string, 0, len(m.tenants))
+	for tenant := range m.tenants {
+		tenants = append(tenants, tenant)
+	}
+	slices.Sort(tenants)
+	return tenants
+}
+
+// Usage returns the quota usage of a tenant. Series are counted per metric
+// name, so indexes that don't implement LabelValuesIndex report no usage.
+func (m *TenantIndexManager) Usage(tenant string) QuotaUsage {
+	usage := QuotaUsage{Tenant: tenant, Quota: m.quota(tenant)}
+	t, ok := m.get(tenant)
+	if !ok {
+		return usage
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	lvi, ok := t.index.(LabelValuesIndex)
+	if !ok {
+		return usage
+	}
+	for _, metric := range lvi.LabelValues(labels.MetricName) {
+		series := t.index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metric))
+		usage.Series += series
+		if series > usage.TopMetricSeries {
+			usage.TopMetric, usage.TopMetricSeries = metric, series
+		}
+	}
+	return usage
+}
+
+// TenantsClosestToLimit returns the usage of up to n tenants with the highest
+// quota utilization, highest first, or of all of them if n is negative.
+// Tenants without a quota are skipped.
+func (m *TenantIndexManager) TenantsClosestToLimit(n int) []QuotaUsage {
+	var usages []QuotaUsage
+	for _, tenant := range m.Tenants() {
+		usage := m.Usage(tenant)
+		if usage.Quota == (Quota{}) {
+			continue
+		}
+		usages = append(usages, usage)
+	}
+
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].Utilization() > usages[j].Utilization()
+	})
+	if n >= 0 && len(usages) > n {
+		usages = usages[:n]
+	}
+	return usages
+}
@@ -0,0 +1,45 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/axiomhq/hyperminhash"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"harry671003/hello/cardinality/sketchcore"
+)
+
+var tracer = otel.Tracer("harry671003/hello/cardinality")
+
+func matchersAttribute(matchers ...*labels.Matcher) attribute.KeyValue {
+	return attribute.StringSlice("matchers", matcherStrings(matchers))
+}
+
+func matcherStrings(matchers []*labels.Matcher) []string {
+	strs := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		strs = append(strs, m.String())
+	}
+	return strs
+}
+
+// setSpanMatchers only renders the matchers if the span is sampled.
+func setSpanMatchers(span trace.Span, matchers ...*labels.Matcher) {
+	if span.IsRecording() {
+		span.SetAttributes(matchersAttribute(matchers...))
+	}
+}
+
+// matcherSpans returns a hook tracing the sketch built for every matcher of
+// a query as a child span of ctx.
+func matcherSpans(ctx context.Context, name string) sketchcore.MatcherHook {
+	return func(matcher *labels.Matcher) func(*hyperminhash.Sketch) {
+		_, span := tracer.Start(ctx, name)
+		setSpanMatchers(span, matcher)
+		return func(sketch *hyperminhash.Sketch) {
+			span.SetAttributes(attribute.Int64("cardinality", int64(sketch.Cardinality())))
+			span.End()
+		}
+	}
+}
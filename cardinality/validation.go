@@ -0,0 +1,65 @@
+package cardinality
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrEmptyLabelName is returned for label sets with an empty label name.
+	ErrEmptyLabelName = errors.New("empty label name")
+	// ErrDuplicateLabelName is returned for label sets with the same label
+	// name more than once with different values.
+	ErrDuplicateLabelName = errors.New("duplicate label name")
+)
+
+// NormalizeLabels returns a well-formed copy of lbls, as the indexes expect
+// it: sorted by name, without repeated labels and without labels with an
+// empty value, which PromQL treats as absent. Label sets with empty names or
+// with a name repeated with different values are rejected. lbls is not
+// modified.
+func NormalizeLabels(lbls labels.Labels) (labels.Labels, error) {
+	normalized := make(labels.Labels, 0, len(lbls))
+	for _, l := range lbls {
+		if l.Name == "" {
+			return nil, fmt.Errorf("%w in %s", ErrEmptyLabelName, lbls)
+		}
+		if l.Value != "" {
+			normalized = append(normalized, l)
+		}
+	}
+	slices.SortStableFunc(normalized, func(a, b labels.Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var err error
+	normalized = slices.CompactFunc(normalized, func(a, b labels.Label) bool {
+		if a.Name != b.Name {
+			return false
+		}
+		if a.Value != b.Value && err == nil {
+			err = fmt.Errorf("%w %q in %s", ErrDuplicateLabelName, a.Name, lbls)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// AddSeriesValidated normalizes the labels with NormalizeLabels before adding
+// the series to the index, for ingestion sources like remote write that may
+// send malformed label sets. Invalid series are not added.
+func AddSeriesValidated(index CardinalityIndex, lbls labels.Labels, ref storage.SeriesRef) error {
+	normalized, err := NormalizeLabels(lbls)
+	if err != nil {
+		return err
+	}
+	index.AddSeries(normalized, ref)
+	return nil
+}
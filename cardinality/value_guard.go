@@ -0,0 +1,197 @@
+package cardinality
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"math"
+	"slices"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// UnboundedValuePrefix starts the values that replace the values
+	// bucketed by a ValueGuard.
+	UnboundedValuePrefix = "__unbounded_"
+
+	// minEntropyLength is the length below which values aren't checked for
+	// entropy: the entropy of short values is bounded by their length, and
+	// they can't blow up the index by much anyway.
+	minEntropyLength = 16
+	// maxExampleLength truncates the examples of UnboundedLabel.
+	maxExampleLength = 64
+)
+
+// ValueGuard configures the ingest guard of an index, which flags the label
+// values that look unbounded, like request or trace IDs, as series are
+// added, see WithValueGuard. Metric names aren't checked: bucketing them
+// would break every matcher on the metric.
+type ValueGuard struct {
+	// MaxLength is the length in bytes above which values are flagged. Zero
+	// disables the check.
+	MaxLength int
+	// MinEntropy is the Shannon entropy in bits per byte from which values
+	// of at least 16 bytes are flagged. Random base62 identifiers of 32 bytes
+	// average 4.5 bits, while names made of words, even with a generated
+	// suffix, stay around 4 bits or below. Hexadecimal identifiers can't
+	// exceed 4 bits and are better caught by MaxLength. Zero disables the
+	// check.
+	MinEntropy float64
+	// Buckets replaces flagged values with one of that many values starting
+	// with UnboundedValuePrefix, chosen by hash, so that they can't blow up
+	// the index. Matchers on the original values no longer select their
+	// series. Zero indexes the values as is and only reports them.
+	Buckets int
+}
+
+// UnboundedLabel reports the values of a label flagged by a ValueGuard.
+type UnboundedLabel struct {
+	Label string `json:"label"`
+	// Series counts the new series added with a flagged value of the label,
+	// and TooLong and HighEntropy the series whose value was flagged for its
+	// length and entropy, which can both apply. Series that only differ by
+	// values bucketed together are the same series.
+	Series      int64 `json:"series"`
+	TooLong     int64 `json:"too_long"`
+	HighEntropy int64 `json:"high_entropy"`
+	// MaxLength is the length of the longest flagged value.
+	MaxLength int `json:"max_length"`
+	// Example is the first flagged value, truncated to at most 64 bytes on
+	// a rune boundary.
+	Example string `json:"example"`
+}
+
+func (l UnboundedLabel) String() string {
+	return fmt.Sprintf("label %s looks unbounded: %d series with flagged values like %q", l.Label, l.Series, l.Example)
+}
+
+// flaggedValue is a label value flagged by a ValueGuard.
+type flaggedValue struct {
+	name, value          string
+	tooLong, highEntropy bool
+}
+
+type valueGuard struct {
+	cfg ValueGuard
+
+	mtx    sync.Mutex
+	labels map[string]*UnboundedLabel
+}
+
+func newValueGuard(cfg ValueGuard) *valueGuard {
+	if cfg.MaxLength <= 0 && cfg.MinEntropy <= 0 {
+		return nil
+	}
+	return &valueGuard{cfg: cfg, labels: make(map[string]*UnboundedLabel)}
+}
+
+// check returns the labels with the flagged values bucketed if configured,
+// and the flagged values, which are recorded with record once the series
+// is known to be new. It is safe to call on a nil guard.
+func (g *valueGuard) check(lbls labels.Labels) (labels.Labels, []flaggedValue) {
+	if g == nil {
+		return lbls, nil
+	}
+	var flagged []flaggedValue
+	lbls.Range(func(l labels.Label) {
+		if l.Name == labels.MetricName {
+			return
+		}
+		tooLong := g.cfg.MaxLength > 0 && len(l.Value) > g.cfg.MaxLength
+		highEntropy := g.cfg.MinEntropy > 0 && len(l.Value) >= minEntropyLength && entropy(l.Value) >= g.cfg.MinEntropy
+		if tooLong || highEntropy {
+			flagged = append(flagged, flaggedValue{name: l.Name, value: l.Value, tooLong: tooLong, highEntropy: highEntropy})
+		}
+	})
+	if len(flagged) == 0 || g.cfg.Buckets <= 0 {
+		return lbls, flagged
+	}
+	lb := labels.NewBuilder(lbls)
+	for _, f := range flagged {
+		lb.Set(f.name, fmt.Sprintf("%s%d", UnboundedValuePrefix, xxhash.Sum64String(f.value)%uint64(g.cfg.Buckets)))
+	}
+	return lb.Labels(), flagged
+}
+
+// record counts the flagged values of a new series.
+func (g *valueGuard) record(flagged []flaggedValue) {
+	if g == nil || len(flagged) == 0 {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, f := range flagged {
+		l, ok := g.labels[f.name]
+		if !ok {
+			l = &UnboundedLabel{Label: f.name, Example: truncate(f.value, maxExampleLength)}
+			g.labels[f.name] = l
+		}
+		l.Series++
+		if f.tooLong {
+			l.TooLong++
+		}
+		if f.highEntropy {
+			l.HighEntropy++
+		}
+		l.MaxLength = max(l.MaxLength, len(f.value))
+	}
+}
+
+// report returns the flagged labels, most series first.
+func (g *valueGuard) report() []UnboundedLabel {
+	if g == nil {
+		return nil
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	report := make([]UnboundedLabel, 0, len(g.labels))
+	for _, l := range g.labels {
+		report = append(report, *l)
+	}
+	slices.SortFunc(report, func(a, b UnboundedLabel) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.Label, b.Label))
+	})
+	return report
+}
+
+// entropy returns the Shannon entropy of the bytes of s, in bits per byte.
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// truncate returns s cut to at most n bytes, without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// UnboundedLabels returns the labels with values flagged by the guard of
+// the index, most series first, or nil if the index was not created
+// WithValueGuard.
+func (b *BitmapIndex) UnboundedLabels() []UnboundedLabel {
+	return b.guard.report()
+}
+
+// UnboundedLabels returns the labels with values flagged by the guard of
+// the index, see BitmapIndex.UnboundedLabels.
+func (h *HyperMinHashIndex) UnboundedLabels() []UnboundedLabel {
+	return h.guard.report()
+}
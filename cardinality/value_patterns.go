@@ -0,0 +1,227 @@
+package cardinality
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var uuidRegexp = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// LabelValuePattern is a group of values of a label that only differ by
+// generated parts, like the pods of a deployment.
+type LabelValuePattern struct {
+	Label string `json:"label"`
+	// Pattern is the values with their generated parts replaced by *, e.g.
+	// api-* for api-7d9f8b6c4-x2k9p.
+	Pattern string `json:"pattern"`
+	Values  int    `json:"values"`
+	Series  int64  `json:"series"`
+}
+
+func (p LabelValuePattern) String() string {
+	return fmt.Sprintf("%s matches pattern %s, %d values, %d series", p.Label, p.Pattern, p.Values, p.Series)
+}
+
+// ValuePattern returns the pattern of a label value: the value with its
+// UUIDs, numbers and generated suffixes replaced by *, and consecutive
+// generated parts merged. It reports whether the value has generated parts.
+// A part counts as generated if it is a number, or alphanumeric with at
+// least 5 characters and 2 digits, like hashes and Kubernetes pod suffixes.
+func ValuePattern(value string) (string, bool) {
+	value = uuidRegexp.ReplaceAllString(value, "*")
+
+	// Split the value into parts, each followed by its separator.
+	var parts, seps []string
+	for {
+		i := strings.IndexAny(value, "-_.:/@")
+		if i == -1 {
+			parts, seps = append(parts, value), append(seps, "")
+			break
+		}
+		parts, seps = append(parts, value[:i]), append(seps, value[i:i+1])
+		value = value[i+1:]
+	}
+	generated := make([]bool, len(parts))
+	for i, part := range parts {
+		generated[i] = isGeneratedPart(part)
+	}
+
+	var sb strings.Builder
+	for i, part := range parts {
+		if !generated[i] {
+			sb.WriteString(part)
+			sb.WriteString(seps[i])
+			continue
+		}
+		if i == 0 || !generated[i-1] {
+			sb.WriteString("*")
+		}
+		if i+1 == len(parts) || !generated[i+1] {
+			sb.WriteString(seps[i])
+		}
+	}
+	return sb.String(), slices.Contains(generated, true)
+}
+
+// isGeneratedPart reports whether a part of a value between separators
+// looks generated.
+func isGeneratedPart(part string) bool {
+	if part == "*" {
+		return true
+	}
+	if part == "" {
+		return false
+	}
+	digits := 0
+	for _, c := range part {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		default:
+			return false
+		}
+	}
+	return digits == len(part) || (len(part) >= 5 && digits >= 2)
+}
+
+// ValuePatterns groups the values of every label by ValuePattern and
+// returns the patterns of at least minValues values, most series first.
+// Such labels usually hold identifiers, and the pattern tells what they
+// identify better than a list of values. Bucketed labels are skipped.
+func (b *BitmapIndex) ValuePatterns(minValues int) []LabelValuePattern {
+	var patterns []LabelValuePattern
+	b.forEachShard(func(name string, s *labelShard) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+		for pattern, ids := range s.patternValues() {
+			if len(ids) < max(minValues, 2) {
+				continue
+			}
+			union := roaring64.NewBitmap()
+			for _, id := range ids {
+				union.Or(s.values[id].postings)
+			}
+			patterns = append(patterns, LabelValuePattern{
+				Label:   name,
+				Pattern: pattern,
+				Values:  len(ids),
+				Series:  int64(union.GetCardinality()),
+			})
+		}
+	})
+	slices.SortFunc(patterns, func(a, b LabelValuePattern) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.Label, b.Label), cmp.Compare(a.Pattern, b.Pattern))
+	})
+	return patterns
+}
+
+// patternValues returns the IDs of the values of the shard with generated
+// parts, keyed by pattern. The caller must hold the lock.
+func (s *labelShard) patternValues() map[string][]uint32 {
+	patterns := make(map[string][]uint32)
+	s.symbols.resolve(func(str func(uint32) string) {
+		for id := range s.values {
+			if pattern, ok := ValuePattern(str(id)); ok {
+				patterns[pattern] = append(patterns[pattern], id)
+			}
+		}
+	})
+	return patterns
+}
+
+// CollapseValuePattern makes the values of the label with the given pattern
+// share the bitmap of their union, and returns the number of values
+// collapsed. The values stay known, but matchers selecting some of them
+// over-count by the series of the other values of the pattern, like
+// matchers on bucketed labels; in exchange the label takes a bitmap per
+// pattern instead of per value. The values keep the number of their own
+// series, see removeShared for how they are dropped.
+func (b *BitmapIndex) CollapseValuePattern(name, pattern string) int {
+	b.metricsMtx.RLock()
+	for _, sub := range b.metrics {
+		sub.CollapseValuePattern(name, pattern)
+	}
+	b.metricsMtx.RUnlock()
+
+	s := b.shard(name)
+	if s == nil {
+		return 0
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ids := s.patternValues()[pattern]
+	if len(ids) < 2 {
+		return 0
+	}
+	union := roaring64.NewBitmap()
+	for _, id := range ids {
+		union.Or(s.values[id].read())
+	}
+	union.RunOptimize()
+	for _, id := range ids {
+		v := s.values[id]
+		v.stat.series = int64(v.read().GetCardinality())
+		v.release()
+		v.postings = union
+	}
+	s.collapsed = true
+	return len(ids)
+}
+
+// removeShared removes the stale series from the bitmaps shared by the
+// values of collapsed patterns, and returns the number of values dropped.
+// Which values the stale series were of isn't known, so the series left
+// are spread over the values in proportion to the series they had, keeping
+// their sum that of the bitmap, and values left without series are
+// dropped. The caller must hold the lock.
+func (s *labelShard) removeShared(stale *roaring64.Bitmap) int {
+	shared := make(map[*roaring64.Bitmap][]uint32)
+	for id, v := range s.values {
+		if v.segment == nil {
+			shared[v.postings] = append(shared[v.postings], id)
+		}
+	}
+	evicted := 0
+	for bitmap, ids := range shared {
+		if len(ids) < 2 || !bitmap.Intersects(stale) {
+			continue
+		}
+		before := int64(bitmap.GetCardinality())
+		bitmap.AndNot(stale)
+		after := int64(bitmap.GetCardinality())
+
+		// The series left over by rounding down go to the values with the
+		// largest remainders.
+		slices.Sort(ids)
+		remainders := make([]int64, len(ids))
+		left := after
+		for i, id := range ids {
+			v := s.values[id]
+			remainders[i] = v.stat.series * after % before
+			v.stat.series = v.stat.series * after / before
+			v.stat.bytes = v.stat.bytes * after / before
+			left -= v.stat.series
+		}
+		order := make([]int, len(ids))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(remainders[b], remainders[a]) })
+		for _, i := range order[:min(max(left, 0), int64(len(order)))] {
+			s.values[ids[i]].stat.series++
+		}
+		for _, id := range ids {
+			if s.values[id].stat.series == 0 {
+				s.delete(id)
+				evicted++
+			}
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,139 @@
+package cardinality
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"sort"
+)
+
+// LabelValueStats describes the series carrying a label value.
+type LabelValueStats struct {
+	Value string
+	// Series is the number of series with the value.
+	Series int64
+	// Bytes is the approximate memory impact of those series: the sum of
+	// the lengths of all label names and values of every series.
+	Bytes int64
+}
+
+type valueStat struct {
+	series int64
+	bytes  int64
+}
+
+// valueStats holds exact per label value statistics, keyed by label name
+// and value.
+type valueStats map[string]labelStats
+
+// seriesBytes returns the sum of the lengths of all label names and values.
+func seriesBytes(lbls labels.Labels) int64 {
+	var n int64
+	for _, l := range lbls {
+		n += int64(len(l.Name) + len(l.Value))
+	}
+	return n
+}
+
+func (s valueStats) add(name, value string, bytes int64) {
+	values, ok := s[name]
+	if !ok {
+		values = make(labelStats)
+		s[name] = values
+	}
+	values.add(value, bytes)
+}
+
+// remove subtracts the statistics of other, a subset of the series of s,
+// dropping the values left without series. Labels s has no statistics for
+// anymore, like bucketed ones, are skipped.
+func (s valueStats) remove(other valueStats) {
+	for name, otherValues := range other {
+		values, ok := s[name]
+		if !ok {
+			continue
+		}
+		for value, o := range otherValues {
+			stat, ok := values[value]
+			if !ok {
+				continue
+			}
+			stat.series -= o.series
+			stat.bytes -= o.bytes
+			if stat.series <= 0 {
+				delete(values, value)
+			}
+		}
+	}
+}
+
+// series returns the number of series with the value, and whether statistics
+// are kept for the label at all.
+func (s valueStats) series(name, value string) (int64, bool) {
+	values, ok := s[name]
+	if !ok {
+		return 0, false
+	}
+	return values.series(value), true
+}
+
+// TopLabelValues returns the statistics of up to n values of a label with
+// the most series. Labels that have been bucketed have no per-value
+// statistics.
+func (s valueStats) TopLabelValues(name string, n int) []LabelValueStats {
+	return s[name].TopLabelValues(n)
+}
+
+// TopLabelValuesByBytes is like TopLabelValues but ranks the values by
+// their memory impact.
+func (s valueStats) TopLabelValuesByBytes(name string, n int) []LabelValueStats {
+	return s[name].TopLabelValuesByBytes(n)
+}
+
+// labelStats holds the exact statistics of the values of a single label.
+type labelStats map[string]*valueStat
+
+func (s labelStats) add(value string, bytes int64) {
+	stat, ok := s[value]
+	if !ok {
+		stat = &valueStat{}
+		s[value] = stat
+	}
+	stat.series++
+	stat.bytes += bytes
+}
+
+func (s labelStats) series(value string) int64 {
+	if stat, ok := s[value]; ok {
+		return stat.series
+	}
+	return 0
+}
+
+// top returns the statistics of up to n values, ordered by less.
+func (s labelStats) top(n int, less func(a, b LabelValueStats) bool) []LabelValueStats {
+	result := make([]LabelValueStats, 0, len(s))
+	for value, stat := range s {
+		result = append(result, LabelValueStats{Value: value, Series: stat.series, Bytes: stat.bytes})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if less(result[i], result[j]) {
+			return true
+		}
+		if less(result[j], result[i]) {
+			return false
+		}
+		return result[i].Value < result[j].Value
+	})
+	if n >= 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func (s labelStats) TopLabelValues(n int) []LabelValueStats {
+	return s.top(n, func(a, b LabelValueStats) bool { return a.Series > b.Series })
+}
+
+func (s labelStats) TopLabelValuesByBytes(n int) []LabelValueStats {
+	return s.top(n, func(a, b LabelValueStats) bool { return a.Bytes > b.Bytes })
+}
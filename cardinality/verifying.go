@@ -0,0 +1,229 @@
+package cardinality
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+)
+
+// verificationQueueSize bounds the series and sampled queries waiting to be
+// applied to the reference index. Samples are dropped while the queue is
+// full, so a slow reference query never slows down the primary; series
+// block the writer only once the reference fell a whole queue behind.
+const verificationQueueSize = 1024
+
+// VerificationStats describes how the answers of the primary index of a
+// VerifyingIndex compare to the reference index.
+type VerificationStats struct {
+	Queries int64 `json:"queries"`
+	// Dropped counts the sampled queries dropped because the comparisons
+	// fell behind.
+	Dropped  int64 `json:"dropped"`
+	Compared int64 `json:"compared"`
+	// Diverged counts the compared queries whose relative error exceeded
+	// the tolerance.
+	Diverged int64 `json:"diverged"`
+	// MeanAbsError and MaxAbsError are the mean and largest absolute
+	// relative errors of the compared queries.
+	MeanAbsError float64 `json:"mean_abs_error"`
+	MaxAbsError  float64 `json:"max_abs_error"`
+}
+
+// referenceOp is a series to add to the reference index, or a sampled
+// query to compare. Both go through a single queue so
+// that the reference answers a sample after adding the series the primary
+// had when it answered.
+type referenceOp struct {
+	lbls     labels.Labels
+	ref      storage.SeriesRef
+	sample   bool
+	matchers []*labels.Matcher
+	primary  int64
+}
+
+// VerifyingIndex answers from a primary index, e.g. a new index type being
+// rolled out, and compares a sampled fraction of the answers to a reference
+// index, typically an exact one, in the background. Series are added to
+// both. The comparisons run in Run; divergences are logged at debug level
+// and exported as metrics, the VerifyingIndex being a prometheus.Collector.
+// The reference is only written and queried by Run, so it needn't be safe
+// for concurrent use. Run must be running for more than
+// verificationQueueSize series to be added.
+type VerifyingIndex struct {
+	primary   CardinalityIndex
+	reference CardinalityIndex
+	fraction  float64
+	tolerance float64
+	logger    *slog.Logger
+	queue     chan referenceOp
+	// done is closed once Run returned, after which the reference is no
+	// longer written.
+	done chan struct{}
+
+	mtx         sync.Mutex
+	stats       VerificationStats
+	absErrorSum float64
+}
+
+// NewVerifyingIndex returns an index answering from primary and comparing
+// fraction of the answers to reference. Answers whose relative error exceeds
+// tolerance count as diverged.
+func NewVerifyingIndex(primary, reference CardinalityIndex, fraction, tolerance float64, logger *slog.Logger) *VerifyingIndex {
+	return &VerifyingIndex{
+		primary:   primary,
+		reference: reference,
+		fraction:  fraction,
+		tolerance: tolerance,
+		logger:    logger,
+		queue:     make(chan referenceOp, verificationQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (v *VerifyingIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	v.primary.AddSeries(lbls, ref)
+	// Callers may reuse the labels once AddSeries returned.
+	select {
+	case v.queue <- referenceOp{lbls: lbls.Copy(), ref: ref}:
+	case <-v.done:
+	}
+}
+
+func (v *VerifyingIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return v.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (v *VerifyingIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	series := GetCardinalityContext(ctx, v.primary, matchers...)
+	v.sample(matchers, series)
+	return series
+}
+
+// GetCardinalityChecked is like GetCardinalityContext but returns the
+// errors of the primary index. Failed queries aren't compared.
+func (v *VerifyingIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	series, err := GetCardinalityChecked(ctx, v.primary, matchers...)
+	if err == nil {
+		v.sample(matchers, series)
+	}
+	return series, err
+}
+
+// sample queues the answer to be compared with the given probability.
+func (v *VerifyingIndex) sample(matchers []*labels.Matcher, series int64) {
+	v.mtx.Lock()
+	v.stats.Queries++
+	v.mtx.Unlock()
+	if rand.Float64() >= v.fraction {
+		return
+	}
+
+	// Callers may reuse the matchers slice once the query returned.
+	select {
+	case v.queue <- referenceOp{sample: true, matchers: slices.Clone(matchers), primary: series}:
+	default:
+		v.mtx.Lock()
+		v.stats.Dropped++
+		v.mtx.Unlock()
+	}
+}
+
+// Run adds the series to the reference index and compares the sampled
+// answers to it until ctx is done. It must be called once.
+func (v *VerifyingIndex) Run(ctx context.Context) {
+	defer close(v.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-v.queue:
+			if !op.sample {
+				v.reference.AddSeries(op.lbls, op.ref)
+				continue
+			}
+			v.compare(ctx, op)
+		}
+	}
+}
+
+// compare records how a sampled answer compares to the reference answer.
+func (v *VerifyingIndex) compare(ctx context.Context, q referenceOp) {
+	reference := GetCardinalityContext(ctx, v.reference, q.matchers...)
+	absErr := RelativeError(q.primary, reference)
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.stats.Compared++
+	v.absErrorSum += absErr
+	v.stats.MaxAbsError = max(v.stats.MaxAbsError, absErr)
+	if absErr > v.tolerance {
+		v.stats.Diverged++
+		v.logger.Debug("Primary index diverged from the reference", "matchers", matcherStrings(q.matchers),
+			"primary", q.primary, "reference", reference, "error", absErr)
+	}
+}
+
+// RelativeError returns the absolute error of estimate relative to truth.
+// Any answer other than 0 is off by 100% when no series match.
+func RelativeError(estimate, truth int64) float64 {
+	if truth == 0 {
+		if estimate == 0 {
+			return 0
+		}
+		return 1
+	}
+	return math.Abs(float64(estimate-truth)) / float64(truth)
+}
+
+// Stats returns the comparison statistics.
+func (v *VerifyingIndex) Stats() VerificationStats {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	stats := v.stats
+	if stats.Compared > 0 {
+		stats.MeanAbsError = v.absErrorSum / float64(stats.Compared)
+	}
+	return stats
+}
+
+var (
+	verificationQueriesDesc = prometheus.NewDesc("cardinality_verification_queries_total",
+		"Queries answered by the primary index.", nil, nil)
+	verificationDroppedDesc = prometheus.NewDesc("cardinality_verification_dropped_total",
+		"Sampled queries dropped because the comparisons fell behind.", nil, nil)
+	verificationComparedDesc = prometheus.NewDesc("cardinality_verification_compared_total",
+		"Sampled queries compared to the reference index.", nil, nil)
+	verificationDivergedDesc = prometheus.NewDesc("cardinality_verification_diverged_total",
+		"Compared queries whose relative error exceeded the tolerance.", nil, nil)
+	verificationMeanErrorDesc = prometheus.NewDesc("cardinality_verification_mean_abs_relative_error",
+		"Mean absolute relative error of the compared queries.", nil, nil)
+	verificationMaxErrorDesc = prometheus.NewDesc("cardinality_verification_max_abs_relative_error",
+		"Largest absolute relative error of the compared queries.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (v *VerifyingIndex) Describe(ch chan<- *prometheus.Desc) {
+	ch <- verificationQueriesDesc
+	ch <- verificationDroppedDesc
+	ch <- verificationComparedDesc
+	ch <- verificationDivergedDesc
+	ch <- verificationMeanErrorDesc
+	ch <- verificationMaxErrorDesc
+}
+
+// Collect implements prometheus.Collector.
+func (v *VerifyingIndex) Collect(ch chan<- prometheus.Metric) {
+	stats := v.Stats()
+	ch <- prometheus.MustNewConstMetric(verificationQueriesDesc, prometheus.CounterValue, float64(stats.Queries))
+	ch <- prometheus.MustNewConstMetric(verificationDroppedDesc, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(verificationComparedDesc, prometheus.CounterValue, float64(stats.Compared))
+	ch <- prometheus.MustNewConstMetric(verificationDivergedDesc, prometheus.CounterValue, float64(stats.Diverged))
+	ch <- prometheus.MustNewConstMetric(verificationMeanErrorDesc, prometheus.GaugeValue, stats.MeanAbsError)
+	ch <- prometheus.MustNewConstMetric(verificationMaxErrorDesc, prometheus.GaugeValue, stats.MaxAbsError)
+}
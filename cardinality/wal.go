@@ -0,0 +1,168 @@
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
+	"log/slog"
+	"sync/atomic"
+)
+
+// walEvictMetric is the type of the records of EvictMetric calls. The
+// series records are the ones of the TSDB WAL.
+const walEvictMetric record.Type = 100
+
+// WALIndex wraps an index and logs its mutations to a write-ahead log
+// before applying them, in the segment format of the Prometheus TSDB WAL. A
+// sidecar restarted after a crash loads its last checkpoint and replays the
+// mutations logged since with OpenWAL, instead of rebuilding the index from
+// the TSDB.
+type WALIndex struct {
+	index  CardinalityIndex
+	wal    *wlog.WL
+	logger *slog.Logger
+	errors atomic.Int64
+}
+
+// OpenWAL opens the write-ahead log in dir, creating it if needed, and
+// replays the mutations it holds into index, which must hold the state of
+// the last Checkpoint. Records torn by a crash are dropped, along with
+// everything logged after them.
+func OpenWAL(dir string, index CardinalityIndex, logger *slog.Logger) (*WALIndex, error) {
+	wal, err := wlog.NewSize(logger, nil, dir, wlog.DefaultSegmentSize, wlog.CompressionSnappy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	w := &WALIndex{index: index, wal: wal, logger: logger}
+
+	replayed, err := w.replay()
+	var corruption *wlog.CorruptionErr
+	if errors.As(err, &corruption) {
+		logger.Warn("Repairing corrupted WAL", "err", err)
+		err = wal.Repair(err)
+	}
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to replay WAL: %w", err)
+	}
+	logger.Info("Replayed WAL", "records", replayed)
+	return w, nil
+}
+
+// replay applies the records of the log to the index and returns the number
+// of records applied.
+func (w *WALIndex) replay() (int, error) {
+	segments, err := wlog.NewSegmentsReader(w.wal.Dir())
+	if err != nil {
+		return 0, err
+	}
+	defer segments.Close()
+
+	r := wlog.NewReader(segments)
+	dec := record.NewDecoder(nil)
+	var series []record.RefSeries
+	replayed := 0
+	for r.Next() {
+		rec := r.Record()
+		switch dec.Type(rec) {
+		case record.Series:
+			if series, err = dec.Series(rec, series[:0]); err != nil {
+				return replayed, err
+			}
+			for _, s := range series {
+				w.index.AddSeries(s.Labels, storage.SeriesRef(s.Ref))
+			}
+		case record.Unknown:
+			if len(rec) == 0 {
+				return replayed, errors.New("empty WAL record")
+			}
+			if record.Type(rec[0]) != walEvictMetric {
+				return replayed, fmt.Errorf("unknown WAL record type %d", rec[0])
+			}
+			if e, ok := w.index.(MetricEvictionIndex); ok {
+				e.EvictMetric(string(rec[1:]))
+			}
+		default:
+			return replayed, fmt.Errorf("unexpected WAL record type %s", dec.Type(rec))
+		}
+		replayed++
+	}
+	return replayed, r.Err()
+}
+
+// log appends a record to the log. Failures are logged and counted in the
+// stats; the mutation is still applied.
+func (w *WALIndex) log(rec []byte) {
+	if err := w.wal.Log(rec); err != nil {
+		w.errors.Add(1)
+		w.logger.Error("Failed to log to the WAL", "err", err)
+	}
+}
+
+func (w *WALIndex) AddSeries(lbls labels.Labels, ref storage.SeriesRef) {
+	var enc record.Encoder
+	w.log(enc.Series([]record.RefSeries{{Ref: chunks.HeadSeriesRef(ref), Labels: lbls}}, nil))
+	w.index.AddSeries(lbls, ref)
+}
+
+// EvictMetric logs the eviction and evicts the metric from the index, if
+// the index supports it.
+func (w *WALIndex) EvictMetric(name string) int {
+	e, ok := w.index.(MetricEvictionIndex)
+	if !ok {
+		return 0
+	}
+	w.log(append([]byte{byte(walEvictMetric)}, name...))
+	return e.EvictMetric(name)
+}
+
+func (w *WALIndex) GetCardinality(matchers ...*labels.Matcher) int64 {
+	return w.GetCardinalityContext(context.Background(), matchers...)
+}
+
+func (w *WALIndex) GetCardinalityContext(ctx context.Context, matchers ...*labels.Matcher) int64 {
+	return GetCardinalityContext(ctx, w.index, matchers...)
+}
+
+func (w *WALIndex) GetCardinalityChecked(ctx context.Context, matchers ...*labels.Matcher) (int64, error) {
+	return GetCardinalityChecked(ctx, w.index, matchers...)
+}
+
+// Stats returns the stats of the wrapped index, if it reports them, with
+// the failed writes to the log added to its errors.
+func (w *WALIndex) Stats() IndexStats {
+	var stats IndexStats
+	if s, ok := w.index.(StatsIndex); ok {
+		stats = s.Stats()
+	}
+	stats.Errors += w.errors.Load()
+	return stats
+}
+
+// Checkpoint persists the index with save, e.g. with WriteIndexFile, and
+// drops the segments of the log it covers. Mutations logged while save runs
+// are kept and replayed after a crash even if save persisted them, so they
+// are applied exactly once only by indexes that deduplicate series.
+func (w *WALIndex) Checkpoint(save func() error) error {
+	segment, err := w.wal.NextSegmentSync()
+	if err != nil {
+		return fmt.Errorf("failed to cut WAL segment: %w", err)
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	if err := w.wal.Truncate(segment); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the log.
+func (w *WALIndex) Close() error {
+	return w.wal.Close()
+}
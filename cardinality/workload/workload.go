@@ -0,0 +1,345 @@
+// Package workload generates synthetic series from a YAML spec of metrics,
+// their labels and the distributions of the label values, and writes them to
+// TSDB blocks, so that benchmarks and accuracy tests can run against
+// realistic on-disk data rather than series held in memory.
+//
+// A spec looks like:
+//
+//	seed: 1
+//	duration: 6h
+//	block_duration: 2h
+//	scrape_interval: 1m
+//	metrics:
+//	  - name: http_requests_total
+//	    series: 10000
+//	    labels:
+//	      - name: method
+//	        values: [GET, POST, PUT, DELETE]
+//	      - name: pod
+//	        count: 1000
+//	        distribution: zipf
+//
+// A metric without a number of series has the cross product of the values
+// of its labels.
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"gopkg.in/yaml.v2"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Distribution is how the values of a label are drawn for the series of a
+// metric with a number of series.
+type Distribution string
+
+const (
+	// DistributionUniform draws every value with the same probability.
+	DistributionUniform Distribution = "uniform"
+	// DistributionZipf draws the first values far more often than the
+	// last ones, like the pods of a few large deployments or the users of a
+	// few heavy tenants.
+	DistributionZipf Distribution = "zipf"
+)
+
+// DefaultSkew is the exponent of zipf distributions without one.
+const DefaultSkew = 1.1
+
+// Spec describes the series to generate and the blocks to write them to.
+type Spec struct {
+	// Seed makes the generated series reproducible.
+	Seed int64 `yaml:"seed,omitempty"`
+	// MinTime is the time of the first sample, in milliseconds.
+	MinTime int64 `yaml:"min_time,omitempty"`
+	// Duration is the time covered by the samples, written to blocks of
+	// BlockDuration each.
+	Duration       model.Duration `yaml:"duration,omitempty"`
+	BlockDuration  model.Duration `yaml:"block_duration,omitempty"`
+	ScrapeInterval model.Duration `yaml:"scrape_interval,omitempty"`
+	Metrics        []MetricSpec   `yaml:"metrics"`
+}
+
+// DefaultSpec is the spec the fields of a loaded spec default to.
+var DefaultSpec = Spec{
+	Duration:       model.Duration(2 * time.Hour),
+	BlockDuration:  model.Duration(2 * time.Hour),
+	ScrapeInterval: model.Duration(time.Minute),
+}
+
+// MetricSpec describes the series of a metric.
+type MetricSpec struct {
+	Name string `yaml:"name"`
+	// Series is the number of series of the metric, drawn from the values
+	// of the labels. Zero means the cross product of the values. Fewer
+	// series are generated if the labels don't have enough combinations.
+	Series int         `yaml:"series,omitempty"`
+	Labels []LabelSpec `yaml:"labels,omitempty"`
+}
+
+// LabelSpec describes the values of a label.
+type LabelSpec struct {
+	Name string `yaml:"name"`
+	// Values are the values of the label. Without them, the label has
+	// Count values made of Prefix and a number, e.g. pod-0 to pod-999.
+	Values []string `yaml:"values,omitempty"`
+	Count  int      `yaml:"count,omitempty"`
+	// Prefix defaults to the name of the label followed by a dash.
+	Prefix       string       `yaml:"prefix,omitempty"`
+	Distribution Distribution `yaml:"distribution,omitempty"`
+	// Skew is the exponent of a zipf distribution, larger than 1. It
+	// defaults to DefaultSkew.
+	Skew float64 `yaml:"skew,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Spec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = DefaultSpec
+	type plain Spec
+	return unmarshal((*plain)(s))
+}
+
+// Validate checks the spec.
+func (s *Spec) Validate() error {
+	if s.Duration <= 0 || s.BlockDuration <= 0 || s.ScrapeInterval <= 0 {
+		return errors.New("duration, block_duration and scrape_interval must be positive")
+	}
+	if len(s.Metrics) == 0 {
+		return errors.New("no metrics")
+	}
+	for _, m := range s.Metrics {
+		if !model.IsValidMetricName(model.LabelValue(m.Name)) {
+			return fmt.Errorf("invalid metric name %q", m.Name)
+		}
+		if m.Series < 0 {
+			return fmt.Errorf("negative number of series of metric %s", m.Name)
+		}
+		names := map[string]bool{}
+		for _, l := range m.Labels {
+			if err := l.validate(); err != nil {
+				return fmt.Errorf("metric %s: %w", m.Name, err)
+			}
+			if names[l.Name] {
+				return fmt.Errorf("metric %s: duplicate label %s", m.Name, l.Name)
+			}
+			names[l.Name] = true
+		}
+	}
+	return nil
+}
+
+func (l LabelSpec) validate() error {
+	if !model.LabelName(l.Name).IsValid() || l.Name == labels.MetricName {
+		return fmt.Errorf("invalid label name %q", l.Name)
+	}
+	if len(l.Values) == 0 && l.Count <= 0 {
+		return fmt.Errorf("label %s has neither values nor a count", l.Name)
+	}
+	switch l.Distribution {
+	case "", DistributionUniform:
+	case DistributionZipf:
+		if l.Skew != 0 && l.Skew <= 1 {
+			return fmt.Errorf("skew of label %s must be larger than 1", l.Name)
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q of label %s", l.Distribution, l.Name)
+	}
+	return nil
+}
+
+// values returns the values of the label.
+func (l LabelSpec) values() []string {
+	if len(l.Values) > 0 {
+		return l.Values
+	}
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = l.Name + "-"
+	}
+	values := make([]string, l.Count)
+	for i := range values {
+		values[i] = prefix + strconv.Itoa(i)
+	}
+	return values
+}
+
+// Load parses a spec.
+func Load(b []byte) (*Spec, error) {
+	s := DefaultSpec
+	if err := yaml.UnmarshalStrict(b, &s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// LoadFile reads and parses the spec file at path.
+func LoadFile(path string) (*Spec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Load(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Series returns the series of the spec. The same spec always returns the
+// same series, in the same order.
+func (s *Spec) Series() []labels.Labels {
+	r := rand.New(rand.NewSource(s.Seed))
+	var series []labels.Labels
+	for _, m := range s.Metrics {
+		if m.Series == 0 {
+			series = appendCrossProduct(series, m)
+		} else {
+			series = appendDrawn(series, m, r)
+		}
+	}
+	return series
+}
+
+// appendCrossProduct appends a series per combination of the values of the
+// labels of the metric.
+func appendCrossProduct(series []labels.Labels, m MetricSpec) []labels.Labels {
+	values := make([][]string, len(m.Labels))
+	for i, l := range m.Labels {
+		values[i] = l.values()
+	}
+	b := labels.NewScratchBuilder(len(m.Labels) + 1)
+	idx := make([]int, len(m.Labels))
+	for {
+		b.Reset()
+		b.Add(labels.MetricName, m.Name)
+		for i, l := range m.Labels {
+			b.Add(l.Name, values[i][idx[i]])
+		}
+		b.Sort()
+		series = append(series, b.Labels())
+
+		// Advance the last label first, like nested loops.
+		i := len(idx) - 1
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < len(values[i]) {
+				break
+			}
+			idx[i] = 0
+		}
+		if i < 0 {
+			return series
+		}
+	}
+}
+
+// appendDrawn appends m.Series distinct series of the metric, the value of
+// every label drawn from its distribution.
+func appendDrawn(series []labels.Labels, m MetricSpec, r *rand.Rand) []labels.Labels {
+	values := make([][]string, len(m.Labels))
+	draw := make([]func() int, len(m.Labels))
+	for i, l := range m.Labels {
+		values[i] = l.values()
+		n := len(values[i])
+		if l.Distribution == DistributionZipf && n > 1 {
+			skew := l.Skew
+			if skew == 0 {
+				skew = DefaultSkew
+			}
+			zipf := rand.NewZipf(r, skew, 1, uint64(n-1))
+			draw[i] = func() int { return int(zipf.Uint64()) }
+		} else {
+			draw[i] = func() int { return r.Intn(n) }
+		}
+	}
+
+	seen := make(map[uint64]struct{}, m.Series)
+	b := labels.NewScratchBuilder(len(m.Labels) + 1)
+	// Give up on labels with fewer combinations than series once most
+	// draws are duplicates.
+	for attempts := 0; len(seen) < m.Series && attempts < 10*m.Series+1000; attempts++ {
+		b.Reset()
+		b.Add(labels.MetricName, m.Name)
+		for i, l := range m.Labels {
+			b.Add(l.Name, values[i][draw[i]()])
+		}
+		b.Sort()
+		lbls := b.Labels()
+		if _, ok := seen[lbls.Hash()]; ok {
+			continue
+		}
+		seen[lbls.Hash()] = struct{}{}
+		series = append(series, lbls)
+	}
+	return series
+}
+
+// WriteBlocks writes the series of the spec to blocks in dir, one per
+// BlockDuration of Duration, every series having a sample per
+// ScrapeInterval, and returns the IDs of the blocks.
+func WriteBlocks(ctx context.Context, s *Spec, dir string, logger *slog.Logger) ([]ulid.ULID, error) {
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	series := s.Series()
+	if len(series) == 0 {
+		return nil, errors.New("the spec has no series")
+	}
+	maxt := s.MinTime + time.Duration(s.Duration).Milliseconds()
+	blockSize := time.Duration(s.BlockDuration).Milliseconds()
+	var ids []ulid.ULID
+	for mint := s.MinTime; mint < maxt; mint += blockSize {
+		id, err := writeBlock(ctx, series, dir, mint, min(mint+blockSize, maxt), time.Duration(s.ScrapeInterval).Milliseconds(), blockSize, logger)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// writeBlock writes a block of the series with samples in [mint, maxt).
+func writeBlock(ctx context.Context, series []labels.Labels, dir string, mint, maxt, interval, blockSize int64, logger *slog.Logger) (ulid.ULID, error) {
+	w, err := tsdb.NewBlockWriter(logger, dir, blockSize)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	defer w.Close()
+
+	// The head only accepts samples close to the last ones, so all series
+	// are appended scrape by scrape.
+	refs := make([]storage.SeriesRef, len(series))
+	var v float64
+	for ts := mint; ts < maxt; ts += interval {
+		app := w.Appender(ctx)
+		for i, lbls := range series {
+			if refs[i], err = app.Append(refs[i], lbls, ts, v); err != nil {
+				app.Rollback()
+				return ulid.ULID{}, fmt.Errorf("failed to append series %s: %w", lbls, err)
+			}
+		}
+		if err := app.Commit(); err != nil {
+			return ulid.ULID{}, err
+		}
+		v++
+	}
+	id, err := w.Flush(ctx)
+	if err != nil {
+		return ulid.ULID{}, fmt.Errorf("failed to write block: %w", err)
+	}
+	return id, nil
+}
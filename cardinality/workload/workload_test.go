@@ -0,0 +1,110 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+const testSpec = `
+seed: 42
+min_time: 0
+duration: 4h
+block_duration: 2h
+scrape_interval: 5m
+metrics:
+  - name: up
+    labels:
+      - name: job
+        values: [api, db]
+      - name: pod
+        count: 3
+  - name: http_requests_total
+    series: 200
+    labels:
+      - name: method
+        values: [GET, POST]
+      - name: pod
+        count: 500
+        prefix: web-
+        distribution: zipf
+`
+
+func TestLoad(t *testing.T) {
+	spec, err := Load([]byte(testSpec))
+	require.NoError(t, err)
+	require.Equal(t, DefaultSpec.ScrapeInterval*5, spec.ScrapeInterval)
+	require.Len(t, spec.Metrics, 2)
+
+	for _, invalid := range []string{
+		`metrics: []`,
+		`metrics: [{name: "1up"}]`,
+		`metrics: [{name: up, labels: [{name: pod}]}]`,
+		`metrics: [{name: up, labels: [{name: pod, count: 2, distribution: normal}]}]`,
+		`metrics: [{name: up, labels: [{name: pod, count: 2, distribution: zipf, skew: 0.5}]}]`,
+		`metrics: [{name: up, labels: [{name: pod, count: 2}, {name: pod, count: 3}]}]`,
+		`metrics: [{name: up, series: 1, unknown: 2}]`,
+		`scrape_interval: 0s
+metrics: [{name: up}]`,
+	} {
+		_, err := Load([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	spec, err := Load([]byte(testSpec))
+	require.NoError(t, err)
+	series := spec.Series()
+	require.Equal(t, series, spec.Series(), "series are reproducible")
+
+	var up, requests int
+	pods := map[string]int{}
+	for _, s := range series {
+		switch s.Get(labels.MetricName) {
+		case "up":
+			up++
+		case "http_requests_total":
+			requests++
+			pods[s.Get("pod")]++
+		}
+	}
+	require.Equal(t, 6, up)
+	require.Equal(t, 200, requests)
+	// The first pods of the zipf distribution have series for most methods,
+	// when about 4 of the series would be on the first 10 pods if the pods
+	// were drawn uniformly.
+	var first int
+	for i := 0; i < 10; i++ {
+		first += pods[fmt.Sprintf("web-%d", i)]
+	}
+	require.Greater(t, first, 15)
+
+	// Labels with too few combinations for the series give up.
+	spec.Metrics = []MetricSpec{{Name: "up", Series: 100, Labels: []LabelSpec{{Name: "pod", Count: 5}}}}
+	require.Len(t, spec.Series(), 5)
+}
+
+func TestWriteBlocks(t *testing.T) {
+	spec, err := Load([]byte(testSpec))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	ids, err := WriteBlocks(context.Background(), spec, dir, nil)
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+
+	for i, id := range ids {
+		block, err := tsdb.OpenBlock(nil, filepath.Join(dir, id.String()), nil, nil)
+		require.NoError(t, err)
+		meta := block.Meta()
+		require.Equal(t, uint64(206), meta.Stats.NumSeries)
+		// 24 samples per series in every 2h block.
+		require.Equal(t, uint64(206*24), meta.Stats.NumSamples)
+		require.Equal(t, int64(i)*7200000, meta.MinTime)
+		require.NoError(t, block.Close())
+	}
+}
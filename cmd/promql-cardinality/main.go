@@ -0,0 +1,468 @@
+// Command promql-cardinality inspects the cardinality of Prometheus data.
+//
+// Usage:
+//
+//	promql-cardinality diff [flags] OLD NEW
+//	promql-cardinality replay [flags] QUERYLOG BLOCK
+//	promql-cardinality scrape [flags] FILE...
+//	promql-cardinality generate [flags] SPEC DIR
+//	promql-cardinality accuracy [flags] BLOCK
+//	promql-cardinality soak [flags]
+//
+// diff compares two block directories or snapshot files, e.g. yesterday's
+// and today's, and prints the metrics and labels whose cardinality changed
+// the most.
+//
+// replay estimates the selectors of the queries of a Prometheus query log
+// against an index of a block, and prints the distribution of the
+// estimates, the slowest selectors and the selectors whose estimates are the
+// furthest off the exact answers.
+//
+// scrape counts the series of scrapes saved in the Prometheus text or
+// OpenMetrics format, e.g. with curl, or read from standard input for "-",
+// to estimate the cardinality of an exporter before deploying it.
+//
+// generate writes TSDB blocks of synthetic series described by a workload
+// spec, see package workload, to a directory, e.g. to benchmark indexes
+// against realistic data.
+//
+// accuracy estimates matcher sets of every class, e.g. single equalities or
+// broad regular expressions, sampled from a block against an index of the
+// block, and prints the error percentiles of every class as markdown or
+// JSON.
+//
+// soak ingests series of pods replaced continuously into a BitmapIndex
+// evicting stale values while issuing random queries, for an hour by
+// default, and fails on the first answer off the series the index should
+// hold or once memory exceeds a ceiling, see package soak.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"harry671003/hello/cardinality"
+	"harry671003/hello/cardinality/soak"
+	"harry671003/hello/cardinality/workload"
+	"harry671003/hello/config"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: promql-cardinality <command> [flags] [args]
+
+Commands:
+  diff OLD NEW            compare the cardinality of two blocks or snapshots
+  replay QUERYLOG BLOCK   estimate the selectors of a query log against a block
+  scrape FILE...          count the series of saved scrapes of /metrics endpoints
+  generate SPEC DIR       write blocks of synthetic series described by a workload spec
+  accuracy BLOCK          report the estimation errors of an index per matcher class
+  soak                    check an index under hours of ingestion with churn and queries
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errors.New("no command given")
+	}
+	switch args[0] {
+	case "diff":
+		return runDiff(args[1:], stdout, stderr)
+	case "replay":
+		return runReplay(args[1:], stdout, stderr)
+	case "scrape":
+		return runScrape(args[1:], os.Stdin, stdout, stderr)
+	case "generate":
+		return runGenerate(args[1:], stdout, stderr)
+	case "accuracy":
+		return runAccuracy(args[1:], stdout, stderr)
+	case "soak":
+		return runSoak(args[1:], stdout, stderr)
+	}
+	fmt.Fprint(stderr, usage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runDiff(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality diff [flags] OLD NEW")
+		fmt.Fprintln(stderr, "\nOLD and NEW are TSDB block directories or snapshot files.")
+		fs.PrintDefaults()
+	}
+	minChange := fs.Int64("min-change", 0, "only report changes larger than this")
+	limit := fs.Int("limit", 20, "maximum number of metrics and labels to print, 0 for all")
+	threshold := fs.Int64("threshold", 1000, "flag metrics and labels that grew past this many series or values")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("diff needs exactly two arguments")
+	}
+
+	old, err := loadSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	current, err := loadSnapshot(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tOLD SERIES\tNEW SERIES\tCHANGE\t")
+	printed := 0
+	for _, c := range cardinality.Diff(old, current, *minChange) {
+		if c.Name != labels.MetricName {
+			continue
+		}
+		if *limit > 0 && printed == *limit {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%+d\t%s\n", c.Value, c.Old, c.New, c.Delta(), note(c.Old, c.New, *threshold))
+		printed++
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "LABEL\tOLD VALUES\tNEW VALUES\tCHANGE\t")
+	for i, c := range cardinality.DiffLabels(old, current, *minChange) {
+		if *limit > 0 && i == *limit {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%+d\t%s\n", c.Name, c.OldValues, c.NewValues, c.Delta(), note(c.OldValues, c.NewValues, *threshold))
+	}
+	return w.Flush()
+}
+
+func runReplay(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality replay [flags] QUERYLOG BLOCK")
+		fmt.Fprintln(stderr, "\nQUERYLOG is a Prometheus query log and BLOCK a TSDB block directory.")
+		fs.PrintDefaults()
+	}
+	indexType := fs.String("index", string(config.IndexTypeHyperMinHash), "type of the index to replay against: bitmap, hyperminhash or exact_hash")
+	limit := fs.Int("limit", 20, "maximum number of selectors to print per ranking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("replay needs exactly two arguments")
+	}
+
+	cfg := config.DefaultIndexConfig
+	cfg.Type = config.IndexType(*indexType)
+	index, err := cfg.NewIndex()
+	if err != nil {
+		return err
+	}
+	block, err := tsdb.OpenBlock(nil, fs.Arg(1), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open block %s: %w", fs.Arg(1), err)
+	}
+	defer block.Close()
+	exact := cardinality.NewBitmapIndex()
+	for _, idx := range []cardinality.CardinalityIndex{index, exact} {
+		if err := cardinality.BuildFromBlock(context.Background(), block, idx); err != nil {
+			return fmt.Errorf("failed to index block %s: %w", fs.Arg(1), err)
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := cardinality.ReplayQueryLog(context.Background(), f, index, exact, *limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%d queries, %d skipped lines, %d distinct selectors\n", report.Queries, report.Skipped, report.Selectors)
+	fmt.Fprintf(w, "mean error %.2f%%, max error %.2f%%\n\n", report.MeanAbsError*100, report.MaxAbsError*100)
+
+	fmt.Fprintln(w, "ESTIMATE\tSELECTORS\t")
+	for _, b := range report.Distribution {
+		fmt.Fprintf(w, "<= %d\t%d\t\n", b.UpperBound, b.Selectors)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "SELECTOR\tQUERIES\tESTIMATE\tDURATION\t")
+	for _, s := range report.Slowest {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n", s.Selector, s.Queries, s.Estimate, s.Duration)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "SELECTOR\tQUERIES\tESTIMATE\tACTUAL\tERROR\t")
+	for _, s := range report.Worst {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2f%%\t\n", s.Selector, s.Queries, s.Estimate, s.Actual, s.Error*100)
+	}
+	return w.Flush()
+}
+
+func runScrape(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality scrape [flags] FILE...")
+		fmt.Fprintln(stderr, "\nFILEs are scrapes in the Prometheus text or OpenMetrics format, - for standard input.")
+		fs.PrintDefaults()
+	}
+	limit := fs.Int("limit", 20, "maximum number of metrics to print, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("scrape needs at least one file")
+	}
+
+	index := cardinality.NewBitmapIndex()
+	ingester := cardinality.NewIngester(index, nil)
+	for _, path := range fs.Args() {
+		r := stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := ingester.IngestExposition(r, ""); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%d series\n\n", ingester.Stats().Series)
+	fmt.Fprintln(w, "METRIC\tSERIES\t")
+	n := *limit
+	if n == 0 {
+		n = math.MaxInt
+	}
+	for _, v := range index.TopLabelValues(labels.MetricName, n) {
+		fmt.Fprintf(w, "%s\t%d\t\n", v.Value, v.Series)
+	}
+	return w.Flush()
+}
+
+func runGenerate(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality generate [flags] SPEC DIR")
+		fmt.Fprintln(stderr, "\nSPEC is a YAML workload spec and DIR the directory to write the blocks to.")
+		fs.PrintDefaults()
+	}
+	seed := fs.Int64("seed", 0, "seed of the generated series, overriding the seed of the spec if set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("generate needs exactly two arguments")
+	}
+
+	spec, err := workload.LoadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *seed != 0 {
+		spec.Seed = *seed
+	}
+	if err := os.MkdirAll(fs.Arg(1), 0o777); err != nil {
+		return err
+	}
+	ids, err := workload.WriteBlocks(context.Background(), spec, fs.Arg(1), nil)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCK\tMIN TIME\tMAX TIME\tSERIES\t")
+	for _, id := range ids {
+		block, err := tsdb.OpenBlock(nil, filepath.Join(fs.Arg(1), id.String()), nil, nil)
+		if err != nil {
+			return err
+		}
+		meta := block.Meta()
+		block.Close()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t\n", id, time.UnixMilli(meta.MinTime).UTC().Format(time.RFC3339), time.UnixMilli(meta.MaxTime).UTC().Format(time.RFC3339), meta.Stats.NumSeries)
+	}
+	return w.Flush()
+}
+
+func runAccuracy(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("accuracy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality accuracy [flags] BLOCK")
+		fmt.Fprintln(stderr, "\nBLOCK is a TSDB block directory.")
+		fs.PrintDefaults()
+	}
+	indexType := fs.String("index", string(config.IndexTypeHyperMinHash), "type of the index to evaluate: bitmap, hyperminhash or exact_hash")
+	queries := fs.Int("queries", 100, "number of matcher sets sampled per class")
+	seed := fs.Uint64("seed", 1, "seed of the sampled matcher sets")
+	format := fs.String("format", "markdown", "output format: markdown or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("accuracy needs exactly one argument")
+	}
+	if *format != "markdown" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	cfg := config.DefaultIndexConfig
+	cfg.Type = config.IndexType(*indexType)
+	index, err := cfg.NewIndex()
+	if err != nil {
+		return err
+	}
+	block, err := tsdb.OpenBlock(nil, fs.Arg(0), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open block %s: %w", fs.Arg(0), err)
+	}
+	defer block.Close()
+	exact := cardinality.NewBitmapIndex()
+	for _, idx := range []cardinality.CardinalityIndex{index, exact} {
+		if err := cardinality.BuildFromBlock(context.Background(), block, idx); err != nil {
+			return fmt.Errorf("failed to index block %s: %w", fs.Arg(0), err)
+		}
+	}
+
+	report, err := cardinality.EvaluateAccuracy(context.Background(), index, exact, cardinality.AccuracyQueries(exact, *queries, *seed))
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.WriteMarkdown(stdout)
+}
+
+func runSoak(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: promql-cardinality soak [flags]")
+		fs.PrintDefaults()
+	}
+	cfg := soak.DefaultConfig
+	fs.DurationVar(&cfg.Duration, "duration", cfg.Duration, "length of the run, 0 to run until interrupted")
+	fs.DurationVar(&cfg.Interval, "interval", cfg.Interval, "time between scrapes of the pods")
+	fs.DurationVar(&cfg.TTL, "ttl", cfg.TTL, "time after which the index evicts values that weren't scraped")
+	fs.IntVar(&cfg.Pods, "pods", cfg.Pods, "number of live pods")
+	fs.IntVar(&cfg.SeriesPerPod, "series-per-pod", cfg.SeriesPerPod, "number of series of a pod")
+	fs.IntVar(&cfg.Jobs, "jobs", cfg.Jobs, "number of jobs of the pods")
+	fs.Float64Var(&cfg.Churn, "churn", cfg.Churn, "fraction of the pods replaced every interval")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of goroutines issuing queries")
+	fs.Int64Var(&cfg.MaxHeapBytes, "max-heap-bytes", 0, "fail once the live heap exceeds this many bytes, 0 for no limit")
+	fs.Int64Var(&cfg.MaxIndexBytes, "max-index-bytes", 0, "fail once the index takes more than this many bytes, 0 for no limit")
+	fs.Uint64Var(&cfg.Seed, "seed", cfg.Seed, "seed of the churn and the queries")
+	fs.DurationVar(&cfg.ProgressInterval, "progress-interval", cfg.ProgressInterval, "time between progress logs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("soak takes no arguments")
+	}
+	cfg.Logger = promslog.New(&promslog.Config{Writer: stderr})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, runErr := soak.Run(ctx, cardinality.NewBitmapIndex(cardinality.WithValueTTL(cfg.TTL)), cfg)
+	if report == nil {
+		return runErr
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ELAPSED\t%s\t\n", report.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "INTERVALS\t%d\t\n", report.Intervals)
+	fmt.Fprintf(w, "PODS ADDED\t%d\t\n", report.PodsAdded)
+	fmt.Fprintf(w, "PODS REMOVED\t%d\t\n", report.PodsRemoved)
+	fmt.Fprintf(w, "PODS EVICTED\t%d\t\n", report.PodsEvicted)
+	fmt.Fprintf(w, "QUERIES\t%d\t\n", report.Queries)
+	fmt.Fprintf(w, "MAX ERROR\t%.2f%%\t\n", report.MaxError*100)
+	fmt.Fprintf(w, "PEAK HEAP BYTES\t%d\t\n", report.PeakHeapBytes)
+	fmt.Fprintf(w, "PEAK INDEX BYTES\t%d\t\n", report.PeakIndexBytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return runErr
+}
+
+// note highlights new metrics and labels, and the ones that crossed the
+// high-cardinality threshold.
+func note(old, new, threshold int64) string {
+	switch {
+	case new >= threshold && old < threshold:
+		return "HIGH CARDINALITY"
+	case old == 0 && new > 0:
+		return "new"
+	case new == 0 && old > 0:
+		return "gone"
+	}
+	return ""
+}
+
+// loadSnapshot reads a snapshot file, or takes a snapshot of a block
+// directory at the end time of the block.
+func loadSnapshot(path string) (*cardinality.Snapshot, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s, err := cardinality.ReadSnapshot(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+		}
+		return s, nil
+	}
+
+	block, err := tsdb.OpenBlock(nil, path, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block %s: %w", path, err)
+	}
+	defer block.Close()
+
+	index := cardinality.NewBitmapIndex()
+	if err := cardinality.BuildFromBlock(context.Background(), block, index); err != nil {
+		return nil, fmt.Errorf("failed to index block %s: %w", path, err)
+	}
+	return cardinality.TakeSnapshot(index, time.UnixMilli(block.Meta().MaxTime))
+}
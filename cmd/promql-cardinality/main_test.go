@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+	"harry671003/hello/cardinality"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+
+	// Yesterday's block has 10 up series.
+	var series []storage.Series
+	for pod := 0; pod < 10; pod++ {
+		series = append(series, storage.NewListSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), chunks.GenerateSamples(0, 1)))
+	}
+	blockDir, err := tsdb.CreateBlock(series, dir, 0, promslog.NewNopLogger())
+	require.NoError(t, err)
+
+	// Today's snapshot adds a request id label to a new metric.
+	index := cardinality.NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		ref++
+		index.AddSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), ref)
+	}
+	for id := 0; id < 50; id++ {
+		ref++
+		index.AddSeries(labels.FromStrings("__name__", "requests_total", "pod", "pod-0", "request_id", fmt.Sprint(id)), ref)
+	}
+	snapshot, err := cardinality.TakeSnapshot(index, time.Now())
+	require.NoError(t, err)
+	snapshotPath := filepath.Join(dir, "today.json")
+	f, err := os.Create(snapshotPath)
+	require.NoError(t, err)
+	_, err = snapshot.WriteTo(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run([]string{"diff", "-threshold", "40", blockDir, snapshotPath}, &stdout, &stderr))
+	lines := strings.Split(stdout.String(), "\n")
+	require.Equal(t, []string{
+		"METRIC          OLD SERIES  NEW SERIES  CHANGE  ",
+		"requests_total  0           50          +50     HIGH CARDINALITY",
+		"",
+		"LABEL       OLD VALUES  NEW VALUES  CHANGE  ",
+		"request_id  0           50          +50     HIGH CARDINALITY",
+		"__name__    1           2           +1      ",
+		"",
+	}, lines)
+
+	require.Error(t, run([]string{"diff", blockDir}, &stdout, &stderr))
+	require.Error(t, run([]string{"unknown"}, &stdout, &stderr))
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	var series []storage.Series
+	for pod := 0; pod < 10; pod++ {
+		series = append(series, storage.NewListSeries(labels.FromStrings("__name__", "up", "pod", fmt.Sprintf("pod-%d", pod)), chunks.GenerateSamples(0, 1)))
+	}
+	blockDir, err := tsdb.CreateBlock(series, dir, 0, promslog.NewNopLogger())
+	require.NoError(t, err)
+
+	logPath := filepath.Join(dir, "queries.log")
+	require.NoError(t, os.WriteFile(logPath, []byte(`{"params":{"query":"sum(up)"}}
+{"params":{"query":"up{pod=\"pod-1\"}"}}
+`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run([]string{"replay", "-index", "bitmap", logPath, blockDir}, &stdout, &stderr))
+	lines := strings.Split(stdout.String(), "\n")
+	require.Equal(t, []string{
+		"2 queries, 0 skipped lines, 2 distinct selectors",
+		"mean error 0.00%, max error 0.00%",
+		"",
+		"ESTIMATE  SELECTORS  ",
+		"<= 0      0          ",
+		"<= 1      1          ",
+		"<= 10     1          ",
+		"",
+	}, lines[:8])
+
+	require.Error(t, run([]string{"replay", "-index", "unknown", logPath, blockDir}, &stdout, &stderr))
+	require.Error(t, run([]string{"replay", logPath}, &stdout, &stderr))
+}
+
+func TestScrape(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	require.NoError(t, os.WriteFile(path, []byte(`# TYPE http_requests_total counter
+http_requests_total{code="200"} 10
+http_requests_total{code="500"} 1
+up 1
+`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, runScrape([]string{path, "-"}, strings.NewReader("go_goroutines 12\n"), &stdout, &stderr))
+	require.Equal(t, `4 series
+
+METRIC               SERIES  
+http_requests_total  2       
+go_goroutines        1       
+up                   1       
+`, stdout.String())
+
+	require.Error(t, run([]string{"scrape"}, &stdout, &stderr))
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "spec.yaml")
+	require.NoError(t, os.WriteFile(specPath, []byte(`duration: 4h
+metrics:
+  - name: up
+    labels:
+      - name: pod
+        count: 10
+`), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	blocksDir := filepath.Join(dir, "blocks")
+	require.NoError(t, run([]string{"generate", specPath, blocksDir}, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Contains(t, lines[1], "1970-01-01T00:00:00Z  1970-01-01T01:59:00Z  10")
+	require.Contains(t, lines[2], "1970-01-01T02:00:00Z  1970-01-01T03:59:00Z  10")
+
+	// The blocks can be diffed like any other.
+	entries, err := os.ReadDir(blocksDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	stdout.Reset()
+	require.NoError(t, run([]string{"diff", filepath.Join(blocksDir, entries[0].Name()), filepath.Join(blocksDir, entries[1].Name())}, &stdout, &stderr))
+
+	require.Error(t, run([]string{"generate", specPath}, &stdout, &stderr))
+}
+
+func TestAccuracy(t *testing.T) {
+	var series []storage.Series
+	for pod := 0; pod < 100; pod++ {
+		lbls := labels.FromStrings("__name__", fmt.Sprintf("metric_%d", pod%4), "job", fmt.Sprintf("job-%d", pod%3), "pod", fmt.Sprintf("pod-%d", pod))
+		series = append(series, storage.NewListSeries(lbls, chunks.GenerateSamples(0, 1)))
+	}
+	blockDir, err := tsdb.CreateBlock(series, t.TempDir(), 0, promslog.NewNopLogger())
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run([]string{"accuracy", "-index", "bitmap", "-queries", "5", blockDir}, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, 9)
+	require.Equal(t, "| Class | Queries | Mean | p50 | p90 | p99 | Max | Worst |", lines[0])
+	// The bitmap index is exact.
+	require.True(t, strings.HasPrefix(lines[2], "| single-eq | 5 | 0.00% | 0.00% | 0.00% | 0.00% | 0.00% | "), lines[2])
+
+	stdout.Reset()
+	require.NoError(t, run([]string{"accuracy", "-format", "json", "-queries", "5", blockDir}, &stdout, &stderr))
+	var report cardinality.AccuracyReport
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Equal(t, 35, report.Queries)
+
+	require.Error(t, run([]string{"accuracy", "-format", "csv", blockDir}, &stdout, &stderr))
+}
+
+func TestSoak(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, run([]string{"soak", "-duration", "300ms", "-interval", "10ms", "-ttl", "100ms", "-pods", "20", "-series-per-pod", "5", "-churn", "0.1"}, &stdout, &stderr))
+	require.Regexp(t, `MAX ERROR +0.00%`, stdout.String())
+
+	require.ErrorContains(t, run([]string{"soak", "-interval", "1s", "-ttl", "1s"}, &stdout, &stderr), "twice the interval")
+	require.ErrorContains(t, run([]string{"soak", "-duration", "300ms", "-interval", "10ms", "-ttl", "100ms", "-max-index-bytes", "1"}, &stdout, &stderr), "index memory")
+}
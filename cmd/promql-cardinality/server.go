@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"harry671003/hello/api"
+	"harry671003/hello/config"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// newGRPCServer listens on the gRPC listen address of the configuration and
+// returns the gRPC server to serve on the listener. The server reports
+// itself as serving to health checks until it is stopped, and traces the
+// calls it serves. newGRPCServer returns a nil server and listener if the
+// gRPC server is disabled.
+func newGRPCServer(cfg config.ServerConfig) (*grpc.Server, net.Listener, error) {
+	if cfg.GRPCListenAddress == "" {
+		return nil, nil, nil
+	}
+	l, err := net.Listen("tcp", cfg.GRPCListenAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on gRPC address %s: %w", cfg.GRPCListenAddress, err)
+	}
+	s := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	return s, l, nil
+}
+
+// authMiddleware returns the authentication middleware of the configuration.
+func authMiddleware(cfg config.AuthConfig) func(http.Handler) http.Handler {
+	auth := api.AuthConfig{
+		BasicAuth:    make(map[string]string, len(cfg.BasicAuthUsers)),
+		BearerTokens: make(map[string]string, len(cfg.BearerTokens)),
+	}
+	for user, password := range cfg.BasicAuthUsers {
+		auth.BasicAuth[user] = string(password)
+	}
+	for client, token := range cfg.BearerTokens {
+		auth.BearerTokens[client] = string(token)
+	}
+	return api.NewAuthMiddleware(auth)
+}
+
+// rateLimitMiddleware returns the rate limit middleware of the
+// configuration, which must run after the authentication middleware to tell
+// clients apart.
+func rateLimitMiddleware(cfg config.RateLimitConfig, logger *slog.Logger) func(http.Handler) http.Handler {
+	limits := api.RateLimitConfig{
+		Default: api.RateLimit{Rate: cfg.RequestsPerSecond, Burst: cfg.Burst},
+		Clients: make(map[string]api.RateLimit, len(cfg.Clients)),
+		Logger:  logger,
+	}
+	for client, limit := range cfg.Clients {
+		limits.Clients[client] = api.RateLimit{Rate: limit.RequestsPerSecond, Burst: limit.Burst}
+	}
+	return api.NewRateLimitMiddleware(limits)
+}
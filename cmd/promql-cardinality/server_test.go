@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"harry671003/hello/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGRPCServer(t *testing.T) {
+	s, l, err := newGRPCServer(config.ServerConfig{})
+	require.NoError(t, err)
+	require.Nil(t, s)
+	require.Nil(t, l)
+
+	s, l, err = newGRPCServer(config.ServerConfig{GRPCListenAddress: "127.0.0.1:0"})
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestServerAuth(t *testing.T) {
+	cfg, err := config.Load([]byte(`
+server:
+  auth:
+    basic_auth_users: {alice: hunter2}
+    bearer_tokens: {team-a: token-a}
+  rate_limit:
+    requests_per_second: 1
+    clients:
+      team-a: {requests_per_second: 100, burst: 10}
+`))
+	require.NoError(t, err)
+
+	handler := authMiddleware(cfg.Server.Auth)(rateLimitMiddleware(cfg.Server.RateLimit, nil)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	codes := func(setup func(r *http.Request), n int) []int {
+		var codes []int
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			setup(req)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			codes = append(codes, rec.Code)
+		}
+		return codes
+	}
+	require.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes(func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, 2))
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, codes(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-a") }, 2))
+	require.Equal(t, []int{http.StatusUnauthorized}, codes(func(*http.Request) {}, 1))
+}
@@ -0,0 +1,568 @@
+package config
+
+import (
+	"fmt"
+	"github.com/alecthomas/units"
+	promconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+	"harry671003/hello/cardinality"
+	"harry671003/hello/cardinality/sketchcore"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IndexType selects the CardinalityIndex implementation to build.
+type IndexType string
+
+const (
+	IndexTypeBitmap       IndexType = "bitmap"
+	IndexTypeHyperMinHash IndexType = "hyperminhash"
+	IndexTypeExactHash    IndexType = "exact_hash"
+)
+
+// DefaultPrecision is the number of register bits of the hyperminhash
+// sketches, see sketchcore.Precision.
+const DefaultPrecision = sketchcore.Precision
+
+var (
+	// DefaultIndexConfig is the default index configuration.
+	DefaultIndexConfig = IndexConfig{
+		Type:          IndexTypeBitmap,
+		Precision:     DefaultPrecision,
+		Deduplication: true,
+	}
+
+	// DefaultServerConfig is the default server configuration.
+	DefaultServerConfig = ServerConfig{
+		HTTPListenAddress: ":8080",
+		GRPCListenAddress: ":9095",
+	}
+
+	// DefaultRetentionConfig is the default retention configuration.
+	DefaultRetentionConfig = RetentionConfig{
+		Series:    model.Duration(24 * time.Hour),
+		Snapshots: model.Duration(7 * 24 * time.Hour),
+	}
+)
+
+// Config is the top-level configuration file.
+type Config struct {
+	Index IndexConfig `yaml:"index"`
+	// MemoryBudget bounds the scratch memory of every query, see
+	// NewQueryContext. Zero disables the budget.
+	MemoryBudget units.Base2Bytes `yaml:"memory_budget,omitempty"`
+	Server       ServerConfig     `yaml:"server"`
+	Retention    RetentionConfig  `yaml:"retention"`
+	Tenants      []TenantConfig   `yaml:"tenants,omitempty"`
+	Tenancy      TenancyConfig    `yaml:"tenancy,omitempty"`
+	// Schemas declare the labels expected on the series of metrics, see
+	// cardinality.SchemaRegistry.
+	Schemas []MetricSchemaConfig `yaml:"schemas,omitempty"`
+	// Snapshots configures the snapshot history of the index, see
+	// cardinality.SnapshotStore.
+	Snapshots SnapshotsConfig `yaml:"snapshots,omitempty"`
+	// Monitor configures alerts on the cardinality of selectors, see
+	// cardinality.Monitor.
+	Monitor MonitorConfig `yaml:"monitor,omitempty"`
+}
+
+// IndexConfig configures a single cardinality index.
+type IndexConfig struct {
+	Type IndexType `yaml:"type"`
+	// Precision is the number of register bits of the sketches of
+	// hyperminhash indexes. Sketches only support DefaultPrecision, which
+	// other index types ignore.
+	Precision     int  `yaml:"precision,omitempty"`
+	Deduplication bool `yaml:"deduplication"`
+	// Labels with more than ValueBucketThreshold values are hashed into
+	// ValueBuckets buckets. A zero threshold disables bucketing.
+	ValueBucketThreshold int `yaml:"value_bucket_threshold,omitempty"`
+	ValueBuckets         int `yaml:"value_buckets,omitempty"`
+	// TargetError is the relative error hyperminhash indexes aim for. Label
+	// values are kept exact until a sketch meeting it is smaller, see
+	// cardinality.WithAccuracyTarget. Zero sketches every value.
+	TargetError float64 `yaml:"target_error,omitempty"`
+	// RelabelConfigs are applied to the labels of series before they are
+	// indexed, e.g. to drop noisy labels, see
+	// cardinality.WithRelabelConfigs. They don't apply to exact_hash
+	// indexes.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// ValueGuard flags the label values that look unbounded as series are
+	// indexed. It doesn't apply to exact_hash indexes.
+	ValueGuard ValueGuardConfig `yaml:"value_guard,omitempty"`
+}
+
+// ValueGuardConfig configures the ingest guard of an index, see
+// cardinality.ValueGuard.
+type ValueGuardConfig struct {
+	MaxLength  int     `yaml:"max_length,omitempty"`
+	MinEntropy float64 `yaml:"min_entropy,omitempty"`
+	Buckets    int     `yaml:"buckets,omitempty"`
+}
+
+// Guard returns the guard of the configuration.
+func (c ValueGuardConfig) Guard() cardinality.ValueGuard {
+	return cardinality.ValueGuard{
+		MaxLength:  c.MaxLength,
+		MinEntropy: c.MinEntropy,
+		Buckets:    c.Buckets,
+	}
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *IndexConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultIndexConfig
+	type plain IndexConfig
+	return unmarshal((*plain)(c))
+}
+
+// Validate checks the index configuration for consistency.
+func (c *IndexConfig) Validate() error {
+	switch c.Type {
+	case IndexTypeBitmap, IndexTypeHyperMinHash, IndexTypeExactHash:
+	default:
+		return fmt.Errorf("unknown index type %q", c.Type)
+	}
+	if c.Type == IndexTypeHyperMinHash && c.Precision != sketchcore.Precision {
+		return fmt.Errorf("unsupported precision %d: hyperminhash sketches use a fixed precision of %d", c.Precision, sketchcore.Precision)
+	}
+	if c.ValueBucketThreshold < 0 {
+		return fmt.Errorf("negative value_bucket_threshold %d", c.ValueBucketThreshold)
+	}
+	if c.ValueBucketThreshold > 0 && c.ValueBuckets <= 0 {
+		return fmt.Errorf("value_buckets must be positive when value_bucket_threshold is set")
+	}
+	if c.TargetError < 0 || c.TargetError >= 1 {
+		return fmt.Errorf("target_error %g must be between 0 and 1", c.TargetError)
+	}
+	for _, rule := range c.RelabelConfigs {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("relabel_configs: %w", err)
+		}
+	}
+	if c.ValueGuard.MaxLength < 0 || c.ValueGuard.MinEntropy < 0 || c.ValueGuard.Buckets < 0 {
+		return fmt.Errorf("value_guard: negative threshold or buckets")
+	}
+	return nil
+}
+
+// NewIndex builds an empty index as described by the configuration.
+func (c *IndexConfig) NewIndex() (cardinality.CardinalityIndex, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c.newIndex(), nil
+}
+
+// newIndex builds an index from a validated configuration, with the given
+// options applied first.
+func (c *IndexConfig) newIndex(opts ...cardinality.Option) cardinality.CardinalityIndex {
+	opts = slices.Clone(opts)
+	if !c.Deduplication {
+		opts = append(opts, cardinality.WithoutDeduplication())
+	}
+	if c.ValueBucketThreshold > 0 {
+		opts = append(opts, cardinality.WithValueBuckets(c.ValueBucketThreshold, c.ValueBuckets))
+	}
+	if c.TargetError > 0 {
+		opts = append(opts, cardinality.WithAccuracyTarget(c.TargetError))
+	}
+	if len(c.RelabelConfigs) > 0 {
+		opts = append(opts, cardinality.WithRelabelConfigs(c.RelabelConfigs...))
+	}
+	if c.ValueGuard != (ValueGuardConfig{}) {
+		opts = append(opts, cardinality.WithValueGuard(c.ValueGuard.Guard()))
+	}
+
+	switch c.Type {
+	case IndexTypeHyperMinHash:
+		return cardinality.NewHyperMinHashIndex(opts...)
+	case IndexTypeExactHash:
+		return cardinality.NewExactHashIndex()
+	default:
+		return cardinality.NewBitmapIndex(opts...)
+	}
+}
+
+// ServerConfig configures the listen addresses of the API servers, and who
+// may use the HTTP API.
+type ServerConfig struct {
+	HTTPListenAddress string `yaml:"http_listen_address"`
+	// GRPCListenAddress is the address of the gRPC server, which serves the
+	// gRPC health checking protocol, e.g. for the gRPC probes of
+	// Kubernetes. An empty address disables the gRPC server.
+	GRPCListenAddress string          `yaml:"grpc_listen_address"`
+	Auth              AuthConfig      `yaml:"auth,omitempty"`
+	RateLimit         RateLimitConfig `yaml:"rate_limit,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultServerConfig
+	type plain ServerConfig
+	return unmarshal((*plain)(c))
+}
+
+// AuthConfig configures the credentials of the clients of the HTTP API. No
+// authentication is required if none are configured.
+type AuthConfig struct {
+	// BasicAuthUsers maps user names to their password.
+	BasicAuthUsers map[string]promconfig.Secret `yaml:"basic_auth_users,omitempty"`
+	// BearerTokens maps the names of clients to their token.
+	BearerTokens map[string]promconfig.Secret `yaml:"bearer_tokens,omitempty"`
+}
+
+// RateLimit is the number of requests per second a client may make on
+// average, and at once.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst,omitempty"`
+}
+
+// RateLimitConfig configures the rate limits of the clients of the HTTP API.
+// Zero requests per second disables the limit.
+type RateLimitConfig struct {
+	RateLimit `yaml:",inline"`
+	// Clients overrides the limit of authenticated clients by name.
+	Clients map[string]RateLimit `yaml:"clients,omitempty"`
+}
+
+// RetentionConfig configures how long indexed data is kept.
+type RetentionConfig struct {
+	// Series is how long the label values of a series stay in bitmap
+	// indexes after they were last added, see cardinality.WithValueTTL.
+	Series model.Duration `yaml:"series"`
+	// Snapshots is how long persisted index snapshots are kept.
+	Snapshots model.Duration `yaml:"snapshots"`
+}
+
+// SnapshotsConfig configures the periodic snapshots of the index, kept for
+// the snapshots retention. Snapshots are disabled if Dir is empty.
+type SnapshotsConfig struct {
+	// Dir is the directory the snapshots are kept in, e.g. a mounted
+	// volume. CacheDir is where they are written before being moved there,
+	// and defaults to a subdirectory of Dir.
+	Dir      string         `yaml:"dir,omitempty"`
+	CacheDir string         `yaml:"cache_dir,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+// NewSnapshotStore returns the store of the configured snapshots, or nil if
+// they are disabled.
+func (c *Config) NewSnapshotStore() (*cardinality.SnapshotStore, error) {
+	if c.Snapshots.Dir == "" {
+		return nil, nil
+	}
+	cacheDir := c.Snapshots.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(c.Snapshots.Dir, "cache")
+	}
+	return cardinality.NewSnapshotStore(cardinality.DirBucket(c.Snapshots.Dir), cacheDir, time.Duration(c.Retention.Snapshots))
+}
+
+// MonitorConfig configures the rules of a cardinality.Monitor, evaluated
+// every interval, and the webhooks their alerts are posted to.
+type MonitorConfig struct {
+	Interval    model.Duration      `yaml:"interval,omitempty"`
+	ResendDelay model.Duration      `yaml:"resend_delay,omitempty"`
+	Webhooks    []WebhookConfig     `yaml:"webhooks,omitempty"`
+	Rules       []MonitorRuleConfig `yaml:"rules,omitempty"`
+}
+
+// WebhookConfig configures a cardinality.WebhookNotifier.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+}
+
+// MonitorRuleConfig configures a cardinality.MonitorRule.
+type MonitorRuleConfig struct {
+	Name         string            `yaml:"name"`
+	Selector     string            `yaml:"selector"`
+	Threshold    int64             `yaml:"threshold,omitempty"`
+	MaxGrowth    int64             `yaml:"max_growth,omitempty"`
+	GrowthWindow model.Duration    `yaml:"growth_window,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+}
+
+// NewMonitor returns a monitor of the configured rules against index.
+func (c MonitorConfig) NewMonitor(index cardinality.CardinalityIndex, logger *slog.Logger) (*cardinality.Monitor, error) {
+	rules := make([]cardinality.MonitorRule, 0, len(c.Rules))
+	for _, r := range c.Rules {
+		matchers, err := cardinality.ParseSelector(r.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		rules = append(rules, cardinality.MonitorRule{
+			Name:         r.Name,
+			Matchers:     matchers,
+			Threshold:    r.Threshold,
+			MaxGrowth:    r.MaxGrowth,
+			GrowthWindow: time.Duration(r.GrowthWindow),
+			Labels:       r.Labels,
+		})
+	}
+	opts := []cardinality.MonitorOption{cardinality.WithMonitorLogger(logger)}
+	if c.ResendDelay > 0 {
+		opts = append(opts, cardinality.WithResendDelay(time.Duration(c.ResendDelay)))
+	}
+	for _, w := range c.Webhooks {
+		opts = append(opts, cardinality.WithNotifier(&cardinality.WebhookNotifier{URL: w.URL}))
+	}
+	return cardinality.NewMonitor(index, rules, opts...)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *RetentionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRetentionConfig
+	type plain RetentionConfig
+	return unmarshal((*plain)(c))
+}
+
+// TenantConfig configures a tenant with its own index.
+type TenantConfig struct {
+	ID string `yaml:"id"`
+	// Index overrides the top-level index configuration for this tenant.
+	Index *IndexConfig `yaml:"index,omitempty"`
+
+	// MaxSeries and MaxSeriesPerMetric are the quota of the tenant. Zero
+	// means unlimited.
+	MaxSeries          int64 `yaml:"max_series,omitempty"`
+	MaxSeriesPerMetric int64 `yaml:"max_series_per_metric,omitempty"`
+}
+
+// TenancyConfig configures how the tenant of series ingested as a single
+// stream is derived from their labels.
+type TenancyConfig struct {
+	// Label is the label holding the tenant, e.g. namespace. StripLabel
+	// removes it from the indexed series.
+	Label      string `yaml:"label,omitempty"`
+	StripLabel bool   `yaml:"strip_label,omitempty"`
+	// RelabelConfigs are applied after the rules of Label, and can set the
+	// tenant by writing the __tenant__ label.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// DefaultTenant is the tenant of series the rules assign none. Such
+	// series are dropped if it is empty.
+	DefaultTenant string `yaml:"default_tenant,omitempty"`
+}
+
+// Rules returns the tenant rules of the configuration.
+func (c TenancyConfig) Rules() []*relabel.Config {
+	var rules []*relabel.Config
+	if c.Label != "" {
+		rules = cardinality.TenantFromLabel(c.Label, c.StripLabel)
+	}
+	return append(rules, c.RelabelConfigs...)
+}
+
+// MetricSchemaConfig configures the schema of a metric, see
+// cardinality.MetricSchema.
+type MetricSchemaConfig struct {
+	Metric          string              `yaml:"metric"`
+	Labels          []LabelSchemaConfig `yaml:"labels,omitempty"`
+	AllowUndeclared bool                `yaml:"allow_undeclared,omitempty"`
+}
+
+// LabelSchemaConfig configures a label of a metric schema.
+type LabelSchemaConfig struct {
+	Name     string `yaml:"name"`
+	Required bool   `yaml:"required,omitempty"`
+	Pattern  string `yaml:"pattern,omitempty"`
+}
+
+// Schema returns the schema of the configuration.
+func (c MetricSchemaConfig) Schema() cardinality.MetricSchema {
+	s := cardinality.MetricSchema{Metric: c.Metric, AllowUndeclared: c.AllowUndeclared}
+	for _, l := range c.Labels {
+		s.Labels = append(s.Labels, cardinality.LabelSchema{Name: l.Name, Required: l.Required, Pattern: l.Pattern})
+	}
+	return s
+}
+
+// SchemaRegistry returns a registry of the configured schemas.
+func (c *Config) SchemaRegistry() (*cardinality.SchemaRegistry, error) {
+	schemas := make([]cardinality.MetricSchema, 0, len(c.Schemas))
+	seen := make(map[string]struct{}, len(c.Schemas))
+	for _, s := range c.Schemas {
+		if _, ok := seen[s.Metric]; ok {
+			return nil, fmt.Errorf("duplicate schema of metric %q", s.Metric)
+		}
+		seen[s.Metric] = struct{}{}
+		schemas = append(schemas, s.Schema())
+	}
+	return cardinality.NewSchemaRegistry(schemas...)
+}
+
+// Quota returns the quota of the tenant.
+func (c TenantConfig) Quota() cardinality.Quota {
+	return cardinality.Quota{
+		MaxSeries:          c.MaxSeries,
+		MaxSeriesPerMetric: c.MaxSeriesPerMetric,
+	}
+}
+
+// TenantIndexConfig returns the effective index configuration for the tenant.
+func (c *Config) TenantIndexConfig(t TenantConfig) IndexConfig {
+	if t.Index != nil {
+		return *t.Index
+	}
+	return c.Index
+}
+
+// NewTenantIndexManager returns a TenantIndexManager creating indexes as
+// configured per tenant, with the configured quotas. Tenants that aren't
+// configured use the top-level index configuration and have no quota.
+func (c *Config) NewTenantIndexManager() (*cardinality.TenantIndexManager, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]IndexConfig, len(c.Tenants))
+	for _, t := range c.Tenants {
+		tenants[t.ID] = c.TenantIndexConfig(t)
+	}
+	defaultIndex := c.Index
+
+	ttl := cardinality.WithValueTTL(time.Duration(c.Retention.Series))
+
+	m := cardinality.NewTenantIndexManager(func(tenant string) cardinality.CardinalityIndex {
+		if cfg, ok := tenants[tenant]; ok {
+			return cfg.newIndex(ttl)
+		}
+		return defaultIndex.newIndex(ttl)
+	})
+	for _, t := range c.Tenants {
+		m.SetQuota(t.ID, t.Quota())
+	}
+	m.SetTenantRules(c.Tenancy.Rules(), c.Tenancy.DefaultTenant)
+	return m, nil
+}
+
+// NewQueryContext returns a QueryContext bounding the scratch memory of
+// queries by the memory budget.
+func (c *Config) NewQueryContext() *cardinality.QueryContext {
+	return cardinality.NewQueryContext(int64(c.MemoryBudget))
+}
+
+// Validate checks the configuration for consistency.
+func (c *Config) Validate() error {
+	if err := c.Index.Validate(); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	seen := make(map[string]struct{}, len(c.Tenants))
+	for _, t := range c.Tenants {
+		if t.ID == "" {
+			return fmt.Errorf("tenant with empty id")
+		}
+		if _, ok := seen[t.ID]; ok {
+			return fmt.Errorf("duplicate tenant %q", t.ID)
+		}
+		seen[t.ID] = struct{}{}
+
+		if t.MaxSeries < 0 || t.MaxSeriesPerMetric < 0 {
+			return fmt.Errorf("tenant %q: negative quota", t.ID)
+		}
+
+		if t.Index != nil {
+			if err := t.Index.Validate(); err != nil {
+				return fmt.Errorf("tenant %q: index: %w", t.ID, err)
+			}
+		}
+	}
+
+	for user := range c.Server.Auth.BasicAuthUsers {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("server: auth: invalid basic auth user %q", user)
+		}
+	}
+	for client, token := range c.Server.Auth.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("server: auth: empty bearer token of client %q", client)
+		}
+	}
+	for client, limit := range c.Server.RateLimit.Clients {
+		if _, ok := c.Server.Auth.BasicAuthUsers[client]; !ok {
+			if _, ok := c.Server.Auth.BearerTokens[client]; !ok {
+				return fmt.Errorf("server: rate_limit: unknown client %q", client)
+			}
+		}
+		if limit.RequestsPerSecond < 0 || limit.Burst < 0 {
+			return fmt.Errorf("server: rate_limit: negative limit of client %q", client)
+		}
+	}
+	if c.Server.RateLimit.RequestsPerSecond < 0 || c.Server.RateLimit.Burst < 0 {
+		return fmt.Errorf("server: rate_limit: negative limit")
+	}
+	if c.MemoryBudget < 0 {
+		return fmt.Errorf("negative memory_budget %s", c.MemoryBudget)
+	}
+	if c.Server.GRPCListenAddress != "" && c.Server.GRPCListenAddress == c.Server.HTTPListenAddress {
+		return fmt.Errorf("server: http and grpc listen on the same address %s", c.Server.GRPCListenAddress)
+	}
+
+	if c.Tenancy.Label != "" && !model.LabelName(c.Tenancy.Label).IsValid() {
+		return fmt.Errorf("tenancy: invalid label %q", c.Tenancy.Label)
+	}
+	for _, rule := range c.Tenancy.RelabelConfigs {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("tenancy: %w", err)
+		}
+	}
+
+	if _, err := c.SchemaRegistry(); err != nil {
+		return fmt.Errorf("schemas: %w", err)
+	}
+	if c.Snapshots.Dir != "" && c.Snapshots.Interval <= 0 {
+		return fmt.Errorf("snapshots: interval must be positive")
+	}
+	if len(c.Monitor.Rules) > 0 && c.Monitor.Interval <= 0 {
+		return fmt.Errorf("monitor: interval must be positive")
+	}
+	for _, w := range c.Monitor.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("monitor: invalid webhook url %q", w.URL)
+		}
+	}
+	// The rules are checked when the monitor is built, before it is given
+	// an index.
+	if _, err := c.Monitor.NewMonitor(nil, slog.Default()); err != nil {
+		return fmt.Errorf("monitor: %w", err)
+	}
+	return nil
+}
+
+// Load parses the YAML input into a Config and validates it.
+func Load(b []byte) (*Config, error) {
+	cfg := &Config{
+		Index:     DefaultIndexConfig,
+		Server:    DefaultServerConfig,
+		Retention: DefaultRetentionConfig,
+	}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadConfig reads and parses the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Load(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"harry671003/hello/cardinality"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load([]byte(`
+index:
+  type: hyperminhash
+  target_error: 0.02
+memory_budget: 512MiB
+server:
+  http_listen_address: ":9090"
+retention:
+  series: 6h
+tenants:
+  - id: team-a
+  - id: team-b
+    index:
+      type: bitmap
+      deduplication: false
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, IndexTypeHyperMinHash, cfg.Index.Type)
+	require.True(t, cfg.Index.Deduplication)
+	require.Equal(t, 0.02, cfg.Index.TargetError)
+	require.EqualValues(t, 512<<20, cfg.MemoryBudget)
+	require.Equal(t, ":9090", cfg.Server.HTTPListenAddress)
+	require.Equal(t, DefaultServerConfig.GRPCListenAddress, cfg.Server.GRPCListenAddress)
+	require.Equal(t, model.Duration(6*time.Hour), cfg.Retention.Series)
+	require.Equal(t, DefaultRetentionConfig.Snapshots, cfg.Retention.Snapshots)
+
+	require.Equal(t, cfg.Index, cfg.TenantIndexConfig(cfg.Tenants[0]))
+	tenantIndex := cfg.TenantIndexConfig(cfg.Tenants[1])
+	require.Equal(t, IndexTypeBitmap, tenantIndex.Type)
+	require.False(t, tenantIndex.Deduplication)
+
+	_, err = tenantIndex.NewIndex()
+	require.NoError(t, err)
+
+	// The precision only applies to hyperminhash indexes.
+	_, err = Load([]byte("index: {type: bitmap, precision: 10}"))
+	require.NoError(t, err)
+}
+
+func TestServerAuth(t *testing.T) {
+	cfg, err := Load([]byte(`
+server:
+  auth:
+    basic_auth_users: {alice: hunter2}
+    bearer_tokens: {team-a: token-a}
+  rate_limit:
+    requests_per_second: 1
+    clients:
+      team-a: {requests_per_second: 100, burst: 10}
+`))
+	require.NoError(t, err)
+	require.Equal(t, 1.0, cfg.Server.RateLimit.RequestsPerSecond)
+
+	// Secrets are hidden when the configuration is printed.
+	out, err := yaml.Marshal(cfg.Server.Auth)
+	require.NoError(t, err)
+	require.NotContains(t, string(out), "hunter2")
+	require.NotContains(t, string(out), "token-a")
+}
+
+func TestIndexIngest(t *testing.T) {
+	cfg, err := Load([]byte(`
+index:
+  relabel_configs:
+    - action: labeldrop
+      regex: trace_id
+  value_guard:
+    max_length: 32
+    buckets: 4
+`))
+	require.NoError(t, err)
+	index, err := cfg.Index.NewIndex()
+	require.NoError(t, err)
+	index.AddSeries(labels.FromStrings("__name__", "up", "trace_id", "1"), 1)
+	index.AddSeries(labels.FromStrings("__name__", "up", "trace_id", "2"), 2)
+	require.Equal(t, int64(1), index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+
+	index.AddSeries(labels.FromStrings("__name__", "up", "query", strings.Repeat("x", 100)), 3)
+	require.Equal(t, []string{"__unbounded_0"}, index.(cardinality.LabelValuesIndex).LabelValues("query"))
+}
+
+func TestMemoryBudget(t *testing.T) {
+	cfg, err := Load([]byte("memory_budget: 1B"))
+	require.NoError(t, err)
+	index, err := cfg.Index.NewIndex()
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		index.AddSeries(labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i)), storage.SeriesRef(i+1))
+	}
+
+	q := cfg.NewQueryContext()
+	_, err = cardinality.GetCardinalityChecked(cardinality.ContextWithQuery(context.Background(), q), index, labels.MustNewMatcher(labels.MatchRegexp, "instance", "1.*"))
+	require.ErrorIs(t, err, cardinality.ErrMemoryBudgetExceeded)
+
+	// Without a budget, queries use the memory they need.
+	q = (&Config{}).NewQueryContext()
+	_, err = cardinality.GetCardinalityChecked(cardinality.ContextWithQuery(context.Background(), q), index, labels.MustNewMatcher(labels.MatchRegexp, "instance", "1.*"))
+	require.NoError(t, err)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, in := range map[string]string{
+		"unknown field":    "foo: bar",
+		"unknown type":     "index: {type: btree}",
+		"precision":        "index: {type: hyperminhash, precision: 10}",
+		"memory budget":    "memory_budget: -1KiB",
+		"same addresses":   "server: {http_listen_address: ':9095', grpc_listen_address: ':9095'}",
+		"duplicate tenant": "tenants: [{id: a}, {id: a}]",
+		"value buckets":    "index: {value_bucket_threshold: 1000}",
+		"target error":     "index: {target_error: -0.1}",
+		"index relabel":    "index: {relabel_configs: [{action: replace}]}",
+		"value guard":      "index: {value_guard: {max_length: -1}}",
+		"tenancy label":    "tenancy: {label: 1abc}",
+		"tenancy rules":    "tenancy: {relabel_configs: [{action: replace}]}",
+		"basic auth user":  "server: {auth: {basic_auth_users: {'a:b': c}}}",
+		"bearer token":     "server: {auth: {bearer_tokens: {a: ''}}}",
+		"rate limit":       "server: {rate_limit: {requests_per_second: -1}}",
+		"unknown client":   "server: {rate_limit: {clients: {a: {requests_per_second: 1}}}}",
+		"schema pattern":   "schemas: [{metric: up, labels: [{name: job, pattern: '('}]}]",
+		"duplicate schema": "schemas: [{metric: up}, {metric: up}]",
+		"snapshots":        "snapshots: {dir: /tmp}",
+		"monitor interval": "monitor: {rules: [{name: a, selector: up, threshold: 1}]}",
+		"monitor selector": "monitor: {interval: 1m, rules: [{name: a, selector: 'up{', threshold: 1}]}",
+		"monitor rule":     "monitor: {interval: 1m, rules: [{name: a, selector: up}]}",
+		"monitor webhook":  "monitor: {webhooks: [{url: alertmanager}]}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load([]byte(in))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("index: {type: bitmap}"), 0o644))
+
+	r, err := NewReloader(path)
+	require.NoError(t, err)
+	require.Equal(t, IndexTypeBitmap, r.Current().Index.Type)
+
+	var reloaded *Config
+	r.OnReload(func(c *Config) { reloaded = c })
+
+	changed, err := r.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	require.NoError(t, os.WriteFile(path, []byte("index: {type: hyperminhash}"), 0o644))
+	changed, err = r.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, IndexTypeHyperMinHash, reloaded.Index.Type)
+
+	// An invalid file keeps the previous configuration.
+	require.NoError(t, os.WriteFile(path, []byte("index: {type: btree}"), 0o644))
+	_, err = r.Reload()
+	require.Error(t, err)
+	require.Equal(t, IndexTypeHyperMinHash, r.Current().Index.Type)
+}
+
+func TestNewTenantIndexManager(t *testing.T) {
+	cfg, err := Load([]byte(`
+tenants:
+  - id: team-a
+    max_series: 10
+    index:
+      type: hyperminhash
+`))
+	require.NoError(t, err)
+
+	m, err := cfg.NewTenantIndexManager()
+	require.NoError(t, err)
+
+	m.AddSeries("team-a", labels.FromStrings("__name__", "up"), 1)
+	m.AddSeries("team-b", labels.FromStrings("__name__", "up"), 1)
+	require.Equal(t, []string{"team-a", "team-b"}, m.Tenants())
+	require.Equal(t, int64(10), m.Usage("team-a").Quota.MaxSeries)
+	require.Zero(t, m.Usage("team-b").Quota.MaxSeries)
+}
+
+func TestTenancy(t *testing.T) {
+	cfg, err := Load([]byte(`
+tenancy:
+  label: namespace
+  strip_label: true
+  relabel_configs:
+    - source_labels: [cluster]
+      regex: staging
+      target_label: __tenant__
+      replacement: staging
+  default_tenant: shared
+`))
+	require.NoError(t, err)
+
+	m, err := cfg.NewTenantIndexManager()
+	require.NoError(t, err)
+
+	tenant, ok := m.AddSeriesFromLabels(labels.FromStrings("__name__", "up", "namespace", "team-a"), 1)
+	require.True(t, ok)
+	require.Equal(t, "team-a", tenant)
+	require.Equal(t, int64(1), m.GetCardinality("team-a", labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")))
+	require.Zero(t, m.GetCardinality("team-a", labels.MustNewMatcher(labels.MatchEqual, "namespace", "team-a")))
+
+	tenant, _ = m.AddSeriesFromLabels(labels.FromStrings("__name__", "up", "namespace", "team-a", "cluster", "staging"), 2)
+	require.Equal(t, "staging", tenant)
+	tenant, _ = m.AddSeriesFromLabels(labels.FromStrings("__name__", "up"), 3)
+	require.Equal(t, "shared", tenant)
+	require.Equal(t, []string{"shared", "staging", "team-a"}, m.Tenants())
+}
+
+func TestSchemas(t *testing.T) {
+	cfg, err := Load([]byte(`
+schemas:
+  - metric: http_requests_total
+    labels:
+      - name: code
+        required: true
+        pattern: "[2-5][0-9][0-9]"
+      - name: pod
+  - metric: up
+    allow_undeclared: true
+`))
+	require.NoError(t, err)
+
+	registry, err := cfg.SchemaRegistry()
+	require.NoError(t, err)
+	require.Equal(t, []cardinality.MetricSchema{
+		{Metric: "http_requests_total", Labels: []cardinality.LabelSchema{
+			{Name: "code", Required: true, Pattern: "[2-5][0-9][0-9]"},
+			{Name: "pod"},
+		}},
+		{Metric: "up", AllowUndeclared: true},
+	}, registry.Schemas())
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := Load([]byte(`
+retention:
+  snapshots: 30d
+snapshots:
+  dir: ` + dir + `
+  interval: 1h
+`))
+	require.NoError(t, err)
+
+	store, err := cfg.NewSnapshotStore()
+	require.NoError(t, err)
+	require.NoError(t, store.Save(context.Background(), cardinality.NewBitmapIndex(), time.Now()))
+	require.DirExists(t, filepath.Join(dir, "cache"))
+	times, err := store.Snapshots(context.Background())
+	require.NoError(t, err)
+	require.Len(t, times, 1)
+
+	cfg, err = Load(nil)
+	require.NoError(t, err)
+	store, err = cfg.NewSnapshotStore()
+	require.NoError(t, err)
+	require.Nil(t, store)
+}
+
+func TestMonitor(t *testing.T) {
+	var posted []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+	}))
+	defer srv.Close()
+
+	cfg, err := Load([]byte(`
+monitor:
+  interval: 1m
+  resend_delay: 5m
+  webhooks:
+    - url: ` + srv.URL + `
+  rules:
+    - name: TooManyUpSeries
+      selector: up
+      threshold: 1
+      labels:
+        team: infra
+    - name: FastGrowth
+      selector: '{job="api"}'
+      max_growth: 1000
+      growth_window: 1h
+`))
+	require.NoError(t, err)
+
+	index := cardinality.NewBitmapIndex()
+	index.AddSeries(labels.FromStrings("__name__", "up", "pod", "a"), 1)
+	index.AddSeries(labels.FromStrings("__name__", "up", "pod", "b"), 2)
+	m, err := cfg.Monitor.NewMonitor(index, slog.Default())
+	require.NoError(t, err)
+	alerts, err := m.Evaluate(context.Background(), time.Now())
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	require.Len(t, posted, 1)
+	require.Equal(t, map[string]any{"alertname": "TooManyUpSeries", "selector": `{__name__="up"}`, "team": "infra"}, posted[0]["labels"])
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader keeps the configuration loaded from a file up to date. Invalid
+// configuration files are rejected and the previous configuration is kept.
+type Reloader struct {
+	path string
+
+	mtx      sync.RWMutex
+	current  *Config
+	checksum []byte
+	onReload []func(*Config)
+}
+
+// NewReloader loads the configuration at path and returns a Reloader for it.
+func NewReloader(path string) (*Reloader, error) {
+	r := &Reloader{path: path}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Current returns the most recently loaded configuration.
+func (r *Reloader) Current() *Config {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.current
+}
+
+// OnReload registers fn to be called with the new configuration every time
+// the file content changes.
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.onReload = append(r.onReload, fn)
+}
+
+// Reload re-reads the configuration file. It reports whether the
+// configuration changed.
+func (r *Reloader) Reload() (bool, error) {
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(b)
+
+	r.mtx.RLock()
+	unchanged := bytes.Equal(r.checksum, sum[:])
+	r.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cfg, err := Load(b)
+	if err != nil {
+		return false, err
+	}
+
+	r.mtx.Lock()
+	r.current = cfg
+	r.checksum = sum[:]
+	callbacks := append([]func(*Config){}, r.onReload...)
+	r.mtx.Unlock()
+
+	for _, fn := range callbacks {
+		fn(cfg)
+	}
+	return true, nil
+}
+
+// Run polls the configuration file every interval until ctx is done.
+// Errors are passed to errFn, which may be nil.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Reload(); err != nil && errFn != nil {
+				errFn(err)
+			}
+		}
+	}
+}
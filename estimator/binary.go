@@ -0,0 +1,128 @@
+package estimator
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+	"harry671003/hello/cardinality"
+	"math"
+)
+
+func (e *Estimator) estimateBinary(n *parser.BinaryExpr) (int64, error) {
+	lhs, err := e.Estimate(n.LHS)
+	if err != nil {
+		return 0, err
+	}
+	rhs, err := e.Estimate(n.RHS)
+	if err != nil {
+		return 0, err
+	}
+
+	lScalar := n.LHS.Type() == parser.ValueTypeScalar
+	rScalar := n.RHS.Type() == parser.ValueTypeScalar
+	switch {
+	case lScalar && rScalar:
+		return 1, nil
+	case lScalar:
+		return rhs, nil
+	case rScalar:
+		return lhs, nil
+	}
+
+	// Fraction of the series on each side that find a match on the other side.
+	lMatched, rMatched := e.matchedFractions(n)
+	lOut := int64(math.Round(float64(lhs) * lMatched))
+	rOut := int64(math.Round(float64(rhs) * rMatched))
+
+	switch n.Op {
+	case parser.LAND:
+		return lOut, nil
+	case parser.LOR:
+		return lhs + rhs - rOut, nil
+	case parser.LUNLESS:
+		return lhs - lOut, nil
+	}
+
+	switch n.VectorMatching.Card {
+	case parser.CardManyToOne:
+		return e.boundJoin(n.LHS, n.VectorMatching, lOut, rOut), nil
+	case parser.CardOneToMany:
+		return e.boundJoin(n.RHS, n.VectorMatching, rOut, lOut), nil
+	default:
+		return min(lOut, rOut), nil
+	}
+}
+
+// boundJoin bounds the output of a many-to-one matching, the matched series
+// of the "many" side, by the matched series of the "one" side times the
+// series of the "many" side each of them joins, see
+// cardinality.EstimateJoinExpansion. This catches "one" sides reduced by
+// functions or aggregations the matched fractions can't see through, like
+// topk.
+func (e *Estimator) boundJoin(many parser.Expr, vm *parser.VectorMatching, manyOut, oneOut int64) int64 {
+	matchers := selectorMatchers(many)
+	if len(matchers) == 0 {
+		return manyOut
+	}
+	expansion, err := cardinality.EstimateJoinExpansion(e.index, matchers, vm.MatchingLabels, vm.On)
+	if err != nil || expansion.Series == 0 {
+		return manyOut
+	}
+	return min(manyOut, int64(math.Ceil(float64(oneOut)*expansion.Factor)))
+}
+
+// matchedFractions estimates which fraction of the series on the left and
+// right side of a vector matching have a partner on the other side.
+//
+// For on(...) matching the overlap of every matching label's values is
+// computed per side, from the values on the series of the selectors of the
+// side, and the labels are assumed to be independent. Matching
+// on all labels or with ignoring(...) can't be modelled from per-label
+// statistics, so every series is assumed to match, making the result an
+// upper bound.
+func (e *Estimator) matchedFractions(n *parser.BinaryExpr) (float64, float64) {
+	vm := n.VectorMatching
+	lvi, ok := e.index.(cardinality.LabelValuesIndex)
+	if vm == nil || !vm.On || !ok {
+		return 1, 1
+	}
+
+	lSelectors, rSelectors := parser.ExtractSelectors(n.LHS), parser.ExtractSelectors(n.RHS)
+	lFraction, rFraction := 1.0, 1.0
+	for _, name := range vm.MatchingLabels {
+		lValues := selectorValues(lvi, lSelectors, name)
+		rValues := selectorValues(lvi, rSelectors, name)
+		if len(lValues) == 0 && len(rValues) == 0 {
+			// Neither side has the label, so it matches on the empty value.
+			continue
+		}
+
+		common := overlap(lValues, rValues)
+		lFraction *= fraction(common, len(lValues))
+		rFraction *= fraction(common, len(rValues))
+	}
+	return lFraction, rFraction
+}
+
+// overlap counts the values present in both sorted slices.
+func overlap(a, b []string) int {
+	common := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			common++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return common
+}
+
+func fraction(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
@@ -0,0 +1,156 @@
+package estimator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"harry671003/hello/cardinality"
+	"math"
+	"slices"
+)
+
+// ErrUnsupported is returned for expressions the estimator can't model.
+var ErrUnsupported = errors.New("unsupported expression")
+
+// Estimator estimates the number of series a PromQL expression returns,
+// using a CardinalityIndex for the selectors in the expression.
+type Estimator struct {
+	index   cardinality.CardinalityIndex
+	density *cardinality.SampleDensity
+}
+
+func New(index cardinality.CardinalityIndex) *Estimator {
+	return &Estimator{index: index}
+}
+
+// EstimateQuery parses query and estimates its output cardinality.
+func (e *Estimator) EstimateQuery(query string) (int64, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return 0, err
+	}
+	return e.Estimate(expr)
+}
+
+// Estimate returns the estimated number of series expr evaluates to at a
+// single step. Scalars and strings count as one series.
+func (e *Estimator) Estimate(expr parser.Expr) (int64, error) {
+	switch n := expr.(type) {
+	case *parser.VectorSelector:
+		return e.index.GetCardinality(n.LabelMatchers...), nil
+	case *parser.MatrixSelector:
+		return e.Estimate(n.VectorSelector)
+	case *parser.SubqueryExpr:
+		return e.Estimate(n.Expr)
+	case *parser.ParenExpr:
+		return e.Estimate(n.Expr)
+	case *parser.StepInvariantExpr:
+		return e.Estimate(n.Expr)
+	case *parser.UnaryExpr:
+		return e.Estimate(n.Expr)
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return 1, nil
+	case *parser.AggregateExpr:
+		return e.estimateAggregate(n)
+	case *parser.BinaryExpr:
+		return e.estimateBinary(n)
+	case *parser.Call:
+		return e.estimateCall(n)
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupported, expr)
+}
+
+func (e *Estimator) estimateAggregate(n *parser.AggregateExpr) (int64, error) {
+	inner, err := e.Estimate(n.Expr)
+	if err != nil {
+		return 0, err
+	}
+
+	var groups int64
+	switch {
+	case n.Without:
+		// Dropping labels can't increase the number of series.
+		groups = inner
+	case len(n.Grouping) == 0:
+		groups = min(inner, 1)
+	default:
+		groups = e.distinctCombinations(n.Expr, n.Grouping, inner)
+	}
+
+	switch n.Op {
+	case parser.TOPK, parser.BOTTOMK, parser.LIMITK:
+		// These keep up to k of the original series per group.
+		if k, ok := n.Param.(*parser.NumberLiteral); ok {
+			return min(inner, int64(k.Val)*groups), nil
+		}
+		return inner, nil
+	case parser.COUNT_VALUES, parser.LIMIT_RATIO:
+		return inner, nil
+	}
+	return groups, nil
+}
+
+// distinctCombinations estimates how many distinct value combinations of
+// names occur on the series of expr, capped at bound.
+func (e *Estimator) distinctCombinations(expr parser.Expr, names []string, bound int64) int64 {
+	lvi, ok := e.index.(cardinality.LabelValuesIndex)
+	if !ok {
+		return bound
+	}
+
+	expr, names = sourceLabels(expr, names)
+	selectors := parser.ExtractSelectors(expr)
+	combinations := 1.0
+	for _, name := range names {
+		// Series without the label form a group of their own.
+		combinations *= float64(max(len(selectorValues(lvi, selectors, name)), 1))
+	}
+
+	// Correct for correlated labels instead of assuming independence.
+	combinations *= cardinality.CombinationsCorrection(e.index, names...)
+
+	return min(int64(math.Ceil(combinations)), bound)
+}
+
+// selectorValues returns the sorted values of the label on the series of
+// the selectors an expression reads from, the union of their values if it
+// reads from several.
+func selectorValues(lvi cardinality.LabelValuesIndex, selectors [][]*labels.Matcher, name string) []string {
+	if len(selectors) == 1 {
+		return lvi.LabelValues(name, selectors[0]...)
+	}
+	var values []string
+	for _, matchers := range selectors {
+		values = append(values, lvi.LabelValues(name, matchers...)...)
+	}
+	slices.Sort(values)
+	return slices.Compact(values)
+}
+
+// selectorMatchers returns the matchers of the selector expr reads from,
+// through functions and aggregations, or nil if expr reads from no or
+// several selectors.
+func selectorMatchers(expr parser.Expr) []*labels.Matcher {
+	switch n := expr.(type) {
+	case *parser.VectorSelector:
+		return n.LabelMatchers
+	case *parser.MatrixSelector:
+		return selectorMatchers(n.VectorSelector)
+	case *parser.SubqueryExpr:
+		return selectorMatchers(n.Expr)
+	case *parser.ParenExpr:
+		return selectorMatchers(n.Expr)
+	case *parser.StepInvariantExpr:
+		return selectorMatchers(n.Expr)
+	case *parser.UnaryExpr:
+		return selectorMatchers(n.Expr)
+	case *parser.AggregateExpr:
+		return selectorMatchers(n.Expr)
+	case *parser.Call:
+		if arg := vectorArg(n); arg != nil {
+			return selectorMatchers(arg)
+		}
+	}
+	return nil
+}
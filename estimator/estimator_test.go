@@ -0,0 +1,248 @@
+package estimator
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+	"harry671003/hello/cardinality"
+	"testing"
+	"time"
+)
+
+// newTestIndex indexes 30 series of metric a (10 pods x 3 containers) and 5
+// series of metric b (pods 0-4).
+func newTestIndex() *cardinality.BitmapIndex {
+	index := cardinality.NewBitmapIndex()
+	ref := storage.SeriesRef(0)
+	for pod := 0; pod < 10; pod++ {
+		for container := 0; container < 3; container++ {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "a", "pod", fmt.Sprintf("pod-%d", pod), "container", fmt.Sprintf("c%d", container)), ref)
+		}
+		if pod < 5 {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "b", "pod", fmt.Sprintf("pod-%d", pod)), ref)
+		}
+	}
+	return index
+}
+
+func TestEstimate(t *testing.T) {
+	e := New(newTestIndex())
+
+	for query, expected := range map[string]int64{
+		`a`:                           30,
+		`(a)[5m:]`:                    30,
+		`-a`:                          30,
+		`a > 5`:                       30,
+		`1 + 2`:                       1,
+		`sum(a)`:                      1,
+		`sum by (pod) (a)`:            10,
+		`sum by (pod, container) (a)`: 30,
+		`sum without (container) (a)`: 30,
+		`topk(2, a)`:                  2,
+		`topk by (pod) (1, a)`:        10,
+	} {
+		t.Run(query, func(t *testing.T) {
+			actual, err := e.EstimateQuery(query)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	enableExperimentalFunctions(t)
+	_, err := e.EstimateQuery(`info(a)`)
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestEstimateFunctions(t *testing.T) {
+	index := newTestIndex()
+	// A classic histogram of 4 pods with 5 buckets each.
+	ref := storage.SeriesRef(1000)
+	for pod := 0; pod < 4; pod++ {
+		for _, le := range []string{"0.1", "0.5", "1", "5", "+Inf"} {
+			ref++
+			index.AddSeries(labels.FromStrings("__name__", "latency_bucket", "pod", fmt.Sprintf("pod-%d", pod), "le", le), ref)
+		}
+	}
+	e := New(index)
+
+	for query, expected := range map[string]int64{
+		`rate(a[5m])`:                         30,
+		`sum by (pod) (rate(a[5m]))`:          10,
+		`abs(clamp_min(a, 0))`:                30,
+		`quantile_over_time(0.9, a[5m])`:      30,
+		`sort_desc(sum by (container) (a))`:   3,
+		`absent(a)`:                           0,
+		`absent(a{pod="none"})`:               1,
+		`absent_over_time(a{pod="none"}[5m])`: 1,
+		`scalar(sum(a))`:                      1,
+		`vector(1)`:                           1,
+		`time()`:                              1,
+		`hour()`:                              1,
+		`topk(3, rate(a[5m]))`:                3,
+		`histogram_quantile(0.9, rate(latency_bucket[5m]))`:                    4,
+		`histogram_quantile(0.9, sum by (le) (rate(latency_bucket[5m])))`:      1,
+		`histogram_quantile(0.9, sum by (pod, le) (rate(latency_bucket[5m])))`: 4,
+		`histogram_quantile(0.9, rate(a[5m]))`:                                 30,
+	} {
+		t.Run(query, func(t *testing.T) {
+			actual, err := e.EstimateQuery(query)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestEstimateLabelFunctions(t *testing.T) {
+	e := New(newTestIndex())
+
+	for query, expected := range map[string]int64{
+		`label_replace(a, "x", "$1", "pod", "pod-(.*)")`:                                             30,
+		`sum by (x) (label_replace(a, "x", "$1", "pod", "pod-(.*)"))`:                                10,
+		`sum by (x) (label_replace(a, "x", "all", "pod", ".*"))`:                                     1,
+		`sum by (x, container) (label_replace(a, "x", "$1", "pod", "(.*)"))`:                         30,
+		`sum by (x) (label_join(a, "x", "/", "pod", "container"))`:                                   30,
+		`sum by (x, pod) (label_join(a, "x", "/", "pod"))`:                                           10,
+		`count by (y) (label_replace(label_join(a, "x", "/", "container"), "y", "$1", "x", "(.*)"))`: 3,
+	} {
+		t.Run(query, func(t *testing.T) {
+			actual, err := e.EstimateQuery(query)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestEstimateBinary(t *testing.T) {
+	e := New(newTestIndex())
+
+	for query, expected := range map[string]int64{
+		`a * on(pod) group_left b`:             15,
+		`b * on(pod) group_right a`:            15,
+		`sum by (pod) (a) * on(pod) b`:         5,
+		`a and on(pod) b`:                      15,
+		`a unless on(pod) b`:                   15,
+		`a or on(pod) b`:                       30,
+		`a * on(pod) group_left b{pod="none"}`: 0,
+		`a * on() group_left b`:                30,
+		`a * on(pod) group_left topk(1, b)`:    3,
+		`a * ignoring(container) group_left b`: 15,
+		`topk(1, b) * on(pod) group_right a`:   3,
+		// The values of a side are those of all its selectors.
+		`a and on(pod) (b{pod="pod-0"} or b{pod="pod-1"})`: 6,
+		`a and on(pod) (b{pod="pod-0"} + b{pod="pod-0"})`:  3,
+	} {
+		t.Run(query, func(t *testing.T) {
+			actual, err := e.EstimateQuery(query)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+// enableExperimentalFunctions lets the parser parse info, which the
+// estimator doesn't support, for the duration of the test.
+func enableExperimentalFunctions(t *testing.T) {
+	parser.EnableExperimentalFunctions = true
+	t.Cleanup(func() { parser.EnableExperimentalFunctions = false })
+}
+
+func TestAnalyzeRules(t *testing.T) {
+	enableExperimentalFunctions(t)
+	index := newTestIndex()
+	index.AddSeries(labels.FromStrings("__name__", "pod:a:sum", "pod", "pod-0"), 1000)
+
+	groups, errs := rulefmt.Parse([]byte(`
+groups:
+  - name: example
+    limit: 20
+    rules:
+      - record: pod:a:sum
+        expr: sum by (pod) (a)
+      - record: pod_container:a:joined
+        expr: a * on(pod) group_left b
+      - alert: TooMany
+        expr: a > 100
+      - record: broken
+        expr: info(a)
+      - record: total:a
+        expr: sum(a)
+`))
+	require.Empty(t, errs)
+
+	impacts := New(index).AnalyzeRules(groups)
+	require.Len(t, impacts, 4)
+
+	require.Equal(t, "pod_container:a:joined", impacts[0].Record)
+	require.Equal(t, int64(15), impacts[0].New)
+
+	require.Equal(t, "pod:a:sum", impacts[1].Record)
+	require.Equal(t, int64(10), impacts[1].Series)
+	require.Equal(t, int64(1), impacts[1].Existing)
+	require.Equal(t, int64(9), impacts[1].New)
+	require.False(t, impacts[1].ExceedsLimit)
+
+	require.Equal(t, "total:a", impacts[2].Record)
+	require.Equal(t, int64(1), impacts[2].New)
+
+	require.Equal(t, "broken", impacts[3].Record)
+	require.ErrorIs(t, impacts[3].Err, ErrUnsupported)
+}
+
+func TestLint(t *testing.T) {
+	e := New(newTestIndex())
+
+	warnings, err := e.Lint(`sum(a) / sum({pod=~"pod-.*"})`, 20)
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	require.Equal(t, `a`, warnings[0].Selector)
+	require.Equal(t, int64(30), warnings[0].Series)
+	require.Equal(t, "selector a matches ~30 series, more than the limit of 20", warnings[0].Message)
+	require.Equal(t, `selector {pod=~"pod-.*"} matches ~35 series; consider adding a metric name`, warnings[1].Message)
+
+	warnings, err = e.Lint(`b`, 20)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+
+	_, err = e.Lint(`sum(`, 0)
+	require.Error(t, err)
+
+	require.Equal(t, "1.2M", humanizeCount(1_234_567))
+}
+
+func TestEstimateSamples(t *testing.T) {
+	e := New(newTestIndex())
+	a := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "a")}
+	b := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "b")}
+	hour := time.Hour.Milliseconds()
+
+	// Without tracked samples the default scrape interval of 1m is assumed.
+	require.Equal(t, SampleEstimate{Series: 30, Samples: 30 * 61, Bytes: 30 * 61 * 16}, e.EstimateSamples(a, 0, hour, 0))
+	// An instant query reads a single sample per series.
+	require.Equal(t, int64(30), e.EstimateSamples(a, hour, hour, 0).Samples)
+
+	// a is scraped every 15s and b every 30s.
+	density := cardinality.NewSampleDensity(time.Minute)
+	for ts := int64(0); ts <= 60_000; ts += 15_000 {
+		density.AddSample(labels.FromStrings("__name__", "a", "pod", "pod-0"), ts)
+		if ts%30_000 == 0 {
+			density.AddSample(labels.FromStrings("__name__", "b", "pod", "pod-0"), ts)
+		}
+	}
+	// Out of order samples are ignored.
+	density.AddSample(labels.FromStrings("__name__", "a", "pod", "pod-0"), 0)
+	e.SetSampleDensity(density)
+
+	require.Equal(t, int64(30*241), e.EstimateSamples(a, 0, hour, 0).Samples)
+	require.Equal(t, int64(5*121), e.EstimateSamples(b, 0, hour, 0).Samples)
+	// Steps longer than the interval bound the samples per series.
+	require.Equal(t, int64(30*61), e.EstimateSamples(a, 0, hour, time.Minute.Milliseconds()).Samples)
+	require.Equal(t, int64(30*241), e.EstimateSamples(a, 0, hour, time.Second.Milliseconds()).Samples)
+	// Other selectors use the mean interval over all series: 4 intervals
+	// of 15s and 2 of 30s.
+	require.Equal(t, 20*time.Second, density.Interval(labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-0")))
+}
@@ -0,0 +1,221 @@
+package estimator
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"slices"
+	"strings"
+)
+
+// functionRule describes how the number of series a function returns
+// relates to the series of its vector argument.
+type functionRule int
+
+const (
+	// perSeries functions return at most a series per series of their
+	// argument: rate, the *_over_time functions, math, sorting and the
+	// label functions, which only change labels. Without a vector
+	// argument, like time functions defaulting to vector(time()), they
+	// return a single series.
+	perSeries functionRule = iota
+	// single functions return a scalar or a single series.
+	single
+	// absent functions return a series only if their argument has none.
+	absent
+	// bucketQuantile functions merge the buckets of classic histograms
+	// into a series per histogram, collapsing the le label.
+	bucketQuantile
+)
+
+// functionRules holds the rules of the functions the estimator models.
+// Experimental functions whose output depends on other series, like info,
+// are missing and unsupported.
+var functionRules = map[string]functionRule{
+	"absent":                       absent,
+	"absent_over_time":             absent,
+	"histogram_quantile":           bucketQuantile,
+	"pi":                           single,
+	"scalar":                       single,
+	"time":                         single,
+	"vector":                       single,
+	"abs":                          perSeries,
+	"acos":                         perSeries,
+	"acosh":                        perSeries,
+	"asin":                         perSeries,
+	"asinh":                        perSeries,
+	"atan":                         perSeries,
+	"atanh":                        perSeries,
+	"avg_over_time":                perSeries,
+	"ceil":                         perSeries,
+	"changes":                      perSeries,
+	"clamp":                        perSeries,
+	"clamp_max":                    perSeries,
+	"clamp_min":                    perSeries,
+	"cos":                          perSeries,
+	"cosh":                         perSeries,
+	"count_over_time":              perSeries,
+	"day_of_month":                 perSeries,
+	"day_of_week":                  perSeries,
+	"day_of_year":                  perSeries,
+	"days_in_month":                perSeries,
+	"deg":                          perSeries,
+	"delta":                        perSeries,
+	"deriv":                        perSeries,
+	"double_exponential_smoothing": perSeries,
+	"exp":                          perSeries,
+	"floor":                        perSeries,
+	"histogram_avg":                perSeries,
+	"histogram_count":              perSeries,
+	"histogram_fraction":           perSeries,
+	"histogram_stddev":             perSeries,
+	"histogram_stdvar":             perSeries,
+	"histogram_sum":                perSeries,
+	"hour":                         perSeries,
+	"idelta":                       perSeries,
+	"increase":                     perSeries,
+	"irate":                        perSeries,
+	"label_join":                   perSeries,
+	"label_replace":                perSeries,
+	"last_over_time":               perSeries,
+	"ln":                           perSeries,
+	"log10":                        perSeries,
+	"log2":                         perSeries,
+	"mad_over_time":                perSeries,
+	"max_over_time":                perSeries,
+	"min_over_time":                perSeries,
+	"minute":                       perSeries,
+	"month":                        perSeries,
+	"predict_linear":               perSeries,
+	"present_over_time":            perSeries,
+	"quantile_over_time":           perSeries,
+	"rad":                          perSeries,
+	"rate":                         perSeries,
+	"resets":                       perSeries,
+	"round":                        perSeries,
+	"sgn":                          perSeries,
+	"sin":                          perSeries,
+	"sinh":                         perSeries,
+	"sort":                         perSeries,
+	"sort_by_label":                perSeries,
+	"sort_by_label_desc":           perSeries,
+	"sort_desc":                    perSeries,
+	"sqrt":                         perSeries,
+	"stddev_over_time":             perSeries,
+	"stdvar_over_time":             perSeries,
+	"sum_over_time":                perSeries,
+	"tan":                          perSeries,
+	"tanh":                         perSeries,
+	"timestamp":                    perSeries,
+	"year":                         perSeries,
+}
+
+func (e *Estimator) estimateCall(n *parser.Call) (int64, error) {
+	rule, ok := functionRules[n.Func.Name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupported, n)
+	}
+	if rule == single {
+		return 1, nil
+	}
+
+	arg := vectorArg(n)
+	if arg == nil {
+		return 1, nil
+	}
+	inner, err := e.Estimate(arg)
+	if err != nil {
+		return 0, err
+	}
+
+	switch rule {
+	case absent:
+		if inner == 0 {
+			return 1, nil
+		}
+		return 0, nil
+	case bucketQuantile:
+		// Assumes every histogram has every bucket. Native histograms have
+		// no le label and are returned as they are.
+		buckets := e.distinctCombinations(arg, []string{labels.BucketLabel}, inner)
+		return (inner + buckets - 1) / max(buckets, 1), nil
+	}
+	return inner, nil
+}
+
+// vectorArg returns the instant or range vector argument of a call, or nil
+// if it has none.
+func vectorArg(n *parser.Call) parser.Expr {
+	for _, arg := range n.Args {
+		switch arg.Type() {
+		case parser.ValueTypeVector, parser.ValueTypeMatrix:
+			return arg
+		}
+	}
+	return nil
+}
+
+// sourceLabels unwraps the label_replace and label_join calls around expr,
+// and replaces the labels they write among names with the labels of the
+// inner series that determine their values. It returns the innermost
+// expression and the replaced names, so the number of distinct values can
+// be taken from the series the selector reads.
+//
+// label_replace is assumed to match the source label of every series, so
+// its destination takes a value per source value, or a single value if the
+// replacement references no group.
+func sourceLabels(expr parser.Expr, names []string) (parser.Expr, []string) {
+	for {
+		if paren, ok := expr.(*parser.ParenExpr); ok {
+			expr = paren.Expr
+			continue
+		}
+		call, ok := expr.(*parser.Call)
+		if !ok {
+			return expr, names
+		}
+
+		var dst string
+		var sources []string
+		switch call.Func.Name {
+		case "label_replace":
+			dst = stringArg(call.Args[1])
+			if strings.Contains(stringArg(call.Args[2]), "$") {
+				sources = []string{stringArg(call.Args[3])}
+			}
+		case "label_join":
+			dst = stringArg(call.Args[1])
+			for _, arg := range call.Args[3:] {
+				sources = append(sources, stringArg(arg))
+			}
+		default:
+			return expr, names
+		}
+
+		if slices.Contains(names, dst) {
+			replaced := make([]string, 0, len(names)+len(sources))
+			for _, name := range names {
+				if name != dst {
+					replaced = append(replaced, name)
+				}
+			}
+			replaced = append(replaced, sources...)
+			slices.Sort(replaced)
+			names = slices.Compact(replaced)
+		}
+		expr = call.Args[0]
+	}
+}
+
+// stringArg returns the value of a string literal argument.
+func stringArg(arg parser.Expr) string {
+	switch n := arg.(type) {
+	case *parser.StringLiteral:
+		return n.Val
+	case *parser.ParenExpr:
+		return stringArg(n.Expr)
+	case *parser.StepInvariantExpr:
+		return stringArg(n.Expr)
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package estimator
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+	"strconv"
+)
+
+// LintWarning is a cardinality problem found in a selector of a query.
+type LintWarning struct {
+	Selector string                 `json:"selector"`
+	Position posrange.PositionRange `json:"position"`
+	Series   int64                  `json:"series"`
+	Message  string                 `json:"message"`
+}
+
+// Lint parses query and warns about selectors without a metric name, and
+// about selectors estimated to match more than maxSeries series. A maxSeries
+// of zero disables the latter.
+func (e *Estimator) Lint(query string, maxSeries int64) ([]LintWarning, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []LintWarning
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		series := e.index.GetCardinality(vs.LabelMatchers...)
+		warning := LintWarning{
+			Selector: vs.String(),
+			Position: vs.PositionRange(),
+			Series:   series,
+		}
+		switch {
+		case !hasMetricName(vs.LabelMatchers):
+			warning.Message = fmt.Sprintf("selector %s matches ~%s series; consider adding a metric name", warning.Selector, humanizeCount(series))
+		case maxSeries > 0 && series > maxSeries:
+			warning.Message = fmt.Sprintf("selector %s matches ~%s series, more than the limit of %s", warning.Selector, humanizeCount(series), humanizeCount(maxSeries))
+		default:
+			return nil
+		}
+		warnings = append(warnings, warning)
+		return nil
+	})
+	return warnings, nil
+}
+
+// hasMetricName reports whether the matchers restrict the metric name.
+func hasMetricName(matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && !m.Matches("") {
+			return true
+		}
+	}
+	return false
+}
+
+// humanizeCount formats n with a metric suffix, e.g. 1.2M.
+func humanizeCount(n int64) string {
+	switch {
+	case n >= 1e9:
+		return strconv.FormatFloat(float64(n)/1e9, 'f', 1, 64) + "G"
+	case n >= 1e6:
+		return strconv.FormatFloat(float64(n)/1e6, 'f', 1, 64) + "M"
+	case n >= 1e3:
+		return strconv.FormatFloat(float64(n)/1e3, 'f', 1, 64) + "k"
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+}
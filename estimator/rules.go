@@ -0,0 +1,73 @@
+package estimator
+
+import (
+	"errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"sort"
+)
+
+// RuleImpact is the estimated output of a single recording rule.
+type RuleImpact struct {
+	Group  string
+	Record string
+	Expr   string
+
+	// Series is the estimated number of series the rule produces.
+	Series int64
+	// Existing is the number of series already indexed under the record name.
+	Existing int64
+	// New is the number of series the rule would add to the index.
+	New int64
+	// ExceedsLimit is set when Series is above the group's series limit,
+	// in which case Prometheus discards the rule's output.
+	ExceedsLimit bool
+
+	Err error
+}
+
+// AnalyzeRuleFile parses a Prometheus rules file and estimates the impact of
+// every recording rule in it. See AnalyzeRules.
+func (e *Estimator) AnalyzeRuleFile(path string) ([]RuleImpact, error) {
+	groups, errs := rulefmt.ParseFile(path)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return e.AnalyzeRules(groups), nil
+}
+
+// AnalyzeRules estimates the output cardinality of every recording rule and
+// returns the results ordered by the number of new series, largest first.
+// Alerting rules are skipped. Rules whose expression can't be estimated are
+// reported with Err set and sorted last.
+func (e *Estimator) AnalyzeRules(groups *rulefmt.RuleGroups) []RuleImpact {
+	var impacts []RuleImpact
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			if rule.Record.Value == "" {
+				continue
+			}
+
+			impact := RuleImpact{
+				Group:  group.Name,
+				Record: rule.Record.Value,
+				Expr:   rule.Expr.Value,
+			}
+			impact.Series, impact.Err = e.EstimateQuery(impact.Expr)
+			if impact.Err == nil {
+				impact.Existing = e.index.GetCardinality(labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, impact.Record))
+				impact.New = max(impact.Series-impact.Existing, 0)
+				impact.ExceedsLimit = group.Limit > 0 && impact.Series > int64(group.Limit)
+			}
+			impacts = append(impacts, impact)
+		}
+	}
+
+	sort.SliceStable(impacts, func(i, j int) bool {
+		if (impacts[i].Err == nil) != (impacts[j].Err == nil) {
+			return impacts[i].Err == nil
+		}
+		return impacts[i].New > impacts[j].New
+	})
+	return impacts
+}
@@ -0,0 +1,52 @@
+package estimator
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"harry671003/hello/cardinality"
+	"time"
+)
+
+const (
+	// DefaultScrapeInterval is the sample interval assumed without a
+	// SampleDensity, the default scrape interval of Prometheus.
+	DefaultScrapeInterval = time.Minute
+
+	// bytesPerSample is the size of a decoded float sample: an int64
+	// timestamp and a float64 value.
+	bytesPerSample = 16
+)
+
+// SampleEstimate is the estimated size of the data a selector reads.
+type SampleEstimate struct {
+	Series  int64 `json:"series"`
+	Samples int64 `json:"samples"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// SetSampleDensity sets the tracker used for the interval between samples
+// in EstimateSamples.
+func (e *Estimator) SetSampleDensity(d *cardinality.SampleDensity) {
+	e.density = d
+}
+
+// EstimateSamples estimates the samples and bytes read by a selector over
+// [mint, maxt], in milliseconds, for cost based query limiting. stepHint is
+// the step of a range query, or zero to read the raw samples. An instant
+// vector selector is evaluated once per step, so steps longer than the
+// sample interval bound the samples per series.
+func (e *Estimator) EstimateSamples(matchers []*labels.Matcher, mint, maxt, stepHint int64) SampleEstimate {
+	series := e.index.GetCardinality(matchers...)
+
+	interval := DefaultScrapeInterval.Milliseconds()
+	if e.density != nil {
+		interval = e.density.Interval(matchers...).Milliseconds()
+	}
+	interval = max(interval, stepHint, 1)
+
+	samples := series * ((max(maxt, mint)-mint)/interval + 1)
+	return SampleEstimate{
+		Series:  series,
+		Samples: samples,
+		Bytes:   samples * bytesPerSample,
+	}
+}